@@ -0,0 +1,205 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// accessLogConfig controls the access log, which logs API requests
+// with their credentials redacted.
+type accessLogConfig struct {
+	// Sample logs one in this many requests which succeed quickly.
+	// Failed and slow requests are always logged.  The default is 1,
+	// logging every request.
+	Sample int `yaml:"sample,omitempty"`
+
+	// SlowRequest is how long a request may take before it is always
+	// logged.  The default is 1s.
+	SlowRequest time.Duration `yaml:"slowRequest,omitempty"`
+
+	// Bodies logs up to MaxBody bytes of each JSON request body, with
+	// secrets and authenticators redacted.
+	Bodies  bool `yaml:"bodies,omitempty"`
+	MaxBody int  `yaml:"maxBody,omitempty"`
+}
+
+func (c *accessLogConfig) applyDefaults() error {
+	if c.Sample < 0 {
+		return fmt.Errorf("accessLog.sample must not be negative")
+	}
+	if c.Sample == 0 {
+		c.Sample = 1
+	}
+	if c.SlowRequest == 0 {
+		c.SlowRequest = time.Second
+	}
+	if c.MaxBody == 0 {
+		c.MaxBody = 4096
+	}
+	return nil
+}
+
+// redacted replaces anything we must not log.
+const redacted = "[REDACTED]"
+
+// sensitiveNames are substrings of the names of query parameters and
+// JSON fields which are redacted.
+var sensitiveNames = []string{"secret", "authenticator", "token", "password", "key"}
+
+func sensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range sensitiveNames {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// accessLog logs requests to next, sampling those which succeed
+// quickly.
+type accessLog struct {
+	config  *accessLogConfig
+	logger  *slog.Logger
+	counter atomic.Uint64
+}
+
+func newAccessLog(config *accessLogConfig) *accessLog {
+	return &accessLog{config: config, logger: slog.With("log", "access")}
+}
+
+func (a *accessLog) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body *limitedBuffer
+		if a.config.Bodies && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			body = &limitedBuffer{max: a.config.MaxBody}
+			r.Body = readCloser{io.TeeReader(r.Body, body), r.Body}
+		}
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		d := time.Since(start)
+
+		n := a.counter.Add(1)
+		if rec.code < 400 && d < a.config.SlowRequest && n%uint64(a.config.Sample) != 0 {
+			return
+		}
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.code,
+			"bytes", rec.size,
+			"duration", d,
+			"remote", r.RemoteAddr,
+		}
+		if r.URL.RawQuery != "" {
+			attrs = append(attrs, "query", redactQuery(r.URL.Query()))
+		}
+		if userID, _, ok := r.BasicAuth(); ok {
+			attrs = append(attrs, "user", userID)
+		} else if r.Header.Get("Authorization") != "" {
+			attrs = append(attrs, "user", redacted)
+		}
+		if ua := r.UserAgent(); ua != "" {
+			attrs = append(attrs, "userAgent", ua)
+		}
+		if body != nil && body.Len() > 0 {
+			attrs = append(attrs, "body", redactBody(body))
+		}
+		level := slog.LevelInfo
+		if rec.code >= 500 {
+			level = slog.LevelWarn
+		}
+		a.logger.Log(r.Context(), level, "request", attrs...)
+	})
+}
+
+func redactQuery(q url.Values) string {
+	for name := range q {
+		if sensitive(name) {
+			q[name] = []string{redacted}
+		}
+	}
+	return q.Encode()
+}
+
+// redactBody returns a JSON body with its sensitive fields redacted.
+// A body we cannot parse, as when it was truncated, is not logged at
+// all, as we cannot tell what is in it.
+func redactBody(b *limitedBuffer) string {
+	if b.truncated {
+		return fmt.Sprintf("[%d bytes or more, not logged]", b.max)
+	}
+	var v any
+	if err := json.Unmarshal(b.Bytes(), &v); err != nil {
+		return "[not JSON, not logged]"
+	}
+	out, err := json.Marshal(redactJSON(v))
+	if err != nil {
+		return "[not logged]"
+	}
+	return string(out)
+}
+
+func redactJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, field := range v {
+			if sensitive(k) {
+				v[k] = redacted
+			} else {
+				v[k] = redactJSON(field)
+			}
+		}
+	case []any:
+		for i := range v {
+			v[i] = redactJSON(v[i])
+		}
+	}
+	return v
+}
+
+// limitedBuffer keeps the first max bytes written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); len(p) > room {
+		b.Buffer.Write(p[:room])
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// adminConfig serves the admin API on its own listener, apart from the
+// work API, to clients presenting a certificate signed by our client CA.
+type adminConfig struct {
+	// Listen is the address of the admin listener, such as
+	// "10.0.0.1:8443".
+	Listen string `yaml:"listen,omitempty"`
+
+	// CertFile and KeyFile are the listener's certificate and key.
+	CertFile string `yaml:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile,omitempty"`
+
+	// ClientCAFile holds the CA certificates which must have signed
+	// the certificates of admin clients.
+	ClientCAFile string `yaml:"clientCAFile,omitempty"`
+
+	// AllowedNetworks, if set, are the addresses and CIDR prefixes
+	// admin requests may come from.
+	AllowedNetworks []string `yaml:"allowedNetworks,omitempty"`
+
+	allowed []netip.Prefix
+}
+
+func (c *adminConfig) applyDefaults() error {
+	if c.Listen == "" {
+		return fmt.Errorf("admin.listen is required")
+	}
+	if c.CertFile == "" || c.KeyFile == "" || c.ClientCAFile == "" {
+		return fmt.Errorf("admin requires certFile, keyFile, and clientCAFile")
+	}
+	c.allowed = nil
+	for _, n := range c.AllowedNetworks {
+		prefix, err := netip.ParsePrefix(n)
+		if err != nil {
+			addr, err2 := netip.ParseAddr(n)
+			if err2 != nil {
+				return fmt.Errorf("admin.allowedNetworks: %v", err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		c.allowed = append(c.allowed, prefix.Masked())
+	}
+	return nil
+}
+
+// allows returns true if requests may come from the remote address.
+func (c *adminConfig) allows(remote string) bool {
+	if len(c.allowed) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(remote)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range c.allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsConfig returns the listener's TLS configuration, which requires
+// and verifies client certificates.
+func (c *adminConfig) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading admin certificate: %v", err)
+	}
+	b, err := os.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", c.ClientCAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// adminRoutes registers the admin API on mux.
+func (s *server) adminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/admin/gc", s.admin(s.handleGC))
+	mux.HandleFunc("/api/v1/admin/conflicts", s.admin(s.handleConflicts))
+	mux.HandleFunc("/api/v1/admin/events", s.admin(s.handleEvents))
+	mux.HandleFunc("/api/v1/admin/store", s.admin(s.handleStoreMetrics))
+	mux.HandleFunc("/api/v1/admin/lockouts", s.admin(s.handleLockouts))
+	mux.HandleFunc("/api/v1/admin/trust", s.admin(s.handleTrust))
+	mux.HandleFunc("/api/v1/admin/quarantine", s.admin(s.handleQuarantine))
+	mux.HandleFunc("/api/v1/admin/enrollments", s.admin(s.handleEnrollments))
+}
+
+// serveAdmin serves the admin API on the admin listener.
+func (s *server) serveAdmin(ctx context.Context) error {
+	config := s.config.Admin
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	s.adminRoutes(mux)
+	srv := &http.Server{
+		Addr:              config.Listen,
+		Handler:           serverTime(decompress(s.metrics.instrument(mux))),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	slog.Info("serving admin API", "addr", config.Listen, "allowedNetworks", strings.Join(config.AllowedNetworks, ","))
+	if err := srv.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// clientSubject returns the subject of the client's certificate, if any.
+func clientSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.String()
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"time"
+
+	"github.com/skandragon/collatz/internal/archive"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// archiveConfig moves old accepted reports out of the database and
+// into object storage.  Receipts, records, and the completed ranges
+// remain in the database.
+type archiveConfig struct {
+	// Directory, if set, receives the archives instead of a bucket.
+	Directory string `yaml:"directory,omitempty"`
+
+	// Endpoint defaults to AWS S3 in Region.
+	Endpoint string `yaml:"endpoint,omitempty"`
+	Region   string `yaml:"region,omitempty"`
+	Bucket   string `yaml:"bucket,omitempty"`
+	Prefix   string `yaml:"prefix,omitempty"`
+
+	// AccessKeyID and SecretAccessKey default to the usual AWS
+	// environment variables.
+	AccessKeyID     string `yaml:"accessKeyID,omitempty"`
+	SecretAccessKey string `yaml:"secretAccessKey,omitempty"`
+
+	// Interval is how often we look for reports to archive.
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// MinAge is how long reports stay in the database before they
+	// are archived.
+	MinAge time.Duration `yaml:"minAge,omitempty"`
+
+	// BatchSize is the most reports written to one archive object.
+	BatchSize int `yaml:"batchSize,omitempty"`
+}
+
+func (c *archiveConfig) applyDefaults() error {
+	if c.Directory == "" && c.Bucket == "" {
+		return fmt.Errorf("archive needs a directory or a bucket")
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = "https://s3." + c.Region + ".amazonaws.com"
+	}
+	if c.AccessKeyID == "" {
+		c.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if c.SecretAccessKey == "" {
+		c.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if c.Interval == 0 {
+		c.Interval = time.Hour
+	}
+	if c.MinAge == 0 {
+		c.MinAge = 7 * 24 * time.Hour
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = 10000
+	}
+	return nil
+}
+
+func (c *archiveConfig) destination() archive.Destination {
+	if c.Directory != "" {
+		return archive.Dir(c.Directory)
+	}
+	return &archive.S3{
+		Endpoint:        c.Endpoint,
+		Region:          c.Region,
+		Bucket:          c.Bucket,
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
+	}
+}
+
+// archiver periodically uploads reports older than MinAge, then
+// deletes them from the database.
+type archiver struct {
+	config *archiveConfig
+	store  store.Store
+	dest   archive.Destination
+}
+
+func newArchiver(config *archiveConfig, st store.Store) *archiver {
+	return &archiver{config: config, store: st, dest: config.destination()}
+}
+
+func (a *archiver) run(ctx context.Context) {
+	t := time.NewTicker(a.config.Interval)
+	defer t.Stop()
+	for {
+		if err := a.archiveAll(ctx); err != nil {
+			slog.Error("archiving reports failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// archiveAll archives batches until no old reports remain.
+func (a *archiver) archiveAll(ctx context.Context) error {
+	cutoff := time.Now().UTC().Add(-a.config.MinAge)
+	for ctx.Err() == nil {
+		n, err := a.archiveBatch(ctx, cutoff)
+		if err != nil || n < a.config.BatchSize {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// archiveBatch uploads one batch, returning its size.  The object key
+// depends only on the batch, so if we fail between uploading and
+// deleting, the next attempt overwrites the same object.
+func (a *archiver) archiveBatch(ctx context.Context, cutoff time.Time) (int, error) {
+	reports, err := a.store.ReportsBefore(ctx, cutoff, a.config.BatchSize)
+	if err != nil || len(reports) == 0 {
+		return 0, err
+	}
+	body, err := archive.EncodeJSONL(reports)
+	if err != nil {
+		return 0, err
+	}
+	first := reports[0]
+	key := path.Join(a.config.Prefix, "reports", first.ReceivedOn.Format("2006/01/02"),
+		fmt.Sprintf("%d-%s.jsonl.gz", first.ReceivedOn.UnixNano(), first.PacketID))
+	if err := a.dest.Put(ctx, key, body); err != nil {
+		return 0, err
+	}
+	ids := make([]string, len(reports))
+	for i, r := range reports {
+		ids[i] = r.PacketID
+	}
+	if err := a.store.DeleteReports(ctx, ids); err != nil {
+		return 0, fmt.Errorf("deleting archived reports: %v", err)
+	}
+	slog.Info("archived reports", "count", len(reports), "key", key, "bytes", len(body))
+	return len(reports), nil
+}
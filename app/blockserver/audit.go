@@ -0,0 +1,240 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"runtime"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// auditConfig has us recompute a sample of the work we accept.  A
+// random sub-range of each sampled packet is tested by our own pool of
+// workers, after the report is answered, and the report checked
+// against it.
+type auditConfig struct {
+	// SampleRate is the fraction of accepted packets audited.  The
+	// default is 0.05.
+	SampleRate float64 `yaml:"sampleRate,omitempty"`
+
+	// Candidates is the number of candidates tested from each packet
+	// audited.  The default is 65536.
+	Candidates int64 `yaml:"candidates,omitempty"`
+
+	// Workers is the number of audits run at once.  The default is
+	// half the CPUs, leaving the rest to the API.
+	Workers int `yaml:"workers,omitempty"`
+
+	// QueueSize is the number of audits which may wait for a worker.
+	// Audits sampled while the queue is full are dropped.  The
+	// default is 64.
+	QueueSize int `yaml:"queueSize,omitempty"`
+}
+
+func (c *auditConfig) applyDefaults() error {
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("audit.sampleRate must be between 0 and 1")
+	}
+	if c.SampleRate == 0 {
+		c.SampleRate = 0.05
+	}
+	if c.Candidates < 0 {
+		return fmt.Errorf("audit.candidates cannot be negative")
+	}
+	if c.Candidates == 0 {
+		c.Candidates = 1 << 16
+	}
+	if c.Workers < 0 {
+		return fmt.Errorf("audit.workers cannot be negative")
+	}
+	if c.Workers == 0 {
+		c.Workers = max(1, runtime.NumCPU()/2)
+	}
+	if c.QueueSize < 0 {
+		return fmt.Errorf("audit.queueSize cannot be negative")
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = 64
+	}
+	return nil
+}
+
+// audit is an accepted report waiting to be checked.
+type audit struct {
+	packet internal.WorkPacket
+	userID string
+	report internal.WorkProgressReport
+
+	receivedOn time.Time
+}
+
+// sampled returns true for the fraction of packets to be audited.
+// Clients cannot predict which, so must do all their work.
+func (c *auditConfig) sampled() bool {
+	const scale = 1 << 30
+	k, err := rand.Int(rand.Reader, big.NewInt(scale))
+	if err != nil {
+		panic(err)
+	}
+	return float64(k.Int64()) < c.SampleRate*scale
+}
+
+// queueAudit samples an accepted report for audit.  It never waits for
+// a worker: if the queue is full, the audit is dropped.
+func (s *server) queueAudit(userID string, p *store.Packet, report internal.WorkProgressReport) {
+	if s.audits == nil || !s.config.Audit.sampled() {
+		return
+	}
+	select {
+	case s.audits <- audit{packet: p.WorkPacket, userID: userID, report: report, receivedOn: time.Now().UTC()}:
+		s.metrics.auditsQueued.Add(1)
+	default:
+		slog.Warn("audit queue full, dropping audit", "packet", p.ID, "user", userID)
+		s.metrics.audited("dropped")
+	}
+}
+
+// runAudits runs the audit workers until the context is cancelled.
+func (s *server) runAudits(ctx context.Context) {
+	for i := 0; i < s.config.Audit.Workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case a := <-s.audits:
+					s.metrics.auditsQueued.Add(-1)
+					s.runAudit(ctx, a)
+				}
+			}
+		}()
+	}
+}
+
+// runAudit checks one report, flagging it if it is wrong.
+func (s *server) runAudit(ctx context.Context, a audit) {
+	start := time.Now()
+	low, high := s.config.Audit.subRange(a.packet)
+	failure := checkAudit(a.packet, a.report, low, high)
+	if failure == nil {
+		slog.Debug("audit passed", "packet", a.packet.ID, "user", a.userID,
+			"low", low, "high", high, "elapsed", time.Since(start))
+		s.metrics.audited("passed")
+		return
+	}
+	slog.Warn("audit failed", "packet", a.packet.ID, "user", a.userID,
+		"node", a.report.NodeInfo.NodeID, "low", low, "high", high, "err", failure)
+	s.metrics.audited("failed")
+	err := s.store.AddReportConflict(ctx, store.ReportConflict{
+		StoredReport: store.StoredReport{
+			PacketID:   a.packet.ID,
+			UserID:     a.userID,
+			NodeID:     a.report.NodeInfo.NodeID,
+			ReceivedOn: a.receivedOn,
+			Report:     a.report,
+		},
+		Reason: store.ConflictAudit,
+	})
+	if err != nil {
+		slog.Error("cannot keep report failing audit", "packet", a.packet.ID, "err", err)
+	}
+	s.event(ctx, internal.Event{
+		Kind:     internal.EventAuditFailure,
+		UserID:   a.userID,
+		NodeID:   a.report.NodeInfo.NodeID,
+		PacketID: a.packet.ID,
+		Message:  "audit failed: " + failure.Error(),
+	})
+	s.addTrust(ctx, store.Trust{UserID: a.userID, AuditFailures: 1})
+}
+
+// subRange chooses the candidates of a packet to audit, from low to
+// high inclusive, at random.
+func (c *auditConfig) subRange(p internal.WorkPacket) (low, high *big.Int) {
+	// candidates are the odd values from the start
+	candidates := new(big.Int).Sub(p.EndingValue, p.StartingValue)
+	candidates.Rsh(candidates, 1)
+	candidates.Add(candidates, big.NewInt(1))
+	count := big.NewInt(c.Candidates)
+	if count.Cmp(candidates) > 0 {
+		count.Set(candidates)
+	}
+	offset, err := rand.Int(rand.Reader, candidates.Sub(candidates, count).Add(candidates, big.NewInt(1)))
+	if err != nil {
+		panic(err)
+	}
+	low = offset.Lsh(offset, 1).Add(offset, p.StartingValue)
+	high = new(big.Int).Lsh(count.Sub(count, big.NewInt(1)), 1)
+	return low, high.Add(high, low)
+}
+
+// checkAudit tests the candidates from low to high, returning an error
+// if the report could not have come from testing them.  Candidates the
+// packet's filter excludes, and any the client skipped, are not
+// counted by the report, so are not tested.
+func checkAudit(p internal.WorkPacket, report internal.WorkProgressReport, low, high *big.Int) error {
+	maxIterations := report.Evidence.MaxIterations
+	histogram := map[uint64]uint64{}
+	two := big.NewInt(2)
+	for v := new(big.Int).Set(low); v.Cmp(high) <= 0; v.Add(v, two) {
+		if internal.Excluded(p.Filter, v) || contains(report.Skipped, v) {
+			continue
+		}
+		// Asking for one more step than the maximum reported shows
+		// whether any candidate took more.
+		answer := internal.Challenge{Value: v, Steps: maxIterations + 1}.Answer()
+		if answer.Steps > maxIterations {
+			return fmt.Errorf("candidate %s took more than the %d iterations reported", v, maxIterations)
+		}
+		if answer.Result.Cmp(v) == 0 && !contains(report.Interesting, v) {
+			return fmt.Errorf("candidate %s loops, and was not reported", v)
+		}
+		if answer.Steps == maxIterations && report.MaxIterationsValue != nil && v.Cmp(report.MaxIterationsValue) < 0 {
+			return fmt.Errorf("candidate %s took %d iterations before %s did", v, maxIterations, report.MaxIterationsValue)
+		}
+		if report.MaxIterationsValue != nil && v.Cmp(report.MaxIterationsValue) == 0 && answer.Steps != maxIterations {
+			return fmt.Errorf("candidate %s took %d iterations, not the %d reported", v, answer.Steps, maxIterations)
+		}
+		histogram[answer.Steps]++
+	}
+	if report.Histogram == nil {
+		return nil
+	}
+	for steps, count := range histogram {
+		if steps >= uint64(len(report.Histogram)) || report.Histogram[steps] < count {
+			return fmt.Errorf("%d candidates took %d iterations, more than the histogram reports", count, steps)
+		}
+	}
+	return nil
+}
+
+// contains returns true if v is in values.
+func contains(values []*big.Int, v *big.Int) bool {
+	for _, x := range values {
+		if x != nil && x.Cmp(v) == 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,231 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/skandragon/collatz/internal/store"
+	"github.com/skandragon/collatz/internal/store/postgres"
+	"github.com/skandragon/collatz/internal/store/sqlite"
+)
+
+// backupConfig schedules database backups.  The frontier and completed
+// ranges represent a great deal of donated CPU time, so we keep
+// several generations.
+type backupConfig struct {
+	// Directory holds the backups.
+	Directory string `yaml:"directory,omitempty"`
+
+	// Interval is how often a backup is taken.
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// Keep is the number of most recent backups always kept.
+	Keep int `yaml:"keep,omitempty"`
+
+	// MaxAge, if set, removes backups older than this, beyond the
+	// Keep most recent.
+	MaxAge time.Duration `yaml:"maxAge,omitempty"`
+}
+
+func (c *backupConfig) applyDefaults() error {
+	if c.Directory == "" {
+		return errors.New("backup needs a directory")
+	}
+	if c.Interval == 0 {
+		c.Interval = 24 * time.Hour
+	}
+	if c.Keep == 0 {
+		c.Keep = 7
+	}
+	return nil
+}
+
+const (
+	backupPrefix     = "blockserver-"
+	backupTimeFormat = "20060102T150405Z"
+)
+
+// backupFile describes one backup in the backup directory.
+type backupFile struct {
+	Path    string
+	TakenOn time.Time
+}
+
+func backupExtension(driver string) string {
+	if driver == "postgres" {
+		return ".pgdump"
+	}
+	return ".db"
+}
+
+// listBackups returns the backups in the directory, oldest first.
+func listBackups(dir string) ([]backupFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := []backupFile{}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, backupPrefix) {
+			continue
+		}
+		stamp := strings.TrimPrefix(strings.TrimSuffix(name, filepath.Ext(name)), backupPrefix)
+		t, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		ret = append(ret, backupFile{Path: filepath.Join(dir, name), TakenOn: t})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].TakenOn.Before(ret[j].TakenOn) })
+	return ret, nil
+}
+
+// takeBackup writes a new backup, then applies the retention policy.
+func takeBackup(ctx context.Context, config *serverConfig, st store.Store) (string, error) {
+	bc := config.Backup
+	if err := os.MkdirAll(bc.Directory, 0o700); err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	name := backupPrefix + now.Format(backupTimeFormat) + backupExtension(config.DatabaseDriver)
+	filename := filepath.Join(bc.Directory, name)
+	// Write under a name listBackups ignores until the backup is complete.
+	tmp := filepath.Join(bc.Directory, "partial-"+name)
+	os.Remove(tmp)
+	if err := st.Backup(ctx, tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return "", err
+	}
+	return filename, pruneBackups(bc, now)
+}
+
+// pruneBackups removes backups beyond the Keep most recent which are
+// older than MaxAge, or all of those if MaxAge is not set.
+func pruneBackups(bc *backupConfig, now time.Time) error {
+	backups, err := listBackups(bc.Directory)
+	if err != nil {
+		return err
+	}
+	if len(backups) <= bc.Keep {
+		return nil
+	}
+	for _, b := range backups[:len(backups)-bc.Keep] {
+		if bc.MaxAge > 0 && now.Sub(b.TakenOn) < bc.MaxAge {
+			continue
+		}
+		if err := os.Remove(b.Path); err != nil {
+			return err
+		}
+		slog.Info("removed old backup", "file", b.Path)
+	}
+	return nil
+}
+
+func runBackups(ctx context.Context, config *serverConfig, st store.Store) {
+	t := time.NewTicker(config.Backup.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		filename, err := takeBackup(ctx, config, st)
+		if err != nil {
+			slog.Error("backup failed", "err", err)
+			continue
+		}
+		slog.Info("backed up", "file", filename)
+	}
+}
+
+func backupCommand(ctx context.Context, config *serverConfig, st store.Store) error {
+	if config.Backup == nil {
+		return errors.New("no backup directory is configured")
+	}
+	filename, err := takeBackup(ctx, config, st)
+	if err != nil {
+		return err
+	}
+	slog.Info("backed up", "file", filename)
+	return nil
+}
+
+// findBackup resolves the restore argument, which is either a backup
+// file, or a time in RFC 3339 format, meaning the newest backup taken
+// at or before then.  "latest" is the newest backup.
+func findBackup(config *serverConfig, arg string) (string, error) {
+	if arg == "" {
+		return "", errors.New("usage: blockserver restore <file | latest | time>")
+	}
+	at := time.Now()
+	if arg != "latest" {
+		t, err := time.Parse(time.RFC3339, arg)
+		if err != nil {
+			return arg, nil
+		}
+		at = t
+	}
+	if config.Backup == nil {
+		return "", errors.New("no backup directory is configured")
+	}
+	backups, err := listBackups(config.Backup.Directory)
+	if err != nil {
+		return "", err
+	}
+	for i := len(backups) - 1; i >= 0; i-- {
+		if !backups[i].TakenOn.After(at) {
+			return backups[i].Path, nil
+		}
+	}
+	return "", fmt.Errorf("no backup taken at or before %s", at.UTC().Format(time.RFC3339))
+}
+
+// restoreCommand replaces the database with a backup.  It runs without
+// the store open, and the server must be stopped.
+func restoreCommand(ctx context.Context, config *serverConfig, arg string) error {
+	filename, err := findBackup(config, arg)
+	if err != nil {
+		return err
+	}
+	switch config.DatabaseDriver {
+	case "sqlite":
+		err = sqlite.Restore(filename, config.Database)
+	case "postgres":
+		err = postgres.Restore(ctx, config.Database, filename)
+	default:
+		err = fmt.Errorf("cannot restore a %s database", config.DatabaseDriver)
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("restored", "file", filename)
+	return nil
+}
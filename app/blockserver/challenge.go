@@ -0,0 +1,100 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/zeebo/blake3"
+)
+
+// challengeConfig enables spot checks: candidates in each packet whose
+// trajectories the client must report part of.
+type challengeConfig struct {
+	// Count is the number of challenges in each packet.  The default
+	// is 2.
+	Count int `yaml:"count,omitempty"`
+
+	// Steps is how far along each trajectory the client must report.
+	// The default is 1000.
+	Steps uint64 `yaml:"steps,omitempty"`
+
+	// Required rejects reports which do not answer every challenge.
+	// Otherwise, as older clients do not answer them, a missing answer
+	// is only logged, while a wrong one is always rejected.
+	Required bool `yaml:"required,omitempty"`
+}
+
+func (c *challengeConfig) applyDefaults() error {
+	if c.Count < 0 {
+		return fmt.Errorf("challenges.count cannot be negative")
+	}
+	if c.Count == 0 {
+		c.Count = 2
+	}
+	if c.Steps == 0 {
+		c.Steps = 1000
+	}
+	return nil
+}
+
+// challengesFor returns the challenges for a packet.  They are chosen
+// from the packet's nonce, so they need not be stored, and the same
+// ones are checked when the report arrives.
+func (c *challengeConfig) challengesFor(p internal.WorkPacket) []internal.Challenge {
+	// candidates are the odd values from the start
+	candidates := new(big.Int).Sub(p.EndingValue, p.StartingValue)
+	candidates.Rsh(candidates, 1)
+	candidates.Add(candidates, big.NewInt(1))
+	ret := []internal.Challenge{}
+	for i := 0; i < c.Count; i++ {
+		sum := blake3.Sum256([]byte(fmt.Sprintf("challenge:%s:%d", p.Nonce, i)))
+		k := new(big.Int).SetBytes(sum[:])
+		k.Mod(k, candidates)
+		k.Lsh(k, 1)
+		ret = append(ret, internal.Challenge{Value: k.Add(k, p.StartingValue), Steps: c.Steps})
+	}
+	return ret
+}
+
+// checkChallenges returns the number of the packet's challenges a
+// report leaves unanswered, and an error if it answers any wrongly,
+// or, if they are required, leaves any unanswered.
+func (c *challengeConfig) checkChallenges(p internal.WorkPacket, report internal.WorkProgressReport) (missing int, err error) {
+	for _, ch := range c.challengesFor(p) {
+		var answer *internal.ChallengeResponse
+		for i := range report.ChallengeResponses {
+			if v := report.ChallengeResponses[i].Value; v != nil && v.Cmp(ch.Value) == 0 {
+				answer = &report.ChallengeResponses[i]
+				break
+			}
+		}
+		if answer == nil {
+			missing++
+			continue
+		}
+		if !ch.Answer().Equal(*answer) {
+			return missing, fmt.Errorf("challenge %s answered wrongly", ch.Value)
+		}
+	}
+	if missing > 0 && c.Required {
+		return missing, fmt.Errorf("%d challenges not answered", missing)
+	}
+	return missing, nil
+}
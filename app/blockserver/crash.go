@@ -0,0 +1,43 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// handleCrash logs a client's report of a panic in one of its workers.
+func (s *server) handleCrash(w http.ResponseWriter, r *http.Request, user *store.User) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var report internal.CrashReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slog.Error("client worker panicked", "user", user.UserID, "node", report.NodeID,
+		"worker", report.WorkerID, "packet", report.PacketID, "value", report.Value,
+		"engine", report.Engine, "panic", report.Panic, "stack", report.Stack)
+	writeJSON(w, internal.CrashReportResponse{Accepted: true})
+}
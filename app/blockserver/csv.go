@@ -0,0 +1,185 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// csvTables are the tables available as CSV, by name.
+var csvTables = map[string]func(ctx context.Context, st store.Store, w *csv.Writer) error{
+	"completed": writeCompletedCSV,
+	"users":     writeUsersCSV,
+	"records":   writeRecordsCSV,
+}
+
+func csvTableNames() string {
+	return "completed, users, or records"
+}
+
+// writeCompletedCSV writes the completed ranges.  Both ends are
+// inclusive, as in work packets.
+func writeCompletedCSV(ctx context.Context, st store.Store, w *csv.Writer) error {
+	completed, err := st.CompletedRanges(ctx)
+	if err != nil {
+		return err
+	}
+	if err := w.Write([]string{"start", "end", "integers"}); err != nil {
+		return err
+	}
+	for _, iv := range completed.Intervals() {
+		size := iv.Size()
+		last := new(big.Int).Sub(iv.End, big.NewInt(1))
+		if err := w.Write([]string{iv.Start.String(), last.String(), size.String()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeUsersCSV writes each user's totals.  Secrets are not included.
+func writeUsersCSV(ctx context.Context, st store.Store, w *csv.Writer) error {
+	totals, err := st.UserTotals(ctx)
+	if err != nil {
+		return err
+	}
+	if err := w.Write([]string{"user", "integers", "iterations", "packets", "first", "last"}); err != nil {
+		return err
+	}
+	for _, t := range totals {
+		err := w.Write([]string{
+			t.UserID,
+			strconv.FormatInt(t.Integers, 10),
+			strconv.FormatInt(t.Iterations, 10),
+			strconv.FormatInt(t.Packets, 10),
+			t.First.Format(time.RFC3339),
+			t.Last.Format(time.RFC3339),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeRecordsCSV(ctx context.Context, st store.Store, w *csv.Writer) error {
+	if err := w.Write([]string{"kind", "value", "iterations", "packet", "user", "found"}); err != nil {
+		return err
+	}
+	for _, kind := range store.RecordKinds {
+		records, err := st.Records(ctx, kind)
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			value := ""
+			if r.Value != nil {
+				value = r.Value.String()
+			}
+			err := w.Write([]string{
+				r.Kind,
+				value,
+				strconv.FormatUint(r.Iterations, 10),
+				r.PacketID,
+				r.UserID,
+				r.FoundOn.Format(time.RFC3339),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeCSV(ctx context.Context, st store.Store, table string, out io.Writer) error {
+	write, found := csvTables[table]
+	if !found {
+		return fmt.Errorf("unknown table %q; use %s", table, csvTableNames())
+	}
+	w := csv.NewWriter(out)
+	if err := write(ctx, st, w); err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// handleExport serves /api/v1/export/<table>.csv, and the block
+// evidence as /api/v1/export/evidence.parquet.
+func (s *server) handleExport(w http.ResponseWriter, r *http.Request, user *store.User) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/export/")
+	if name == "evidence.parquet" {
+		w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		if err := writeParquet(r.Context(), s.store, w); err != nil {
+			internalError(w, err)
+		}
+		return
+	}
+	table := strings.TrimSuffix(name, ".csv")
+	if _, found := csvTables[table]; !found || table == name {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if err := writeCSV(r.Context(), s.store, table, w); err != nil {
+		internalError(w, err)
+	}
+}
+
+// csvCommand writes a table as CSV to filename, or stdout if it is
+// empty or "-".
+func csvCommand(ctx context.Context, config *serverConfig, st store.Store, table, filename string) error {
+	if table == "" {
+		return fmt.Errorf("usage: blockserver csv <table> [file], where table is %s", csvTableNames())
+	}
+	if err := prepareStore(ctx, config, st); err != nil {
+		return err
+	}
+	out := os.Stdout
+	if filename != "" && filename != "-" {
+		var err error
+		if out, err = os.Create(filename); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	if err := writeCSV(ctx, st, table, out); err != nil {
+		return err
+	}
+	if out != os.Stdout {
+		return out.Close()
+	}
+	return nil
+}
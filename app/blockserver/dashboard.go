@@ -0,0 +1,295 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/skandragon/collatz/internal/prom"
+)
+
+// A Grafana dashboard, with only the fields we set.
+type dashboard struct {
+	UID           string           `json:"uid"`
+	Title         string           `json:"title"`
+	Tags          []string         `json:"tags"`
+	SchemaVersion int              `json:"schemaVersion"`
+	Refresh       string           `json:"refresh"`
+	Time          dashboardTime    `json:"time"`
+	Templating    dashboardVars    `json:"templating"`
+	Panels        []dashboardPanel `json:"panels"`
+}
+
+type dashboardTime struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type dashboardVars struct {
+	List []dashboardVar `json:"list"`
+}
+
+type dashboardVar struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	Type  string `json:"type"`
+	Query string `json:"query"`
+}
+
+type dashboardPanel struct {
+	ID          int               `json:"id"`
+	Type        string            `json:"type"`
+	Title       string            `json:"title"`
+	GridPos     gridPos           `json:"gridPos"`
+	Datasource  *datasourceRef    `json:"datasource,omitempty"`
+	Targets     []dashboardTarget `json:"targets,omitempty"`
+	FieldConfig *dashboardFields  `json:"fieldConfig,omitempty"`
+	Collapsed   *bool             `json:"collapsed,omitempty"`
+	Panels      []dashboardPanel  `json:"panels,omitempty"`
+	Options     map[string]any    `json:"options,omitempty"`
+}
+
+type gridPos struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+type datasourceRef struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type dashboardTarget struct {
+	RefID        string         `json:"refId"`
+	Expr         string         `json:"expr"`
+	LegendFormat string         `json:"legendFormat,omitempty"`
+	Datasource   *datasourceRef `json:"datasource"`
+}
+
+type dashboardFields struct {
+	Defaults fieldDefaults `json:"defaults"`
+}
+
+type fieldDefaults struct {
+	Unit string `json:"unit,omitempty"`
+}
+
+// A graph to add to the dashboard: a query per series, by legend.
+type graph struct {
+	title string
+	unit  string
+	exprs []string
+	// legends are Grafana legend formats, one per expression.
+	legends []string
+}
+
+// dashboardRows are the dashboard's sections, each with its graphs.
+var dashboardRows = []struct {
+	title  string
+	graphs []graph
+}{
+	{"Server", []graph{
+		{
+			title:   "Integers checked per second, by user",
+			unit:    "short",
+			exprs:   []string{fmt.Sprintf("sum by (user) (rate(%s[5m]))", prom.ServerUserIntegers)},
+			legends: []string{"{{user}}"},
+		},
+		{
+			title:   "Packets accepted per minute, by user",
+			unit:    "short",
+			exprs:   []string{fmt.Sprintf("sum by (user) (rate(%s[5m])) * 60", prom.ServerUserPackets)},
+			legends: []string{"{{user}}"},
+		},
+		{
+			title: "Packets outstanding and reports waiting",
+			unit:  "short",
+			exprs: []string{
+				prom.ServerPacketsOutstanding,
+				prom.ServerReportsWaiting,
+			},
+			legends: []string{"outstanding", "waiting"},
+		},
+		{
+			title:   "Frontier bit length",
+			unit:    "short",
+			exprs:   []string{prom.ServerFrontierBitLength},
+			legends: []string{"bits"},
+		},
+		{
+			title:   "Reports per second, by status and result",
+			unit:    "reqps",
+			exprs:   []string{fmt.Sprintf("sum by (status, result) (rate(%s[5m]))", prom.ServerReports)},
+			legends: []string{"{{status}} {{result}}"},
+		},
+		{
+			title: "API latency, 95th percentile, by handler",
+			unit:  "s",
+			exprs: []string{fmt.Sprintf("histogram_quantile(0.95, sum by (le, handler) (rate(%s_bucket[5m])))",
+				prom.ServerRequestDuration)},
+			legends: []string{"{{handler}}"},
+		},
+	}},
+	{"Clients", []graph{
+		{
+			title:   "Candidates tested per second, by node",
+			unit:    "short",
+			exprs:   []string{fmt.Sprintf("sum by (instance) (%s)", prom.CrunchCandidateRateSmoothed)},
+			legends: []string{"{{instance}}"},
+		},
+		{
+			title:   "Packets completed per hour, by node",
+			unit:    "short",
+			exprs:   []string{fmt.Sprintf("sum by (instance) (rate(%s[1h])) * 3600", prom.CrunchPacketsCompleted)},
+			legends: []string{"{{instance}}"},
+		},
+		{
+			title: "Estimated time to finish",
+			unit:  "s",
+			exprs: []string{
+				fmt.Sprintf("max by (instance) (%s)", prom.CrunchPacketETA),
+				prom.CrunchHeldETA,
+			},
+			legends: []string{"{{instance}} packet", "{{instance}} held"},
+		},
+		{
+			title: "Average time per packet, by phase",
+			unit:  "s",
+			exprs: []string{fmt.Sprintf("sum by (phase) (rate(%s_sum[1h])) / sum by (phase) (rate(%s_count[1h]))",
+				prom.CrunchPacketPhase, prom.CrunchPacketPhase)},
+			legends: []string{"{{phase}}"},
+		},
+		{
+			title:   "CPU temperature",
+			unit:    "celsius",
+			exprs:   []string{prom.CrunchCPUTemperature},
+			legends: []string{"{{instance}}"},
+		},
+		{
+			title:   "Workers paused by the thermal throttle",
+			unit:    "short",
+			exprs:   []string{prom.CrunchThrottledWorkers},
+			legends: []string{"{{instance}}"},
+		},
+		{
+			title:   "Heap allocations per candidate, by engine",
+			unit:    "short",
+			exprs:   []string{fmt.Sprintf("avg by (engine) (%s)", prom.CrunchEngineAllocsPerCandidate)},
+			legends: []string{"{{engine}}"},
+		},
+		{
+			title:   "Heap in use",
+			unit:    "bytes",
+			exprs:   []string{prom.CrunchHeapInUse},
+			legends: []string{"{{instance}}"},
+		},
+		{
+			title:   "Reports awaiting delivery",
+			unit:    "short",
+			exprs:   []string{prom.CrunchSpooledReports},
+			legends: []string{"{{instance}}"},
+		},
+		{
+			title: "Server latency seen by clients, 95th percentile, by handler",
+			unit:  "s",
+			exprs: []string{fmt.Sprintf("histogram_quantile(0.95, sum by (le, handler) (rate(%s_bucket[5m])))",
+				prom.CrunchRequestDuration)},
+			legends: []string{"{{handler}}"},
+		},
+	}},
+}
+
+// newDashboard returns a dashboard graphing the metrics exposed by
+// the server and by crunch, from a Prometheus datasource chosen when
+// it is imported.
+func newDashboard() *dashboard {
+	ds := &datasourceRef{Type: "prometheus", UID: "${datasource}"}
+	d := &dashboard{
+		UID:           "collatz",
+		Title:         "Collatz",
+		Tags:          []string{"collatz"},
+		SchemaVersion: 39,
+		Refresh:       "1m",
+		Time:          dashboardTime{From: "now-24h", To: "now"},
+		Templating: dashboardVars{List: []dashboardVar{
+			{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"},
+		}},
+	}
+	const width, height = 12, 8
+	id := 0
+	y := 0
+	collapsed := false
+	for _, row := range dashboardRows {
+		id++
+		d.Panels = append(d.Panels, dashboardPanel{
+			ID:        id,
+			Type:      "row",
+			Title:     row.title,
+			GridPos:   gridPos{X: 0, Y: y, W: 2 * width, H: 1},
+			Collapsed: &collapsed,
+		})
+		y++
+		for i, g := range row.graphs {
+			id++
+			p := dashboardPanel{
+				ID:          id,
+				Type:        "timeseries",
+				Title:       g.title,
+				GridPos:     gridPos{X: (i % 2) * width, Y: y + (i/2)*height, W: width, H: height},
+				Datasource:  ds,
+				FieldConfig: &dashboardFields{Defaults: fieldDefaults{Unit: g.unit}},
+			}
+			for j, expr := range g.exprs {
+				p.Targets = append(p.Targets, dashboardTarget{
+					RefID:        string(rune('A' + j)),
+					Expr:         expr,
+					LegendFormat: g.legends[j],
+					Datasource:   ds,
+				})
+			}
+			d.Panels = append(d.Panels, p)
+		}
+		y += (len(row.graphs) + 1) / 2 * height
+	}
+	return d
+}
+
+// dashboardCommand implements "blockserver dashboard export [file]",
+// which writes the dashboard as JSON for Grafana to import or
+// provision, to the file or to stdout.
+func dashboardCommand(args []string) error {
+	if len(args) == 0 || args[0] != "export" || len(args) > 2 {
+		return fmt.Errorf("usage: blockserver dashboard export [file]")
+	}
+	var w io.Writer = os.Stdout
+	if len(args) == 2 {
+		f, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(newDashboard())
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+
+	"github.com/skandragon/collatz/internal/auth"
+	"github.com/skandragon/collatz/internal/keyring"
+	"github.com/skandragon/collatz/internal/store"
+	"github.com/skandragon/collatz/internal/store/encrypted"
+)
+
+// encryptionConfig enables sealing user secrets in the database with
+// master keys kept outside it.
+type encryptionConfig struct {
+	// Primary is the ID of the key used for new secrets.  It defaults
+	// to the first key listed.
+	Primary string `yaml:"primary,omitempty"`
+
+	// Keys lists every key which may have sealed a stored secret.
+	// To rotate, add a new key, make it primary, and run
+	// "blockserver rotate-keys"; the old key may then be removed.
+	Keys []masterKeyConfig `yaml:"keys,omitempty"`
+}
+
+// masterKeyConfig says where to find one master key, which is 32
+// random bytes encoded in base64.  Exactly one source must be set.
+type masterKeyConfig struct {
+	ID string `yaml:"id,omitempty"`
+
+	// File holds the key.
+	File string `yaml:"file,omitempty"`
+
+	// Env names an environment variable holding the key.
+	Env string `yaml:"env,omitempty"`
+
+	// Command is run to obtain the key on its standard output, such
+	// as a KMS or secrets manager client.
+	Command []string `yaml:"command,omitempty"`
+}
+
+func (c *masterKeyConfig) load(ctx context.Context) ([]byte, error) {
+	var encoded []byte
+	switch {
+	case c.File != "" && c.Env == "" && len(c.Command) == 0:
+		b, err := os.ReadFile(c.File)
+		if err != nil {
+			return nil, err
+		}
+		encoded = b
+	case c.Env != "" && c.File == "" && len(c.Command) == 0:
+		v, found := os.LookupEnv(c.Env)
+		if !found {
+			return nil, fmt.Errorf("environment variable %s is not set", c.Env)
+		}
+		encoded = []byte(v)
+	case len(c.Command) > 0 && c.File == "" && c.Env == "":
+		cmd := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...)
+		cmd.Stderr = os.Stderr
+		b, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("running %s: %v", c.Command[0], err)
+		}
+		encoded = b
+	default:
+		return nil, errors.New("exactly one of file, env, or command must be set")
+	}
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("key is not valid base64: %v", err)
+	}
+	return key, nil
+}
+
+func loadKeyring(ctx context.Context, c *encryptionConfig) (*keyring.Keyring, error) {
+	if len(c.Keys) == 0 {
+		return nil, errors.New("encryption is configured without any keys")
+	}
+	keys := keyring.New()
+	for _, kc := range c.Keys {
+		key, err := kc.load(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("loading master key %q: %v", kc.ID, err)
+		}
+		if err := keys.Add(kc.ID, key); err != nil {
+			return nil, err
+		}
+	}
+	if c.Primary != "" {
+		if err := keys.SetPrimary(c.Primary); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// rotateKeysCommand reseals every stored secret with the primary key.
+func rotateKeysCommand(ctx context.Context, config *serverConfig, st store.Store) error {
+	es, ok := st.(*encrypted.Store)
+	if !ok {
+		return errors.New("encryption is not configured")
+	}
+	if err := prepareStore(ctx, config, st); err != nil {
+		return err
+	}
+	n, err := es.Reseal(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("resealed user secrets with the primary key", "count", n)
+	return nil
+}
+
+// hashSecretsCommand replaces every stored plaintext secret with its
+// hash.  Once it is run, those users' clients must use the v3
+// authenticator.
+func hashSecretsCommand(ctx context.Context, config *serverConfig, st store.Store) error {
+	if err := prepareStore(ctx, config, st); err != nil {
+		return err
+	}
+	users, err := st.Users(ctx)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, u := range users {
+		if auth.IsHashed(u.UserSecret) {
+			continue
+		}
+		u.UserSecret = auth.HashSecret(u.Credentials())
+		if err := st.PutUser(ctx, u); err != nil {
+			return fmt.Errorf("hashing secret for %s: %v", u.UserID, err)
+		}
+		n++
+	}
+	slog.Info("hashed user secrets", "count", n, "users", len(users))
+	return nil
+}
+
+// warnPlaintextSecrets logs how many users' secrets are still stored
+// in plaintext, as they were before hashing became the default.
+func warnPlaintextSecrets(ctx context.Context, st store.Store) {
+	users, err := st.Users(ctx)
+	if err != nil {
+		slog.Warn("cannot check for plaintext secrets", "err", err)
+		return
+	}
+	n := 0
+	for _, u := range users {
+		if !auth.IsHashed(u.UserSecret) {
+			n++
+		}
+	}
+	if n > 0 {
+		slog.Warn("user secrets are stored in plaintext; run \"blockserver hash-secrets\", or set hashSecrets to false", "count", n)
+	}
+}
+
+// keygenCommand prints a new random master key.
+func keygenCommand() error {
+	key := make([]byte, keyring.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(key))
+	return nil
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/auth"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// enrollmentConfig lets a new node be set up with a short one-time
+// code, issued by the admin API, which it exchanges for its user's
+// credentials, instead of having the secret copied into its config.
+// A code issued for a user who does not exist yet creates them, with a
+// random secret, when it is used.  The server must hold the secrets of
+// existing users to hand them out, so codes cannot be issued for users
+// whose secrets are hashed.
+type enrollmentConfig struct {
+	// CodeLifetime is how long a code is valid, by default an hour.
+	CodeLifetime time.Duration `yaml:"codeLifetime,omitempty"`
+
+	// AllowPlaintext accepts codes over plain HTTP from addresses
+	// other than loopback, as when a reverse proxy terminates TLS.
+	// Otherwise codes are only accepted over TLS.
+	AllowPlaintext bool `yaml:"allowPlaintext,omitempty"`
+}
+
+func (c *enrollmentConfig) applyDefaults() error {
+	if c.CodeLifetime < 0 {
+		return fmt.Errorf("enrollment.codeLifetime cannot be negative")
+	}
+	if c.CodeLifetime == 0 {
+		c.CodeLifetime = time.Hour
+	}
+	return nil
+}
+
+// enrollmentAlphabet leaves out letters and digits easily confused
+// when a code is read aloud or retyped.
+const enrollmentAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// enrollmentCodeLength gives codes about 50 bits, plenty for codes
+// which expire, are used once, and whose guesses are locked out.
+const enrollmentCodeLength = 10
+
+// newEnrollmentCode returns a random code, grouped for reading, such
+// as "ABCDE-FGH23".
+func newEnrollmentCode() string {
+	b := make([]byte, enrollmentCodeLength)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	var sb strings.Builder
+	for i, c := range b {
+		if i > 0 && i%5 == 0 {
+			sb.WriteByte('-')
+		}
+		// 256 % 31 is small enough that the bias does not matter.
+		sb.WriteByte(enrollmentAlphabet[int(c)%len(enrollmentAlphabet)])
+	}
+	return sb.String()
+}
+
+// hashEnrollmentCode returns the hash under which a code is stored,
+// ignoring case, spaces, and dashes.
+func hashEnrollmentCode(code string) string {
+	code = strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// newUserSecret returns a random secret for a user created by
+// enrollment.
+func newUserSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// secureRequest returns true if the request came over TLS, or from
+// loopback.
+func secureRequest(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	addr, err := netip.ParseAddr(remoteHost(r))
+	return err == nil && addr.Unmap().IsLoopback()
+}
+
+// handleEnroll exchanges an enrollment code for the credentials of the
+// user it was issued for.  The request is not authenticated, so a bad
+// code counts as an authentication failure against the address.
+func (s *server) handleEnroll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.config.Enrollment.AllowPlaintext && !secureRequest(r) {
+		http.Error(w, "enrollment requires TLS", http.StatusForbidden)
+		return
+	}
+	if s.lockedOut(w, r, "") {
+		return
+	}
+	var req internal.EnrollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now().UTC()
+	codeHash := hashEnrollmentCode(req.Code)
+	invalid := func() {
+		s.authFailed(ctx, r, "", "invalid enrollment code")
+		http.Error(w, "invalid, expired, or already used enrollment code", http.StatusForbidden)
+	}
+
+	// The code's user is checked before the code is redeemed, so a code
+	// for a user we cannot enroll nodes for is not spent.
+	e, err := s.store.GetEnrollment(ctx, codeHash)
+	if errors.Is(err, store.ErrNotFound) || (err == nil && !e.Redeemable(now)) {
+		invalid()
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	user, err := s.store.GetUser(ctx, e.UserID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		internalError(w, err)
+		return
+	}
+	if user != nil && auth.IsHashed(user.UserSecret) {
+		slog.Warn("enrollment code used for a user whose secret is hashed", "user", user.UserID, "node", req.NodeID)
+		http.Error(w, "the server holds only a hash of this user's secret, and cannot enroll nodes for them", http.StatusConflict)
+		return
+	}
+	// Another replica may have redeemed it since.
+	_, err = s.store.RedeemEnrollment(ctx, codeHash, req.NodeID, now)
+	if errors.Is(err, store.ErrNotFound) {
+		invalid()
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	var resp internal.EnrollResponse
+	if user == nil {
+		resp = internal.EnrollResponse{UserID: e.UserID, UserSecretVersion: "1", UserSecret: newUserSecret()}
+		user = &store.User{
+			UserID:            resp.UserID,
+			UserSecretVersion: resp.UserSecretVersion,
+			UserSecret:        resp.UserSecret,
+			CreatedAt:         now,
+		}
+		if s.config.hashSecrets() {
+			user.UserSecret = auth.HashSecret(user.Credentials())
+		}
+		if err := s.store.PutUser(ctx, *user); err != nil {
+			internalError(w, err)
+			return
+		}
+		slog.Info("created user by enrollment", "user", user.UserID)
+	} else {
+		resp = internal.EnrollResponse{
+			UserID:            user.UserID,
+			UserSecretVersion: user.UserSecretVersion,
+			UserSecret:        user.UserSecret,
+		}
+	}
+
+	slog.Info("node enrolled", "user", user.UserID, "node", req.NodeID, "remote", remoteHost(r))
+	s.event(ctx, internal.Event{
+		Kind:    internal.EventEnrolled,
+		UserID:  user.UserID,
+		NodeID:  req.NodeID,
+		Message: fmt.Sprintf("enrolled from %s", remoteHost(r)),
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, resp)
+}
+
+// enrollmentListWindow is how far back the enrollment admin API lists
+// codes, unless asked for more.
+const enrollmentListWindow = 7 * 24 * time.Hour
+
+// handleEnrollments lists recently issued enrollment codes.  POST with
+// an EnrollmentRequest issues a new one, which is shown only then.
+func (s *server) handleEnrollments(w http.ResponseWriter, r *http.Request) {
+	if s.config.Enrollment == nil {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+		since := time.Now().Add(-enrollmentListWindow)
+		if v := r.URL.Query().Get("since"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "since: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			since = t
+		}
+		enrollments, err := s.store.Enrollments(ctx, since)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		resp := internal.EnrollmentsResponse{Enrollments: []internal.Enrollment{}}
+		for _, e := range enrollments {
+			resp.Enrollments = append(resp.Enrollments, internal.Enrollment{
+				UserID:     e.UserID,
+				IssuedOn:   e.IssuedOn,
+				ExpiresOn:  e.ExpiresOn,
+				RedeemedOn: e.RedeemedOn,
+				RedeemedBy: e.RedeemedBy,
+			})
+		}
+		writeJSON(w, resp)
+	case http.MethodPost:
+		var req internal.EnrollmentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.UserID == "" || req.Lifetime < 0 {
+			http.Error(w, "userID is required, and lifetime cannot be negative", http.StatusBadRequest)
+			return
+		}
+		user, err := s.store.GetUser(ctx, req.UserID)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			internalError(w, err)
+			return
+		}
+		if user != nil && auth.IsHashed(user.UserSecret) {
+			http.Error(w, "the server holds only a hash of this user's secret, and cannot enroll nodes for them", http.StatusConflict)
+			return
+		}
+		lifetime := req.Lifetime
+		if lifetime == 0 {
+			lifetime = s.config.Enrollment.CodeLifetime
+		}
+		now := time.Now().UTC()
+		code := newEnrollmentCode()
+		e := store.Enrollment{
+			CodeHash:  hashEnrollmentCode(code),
+			UserID:    req.UserID,
+			IssuedOn:  now,
+			ExpiresOn: now.Add(lifetime),
+		}
+		if err := s.store.AddEnrollment(ctx, e); err != nil {
+			internalError(w, err)
+			return
+		}
+		slog.Info("issued enrollment code", "user", e.UserID, "newUser", user == nil, "expiresOn", e.ExpiresOn)
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, internal.Enrollment{
+			Code:      code,
+			UserID:    e.UserID,
+			IssuedOn:  e.IssuedOn,
+			ExpiresOn: e.ExpiresOn,
+		})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
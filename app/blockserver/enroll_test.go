@@ -0,0 +1,85 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skandragon/collatz/internal/store"
+	"github.com/skandragon/collatz/internal/store/memory"
+)
+
+func TestHandleEnroll(t *testing.T) {
+	tests := []struct {
+		name     string
+		userID   string
+		code     string
+		wantCode int
+		// wantRedeemed is whether the code is used after.
+		wantRedeemed bool
+	}{
+		{"new user", "carol", "ABCDE-FGH23", http.StatusOK, true},
+		{"hashed secret", "alice", "ABCDE-FGH23", http.StatusConflict, false},
+		{"wrong code", "carol", "ABCDE-FGH24", http.StatusForbidden, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "blockserver.yaml")
+			yaml := "enrollment: {}\nusers:\n  - userID: alice\n    userSecretVersion: \"1\"\n    userSecret: alicesecretalicesecret\n"
+			if err := os.WriteFile(filename, []byte(yaml), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			config, err := loadConfig(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			st := memory.New()
+			s, err := newServer(ctx, config, st, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now().UTC()
+			codeHash := hashEnrollmentCode("ABCDE-FGH23")
+			if err := st.AddEnrollment(ctx, store.Enrollment{CodeHash: codeHash, UserID: tt.userID, IssuedOn: now, ExpiresOn: now.Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/enroll", strings.NewReader(`{"code":"`+tt.code+`","nodeID":"node-1"}`))
+			r.RemoteAddr = "127.0.0.1:1234"
+			w := httptest.NewRecorder()
+			s.handleEnroll(w, r)
+			if w.Code != tt.wantCode {
+				t.Fatalf("got %d %s, want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.wantCode)
+			}
+			e, err := st.GetEnrollment(ctx, codeHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if redeemed := !e.RedeemedOn.IsZero(); redeemed != tt.wantRedeemed {
+				t.Errorf("code redeemed: %v, want %v", redeemed, tt.wantRedeemed)
+			}
+		})
+	}
+}
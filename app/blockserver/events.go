@@ -0,0 +1,144 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// maxEvents bounds the size of an events response.
+const maxEvents = 1000
+
+// eventPollInterval is how often a waiting events request checks for
+// new events.  Other replicas may add them, so we poll the store.
+const eventPollInterval = time.Second
+
+// event appends to the event log.  Failing to is logged, but does not
+// fail the request which caused the event.
+func (s *server) event(ctx context.Context, e internal.Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if err := s.store.AddEvent(ctx, &e); err != nil {
+		slog.Error("cannot add to event log", "kind", e.Kind, "packet", e.PacketID, "err", err)
+	}
+}
+
+// skippedEvents adds an event for each candidate a node's watchdog
+// skipped, as they were not tested and need manual review.
+func (s *server) skippedEvents(ctx context.Context, userID string, report internal.WorkProgressReport) {
+	for _, v := range report.Skipped {
+		slog.Warn("candidate skipped by node, needs review", "user", userID, "packet", report.Work.ID,
+			"node", report.NodeInfo.NodeID, "value", v)
+		s.event(ctx, internal.Event{
+			Kind:     internal.EventStall,
+			UserID:   userID,
+			NodeID:   report.NodeInfo.NodeID,
+			PacketID: report.Work.ID,
+			Value:    v,
+			Message:  "candidate skipped, needs review",
+		})
+	}
+}
+
+// recordEvents adds events for the records in an accepted report.
+func (s *server) recordEvents(ctx context.Context, nodeID string, records []store.Record) {
+	for _, r := range records {
+		kind := internal.EventRecord
+		if r.Kind == store.RecordLoop {
+			kind = internal.EventLoop
+		}
+		s.event(ctx, internal.Event{
+			Time:       r.FoundOn,
+			Kind:       kind,
+			UserID:     r.UserID,
+			NodeID:     nodeID,
+			PacketID:   r.PacketID,
+			Value:      r.Value,
+			Iterations: r.Iterations,
+		})
+	}
+}
+
+// handleEvents tails the event log, returning up to "limit" (default
+// and most 1000) events after the sequence number "after", oldest
+// first.  If there are none, it waits up to "wait" (default none) for
+// one to be added.
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	after, err := parseInt(r, "after", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseInt(r, "limit", maxEvents)
+	if err != nil || limit <= 0 {
+		http.Error(w, "invalid limit", http.StatusBadRequest)
+		return
+	}
+	if limit > maxEvents {
+		limit = maxEvents
+	}
+	wait := time.Duration(0)
+	if r.URL.Query().Get("wait") != "" {
+		if wait, err = parseDuration(r, "wait", 0); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		events, err := s.store.Events(r.Context(), after, int(limit))
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if len(events) > 0 || !time.Now().Before(deadline) {
+			writeJSON(w, internal.EventsResponse{Events: events})
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(eventPollInterval):
+		}
+	}
+}
+
+// parseInt parses a query parameter, returning def if it is missing.
+func parseInt(r *http.Request, name string, def int64) (int64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return n, nil
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// gcConfig sets how long data the server no longer needs is kept.  A
+// zero duration keeps that data forever.
+type gcConfig struct {
+	// Interval is how often the sweeper runs.
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// ExpiredPackets is how long to keep packets which expired and
+	// were reissued under a new ID.  It defaults to a week.
+	ExpiredPackets time.Duration `yaml:"expiredPackets,omitempty"`
+
+	// CompletedPackets is how long to keep completed packets.  Their
+	// ranges remain in the completed ranges, and their receipts are
+	// kept, but late duplicate reports will no longer be recognized.
+	CompletedPackets time.Duration `yaml:"completedPackets,omitempty"`
+
+	// Reports is how long to keep accepted reports, for deployments
+	// which do not archive them.
+	Reports time.Duration `yaml:"reports,omitempty"`
+
+	// Nodes is how long to remember nodes we have not heard from.
+	Nodes time.Duration `yaml:"nodes,omitempty"`
+
+	// RateSamples is how much throughput history to keep.
+	RateSamples time.Duration `yaml:"rateSamples,omitempty"`
+}
+
+func (c *gcConfig) applyDefaults() {
+	if c.Interval == 0 {
+		c.Interval = time.Hour
+	}
+	if c.ExpiredPackets == 0 {
+		c.ExpiredPackets = 7 * 24 * time.Hour
+	}
+}
+
+// collector runs garbage collection sweeps, and keeps statistics on them.
+type collector struct {
+	sync.Mutex
+	config *gcConfig
+	store  store.Store
+	status internal.GCStatus
+}
+
+func newCollector(config *gcConfig, st store.Store) *collector {
+	return &collector{config: config, store: st}
+}
+
+func (c *collector) run(ctx context.Context) {
+	t := time.NewTicker(c.config.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if _, err := c.sweep(ctx); err != nil {
+			slog.Error("garbage collection failed", "err", err)
+		}
+	}
+}
+
+// sweep runs one garbage collection pass.  Only one runs at a time.
+func (c *collector) sweep(ctx context.Context) (*internal.GCSweep, error) {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now().UTC()
+	sweep := &internal.GCSweep{StartedOn: now}
+
+	purges := []struct {
+		age   time.Duration
+		count *int64
+		purge func(time.Time) (int64, error)
+	}{
+		{c.config.ExpiredPackets, &sweep.ExpiredPackets, func(t time.Time) (int64, error) {
+			return c.store.PurgePackets(ctx, store.PacketExpired, t)
+		}},
+		{c.config.CompletedPackets, &sweep.CompletedPackets, func(t time.Time) (int64, error) {
+			return c.store.PurgePackets(ctx, store.PacketCompleted, t)
+		}},
+		{c.config.Reports, &sweep.Reports, func(t time.Time) (int64, error) {
+			return c.store.PurgeReports(ctx, t)
+		}},
+		{c.config.Nodes, &sweep.Nodes, func(t time.Time) (int64, error) {
+			return c.store.PurgeNodes(ctx, t)
+		}},
+		{c.config.RateSamples, &sweep.RateSamples, func(t time.Time) (int64, error) {
+			return c.store.PurgeRateSamples(ctx, t)
+		}},
+	}
+	var err error
+	for _, p := range purges {
+		if p.age == 0 {
+			continue
+		}
+		if *p.count, err = p.purge(now.Add(-p.age)); err != nil {
+			break
+		}
+	}
+	sweep.Duration = time.Since(now)
+	if err != nil {
+		sweep.Error = err.Error()
+	}
+
+	c.status.Sweeps++
+	c.status.Last = sweep
+	c.status.Total.Add(sweep.GCCounts)
+	if sweep.ExpiredPackets+sweep.CompletedPackets+sweep.Reports+sweep.Nodes+sweep.RateSamples > 0 {
+		slog.Info("garbage collection finished",
+			"expiredPackets", sweep.ExpiredPackets, "completedPackets", sweep.CompletedPackets,
+			"reports", sweep.Reports, "nodes", sweep.Nodes, "rateSamples", sweep.RateSamples,
+			"duration", sweep.Duration)
+	}
+	return sweep, err
+}
+
+func (c *collector) statusCopy() internal.GCStatus {
+	c.Lock()
+	defer c.Unlock()
+	return c.status
+}
+
+// handleGC returns the collector's statistics on GET, and runs a sweep
+// on POST.
+func (s *server) handleGC(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if _, err := s.gc.sweep(r.Context()); err != nil {
+			internalError(w, err)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.gc.statusCopy())
+}
@@ -0,0 +1,400 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/graph-gophers/graphql-go"
+
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// graphqlSchema is the schema of the read-only query API served at
+// /api/v1/graphql, to anyone with the read scope.  It lets dashboards
+// and visualizations fetch exactly what they need of the campaign,
+// frontier, records, users, and reports in one request.
+//
+//go:embed graphql.graphql
+var graphqlSchema string
+
+// Bounds on what one query may ask for.
+const (
+	graphqlMaxDepth   = 8
+	graphqlMaxReports = 1000
+)
+
+// errGraphQLInternal is what a query is told of a store error, which is
+// logged instead.
+var errGraphQLInternal = errors.New("internal error")
+
+// graphqlRequest is a query, as POSTed or given in a GET's parameters.
+type graphqlRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// handleGraphQL returns a handler answering queries against
+// graphqlSchema.  The schema is embedded, so it failing to parse is a
+// bug, and panics.
+func (s *server) handleGraphQL() func(http.ResponseWriter, *http.Request, *store.User) {
+	schema := graphql.MustParseSchema(graphqlSchema, &graphqlResolver{s: s},
+		graphql.MaxDepth(graphqlMaxDepth))
+	return func(w http.ResponseWriter, r *http.Request, user *store.User) {
+		var req graphqlRequest
+		switch r.Method {
+		case http.MethodGet:
+			q := r.URL.Query()
+			req.Query = q.Get("query")
+			req.OperationName = q.Get("operationName")
+			if v := q.Get("variables"); v != "" {
+				if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+					http.Error(w, "invalid variables", http.StatusBadRequest)
+					return
+				}
+			}
+		case http.MethodPost:
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if req.Query == "" {
+			http.Error(w, "query is required", http.StatusBadRequest)
+			return
+		}
+		ctx := context.WithValue(r.Context(), graphqlUsersKey{}, &graphqlUsers{s: s})
+		writeJSON(w, schema.Exec(ctx, req.Query, req.OperationName, req.Variables))
+	}
+}
+
+// graphqlBigInt is the BigInt scalar, a decimal string.
+type graphqlBigInt struct {
+	v *big.Int
+}
+
+func (graphqlBigInt) ImplementsGraphQLType(name string) bool {
+	return name == "BigInt"
+}
+
+func (b *graphqlBigInt) UnmarshalGraphQL(input any) error {
+	s, ok := input.(string)
+	if !ok {
+		return fmt.Errorf("BigInt must be a string")
+	}
+	v, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return fmt.Errorf("invalid BigInt %q", s)
+	}
+	b.v = v
+	return nil
+}
+
+func (b graphqlBigInt) MarshalJSON() ([]byte, error) {
+	if b.v == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(b.v.String())
+}
+
+// bigInt returns v as a nullable BigInt.
+func bigInt(v *big.Int) *graphqlBigInt {
+	if v == nil {
+		return nil
+	}
+	return &graphqlBigInt{v: v}
+}
+
+func bigUint64(v uint64) graphqlBigInt {
+	return graphqlBigInt{v: new(big.Int).SetUint64(v)}
+}
+
+func bigInt64(v int64) graphqlBigInt {
+	return graphqlBigInt{v: big.NewInt(v)}
+}
+
+// graphqlTime returns t as a nullable Time.
+func graphqlTime(t time.Time) *graphql.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &graphql.Time{Time: t}
+}
+
+// graphqlError logs err, returning what the query is told.
+func graphqlError(err error) error {
+	slog.Error("internal error", "err", err)
+	return errGraphQLInternal
+}
+
+type graphqlResolver struct {
+	s *server
+}
+
+func (q *graphqlResolver) Campaign() *graphqlCampaign {
+	return &graphqlCampaign{s: q.s}
+}
+
+func (q *graphqlResolver) Records(ctx context.Context, args struct {
+	Kind string
+	Last *int32
+}) ([]*graphqlRecord, error) {
+	if !slices.Contains(store.RecordKinds, args.Kind) {
+		return nil, fmt.Errorf("kind must be one of %q", store.RecordKinds)
+	}
+	records, err := q.s.store.Records(ctx, args.Kind)
+	if err != nil {
+		return nil, graphqlError(err)
+	}
+	if args.Last != nil && *args.Last >= 0 && int(*args.Last) < len(records) {
+		records = records[len(records)-int(*args.Last):]
+	}
+	ret := make([]*graphqlRecord, len(records))
+	for i := range records {
+		ret[i] = &graphqlRecord{r: records[i]}
+	}
+	return ret, nil
+}
+
+func (q *graphqlResolver) Users(ctx context.Context) ([]*graphqlUser, error) {
+	users := usersFrom(ctx)
+	if err := users.load(ctx); err != nil {
+		return nil, err
+	}
+	return users.list, nil
+}
+
+func (q *graphqlResolver) User(ctx context.Context, args struct{ ID string }) (*graphqlUser, error) {
+	users := usersFrom(ctx)
+	if err := users.load(ctx); err != nil {
+		return nil, err
+	}
+	return users.byID[args.ID], nil
+}
+
+func (q *graphqlResolver) Reports(ctx context.Context, args struct {
+	After string
+	Limit int32
+}) ([]*graphqlReport, error) {
+	if args.Limit < 0 || args.Limit > graphqlMaxReports {
+		return nil, fmt.Errorf("limit must be between 0 and %d", graphqlMaxReports)
+	}
+	reports, err := q.s.store.ReportsAfter(ctx, args.After, int(args.Limit))
+	if err != nil {
+		return nil, graphqlError(err)
+	}
+	ret := make([]*graphqlReport, len(reports))
+	for i := range reports {
+		ret[i] = &graphqlReport{r: reports[i]}
+	}
+	return ret, nil
+}
+
+type graphqlCampaign struct {
+	s *server
+}
+
+func (c *graphqlCampaign) Name() *string {
+	if c.s.config.Campaign == "" {
+		return nil
+	}
+	return &c.s.config.Campaign
+}
+
+func (c *graphqlCampaign) Origin() graphqlBigInt {
+	return graphqlBigInt{v: c.s.origin}
+}
+
+func (c *graphqlCampaign) Frontier(ctx context.Context) (*graphqlFrontier, error) {
+	frontier, err := c.s.store.Frontier(ctx)
+	if err != nil {
+		return nil, graphqlError(err)
+	}
+	completed, err := c.s.store.CompletedRanges(ctx)
+	if err != nil {
+		return nil, graphqlError(err)
+	}
+	ret := &graphqlFrontier{
+		next:             frontier,
+		completedThrough: completed.ContiguousFrom(c.s.origin),
+	}
+	for _, iv := range completed.Intervals() {
+		ret.completed = append(ret.completed, &graphqlRange{start: iv.Start, end: iv.End, size: iv.Size()})
+	}
+	return ret, nil
+}
+
+type graphqlFrontier struct {
+	next             *big.Int
+	completedThrough *big.Int
+	completed        []*graphqlRange
+}
+
+func (f *graphqlFrontier) Next() *graphqlBigInt             { return bigInt(f.next) }
+func (f *graphqlFrontier) CompletedThrough() *graphqlBigInt { return bigInt(f.completedThrough) }
+func (f *graphqlFrontier) Completed() []*graphqlRange       { return f.completed }
+
+type graphqlRange struct {
+	start, end, size *big.Int
+}
+
+func (r *graphqlRange) Start() graphqlBigInt { return graphqlBigInt{v: r.start} }
+func (r *graphqlRange) End() graphqlBigInt   { return graphqlBigInt{v: r.end} }
+func (r *graphqlRange) Size() graphqlBigInt  { return graphqlBigInt{v: r.size} }
+
+type graphqlRecord struct {
+	r store.Record
+}
+
+func (r *graphqlRecord) Kind() string              { return r.r.Kind }
+func (r *graphqlRecord) Value() *graphqlBigInt     { return bigInt(r.r.Value) }
+func (r *graphqlRecord) Iterations() graphqlBigInt { return bigUint64(r.r.Iterations) }
+func (r *graphqlRecord) PacketID() string          { return r.r.PacketID }
+func (r *graphqlRecord) FoundOn() graphql.Time     { return graphql.Time{Time: r.r.FoundOn} }
+func (r *graphqlRecord) User(ctx context.Context) (*graphqlUser, error) {
+	return usersFrom(ctx).get(ctx, r.r.UserID)
+}
+
+type graphqlReport struct {
+	r store.StoredReport
+}
+
+func (r *graphqlReport) PacketID() string         { return r.r.PacketID }
+func (r *graphqlReport) NodeID() string           { return r.r.NodeID }
+func (r *graphqlReport) ReceivedOn() graphql.Time { return graphql.Time{Time: r.r.ReceivedOn} }
+func (r *graphqlReport) WorkerID() int32          { return int32(r.r.Report.WorkerID) }
+func (r *graphqlReport) StartingValue() *graphqlBigInt {
+	return bigInt(r.r.Report.Work.StartingValue)
+}
+func (r *graphqlReport) EndingValue() *graphqlBigInt { return bigInt(r.r.Report.Work.EndingValue) }
+func (r *graphqlReport) StartedOn() *graphql.Time    { return graphqlTime(r.r.Report.StartedOn) }
+func (r *graphqlReport) CompletedOn() *graphql.Time  { return graphqlTime(r.r.Report.CompletedOn) }
+func (r *graphqlReport) TotalIterations() graphqlBigInt {
+	return bigUint64(r.r.Report.Evidence.TotalIterations)
+}
+func (r *graphqlReport) MaxIterations() graphqlBigInt {
+	return bigUint64(r.r.Report.Evidence.MaxIterations)
+}
+func (r *graphqlReport) MaxIterationsValue() *graphqlBigInt {
+	return bigInt(r.r.Report.MaxIterationsValue)
+}
+func (r *graphqlReport) Filter() *string {
+	if r.r.Report.Evidence.Filter == "" {
+		return nil
+	}
+	return &r.r.Report.Evidence.Filter
+}
+func (r *graphqlReport) Interesting() []graphqlBigInt {
+	ret := make([]graphqlBigInt, len(r.r.Report.Interesting))
+	for i, v := range r.r.Report.Interesting {
+		ret[i] = graphqlBigInt{v: v}
+	}
+	return ret
+}
+func (r *graphqlReport) User(ctx context.Context) (*graphqlUser, error) {
+	return usersFrom(ctx).get(ctx, r.r.UserID)
+}
+
+type graphqlUser struct {
+	id        string
+	createdAt time.Time
+	totals    store.UserTotals
+}
+
+func (u *graphqlUser) ID() string                { return u.id }
+func (u *graphqlUser) CreatedAt() *graphql.Time  { return graphqlTime(u.createdAt) }
+func (u *graphqlUser) Integers() graphqlBigInt   { return bigInt64(u.totals.Integers) }
+func (u *graphqlUser) Iterations() graphqlBigInt { return bigInt64(u.totals.Iterations) }
+func (u *graphqlUser) Packets() graphqlBigInt    { return bigInt64(u.totals.Packets) }
+func (u *graphqlUser) First() *graphql.Time      { return graphqlTime(u.totals.First) }
+func (u *graphqlUser) Last() *graphql.Time       { return graphqlTime(u.totals.Last) }
+
+type graphqlUsersKey struct{}
+
+// graphqlUsers loads the users and their totals once per query, however
+// many records and reports refer to them.
+type graphqlUsers struct {
+	s    *server
+	once sync.Once
+	err  error
+	list []*graphqlUser
+	byID map[string]*graphqlUser
+}
+
+func usersFrom(ctx context.Context) *graphqlUsers {
+	return ctx.Value(graphqlUsersKey{}).(*graphqlUsers)
+}
+
+func (u *graphqlUsers) load(ctx context.Context) error {
+	u.once.Do(func() {
+		users, err := u.s.store.Users(ctx)
+		if err != nil {
+			u.err = graphqlError(err)
+			return
+		}
+		totals, err := u.s.store.UserTotals(ctx)
+		if err != nil {
+			u.err = graphqlError(err)
+			return
+		}
+		u.byID = map[string]*graphqlUser{}
+		for _, user := range users {
+			u.byID[user.UserID] = &graphqlUser{id: user.UserID, createdAt: user.CreatedAt}
+		}
+		// Those with totals come first, as UserTotals orders them.
+		for _, t := range totals {
+			gu := u.byID[t.UserID]
+			if gu == nil {
+				continue
+			}
+			gu.totals = t
+			u.list = append(u.list, gu)
+		}
+		for _, user := range users {
+			if gu := u.byID[user.UserID]; gu.totals.UserID == "" {
+				u.list = append(u.list, gu)
+			}
+		}
+	})
+	return u.err
+}
+
+// get returns the user, who, if they have since been deleted, has only
+// an ID.
+func (u *graphqlUsers) get(ctx context.Context, userID string) (*graphqlUser, error) {
+	if err := u.load(ctx); err != nil {
+		return nil, err
+	}
+	if gu := u.byID[userID]; gu != nil {
+		return gu, nil
+	}
+	return &graphqlUser{id: userID}, nil
+}
@@ -0,0 +1,247 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/pb"
+	"github.com/skandragon/collatz/internal/trace"
+)
+
+// grpcConfig serves the work API over gRPC as well, for clients which
+// claim and report at a high rate, or are not written in Go.
+type grpcConfig struct {
+	// Listen is the address of the gRPC listener, such as ":8444".
+	// It serves TLS with the same certificate as Listen, if TLS is
+	// configured.
+	Listen string `yaml:"listen,omitempty"`
+
+	// StreamWait is how long StreamWork waits to claim again when
+	// the client holds all the packets it may.  It defaults to 10s.
+	StreamWait time.Duration `yaml:"streamWait,omitempty"`
+}
+
+func (c *grpcConfig) applyDefaults() error {
+	if c.Listen == "" {
+		return fmt.Errorf("grpc.listen is required")
+	}
+	if c.StreamWait == 0 {
+		c.StreamWait = 10 * time.Second
+	}
+	return nil
+}
+
+// grpcRequestHeaders are the metadata passed on to the REST handlers as
+// request headers.
+var grpcRequestHeaders = []string{"Authorization", trace.Header, "User-Agent"}
+
+// grpcResponseHeaders are the response headers passed back to the
+// client as metadata.
+var grpcResponseHeaders = []string{internal.ServerTimeHeader, "Retry-After"}
+
+// workService answers the gRPC work API by making the REST call each
+// method mirrors, in process, so both are authorized, throttled,
+// instrumented, and handled by the same code.
+type workService struct {
+	pb.UnimplementedWorkServiceServer
+	routes http.Handler
+	wait   time.Duration
+}
+
+func (s *server) serveGRPC(ctx context.Context) error {
+	config := s.config.GRPC
+	var opts []grpc.ServerOption
+	if s.config.TLS != nil {
+		tlsConfig, _, err := s.config.TLS.listener(config.Listen)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	opts = append(opts, grpc.MaxRecvMsgSize(maxRequestSize))
+	srv := grpc.NewServer(opts...)
+	pb.RegisterWorkServiceServer(srv, &workService{routes: s.routes(), wait: config.StreamWait})
+
+	l, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+	slog.Info("serving gRPC", "addr", config.Listen, "tls", s.config.TLS != nil)
+	return srv.Serve(l)
+}
+
+func (ws *workService) Claim(ctx context.Context, req *pb.ClaimRequest) (*pb.ClaimResponse, error) {
+	resp := &pb.ClaimResponse{}
+	if err := ws.call(ctx, "/api/v1/claim", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (ws *workService) Report(ctx context.Context, req *pb.WorkProgressReport) (*pb.ReportResponse, error) {
+	resp := &pb.ReportResponse{}
+	if err := ws.call(ctx, "/api/v1/report", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (ws *workService) Heartbeat(ctx context.Context, req *pb.WorkProgressReport) (*pb.ReportResponse, error) {
+	req.Status = "running"
+	return ws.Report(ctx, req)
+}
+
+// StreamWork claims repeatedly, sending each packet assigned.  Claims
+// fail with the same errors as Claim; a claim assigning nothing means
+// the client holds all it may, so we wait before asking again.
+func (ws *workService) StreamWork(req *pb.ClaimRequest, stream pb.WorkService_StreamWorkServer) error {
+	ctx := stream.Context()
+	for {
+		resp, err := ws.Claim(ctx, req)
+		if err != nil {
+			return err
+		}
+		for _, p := range resp.GetWork() {
+			if err := stream.Send(p); err != nil {
+				return err
+			}
+		}
+		if len(resp.GetWork()) > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-time.After(ws.wait):
+		}
+	}
+}
+
+// call POSTs req to path, as a REST client would, and decodes the
+// response into resp.  Errors are returned as gRPC statuses.
+func (ws *workService) call(ctx context.Context, path string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, path, bytes.NewReader(body))
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	r.Header.Set("Content-Type", "application/json")
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, name := range grpcRequestHeaders {
+		if v := md.Get(name); len(v) > 0 {
+			r.Header.Set(name, v[0])
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	r.RequestURI = path
+
+	w := newBufferedResponse()
+	ws.routes.ServeHTTP(w, r)
+
+	var header metadata.MD
+	for _, name := range grpcResponseHeaders {
+		if v := w.header.Get(name); v != "" {
+			header = metadata.Join(header, metadata.Pairs(name, v))
+		}
+	}
+	if header != nil {
+		grpc.SetHeader(ctx, header)
+	}
+	if w.code != http.StatusOK {
+		return status.Error(grpcCode(w.code), strings.TrimSpace(w.body.String()))
+	}
+	if err := json.Unmarshal(w.body.Bytes(), resp); err != nil {
+		return status.Errorf(codes.Internal, "decoding response: %v", err)
+	}
+	return nil
+}
+
+// grpcCode returns the gRPC status code nearest an HTTP status.
+func grpcCode(code int) codes.Code {
+	switch code {
+	case http.StatusBadRequest, http.StatusUnsupportedMediaType, http.StatusRequestEntityTooLarge:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return codes.Unimplemented
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	}
+	if code >= 500 {
+		return codes.Internal
+	}
+	return codes.Unknown
+}
+
+// bufferedResponse collects a response made in process.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: http.Header{}}
+}
+
+func (w *bufferedResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponse) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *bufferedResponse) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
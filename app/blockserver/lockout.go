@@ -0,0 +1,298 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/natshttp"
+)
+
+// lockoutConfig sets how repeated authentication failures are throttled.
+// Failures are counted per client address, and per user from each
+// address, in memory, so each replica counts only those it sees.  User
+// IDs are public, so failures naming a user lock them out only at the
+// address they came from.  Behind a proxy, every client has the
+// proxy's address.  Over NATS, every client has the same address, so
+// failures there are counted only per user.
+type lockoutConfig struct {
+	// Threshold is how many failures within Window lock out the user
+	// or address.  It defaults to 10; a negative value disables
+	// lockouts.
+	Threshold int `yaml:"threshold,omitempty"`
+
+	// Window defaults to 15 minutes.
+	Window time.Duration `yaml:"window,omitempty"`
+
+	// Duration is how long the first lockout lasts, by default a
+	// minute.  Each lockout following soon after another lasts twice
+	// as long, up to MaxDuration, by default an hour.
+	Duration    time.Duration `yaml:"duration,omitempty"`
+	MaxDuration time.Duration `yaml:"maxDuration,omitempty"`
+}
+
+func (c *lockoutConfig) applyDefaults() error {
+	if c.Threshold == 0 {
+		c.Threshold = 10
+	}
+	if c.Window == 0 {
+		c.Window = 15 * time.Minute
+	}
+	if c.Duration == 0 {
+		c.Duration = time.Minute
+	}
+	if c.MaxDuration == 0 {
+		c.MaxDuration = time.Hour
+	}
+	if c.Window < 0 || c.Duration < 0 || c.MaxDuration < c.Duration {
+		return fmt.Errorf("lockout durations must be positive, with maxDuration at least duration")
+	}
+	return nil
+}
+
+// Kinds of lockout key.  A user key's ID is the user's and the
+// address's, as "<user>@<address>".
+const (
+	lockoutUser    = "user"
+	lockoutAddress = "address"
+)
+
+type lockoutKey struct {
+	kind string
+	id   string
+}
+
+type lockoutState struct {
+	// failures are the times of the failures within the window.
+	failures []time.Time
+
+	// lockouts counts the lockouts so far, doubling the next.
+	lockouts    int
+	lockedUntil time.Time
+}
+
+// quiet returns true if the state has nothing left to remember: its
+// failures have left the window, and it has not been locked out for
+// long enough that the next lockout starts over.
+func (st *lockoutState) quiet(config *lockoutConfig, now time.Time) bool {
+	return len(st.failures) == 0 && now.After(st.lockedUntil.Add(config.MaxDuration))
+}
+
+// lockouts counts authentication failures, and locks out those with
+// too many.
+type lockouts struct {
+	sync.Mutex
+	config *lockoutConfig
+	state  map[lockoutKey]*lockoutState
+	pruned time.Time
+}
+
+func newLockouts(config *lockoutConfig) *lockouts {
+	return &lockouts{config: config, state: map[lockoutKey]*lockoutState{}}
+}
+
+// locked returns how long remains on the longest lockout of keys.
+func (l *lockouts) locked(now time.Time, keys ...lockoutKey) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	var ret time.Duration
+	for _, key := range keys {
+		if st := l.state[key]; st != nil && st.lockedUntil.Sub(now) > ret {
+			ret = st.lockedUntil.Sub(now)
+		}
+	}
+	return ret
+}
+
+// fail records a failure for key, returning the length of the lockout
+// it caused, if any.
+func (l *lockouts) fail(now time.Time, key lockoutKey) time.Duration {
+	if l.config.Threshold < 0 {
+		return 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.prune(now)
+	st := l.state[key]
+	if st == nil {
+		st = &lockoutState{}
+		l.state[key] = st
+	}
+	st.failures = append(l.recent(st.failures, now), now)
+	if len(st.failures) < l.config.Threshold || now.Before(st.lockedUntil) {
+		return 0
+	}
+	d := l.config.Duration << st.lockouts
+	if d > l.config.MaxDuration || d <= 0 {
+		d = l.config.MaxDuration
+	}
+	st.failures = nil
+	st.lockouts++
+	st.lockedUntil = now.Add(d)
+	return d
+}
+
+// recent returns the failures still within the window.
+func (l *lockouts) recent(failures []time.Time, now time.Time) []time.Time {
+	i := sort.Search(len(failures), func(i int) bool { return now.Sub(failures[i]) < l.config.Window })
+	return failures[i:]
+}
+
+// prune forgets quiet keys, at most once a minute.
+func (l *lockouts) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	for key, st := range l.state {
+		st.failures = l.recent(st.failures, now)
+		if st.quiet(l.config, now) {
+			delete(l.state, key)
+		}
+	}
+}
+
+// forget clears a key, returning false if it had nothing recorded.
+func (l *lockouts) forget(key lockoutKey) bool {
+	l.Lock()
+	defer l.Unlock()
+	_, found := l.state[key]
+	delete(l.state, key)
+	return found
+}
+
+// list returns the keys with recent failures or lockouts, most
+// recently locked first.
+func (l *lockouts) list(now time.Time) []internal.Lockout {
+	l.Lock()
+	defer l.Unlock()
+	ret := []internal.Lockout{}
+	for key, st := range l.state {
+		st.failures = l.recent(st.failures, now)
+		if st.quiet(l.config, now) {
+			continue
+		}
+		lockout := internal.Lockout{
+			Kind:     key.kind,
+			ID:       key.id,
+			Failures: len(st.failures),
+			Lockouts: st.lockouts,
+		}
+		if now.Before(st.lockedUntil) {
+			lockout.LockedUntil = st.lockedUntil
+		}
+		ret = append(ret, lockout)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if !ret[i].LockedUntil.Equal(ret[j].LockedUntil) {
+			return ret[i].LockedUntil.After(ret[j].LockedUntil)
+		}
+		return ret[i].Kind+ret[i].ID < ret[j].Kind+ret[j].ID
+	})
+	return ret
+}
+
+// remoteHost returns the address of the client, without the port.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// lockoutKeys returns the keys a request's failures count against: its
+// address, and the user, if known, at that address.  Requests over
+// NATS share one address, which one client failing could lock every
+// other out of, so only the user counts.
+func lockoutKeys(r *http.Request, userID string) []lockoutKey {
+	host := remoteHost(r)
+	var keys []lockoutKey
+	if r.RemoteAddr != natshttp.RemoteAddr {
+		keys = append(keys, lockoutKey{lockoutAddress, host})
+	}
+	if userID != "" {
+		keys = append(keys, lockoutKey{lockoutUser, userID + "@" + host})
+	}
+	return keys
+}
+
+// lockedOut replies if the request's address, or the user, if known,
+// is locked out there, returning true if it did.
+func (s *server) lockedOut(w http.ResponseWriter, r *http.Request, userID string) bool {
+	wait := s.lockouts.locked(time.Now(), lockoutKeys(r, userID)...)
+	if wait <= 0 {
+		return false
+	}
+	seconds := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("too many authentication failures; try again in %ds", seconds), http.StatusTooManyRequests)
+	return true
+}
+
+// authFailed counts an authentication failure against the request's
+// lockoutKeys, logging any lockout it causes to the event log.
+func (s *server) authFailed(ctx context.Context, r *http.Request, userID string, reason string) {
+	now := time.Now()
+	for _, key := range lockoutKeys(r, userID) {
+		d := s.lockouts.fail(now, key)
+		if d == 0 {
+			continue
+		}
+		msg := fmt.Sprintf("%s %s locked out for %s after repeated authentication failures", key.kind, key.id, d)
+		slog.Warn("locking out after repeated authentication failures", "kind", key.kind, "id", key.id,
+			"user", userID, "duration", d, "reason", reason)
+		s.event(ctx, internal.Event{
+			Kind:    internal.EventLockout,
+			UserID:  userID,
+			Message: msg,
+		})
+	}
+}
+
+// handleLockouts lists the users and addresses with recent
+// authentication failures.  DELETE with "kind" and "id" lifts a
+// lockout, and forgets the failures leading to it.
+func (s *server) handleLockouts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		key := lockoutKey{kind: r.URL.Query().Get("kind"), id: r.URL.Query().Get("id")}
+		if (key.kind != lockoutUser && key.kind != lockoutAddress) || key.id == "" {
+			http.Error(w, "kind (user or address) and id are required", http.StatusBadRequest)
+			return
+		}
+		if !s.lockouts.forget(key) {
+			http.NotFound(w, r)
+			return
+		}
+		slog.Info("lockout lifted", "kind", key.kind, "id", key.id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, internal.LockoutsResponse{Lockouts: s.lockouts.list(time.Now())})
+}
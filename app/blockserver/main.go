@@ -15,3 +15,573 @@
  */
 
 package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/auth"
+	"github.com/skandragon/collatz/internal/debug"
+	"github.com/skandragon/collatz/internal/logging"
+	"github.com/skandragon/collatz/internal/statsd"
+	"github.com/skandragon/collatz/internal/store"
+	"github.com/skandragon/collatz/internal/store/instrumented"
+	"github.com/skandragon/collatz/internal/trace"
+	"gopkg.in/yaml.v3"
+)
+
+type userConfig struct {
+	UserID            string `yaml:"userID,omitempty"`
+	UserSecretVersion string `yaml:"userSecretVersion,omitempty"`
+	UserSecret        string `yaml:"userSecret,omitempty"`
+}
+
+type plainUserConfig userConfig
+
+func (c userConfig) String() string { return fmt.Sprintf("%+v", c.redacted()) }
+
+func (c userConfig) GoString() string { return fmt.Sprintf("%#v", c.redacted()) }
+
+func (c userConfig) redacted() plainUserConfig {
+	ret := plainUserConfig(c)
+	if ret.UserSecret != "" {
+		ret.UserSecret = internal.Redacted
+	}
+	return ret
+}
+
+// tracingConfig selects where spans are exported.
+type tracingConfig struct {
+	// Endpoint is the OTLP HTTP traces endpoint, such as
+	// "http://localhost:4318/v1/traces".
+	Endpoint string `yaml:"endpoint,omitempty"`
+
+	// ServiceName defaults to "blockserver".
+	ServiceName string `yaml:"serviceName,omitempty"`
+}
+
+type serverConfig struct {
+	// Listen is the address of the HTTP listener, ":8080" by default,
+	// or "none" for none.
+	Listen string `yaml:"listen,omitempty"`
+
+	// TLS, if set, serves HTTPS on Listen, rather than leaving TLS to
+	// a reverse proxy.
+	TLS *tlsConfig `yaml:"tls,omitempty"`
+
+	// DatabaseDriver is "sqlite" (the default), "postgres", or
+	// "memory", which loses all state on restart.
+	DatabaseDriver string `yaml:"databaseDriver,omitempty"`
+
+	// Database is the SQLite database file, or the PostgreSQL
+	// connection URL, holding our state.
+	Database string `yaml:"database,omitempty"`
+
+	// AutoMigrate applies any pending schema migrations at startup.
+	// It defaults to true.  If false, "blockserver migrate" must be
+	// run after upgrading.
+	AutoMigrate *bool `yaml:"autoMigrate,omitempty"`
+
+	// StartingValue is the first value handed out when no work has
+	// yet been assigned, in decimal.
+	StartingValue string `yaml:"startingValue,omitempty"`
+
+	// BlockSize is the number of integers (not candidates) in each work
+	// packet given to a node we know nothing about.
+	BlockSize int64 `yaml:"blockSize,omitempty"`
+
+	// MinBlockSize and MaxBlockSize bound the packet size chosen
+	// from a node's history.  They default to a tenth and a hundred
+	// times BlockSize; MinBlockSize must be at least 2.
+	MinBlockSize int64 `yaml:"minBlockSize,omitempty"`
+	MaxBlockSize int64 `yaml:"maxBlockSize,omitempty"`
+
+	// TargetPacketDuration is how long we would like a packet to take
+	// on the node it is assigned to.
+	TargetPacketDuration time.Duration `yaml:"targetPacketDuration,omitempty"`
+
+	// PacketLifetime is how long a client has to complete a packet
+	// before it may be reassigned.
+	PacketLifetime time.Duration `yaml:"packetLifetime,omitempty"`
+
+	// MaxOutstanding limits how many unexpired packets one user
+	// may hold at once.
+	MaxOutstanding int `yaml:"maxOutstanding,omitempty"`
+
+	// Signing, if set, is where to find the key used to sign work
+	// packets, so clients given its public key can detect packets
+	// tampered with or spoofed on the way.
+	Signing *masterKeyConfig `yaml:"signing,omitempty"`
+
+	// Encryption, if set, seals user secrets in the database.
+	Encryption *encryptionConfig `yaml:"encryption,omitempty"`
+
+	// HashSecrets stores user secrets only as Argon2id hashes, so
+	// their clients must use the v3 authenticator.  It defaults to
+	// true.  Secrets stored in plaintext before are hashed by
+	// "blockserver hash-secrets".  Set it false only where clients
+	// still need the v1 or v2 authenticators, or nodes must be
+	// enrolled for users who already have a secret, as both need the
+	// secret itself.
+	HashSecrets *bool `yaml:"hashSecrets,omitempty"`
+
+	// Tokens, if set, lets clients log in for short-lived bearer
+	// tokens, rather than send their secret with every request.
+	Tokens *tokenConfig `yaml:"tokens,omitempty"`
+
+	// Enrollment, if set, lets nodes exchange one-time codes from the
+	// admin API for their user's credentials.
+	Enrollment *enrollmentConfig `yaml:"enrollment,omitempty"`
+
+	// Lockout throttles clients failing to authenticate.
+	Lockout lockoutConfig `yaml:"lockout,omitempty"`
+
+	// AdminToken enables the admin API, which requires it as a
+	// bearer token.
+	AdminToken string `yaml:"adminToken,omitempty"`
+
+	// Admin, if set, moves the admin API to its own listener, which
+	// requires client certificates.
+	Admin *adminConfig `yaml:"admin,omitempty"`
+
+	// GRPC, if set, also serves the work API over gRPC.
+	GRPC *grpcConfig `yaml:"grpc,omitempty"`
+
+	// NATS, if set, also serves the work API through a NATS server.
+	NATS *natsConfig `yaml:"nats,omitempty"`
+
+	// MetricsListen, if set, is the address on which we serve
+	// Prometheus metrics at /metrics, such as "127.0.0.1:9090".
+	MetricsListen string `yaml:"metricsListen,omitempty"`
+
+	// Statsd, if set, pushes the same metrics to a statsd server.
+	Statsd *statsd.Config `yaml:"statsd,omitempty"`
+
+	// Tracing, if set, exports spans for API requests, and the
+	// verification and acceptance of reports.
+	Tracing *tracingConfig `yaml:"tracing,omitempty"`
+
+	// SlowStoreOperation is how long a store operation may take before
+	// it is logged.  The default is 250ms; a negative value disables
+	// the log.
+	SlowStoreOperation time.Duration `yaml:"slowStoreOperation,omitempty"`
+
+	// GC sets how long old data is kept.
+	GC gcConfig `yaml:"gc,omitempty"`
+
+	// Backup, if set, takes scheduled backups of the database.
+	Backup *backupConfig `yaml:"backup,omitempty"`
+
+	// Archive, if set, moves old reports to object storage.
+	Archive *archiveConfig `yaml:"archive,omitempty"`
+
+	// Trajectories, if set, collects the trajectories of findings.
+	Trajectories *trajectoryConfig `yaml:"trajectories,omitempty"`
+
+	// Campaign, if set, names the search we are running, and is
+	// attached to every line we log.
+	Campaign string `yaml:"campaign,omitempty"`
+
+	// Logging selects the log format and level.
+	Logging logging.Config `yaml:"logging,omitempty"`
+
+	// Trust, if set, has packets double-checked by a second user
+	// before their ranges count as completed, unless the user who
+	// completed them is trusted.
+	Trust *trustConfig `yaml:"trust,omitempty"`
+
+	// Quarantine, if set, refuses results from client builds known to
+	// be faulty.
+	Quarantine *quarantineConfig `yaml:"quarantine,omitempty"`
+
+	// Challenges, if set, adds spot checks to each packet.
+	Challenges *challengeConfig `yaml:"challenges,omitempty"`
+
+	// Audit, if set, recomputes part of a sample of the packets we
+	// accept.
+	Audit *auditConfig `yaml:"audit,omitempty"`
+
+	// Filter, if set, names the residue filter packets are issued
+	// with, such as "mod3".  Clients which do not support it are
+	// issued packets without one.
+	Filter string `yaml:"filter,omitempty"`
+
+	// Authenticators chooses the authenticator versions accepted on
+	// completed reports.
+	Authenticators auth.Policy `yaml:"authenticators,omitempty"`
+
+	// AccessLog, if set, logs API requests.
+	AccessLog *accessLogConfig `yaml:"accessLog,omitempty"`
+
+	Users []userConfig `yaml:"users,omitempty"`
+}
+
+type plainServerConfig serverConfig
+
+// String and GoString keep the admin token and user secrets out of
+// anything dumping the config.
+func (c serverConfig) String() string { return fmt.Sprintf("%+v", c.redacted()) }
+
+func (c serverConfig) GoString() string { return fmt.Sprintf("%#v", c.redacted()) }
+
+func (c serverConfig) redacted() plainServerConfig {
+	ret := plainServerConfig(c)
+	if ret.AdminToken != "" {
+		ret.AdminToken = internal.Redacted
+	}
+	return ret
+}
+
+// hashSecrets reports whether user secrets are stored only as hashes.
+func (c *serverConfig) hashSecrets() bool {
+	return c.HashSecrets == nil || *c.HashSecrets
+}
+
+func loadConfig(filename string) (*serverConfig, error) {
+	config := &serverConfig{}
+	if filename != "" {
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(b, config); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := config.Logging.Validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Authenticators.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Listen == "" {
+		config.Listen = ":8080"
+	}
+	if config.DatabaseDriver == "" {
+		config.DatabaseDriver = "sqlite"
+	}
+	if config.Database == "" && config.DatabaseDriver == "sqlite" {
+		config.Database = "blockserver.db"
+	}
+	if config.StartingValue == "" {
+		initial := big.NewInt(0)
+		initial.SetBit(initial, 40, 1)
+		initial.SetBit(initial, 0, 1)
+		config.StartingValue = initial.String()
+	}
+	if config.BlockSize == 0 {
+		config.BlockSize = 100000000
+	}
+	if config.MinBlockSize == 0 {
+		config.MinBlockSize = config.BlockSize / 10
+	}
+	if config.MaxBlockSize == 0 {
+		config.MaxBlockSize = config.BlockSize * 100
+	}
+	// Packet sizes are rounded down to even, so anything less than 2
+	// would make an empty packet.
+	if config.MinBlockSize < 2 {
+		return nil, fmt.Errorf("minBlockSize is %d, but must be at least 2; set it, or a blockSize of at least 20", config.MinBlockSize)
+	}
+	if config.MaxBlockSize < config.MinBlockSize {
+		return nil, fmt.Errorf("maxBlockSize %d is less than minBlockSize %d", config.MaxBlockSize, config.MinBlockSize)
+	}
+	if config.TargetPacketDuration == 0 {
+		config.TargetPacketDuration = time.Hour
+	}
+	if config.MaxOutstanding == 0 {
+		config.MaxOutstanding = 64
+	}
+	if config.PacketLifetime == 0 {
+		config.PacketLifetime = 24 * time.Hour
+	}
+	if config.Tracing != nil {
+		if config.Tracing.Endpoint == "" {
+			return nil, fmt.Errorf("tracing.endpoint is required")
+		}
+		if config.Tracing.ServiceName == "" {
+			config.Tracing.ServiceName = "blockserver"
+		}
+	}
+	if config.SlowStoreOperation == 0 {
+		config.SlowStoreOperation = 250 * time.Millisecond
+	}
+	config.GC.applyDefaults()
+	if err := config.Lockout.applyDefaults(); err != nil {
+		return nil, err
+	}
+	if config.Backup != nil {
+		if err := config.Backup.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Archive != nil {
+		if err := config.Archive.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Statsd != nil {
+		if err := config.Statsd.ApplyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Admin != nil {
+		if err := config.Admin.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if config.GRPC != nil {
+		if err := config.GRPC.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if config.NATS != nil {
+		if err := config.NATS.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Listen == listenNone && config.TLS != nil {
+		return nil, fmt.Errorf("tls cannot be set when listen is %q", listenNone)
+	}
+	if config.TLS != nil {
+		if err := config.TLS.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Tokens != nil {
+		if err := config.Tokens.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Enrollment != nil {
+		if err := config.Enrollment.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Trust != nil {
+		if err := config.Trust.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Quarantine != nil {
+		if err := config.Quarantine.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Challenges != nil {
+		if err := config.Challenges.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Audit != nil {
+		if err := config.Audit.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if config.AccessLog != nil {
+		if err := config.AccessLog.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if config.Trajectories != nil {
+		if err := config.Trajectories.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if err := internal.CheckFilter(config.Filter); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func main() {
+	configFile := flag.String("config", "", "configuration file")
+	debugListen := flag.String("debug", "", "serve pprof and expvar on this loopback address, such as localhost:6060")
+	flag.Parse()
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		logging.Fatal("cannot load config", "file", *configFile, "err", err)
+	}
+	if err := logging.Setup(config.Logging, config.Campaign); err != nil {
+		logging.Fatal("cannot set up logging", "err", err)
+	}
+
+	ctx := context.Background()
+	if *debugListen != "" {
+		if err := debug.CheckAddr(*debugListen); err != nil {
+			logging.Fatal("cannot serve debug endpoints", "err", err)
+		}
+		go func() {
+			if err := debug.Serve(ctx, *debugListen); err != nil {
+				slog.Error("debug server failed", "err", err)
+			}
+		}()
+	}
+
+	// These commands must run without the store open.
+	switch flag.Arg(0) {
+	case "restore":
+		if err := restoreCommand(ctx, config, flag.Arg(1)); err != nil {
+			logging.Fatal("restore failed", "err", err)
+		}
+		return
+	case "keygen":
+		if err := keygenCommand(); err != nil {
+			logging.Fatal("keygen failed", "err", err)
+		}
+		return
+	case "dashboard":
+		if err := dashboardCommand(flag.Args()[1:]); err != nil {
+			logging.Fatal("dashboard failed", "err", err)
+		}
+		return
+	}
+
+	metrics := instrumented.NewMetrics(config.SlowStoreOperation)
+	st, err := openStore(ctx, config, metrics)
+	if err != nil {
+		logging.Fatal("cannot open database", "driver", config.DatabaseDriver, "err", err)
+	}
+	defer st.Close()
+
+	switch flag.Arg(0) {
+	case "", "serve":
+		err = serve(ctx, config, st, metrics)
+	case "migrate":
+		err = migrateCommand(ctx, st)
+	case "export":
+		err = exportCommand(ctx, config, st, flag.Arg(1))
+	case "import":
+		err = importCommand(ctx, config, st, flag.Arg(1))
+	case "csv":
+		err = csvCommand(ctx, config, st, flag.Arg(1), flag.Arg(2))
+	case "parquet":
+		err = parquetCommand(ctx, config, st, flag.Arg(1))
+	case "backup":
+		err = backupCommand(ctx, config, st)
+	case "rotate-keys":
+		err = rotateKeysCommand(ctx, config, st)
+	case "public-key":
+		err = publicKeyCommand(ctx, config)
+	case "hash-secrets":
+		err = hashSecretsCommand(ctx, config, st)
+	default:
+		err = fmt.Errorf("unknown command %q", flag.Arg(0))
+	}
+	if err != nil {
+		logging.Fatal("command failed", "command", flag.Arg(0), "err", err)
+	}
+}
+
+func migrateCommand(ctx context.Context, st store.Store) error {
+	applied, err := st.Migrate(ctx)
+	if err != nil {
+		return err
+	}
+	slog.Info("applied migrations", "count", applied)
+	return nil
+}
+
+// prepareStore applies migrations if configured to, and checks the
+// schema is what we expect.
+func prepareStore(ctx context.Context, config *serverConfig, st store.Store) error {
+	if config.AutoMigrate == nil || *config.AutoMigrate {
+		applied, err := st.Migrate(ctx)
+		if err != nil {
+			return fmt.Errorf("migrating database: %v", err)
+		}
+		if applied > 0 {
+			slog.Info("applied migrations", "count", applied)
+		}
+	}
+	return st.CheckSchema(ctx)
+}
+
+func serve(ctx context.Context, config *serverConfig, st store.Store, metrics *instrumented.Metrics) error {
+	if err := prepareStore(ctx, config, st); err != nil {
+		return err
+	}
+
+	s, err := newServer(ctx, config, st, metrics)
+	if err != nil {
+		return fmt.Errorf("cannot create server: %v", err)
+	}
+
+	if config.Tracing != nil {
+		s.tracer = trace.New(config.Tracing.ServiceName, config.Tracing.Endpoint)
+		go s.tracer.Run(ctx)
+	}
+	go s.gc.run(ctx)
+	if config.Audit != nil {
+		s.runAudits(ctx)
+	}
+	if config.MetricsListen != "" {
+		go s.serveMetrics(ctx, config.MetricsListen)
+	}
+	if config.Statsd != nil {
+		go statsd.Push(ctx, config.Statsd, func(w io.Writer) { s.metrics.write(ctx, w, s.store) })
+	}
+	if config.Backup != nil {
+		go runBackups(ctx, config, st)
+	}
+	if config.Archive != nil {
+		go newArchiver(config.Archive, st).run(ctx)
+	}
+
+	if config.Admin != nil {
+		go func() {
+			if err := s.serveAdmin(ctx); err != nil {
+				logging.Fatal("admin listener failed", "addr", config.Admin.Listen, "err", err)
+			}
+		}()
+	}
+	if config.GRPC != nil {
+		go func() {
+			if err := s.serveGRPC(ctx); err != nil {
+				logging.Fatal("gRPC listener failed", "addr", config.GRPC.Listen, "err", err)
+			}
+		}()
+	}
+	if config.NATS != nil {
+		go func() {
+			if err := s.serveNATS(ctx); err != nil {
+				logging.Fatal("cannot serve over NATS", "err", err)
+			}
+		}()
+	}
+	if config.Listen == listenNone {
+		slog.Info("not listening for HTTP")
+		<-ctx.Done()
+		return nil
+	}
+
+	srv := &http.Server{
+		Addr:              config.Listen,
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if config.TLS != nil {
+		tlsConfig, plain, err := config.TLS.listener(config.Listen)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = tlsConfig
+		if config.TLS.HTTPListen != "" {
+			go serveHTTP(ctx, config.TLS.HTTPListen, plain)
+		}
+		slog.Info("listening", "addr", config.Listen, "tls", true)
+		return srv.ListenAndServeTLS("", "")
+	}
+	slog.Info("listening", "addr", config.Listen)
+	return srv.ListenAndServe()
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigBlockSizes(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		wantErr  bool
+		min, max int64
+	}{
+		{"defaults", "", false, 10000000, 10000000000},
+		{"from blockSize", "blockSize: 20\n", false, 2, 2000},
+		{"blockSize too small for the minimum", "blockSize: 10\n", true, 0, 0},
+		{"minimum set", "blockSize: 10\nminBlockSize: 2\n", false, 2, 1000},
+		{"minimum of one", "minBlockSize: 1\n", true, 0, 0},
+		{"negative minimum", "minBlockSize: -4\n", true, 0, 0},
+		{"maximum below minimum", "minBlockSize: 100\nmaxBlockSize: 50\n", true, 0, 0},
+		{"maximum of the minimum", "minBlockSize: 100\nmaxBlockSize: 100\n", false, 100, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "blockserver.yaml")
+			if err := os.WriteFile(filename, []byte(tt.yaml), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			config, err := loadConfig(filename)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got block sizes %d to %d, want an error", config.MinBlockSize, config.MaxBlockSize)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.MinBlockSize != tt.min || config.MaxBlockSize != tt.max {
+				t.Errorf("got block sizes %d to %d, want %d to %d", config.MinBlockSize, config.MaxBlockSize, tt.min, tt.max)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/prom"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// serverMetrics collects what we expose at /metrics in the Prometheus
+// text format.  Counters start from zero when the server starts.
+type serverMetrics struct {
+	sync.Mutex
+	requests map[requestKey]*prom.Histogram
+	reports  map[reportKey]uint64
+	users    map[string]*userCounters
+
+	// audits counts audits by result.
+	audits map[string]uint64
+
+	// reportsWaiting counts reports waiting for, or holding, the
+	// server lock to be verified and accepted.
+	reportsWaiting atomic.Int64
+
+	// auditsQueued counts audits waiting for a worker.
+	auditsQueued atomic.Int64
+}
+
+type requestKey struct {
+	path string
+	code int
+}
+
+type reportKey struct {
+	status string
+	result string
+}
+
+type userCounters struct {
+	integers   *big.Int
+	iterations uint64
+	packets    uint64
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		requests: map[requestKey]*prom.Histogram{},
+		reports:  map[reportKey]uint64{},
+		users:    map[string]*userCounters{},
+		audits:   map[string]uint64{},
+	}
+}
+
+// statusRecorder remembers the status code written, and counts the
+// bytes of the body.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+	size int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// instrument measures each request to mux, labelled with the pattern
+// it matched rather than its path, so IDs in paths cannot grow the
+// number of series.
+func (m *serverMetrics) instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "other"
+		}
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		start := time.Now()
+		mux.ServeHTTP(rec, r)
+		d := time.Since(start)
+
+		m.Lock()
+		defer m.Unlock()
+		key := requestKey{path: pattern, code: rec.code}
+		h, found := m.requests[key]
+		if !found {
+			h = prom.NewHistogram(prom.DefaultBuckets)
+			m.requests[key] = h
+		}
+		h.Observe(d.Seconds())
+	})
+}
+
+// report counts the answer to a progress report.
+func (m *serverMetrics) report(status string, resp internal.ReportResponse) {
+	result := "rejected"
+	switch {
+	case resp.Accepted && resp.Message == "already accepted":
+		result = "duplicate"
+	case resp.Accepted:
+		result = "accepted"
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.reports[reportKey{status: status, result: result}]++
+}
+
+// audited counts an audit's result: "passed", "failed", or "dropped".
+func (m *serverMetrics) audited(result string) {
+	m.Lock()
+	defer m.Unlock()
+	m.audits[result]++
+}
+
+// accepted adds a user's accepted packet to their throughput.
+func (m *serverMetrics) accepted(userID string, size *big.Int, iterations uint64) {
+	m.Lock()
+	defer m.Unlock()
+	u, found := m.users[userID]
+	if !found {
+		u = &userCounters{integers: big.NewInt(0)}
+		m.users[userID] = u
+	}
+	u.integers.Add(u.integers, size)
+	u.iterations += iterations
+	u.packets++
+}
+
+// write writes the metrics, including gauges read from the store.
+func (m *serverMetrics) write(ctx context.Context, w io.Writer, st store.Store) {
+	outstanding, err := st.Packets(ctx, store.PacketOutstanding)
+	if err != nil {
+		slog.Error("metrics: reading outstanding packets", "err", err)
+	}
+	frontier, err := st.Frontier(ctx)
+	if err != nil {
+		slog.Error("metrics: reading frontier", "err", err)
+		frontier = big.NewInt(0)
+	}
+
+	prom.WriteHeader(w, prom.ServerPacketsOutstanding, "gauge", "Packets assigned and not yet completed.")
+	fmt.Fprintf(w, "%s %d\n", prom.ServerPacketsOutstanding, len(outstanding))
+	prom.WriteHeader(w, prom.ServerFrontierBitLength, "gauge", "Bit length of the next value to assign.")
+	fmt.Fprintf(w, "%s %d\n", prom.ServerFrontierBitLength, frontier.BitLen())
+	prom.WriteHeader(w, prom.ServerReportsWaiting, "gauge", "Reports waiting to be verified and accepted.")
+	fmt.Fprintf(w, "%s %d\n", prom.ServerReportsWaiting, m.reportsWaiting.Load())
+	prom.WriteHeader(w, prom.ServerAuditsQueued, "gauge", "Audits waiting for a worker.")
+	fmt.Fprintf(w, "%s %d\n", prom.ServerAuditsQueued, m.auditsQueued.Load())
+
+	m.Lock()
+	defer m.Unlock()
+
+	reportKeys := make([]reportKey, 0, len(m.reports))
+	for k := range m.reports {
+		reportKeys = append(reportKeys, k)
+	}
+	sort.Slice(reportKeys, func(i, j int) bool {
+		if reportKeys[i].status != reportKeys[j].status {
+			return reportKeys[i].status < reportKeys[j].status
+		}
+		return reportKeys[i].result < reportKeys[j].result
+	})
+	prom.WriteHeader(w, prom.ServerReports, "counter", "Progress reports, by status and result.")
+	for _, k := range reportKeys {
+		fmt.Fprintf(w, "%s%s %d\n", prom.ServerReports, prom.Labels("status", k.status, "result", k.result), m.reports[k])
+	}
+
+	results := make([]string, 0, len(m.audits))
+	for r := range m.audits {
+		results = append(results, r)
+	}
+	sort.Strings(results)
+	prom.WriteHeader(w, prom.ServerAudits, "counter", "Audits of accepted packets, by result.")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s%s %d\n", prom.ServerAudits, prom.Labels("result", r), m.audits[r])
+	}
+
+	userIDs := make([]string, 0, len(m.users))
+	for id := range m.users {
+		userIDs = append(userIDs, id)
+	}
+	sort.Strings(userIDs)
+	prom.WriteHeader(w, prom.ServerUserIntegers, "counter", "Integers checked in accepted packets, by user.")
+	for _, id := range userIDs {
+		v, _ := new(big.Float).SetInt(m.users[id].integers).Float64()
+		fmt.Fprintf(w, "%s%s %s\n", prom.ServerUserIntegers, prom.Labels("user", id), prom.FormatFloat(v))
+	}
+	prom.WriteHeader(w, prom.ServerUserIterations, "counter", "Iterations in accepted packets, by user.")
+	for _, id := range userIDs {
+		fmt.Fprintf(w, "%s%s %d\n", prom.ServerUserIterations, prom.Labels("user", id), m.users[id].iterations)
+	}
+	prom.WriteHeader(w, prom.ServerUserPackets, "counter", "Accepted packets, by user.")
+	for _, id := range userIDs {
+		fmt.Fprintf(w, "%s%s %d\n", prom.ServerUserPackets, prom.Labels("user", id), m.users[id].packets)
+	}
+
+	requestKeys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		requestKeys = append(requestKeys, k)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		if requestKeys[i].path != requestKeys[j].path {
+			return requestKeys[i].path < requestKeys[j].path
+		}
+		return requestKeys[i].code < requestKeys[j].code
+	})
+	prom.WriteHeader(w, prom.ServerRequestDuration, "histogram", "Latency of API requests, by handler and status code.")
+	for _, k := range requestKeys {
+		m.requests[k].Write(w, prom.ServerRequestDuration, "handler", k.path, "code", strconv.Itoa(k.code))
+	}
+}
+
+// serveMetrics serves /metrics on addr until the context is cancelled.
+func (s *server) serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", prom.ContentType)
+		s.metrics.write(r.Context(), w, s.store)
+	})
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	slog.Info("serving metrics", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("metrics server failed", "err", err)
+	}
+}
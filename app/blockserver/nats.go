@@ -0,0 +1,101 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/skandragon/collatz/internal/natshttp"
+)
+
+// listenNone, as Listen, serves no HTTP listener, for a server reached
+// only over NATS or gRPC.
+const listenNone = "none"
+
+// natsConfig also serves the work API through a NATS server, for a LAN
+// of nodes coordinated without exposing an HTTP listener.  Nodes use a
+// serverURL of "nats://<NATS server>/<prefix>".
+type natsConfig struct {
+	// URL is the NATS server's, such as "nats://localhost:4222",
+	// including any credentials.  Its path is the subject prefix,
+	// "collatz" by default, which nodes must use too.
+	URL string `yaml:"url,omitempty"`
+
+	// Queue is the queue group servers sharing the requests join.  It
+	// defaults to "blockserver".
+	Queue string `yaml:"queue,omitempty"`
+
+	server string
+	prefix string
+}
+
+func (c *natsConfig) applyDefaults() error {
+	if c.URL == "" {
+		return fmt.Errorf("nats.url is required")
+	}
+	var err error
+	c.server, c.prefix, err = natshttp.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("nats.url: %v", err)
+	}
+	if c.Queue == "" {
+		c.Queue = "blockserver"
+	}
+	return nil
+}
+
+// serveNATS answers the work API on the NATS server until ctx is done.
+// Requests are handled by the same routes as HTTP, but for enrollment.
+func (s *server) serveNATS(ctx context.Context) error {
+	config := s.config.NATS
+	conn, err := nats.Connect(config.server,
+		nats.Name("blockserver"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			slog.Warn("disconnected from NATS", "err", err)
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			slog.Info("reconnected to NATS", "server", conn.ConnectedUrlRedacted())
+		}))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	slog.Info("serving over NATS", "server", conn.ConnectedUrlRedacted(), "prefix", config.prefix, "queue", config.Queue)
+	return natshttp.Serve(ctx, conn, config.prefix, config.Queue, refuseEnroll(s.routes()))
+}
+
+// refuseEnroll serves h but for enrollment.  Over NATS, every client
+// has the same address, so failures are not counted against it, and
+// guesses at enrollment codes would go unthrottled; and the
+// credentials would be sent in a reply anyone allowed to subscribe to
+// reply subjects could read.
+func refuseEnroll(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path.Clean(r.URL.Path) == "/api/v1/enroll" {
+			http.Error(w, "enroll over HTTP, not NATS", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// rateSmoothing is the weight given to each new rate sample for a node.
+const rateSmoothing = 0.3
+
+// flaky returns true if this node has lost a significant fraction
+// of the work it was given.
+func flaky(n *store.Node) bool {
+	return n.Expired > 2 && n.Expired*4 > n.Completed
+}
+
+// recordCompletion updates a node's history with a completed packet.
+func recordCompletion(n *store.Node, size *big.Int, started time.Time, completed time.Time) {
+	n.Completed++
+	elapsed := completed.Sub(started).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	sample, _ := new(big.Float).Quo(new(big.Float).SetInt(size), big.NewFloat(elapsed)).Float64()
+	if n.Rate == 0 {
+		n.Rate = sample
+	} else {
+		n.Rate += (sample - n.Rate) * rateSmoothing
+	}
+}
+
+// blockSize returns the packet size to give this node, based on its
+// history.  Nodes without history get the configured default, and
+// flaky nodes get the minimum so less work is lost when they vanish.
+func (s *server) blockSize(n *store.Node) *big.Int {
+	size := s.config.BlockSize
+	switch {
+	case n == nil:
+	case flaky(n):
+		size = s.config.MinBlockSize
+	case n.Rate > 0:
+		size = int64(n.Rate * s.config.TargetPacketDuration.Seconds())
+	}
+	if size < s.config.MinBlockSize {
+		size = s.config.MinBlockSize
+	}
+	if size > s.config.MaxBlockSize {
+		size = s.config.MaxBlockSize
+	}
+	// keep packets starting on odd numbers
+	size -= size % 2
+	return big.NewInt(size)
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"io"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// evidenceBatch is how many reports we read from the store, and write
+// as one row group, at a time.
+const evidenceBatch = 10000
+
+// evidenceRow is one accepted block in the columnar export.  Values
+// beyond 64 bits are written as decimal strings; cast them to a wide
+// integer or decimal type to compute with them.
+type evidenceRow struct {
+	PacketID           string    `parquet:"packet_id,dict"`
+	UserID             string    `parquet:"user_id,dict"`
+	NodeID             string    `parquet:"node_id,dict"`
+	WorkerID           int32     `parquet:"worker_id"`
+	Start              string    `parquet:"start"`
+	End                string    `parquet:"end"`
+	Integers           int64     `parquet:"integers"`
+	StartedOn          time.Time `parquet:"started_on,timestamp"`
+	CompletedOn        time.Time `parquet:"completed_on,timestamp"`
+	ReceivedOn         time.Time `parquet:"received_on,timestamp"`
+	TotalIterations    uint64    `parquet:"total_iterations"`
+	MaxIterations      uint64    `parquet:"max_iterations"`
+	MaxIterationsValue *string   `parquet:"max_iterations_value,optional"`
+	Histogram          []uint64  `parquet:"histogram,list"`
+	Interesting        []string  `parquet:"interesting,list"`
+	Records            []string  `parquet:"records,list"`
+}
+
+func newEvidenceRow(r store.StoredReport, records []string) evidenceRow {
+	work := r.Report.Work
+	row := evidenceRow{
+		PacketID:        r.PacketID,
+		UserID:          r.UserID,
+		NodeID:          r.NodeID,
+		WorkerID:        int32(r.Report.WorkerID),
+		StartedOn:       r.Report.StartedOn,
+		CompletedOn:     r.Report.CompletedOn,
+		ReceivedOn:      r.ReceivedOn,
+		TotalIterations: r.Report.Evidence.TotalIterations,
+		MaxIterations:   r.Report.Evidence.MaxIterations,
+		Histogram:       r.Report.Histogram,
+		Records:         records,
+	}
+	if work.StartingValue != nil && work.EndingValue != nil {
+		row.Start = work.StartingValue.String()
+		row.End = work.EndingValue.String()
+		size := new(big.Int).Sub(work.EndingValue, work.StartingValue)
+		row.Integers = size.Add(size, big.NewInt(1)).Int64()
+	}
+	if r.Report.MaxIterationsValue != nil {
+		v := r.Report.MaxIterationsValue.String()
+		row.MaxIterationsValue = &v
+	}
+	for _, v := range r.Report.Interesting {
+		row.Interesting = append(row.Interesting, v.String())
+	}
+	return row
+}
+
+// recordsByPacket returns the kinds of record each packet holds.
+func recordsByPacket(ctx context.Context, st store.Store) (map[string][]string, error) {
+	ret := map[string][]string{}
+	for _, kind := range store.RecordKinds {
+		records, err := st.Records(ctx, kind)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			ret[r.PacketID] = append(ret[r.PacketID], r.Kind)
+		}
+	}
+	return ret, nil
+}
+
+// writeParquet writes every accepted report still in the database as
+// Parquet, a batch at a time, so the export never holds more than one
+// batch in memory.  Reports which have been archived are not included.
+func writeParquet(ctx context.Context, st store.Store, out io.Writer) error {
+	records, err := recordsByPacket(ctx, st)
+	if err != nil {
+		return err
+	}
+	w := parquet.NewGenericWriter[evidenceRow](out, parquet.Compression(&parquet.Zstd))
+	after := ""
+	for {
+		reports, err := st.ReportsAfter(ctx, after, evidenceBatch)
+		if err != nil {
+			return err
+		}
+		if len(reports) == 0 {
+			break
+		}
+		rows := make([]evidenceRow, len(reports))
+		for i, r := range reports {
+			rows[i] = newEvidenceRow(r, records[r.PacketID])
+		}
+		if _, err := w.Write(rows); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		after = reports[len(reports)-1].PacketID
+	}
+	return w.Close()
+}
+
+// parquetCommand writes the evidence export to filename, or stdout if
+// it is empty or "-".
+func parquetCommand(ctx context.Context, config *serverConfig, st store.Store, filename string) error {
+	if err := prepareStore(ctx, config, st); err != nil {
+		return err
+	}
+	out := os.Stdout
+	if filename != "" && filename != "-" {
+		var err error
+		if out, err = os.Create(filename); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	if err := writeParquet(ctx, st, out); err != nil {
+		return err
+	}
+	if out != os.Stdout {
+		return out.Close()
+	}
+	return nil
+}
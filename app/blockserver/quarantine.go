@@ -0,0 +1,234 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// quarantineConfig lists client builds whose results we no longer
+// accept, as identified by the attestation sent with each completed
+// report.  New reports from them are refused, and their ranges
+// reassigned.  Reports already accepted can be found, and redone by
+// another user, with the quarantine admin API.
+type quarantineConfig struct {
+	Builds []quarantinedBuild `yaml:"builds,omitempty"`
+
+	// RequireAttestation refuses completed reports without an
+	// attestation, as older clients send.
+	RequireAttestation bool `yaml:"requireAttestation,omitempty"`
+}
+
+// quarantinedBuild matches attestations.  Fields left empty match
+// anything, but at least one must be set.
+type quarantinedBuild struct {
+	Version     string `yaml:"version,omitempty"`
+	Engine      string `yaml:"engine,omitempty"`
+	Convention  string `yaml:"convention,omitempty"`
+	Conformance string `yaml:"conformance,omitempty"`
+
+	// Reason is logged, and given to clients whose reports are refused.
+	Reason string `yaml:"reason,omitempty"`
+}
+
+func (c *quarantineConfig) applyDefaults() error {
+	for i, b := range c.Builds {
+		if b.Version == "" && b.Engine == "" && b.Convention == "" && b.Conformance == "" {
+			return fmt.Errorf("quarantine.builds[%d] must set version, engine, convention, or conformance", i)
+		}
+		if b.Reason == "" {
+			c.Builds[i].Reason = "build quarantined"
+		}
+	}
+	return nil
+}
+
+func (b *quarantinedBuild) matches(a *internal.Attestation) bool {
+	return (b.Version == "" || b.Version == a.Version) &&
+		(b.Engine == "" || b.Engine == a.Engine) &&
+		(b.Convention == "" || b.Convention == a.Convention) &&
+		(b.Conformance == "" || b.Conformance == a.Conformance)
+}
+
+// quarantined returns the reason results from a build are refused,
+// or "" if they are not.  A missing attestation matches no build.
+func (c *quarantineConfig) quarantined(a *internal.Attestation) string {
+	if c == nil {
+		return ""
+	}
+	if a == nil {
+		if c.RequireAttestation {
+			return "reports must carry an attestation; upgrade the client"
+		}
+		return ""
+	}
+	for _, b := range c.Builds {
+		if b.matches(a) {
+			return b.Reason
+		}
+	}
+	return ""
+}
+
+// refuseQuarantined refuses a completed report from a quarantined
+// build, reassigning its packet.  It returns true if it did.
+func (s *server) refuseQuarantined(w http.ResponseWriter, r *http.Request, user *store.User, p *store.Packet, report internal.WorkProgressReport) bool {
+	reason := s.config.Quarantine.quarantined(report.Attestation)
+	if reason == "" {
+		return false
+	}
+	ctx := r.Context()
+	attrs := []any{"user", user.UserID, "node", report.NodeInfo.NodeID, "packet", p.ID, "reason", reason}
+	if a := report.Attestation; a != nil {
+		attrs = append(attrs, "version", a.Version, "engine", a.Engine, "convention", a.Convention, "conformance", a.Conformance)
+	}
+	slog.Warn("refusing report from a quarantined build", attrs...)
+	// As with a rejected packet, another node may run it.
+	p.Expiry = time.Now().UTC()
+	p.Status = store.PacketRejected
+	if err := s.store.UpdatePacket(ctx, p); err != nil {
+		internalError(w, err)
+		return true
+	}
+	s.replyReport(w, report, internal.ReportResponse{Message: "results from this build are quarantined: " + reason})
+	return true
+}
+
+// quarantinedReports returns the accepted reports still in the
+// database from quarantined builds, whose packets are completed.
+// Archived reports are not searched.
+func (s *server) quarantinedReports(ctx context.Context) ([]internal.QuarantinedReport, error) {
+	ret := []internal.QuarantinedReport{}
+	after := ""
+	for {
+		reports, err := s.store.ReportsAfter(ctx, after, evidenceBatch)
+		if err != nil {
+			return nil, err
+		}
+		if len(reports) == 0 {
+			return ret, nil
+		}
+		for _, r := range reports {
+			a := r.Report.Attestation
+			reason := s.config.Quarantine.quarantined(a)
+			if reason == "" || a == nil {
+				continue
+			}
+			p, err := s.store.GetPacket(ctx, r.PacketID)
+			if err != nil {
+				return nil, fmt.Errorf("packet %s: %v", r.PacketID, err)
+			}
+			if p.Status != store.PacketCompleted {
+				continue
+			}
+			ret = append(ret, internal.QuarantinedReport{
+				PacketID:      r.PacketID,
+				UserID:        r.UserID,
+				NodeID:        r.NodeID,
+				StartingValue: p.StartingValue,
+				EndingValue:   p.EndingValue,
+				ReceivedOn:    r.ReceivedOn,
+				Filter:        p.Filter,
+				Attestation:   a,
+				Reason:        reason,
+			})
+		}
+		after = reports[len(reports)-1].PacketID
+	}
+}
+
+// pendingChecks maps the packets with a double check queued, running,
+// or completed, to the check.
+func (s *server) pendingChecks(ctx context.Context) (map[string]string, error) {
+	ret := map[string]string{}
+	for _, status := range []string{store.PacketVerify, store.PacketOutstanding, store.PacketExpired, store.PacketCompleted} {
+		packets, err := s.store.Packets(ctx, status)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range packets {
+			if p.Verifies != "" {
+				ret[p.Verifies] = p.ID
+			}
+		}
+	}
+	return ret, nil
+}
+
+// handleQuarantine lists the accepted reports from quarantined builds.
+// POST also queues a double check of each, which another user must
+// run; if it disagrees, the packet is reassigned.
+func (s *server) handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.config.Quarantine == nil {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := r.Context()
+	s.Lock()
+	defer s.Unlock()
+	reports, err := s.quarantinedReports(ctx)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	checks, err := s.pendingChecks(ctx)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	queued := 0
+	for i := range reports {
+		q := &reports[i]
+		q.CheckID = checks[q.PacketID]
+		if q.CheckID != "" || r.Method != http.MethodPost {
+			continue
+		}
+		check := &store.Packet{
+			WorkPacket: internal.WorkPacket{
+				ID:            randomString(),
+				Nonce:         randomString(),
+				StartingValue: q.StartingValue,
+				EndingValue:   q.EndingValue,
+				AssignedOn:    time.Now().UTC(),
+				Filter:        q.Filter,
+			},
+			Status:   store.PacketVerify,
+			Verifies: q.PacketID,
+		}
+		if err := s.store.AddPacket(ctx, check); err != nil {
+			internalError(w, err)
+			return
+		}
+		q.CheckID = check.ID
+		queued++
+	}
+	if queued > 0 {
+		slog.Info("queued double checks of reports from quarantined builds", "queued", queued, "reports", len(reports))
+	}
+	writeJSON(w, internal.QuarantineResponse{Reports: reports})
+}
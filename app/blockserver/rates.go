@@ -0,0 +1,126 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// maxRatePoints bounds the size of a rates response.
+const maxRatePoints = 10000
+
+// rateSamples returns the samples which add a completed packet to the
+// throughput history of its user, and of all users.
+func rateSamples(receipt internal.Receipt, size *big.Int) []store.RateSample {
+	ret := []store.RateSample{}
+	for _, userID := range []string{receipt.UserID, store.AllUsers} {
+		ret = append(ret, store.RateSample{
+			UserID:     userID,
+			Start:      receipt.AcceptedOn,
+			Integers:   size.Int64(),
+			Iterations: int64(receipt.Evidence.TotalIterations),
+			Packets:    1,
+		})
+	}
+	return ret
+}
+
+// parseDuration parses a query parameter, returning def if it is missing.
+func parseDuration(r *http.Request, name string, def time.Duration) (time.Duration, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return d, nil
+}
+
+// handleRates returns throughput history for the user, or with
+// scope=global, for everyone.  The history covers the "window" (default
+// a day) up to now, in "step" sized points (default an hour).
+func (s *server) handleRates(w http.ResponseWriter, r *http.Request, user *store.User) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := user.UserID
+	switch r.URL.Query().Get("scope") {
+	case "", "user":
+	case "global":
+		userID = store.AllUsers
+	default:
+		http.Error(w, "scope must be user or global", http.StatusBadRequest)
+		return
+	}
+	window, err := parseDuration(r, "window", 24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	step, err := parseDuration(r, "step", time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if step < store.RateBucket {
+		step = store.RateBucket
+	}
+	if window/step > maxRatePoints {
+		http.Error(w, "too many points; use a larger step", http.StatusBadRequest)
+		return
+	}
+
+	to := time.Now().UTC().Truncate(step).Add(step)
+	from := to.Add(-window).Truncate(step)
+	samples, err := s.store.RateSamples(r.Context(), userID, from, to)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, internal.RatesResponse{Step: step, Points: ratePoints(samples, from, to, step)})
+}
+
+// ratePoints sums samples into step sized points covering [from, to),
+// including points with no work, so graphs show gaps as zero.
+func ratePoints(samples []store.RateSample, from, to time.Time, step time.Duration) []internal.RatePoint {
+	points := []internal.RatePoint{}
+	for t := from; t.Before(to); t = t.Add(step) {
+		points = append(points, internal.RatePoint{Start: t})
+	}
+	for _, sample := range samples {
+		i := int(sample.Start.Sub(from) / step)
+		if i < 0 || i >= len(points) {
+			continue
+		}
+		points[i].Integers += sample.Integers
+		points[i].Iterations += sample.Iterations
+		points[i].Packets += sample.Packets
+	}
+	for i := range points {
+		points[i].Rate = float64(points[i].Integers) / step.Seconds()
+	}
+	return points
+}
@@ -0,0 +1,341 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/auth"
+	"github.com/skandragon/collatz/internal/store"
+	"github.com/skandragon/collatz/internal/store/instrumented"
+	"github.com/skandragon/collatz/internal/trace"
+)
+
+// maxRequestSize limits request bodies, after any decompression.
+const maxRequestSize = 16 << 20
+
+type server struct {
+	// The lock serializes read-modify-write sequences against the
+	// store, such as updating node history.
+	sync.Mutex
+	config *serverConfig
+	store  store.Store
+
+	// origin is the first value this server was configured to assign.
+	origin *big.Int
+
+	gc *collector
+
+	// storeMetrics measures the store's operations.
+	storeMetrics *instrumented.Metrics
+
+	metrics *serverMetrics
+
+	// tracer is nil unless tracing is configured.
+	tracer *trace.Tracer
+
+	// signer, if set, signs the work packets we assign.
+	signer ed25519.PrivateKey
+
+	// secrets checks the secrets users authenticate with.
+	secrets *auth.SecretChecker
+
+	// tokens, if set, issues bearer tokens at login.
+	tokens *tokenIssuer
+
+	lockouts *lockouts
+
+	// audits, if set, holds the reports waiting to be audited.
+	audits chan audit
+}
+
+func newServer(ctx context.Context, config *serverConfig, st store.Store, metrics *instrumented.Metrics) (*server, error) {
+	next, ok := big.NewInt(0).SetString(config.StartingValue, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid startingValue %q", config.StartingValue)
+	}
+	if next.Bit(0) == 0 {
+		next.Add(next, big.NewInt(1))
+	}
+	if err := st.InitFrontier(ctx, next); err != nil {
+		return nil, fmt.Errorf("initializing frontier: %v", err)
+	}
+	for _, u := range config.Users {
+		user := store.User{
+			UserID:            u.UserID,
+			UserSecretVersion: u.UserSecretVersion,
+			UserSecret:        u.UserSecret,
+		}
+		if config.hashSecrets() {
+			user.UserSecret = auth.HashSecret(user.Credentials())
+		}
+		if err := st.PutUser(ctx, user); err != nil {
+			return nil, fmt.Errorf("adding user %s: %v", u.UserID, err)
+		}
+	}
+	if config.hashSecrets() {
+		warnPlaintextSecrets(ctx, st)
+	}
+	s := &server{
+		config:       config,
+		store:        st,
+		origin:       next,
+		gc:           newCollector(&config.GC, st),
+		storeMetrics: metrics,
+		metrics:      newServerMetrics(),
+		secrets:      auth.NewSecretChecker(),
+		lockouts:     newLockouts(&config.Lockout),
+	}
+	if config.Audit != nil {
+		s.audits = make(chan audit, config.Audit.QueueSize)
+	}
+	if config.Tokens != nil {
+		tokens, err := newTokenIssuer(ctx, config.Tokens)
+		if err != nil {
+			return nil, err
+		}
+		s.tokens = tokens
+	}
+	if config.Signing != nil {
+		key, err := loadSigningKey(ctx, config.Signing)
+		if err != nil {
+			return nil, err
+		}
+		s.signer = key
+		slog.Info("signing work packets", "publicKey", publicKey(key))
+	}
+	return s, nil
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	if s.tokens != nil {
+		mux.HandleFunc("/api/v1/login", s.authenticated(scopeLogin, s.handleLogin))
+	}
+	if s.config.Enrollment != nil {
+		mux.HandleFunc("/api/v1/enroll", s.handleEnroll)
+	}
+	mux.HandleFunc("/api/v1/claim", s.authenticated(internal.ScopeWork, s.handleClaim))
+	mux.HandleFunc("/api/v1/report", s.authenticated(internal.ScopeWork, s.handleReport))
+	mux.HandleFunc("/api/v1/receipts", s.authenticated(internal.ScopeRead, s.handleReceipts))
+	mux.HandleFunc("/api/v1/trajectory", s.authenticated(internal.ScopeWork, s.handleTrajectory))
+	mux.HandleFunc("/api/v1/crash", s.authenticated(internal.ScopeWork, s.handleCrash))
+	mux.HandleFunc("/api/v1/progress", s.authenticated(internal.ScopeRead, s.handleProgress))
+	mux.HandleFunc("/api/v1/rates", s.authenticated(internal.ScopeRead, s.handleRates))
+	mux.HandleFunc("/api/v1/export/", s.authenticated(internal.ScopeRead, s.handleExport))
+	mux.HandleFunc("/api/v1/graphql", s.authenticated(internal.ScopeRead, s.handleGraphQL()))
+	if s.config.Admin == nil {
+		s.adminRoutes(mux)
+	}
+	var h http.Handler = s.traced(mux, s.metrics.instrument(mux))
+	if s.config.AccessLog != nil {
+		h = newAccessLog(s.config.AccessLog).handler(h)
+	}
+	return serverTime(decompress(h))
+}
+
+// traced continues the caller's trace, if any, with a span for each
+// request, named for the pattern it matched in mux.
+func (s *server) traced(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		ctx := trace.Extract(r.Context(), r.Header)
+		ctx, span := s.tracer.Start(ctx, r.Method+" "+pattern, trace.KindServer)
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", pattern)
+		span.SetAttribute("http.status_code", rec.code)
+		span.End()
+	})
+}
+
+// decompress transparently handles gzip request bodies, and advertises
+// that we accept them using the Accept-Encoding response header (RFC 7694).
+func decompress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Encoding", "gzip")
+		switch r.Header.Get("Content-Encoding") {
+		case "", "identity":
+			r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+		case "gzip":
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "invalid gzip body", http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			r.Body = http.MaxBytesReader(w, gz, maxRequestSize)
+			r.Header.Del("Content-Encoding")
+		default:
+			http.Error(w, "unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serverTime attaches our idea of the current time to every response,
+// so clients can estimate their clock skew.
+func serverTime(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(internal.ServerTimeHeader, time.Now().UTC().Format(time.RFC3339Nano))
+		next.ServeHTTP(w, r)
+	})
+}
+
+type userHandlerFunc func(w http.ResponseWriter, r *http.Request, user *store.User)
+
+// scopeLogin marks the login handler, which only the user secret can
+// authenticate.
+const scopeLogin = "login"
+
+// authFailure is an error to be returned as 401 Unauthorized.
+type authFailure string
+
+func (e authFailure) Error() string {
+	return string(e)
+}
+
+// authenticated requires a user, authenticated by a bearer token which
+// allows scope, or unless tokens are required, by the user's secret.
+// Clients, and users guessing at secrets, which fail too often are
+// locked out.
+func (s *server) authenticated(scope string, next userHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var user *store.User
+		var err error
+		token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		userID, _, basic := r.BasicAuth()
+		if s.lockedOut(w, r, userID) {
+			return
+		}
+		switch {
+		case s.tokens != nil && scope != scopeLogin && bearer:
+			userID = ""
+			user, err = s.tokenUser(r.Context(), token, scope)
+		case s.tokens != nil && scope != scopeLogin && s.config.Tokens.Required:
+			err = authFailure("a token is required; log in first")
+		default:
+			user, err = s.secretUser(r)
+		}
+		var failure authFailure
+		if errors.As(err, &failure) {
+			// Requests with no credentials at all are not guesses.
+			if bearer || basic {
+				s.authFailed(r.Context(), r, userID, failure.Error())
+			}
+			http.Error(w, failure.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		next(w, r, user)
+	}
+}
+
+// secretUser returns the user authenticated by their secret.
+func (s *server) secretUser(r *http.Request) (*store.User, error) {
+	userID, secret, ok := r.BasicAuth()
+	if !ok {
+		return nil, authFailure("authentication required")
+	}
+	user, err := s.store.GetUser(r.Context(), userID)
+	if errors.Is(err, store.ErrNotFound) || (err == nil && !s.secrets.Check(user.UserID, user.UserSecretVersion, user.UserSecret, secret)) {
+		return nil, authFailure("invalid credentials")
+	}
+	return user, err
+}
+
+// tokenUser returns the user a token was minted for, if it allows
+// scope.  Rotating the user's secret revokes their tokens.
+func (s *server) tokenUser(ctx context.Context, token string, scope string) (*store.User, error) {
+	claims, err := s.tokens.parse(token, time.Now())
+	if err != nil {
+		return nil, authFailure(err.Error())
+	}
+	if !claims.allows(scope) {
+		return nil, authFailure(fmt.Sprintf("token does not allow %s", scope))
+	}
+	user, err := s.store.GetUser(ctx, claims.UserID)
+	if errors.Is(err, store.ErrNotFound) || (err == nil && user.UserSecretVersion != claims.SecretVersion) {
+		return nil, authFailure("token revoked")
+	}
+	return user, err
+}
+
+// admin requires the configured admin token as a bearer token.  On
+// the public listener, the admin API is disabled if no token is
+// configured.  On the admin listener, the client's certificate is
+// enough, though the token is still required if set, and the client's
+// address must be allowed.
+func (s *server) admin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config.Admin != nil && !s.config.Admin.allows(remoteHost(r)) {
+			slog.Warn("admin request from a disallowed address", "remote", r.RemoteAddr, "subject", clientSubject(r), "path", r.URL.Path)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if s.config.Admin == nil && s.config.AdminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if s.config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) != 1 {
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func internalError(w http.ResponseWriter, err error) {
+	slog.Error("internal error", "err", err)
+	http.Error(w, "internal error", http.StatusInternalServerError)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("writing response", "err", err)
+	}
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+)
+
+// loadSigningKey loads the key used to sign work packets.  It is an
+// Ed25519 seed, 32 random bytes in base64, as printed by "blockserver
+// keygen".
+func loadSigningKey(ctx context.Context, c *masterKeyConfig) (ed25519.PrivateKey, error) {
+	seed, err := c.load(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading signing key: %v", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("signing key is %d bytes, not %d", len(seed), ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// publicKey returns the public half of a signing key, in base64, as
+// given to clients as serverPublicKey.
+func publicKey(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// publicKeyCommand prints the public key for the configured signing key.
+func publicKeyCommand(ctx context.Context, config *serverConfig) error {
+	if config.Signing == nil {
+		return fmt.Errorf("signing is not configured")
+	}
+	key, err := loadSigningKey(ctx, config.Signing)
+	if err != nil {
+		return err
+	}
+	fmt.Println(publicKey(key))
+	return nil
+}
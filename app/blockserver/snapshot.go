@@ -0,0 +1,185 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/skandragon/collatz/internal/intervals"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// snapshotVersion is incremented when the snapshot format changes
+// incompatibly.
+const snapshotVersion = 1
+
+// snapshot is a portable copy of the state needed to carry on
+// assigning work: who may claim it, where the frontier is, what has
+// been done, what has been found, and what is still out.  Reports and
+// receipts are not included; see the archive and backup settings.
+type snapshot struct {
+	Version   int                  `json:"version"`
+	CreatedOn time.Time            `json:"createdOn"`
+	Frontier  *big.Int             `json:"frontier"`
+	Users     []store.User         `json:"users"`
+	Completed []intervals.Interval `json:"completed"`
+	Records   []store.Record       `json:"records"`
+	Packets   []*store.Packet      `json:"packets"`
+}
+
+func takeSnapshot(ctx context.Context, st store.Store) (*snapshot, error) {
+	var err error
+	snap := &snapshot{Version: snapshotVersion, CreatedOn: time.Now().UTC()}
+	if snap.Frontier, err = st.Frontier(ctx); err != nil {
+		return nil, fmt.Errorf("reading frontier: %v", err)
+	}
+	if snap.Users, err = st.Users(ctx); err != nil {
+		return nil, fmt.Errorf("reading users: %v", err)
+	}
+	completed, err := st.CompletedRanges(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading completed ranges: %v", err)
+	}
+	snap.Completed = completed.Intervals()
+	for _, kind := range store.RecordKinds {
+		records, err := st.Records(ctx, kind)
+		if err != nil {
+			return nil, fmt.Errorf("reading records: %v", err)
+		}
+		snap.Records = append(snap.Records, records...)
+	}
+	// Rejected packets are outstanding as far as reassignment goes.
+	for _, status := range []string{store.PacketOutstanding, store.PacketRejected} {
+		packets, err := st.Packets(ctx, status)
+		if err != nil {
+			return nil, fmt.Errorf("reading packets: %v", err)
+		}
+		snap.Packets = append(snap.Packets, packets...)
+	}
+	return snap, nil
+}
+
+// restoreSnapshot loads a snapshot into an empty store.
+func restoreSnapshot(ctx context.Context, st store.Store, snap *snapshot) error {
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("snapshot version %d is not supported (want %d)", snap.Version, snapshotVersion)
+	}
+	if snap.Frontier == nil {
+		return errors.New("snapshot has no frontier")
+	}
+	_, err := st.Frontier(ctx)
+	if err == nil {
+		return errors.New("database already holds state; import needs an empty database")
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+
+	for _, u := range snap.Users {
+		if err := st.PutUser(ctx, u); err != nil {
+			return fmt.Errorf("importing user %s: %v", u.UserID, err)
+		}
+	}
+	for _, iv := range snap.Completed {
+		if err := st.AddCompletedRange(ctx, iv); err != nil {
+			return fmt.Errorf("importing completed range: %v", err)
+		}
+	}
+	for _, r := range snap.Records {
+		if err := st.AddRecord(ctx, r); err != nil {
+			return fmt.Errorf("importing record: %v", err)
+		}
+	}
+	for _, p := range snap.Packets {
+		if err := st.AddPacket(ctx, p); err != nil {
+			return fmt.Errorf("importing packet %s: %v", p.ID, err)
+		}
+	}
+	// The frontier goes last, so a failed import leaves the database
+	// looking empty, and newServer will not initialize it over us.
+	if err := st.InitFrontier(ctx, snap.Frontier); err != nil {
+		return fmt.Errorf("importing frontier: %v", err)
+	}
+	return nil
+}
+
+// exportCommand writes a snapshot to filename, or stdout if it is
+// empty or "-".
+func exportCommand(ctx context.Context, config *serverConfig, st store.Store, filename string) error {
+	if err := prepareStore(ctx, config, st); err != nil {
+		return err
+	}
+	snap, err := takeSnapshot(ctx, st)
+	if err != nil {
+		return err
+	}
+	out := os.Stdout
+	if filename != "" && filename != "-" {
+		if out, err = os.Create(filename); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(snap); err != nil {
+		return err
+	}
+	if out != os.Stdout {
+		if err := out.Close(); err != nil {
+			return err
+		}
+	}
+	slog.Info("exported snapshot", "users", len(snap.Users), "completed", len(snap.Completed),
+		"records", len(snap.Records), "packets", len(snap.Packets))
+	return nil
+}
+
+// importCommand loads a snapshot from filename, or stdin if it is
+// empty or "-", into an empty database.
+func importCommand(ctx context.Context, config *serverConfig, st store.Store, filename string) error {
+	if err := prepareStore(ctx, config, st); err != nil {
+		return err
+	}
+	var r io.Reader = os.Stdin
+	if filename != "" && filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	var snap snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return fmt.Errorf("reading snapshot: %v", err)
+	}
+	if err := restoreSnapshot(ctx, st, &snap); err != nil {
+		return err
+	}
+	slog.Info("imported snapshot", "users", len(snap.Users), "completed", len(snap.Completed),
+		"records", len(snap.Records), "packets", len(snap.Packets))
+	return nil
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/skandragon/collatz/internal/store"
+	"github.com/skandragon/collatz/internal/store/encrypted"
+	"github.com/skandragon/collatz/internal/store/instrumented"
+	"github.com/skandragon/collatz/internal/store/memory"
+	"github.com/skandragon/collatz/internal/store/postgres"
+	"github.com/skandragon/collatz/internal/store/sqlite"
+)
+
+// openStore opens the storage backend selected in the config, measuring
+// its operations into metrics, and sealing user secrets if encryption
+// is configured.
+func openStore(ctx context.Context, config *serverConfig, metrics *instrumented.Metrics) (store.Store, error) {
+	backend, err := openBackend(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	var st store.Store = instrumented.New(backend, metrics)
+	if config.Encryption == nil {
+		return st, nil
+	}
+	keys, err := loadKeyring(ctx, config.Encryption)
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+	return encrypted.New(st, keys), nil
+}
+
+func openBackend(ctx context.Context, config *serverConfig) (store.Store, error) {
+	switch config.DatabaseDriver {
+	case "sqlite":
+		return sqlite.Open(config.Database)
+	case "postgres":
+		return postgres.Open(ctx, config.Database)
+	case "memory":
+		return memory.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown databaseDriver %q", config.DatabaseDriver)
+	}
+}
+
+// handleStoreMetrics returns the store's latency histograms and error
+// counts.
+func (s *server) handleStoreMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.storeMetrics.Snapshot())
+}
@@ -0,0 +1,227 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsConfig has the server terminate TLS itself, with either a
+// certificate we are given, or one obtained automatically by ACME.
+type tlsConfig struct {
+	// CertFile and KeyFile are the certificate chain and its key, in
+	// PEM.  They are reloaded when they change, so a renewed
+	// certificate is picked up without a restart.
+	CertFile string `yaml:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile,omitempty"`
+
+	// ACME, if set, obtains and renews certificates automatically,
+	// from Let's Encrypt unless configured otherwise.
+	ACME *acmeConfig `yaml:"acme,omitempty"`
+
+	// MinVersion is "1.2" (the default) or "1.3".
+	MinVersion string `yaml:"minVersion,omitempty"`
+
+	// HTTPListen, if set, is an address such as ":80" on which we
+	// redirect plain HTTP to HTTPS, and answer ACME HTTP challenges.
+	// Without it, ACME can only use TLS-ALPN challenges, which need
+	// Listen to be port 443.
+	HTTPListen string `yaml:"httpListen,omitempty"`
+}
+
+type acmeConfig struct {
+	// Domains are the names we obtain certificates for.  Requests for
+	// others are refused.
+	Domains []string `yaml:"domains,omitempty"`
+
+	// Email is given to the CA, to warn of problems with certificates.
+	Email string `yaml:"email,omitempty"`
+
+	// AcceptTOS must be true, accepting the CA's terms of service.
+	AcceptTOS bool `yaml:"acceptTOS,omitempty"`
+
+	// CacheDir holds the certificates and account key, and defaults
+	// to "autocert".  Replicas may share it.
+	CacheDir string `yaml:"cacheDir,omitempty"`
+
+	// DirectoryURL is the CA's ACME directory, by default Let's
+	// Encrypt's.  Its staging directory is useful when testing.
+	DirectoryURL string `yaml:"directoryURL,omitempty"`
+}
+
+func (c *tlsConfig) applyDefaults() error {
+	switch c.MinVersion {
+	case "":
+		c.MinVersion = "1.2"
+	case "1.2", "1.3":
+	default:
+		return fmt.Errorf("tls.minVersion must be 1.2 or 1.3, not %q", c.MinVersion)
+	}
+	if c.ACME == nil {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return fmt.Errorf("tls requires certFile and keyFile, or acme")
+		}
+		return nil
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		return fmt.Errorf("tls.acme cannot be used with certFile and keyFile")
+	}
+	if len(c.ACME.Domains) == 0 {
+		return fmt.Errorf("tls.acme.domains is required")
+	}
+	if !c.ACME.AcceptTOS {
+		return fmt.Errorf("tls.acme.acceptTOS must be true, accepting the CA's terms of service")
+	}
+	if c.ACME.CacheDir == "" {
+		c.ACME.CacheDir = "autocert"
+	}
+	if c.ACME.DirectoryURL == "" {
+		c.ACME.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	return nil
+}
+
+// listener sets up what we need to serve TLS on listen: the server's
+// TLS configuration, and the handler for HTTPListen.
+func (c *tlsConfig) listener(listen string) (*tls.Config, http.Handler, error) {
+	var ret *tls.Config
+	var plain http.Handler = redirectHTTPS(listen)
+	if c.ACME != nil {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(c.ACME.CacheDir),
+			HostPolicy: autocert.HostWhitelist(c.ACME.Domains...),
+			Email:      c.ACME.Email,
+			Client:     &acme.Client{DirectoryURL: c.ACME.DirectoryURL},
+		}
+		ret = m.TLSConfig()
+		plain = m.HTTPHandler(plain)
+	} else {
+		kp := &keyPair{certFile: c.CertFile, keyFile: c.KeyFile}
+		if _, err := kp.load(time.Now()); err != nil {
+			return nil, nil, err
+		}
+		ret = &tls.Config{GetCertificate: kp.getCertificate}
+	}
+	ret.MinVersion = tls.VersionTLS12
+	if c.MinVersion == "1.3" {
+		ret.MinVersion = tls.VersionTLS13
+	}
+	return ret, plain, nil
+}
+
+// redirectHTTPS sends plain HTTP requests to the same URL over HTTPS,
+// served on listen.  Clients should be configured with https URLs, as
+// a redirected request has already sent its credentials in the clear.
+func redirectHTTPS(listen string) http.Handler {
+	_, port, _ := net.SplitHostPort(listen)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// keyPairCheckInterval is how often we look for a changed certificate.
+const keyPairCheckInterval = time.Minute
+
+// keyPair is a certificate loaded from files, and reloaded when they
+// change.  If a reload fails, we keep using the last good certificate.
+type keyPair struct {
+	sync.Mutex
+	certFile, keyFile string
+	cert              *tls.Certificate
+	modified          time.Time
+	checked           time.Time
+}
+
+func (kp *keyPair) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return kp.load(time.Now())
+}
+
+func (kp *keyPair) load(now time.Time) (*tls.Certificate, error) {
+	kp.Lock()
+	defer kp.Unlock()
+	if kp.cert != nil && now.Sub(kp.checked) < keyPairCheckInterval {
+		return kp.cert, nil
+	}
+	kp.checked = now
+	modified, err := kp.lastModified()
+	if err == nil && kp.cert != nil && !modified.After(kp.modified) {
+		return kp.cert, nil
+	}
+	var cert tls.Certificate
+	if err == nil {
+		cert, err = tls.LoadX509KeyPair(kp.certFile, kp.keyFile)
+	}
+	if err != nil {
+		if kp.cert == nil {
+			return nil, fmt.Errorf("loading TLS certificate: %v", err)
+		}
+		slog.Error("cannot reload TLS certificate; using the last one loaded", "certFile", kp.certFile, "err", err)
+		return kp.cert, nil
+	}
+	if kp.cert != nil {
+		slog.Info("reloaded TLS certificate", "certFile", kp.certFile)
+	}
+	kp.cert, kp.modified = &cert, modified
+	return kp.cert, nil
+}
+
+// lastModified returns the later modification time of the files.
+func (kp *keyPair) lastModified() (time.Time, error) {
+	var ret time.Time
+	for _, name := range []string{kp.certFile, kp.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(ret) {
+			ret = fi.ModTime()
+		}
+	}
+	return ret, nil
+}
+
+// serveHTTP serves the redirect and ACME challenges on HTTPListen.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler) {
+	srv := &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	slog.Info("redirecting HTTP to HTTPS", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("HTTP listener failed", "addr", addr, "err", err)
+	}
+}
@@ -0,0 +1,201 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/store"
+	"github.com/zeebo/blake3"
+)
+
+// tokenConfig enables short-lived bearer tokens, minted at login from
+// a user's secret, so the secret is not sent with every request.
+type tokenConfig struct {
+	// Lifetime is how long a token is valid.  The default is 1h.
+	Lifetime time.Duration `yaml:"lifetime,omitempty"`
+
+	// Key, if set, is where to find the key tokens are signed with,
+	// 32 random bytes in base64, as from "blockserver keygen".  It
+	// must be shared by replicas.  If it is not set, a random key is
+	// used, and tokens do not survive a restart.
+	Key *masterKeyConfig `yaml:"key,omitempty"`
+
+	// Required refuses the user secret on every request but login.
+	Required bool `yaml:"required,omitempty"`
+}
+
+func (c *tokenConfig) applyDefaults() error {
+	if c.Lifetime < 0 {
+		return fmt.Errorf("tokens.lifetime cannot be negative")
+	}
+	if c.Lifetime == 0 {
+		c.Lifetime = time.Hour
+	}
+	return nil
+}
+
+// tokenPrefix starts every token, so they are recognizable, and the
+// format can change.
+const tokenPrefix = "ct1."
+
+// allScopes lists every scope, as granted by default.
+var allScopes = []string{internal.ScopeWork, internal.ScopeRead}
+
+// tokenClaims are what a token asserts.
+type tokenClaims struct {
+	UserID        string   `json:"u"`
+	SecretVersion string   `json:"v"`
+	Scopes        []string `json:"s"`
+	ExpiresOn     int64    `json:"e"`
+}
+
+// tokenIssuer mints and checks tokens.
+type tokenIssuer struct {
+	config *tokenConfig
+	key    []byte
+}
+
+func newTokenIssuer(ctx context.Context, c *tokenConfig) (*tokenIssuer, error) {
+	t := &tokenIssuer{config: c}
+	if c.Key != nil {
+		key, err := c.Key.load(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("loading token key: %v", err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("token key is %d bytes, not 32", len(key))
+		}
+		t.key = key
+	} else {
+		t.key = make([]byte, 32)
+		if _, err := rand.Read(t.key); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *tokenIssuer) mac(payload string) string {
+	h, err := blake3.NewKeyed(t.key)
+	if err != nil {
+		// only possible if the key is not 32 bytes
+		panic(err)
+	}
+	io.WriteString(h, payload)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// mint returns a new token for the user.
+func (t *tokenIssuer) mint(user *store.User, scopes []string, now time.Time) (internal.LoginResponse, error) {
+	expiresOn := now.Add(t.config.Lifetime).UTC().Truncate(time.Second)
+	b, err := json.Marshal(tokenClaims{
+		UserID:        user.UserID,
+		SecretVersion: user.UserSecretVersion,
+		Scopes:        scopes,
+		ExpiresOn:     expiresOn.Unix(),
+	})
+	if err != nil {
+		return internal.LoginResponse{}, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return internal.LoginResponse{
+		Token:     tokenPrefix + payload + "." + t.mac(payload),
+		Scopes:    scopes,
+		ExpiresOn: expiresOn,
+	}, nil
+}
+
+// parse returns the claims of a token, if it is one we minted and it
+// has not expired.
+func (t *tokenIssuer) parse(token string, now time.Time) (*tokenClaims, error) {
+	payload, mac, ok := strings.Cut(strings.TrimPrefix(token, tokenPrefix), ".")
+	if !ok || !strings.HasPrefix(token, tokenPrefix) {
+		return nil, errors.New("malformed token")
+	}
+	if subtle.ConstantTimeCompare([]byte(mac), []byte(t.mac(payload))) != 1 {
+		return nil, errors.New("invalid token")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errors.New("malformed token")
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, errors.New("malformed token")
+	}
+	if now.Unix() >= claims.ExpiresOn {
+		return nil, errors.New("token expired")
+	}
+	return &claims, nil
+}
+
+func (c *tokenClaims) allows(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// handleLogin mints a token for a user who authenticated with their
+// secret.
+func (s *server) handleLogin(w http.ResponseWriter, r *http.Request, user *store.User) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req internal.LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scopes := req.Scopes
+	if len(scopes) == 0 {
+		scopes = allScopes
+	}
+	for _, scope := range scopes {
+		known := false
+		for _, k := range allScopes {
+			known = known || scope == k
+		}
+		if !known {
+			http.Error(w, fmt.Sprintf("unknown scope %q", scope), http.StatusBadRequest)
+			return
+		}
+	}
+	resp, err := s.tokens.mint(user, scopes, time.Now())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	slog.Debug("issued token", "user", user.UserID, "scopes", scopes, "expiresOn", resp.ExpiresOn)
+	writeJSON(w, resp)
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// trajectoryConfig asks clients for the trajectories of their
+// findings.  Findings are rare, so this costs little, and the
+// trajectory is the complete evidence for one.
+type trajectoryConfig struct {
+	// Format is "parity" (the default) or "full".
+	Format string `yaml:"format,omitempty"`
+
+	// MaxSteps bounds the length of a trajectory.
+	MaxSteps uint64 `yaml:"maxSteps,omitempty"`
+}
+
+func (c *trajectoryConfig) applyDefaults() error {
+	switch c.Format {
+	case "":
+		c.Format = internal.TrajectoryParity
+	case internal.TrajectoryParity, internal.TrajectoryFull:
+	default:
+		return fmt.Errorf("trajectories: unknown format %q", c.Format)
+	}
+	if c.MaxSteps == 0 {
+		c.MaxSteps = 1 << 20
+	}
+	return nil
+}
+
+// trajectoryRequests asks for the trajectory of each new record.
+func (s *server) trajectoryRequests(records []store.Record) []internal.TrajectoryRequest {
+	config := s.config.Trajectories
+	if config == nil {
+		return nil
+	}
+	ret := []internal.TrajectoryRequest{}
+	for _, r := range records {
+		if r.Value == nil {
+			continue
+		}
+		ret = append(ret, internal.TrajectoryRequest{
+			PacketID: r.PacketID,
+			Value:    r.Value,
+			Format:   config.Format,
+			MaxSteps: config.MaxSteps,
+		})
+	}
+	return ret
+}
+
+// finding returns true if the user holds a record for the value in the
+// packet given.
+func (s *server) finding(r *http.Request, user *store.User, packetID string, value *big.Int) (bool, error) {
+	for _, kind := range store.RecordKinds {
+		records, err := s.store.Records(r.Context(), kind)
+		if err != nil {
+			return false, err
+		}
+		for _, record := range records {
+			if record.Value != nil && record.Value.Cmp(value) == 0 &&
+				record.PacketID == packetID && record.UserID == user.UserID {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// handleTrajectory stores a trajectory we asked for on POST, after
+// checking it by computing it ourselves.  On GET, it returns the
+// trajectory stored for the "value" given.
+func (s *server) handleTrajectory(w http.ResponseWriter, r *http.Request, user *store.User) {
+	switch r.Method {
+	case http.MethodGet:
+		value, ok := new(big.Int).SetString(r.URL.Query().Get("value"), 10)
+		if !ok {
+			http.Error(w, "invalid value", http.StatusBadRequest)
+			return
+		}
+		t, err := s.store.GetTrajectory(r.Context(), value)
+		if errors.Is(err, store.ErrNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		writeJSON(w, t)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config := s.config.Trajectories
+	if config == nil {
+		writeJSON(w, internal.TrajectoryResponse{Message: "trajectories are not collected"})
+		return
+	}
+	var t internal.Trajectory
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if t.Value == nil || t.Format != config.Format {
+		writeJSON(w, internal.TrajectoryResponse{Message: "trajectory not requested"})
+		return
+	}
+	found, err := s.finding(r, user, t.PacketID, t.Value)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if !found {
+		writeJSON(w, internal.TrajectoryResponse{Message: "trajectory not requested"})
+		return
+	}
+	expected := internal.ComputeTrajectory(internal.TrajectoryRequest{
+		PacketID: t.PacketID,
+		Value:    t.Value,
+		Format:   config.Format,
+		MaxSteps: config.MaxSteps,
+	})
+	if !expected.Equal(t) {
+		slog.Warn("incorrect trajectory", "user", user.UserID, "value", t.Value)
+		writeJSON(w, internal.TrajectoryResponse{Message: "trajectory mismatch"})
+		return
+	}
+	err = s.store.AddTrajectory(r.Context(), store.StoredTrajectory{
+		UserID:     user.UserID,
+		ReceivedOn: time.Now().UTC(),
+		Trajectory: t,
+	})
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	slog.Info("stored trajectory", "user", user.UserID, "value", t.Value, "steps", t.Steps)
+	writeJSON(w, internal.TrajectoryResponse{Accepted: true})
+}
@@ -0,0 +1,252 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// trustConfig has packets double-checked by a second user before their
+// ranges count as completed: every packet of a user we do not yet
+// trust, and a sample of the rest.  Trust is earned by packets other
+// users confirm, and lost by disputes and audit failures.  A double
+// check must be run by a different user, so with only one active user,
+// ranges needing one are never completed.
+type trustConfig struct {
+	// TrustedScore is the score at which a user is trusted.  Each
+	// packet another user confirms scores one.  It defaults to 20.
+	TrustedScore int64 `yaml:"trustedScore,omitempty"`
+
+	// Penalty is what each dispute and audit failure costs, by
+	// default 10.
+	Penalty int64 `yaml:"penalty,omitempty"`
+
+	// SampleRate is the fraction of a trusted user's packets which
+	// are double-checked anyway, by default 0.05.
+	SampleRate float64 `yaml:"sampleRate,omitempty"`
+}
+
+func (c *trustConfig) applyDefaults() error {
+	if c.TrustedScore == 0 {
+		c.TrustedScore = 20
+	}
+	if c.Penalty == 0 {
+		c.Penalty = 10
+	}
+	if c.SampleRate == 0 {
+		c.SampleRate = 0.05
+	}
+	if c.Penalty < 0 || c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("trust.penalty must be positive, and trust.sampleRate between 0 and 1")
+	}
+	return nil
+}
+
+// score returns a user's trust score.
+func (c *trustConfig) score(t store.Trust) int64 {
+	return t.Confirmed - c.Penalty*(t.Disputed+t.AuditFailures)
+}
+
+func (c *trustConfig) trusted(t store.Trust) bool {
+	return c.score(t) >= c.TrustedScore
+}
+
+// userTrust returns a user's audit history, which is empty if they
+// have none.
+func (s *server) userTrust(ctx context.Context, userID string) (store.Trust, error) {
+	t, err := s.store.GetTrust(ctx, userID)
+	if errors.Is(err, store.ErrNotFound) {
+		return store.Trust{UserID: userID}, nil
+	}
+	if err != nil {
+		return store.Trust{}, err
+	}
+	return *t, nil
+}
+
+// addTrust adds to a user's audit history, if trust is configured.
+// Failing to is logged, but does not fail the request.
+func (s *server) addTrust(ctx context.Context, t store.Trust) {
+	if s.config.Trust == nil {
+		return
+	}
+	t.UpdatedOn = time.Now().UTC()
+	if err := s.store.AddTrust(ctx, t); err != nil {
+		slog.Error("cannot update trust", "user", t.UserID, "err", err)
+	}
+}
+
+// verification returns the double check to add when accepting a
+// packet, or nil if it needs none.
+func (s *server) verification(ctx context.Context, user *store.User, p *store.Packet) (*store.Packet, error) {
+	if s.config.Trust == nil || p.Verifies != "" {
+		return nil, nil
+	}
+	t, err := s.userTrust(ctx, user.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if s.config.Trust.trusted(t) && rand.Float64() >= s.config.Trust.SampleRate {
+		return nil, nil
+	}
+	return &store.Packet{
+		WorkPacket: internal.WorkPacket{
+			ID:            randomString(),
+			Nonce:         randomString(),
+			StartingValue: p.StartingValue,
+			EndingValue:   p.EndingValue,
+			AssignedOn:    time.Now().UTC(),
+			Filter:        p.Filter,
+		},
+		Status:   store.PacketVerify,
+		Verifies: p.ID,
+	}, nil
+}
+
+// claimVerification assigns a double check to a user, if one is
+// waiting for a user other than the one who completed the packet, with
+// a filter in filters.  A double check must use the filter of the
+// packet it checks, so others wait for a client which supports theirs.
+func (s *server) claimVerification(ctx context.Context, userID string, nodeID string, filters []string, now time.Time) (*store.Packet, error) {
+	p, err := s.store.ClaimVerification(ctx, &store.Packet{
+		WorkPacket: internal.WorkPacket{
+			Nonce:      randomString(),
+			AssignedOn: now,
+			Expiry:     now.Add(s.config.PacketLifetime),
+		},
+		UserID: userID,
+		NodeID: nodeID,
+	}, filters)
+	if p != nil {
+		slog.Info("assigned double check", "packet", p.ID, "verifies", p.Verifies, "user", userID, "node", nodeID)
+	}
+	return p, err
+}
+
+// checkVerification compares a double check with the report it
+// checks.  If they disagree, neither counts: the double check is
+// marked disputed, the packet it checked is reassigned, and both users
+// lose trust.  It returns true if they agree.
+func (s *server) checkVerification(ctx context.Context, user *store.User, p *store.Packet, report internal.WorkProgressReport) (bool, error) {
+	checked, err := s.store.GetPacket(ctx, p.Verifies)
+	if err != nil {
+		return false, fmt.Errorf("packet %s verified by %s: %v", p.Verifies, p.ID, err)
+	}
+	receipt, err := s.store.GetReceipt(ctx, checked.ID)
+	if err != nil {
+		return false, fmt.Errorf("receipt for packet %s verified by %s: %v", checked.ID, p.ID, err)
+	}
+	if receipt.Evidence == report.Evidence {
+		return true, nil
+	}
+
+	slog.Warn("double check disagrees; reassigning the range", "packet", p.ID, "user", user.UserID,
+		"verifies", checked.ID, "checkedUser", checked.UserID, "evidence", report.Evidence, "checkedEvidence", receipt.Evidence)
+	err = s.store.AddReportConflict(ctx, store.ReportConflict{
+		StoredReport: store.StoredReport{
+			PacketID:   p.ID,
+			UserID:     user.UserID,
+			NodeID:     report.NodeInfo.NodeID,
+			ReceivedOn: time.Now().UTC(),
+			Report:     report,
+		},
+		Reason: store.ConflictVerification,
+	})
+	if err != nil {
+		return false, err
+	}
+	p.Status = store.PacketDisputed
+	if err := s.store.UpdatePacket(ctx, p); err != nil {
+		return false, err
+	}
+	// A rejected packet is reassigned once expired, without counting
+	// against its node.
+	checked.Status = store.PacketRejected
+	checked.Expiry = time.Now().UTC()
+	if err := s.store.UpdatePacket(ctx, checked); err != nil {
+		return false, err
+	}
+	s.addTrust(ctx, store.Trust{UserID: user.UserID, Disputed: 1})
+	s.addTrust(ctx, store.Trust{UserID: checked.UserID, Disputed: 1})
+	for _, e := range []internal.Event{
+		{UserID: checked.UserID, NodeID: checked.NodeID, PacketID: checked.ID},
+		{UserID: user.UserID, NodeID: report.NodeInfo.NodeID, PacketID: p.ID},
+	} {
+		e.Kind = internal.EventAuditFailure
+		e.Message = fmt.Sprintf("double check %s of packet %s disagrees", p.ID, checked.ID)
+		s.event(ctx, e)
+	}
+	return false, nil
+}
+
+// verified notes what accepting a packet did for verification: queued
+// a double check of it, or as a double check itself, confirmed the
+// packet it checked, to the credit of that packet's user.
+func (s *server) verified(ctx context.Context, p *store.Packet, verify *store.Packet) {
+	if verify != nil {
+		slog.Info("double check queued", "packet", p.ID, "user", p.UserID, "check", verify.ID)
+	}
+	if p.Verifies == "" {
+		return
+	}
+	checked, err := s.store.GetPacket(ctx, p.Verifies)
+	if err != nil {
+		slog.Error("cannot find packet confirmed by double check", "packet", p.Verifies, "check", p.ID, "err", err)
+		return
+	}
+	slog.Info("double check confirmed packet", "packet", checked.ID, "user", checked.UserID, "check", p.ID, "checkedBy", p.UserID)
+	s.addTrust(ctx, store.Trust{UserID: checked.UserID, Confirmed: 1})
+}
+
+// handleTrust lists each user's audit history and trust score.
+func (s *server) handleTrust(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.config.Trust == nil {
+		http.NotFound(w, r)
+		return
+	}
+	history, err := s.store.TrustHistory(r.Context())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	resp := internal.TrustResponse{Users: []internal.UserTrust{}}
+	for _, t := range history {
+		resp.Users = append(resp.Users, internal.UserTrust{
+			UserID:        t.UserID,
+			Confirmed:     t.Confirmed,
+			Disputed:      t.Disputed,
+			AuditFailures: t.AuditFailures,
+			Score:         s.config.Trust.score(t),
+			Trusted:       s.config.Trust.trusted(t),
+			UpdatedOn:     t.UpdatedOn,
+		})
+	}
+	writeJSON(w, resp)
+}
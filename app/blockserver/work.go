@@ -0,0 +1,648 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/auth"
+	"github.com/skandragon/collatz/internal/store"
+	"github.com/skandragon/collatz/internal/trace"
+)
+
+const maxClaimCount = 16
+
+// maxConflicts bounds the size of a conflicts response.
+const maxConflicts = 1000
+
+// errForeignNode is returned for a node ID already used by another
+// user, whose history the request may not change.
+var errForeignNode = errors.New("node ID belongs to another user")
+
+func (s *server) handleClaim(w http.ResponseWriter, r *http.Request, user *store.User) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req internal.ClaimRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	count := req.Count
+	if count < 1 {
+		count = 1
+	}
+	if count > maxClaimCount {
+		count = maxClaimCount
+	}
+
+	ctx := r.Context()
+	s.Lock()
+	defer s.Unlock()
+
+	held, err := s.store.CountOutstanding(ctx, user.UserID, time.Now().UTC())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if available := s.config.MaxOutstanding - held; count > available {
+		count = available
+	}
+	resp := internal.ClaimResponse{
+		MaxOutstanding: s.config.MaxOutstanding,
+		Authenticators: auth.Usable(s.config.Authenticators.Supported(time.Now()), user.Credentials()),
+	}
+	for i := 0; i < count; i++ {
+		p, err := s.assign(ctx, user.UserID, req.NodeInfo.NodeID, req.Filters)
+		if errors.Is(err, errForeignNode) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if s.config.Challenges != nil {
+			p.Challenges = s.config.Challenges.challengesFor(p)
+		}
+		if s.signer != nil {
+			auth.SignPacket(s.signer, &p)
+		}
+		resp.Work = append(resp.Work, p)
+	}
+	slog.Info("assigned packets", "count", len(resp.Work), "user", user.UserID, "node", req.NodeInfo.NodeID)
+	writeJSON(w, resp)
+}
+
+// node returns the history for a node, creating it if needed, and
+// marks it as seen now.  It returns nil if no node ID was given, and
+// errForeignNode if the node is another user's.
+func (s *server) node(ctx context.Context, userID string, nodeID string) (*store.Node, error) {
+	if nodeID == "" {
+		return nil, nil
+	}
+	n, err := s.store.GetNode(ctx, nodeID)
+	if errors.Is(err, store.ErrNotFound) {
+		n = &store.Node{NodeID: nodeID, UserID: userID}
+	} else if err != nil {
+		return nil, err
+	} else if n.UserID != userID {
+		return nil, errForeignNode
+	}
+	n.LastSeen = time.Now().UTC()
+	return n, nil
+}
+
+// assign returns the next work packet.  Double checks waiting for
+// another user, then expired packets, are handed out before new ranges
+// are assigned.  Double checks are queued by trust, or to redo the
+// packets of quarantined builds.  Filters lists the residue filters the
+// client supports.  The lock must be held.
+func (s *server) assign(ctx context.Context, userID string, nodeID string, filters []string) (internal.WorkPacket, error) {
+	now := time.Now().UTC()
+	n, err := s.node(ctx, userID, nodeID)
+	if err != nil {
+		return internal.WorkPacket{}, err
+	}
+	if n != nil {
+		n.Assigned++
+		if err := s.store.PutNode(ctx, n); err != nil {
+			return internal.WorkPacket{}, err
+		}
+	}
+
+	if s.config.Trust != nil || s.config.Quarantine != nil {
+		p, err := s.claimVerification(ctx, userID, nodeID, filters, now)
+		if err != nil {
+			return internal.WorkPacket{}, err
+		}
+		if p != nil {
+			return p.WorkPacket, nil
+		}
+	}
+
+	for {
+		expired, err := s.store.ReclaimExpired(ctx, now)
+		if err != nil {
+			return internal.WorkPacket{}, err
+		}
+		if expired == nil {
+			break
+		}
+		if err := s.penalize(ctx, expired); err != nil {
+			return internal.WorkPacket{}, err
+		}
+		if expired.Verifies != "" {
+			// Double checks wait for another user to claim them.
+			expired.Status = store.PacketVerify
+			if err := s.store.UpdatePacket(ctx, expired); err != nil {
+				return internal.WorkPacket{}, err
+			}
+			continue
+		}
+		return s.issue(ctx, expired.WorkPacket, userID, nodeID, filters, now)
+	}
+
+	size := s.blockSize(n)
+	starting, err := s.store.AllocateRange(ctx, size)
+	if err != nil {
+		return internal.WorkPacket{}, err
+	}
+	ending := big.NewInt(0).Add(starting, size)
+	ending.Sub(ending, big.NewInt(1))
+	return s.issue(ctx, internal.WorkPacket{StartingValue: starting, EndingValue: ending}, userID, nodeID, filters, now)
+}
+
+// penalize records that a node let a packet expire.  Packets the node
+// explicitly rejected do not count against it.
+func (s *server) penalize(ctx context.Context, p *store.Packet) error {
+	if p.Status == store.PacketRejected || p.NodeID == "" {
+		return nil
+	}
+	previous, err := s.store.GetNode(ctx, p.NodeID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	previous.Expired++
+	if flaky(previous) {
+		slog.Warn("node is flaky", "node", previous.NodeID, "user", previous.UserID,
+			"completed", previous.Completed, "expired", previous.Expired)
+	}
+	return s.store.PutNode(ctx, previous)
+}
+
+// issue assigns a range to a user's node as a new packet, with the
+// configured filter if the client supports it.
+func (s *server) issue(ctx context.Context, packet internal.WorkPacket, userID string, nodeID string, filters []string, now time.Time) (internal.WorkPacket, error) {
+	p := &store.Packet{
+		WorkPacket: internal.WorkPacket{
+			ID:            randomString(),
+			Nonce:         randomString(),
+			StartingValue: packet.StartingValue,
+			EndingValue:   packet.EndingValue,
+			AssignedOn:    now,
+			Expiry:        now.Add(s.config.PacketLifetime),
+		},
+		UserID: userID,
+		NodeID: nodeID,
+		Status: store.PacketOutstanding,
+	}
+	if supportsFilter(filters, s.config.Filter) {
+		p.Filter = s.config.Filter
+	}
+	if err := s.store.AddPacket(ctx, p); err != nil {
+		return internal.WorkPacket{}, err
+	}
+	return p.WorkPacket, nil
+}
+
+// supportsFilter returns true if filter is in filters.  Every client
+// can run a packet without one.
+func supportsFilter(filters []string, filter string) bool {
+	if filter == internal.FilterNone {
+		return true
+	}
+	for _, f := range filters {
+		if f == filter {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *server) handleReport(w http.ResponseWriter, r *http.Request, user *store.User) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var report internal.WorkProgressReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	s.metrics.reportsWaiting.Add(1)
+	defer s.metrics.reportsWaiting.Add(-1)
+	s.Lock()
+	defer s.Unlock()
+	p, err := s.store.GetPacket(ctx, report.Work.ID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		internalError(w, err)
+		return
+	}
+	if p == nil || subtle.ConstantTimeCompare([]byte(p.Nonce), []byte(report.Work.Nonce)) != 1 || p.UserID != user.UserID || !sameRange(p.WorkPacket, report.Work) {
+		s.replyReport(w, report, internal.ReportResponse{Message: "unknown work packet"})
+		return
+	}
+	if p.Status == store.PacketCompleted || p.Status == store.PacketUnverified || p.Status == store.PacketDisputed {
+		s.reaccept(w, r, user, p, report)
+		return
+	}
+
+	switch report.Status {
+	case "completed":
+	case "rejected":
+		slog.Warn("packet rejected", "user", user.UserID, "node", report.NodeInfo.NodeID,
+			"packet", p.ID, "start", p.StartingValue, "end", p.EndingValue, "message", report.Message)
+		// Another node, with different limits, may be happy to run it.
+		p.Expiry = time.Now().UTC()
+		p.Status = store.PacketRejected
+		if err := s.store.UpdatePacket(ctx, p); err != nil {
+			internalError(w, err)
+			return
+		}
+		s.replyReport(w, report, internal.ReportResponse{Accepted: true})
+		return
+	case "running":
+		p.LastHeartbeat = time.Now().UTC()
+		p.EstimatedCompletion = report.EstimatedCompletion.UTC()
+		if err := s.store.UpdatePacket(ctx, p); err != nil {
+			internalError(w, err)
+			return
+		}
+		s.replyReport(w, report, internal.ReportResponse{Accepted: true})
+		return
+	default:
+		s.replyReport(w, report, internal.ReportResponse{Accepted: true})
+		return
+	}
+
+	if s.refuseQuarantined(w, r, user, p, report) {
+		return
+	}
+
+	version := auth.Version(report.Authenticator)
+	if err := s.config.Authenticators.Check(version, time.Now()); err != nil {
+		slog.Warn("rejecting report", "user", user.UserID, "node", report.NodeInfo.NodeID, "packet", p.ID, "err", err)
+		s.replyReport(w, report, internal.ReportResponse{Message: err.Error()})
+		return
+	}
+	if len(auth.Usable([]string{version}, user.Credentials())) == 0 {
+		slog.Warn("rejecting report with an authenticator we cannot verify", "user", user.UserID,
+			"node", report.NodeInfo.NodeID, "packet", p.ID, "version", version)
+		s.replyReport(w, report, internal.ReportResponse{
+			Message: fmt.Sprintf("authenticator version %q cannot be verified, as this server stores only hashed secrets", version),
+		})
+		return
+	}
+	_, span := s.tracer.Start(ctx, "verify", trace.KindInternal)
+	span.SetAttribute("collatz.packet", p.ID)
+	ok := authentic(user, p, report)
+	span.SetAttribute("collatz.authentic", ok)
+	span.End()
+	if !ok {
+		s.event(ctx, internal.Event{
+			Kind:     internal.EventAuditFailure,
+			UserID:   user.UserID,
+			NodeID:   report.NodeInfo.NodeID,
+			PacketID: p.ID,
+			Message:  "authenticator mismatch",
+		})
+		s.authFailed(ctx, r, user.UserID, "authenticator mismatch")
+		s.addTrust(ctx, store.Trust{UserID: user.UserID, AuditFailures: 1})
+		s.replyReport(w, report, internal.ReportResponse{Message: "authenticator mismatch"})
+		return
+	}
+
+	if report.Evidence.Filter != p.Filter {
+		// The evidence of a range tested with another filter cannot
+		// be compared with its double check.
+		slog.Warn("rejecting report using the wrong filter", "user", user.UserID, "node", report.NodeInfo.NodeID,
+			"packet", p.ID, "filter", report.Evidence.Filter, "want", p.Filter)
+		s.replyReport(w, report, internal.ReportResponse{
+			Message: fmt.Sprintf("report used filter %q, but the packet was issued with %q", report.Evidence.Filter, p.Filter),
+		})
+		return
+	}
+
+	if s.config.Challenges != nil {
+		missing, err := s.config.Challenges.checkChallenges(p.WorkPacket, report)
+		if err != nil {
+			slog.Warn("rejecting report failing its challenges", "user", user.UserID,
+				"node", report.NodeInfo.NodeID, "packet", p.ID, "err", err)
+			s.event(ctx, internal.Event{
+				Kind:     internal.EventAuditFailure,
+				UserID:   user.UserID,
+				NodeID:   report.NodeInfo.NodeID,
+				PacketID: p.ID,
+				Message:  err.Error(),
+			})
+			s.addTrust(ctx, store.Trust{UserID: user.UserID, AuditFailures: 1})
+			s.replyReport(w, report, internal.ReportResponse{Message: err.Error()})
+			return
+		}
+		if missing > 0 {
+			slog.Info("report left challenges unanswered", "user", user.UserID,
+				"node", report.NodeInfo.NodeID, "packet", p.ID, "missing", missing)
+		}
+	}
+
+	if p.Verifies != "" {
+		agrees, err := s.checkVerification(ctx, user, p, report)
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		if !agrees {
+			s.replyReport(w, report, internal.ReportResponse{
+				Message: "report disagrees with the report it double-checks; the range will be reassigned",
+			})
+			return
+		}
+	}
+	verify, err := s.verification(ctx, user, p)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	err = s.store.ConsumeNonce(ctx, store.Nonce{
+		Nonce:         p.Nonce,
+		PacketID:      p.ID,
+		UserID:        user.UserID,
+		StartingValue: p.StartingValue,
+		EndingValue:   p.EndingValue,
+		ConsumedOn:    time.Now().UTC(),
+	})
+	if errors.Is(err, store.ErrNonceReused) {
+		slog.Warn("rejecting report reusing a nonce", "user", user.UserID, "node", report.NodeInfo.NodeID, "packet", p.ID)
+		s.event(ctx, internal.Event{
+			Kind:     internal.EventAuditFailure,
+			UserID:   user.UserID,
+			NodeID:   report.NodeInfo.NodeID,
+			PacketID: p.ID,
+			Message:  "nonce already used",
+		})
+		s.addTrust(ctx, store.Trust{UserID: user.UserID, AuditFailures: 1})
+		s.replyReport(w, report, internal.ReportResponse{Message: "nonce already used"})
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+
+	receipt := internal.Receipt{
+		PacketID:      p.ID,
+		UserID:        user.UserID,
+		NodeID:        report.NodeInfo.NodeID,
+		StartingValue: p.StartingValue,
+		EndingValue:   p.EndingValue,
+		Evidence:      report.Evidence,
+		AcceptedOn:    time.Now().UTC(),
+	}
+	size := big.NewInt(0).Sub(p.EndingValue, p.StartingValue)
+	size.Add(size, big.NewInt(1))
+	records, err := s.newRecords(ctx, report, receipt)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	n, err := s.node(ctx, user.UserID, report.NodeInfo.NodeID)
+	if errors.Is(err, errForeignNode) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if n != nil {
+		recordCompletion(n, size, report.StartedOn, report.CompletedOn)
+	}
+	actx, span := s.tracer.Start(ctx, "accept", trace.KindInternal)
+	err = s.store.AcceptReport(actx, &store.Acceptance{
+		Report:   report,
+		Receipt:  receipt,
+		Records:  records,
+		Node:     n,
+		Rates:    rateSamples(receipt, size),
+		Verify:   verify,
+		Confirms: p.Verifies,
+	})
+	span.SetError(err)
+	span.End()
+	if errors.Is(err, store.ErrAlreadyAccepted) {
+		// another replica accepted it first
+		s.reaccept(w, r, user, p, report)
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	s.metrics.accepted(user.UserID, size, report.Evidence.TotalIterations)
+	s.verified(ctx, p, verify)
+	s.recordEvents(ctx, report.NodeInfo.NodeID, records)
+	s.skippedEvents(ctx, user.UserID, report)
+	s.queueAudit(user.UserID, p, report)
+	slog.Info("accepted report", "packet", p.ID, "user", user.UserID, "node", report.NodeInfo.NodeID,
+		"worker", report.WorkerID, "start", p.StartingValue, "end", p.EndingValue,
+		"totalIterations", report.Evidence.TotalIterations, "maxIterations", report.Evidence.MaxIterations)
+	s.replyReport(w, report, internal.ReportResponse{
+		Accepted:     true,
+		Receipt:      &receipt,
+		Trajectories: s.trajectoryRequests(records),
+	})
+}
+
+// replyReport answers a progress report, counting the answer.
+func (s *server) replyReport(w http.ResponseWriter, report internal.WorkProgressReport, resp internal.ReportResponse) {
+	s.metrics.report(report.Status, resp)
+	writeJSON(w, resp)
+}
+
+// sameRange returns true unless the report gives a range for its
+// packet which is not the one we assigned.  Older clients may not
+// echo the range at all.
+func sameRange(assigned internal.WorkPacket, reported internal.WorkPacket) bool {
+	if reported.StartingValue != nil && reported.StartingValue.Cmp(assigned.StartingValue) != 0 {
+		return false
+	}
+	if reported.EndingValue != nil && reported.EndingValue.Cmp(assigned.EndingValue) != 0 {
+		return false
+	}
+	return true
+}
+
+// authentic returns true if the report's authenticator is correct for
+// the user and packet.
+func authentic(user *store.User, p *store.Packet, report internal.WorkProgressReport) bool {
+	return auth.Verify(user.Credentials(), p.WorkPacket, report.Evidence, report.Authenticator)
+}
+
+// reaccept answers a completed report for a packet already accepted.
+// If it is the same evidence, as when a client retries after losing our
+// response, it gets the receipt originally issued, so acceptance is
+// idempotent.  Any other completed report is kept for audit, and the
+// first report stands.
+func (s *server) reaccept(w http.ResponseWriter, r *http.Request, user *store.User, p *store.Packet, report internal.WorkProgressReport) {
+	if report.Status != "completed" {
+		s.replyReport(w, report, internal.ReportResponse{Message: "packet already completed"})
+		return
+	}
+	if !authentic(user, p, report) {
+		s.conflict(w, r, user, p, report, store.ConflictAuthenticator)
+		return
+	}
+	receipt, err := s.store.GetReceipt(r.Context(), p.ID)
+	if errors.Is(err, store.ErrNotFound) {
+		s.replyReport(w, report, internal.ReportResponse{Message: "packet already completed"})
+		return
+	}
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	if receipt.Evidence != report.Evidence {
+		s.conflict(w, r, user, p, report, store.ConflictDifferentEvidence)
+		return
+	}
+	s.replyReport(w, report, internal.ReportResponse{Accepted: true, Message: "already accepted", Receipt: receipt})
+}
+
+// conflict flags a completed report which disagrees with the one
+// already accepted for the packet.
+func (s *server) conflict(w http.ResponseWriter, r *http.Request, user *store.User, p *store.Packet, report internal.WorkProgressReport, reason string) {
+	slog.Warn("conflicting report for completed packet", "user", user.UserID,
+		"node", report.NodeInfo.NodeID, "worker", report.WorkerID, "packet", p.ID, "reason", reason)
+	err := s.store.AddReportConflict(r.Context(), store.ReportConflict{
+		StoredReport: store.StoredReport{
+			PacketID:   p.ID,
+			UserID:     user.UserID,
+			NodeID:     report.NodeInfo.NodeID,
+			ReceivedOn: time.Now().UTC(),
+			Report:     report,
+		},
+		Reason: reason,
+	})
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	s.event(r.Context(), internal.Event{
+		Kind:     internal.EventAuditFailure,
+		UserID:   user.UserID,
+		NodeID:   report.NodeInfo.NodeID,
+		PacketID: p.ID,
+		Message:  "conflicting report: " + reason,
+	})
+	s.addTrust(r.Context(), store.Trust{UserID: user.UserID, AuditFailures: 1})
+	s.replyReport(w, report, internal.ReportResponse{Message: "packet already completed"})
+}
+
+// handleConflicts lists conflicting reports received in the "window"
+// (default a week) up to now, oldest first.
+func (s *server) handleConflicts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	window, err := parseDuration(r, "window", 7*24*time.Hour)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conflicts, err := s.store.ReportConflicts(r.Context(), time.Now().UTC().Add(-window), maxConflicts)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, conflicts)
+}
+
+// newRecords returns any findings in a report.  The lock must be held.
+func (s *server) newRecords(ctx context.Context, report internal.WorkProgressReport, receipt internal.Receipt) ([]store.Record, error) {
+	ret := []store.Record{}
+	for _, v := range report.Interesting {
+		slog.Warn("LOOP FOUND", "user", receipt.UserID, "packet", receipt.PacketID, "value", v)
+		ret = append(ret, store.Record{
+			Kind:     store.RecordLoop,
+			Value:    v,
+			PacketID: receipt.PacketID,
+			UserID:   receipt.UserID,
+			FoundOn:  receipt.AcceptedOn,
+		})
+	}
+
+	records, err := s.store.Records(ctx, store.RecordMaxIterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > 0 && records[len(records)-1].Iterations >= report.Evidence.MaxIterations {
+		return ret, nil
+	}
+	slog.Info("new max iterations record", "user", receipt.UserID, "packet", receipt.PacketID,
+		"maxIterations", report.Evidence.MaxIterations, "value", report.MaxIterationsValue)
+	return append(ret, store.Record{
+		Kind:       store.RecordMaxIterations,
+		Value:      report.MaxIterationsValue,
+		Iterations: report.Evidence.MaxIterations,
+		PacketID:   receipt.PacketID,
+		UserID:     receipt.UserID,
+		FoundOn:    receipt.AcceptedOn,
+	}), nil
+}
+
+func (s *server) handleReceipts(w http.ResponseWriter, r *http.Request, user *store.User) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	receipts, err := s.store.Receipts(r.Context(), user.UserID)
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, internal.ReceiptsResponse{Receipts: receipts})
+}
+
+func (s *server) handleProgress(w http.ResponseWriter, r *http.Request, user *store.User) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	frontier, err := s.store.Frontier(r.Context())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	completed, err := s.store.CompletedRanges(r.Context())
+	if err != nil {
+		internalError(w, err)
+		return
+	}
+	writeJSON(w, internal.ProgressResponse{
+		Frontier:         frontier,
+		CompletedThrough: completed.ContiguousFrom(s.origin),
+		Completed:        completed.Intervals(),
+	})
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/localstore"
+	"github.com/skandragon/collatz/internal/trace"
+)
+
+// aggregateBatch bounds the number of finished packets recorded in one
+// transaction.
+const aggregateBatch = 32
+
+// deliveryBacklog is the number of batches which may wait to be sent.
+// Batches recorded while it is full stay in the spool, and are sent
+// by flushSpool.
+const deliveryBacklog = 4
+
+// finishedPacket is a worker's result for a packet, handed to the
+// aggregator.  The result is handed over, not copied; the worker does
+// not touch it again.
+type finishedPacket struct {
+	// ctx carries the packet's trace.
+	ctx         context.Context
+	work        internal.WorkPacket
+	workerID    int
+	startedOn   time.Time
+	completedOn time.Time
+	result      *blockResult
+
+	// report is spooled for the packet once it is recorded.
+	report *internal.WorkProgressReport
+
+	// version is the authenticator version to send.
+	version string
+
+	timing *blockTiming
+	logger *slog.Logger
+}
+
+// aggregator records and reports the packets workers finish, so they
+// never wait on the disk or the network.  A worker waits only when the
+// aggregator has fallen a packet per worker behind.  Packets are
+// recorded in batches, so a burst of them costs one sync of the local
+// store, and their reports are then sent in the background.
+type aggregator struct {
+	r *reporter
+	m *metrics
+
+	results    chan *finishedPacket
+	deliveries chan []*finishedPacket
+	done       chan struct{}
+}
+
+func newAggregator(r *reporter, m *metrics, workers int) *aggregator {
+	return &aggregator{
+		r:          r,
+		m:          m,
+		results:    make(chan *finishedPacket, workers),
+		deliveries: make(chan []*finishedPacket, deliveryBacklog),
+		done:       make(chan struct{}),
+	}
+}
+
+// submit hands a finished packet to the aggregator.
+func (a *aggregator) submit(f *finishedPacket) {
+	a.results <- f
+}
+
+// close waits for every packet submitted to be recorded, and for those
+// being sent to be answered or fail.  Nothing may be submitted after.
+func (a *aggregator) close() {
+	close(a.results)
+	<-a.done
+}
+
+// run records finished packets until close is called, and sends their
+// reports.  Reports not sent by then stay in the spool, to be sent
+// when we next start.
+func (a *aggregator) run() {
+	go a.deliver()
+	defer close(a.deliveries)
+	for f := range a.results {
+		batch := []*finishedPacket{f}
+	gather:
+		for len(batch) < aggregateBatch {
+			select {
+			case f, ok := <-a.results:
+				if !ok {
+					break gather
+				}
+				batch = append(batch, f)
+			default:
+				break gather
+			}
+		}
+		a.record(batch)
+		select {
+		case a.deliveries <- batch:
+		default:
+			slog.Warn("reports backed up, leaving them in the spool", "packets", len(batch))
+			for _, f := range batch {
+				a.finish(f)
+			}
+		}
+	}
+}
+
+// record keeps a batch of finished packets, and spools their reports,
+// adding the time taken to each packet's timing.
+func (a *aggregator) record(batch []*finishedPacket) {
+	start := time.Now()
+	entries := make([]localstore.Finished, 0, len(batch))
+	for _, f := range batch {
+		a.r.events.finished(a.r.ni.NodeID, f.workerID, &f.work, f.result)
+		entries = append(entries, a.r.finished(f))
+	}
+	if err := a.r.store.AddFinished(entries); err != nil {
+		slog.Error("cannot record finished packets", "packets", len(batch), "err", err)
+	}
+	elapsed := time.Since(start)
+	for i, f := range batch {
+		f.timing.checkpoint += elapsed
+		f.report = &entries[i].Report
+	}
+}
+
+// deliver sends the reports of recorded batches.
+func (a *aggregator) deliver() {
+	defer close(a.done)
+	for batch := range a.deliveries {
+		for _, f := range batch {
+			start := time.Now()
+			rctx, span := a.r.tracer.Start(f.ctx, "report", trace.KindClient)
+			span.SetAttribute("collatz.packet", f.work.ID)
+			a.r.deliver(rctx, *f.report)
+			span.End()
+			f.timing.since(&f.timing.network, start)
+			a.finish(f)
+		}
+	}
+}
+
+// finish counts and logs a packet, once recorded and, if we could,
+// reported.
+func (a *aggregator) finish(f *finishedPacket) {
+	a.m.observeBlock(f.timing)
+	attrs := f.timing.logAttrs()
+	if remaining, ok := a.m.runETA(); ok {
+		attrs = append(attrs, "heldRemaining", remaining.Round(time.Second))
+	}
+	f.logger.Info("finished packet", attrs...)
+}
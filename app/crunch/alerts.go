@@ -0,0 +1,305 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// alertConfig runs a hook when something looks wrong, so a node left
+// unattended can tell someone.  At least one of Webhook and Exec must
+// be set.
+type alertConfig struct {
+	// Webhook, if set, is a URL to which each alert is POSTed as JSON.
+	Webhook string `yaml:"webhook,omitempty"`
+
+	// Exec, if set, is a command run for each alert, with the alert
+	// as JSON on its standard input, and in COLLATZ_ALERT_* variables
+	// in its environment.
+	Exec []string `yaml:"exec,omitempty"`
+
+	// Interval is how often conditions are checked.  The default is
+	// 1m.
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// Repeat is how often an alert is sent again while its condition
+	// holds.  The default is 1h.
+	Repeat time.Duration `yaml:"repeat,omitempty"`
+
+	// RateDrop is the fraction by which our rate over the last minute
+	// may fall below its moving average before we alert.  The default
+	// is 0.5.
+	RateDrop float64 `yaml:"rateDrop,omitempty"`
+
+	// StallTimeout is how long a worker may go without advancing
+	// through its packet before we alert.  The default is 10m.
+	StallTimeout time.Duration `yaml:"stallTimeout,omitempty"`
+
+	// SubmissionFailures is the number of reports in a row which may
+	// fail to reach the server before we alert.  The default is 5.
+	SubmissionFailures int `yaml:"submissionFailures,omitempty"`
+
+	// MaxAllocationsPerCandidate, if set, is the number of heap
+	// allocations per candidate tested above which we alert.  An
+	// engine working in machine words should allocate next to
+	// nothing, so a high rate means we are running a slower path than
+	// expected.
+	MaxAllocationsPerCandidate float64 `yaml:"maxAllocationsPerCandidate,omitempty"`
+}
+
+func (c *alertConfig) applyDefaults() error {
+	if c.Webhook == "" && len(c.Exec) == 0 {
+		return fmt.Errorf("alerts needs a webhook or exec hook")
+	}
+	if c.RateDrop < 0 || c.RateDrop >= 1 {
+		return fmt.Errorf("alerts.rateDrop must be between 0 and 1")
+	}
+	if c.Interval == 0 {
+		c.Interval = time.Minute
+	}
+	if c.Repeat == 0 {
+		c.Repeat = time.Hour
+	}
+	if c.RateDrop == 0 {
+		c.RateDrop = 0.5
+	}
+	if c.StallTimeout == 0 {
+		c.StallTimeout = 10 * time.Minute
+	}
+	if c.SubmissionFailures == 0 {
+		c.SubmissionFailures = 5
+	}
+	return nil
+}
+
+// Alert kinds.
+const (
+	alertRateDrop   = "rate-drop"
+	alertStalled    = "worker-stalled"
+	alertSubmission = "submission-failures"
+	alertAllocation = "allocations"
+)
+
+// Alert states.  An alert fires when its condition starts to hold, and
+// is resolved when it stops.
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// alert is what a hook is given.
+type alert struct {
+	Kind     string    `json:"kind"`
+	State    string    `json:"state"`
+	Message  string    `json:"message,omitempty"`
+	NodeID   string    `json:"nodeID"`
+	Campaign string    `json:"campaign,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// alerter checks for anomalies and runs the hooks.
+type alerter struct {
+	config   *alertConfig
+	metrics  *metrics
+	pipeline *pipeline
+	nodeID   string
+	campaign string
+
+	// rate tracks the candidates tested by all workers together.
+	rate    *rateTracker
+	started time.Time
+
+	// firing holds when each firing alert was last sent.
+	firing map[string]time.Time
+}
+
+func newAlerter(config *alertConfig, m *metrics, p *pipeline, nodeID string, campaign string) *alerter {
+	return &alerter{
+		config:   config,
+		metrics:  m,
+		pipeline: p,
+		nodeID:   nodeID,
+		campaign: campaign,
+		firing:   map[string]time.Time{},
+	}
+}
+
+// run checks for anomalies every interval until the context is
+// cancelled.
+func (a *alerter) run(ctx context.Context) {
+	ticker := time.NewTicker(a.config.Interval)
+	defer ticker.Stop()
+	for {
+		a.check(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check evaluates each condition, sending an alert when one starts or
+// stops holding, and repeating it while it holds.
+func (a *alerter) check(ctx context.Context, now time.Time) {
+	conditions := map[string]string{
+		alertRateDrop:   a.rateDrop(now),
+		alertStalled:    a.stalled(now),
+		alertSubmission: a.submissionFailures(),
+		alertAllocation: a.allocations(),
+	}
+	for _, kind := range []string{alertRateDrop, alertStalled, alertSubmission, alertAllocation} {
+		message := conditions[kind]
+		sent, firing := a.firing[kind]
+		switch {
+		case message != "" && (!firing || now.Sub(sent) >= a.config.Repeat):
+			a.firing[kind] = now
+			a.send(ctx, alert{Kind: kind, State: alertFiring, Message: message, Time: now})
+		case message == "" && firing:
+			delete(a.firing, kind)
+			a.send(ctx, alert{Kind: kind, State: alertResolved, Time: now})
+		}
+	}
+}
+
+// rateDrop returns why our rate has dropped, or "" if it has not.  We
+// wait for the moving average to settle before judging.
+func (a *alerter) rateDrop(now time.Time) string {
+	tested := new(big.Int).SetUint64(a.metrics.candidatesTested())
+	if a.rate == nil {
+		a.rate = newRateTracker(tested, now)
+		a.started = now
+		return ""
+	}
+	a.rate.observe(tested, now)
+	if now.Sub(a.started) < rateHalfLife {
+		return ""
+	}
+	recent, average := a.rate.instant(), a.rate.smoothed()
+	if average > 0 && recent < average*(1-a.config.RateDrop) {
+		return fmt.Sprintf("testing %.0f candidates per second, down from an average of %.0f", recent, average)
+	}
+	return ""
+}
+
+// stalled returns which workers have stalled, or "" if none have.
+func (a *alerter) stalled(now time.Time) string {
+	var stalled []string
+	for _, w := range a.metrics.workerStates(now, a.config.StallTimeout, a.pipeline.throttle) {
+		if w.State == workerStalled {
+			stalled = append(stalled, fmt.Sprintf("worker %d on packet %s since %s",
+				w.Worker, w.Packet, w.LastProgress.Format(time.RFC3339)))
+		}
+	}
+	if crashes := a.pipeline.crashes.Load(); crashes > 0 {
+		stalled = append(stalled, fmt.Sprintf("%d workers crashed", crashes))
+	}
+	if len(stalled) == 0 {
+		return ""
+	}
+	return "stalled: " + strings.Join(stalled, ", ")
+}
+
+// submissionFailures returns how many reports in a row have failed, or
+// "" if too few have.
+func (a *alerter) submissionFailures() string {
+	failures := a.metrics.reportFailures()
+	if failures < a.config.SubmissionFailures {
+		return ""
+	}
+	return fmt.Sprintf("%d reports in a row could not be sent to the server", failures)
+}
+
+// allocations returns which engines allocate too much per candidate,
+// or "" if none do.
+func (a *alerter) allocations() string {
+	if a.config.MaxAllocationsPerCandidate <= 0 {
+		return ""
+	}
+	var engines []string
+	for engine, perCandidate := range a.metrics.allocsPerCandidate() {
+		if perCandidate > a.config.MaxAllocationsPerCandidate {
+			engines = append(engines, fmt.Sprintf("%s engine allocating %.2f objects per candidate", engine, perCandidate))
+		}
+	}
+	sort.Strings(engines)
+	return strings.Join(engines, ", ")
+}
+
+// send runs the hooks for an alert.  Failures are logged; there is no
+// one else to tell.
+func (a *alerter) send(ctx context.Context, al alert) {
+	al.NodeID = a.nodeID
+	al.Campaign = a.campaign
+	level := slog.LevelWarn
+	if al.State == alertResolved {
+		level = slog.LevelInfo
+	}
+	slog.Log(ctx, level, "alert", "kind", al.Kind, "state", al.State, "message", al.Message)
+	body, err := json.Marshal(al)
+	if err != nil {
+		slog.Error("cannot encode alert", "err", err)
+		return
+	}
+	hctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if a.config.Webhook != "" {
+		if err := postAlert(hctx, a.config.Webhook, body); err != nil {
+			slog.Error("alert webhook failed", "kind", al.Kind, "err", err)
+		}
+	}
+	if len(a.config.Exec) > 0 {
+		cmd := exec.CommandContext(hctx, a.config.Exec[0], a.config.Exec[1:]...)
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.Env = append(os.Environ(),
+			"COLLATZ_ALERT_KIND="+al.Kind,
+			"COLLATZ_ALERT_STATE="+al.State,
+			"COLLATZ_ALERT_MESSAGE="+al.Message,
+			"COLLATZ_ALERT_NODE="+al.NodeID)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			slog.Error("alert command failed", "kind", al.Kind, "err", err, "output", string(out))
+		}
+	}
+}
+
+func postAlert(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"runtime/debug"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// iterationConvention is what iterate counts: each 3n+1 and each n/2
+// is one iteration, until the trajectory drops below its start.
+//
+// No engine memoizes stopping times.  Under this convention a
+// trajectory is only followed while it is above its start, so above
+// every candidate tested before it, and trajectories from nearby
+// starts merge only once below them: a cache of glides, even of those
+// of every value passed through, finds nothing.
+const iterationConvention = "steps-below-start"
+
+// conformanceCandidates are run through the engines when we start, to
+// hash into our attestation: the small odd numbers, and a few large
+// enough to need more than one word.
+func conformanceCandidates() []*big.Int {
+	var ret []*big.Int
+	for i := int64(3); i < 10000; i += 2 {
+		ret = append(ret, big.NewInt(i))
+	}
+	for _, s := range []string{
+		"18446744073709551617",    // 2^64 + 1
+		"18446744073709551615",    // 2^64 - 1
+		"295147905179352825855",   // 2^68 - 1
+		"1180591620717411303423",  // 2^70 - 1
+		"12345678901234567890123", // arbitrary
+	} {
+		v, _ := new(big.Int).SetString(s, 10)
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+// conformance runs the conformance candidates through e, returning a
+// hash of the iterations each took, and whether it looped.
+func conformance(e engine) string {
+	h := sha256.New()
+	for _, v := range conformanceCandidates() {
+		interesting, iterations, _ := e.iterate(v, nil)
+		fmt.Fprintf(h, "%s %d %t\n", v, iterations, interesting)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// buildVersion returns our version as recorded in the binary: the
+// module version, or for a development build, the commit it was
+// built from.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	var revision string
+	var modified bool
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if (version == "" || version == "(devel)") && revision != "" {
+		version = revision
+		if modified {
+			version += "+dirty"
+		}
+	}
+	if version == "" {
+		version = "(devel)"
+	}
+	return version
+}
+
+// newAttestations describes this build, running the conformance
+// candidates through each engine.  Reports carry the attestation of
+// the engine which produced them.
+func newAttestations() map[string]internal.Attestation {
+	version := buildVersion()
+	ret := map[string]internal.Attestation{}
+	for _, e := range engines() {
+		ret[e.name()] = internal.Attestation{
+			Version:     version,
+			Engine:      e.name(),
+			Convention:  iterationConvention,
+			Conformance: conformance(e),
+		}
+	}
+	return ret
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/big"
+	"math/bits"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// maxLimbBatch bounds limbBatch, as the lanes are arrays.
+const maxLimbBatch = 64
+
+// limbBatchMaxSteps bounds each candidate's iterations in a batch, so
+// one long trajectory does not hold up the rest.  Candidates needing
+// more are followed again on their own, where the watch applies.
+const limbBatchMaxSteps = 1 << 10
+
+// limbBatch is the number of candidates the u256 engine follows at
+// once; 1 follows them one at a time.
+var limbBatch = defaultLimbBatch
+
+// selectLimbBatch sets limbBatch from the configured size, or
+// defaultLimbBatch if it is zero.
+func selectLimbBatch(n int) error {
+	if n == 0 {
+		n = defaultLimbBatch
+	}
+	if n < 1 || n > maxLimbBatch {
+		return fmt.Errorf("limbBatch must be from 1 to %d", maxLimbBatch)
+	}
+	limbBatch = n
+	return nil
+}
+
+// limbLanes holds a batch of trajectories in struct-of-arrays form:
+// each limb of every lane's n, and of its start, is in its own array.
+// The lanes' dependency chains are independent, so stepping each in
+// turn lets the CPU overlap them, where a single trajectory keeps it
+// waiting on one chain.
+type limbLanes struct {
+	count int
+
+	n0, n1, n2, n3 [maxLimbBatch]uint64
+	s0, s1, s2, s3 [maxLimbBatch]uint64
+
+	// steps and stops are each lane's result, as limbSteps would
+	// return them, but a lane may pass max before stopping.
+	steps [maxLimbBatch]uint64
+	stops [maxLimbBatch]uint8
+}
+
+// set starts lane i at v.
+func (l *limbLanes) set(i int, v *u256) {
+	i &= maxLimbBatch - 1
+	l.n0[i], l.n1[i], l.n2[i], l.n3[i] = v[0], v[1], v[2], v[3]
+	l.s0[i], l.s1[i], l.s2[i], l.s3[i] = v[0], v[1], v[2], v[3]
+}
+
+// limbBatchSteps follows every lane for about max iterations, as
+// limbStepsGeneric follows one, making a pass over the lanes still
+// running until none are.  Each pass takes a lane through a 3n+1 and
+// the halving which must follow it, as (3n+1)/2 is above n, so cannot
+// be below the start; or through a run of halvings, all at once if it
+// stays above the start, and otherwise one at a time.
+func limbBatchSteps(l *limbLanes, max uint64) {
+	var buf [maxLimbBatch]uint8
+	active := buf[:0]
+	for i := 0; i < l.count && i < maxLimbBatch; i++ {
+		active = append(active, uint8(i))
+		l.steps[i] = 0
+		l.stops[i] = stopLimit
+	}
+	for len(active) > 0 {
+		kept := active[:0]
+		for _, i := range active {
+			i &= maxLimbBatch - 1
+			n0, n1, n2, n3 := l.n0[i], l.n1[i], l.n2[i], l.n3[i]
+			s0, s1, s2, s3 := l.s0[i], l.s1[i], l.s2[i], l.s3[i]
+			steps := l.steps[i]
+			if n0&1 == 1 {
+				// 3n+1 as n+2n+1, then halved
+				m0, c := bits.Add64(n0, n0<<1, 1)
+				m1, c := bits.Add64(n1, n1<<1|n0>>63, c)
+				m2, c := bits.Add64(n2, n2<<1|n1>>63, c)
+				m3, c := bits.Add64(n3, n3<<1|n2>>63, c)
+				if c != 0 || n3>>63 != 0 {
+					l.stops[i] = stopOverflow
+					continue
+				}
+				n0, n1, n2, n3 = m0>>1|m1<<63, m1>>1|m2<<63, m2>>1|m3<<63, m3>>1
+				steps += 2
+			} else {
+				// a run of up to 63 halvings
+				k := uint(bits.TrailingZeros64(n0 | 1<<63))
+				h0, h1, h2, h3 := n0>>k|n1<<(64-k), n1>>k|n2<<(64-k), n2>>k|n3<<(64-k), n3>>k
+				_, above := bits.Sub64(s0, h0, 0)
+				_, above = bits.Sub64(s1, h1, above)
+				_, above = bits.Sub64(s2, h2, above)
+				_, above = bits.Sub64(s3, h3, above)
+				if above != 0 {
+					n0, n1, n2, n3 = h0, h1, h2, h3
+					steps += uint64(k)
+				} else {
+					n0, n1, n2, n3 = n0>>1|n1<<63, n1>>1|n2<<63, n2>>1|n3<<63, n3>>1
+					steps++
+					_, below := bits.Sub64(n0, s0, 0)
+					_, below = bits.Sub64(n1, s1, below)
+					_, below = bits.Sub64(n2, s2, below)
+					_, below = bits.Sub64(n3, s3, below)
+					if below != 0 {
+						l.steps[i], l.stops[i] = steps, stopBelow
+						continue
+					}
+					if n0 == s0 && n1 == s1 && n2 == s2 && n3 == s3 {
+						l.steps[i], l.stops[i] = steps, stopLoop
+						continue
+					}
+				}
+			}
+			l.n0[i], l.n1[i], l.n2[i], l.n3[i] = n0, n1, n2, n3
+			l.steps[i] = steps
+			if steps < max {
+				kept = append(kept, i)
+			}
+		}
+		active = kept
+	}
+}
+
+// limbBatchIterator is the u256 engine following size candidates at
+// once.  Run asks it about odd candidates in order, passing over
+// only those the packet's filter leaves out or its wheel sieves, so
+// on being asked about one not in its current batch, it fills a batch
+// with the candidates run will ask about next, up to end.
+type limbBatchIterator struct {
+	size  int
+	end   *big.Int
+	mod3  bool
+	wheel *residueWheel
+
+	// values are the candidates in the batch, and pos the index of
+	// the one we expect to be asked about.
+	lanes  limbLanes
+	values []u256
+	pos    int
+	r3     big.Int
+
+	// single follows the candidates the batch could not finish.
+	single limbIterator
+}
+
+// newLimbBatchIterator returns the u256 engine for the work packet,
+// following candidates in batches if limbBatch is more than one.
+func newLimbBatchIterator(work *internal.WorkPacket, dom *domain) engine {
+	if limbBatch <= 1 {
+		return &limbIterator{}
+	}
+	return &limbBatchIterator{
+		size:  limbBatch,
+		end:   work.EndingValue,
+		mod3:  work.Filter == internal.FilterMod3,
+		wheel: wheelFor(work, dom),
+	}
+}
+
+// name returns the engine's name, as recorded in results.
+func (it *limbBatchIterator) name() string {
+	return engineLimbs
+}
+
+// iterate returns the batch's result for s, filling a new batch if
+// need be.  Candidates the batch gave up on, or which do not fit, are
+// followed on their own, where watch applies.
+func (it *limbBatchIterator) iterate(s *big.Int, watch *candidateWatch) (interesting bool, iterCount uint64, abandoned bool) {
+	var v u256
+	if !v.setBig(s) {
+		return it.single.iterate(s, watch)
+	}
+	for it.pos < len(it.values) && it.values[it.pos].cmp(&v) < 0 {
+		it.pos++
+	}
+	if it.pos >= len(it.values) || it.values[it.pos] != v {
+		it.batch(s, v)
+	}
+	pos := it.pos
+	it.pos++
+	switch it.lanes.stops[pos] {
+	case stopBelow:
+		return false, it.lanes.steps[pos], false
+	case stopLoop:
+		slog.Warn("found a loop back to starting value", "value", s)
+		return true, it.lanes.steps[pos], false
+	}
+	return it.single.iterate(s, watch)
+}
+
+// batch follows the candidates from s, which is v, that run will ask
+// about, passing over the same ones it does.
+func (it *limbBatchIterator) batch(s *big.Int, v u256) {
+	var last u256
+	if !last.setBig(it.end) {
+		last = u256{^uint64(0), ^uint64(0), ^uint64(0), ^uint64(0)}
+	}
+	r3 := it.r3.Mod(s, three).Uint64()
+	it.values = it.values[:0]
+	for len(it.values) < it.size && v.cmp(&last) <= 0 {
+		passed := it.mod3 && r3 == 2 || it.wheel != nil && it.wheel.sieved(v[0]) != 0
+		if !passed || len(it.values) == 0 {
+			it.values = append(it.values, v)
+		}
+		v.add2()
+		r3 = (r3 + 2) % 3
+		if v == (u256{}) {
+			break
+		}
+	}
+	it.lanes.count = len(it.values)
+	for i := range it.values {
+		it.lanes.set(i, &it.values[i])
+	}
+	limbBatchSteps(&it.lanes, limbBatchMaxSteps)
+	it.pos = 0
+}
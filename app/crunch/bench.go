@@ -0,0 +1,292 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// iterateReference is the plainest statement of what the engines
+// compute, comparing with s at every step.  "crunch bench" checks that
+// each engine agrees with it, and measures how much faster each is.
+func iterateReference(s *big.Int) (interesting bool, iterCount uint64) {
+	n := new(big.Int).Set(s)
+	for {
+		iterCount++
+		if n.Bit(0) == 0 {
+			n.Rsh(n, 1)
+		} else {
+			n.Mul(n, three)
+			n.Add(n, one)
+		}
+		switch n.Cmp(s) {
+		case 0:
+			return true, iterCount
+		case -1:
+			return false, iterCount
+		}
+	}
+}
+
+// benchCommand times each engine and iterateReference over the same
+// odd candidates, failing if any engine disagrees on any.  The limbs
+// engine is also timed with limbStepsGeneric, and in batches, to show
+// what its assembly kernel and batching are worth on this machine.  It then times run over
+// the candidates as a packet, with each residue wheel and filter, and
+// counts what each wheel sieves.  With -bits, it does all this for
+// candidates of each size given, rather than from -start.
+//
+// To compare runs before and after a change with benchstat, use the
+// benchmarks in bench_test.go instead.
+func benchCommand(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	start := flags.String("start", "1099511627777", "first candidate, which is made odd")
+	bitLengths := flags.String("bits", "", "comma-separated candidate sizes in bits, such as 41,64,128, to bench from 2^(bits-1)+1 instead of -start")
+	wheelSizes := flags.String("wheels", "none,8,12,16,20", "comma-separated residue wheel sizes to time packets with, or none")
+	count := flags.Int("n", 1<<20, "number of odd candidates to test")
+	rounds := flags.Int("rounds", 5, "number of times to time each loop")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	usage := fmt.Errorf("usage: crunch bench [-start value | -bits sizes] [-wheels sizes] [-n count] [-rounds rounds]")
+	first, ok := new(big.Int).SetString(*start, 10)
+	if !ok || first.Sign() <= 0 || *count <= 0 || *rounds <= 0 {
+		return usage
+	}
+	first.SetBit(first, 0, 1)
+	starts := []*big.Int{first}
+	if *bitLengths != "" {
+		starts = nil
+		for _, f := range strings.Split(*bitLengths, ",") {
+			b, err := strconv.Atoi(strings.TrimSpace(f))
+			if err != nil || b < 2 {
+				return usage
+			}
+			v := new(big.Int).SetBit(new(big.Int), b-1, 1)
+			starts = append(starts, v.SetBit(v, 0, 1))
+		}
+	}
+	wheels := []*residueWheel{}
+	for _, f := range strings.Split(*wheelSizes, ",") {
+		f = strings.TrimSpace(f)
+		if f == "none" {
+			wheels = append(wheels, nil)
+			continue
+		}
+		b, err := strconv.Atoi(f)
+		if err != nil || b < 2 || b > maxWheelBits {
+			return fmt.Errorf("wheel sizes must be none, or from 2 to %d", maxWheelBits)
+		}
+		wheels = append(wheels, newResidueWheel(uint(b)))
+	}
+
+	for _, first := range starts {
+		if err := benchEngines(first, *count, *rounds); err != nil {
+			return err
+		}
+		if err := benchBlocks(first, *count, *rounds, wheels); err != nil {
+			return err
+		}
+		benchSieve(first, *count, wheels)
+	}
+	fmt.Printf("The %s engine's kernel is %s.\n", engineLimbs, limbKernel)
+	fmt.Printf("Every engine agrees with the reference on every candidate, and every wheel and filter with none.\n")
+	return nil
+}
+
+// benchEngines times each engine on count candidates from first.
+func benchEngines(first *big.Int, count, rounds int) error {
+	bits := first.BitLen()
+	expected := make([]uint64, count)
+	v := new(big.Int)
+	v.Set(first)
+	for i := range expected {
+		_, expected[i] = iterateReference(v)
+		v.Add(v, two)
+	}
+	type loop struct {
+		name string
+		e    engine
+	}
+	var all []loop
+	for _, e := range engines() {
+		all = append(all, loop{e.name(), e})
+	}
+	// the same engine without its kernel, to measure what it is worth
+	all = append(all, loop{engineLimbs + " (pure Go)", &limbIterator{kernel: limbStepsGeneric}})
+	if bits <= limbsMaxStartBits {
+		// batched, as configured, or as large as it can be
+		end := new(big.Int).Add(first, big.NewInt(2*int64(count-1)))
+		size := limbBatch
+		if size == 1 {
+			size = maxLimbBatch
+		}
+		all = append(all, loop{fmt.Sprintf("%s (batch %d)", engineLimbs, size), &limbBatchIterator{end: end, size: size}})
+	}
+	for _, l := range all {
+		e := l.e
+		v.Set(first)
+		for i := range expected {
+			_, iterations, _ := e.iterate(v, nil)
+			if iterations != expected[i] {
+				return fmt.Errorf("the %s engine disagrees with the reference for %s: %d iterations, not %d",
+					l.name, v, iterations, expected[i])
+			}
+			v.Add(v, two)
+		}
+	}
+
+	// the best of several rounds, taken in turn, to discount noise
+	reference := time.Duration(0)
+	elapsed := make([]time.Duration, len(all))
+	for round := 0; round < rounds; round++ {
+		d := timeLoop(first, count, func(v *big.Int) { iterateReference(v) })
+		if round == 0 || d < reference {
+			reference = d
+		}
+		for i, l := range all {
+			d := timeLoop(first, count, func(v *big.Int) { l.e.iterate(v, nil) })
+			if round == 0 || d < elapsed[i] {
+				elapsed[i] = d
+			}
+		}
+	}
+
+	fmt.Printf("Engines, from %s (%d bits):\n", first, bits)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Loop\tCandidates\tElapsed\tCandidates/s\tSpeedup\n")
+	row := func(name string, d time.Duration) {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%.0f\t%.2fx\n", name, count, d.Round(time.Millisecond),
+			float64(count)/d.Seconds(), reference.Seconds()/d.Seconds())
+	}
+	row("reference", reference)
+	for i, l := range all {
+		row(l.name, elapsed[i])
+	}
+	return w.Flush()
+}
+
+// benchBlocks times run over count candidates from first, as one
+// packet, with each wheel and filter, failing if any result differs
+// from that with no wheel.  The engine is the one run would choose.
+func benchBlocks(first *big.Int, count, rounds int, wheels []*residueWheel) error {
+	saved := wheel
+	defer func() { wheel = saved }()
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	last := new(big.Int).Add(first, big.NewInt(2*int64(count-1)))
+	bits := first.BitLen()
+
+	fmt.Printf("Packets, from %s (%d bits):\n", first, bits)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Wheel\tFilter\tEngine\tCandidates\tElapsed\tCandidates/s\n")
+	for _, filter := range []string{internal.FilterNone, internal.FilterMod3} {
+		filterName := filter
+		if filterName == "" {
+			filterName = "none"
+		}
+		var expected *blockResult
+		for _, wh := range wheels {
+			wheel = wh
+			wheelName := "none"
+			if wh != nil {
+				wheelName = strconv.Itoa(int(wh.bits))
+			}
+			best := time.Duration(0)
+			for round := 0; round < rounds; round++ {
+				work := &internal.WorkPacket{ID: "bench", StartingValue: first, EndingValue: last, Filter: filter}
+				began := time.Now()
+				result := run(work, nil, discard, nil, nil, nil, nil)
+				d := time.Since(began)
+				if expected == nil {
+					expected = result
+				} else if result.TotalIterations != expected.TotalIterations ||
+					result.MaxIterations != expected.MaxIterations ||
+					result.MaxIterationsValue.Cmp(expected.MaxIterationsValue) != 0 {
+					return fmt.Errorf("with wheel %s and filter %s, run disagrees with no wheel from %s",
+						wheelName, filterName, first)
+				}
+				if round == 0 || d < best {
+					best = d
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%.0f\n", wheelName, filterName, expected.Engine, count,
+				best.Round(time.Millisecond), float64(count)/best.Seconds())
+		}
+	}
+	return w.Flush()
+}
+
+// benchSieve counts the share of count candidates from first which
+// each wheel sieves, and the share left to follow, with no filter and
+// with mod3.
+func benchSieve(first *big.Int, count int, wheels []*residueWheel) {
+	bits := first.BitLen()
+	fmt.Printf("Sieving, from %s (%d bits):\n", first, bits)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Wheel\tTable\tSieved\tFollowed\tFollowed with mod3\n")
+	low := uint64(0)
+	if len(first.Bits()) > 0 {
+		low = uint64(first.Bits()[0])
+	}
+	r3 := new(big.Int).Mod(first, three).Uint64()
+	share := func(n int) float64 { return float64(n) / float64(count) }
+	for _, wh := range wheels {
+		if wh != nil && first.Cmp(wh.threshold) <= 0 {
+			// run would not use it
+			continue
+		}
+		sieved, followedMod3 := 0, 0
+		l, r := low, r3
+		for i := 0; i < count; i, l, r = i+1, l+2, (r+2)%3 {
+			if wh != nil && wh.sieved(l) != 0 {
+				sieved++
+			} else if r != 2 {
+				followedMod3++
+			}
+		}
+		wheelName, table := "none", 0
+		if wh != nil {
+			wheelName, table = strconv.Itoa(int(wh.bits)), len(wh.steps)
+		}
+		fmt.Fprintf(w, "%s\t%d bytes\t%.1f%%\t%.1f%%\t%.1f%%\n", wheelName, table,
+			100*share(sieved), 100*share(count-sieved), 100*share(followedMod3))
+	}
+	w.Flush()
+}
+
+// timeLoop returns how long f takes over count odd candidates from
+// first.
+func timeLoop(first *big.Int, count int, f func(*big.Int)) time.Duration {
+	v := new(big.Int).Set(first)
+	began := time.Now()
+	for i := 0; i < count; i++ {
+		f(v)
+		v.Add(v, two)
+	}
+	return time.Since(began)
+}
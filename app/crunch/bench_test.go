@@ -0,0 +1,225 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"strconv"
+	"testing"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// benchBits are the candidate sizes benchmarked, each from
+// 2^(bits-1)+1: the default local start, one word, and the widest the
+// u256 engine is given.
+var benchBits = []int{41, 64, limbsMaxStartBits}
+
+// benchWheels are the residue wheel sizes benchmarked; 0 is none.
+var benchWheels = []uint{0, 8, 12, 16, 20}
+
+// benchPacket is the number of candidates in each packet BenchmarkBlock
+// runs.
+const benchPacket = 1 << 14
+
+// benchStart returns the first odd candidate of the size.
+func benchStart(bits int) *big.Int {
+	v := new(big.Int).SetBit(new(big.Int), bits-1, 1)
+	return v.SetBit(v, 0, 1)
+}
+
+// benchEngine is an engine, or some variant of one, to benchmark.
+type benchEngine struct {
+	name string
+	e    func(first *big.Int, count int) engine
+}
+
+// benchEngineList returns every engine, iterateReference, the math/big
+// loop as it was before iterator.follow, and the u256 engine without
+// its kernel and batched, for count candidates from first.
+func benchEngineList(first *big.Int, count int) []benchEngine {
+	ret := []benchEngine{
+		{"reference", func(*big.Int, int) engine { return referenceEngine{} }},
+		{engineBig + "-cmp-always", func(*big.Int, int) engine { return cmpAlwaysEngine{} }},
+	}
+	for _, e := range engines() {
+		e := e
+		ret = append(ret, benchEngine{e.name(), func(*big.Int, int) engine { return e }})
+	}
+	ret = append(ret, benchEngine{engineLimbs + "-generic", func(*big.Int, int) engine {
+		return &limbIterator{kernel: limbStepsGeneric}
+	}})
+	if first.BitLen() <= limbsMaxStartBits {
+		ret = append(ret, benchEngine{fmt.Sprintf("%s-batch%d", engineLimbs, maxLimbBatch), func(first *big.Int, count int) engine {
+			end := new(big.Int).Add(first, big.NewInt(2*int64(count-1)))
+			return &limbBatchIterator{end: end, size: maxLimbBatch}
+		}})
+	}
+	return ret
+}
+
+// referenceEngine is iterateReference as an engine.
+type referenceEngine struct{}
+
+func (referenceEngine) name() string { return "reference" }
+
+func (referenceEngine) iterate(s *big.Int, watch *candidateWatch) (bool, uint64, bool) {
+	interesting, iterCount := iterateReference(s)
+	return interesting, iterCount, false
+}
+
+// cmpAlwaysEngine is the math/big loop before iterator.follow, which
+// compared with s after every step, and allocated n afresh for each
+// candidate, and for each 3n+1.  It is kept to measure follow against.
+type cmpAlwaysEngine struct{}
+
+func (cmpAlwaysEngine) name() string { return engineBig + "-cmp-always" }
+
+func (cmpAlwaysEngine) iterate(s *big.Int, watch *candidateWatch) (interesting bool, iterCount uint64, abandoned bool) {
+	n := big.NewInt(0)
+	n.Add(n, s)
+	for {
+		iterCount++
+		if n.Bit(0) == 0 {
+			n.Rsh(n, 1)
+		} else {
+			n.Mul(n, three)
+			n.Add(n, one)
+		}
+		c := n.Cmp(s)
+		if c == 0 {
+			return true, iterCount, false
+		} else if c == -1 {
+			return false, iterCount, false
+		}
+	}
+}
+
+// TestEnginesAgree checks that every engine agrees with iterateReference
+// on candidates of each size benchmarked.
+func TestEnginesAgree(t *testing.T) {
+	const count = 1 << 12
+	for _, bits := range benchBits {
+		first := benchStart(bits)
+		expected := make([]uint64, count)
+		v := new(big.Int).Set(first)
+		for i := range expected {
+			_, expected[i] = iterateReference(v)
+			v.Add(v, two)
+		}
+		for _, be := range benchEngineList(first, count) {
+			e := be.e(first, count)
+			v.Set(first)
+			for i := range expected {
+				if _, iterations, _ := e.iterate(v, nil); iterations != expected[i] {
+					t.Fatalf("the %s engine takes %d iterations for %s, not %d", be.name, iterations, v, expected[i])
+				}
+				v.Add(v, two)
+			}
+		}
+	}
+}
+
+// BenchmarkIterate times each engine on one candidate per op.  The
+// big engine is iterator.follow, and big-cmp-always the loop it
+// replaced.
+func BenchmarkIterate(b *testing.B) {
+	for _, bits := range benchBits {
+		first := benchStart(bits)
+		for _, be := range benchEngineList(first, 1) {
+			b.Run(fmt.Sprintf("bits=%d/engine=%s", bits, be.name), func(b *testing.B) {
+				e := be.e(first, b.N)
+				v := new(big.Int).Set(first)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					e.iterate(v, nil)
+					v.Add(v, two)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkBlock times run on one packet of benchPacket candidates per
+// op, with each wheel and filter, reporting the time per candidate.
+func BenchmarkBlock(b *testing.B) {
+	saved := wheel
+	defer func() { wheel = saved }()
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, bits := range benchBits {
+		first := benchStart(bits)
+		last := new(big.Int).Add(first, big.NewInt(2*(benchPacket-1)))
+		for _, wheelBits := range benchWheels {
+			for _, filter := range []string{internal.FilterNone, internal.FilterMod3} {
+				wheelName, filterName := "none", filter
+				if wheelBits > 0 {
+					wheelName = strconv.Itoa(int(wheelBits))
+				}
+				if filterName == "" {
+					filterName = "none"
+				}
+				b.Run(fmt.Sprintf("bits=%d/wheel=%s/filter=%s", bits, wheelName, filterName), func(b *testing.B) {
+					wheel = nil
+					if wheelBits > 0 {
+						wheel = newResidueWheel(wheelBits)
+					}
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						work := &internal.WorkPacket{ID: "bench", StartingValue: first, EndingValue: last, Filter: filter}
+						run(work, nil, discard, nil, nil, nil, nil)
+					}
+					b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*benchPacket), "ns/candidate")
+				})
+			}
+		}
+	}
+}
+
+// BenchmarkSieve times each wheel on one candidate per op, reporting
+// the share it sieves, and the share left to follow with no filter and
+// with mod3.
+func BenchmarkSieve(b *testing.B) {
+	for _, bits := range benchBits {
+		first := benchStart(bits)
+		low := uint64(first.Bits()[0])
+		r3 := new(big.Int).Mod(first, three).Uint64()
+		for _, wheelBits := range benchWheels[1:] {
+			wh := newResidueWheel(wheelBits)
+			if first.Cmp(wh.threshold) <= 0 {
+				// run would not use it
+				continue
+			}
+			b.Run(fmt.Sprintf("bits=%d/wheel=%d", bits, wheelBits), func(b *testing.B) {
+				sieved, followedMod3 := 0, 0
+				l, r := low, r3
+				for i := 0; i < b.N; i, l, r = i+1, l+2, (r+2)%3 {
+					if wh.sieved(l) != 0 {
+						sieved++
+					} else if r != 2 {
+						followedMod3++
+					}
+				}
+				b.ReportMetric(float64(sieved)/float64(b.N), "sieved/op")
+				b.ReportMetric(float64(b.N-sieved)/float64(b.N), "followed/op")
+				b.ReportMetric(float64(followedMod3)/float64(b.N), "followed-mod3/op")
+			})
+		}
+	}
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/big"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/skandragon/collatz/internal/logging"
+)
+
+// candidateLogConfig writes a line of JSON for a sample of the
+// candidates tested, for research needing more than each packet's
+// evidence.  Every candidate would be far too much to keep, so only
+// SampleRate of them are written.  Lines are
+//
+//	{"value":27,"iterations":111,"maxBits":13}
+//
+// where maxBits is the bit length of the highest value the trajectory
+// reaches before it drops below its start.  Candidates the filter
+// leaves out are not tested, so never written; those the residue
+// wheel counts are.  The file is rotated, and rotated files may be
+// compressed, as the log file is.
+type candidateLogConfig struct {
+	logging.FileConfig `yaml:",inline"`
+
+	// SampleRate is the fraction of candidates written, such as
+	// 0.0001.  It is required, and at most 1.
+	SampleRate float64 `yaml:"sampleRate,omitempty"`
+}
+
+func (c *candidateLogConfig) applyDefaults() error {
+	if err := c.FileConfig.ApplyDefaults(); err != nil {
+		return fmt.Errorf("candidateLog: %v", err)
+	}
+	if !(c.SampleRate > 0 && c.SampleRate <= 1) {
+		return fmt.Errorf("candidateLog.sampleRate must be above 0 and at most 1")
+	}
+	return nil
+}
+
+// candidateLog is the file sampled candidates are written to.
+type candidateLog struct {
+	w   io.WriteCloser
+	buf []byte
+}
+
+func openCandidateLog(c *candidateLogConfig) (*candidateLog, error) {
+	w, err := logging.OpenFile(&c.FileConfig)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("writing sampled candidates", "path", c.Path, "sampleRate", c.SampleRate)
+	return &candidateLog{w: w}, nil
+}
+
+// write writes a line for each sample.  Only one sampler writes at a
+// time.
+func (l *candidateLog) write(packetID string, samples []sampledCandidate) error {
+	buf := l.buf[:0]
+	for _, c := range samples {
+		buf = append(buf, `{"value":`...)
+		buf = c.value.Append(buf, 10)
+		buf = append(buf, `,"iterations":`...)
+		buf = strconv.AppendUint(buf, c.iterations, 10)
+		buf = append(buf, `,"maxBits":`...)
+		buf = strconv.AppendInt(buf, int64(c.maxBits), 10)
+		buf = append(buf, "}\n"...)
+	}
+	l.buf = buf
+	_, err := l.w.Write(buf)
+	return err
+}
+
+func (l *candidateLog) close() error {
+	return l.w.Close()
+}
+
+// sampledCandidate is a candidate a sampler picked.
+type sampledCandidate struct {
+	value      *big.Int
+	iterations uint64
+
+	// maxBits is the bit length of the highest value the trajectory
+	// reached.
+	maxBits int
+}
+
+// candidateOutput is somewhere sampled candidates are written, each
+// with the chance rate.
+type candidateOutput struct {
+	name string
+	rate float64
+
+	// write is called with the samples taken in a sub-block.  Calls
+	// are serialized.
+	write func(packetID string, samples []sampledCandidate) error
+
+	sync.Mutex
+	failed bool
+}
+
+// candidateOutputs are where run writes sampled candidates.
+var candidateOutputs []*candidateOutput
+
+// addCandidateOutput has run sample candidates at rate for write.
+func addCandidateOutput(name string, rate float64, write func(string, []sampledCandidate) error) {
+	candidateOutputs = append(candidateOutputs, &candidateOutput{name: name, rate: rate, write: write})
+}
+
+// newSampler returns a sampler for a worker running packetID, or nil
+// if there is no candidate output.
+func newSampler(packetID string) *candidateSampler {
+	if len(candidateOutputs) == 0 {
+		return nil
+	}
+	s := &candidateSampler{
+		packetID: packetID,
+		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		samples:  make([][]sampledCandidate, len(candidateOutputs)),
+	}
+	for _, out := range candidateOutputs {
+		s.rate = max(s.rate, out.rate)
+	}
+	s.skip = s.draw()
+	return s
+}
+
+// candidateSampler picks which of a worker's candidates are written,
+// at the highest rate any output asks for, and holds them until the
+// end of the sub-block.  Each output is given a sample picked at that
+// rate, thinned to its own.  Its methods do nothing if it is nil.
+type candidateSampler struct {
+	packetID string
+	rate     float64
+	rng      *rand.Rand
+
+	// skip is the number of candidates to pass over before the next
+	// one sampled.  Drawing it, rather than a chance per candidate,
+	// keeps the cost of those not sampled to a decrement.
+	skip uint64
+
+	// samples are those held for each output.
+	samples [][]sampledCandidate
+	n, t    big.Int
+}
+
+// draw returns the number of candidates before the next sampled,
+// which is geometrically distributed.
+func (s *candidateSampler) draw() uint64 {
+	if s.rate >= 1 {
+		return 0
+	}
+	u := 1 - s.rng.Float64()
+	skip := math.Floor(math.Log(u) / math.Log1p(-s.rate))
+	if skip >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return uint64(skip)
+}
+
+// take reports whether the next candidate is sampled.
+func (s *candidateSampler) take() bool {
+	if s == nil {
+		return false
+	}
+	if s.skip > 0 {
+		s.skip--
+		return false
+	}
+	s.skip = s.draw()
+	return true
+}
+
+// record holds value, which took iterations, for the outputs its
+// sample is thinned to.  The trajectory is followed again for its
+// peak, which the engines do not track.
+func (s *candidateSampler) record(value *big.Int, iterations uint64) {
+	n, t := &s.n, &s.t
+	n.Set(value)
+	maxBits := n.BitLen()
+	for i := uint64(0); i < iterations; i++ {
+		if n.Bit(0) == 0 {
+			n.Rsh(n, 1)
+			continue
+		}
+		t.Lsh(n, 1)
+		n.Add(n, t)
+		n.Add(n, one)
+		if bits := n.BitLen(); bits > maxBits {
+			maxBits = bits
+		}
+	}
+	c := sampledCandidate{value: new(big.Int).Set(value), iterations: iterations, maxBits: maxBits}
+	for i, out := range candidateOutputs {
+		if out.rate < s.rate && s.rng.Float64()*s.rate >= out.rate {
+			continue
+		}
+		s.samples[i] = append(s.samples[i], c)
+	}
+}
+
+// flush writes the candidates held.  A failed write is logged once per
+// output, and its candidates dropped.
+func (s *candidateSampler) flush() {
+	if s == nil {
+		return
+	}
+	for i, out := range candidateOutputs {
+		if len(s.samples[i]) == 0 {
+			continue
+		}
+		out.Lock()
+		if err := out.write(s.packetID, s.samples[i]); err != nil && !out.failed {
+			out.failed = true
+			slog.Error("cannot write sampled candidates; dropping them", "output", out.name, "err", err)
+		}
+		out.Unlock()
+		clear(s.samples[i])
+		s.samples[i] = s.samples[i][:0]
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"math/big"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// captureMaxSteps bounds a captured trajectory.  It is the server's
+// default limit on those it asks for.
+const captureMaxSteps = 1 << 20
+
+// maxCaptures is the number of captured trajectories we keep for the
+// server to ask for.  It asks only about records, and soon after the
+// packet is reported.
+const maxCaptures = 32
+
+// trajectoryArena is the scratch space for capturing a trajectory.
+// Every value is kept in words, one after another, so once the arena
+// has grown to fit, a capture allocates nothing until it is copied
+// out.
+type trajectoryArena struct {
+	n, t big.Int
+
+	// words holds each value in turn, and ends[i] is where value i
+	// ends in it.
+	words []big.Word
+	ends  []int
+
+	truncated bool
+}
+
+// arenaPool holds arenas between captures, which are rare, so workers
+// need not each keep one.
+var arenaPool = sync.Pool{New: func() any { return new(trajectoryArena) }}
+
+// capture follows s for at most max steps, as internal.ComputeTrajectory
+// does, keeping every value.
+func (a *trajectoryArena) capture(s *big.Int, max uint64) {
+	a.words = append(a.words[:0], s.Bits()...)
+	a.ends = append(a.ends[:0], len(a.words))
+	a.truncated = false
+	n, t := &a.n, &a.t
+	n.Set(s)
+	for steps := uint64(0); ; steps++ {
+		if steps == max {
+			a.truncated = true
+			return
+		}
+		if n.Bit(0) == 0 {
+			n.Rsh(n, 1)
+		} else {
+			// 3n+1 as n+2n+1, so n's words are reused
+			t.Lsh(n, 1)
+			n.Add(n, t)
+			n.Add(n, one)
+		}
+		a.words = append(a.words, n.Bits()...)
+		a.ends = append(a.ends, len(a.words))
+		if n.Cmp(s) <= 0 {
+			return
+		}
+	}
+}
+
+// captured returns a copy of the arena's trajectory of s, sized to
+// fit.
+func (a *trajectoryArena) captured(s *big.Int) *capturedTrajectory {
+	return &capturedTrajectory{
+		value:     new(big.Int).Set(s),
+		words:     slices.Clip(slices.Clone(a.words)),
+		ends:      slices.Clip(slices.Clone(a.ends)),
+		truncated: a.truncated,
+	}
+}
+
+// capturedTrajectory is a trajectory kept as the arena held it.
+type capturedTrajectory struct {
+	value     *big.Int
+	words     []big.Word
+	ends      []int
+	truncated bool
+}
+
+// steps returns the number of steps captured.
+func (c *capturedTrajectory) steps() uint64 {
+	return uint64(len(c.ends) - 1)
+}
+
+// at returns value i of the trajectory.  It shares the captured words,
+// so must not be changed.
+func (c *capturedTrajectory) at(i uint64) *big.Int {
+	end := c.ends[i]
+	return new(big.Int).SetBits(c.words[c.start(i):end:end])
+}
+
+// trajectory returns the trajectory req asks for, exactly as
+// internal.ComputeTrajectory would, or false if the capture was cut
+// off before the steps req asks for.
+func (c *capturedTrajectory) trajectory(req internal.TrajectoryRequest) (internal.Trajectory, bool) {
+	t := internal.Trajectory{
+		PacketID: req.PacketID,
+		Value:    new(big.Int).Set(req.Value),
+		Format:   req.Format,
+		Steps:    c.steps(),
+	}
+	if req.MaxSteps != 0 && req.MaxSteps < t.Steps {
+		t.Steps = req.MaxSteps
+		t.Truncated = true
+	} else if c.truncated {
+		if req.MaxSteps != t.Steps {
+			return internal.Trajectory{}, false
+		}
+		t.Truncated = true
+	}
+	switch req.Format {
+	case internal.TrajectoryFull:
+		t.Values = make([]*big.Int, 0, t.Steps+1)
+		for i := uint64(0); i <= t.Steps; i++ {
+			t.Values = append(t.Values, c.at(i))
+		}
+	case internal.TrajectoryParity:
+		var parity strings.Builder
+		parity.Grow(int(t.Steps))
+		for i := uint64(0); i < t.Steps; i++ {
+			parity.WriteByte('0' + byte(c.words[c.start(i)]&1))
+		}
+		t.Parity = parity.String()
+	}
+	return t, true
+}
+
+// start returns where value i begins in words.
+func (c *capturedTrajectory) start(i uint64) int {
+	if i == 0 {
+		return 0
+	}
+	return c.ends[i-1]
+}
+
+// captureStore holds the last maxCaptures trajectories captured, by
+// value.
+type captureStore struct {
+	sync.Mutex
+	byValue map[string]*capturedTrajectory
+	order   []string
+}
+
+// captures is every worker's captured trajectories.
+var captures = captureStore{byValue: map[string]*capturedTrajectory{}}
+
+// add keeps c, forgetting the oldest capture if we hold maxCaptures.
+func (cs *captureStore) add(c *capturedTrajectory) {
+	key := c.value.String()
+	cs.Lock()
+	defer cs.Unlock()
+	if _, found := cs.byValue[key]; !found {
+		if len(cs.order) == maxCaptures {
+			delete(cs.byValue, cs.order[0])
+			cs.order = cs.order[1:]
+		}
+		cs.order = append(cs.order, key)
+	}
+	cs.byValue[key] = c
+}
+
+// trajectory returns the trajectory req asks for, if we captured it.
+func (cs *captureStore) trajectory(req internal.TrajectoryRequest) (internal.Trajectory, bool) {
+	cs.Lock()
+	c, found := cs.byValue[req.Value.String()]
+	cs.Unlock()
+	if !found {
+		return internal.Trajectory{}, false
+	}
+	return c.trajectory(req)
+}
+
+// captureFinding captures the trajectory of s, so the server can be
+// sent it without following s again.
+func captureFinding(s *big.Int) {
+	a := arenaPool.Get().(*trajectoryArena)
+	defer arenaPool.Put(a)
+	a.capture(s, captureMaxSteps)
+	captures.add(a.captured(s))
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"math/big"
+	"sort"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// pendingChallenges returns the challenges at or after position which
+// are not yet answered, lowest first.
+func pendingChallenges(challenges []internal.Challenge, position *big.Int, answers []internal.ChallengeResponse) []internal.Challenge {
+	ret := []internal.Challenge{}
+	for _, c := range challenges {
+		if c.Value == nil || c.Value.Cmp(position) < 0 || answered(c, answers) {
+			continue
+		}
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Value.Cmp(ret[j].Value) < 0 })
+	return ret
+}
+
+// answerRemaining answers any challenges not yet answered, such as
+// those which are not candidates we test, or which were passed before
+// resuming from a journal written by an older client.
+func answerRemaining(challenges []internal.Challenge, answers []internal.ChallengeResponse) []internal.ChallengeResponse {
+	for _, c := range challenges {
+		if c.Value != nil && !answered(c, answers) {
+			answers = append(answers, c.Answer())
+		}
+	}
+	return answers
+}
+
+func answered(c internal.Challenge, answers []internal.ChallengeResponse) bool {
+	for _, a := range answers {
+		if a.Value != nil && a.Value.Cmp(c.Value) == 0 {
+			return true
+		}
+	}
+	return false
+}
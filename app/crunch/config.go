@@ -0,0 +1,359 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/auth"
+	"github.com/skandragon/collatz/internal/localstore"
+	"github.com/skandragon/collatz/internal/logging"
+	"github.com/skandragon/collatz/internal/statsd"
+	"gopkg.in/yaml.v3"
+)
+
+type config struct {
+	// ServerURL is the base URL of the work server, or a "nats://"
+	// URL to reach it through a NATS server.  If empty, we run a
+	// fixed local block instead of asking a server for work.
+	ServerURL string `yaml:"serverURL,omitempty"`
+
+	UserID            string `yaml:"userID,omitempty"`
+	UserSecretVersion string `yaml:"userSecretVersion,omitempty"`
+
+	// UserSecret may be set here, but "crunch secret set" will store
+	// it in the OS keyring, or an encrypted file, instead.  "crunch
+	// enroll" sets all three from a one-time enrollment code.
+	UserSecret string `yaml:"userSecret,omitempty"`
+
+	// ServerPublicKey, if set, is the server's packet signing key, as
+	// printed by "blockserver public-key".  Packets without a valid
+	// signature by it are not run.
+	ServerPublicKey string `yaml:"serverPublicKey,omitempty"`
+
+	// MaxClockSkew is the local clock error we tolerate silently.
+	MaxClockSkew time.Duration `yaml:"maxClockSkew,omitempty"`
+
+	// PrefetchDepth is the number of packets to hold beyond the one
+	// each worker is running, so workers never wait on the network.
+	PrefetchDepth int `yaml:"prefetchDepth,omitempty"`
+
+	// JournalInterval is how often a worker records its progress
+	// through a packet, bounding the work lost to a crash.
+	JournalInterval time.Duration `yaml:"journalInterval,omitempty"`
+
+	// SummaryInterval is how often a summary of our work is logged.
+	// The default is 10m; a negative value disables the summary.
+	SummaryInterval time.Duration `yaml:"summaryInterval,omitempty"`
+
+	// MaxPacketBitLength and MaxPacketSize reject packets from the
+	// server which are outside what we consider sane.
+	MaxPacketBitLength int   `yaml:"maxPacketBitLength,omitempty"`
+	MaxPacketSize      int64 `yaml:"maxPacketSize,omitempty"`
+
+	// Local is the range run when there is no ServerURL.
+	Local localConfig `yaml:"local,omitempty"`
+
+	// MetricsListen, if set, is the address on which we serve
+	// Prometheus metrics at /metrics, such as "127.0.0.1:9100".
+	MetricsListen string `yaml:"metricsListen,omitempty"`
+
+	// Statsd, if set, pushes the same metrics to a statsd server.
+	Statsd *statsd.Config `yaml:"statsd,omitempty"`
+
+	// Tracing, if set, exports spans covering each packet's claim,
+	// computation, and report.
+	Tracing *tracingConfig `yaml:"tracing,omitempty"`
+
+	// Thermal, if set, pauses workers while the CPU is too hot.
+	Thermal *thermalConfig `yaml:"thermal,omitempty"`
+
+	// Yield pauses workers while the machine is busy with other work,
+	// unless disabled.
+	Yield yieldConfig `yaml:"yield,omitempty"`
+
+	// Health, if set, serves a health check for orchestrators.
+	Health *healthConfig `yaml:"health,omitempty"`
+
+	// WheelBits sizes the residue wheel, which counts candidates
+	// certain to drop below themselves within their first steps
+	// without following them.  The default is 16; a negative value
+	// disables the wheel.
+	WheelBits int `yaml:"wheelBits,omitempty"`
+
+	// JumpBits is the number of halvings the jump engine takes at
+	// once, from 8 to 20; its table takes 2^JumpBits words.  If
+	// unset, calibration picks it, or it is 8.  A negative value
+	// disables the jump engine.
+	JumpBits int `yaml:"jumpBits,omitempty"`
+
+	// TableMemory is the MiB the jump table and residue wheel may
+	// take together; calibration picks no jump table larger.  By
+	// default it is half the last level cache.  -table-memory
+	// overrides it.
+	TableMemory int `yaml:"tableMemory,omitempty"`
+
+	// LimbBatch is the number of candidates the u256 engine follows
+	// at once, up to 64, so the CPU can overlap their arithmetic; 1
+	// follows them one at a time.  The default is 1 where the engine
+	// has an assembly kernel, and 64 elsewhere.  "crunch bench" shows
+	// which is faster here.
+	LimbBatch int `yaml:"limbBatch,omitempty"`
+
+	// Workers is the number of packets run at once.  By default it is
+	// one per physical core we may use, within any cgroup CPU quota.
+	Workers int `yaml:"workers,omitempty"`
+
+	// Placement is "auto", the default, to spread workers over the
+	// machine's NUMA nodes, or its L3 caches if it has one node, each
+	// with its own copy of the lookup tables; or "none".  Workers are
+	// placed only on Linux, and only on machines with more than one
+	// such domain.
+	Placement string `yaml:"placement,omitempty"`
+
+	// NoCalibration skips timing the engines at startup.  Otherwise
+	// "crunch run" with -engine=auto uses the fastest it finds.
+	NoCalibration bool `yaml:"noCalibration,omitempty"`
+
+	// Watchdog, if set, looks for workers stuck on one candidate.
+	Watchdog *watchdogConfig `yaml:"watchdog,omitempty"`
+
+	// Alerts, if set, runs a hook when something looks wrong.
+	Alerts *alertConfig `yaml:"alerts,omitempty"`
+
+	// CandidateLog, if set, writes a sample of the candidates tested
+	// to a file, one per line.
+	CandidateLog *candidateLogConfig `yaml:"candidateLog,omitempty"`
+
+	// ResultsDB, if set, keeps a summary of each block, the records
+	// set, and optionally a sample of the candidates tested, in a
+	// local SQLite database.
+	ResultsDB *resultsDBConfig `yaml:"resultsDB,omitempty"`
+
+	// Publish, if set, POSTs a summary of each block, and what it
+	// finds, to an endpoint of the user's.
+	Publish *publishConfig `yaml:"publish,omitempty"`
+
+	// Kafka, if set, produces a summary of each block, and what it
+	// finds, to a Kafka topic.
+	Kafka *kafkaConfig `yaml:"kafka,omitempty"`
+
+	// MQTT, if set, publishes a summary of each block, what it finds,
+	// and our progress to an MQTT broker.
+	MQTT *mqttConfig `yaml:"mqtt,omitempty"`
+
+	// Reports controls report cadence and content.
+	Reports reportSettings `yaml:"reports,omitempty"`
+
+	// StateDir holds data that must persist across restarts, such
+	// as our node ID.
+	StateDir string `yaml:"stateDir,omitempty"`
+
+	// StateEncoding is how checkpoints, spooled reports, and the rest
+	// of our state are written: "cbor", the default and most compact,
+	// or "json", as clients before this option wrote them.  Changing
+	// it rewrites the state when we next start.
+	StateEncoding string `yaml:"stateEncoding,omitempty"`
+
+	// Campaign, if set, names the search we are taking part in, and
+	// is attached to every line we log.
+	Campaign string `yaml:"campaign,omitempty"`
+
+	// Logging selects the log format and level.
+	Logging logging.Config `yaml:"logging,omitempty"`
+}
+
+type plainConfig config
+
+// String and GoString keep the secret out of anything dumping the config.
+func (c config) String() string { return fmt.Sprintf("%+v", c.redacted()) }
+
+func (c config) GoString() string { return fmt.Sprintf("%#v", c.redacted()) }
+
+func (c config) redacted() plainConfig {
+	ret := plainConfig(c)
+	if ret.UserSecret != "" {
+		ret.UserSecret = internal.Redacted
+	}
+	return ret
+}
+
+// tracingConfig selects where spans are exported.
+type tracingConfig struct {
+	// Endpoint is the OTLP HTTP traces endpoint, such as
+	// "http://localhost:4318/v1/traces".
+	Endpoint string `yaml:"endpoint,omitempty"`
+
+	// ServiceName defaults to "crunch".
+	ServiceName string `yaml:"serviceName,omitempty"`
+}
+
+func defaultStateDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".collatz"
+	}
+	return filepath.Join(dir, "collatz")
+}
+
+func defaultConfigPath() string {
+	return filepath.Join(defaultStateDir(), "crunch.yaml")
+}
+
+// loadConfig reads the config file.  A missing file is not an error,
+// and results in an empty config.
+func loadConfig(filename string) (*config, error) {
+	c := &config{}
+	b, err := os.ReadFile(filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	if err := c.Logging.Validate(); err != nil {
+		return nil, err
+	}
+	switch c.Reports.NodeInfo {
+	case "", nodeInfoAlways, nodeInfoCompleted, nodeInfoNever:
+	default:
+		return nil, fmt.Errorf("reports.nodeInfo must be one of %q, %q, or %q",
+			nodeInfoAlways, nodeInfoCompleted, nodeInfoNever)
+	}
+	switch c.Reports.Authenticator {
+	case "", auth.V1, auth.V2:
+	default:
+		return nil, fmt.Errorf("reports.authenticator must be %q or %q", auth.V1, auth.V2)
+	}
+	if c.ServerPublicKey != "" {
+		if _, err := auth.ParsePublicKey(c.ServerPublicKey); err != nil {
+			return nil, fmt.Errorf("serverPublicKey: %v", err)
+		}
+	}
+	if _, _, err := c.Local.candidates(1); err != nil {
+		return nil, err
+	}
+	if c.MaxPacketBitLength == 0 {
+		c.MaxPacketBitLength = internal.DefaultPacketLimits.MaxBitLength
+	}
+	if c.MaxPacketSize == 0 {
+		c.MaxPacketSize = internal.DefaultPacketLimits.MaxBlockSize
+	}
+	if c.PrefetchDepth == 0 {
+		c.PrefetchDepth = 1
+	}
+	if c.JournalInterval == 0 {
+		c.JournalInterval = 5 * time.Second
+	}
+	if c.SummaryInterval == 0 {
+		c.SummaryInterval = 10 * time.Minute
+	}
+	if c.StateDir == "" {
+		c.StateDir = defaultStateDir()
+	}
+	encoding, err := localstore.ParseEncoding(c.StateEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("stateEncoding: %v", err)
+	}
+	c.StateEncoding = string(encoding)
+	if c.Workers < 0 {
+		return nil, fmt.Errorf("workers cannot be negative")
+	}
+	switch c.Placement {
+	case "":
+		c.Placement = placementAuto
+	case placementAuto, placementNone:
+	default:
+		return nil, fmt.Errorf("placement must be %q or %q", placementAuto, placementNone)
+	}
+	if c.WheelBits == 0 {
+		c.WheelBits = defaultWheelBits
+	}
+	if c.Thermal != nil {
+		if err := c.Thermal.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Yield.applyDefaults(); err != nil {
+		return nil, err
+	}
+	if c.Statsd != nil {
+		if err := c.Statsd.ApplyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if c.Health != nil {
+		if err := c.Health.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if c.Watchdog != nil {
+		c.Watchdog.applyDefaults()
+	}
+	if c.Alerts != nil {
+		if err := c.Alerts.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if c.CandidateLog != nil {
+		if err := c.CandidateLog.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if c.ResultsDB != nil {
+		if err := c.ResultsDB.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if c.Publish != nil {
+		if err := c.Publish.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if c.Kafka != nil {
+		if err := c.Kafka.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if c.MQTT != nil {
+		if err := c.MQTT.applyDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if c.Tracing != nil {
+		if c.Tracing.Endpoint == "" {
+			return nil, fmt.Errorf("tracing.endpoint is required")
+		}
+		if c.Tracing.ServiceName == "" {
+			c.Tracing.ServiceName = "crunch"
+		}
+	}
+	return c, nil
+}
+
+func (c *config) packetLimits() internal.PacketLimits {
+	return internal.PacketLimits{
+		MaxBitLength: c.MaxPacketBitLength,
+		MaxBlockSize: c.MaxPacketSize,
+	}
+}
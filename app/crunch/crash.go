@@ -0,0 +1,115 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// workerPanic is what run panics with when testing a candidate panics,
+// adding where it was.
+type workerPanic struct {
+	value    any
+	stack    []byte
+	position *big.Int
+	engine   string
+}
+
+func (p *workerPanic) Error() string {
+	return fmt.Sprintf("%v (testing %s with the %s engine)", p.value, p.position, p.engine)
+}
+
+// runRecovering calls run, returning a crash report rather than
+// panicking.
+func runRecovering(work *internal.WorkPacket, dom *domain, logger *slog.Logger, position *big.Int, partial *blockResult, journal journalFunc, watch *candidateWatch) (result *blockResult, crash *internal.CrashReport) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		crash = &internal.CrashReport{
+			Time:     time.Now().UTC(),
+			PacketID: work.ID,
+			Panic:    fmt.Sprint(v),
+			Stack:    string(debug.Stack()),
+		}
+		if p, ok := v.(*workerPanic); ok {
+			crash.Panic = fmt.Sprint(p.value)
+			crash.Stack = string(p.stack)
+			crash.Value = p.position
+			crash.Engine = p.engine
+		}
+	}()
+	return run(work, dom, logger, position, partial, journal, watch), nil
+}
+
+// crashed logs a crash report and writes it to the crash directory.
+// If configured to, it also sends the report to the server.
+func (r *reporter) crashed(ctx context.Context, report internal.CrashReport) {
+	report.NodeID = r.ni.NodeID
+	logger := packetLogger(report.WorkerID, report.PacketID)
+	logger.Error("worker panicked", "value", report.Value, "engine", report.Engine,
+		"panic", report.Panic, "stack", report.Stack)
+	filename, err := writeCrashReport(r.crashDir, report)
+	if err != nil {
+		logger.Error("cannot write crash report", "err", err)
+	} else {
+		logger.Info("wrote crash report", "file", filename)
+	}
+	if !r.settings.Crashes {
+		return
+	}
+	resp, err := r.c.Crash(ctx, report)
+	if err != nil {
+		logger.Error("cannot send crash report", "err", err)
+		return
+	}
+	if !resp.Accepted {
+		logger.Warn("crash report rejected")
+	}
+}
+
+func writeCrashReport(dir string, report internal.CrashReport) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	filename := filepath.Join(dir, fmt.Sprintf("crash-%s-%04d.json",
+		report.Time.Format("20060102T150405.000000000Z"), report.WorkerID))
+	return filename, os.WriteFile(filename, b, 0o600)
+}
+
+// repanicAt is deferred by run, so that a panic says which candidate
+// was being tested.
+func repanicAt(current *big.Int, engine string) {
+	if v := recover(); v != nil {
+		panic(&workerPanic{value: v, stack: debug.Stack(), position: new(big.Int).Set(current), engine: engine})
+	}
+}
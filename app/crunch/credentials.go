@@ -0,0 +1,218 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+const (
+	keyringService = "collatz"
+
+	// secretFile holds the encrypted user secret when no keyring is available.
+	secretFile = "user-secret.enc"
+
+	// secretKeyFile holds a random key used to encrypt secretFile
+	// when no passphrase is provided in the environment.
+	secretKeyFile = "user-secret.key"
+
+	// passphraseEnv names an environment variable holding a passphrase
+	// used to encrypt the secret file.
+	passphraseEnv = "COLLATZ_SECRET_PASSPHRASE"
+)
+
+// loadUserSecret returns the user secret, preferring the plaintext
+// config value (for backwards compatibility), then the OS keyring,
+// then the encrypted file in the state directory.
+func loadUserSecret(c *config) (string, error) {
+	if c.UserSecret != "" {
+		return c.UserSecret, nil
+	}
+	secret, err := keyring.Get(keyringService, c.UserID)
+	if err == nil {
+		return secret, nil
+	}
+	secret, ferr := readSecretFile(c.StateDir)
+	if ferr == nil {
+		return secret, nil
+	}
+	if errors.Is(ferr, fs.ErrNotExist) {
+		return "", fmt.Errorf("no secret for user %q in config, keyring (%v), or %s; run \"crunch secret set\" or \"crunch enroll\"",
+			c.UserID, err, filepath.Join(c.StateDir, secretFile))
+	}
+	return "", ferr
+}
+
+// storeUserSecret saves the secret in the OS keyring, or if that is not
+// available, in an encrypted file in the state directory.
+func storeUserSecret(c *config, secret string) (string, error) {
+	err := keyring.Set(keyringService, c.UserID, secret)
+	if err == nil {
+		return "OS keyring", nil
+	}
+	if ferr := writeSecretFile(c.StateDir, secret); ferr != nil {
+		return "", fmt.Errorf("keyring: %v, file: %v", err, ferr)
+	}
+	return filepath.Join(c.StateDir, secretFile), nil
+}
+
+func secretCommand(c *config, args []string) error {
+	if len(args) != 1 || args[0] != "set" {
+		return fmt.Errorf("usage: crunch secret set")
+	}
+	if c.UserID == "" {
+		return fmt.Errorf("userID must be set in the config file first")
+	}
+	secret, err := readSecret()
+	if err != nil {
+		return err
+	}
+	where, err := storeUserSecret(c, secret)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Secret for %s stored in %s.\n", c.UserID, where)
+	if c.UserSecret != "" {
+		fmt.Println("You should now remove userSecret from your config file.")
+	}
+	return nil
+}
+
+func readSecret() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "User secret: ")
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// secretFileKey returns the key protecting the secret file.  With a
+// passphrase this is real protection; with only the generated key file
+// it guards against accidental disclosure (config backups, dotfile
+// repositories) but not against someone who can read the state directory.
+// Only when create is set, for writing the secret file, is the key file
+// generated if it is missing or malformed; otherwise that is an error,
+// as a new key could not decrypt the file anyway.
+func secretFileKey(stateDir string, salt []byte, create bool) ([]byte, error) {
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	}
+	filename := filepath.Join(stateDir, secretKeyFile)
+	key, err := os.ReadFile(filename)
+	if err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if !create {
+		problem := "is missing"
+		if err == nil {
+			problem = fmt.Sprintf("holds %d bytes, not 32", len(key))
+		}
+		return nil, fmt.Errorf("cannot decrypt %s: %s %s (was it written with %s set?); run \"crunch secret set\" again",
+			secretFile, filename, problem, passphraseEnv)
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(filename, key, 0o600)
+}
+
+// The secret file is salt (16 bytes) || nonce || AES-256-GCM ciphertext.
+func writeSecretFile(stateDir string, secret string) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := secretFileAEAD(stateDir, salt, true)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	out := append(salt, nonce...)
+	out = aead.Seal(out, nonce, []byte(secret), nil)
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(stateDir, secretFile), out, 0o600)
+}
+
+func readSecretFile(stateDir string) (string, error) {
+	b, err := os.ReadFile(filepath.Join(stateDir, secretFile))
+	if err != nil {
+		return "", err
+	}
+	if len(b) < 16 {
+		return "", fmt.Errorf("%s is truncated", secretFile)
+	}
+	aead, err := secretFileAEAD(stateDir, b[:16], false)
+	if err != nil {
+		return "", err
+	}
+	b = b[16:]
+	if len(b) < aead.NonceSize() {
+		return "", fmt.Errorf("%s is truncated", secretFile)
+	}
+	plaintext, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt %s (wrong %s?): %v", secretFile, passphraseEnv, err)
+	}
+	return string(plaintext), nil
+}
+
+func secretFileAEAD(stateDir string, salt []byte, create bool) (cipher.AEAD, error) {
+	key, err := secretFileKey(stateDir, salt, create)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
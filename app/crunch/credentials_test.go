@@ -0,0 +1,95 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretFile(t *testing.T) {
+	t.Setenv(passphraseEnv, "")
+	dir := t.TempDir()
+	if err := writeSecretFile(dir, "sekrit"); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := readSecretFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != "sekrit" {
+		t.Fatalf("read %q, want %q", secret, "sekrit")
+	}
+	key, err := os.ReadFile(filepath.Join(dir, secretKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a second write keeps the key
+	if err := writeSecretFile(dir, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := os.ReadFile(filepath.Join(dir, secretKeyFile)); err != nil || !bytes.Equal(again, key) {
+		t.Fatalf("writing the secret file again replaced its key")
+	}
+}
+
+// TestSecretFileKeyNotCreatedOnRead checks that reading the secret file
+// fails, leaving the key file as it was, when the key file is missing or
+// malformed.
+func TestSecretFileKeyNotCreatedOnRead(t *testing.T) {
+	t.Setenv(passphraseEnv, "")
+	for _, tt := range []struct {
+		name string
+		key  []byte
+	}{
+		{"missing", nil},
+		{"short", []byte("short")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := writeSecretFile(dir, "sekrit"); err != nil {
+				t.Fatal(err)
+			}
+			keyFile := filepath.Join(dir, secretKeyFile)
+			if tt.key == nil {
+				if err := os.Remove(keyFile); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := os.WriteFile(keyFile, tt.key, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := readSecretFile(dir)
+			if err == nil {
+				t.Fatal("read the secret file without its key")
+			}
+			if errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("got %v, which reads as no secret file at all", err)
+			}
+			key, err := os.ReadFile(keyFile)
+			if tt.key == nil && !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("reading created %s", secretKeyFile)
+			}
+			if tt.key != nil && !bytes.Equal(key, tt.key) {
+				t.Errorf("reading replaced %s", secretKeyFile)
+			}
+		})
+	}
+}
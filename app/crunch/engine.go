@@ -0,0 +1,344 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/big"
+	"math/bits"
+	"sync"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// engineLimbs tests candidates using four fixed 64-bit limbs.
+const engineLimbs = "u256"
+
+// limbsMaxStartBits is the largest candidate, in bits, that run hands
+// to the limbs engine.  A trajectory from below 2^128 would need to
+// more than square its start to overflow 256 bits, which none known
+// comes close to; those that do are finished with math/big.
+const limbsMaxStartBits = 128
+
+// engineGMP tests candidates using GMP, when built with -tags gmp.
+const engineGMP = "gmp"
+
+// engine follows trajectories for run, one candidate at a time.
+type engine interface {
+	name() string
+	iterate(s *big.Int, watch *candidateWatch) (interesting bool, iterCount uint64, abandoned bool)
+}
+
+// engineAuto lets engineFor pick the fastest engine for each packet.
+const engineAuto = "auto"
+
+// engineChoice is the engine named by -engine: engineAuto, or one of
+// the engines' names.
+var engineChoice = engineAuto
+
+// disabledEngines are those which disagreed with math/big on the
+// conformance candidates, which engineFor no longer uses.
+var disabledEngines = map[string]bool{}
+
+// selectEngine checks the engine named by -engine, opening the GPU
+// if it is "gpu".
+func selectEngine(name string, device int) error {
+	if name != engineAuto {
+		if err := openEngine(name, device); err != nil {
+			return err
+		}
+	}
+	engineChoice = name
+	return nil
+}
+
+// openEngine checks that the engine named can be used, opening the
+// GPU if it is "gpu" and not yet open.
+func openEngine(name string, device int) error {
+	switch name {
+	case engineBig, engineLimbs:
+	case engineGMP:
+		if !gmpBuilt {
+			return fmt.Errorf("built without GMP; rebuild with cgo and -tags gmp")
+		}
+	case engineJump:
+		if jumps == nil {
+			return fmt.Errorf("the jump engine is disabled by jumpBits")
+		}
+	case engineGPU:
+		if gpu != nil {
+			return nil
+		}
+		dev, err := openGPU(device)
+		if err != nil {
+			return err
+		}
+		gpu = dev
+	default:
+		return fmt.Errorf("unknown engine %q: want %s, %s, %s, %s, %s or %s", name, engineAuto, engineBig, engineLimbs, engineJump, engineGMP, engineGPU)
+	}
+	return nil
+}
+
+// engines lists every engine, for attesting and benchmarking.
+func engines() []engine {
+	ret := []engine{&iterator{}, &limbIterator{}}
+	if jumps != nil {
+		ret = append(ret, &jumpIterator{table: jumps})
+	}
+	if gmpBuilt {
+		ret = append(ret, newGMPIterator())
+	}
+	if gpu != nil {
+		ret = append(ret, newGPUIterator(gpu, nil))
+	}
+	return ret
+}
+
+// iteratorPool holds math/big iterators between packets, and between
+// the limbs engine's rare overflows, so that the scratch space they
+// have grown is reused rather than allocated again.
+var iteratorPool = sync.Pool{New: func() any { return new(iterator) }}
+
+// getIterator returns a math/big iterator from iteratorPool.
+func getIterator() *iterator {
+	return iteratorPool.Get().(*iterator)
+}
+
+// putIterator returns it to iteratorPool.
+func putIterator(it *iterator) {
+	iteratorPool.Put(it)
+}
+
+// releaseEngine returns e's scratch space to its pool, once run has
+// finished with it.
+func releaseEngine(e engine) {
+	switch it := e.(type) {
+	case *iterator:
+		putIterator(it)
+	case interface{ release() }:
+		it.release()
+	}
+}
+
+// engineFor returns the engine run uses for the work packet, with the
+// shadow engine alongside it if -shadow names one.
+func engineFor(work *internal.WorkPacket, dom *domain) engine {
+	e := primaryEngineFor(work, dom)
+	if shadowChoice != "" {
+		return &shadowEngine{primary: e, shadow: shadowFor(work, dom)}
+	}
+	return e
+}
+
+// primaryEngineFor returns the engine for the work packet: the one
+// -engine names, or with -engine=auto, the one calibration picked.
+// Packets whose candidates do not all fit in limbsMaxStartBits use
+// the jump engine, or failing that, GMP if built in, or math/big;
+// otherwise it is the limbs engine by default.  Engines which failed
+// conformance are not used.  The jump
+// engine uses the table of the worker's domain, if it has one.
+func primaryEngineFor(work *internal.WorkPacket, dom *domain) engine {
+	wide := work.EndingValue.BitLen() > limbsMaxStartBits
+	choice := engineChoice
+	if choice == engineAuto && tuned != nil {
+		choice = tuned.Engine
+		if wide {
+			choice = tuned.WideEngine
+		}
+	}
+	table := dom.jumpTable()
+	useJump := table != nil && !disabledEngines[engineJump]
+	useGMP := gmpBuilt && !disabledEngines[engineGMP]
+	switch {
+	case choice == engineBig:
+		return getIterator()
+	case choice == engineJump && useJump:
+		return &jumpIterator{table: table}
+	case choice == engineGMP && useGMP:
+		return newGMPIterator()
+	case wide:
+		if useJump {
+			return &jumpIterator{table: table}
+		}
+		if useGMP {
+			return newGMPIterator()
+		}
+		return getIterator()
+	case choice == engineGPU && gpu != nil && !disabledEngines[engineGPU]:
+		return newGPUIterator(gpu, work.EndingValue)
+	case !disabledEngines[engineLimbs]:
+		return newLimbBatchIterator(work, dom)
+	}
+	return getIterator()
+}
+
+// u256 is an unsigned 256-bit integer, least significant limb first.
+type u256 [4]uint64
+
+// setBig sets x to v, returning false if v does not fit.
+func (x *u256) setBig(v *big.Int) bool {
+	if v.Sign() < 0 || v.BitLen() > 256 {
+		return false
+	}
+	var buf [32]byte
+	v.FillBytes(buf[:])
+	for i := range x {
+		x[i] = binary.BigEndian.Uint64(buf[24-8*i:])
+	}
+	return true
+}
+
+// toBig sets v to x, and returns it.
+func (x *u256) toBig(v *big.Int) *big.Int {
+	var buf [32]byte
+	for i := range x {
+		binary.BigEndian.PutUint64(buf[24-8*i:], x[i])
+	}
+	return v.SetBytes(buf[:])
+}
+
+// add2 adds 2 to x, wrapping at 2^256.
+func (x *u256) add2() {
+	var c uint64
+	x[0], c = bits.Add64(x[0], 2, 0)
+	x[1], c = bits.Add64(x[1], 0, c)
+	x[2], c = bits.Add64(x[2], 0, c)
+	x[3], _ = bits.Add64(x[3], 0, c)
+}
+
+// cmp returns -1, 0 or +1 as x is less than, equal to, or greater
+// than y.
+func (x *u256) cmp(y *u256) int {
+	for i := 3; i >= 0; i-- {
+		if x[i] != y[i] {
+			if x[i] < y[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// How limbSteps stopped.
+const (
+	stopLimit    = iota // took as many steps as allowed
+	stopBelow           // dropped below the start
+	stopLoop            // came back to the start
+	stopOverflow        // the next 3n+1 would overflow; n is left before it
+)
+
+// limbStepsGeneric is limbSteps in Go, for architectures without an
+// assembly kernel, and for "crunch bench" to measure the kernel
+// against.
+func limbStepsGeneric(n, start *u256, max uint64) (steps uint64, stop int) {
+	for steps < max {
+		if n[0]&1 == 1 {
+			// 3n+1, which cannot bring n back down to start
+			var m u256
+			carry := uint64(1)
+			for i := range n {
+				hi, lo := bits.Mul64(n[i], 3)
+				var c uint64
+				m[i], c = bits.Add64(lo, carry, 0)
+				carry = hi + c
+			}
+			if carry != 0 {
+				return steps, stopOverflow
+			}
+			*n = m
+			steps++
+			continue
+		}
+		n[0] = n[0]>>1 | n[1]<<63
+		n[1] = n[1]>>1 | n[2]<<63
+		n[2] = n[2]>>1 | n[3]<<63
+		n[3] >>= 1
+		steps++
+		switch n.cmp(start) {
+		case 0:
+			return steps, stopLoop
+		case -1:
+			return steps, stopBelow
+		}
+	}
+	return steps, stopLimit
+}
+
+// limbIterator follows trajectories in a u256, which needs no heap
+// at all.  A trajectory which would overflow it is handed, where it
+// got to, to a math/big iterator from iteratorPool.
+type limbIterator struct {
+	// start and n live here rather than on the stack, which they
+	// would escape as arguments to kernel.
+	start, n u256
+
+	// kernel, if set, replaces limbSteps.
+	kernel func(n, start *u256, max uint64) (steps uint64, stop int)
+}
+
+// name returns the engine's name, as recorded in results.
+func (it *limbIterator) name() string {
+	return engineLimbs
+}
+
+// iterate follows the trajectory of s, as iterator.iterate does, and
+// counts iterations the same way.  The kernel runs between checks of
+// watch.
+func (it *limbIterator) iterate(s *big.Int, watch *candidateWatch) (interesting bool, iterCount uint64, abandoned bool) {
+	start, n := &it.start, &it.n
+	if !start.setBig(s) {
+		fallback := getIterator()
+		defer putIterator(fallback)
+		return fallback.iterate(s, watch)
+	}
+	*n = *start
+	kernel := it.kernel
+	if kernel == nil {
+		kernel = limbSteps
+	}
+	for {
+		limit := uint64(math.MaxUint64)
+		if watch != nil {
+			limit = watchIterations - iterCount%watchIterations
+		}
+		steps, stop := kernel(n, start, limit)
+		iterCount += steps
+		switch stop {
+		case stopBelow:
+			return false, iterCount, false
+		case stopLoop:
+			slog.Warn("found a loop back to starting value", "value", s)
+			return true, iterCount, false
+		case stopOverflow:
+			slog.Debug("trajectory overflowed 256 bits", "value", s)
+			fallback := getIterator()
+			fallback.reserve(2 * 256)
+			n.toBig(&fallback.n)
+			interesting, iterCount, abandoned = fallback.follow(s, iterCount, watch)
+			putIterator(fallback)
+			return interesting, iterCount, abandoned
+		}
+		if watch != nil && watch.check(iterCount) {
+			return false, iterCount, true
+		}
+	}
+}
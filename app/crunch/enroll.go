@@ -0,0 +1,179 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/client"
+	"github.com/skandragon/collatz/internal/natshttp"
+	"gopkg.in/yaml.v3"
+)
+
+// enrollCommand exchanges a one-time code, issued by the server's
+// admin, for our user's credentials.  The secret is stored as by
+// "crunch secret set", and the server URL, user ID, and secret version
+// are written to the config file.
+func enrollCommand(ctx context.Context, c *config, configFile string, args []string) error {
+	flags := flag.NewFlagSet("enroll", flag.ContinueOnError)
+	server := flags.String("server", c.ServerURL, "base URL of the work server")
+	insecure := flags.Bool("insecure", false, "allow enrolling over plain HTTP")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 || *server == "" {
+		return fmt.Errorf("usage: crunch enroll [-server URL] CODE")
+	}
+	if err := checkEnrollURL(*server, *insecure); err != nil {
+		return err
+	}
+
+	st, err := openLocalStore(c)
+	if err != nil {
+		return err
+	}
+	nodeID, err := loadOrCreateNodeID(st, c.StateDir)
+	st.Close()
+	if err != nil {
+		return err
+	}
+	resp, err := client.New(*server, internal.UserCredentials{}, c.MaxClockSkew).Enroll(ctx, internal.EnrollRequest{
+		Code:   flags.Arg(0),
+		NodeID: nodeID,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.ServerURL = *server
+	c.UserID = resp.UserID
+	c.UserSecretVersion = resp.UserSecretVersion
+	where, err := storeUserSecret(c, resp.UserSecret)
+	if err != nil {
+		return err
+	}
+	err = updateConfigFile(configFile, []configSetting{
+		{"serverURL", c.ServerURL},
+		{"userID", c.UserID},
+		{"userSecretVersion", c.UserSecretVersion},
+	}, "userSecret")
+	if err != nil {
+		return fmt.Errorf("secret stored in %s, but cannot update %s: %v", where, configFile, err)
+	}
+	fmt.Printf("Enrolled as %s.  Secret stored in %s; %s updated.\n", c.UserID, where, configFile)
+	return nil
+}
+
+// checkEnrollURL refuses to send an enrollment code, and receive a
+// secret, in the clear, unless to loopback or allowed.  Servers do not
+// enroll over NATS at all.
+func checkEnrollURL(server string, insecure bool) error {
+	if natshttp.IsURL(server) {
+		return fmt.Errorf("servers do not enroll over NATS; give -server the server's HTTPS URL")
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return fmt.Errorf("server URL: %v", err)
+	}
+	if u.Scheme == "https" || insecure {
+		return nil
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return nil
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && addr.IsLoopback() {
+		return nil
+	}
+	if ips, err := net.LookupIP(host); err == nil && len(ips) > 0 && ips[0].IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("refusing to enroll over %s to %s; use https, or -insecure", u.Scheme, host)
+}
+
+// configSetting is a top-level key of the config file, and its value.
+type configSetting struct {
+	key, value string
+}
+
+// updateConfigFile sets keys in the top level of a YAML config file,
+// and removes others, keeping the rest of it, including comments.  A
+// missing file is created.
+func updateConfigFile(filename string, set []configSetting, remove ...string) error {
+	b, err := os.ReadFile(filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s is not a YAML mapping", filename)
+	}
+	for _, r := range remove {
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			if root.Content[i].Value == r {
+				root.Content = append(root.Content[:i], root.Content[i+2:]...)
+				break
+			}
+		}
+	}
+	for _, setting := range set {
+		value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: setting.value}
+		found := false
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			if root.Content[i].Value == setting.key {
+				root.Content[i+1] = value
+				found = true
+				break
+			}
+		}
+		if !found {
+			root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: setting.key}, value)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0o600)
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// eventsFile is the node's event log, in the state directory.  It is
+// a file of its own, rather than part of the local store, so it can be
+// read while we run.
+const eventsFile = "events.jsonl"
+
+// eventLog is the node's event log of findings, records, and reports
+// the server would not accept: an append-only file of JSON lines, one
+// internal.Event each.
+type eventLog struct {
+	sync.Mutex
+	path string
+	seq  int64
+
+	// best is the most iterations of any record in the log.
+	best uint64
+}
+
+// openEventLog picks up where an existing log left off.
+func openEventLog(path string) (*eventLog, error) {
+	l := &eventLog{path: path}
+	err := readEvents(path, func(e internal.Event) {
+		l.seq = e.Seq
+		if e.Kind == internal.EventRecord && e.Iterations > l.best {
+			l.best = e.Iterations
+		}
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return l, nil
+}
+
+// readEvents calls fn with each event in the log, oldest first.
+func readEvents(path string, fn func(internal.Event)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e internal.Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// a line torn by a crash
+			continue
+		}
+		fn(e)
+	}
+	return scanner.Err()
+}
+
+// add appends an event, numbering and timestamping it.  Failing to is
+// logged; the event is also in the general log.
+func (l *eventLog) add(e internal.Event) {
+	l.Lock()
+	defer l.Unlock()
+	l.seq++
+	e.Seq = l.seq
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.Kind == internal.EventRecord && e.Iterations > l.best {
+		l.best = e.Iterations
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("cannot encode event", "kind", e.Kind, "err", err)
+		return
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		slog.Error("cannot open event log", "file", l.path, "err", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		slog.Error("cannot write event log", "file", l.path, "err", err)
+	}
+}
+
+// finished adds events for the findings in a packet, and for a new
+// record for this node.
+func (l *eventLog) finished(nodeID string, workerID int, work *internal.WorkPacket, result *blockResult) {
+	for _, v := range result.Interesting {
+		packetLogger(workerID, work.ID).Warn("LOOP FOUND", "value", v)
+		l.add(internal.Event{Kind: internal.EventLoop, NodeID: nodeID, PacketID: work.ID, Value: v})
+	}
+	l.Lock()
+	record := result.MaxIterations > l.best
+	l.Unlock()
+	if record {
+		packetLogger(workerID, work.ID).Info("new record for this node",
+			"maxIterations", result.MaxIterations, "value", result.MaxIterationsValue)
+		l.add(internal.Event{
+			Kind:       internal.EventRecord,
+			NodeID:     nodeID,
+			PacketID:   work.ID,
+			Value:      result.MaxIterationsValue,
+			Iterations: result.MaxIterations,
+		})
+	}
+}
+
+// eventsCommand implements "crunch events", printing the event log,
+// and with -f, following it as it grows.
+func eventsCommand(c *config, args []string) error {
+	flags := flag.NewFlagSet("events", flag.ContinueOnError)
+	follow := flags.Bool("f", false, "keep printing events as they are added")
+	limit := flags.Int("n", 0, "show only the most recent events")
+	asJSON := flags.Bool("json", false, "print JSON lines instead of a table")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	path := filepath.Join(c.StateDir, eventsFile)
+
+	var events []internal.Event
+	err := readEvents(path, func(e internal.Event) { events = append(events, e) })
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if *limit > 0 && len(events) > *limit {
+		events = events[len(events)-*limit:]
+	}
+	print, flush := eventPrinter(os.Stdout, *asJSON)
+	last := int64(0)
+	for _, e := range events {
+		print(e)
+		last = e.Seq
+	}
+	flush()
+	for *follow {
+		time.Sleep(time.Second)
+		err := readEvents(path, func(e internal.Event) {
+			if e.Seq > last {
+				print(e)
+				last = e.Seq
+			}
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		flush()
+	}
+	return nil
+}
+
+// eventPrinter returns functions printing events to w, as JSON lines
+// or as rows of a table, and flushing what has been printed.
+func eventPrinter(w io.Writer, asJSON bool) (func(internal.Event), func()) {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		return func(e internal.Event) { enc.Encode(e) }, func() {}
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SEQ\tTIME\tKIND\tPACKET\tVALUE\tITERATIONS\tMESSAGE")
+	return func(e internal.Event) {
+		value := ""
+		if e.Value != nil {
+			value = e.Value.String()
+		}
+		iterations := ""
+		if e.Iterations > 0 {
+			iterations = fmt.Sprint(e.Iterations)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Seq, e.Time.Format(time.RFC3339),
+			e.Kind, e.PacketID, value, iterations, e.Message)
+	}, func() { tw.Flush() }
+}
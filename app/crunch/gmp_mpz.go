@@ -0,0 +1,80 @@
+//go:build gmp && cgo
+
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log/slog"
+	"math"
+	"math/big"
+	"sync"
+
+	"github.com/skandragon/collatz/internal/gmp"
+)
+
+// gmpBuilt is true if the GMP engine is built in.
+const gmpBuilt = true
+
+// gmpPool holds GMP engines between packets, as their integers keep
+// the space they have grown to.
+var gmpPool = sync.Pool{New: func() any { return &gmpIterator{stepper: gmp.NewStepper()} }}
+
+// gmpIterator follows trajectories in GMP integers, a trajectory at a
+// time, in C.
+type gmpIterator struct {
+	stepper *gmp.Stepper
+}
+
+// newGMPIterator returns a GMP engine from gmpPool.
+func newGMPIterator() engine {
+	return gmpPool.Get().(*gmpIterator)
+}
+
+// release returns it to gmpPool.
+func (it *gmpIterator) release() {
+	gmpPool.Put(it)
+}
+
+// name returns the engine's name, as recorded in results.
+func (it *gmpIterator) name() string {
+	return engineGMP
+}
+
+// iterate follows the trajectory of s, as iterator.iterate does, and
+// counts iterations the same way.  GMP runs between checks of watch.
+func (it *gmpIterator) iterate(s *big.Int, watch *candidateWatch) (interesting bool, iterCount uint64, abandoned bool) {
+	limit := uint64(math.MaxUint64)
+	if watch != nil {
+		limit = watchIterations
+	}
+	steps, stop := it.stepper.Start(s, limit)
+	for {
+		iterCount += steps
+		switch stop {
+		case gmp.StopBelow:
+			return false, iterCount, false
+		case gmp.StopLoop:
+			slog.Warn("found a loop back to starting value", "value", s)
+			return true, iterCount, false
+		}
+		if watch != nil && watch.check(iterCount) {
+			return false, iterCount, true
+		}
+		steps, stop = it.stepper.Steps(watchIterations)
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !gmp || !cgo
+
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+// gmpBuilt is true if the GMP engine is built in.
+const gmpBuilt = false
+
+// newGMPIterator is never called, as the GMP engine is not built in.
+func newGMPIterator() engine {
+	return nil
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"text/tabwriter"
+)
+
+// engineGPU runs the limbs kernel on a GPU, a batch of candidates at
+// a time.  It is experimental.
+const engineGPU = "gpu"
+
+// gpuBatch is the number of consecutive odd candidates sent to the GPU
+// at once.
+const gpuBatch = 1 << 16
+
+// gpuMaxSteps bounds each candidate's iterations on the GPU, so one
+// long trajectory does not hold up its batch.  Candidates needing
+// more, like those which overflow, are finished on the CPU.
+const gpuMaxSteps = 1 << 12
+
+// gpu is the device opened by -engine=gpu, if any.
+var gpu gpuDevice
+
+// gpuDevice runs the limbs kernel over a batch of starting values,
+// setting each one's steps and stop as limbStepsGeneric would return
+// them, with max gpuMaxSteps.  It must be safe to call from several
+// workers at once.
+type gpuDevice interface {
+	info() gpuDeviceInfo
+	steps(starts []u256, maxSteps uint64, steps []uint64, stops []uint8) error
+}
+
+// gpuDeviceInfo describes a device found by the capability probe.
+type gpuDeviceInfo struct {
+	Index        int
+	Platform     string
+	Name         string
+	Vendor       string
+	Version      string
+	ComputeUnits int
+	Memory       uint64
+}
+
+// openGPU probes for devices, and opens the one at index.
+func openGPU(index int) (gpuDevice, error) {
+	devices, err := gpuProbe()
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 || index >= len(devices) {
+		return nil, fmt.Errorf("no GPU %d: %d found; see \"crunch gpus\"", index, len(devices))
+	}
+	dev, err := gpuOpen(devices[index])
+	if err != nil {
+		return nil, err
+	}
+	info := dev.info()
+	slog.Info("using GPU", "index", info.Index, "platform", info.Platform, "name", info.Name,
+		"vendor", info.Vendor, "version", info.Version, "computeUnits", info.ComputeUnits, "memory", info.Memory)
+	return dev, nil
+}
+
+// gpuIterator is the GPU engine.  Run asks it about odd candidates in
+// order, passing over only those it filters or sieves, so on being
+// asked about one not in its current batch it sends the GPU the batch
+// starting there, up to end if set.
+type gpuIterator struct {
+	dev gpuDevice
+	end *big.Int
+
+	// next is the candidate we expect to be asked about, at index
+	// pos of the batch.
+	next   big.Int
+	pos    int
+	starts []u256
+	steps  []uint64
+	stops  []uint8
+
+	// cpu finishes the candidates the GPU could not.
+	cpu limbIterator
+}
+
+// newGPUIterator returns an engine running batches on dev, none going
+// past end if it is set.
+func newGPUIterator(dev gpuDevice, end *big.Int) *gpuIterator {
+	return &gpuIterator{dev: dev, end: end}
+}
+
+// name returns the engine's name, as recorded in results.
+func (it *gpuIterator) name() string {
+	return engineGPU
+}
+
+// iterate returns the GPU's result for s, running a new batch if need
+// be.  Candidates the GPU gave up on, or cannot run, are followed on
+// the CPU, where watch applies.
+func (it *gpuIterator) iterate(s *big.Int, watch *candidateWatch) (interesting bool, iterCount uint64, abandoned bool) {
+	if it.dev == nil {
+		return it.cpu.iterate(s, watch)
+	}
+	for it.pos < len(it.starts) && s.Cmp(&it.next) > 0 {
+		it.pos++
+		it.next.Add(&it.next, two)
+	}
+	if s.Cmp(&it.next) != 0 || it.pos >= len(it.starts) {
+		if err := it.batch(s); err != nil {
+			slog.Error("GPU failed; continuing on the CPU", "err", err)
+			it.dev = nil
+			return it.cpu.iterate(s, watch)
+		}
+	}
+	pos := it.pos
+	it.pos++
+	it.next.Add(&it.next, two)
+	switch it.stops[pos] {
+	case stopBelow:
+		return false, it.steps[pos], false
+	case stopLoop:
+		slog.Warn("found a loop back to starting value", "value", s)
+		return true, it.steps[pos], false
+	}
+	return it.cpu.iterate(s, watch)
+}
+
+// batch runs the consecutive odd candidates from s on the GPU.
+func (it *gpuIterator) batch(s *big.Int) error {
+	n := gpuBatch
+	if it.end != nil {
+		remaining := new(big.Int).Sub(it.end, s)
+		remaining.Rsh(remaining, 1)
+		if remaining.IsInt64() && remaining.Int64() < int64(n) {
+			n = int(remaining.Int64()) + 1
+		}
+	}
+	var v u256
+	if !v.setBig(s) || s.Bit(0) == 0 || n <= 0 {
+		return fmt.Errorf("cannot batch from %s", s)
+	}
+	if cap(it.starts) < n {
+		it.starts = make([]u256, n)
+		it.steps = make([]uint64, n)
+		it.stops = make([]uint8, n)
+	}
+	it.starts, it.steps, it.stops = it.starts[:n], it.steps[:n], it.stops[:n]
+	for i := range it.starts {
+		it.starts[i] = v
+		v.add2()
+	}
+	it.next.Set(s)
+	it.pos = 0
+	if err := it.dev.steps(it.starts, gpuMaxSteps, it.steps, it.stops); err != nil {
+		it.starts = it.starts[:0]
+		return err
+	}
+	return nil
+}
+
+// gpusCommand lists the GPUs the capability probe finds.
+func gpusCommand() error {
+	devices, err := gpuProbe()
+	if err != nil {
+		return err
+	}
+	if len(devices) == 0 {
+		fmt.Printf("No GPUs found (backend: %s).\n", gpuBackend)
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Index\tPlatform\tName\tVendor\tVersion\tCompute units\tMemory\n")
+	for _, d := range devices {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%d MiB\n", d.Index, d.Platform, d.Name, d.Vendor,
+			d.Version, d.ComputeUnits, d.Memory>>20)
+	}
+	return w.Flush()
+}
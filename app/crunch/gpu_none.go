@@ -0,0 +1,34 @@
+//go:build !opencl || !cgo
+
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import "errors"
+
+// gpuBackend names the GPU support built in.
+const gpuBackend = "none"
+
+// gpuProbe fails, as there is no GPU support in this build.
+func gpuProbe() ([]gpuDeviceInfo, error) {
+	return nil, errors.New("built without GPU support; rebuild with cgo and -tags opencl")
+}
+
+// gpuOpen fails, as there is no GPU support in this build.
+func gpuOpen(gpuDeviceInfo) (gpuDevice, error) {
+	return nil, errors.New("built without GPU support; rebuild with cgo and -tags opencl")
+}
@@ -0,0 +1,67 @@
+//go:build opencl && cgo
+
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"unsafe"
+
+	"github.com/skandragon/collatz/internal/opencl"
+)
+
+// gpuBackend names the GPU support built in.
+const gpuBackend = "opencl"
+
+// openclDevice adapts an OpenCL device to gpuDevice.
+type openclDevice struct {
+	dev *opencl.Device
+}
+
+// gpuProbe lists the GPUs OpenCL finds.
+func gpuProbe() ([]gpuDeviceInfo, error) {
+	devices, err := opencl.Probe()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]gpuDeviceInfo, len(devices))
+	for i, d := range devices {
+		ret[i] = gpuDeviceInfo(d)
+	}
+	return ret, nil
+}
+
+// gpuOpen builds the kernel for the GPU.
+func gpuOpen(info gpuDeviceInfo) (gpuDevice, error) {
+	dev, err := opencl.Open(opencl.DeviceInfo(info))
+	if err != nil {
+		return nil, err
+	}
+	return &openclDevice{dev: dev}, nil
+}
+
+func (d *openclDevice) info() gpuDeviceInfo {
+	return gpuDeviceInfo(d.dev.Info)
+}
+
+func (d *openclDevice) steps(starts []u256, maxSteps uint64, steps []uint64, stops []uint8) error {
+	if len(starts) == 0 {
+		return nil
+	}
+	limbs := unsafe.Slice(&starts[0][0], 4*len(starts))
+	return d.dev.LimbSteps(limbs, maxSteps, steps, stops)
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// Bounds on what "crunch graph" draws, as the inverse tree roughly
+// grows by a third with each level.
+const (
+	graphMaxSteps = 100000
+	graphMaxDepth = 40
+)
+
+// collatzGraph is a trajectory or inverse tree to draw.  Each edge
+// goes from a value to the next in its trajectory.
+type collatzGraph struct {
+	title string
+	nodes []graphNode
+	edges [][2]int
+}
+
+type graphNode struct {
+	value *big.Int
+
+	// level is the node's row when drawn: its step in a trajectory,
+	// or its depth in a tree.
+	level int
+}
+
+func (g *collatzGraph) add(v *big.Int, level int) int {
+	g.nodes = append(g.nodes, graphNode{value: v, level: level})
+	return len(g.nodes) - 1
+}
+
+// trajectoryGraph follows n down to 1, or if stopping, until it first
+// drops below n, for at most maxSteps steps.
+func trajectoryGraph(n *big.Int, stopping bool, maxSteps int) *collatzGraph {
+	g := &collatzGraph{title: "trajectory of " + n.String()}
+	v := new(big.Int).Set(n)
+	prev := g.add(v, 0)
+	for step := 1; step <= maxSteps && v.Cmp(one) > 0; step++ {
+		v = collatzStep(v)
+		next := g.add(v, step)
+		g.edges = append(g.edges, [2]int{prev, next})
+		prev = next
+		if stopping && v.Cmp(n) < 0 {
+			break
+		}
+	}
+	return g
+}
+
+// collatzStep returns the value after v.
+func collatzStep(v *big.Int) *big.Int {
+	ret := new(big.Int)
+	if v.Bit(0) == 0 {
+		return ret.Rsh(v, 1)
+	}
+	ret.Lsh(v, 1)
+	ret.Add(ret, v)
+	return ret.Add(ret, one)
+}
+
+// inverseTreeGraph returns every value reaching n in at most depth
+// steps.  Each value m is reached from 2m, and if m is 4 mod 6, from
+// (m-1)/3.  The cycle 1, 4, 2, 1 is left out, so 1's tree is a tree.
+func inverseTreeGraph(n *big.Int, depth int) *collatzGraph {
+	g := &collatzGraph{title: fmt.Sprintf("inverse tree of %s to depth %d", n, depth)}
+	six, three, four := big.NewInt(6), big.NewInt(3), big.NewInt(4)
+	level := []int{g.add(new(big.Int).Set(n), 0)}
+	for d := 1; d <= depth; d++ {
+		var next []int
+		for _, i := range level {
+			m := g.nodes[i].value
+			parents := []*big.Int{new(big.Int).Lsh(m, 1)}
+			if new(big.Int).Mod(m, six).Cmp(four) == 0 {
+				p := new(big.Int).Sub(m, one)
+				p.Quo(p, three)
+				if p.Cmp(one) > 0 {
+					parents = append(parents, p)
+				}
+			}
+			for _, p := range parents {
+				j := g.add(p, d)
+				g.edges = append(g.edges, [2]int{j, i})
+				next = append(next, j)
+			}
+		}
+		level = next
+	}
+	return g
+}
+
+// writeDOT writes g in Graphviz's DOT language.  Odd values, which
+// step by 3n+1, are boxes, and even ones, which halve, are ellipses.
+func (g *collatzGraph) writeDOT(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph collatz {\n")
+	fmt.Fprintf(&b, "\tlabel=%q;\n\tlabelloc=t;\n", g.title)
+	fmt.Fprintf(&b, "\tnode [shape=ellipse, fontname=\"Helvetica\"];\n")
+	for i, n := range g.nodes {
+		attrs := fmt.Sprintf("label=%q", n.value.String())
+		if n.value.Bit(0) == 1 {
+			attrs += ", shape=box"
+		}
+		if i == 0 {
+			attrs += ", style=filled, fillcolor=\"#ffd966\""
+		}
+		fmt.Fprintf(&b, "\tn%d [%s];\n", i, attrs)
+	}
+	for _, e := range g.edges {
+		fmt.Fprintf(&b, "\tn%d -> n%d;\n", e[0], e[1])
+	}
+	fmt.Fprintf(&b, "}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// svgLayout is what svgTemplate draws: g laid out in rows by level.
+type svgLayout struct {
+	Title         string
+	Width, Height int
+	Nodes         []svgNode
+	Edges         []svgEdge
+}
+
+type svgNode struct {
+	X, Y, W, H int
+	CX, CY     int
+	Label      string
+	Odd, Start bool
+}
+
+type svgEdge struct {
+	X1, Y1, X2, Y2 int
+}
+
+var svgTemplate = template.Must(template.New("svg").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}" font-family="Helvetica, sans-serif" font-size="12">
+<title>{{.Title}}</title>
+<defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="6" markerHeight="6" orient="auto"><path d="M0,0 L10,5 L0,10 z" fill="#555"/></marker></defs>
+<text x="{{.Width}}" y="20" dx="-10" text-anchor="end" fill="#555">{{.Title}}</text>
+{{range .Edges}}<line x1="{{.X1}}" y1="{{.Y1}}" x2="{{.X2}}" y2="{{.Y2}}" stroke="#555" marker-end="url(#arrow)"/>
+{{end}}{{range .Nodes}}<rect x="{{.X}}" y="{{.Y}}" width="{{.W}}" height="{{.H}}" rx="{{if .Odd}}2{{else}}12{{end}}" fill="{{if .Start}}#ffd966{{else}}#fff{{end}}" stroke="#333"/>
+<text x="{{.CX}}" y="{{.CY}}" text-anchor="middle" dominant-baseline="central">{{.Label}}</text>
+{{end}}</svg>
+`))
+
+// Dimensions of the SVG layout, in pixels.
+const (
+	svgCharWidth  = 8
+	svgNodeHeight = 24
+	svgRowHeight  = 56
+	svgGap        = 16
+	svgMargin     = 32
+)
+
+// writeSVG writes g as an SVG, drawn in rows by level with the value
+// graphed from at the top.  Odd values are square boxes, and even
+// ones rounded.
+func (g *collatzGraph) writeSVG(w io.Writer) error {
+	var rows [][]int
+	colWidth := 0
+	for i, n := range g.nodes {
+		for len(rows) <= n.level {
+			rows = append(rows, nil)
+		}
+		rows[n.level] = append(rows[n.level], i)
+		colWidth = max(colWidth, len(n.value.String())*svgCharWidth+svgGap)
+	}
+	widest := 0
+	for _, row := range rows {
+		widest = max(widest, len(row))
+	}
+	layout := svgLayout{
+		Title:  g.title,
+		Width:  2*svgMargin + widest*(colWidth+svgGap),
+		Height: 2*svgMargin + len(rows)*svgRowHeight,
+	}
+	layout.Width = max(layout.Width, len(g.title)*svgCharWidth+2*svgMargin)
+	centers := make([][2]int, len(g.nodes))
+	for level, row := range rows {
+		// each row is centered
+		offset := (layout.Width - len(row)*(colWidth+svgGap)) / 2
+		for k, i := range row {
+			n := g.nodes[i]
+			label := n.value.String()
+			width := len(label)*svgCharWidth + svgGap
+			cx := offset + k*(colWidth+svgGap) + colWidth/2
+			y := svgMargin + level*svgRowHeight
+			centers[i] = [2]int{cx, y}
+			layout.Nodes = append(layout.Nodes, svgNode{
+				X: cx - width/2, Y: y, W: width, H: svgNodeHeight,
+				CX: cx, CY: y + svgNodeHeight/2,
+				Label: label,
+				Odd:   n.value.Bit(0) == 1,
+				Start: i == 0,
+			})
+		}
+	}
+	for _, e := range g.edges {
+		from, to := centers[e[0]], centers[e[1]]
+		// from the bottom of the upper node to the top of the lower
+		y1, y2 := from[1], to[1]
+		if y1 < y2 {
+			y1 += svgNodeHeight
+		} else {
+			y2 += svgNodeHeight
+		}
+		layout.Edges = append(layout.Edges, svgEdge{X1: from[0], Y1: y1, X2: to[0], Y2: y2})
+	}
+	return svgTemplate.Execute(w, layout)
+}
+
+// graphCommand implements "crunch graph <n>", writing the trajectory of
+// n, or with -tree, the values reaching it, as DOT or SVG.
+func graphCommand(args []string) error {
+	flags := flag.NewFlagSet("graph", flag.ContinueOnError)
+	tree := flags.Int("tree", 0, "draw the inverse tree of n to this depth, instead of its trajectory")
+	stopping := flags.Bool("stopping", false, "end the trajectory when it first drops below n, rather than at 1")
+	maxSteps := flags.Int("max-steps", 1000, "end the trajectory after this many steps")
+	format := flags.String("format", "dot", "write \"dot\" for Graphviz, or \"svg\"")
+	output := flags.String("o", "", "write to this file, rather than standard output")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: crunch graph [flags] <n>")
+	}
+	n, ok := new(big.Int).SetString(flags.Arg(0), 10)
+	if !ok || n.Sign() <= 0 {
+		return fmt.Errorf("%q is not a positive integer", flags.Arg(0))
+	}
+	if *tree < 0 || *tree > graphMaxDepth {
+		return fmt.Errorf("-tree must be between 0 and %d", graphMaxDepth)
+	}
+	if *maxSteps <= 0 || *maxSteps > graphMaxSteps {
+		return fmt.Errorf("-max-steps must be between 1 and %d", graphMaxSteps)
+	}
+	var g *collatzGraph
+	if *tree > 0 {
+		g = inverseTreeGraph(n, *tree)
+	} else {
+		g = trajectoryGraph(n, *stopping, *maxSteps)
+	}
+	var write func(io.Writer) error
+	switch *format {
+	case "dot":
+		write = g.writeDOT
+	case "svg":
+		write = g.writeSVG
+	default:
+		return fmt.Errorf("-format must be \"dot\" or \"svg\"")
+	}
+	if *output == "" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
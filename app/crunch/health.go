@@ -0,0 +1,230 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// healthConfig enables a health check at /healthz, so an orchestrator
+// can restart us if a worker wedges.
+type healthConfig struct {
+	// Listen is the address to serve on, such as "127.0.0.1:9101".
+	Listen string `yaml:"listen"`
+
+	// StallTimeout is how long a worker may go without advancing
+	// through its packet before we are unhealthy.  Paused workers
+	// are not stalled.  The default is 10m.
+	StallTimeout time.Duration `yaml:"stallTimeout,omitempty"`
+
+	// ServerTimeout, if set, makes us unhealthy once the server has
+	// not answered for this long.  Workers keep running, and spool
+	// their reports, while the server is unreachable, so by default
+	// this is only reported.
+	ServerTimeout time.Duration `yaml:"serverTimeout,omitempty"`
+
+	// MaxSpooled, if set, makes us unhealthy once more reports than
+	// this are waiting to be delivered.
+	MaxSpooled int `yaml:"maxSpooled,omitempty"`
+}
+
+func (c *healthConfig) applyDefaults() error {
+	if c.Listen == "" {
+		return fmt.Errorf("health.listen is required")
+	}
+	if c.StallTimeout == 0 {
+		c.StallTimeout = 10 * time.Minute
+	}
+	return nil
+}
+
+// healthReport is the body of a health check.
+type healthReport struct {
+	Healthy bool `json:"healthy"`
+
+	// Problems says why we are unhealthy.
+	Problems []string `json:"problems,omitempty"`
+
+	Workers        []workerHealth `json:"workers"`
+	CrashedWorkers int64          `json:"crashedWorkers"`
+
+	// LastCheckpoint is when progress through any packet was last
+	// journaled.
+	LastCheckpoint *time.Time `json:"lastCheckpoint,omitempty"`
+
+	// LastContact is when the server last answered a request, and
+	// LastFailure is when one last failed.
+	LastContact     *time.Time `json:"lastContact,omitempty"`
+	LastFailure     *time.Time `json:"lastFailure,omitempty"`
+	ServerReachable bool       `json:"serverReachable"`
+
+	SpooledReports int `json:"spooledReports"`
+}
+
+type workerHealth struct {
+	Worker int    `json:"worker"`
+	State  string `json:"state"`
+	Packet string `json:"packet,omitempty"`
+
+	// LastProgress is when the worker last advanced.
+	LastProgress time.Time `json:"lastProgress"`
+}
+
+// optionalTime returns nil for the zero time, so it is omitted.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Worker states in a health report.
+const (
+	workerIdle    = "idle"
+	workerRunning = "running"
+	workerPaused  = "paused"
+	workerStalled = "stalled"
+)
+
+// workerStates returns the state of each worker we have seen, as of
+// now.  A running worker is stalled if it has not advanced for
+// stallTimeout, unless t is pausing it.
+func (m *metrics) workerStates(now time.Time, stallTimeout time.Duration, t *throttle) []workerHealth {
+	m.Lock()
+	defer m.Unlock()
+	ids := make([]int, 0, len(m.workers))
+	for id := range m.workers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	ret := make([]workerHealth, 0, len(ids))
+	for _, id := range ids {
+		w := m.workers[id]
+		wh := workerHealth{Worker: id, State: workerIdle, LastProgress: w.observedOn}
+		if w.running {
+			wh.Packet = w.packetID
+			switch {
+			case t.pausing(id):
+				wh.State = workerPaused
+			case now.Sub(w.observedOn) > stallTimeout:
+				wh.State = workerStalled
+			default:
+				wh.State = workerRunning
+			}
+		}
+		ret = append(ret, wh)
+	}
+	return ret
+}
+
+// health answers health checks from what the metrics and pipeline
+// already track.
+type health struct {
+	config   *healthConfig
+	metrics  *metrics
+	pipeline *pipeline
+	started  time.Time
+}
+
+func newHealth(config *healthConfig, m *metrics, p *pipeline) *health {
+	return &health{config: config, metrics: m, pipeline: p, started: time.Now()}
+}
+
+// check returns our health as of now.
+func (h *health) check(now time.Time) *healthReport {
+	ret := &healthReport{}
+
+	checkpoints, err := h.metrics.store.Checkpoints()
+	if err != nil {
+		ret.Problems = append(ret.Problems, fmt.Sprintf("cannot read checkpoints: %v", err))
+	}
+	var lastCheckpoint time.Time
+	for _, cp := range checkpoints {
+		if cp.JournaledOn.After(lastCheckpoint) {
+			lastCheckpoint = cp.JournaledOn
+		}
+	}
+	ret.LastCheckpoint = optionalTime(lastCheckpoint)
+	ret.SpooledReports, err = h.metrics.store.SpoolDepth()
+	if err != nil {
+		ret.Problems = append(ret.Problems, fmt.Sprintf("cannot read report spool: %v", err))
+	}
+	if h.config.MaxSpooled > 0 && ret.SpooledReports > h.config.MaxSpooled {
+		ret.Problems = append(ret.Problems, fmt.Sprintf("%d reports spooled", ret.SpooledReports))
+	}
+
+	ret.CrashedWorkers = h.pipeline.crashes.Load()
+	if ret.CrashedWorkers > 0 {
+		ret.Problems = append(ret.Problems, fmt.Sprintf("%d workers crashed", ret.CrashedWorkers))
+	}
+
+	ret.Workers = h.metrics.workerStates(now, h.config.StallTimeout, h.pipeline.throttle)
+	for _, w := range ret.Workers {
+		if w.State == workerStalled {
+			ret.Problems = append(ret.Problems, fmt.Sprintf("worker %d stalled on packet %s", w.Worker, w.Packet))
+		}
+	}
+	h.metrics.Lock()
+	contactOn, failedOn := h.metrics.contactOn, h.metrics.failedOn
+	h.metrics.Unlock()
+
+	ret.LastContact = optionalTime(contactOn)
+	ret.LastFailure = optionalTime(failedOn)
+	ret.ServerReachable = !contactOn.IsZero() && !failedOn.After(contactOn)
+	if h.config.ServerTimeout > 0 {
+		since := contactOn
+		if since.IsZero() {
+			since = h.started
+		}
+		if now.Sub(since) > h.config.ServerTimeout {
+			ret.Problems = append(ret.Problems, "server unreachable")
+		}
+	}
+
+	ret.Healthy = len(ret.Problems) == 0
+	return ret
+}
+
+// serve serves /healthz on the configured address until the context
+// is cancelled.  It answers 200 when healthy and 503 when not, with a
+// healthReport either way.
+func (h *health) serve(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		report := h.check(time.Now())
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+	srv := &http.Server{Addr: h.config.Listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	slog.Info("serving health checks", "addr", h.config.Listen)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("health server failed", "err", err)
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/skandragon/collatz/internal/localstore"
+)
+
+// legacyNodeIDFile held the node ID before the local store existed.
+const legacyNodeIDFile = "node-id"
+
+// loadOrCreateNodeID returns the node ID held in the local store,
+// creating and persisting a new random one if none exists.
+func loadOrCreateNodeID(st *localstore.Store, stateDir string) (string, error) {
+	id, err := st.NodeID()
+	if err != nil || id != "" {
+		return id, err
+	}
+
+	legacy := filepath.Join(stateDir, legacyNodeIDFile)
+	b, err := os.ReadFile(legacy)
+	switch {
+	case err == nil && strings.TrimSpace(string(b)) != "":
+		id = strings.TrimSpace(string(b))
+	case err == nil || errors.Is(err, fs.ErrNotExist):
+		raw := make([]byte, 16)
+		if _, err := rand.Read(raw); err != nil {
+			return "", err
+		}
+		id = hex.EncodeToString(raw)
+	default:
+		return "", err
+	}
+	if err := st.SetNodeID(id); err != nil {
+		return "", err
+	}
+	_ = os.Remove(legacy)
+	return id, nil
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math/big"
+)
+
+// engineJump tests candidates using math/big, taking k halvings at a
+// time from a jumpTable.
+const engineJump = "jump"
+
+// defaultJumpBits is the jump table's k unless configured.
+const defaultJumpBits = 8
+
+// Bounds on the configured k.  The table has 2^k entries of eight
+// bytes, so 20 takes 8 MiB.
+const (
+	minJumpBits = 8
+	maxJumpBits = 20
+)
+
+// jumps is the table the jump engine uses, or nil if it is disabled.
+var jumps *jumpTable
+
+// jumpTable takes a trajectory k halvings forward at once.  The k
+// halvings from n = 2^k h + l, and the odd steps between them, depend
+// only on l: if a of those steps are odd, they reach 3^a h + d, with
+// d what they would reach from l itself.  So a jump from n takes its
+// low k bits, and costs a shift, a multiply and an add, however many
+// steps it covers.
+type jumpTable struct {
+	bits uint
+	mask uint64
+
+	// entries, indexed by l, pack a, the dip, and d; see jumpEntry.
+	// They are in mem.
+	entries []uint64
+	mem     *tableBuffer
+
+	// pow3 holds 3^a for every a.
+	pow3 []big.Int
+}
+
+// A jump's entry holds a in its top byte, then its dip: the most bits
+// a value on the way can have lost from n, which is what n must have
+// to spare over s for the jump not to pass below it.  d is in the
+// rest.
+const (
+	jumpOddShift = 56
+	jumpDipShift = 48
+	jumpDMask    = 1<<jumpDipShift - 1
+)
+
+// newJumpTable builds the table for jumps of k halvings.
+func newJumpTable(k uint) *jumpTable {
+	t := &jumpTable{
+		bits: k,
+		mask: 1<<k - 1,
+		mem:  newTableBuffer(8 << k),
+		pow3: make([]big.Int, k+1),
+	}
+	t.entries = t.mem.uint64s(1 << k)
+	for l := range t.entries {
+		// for k <= 20, the values on the way stay below 2^(k+1) 3^k,
+		// and d below 2 3^k
+		d, pow3, a, b, dip := uint64(l), uint64(1), uint64(0), uint(0), uint64(0)
+		for b < k {
+			if d&1 == 1 {
+				d = 3*d + 1
+				pow3 *= 3
+				a++
+				continue
+			}
+			d >>= 1
+			b++
+			// a value here is at least n 3^a / 2^b
+			for pow3<<dip < 1<<b {
+				dip++
+			}
+		}
+		t.entries[l] = a<<jumpOddShift | dip<<jumpDipShift | d
+	}
+	t.pow3[0].SetUint64(1)
+	for a := 1; a < len(t.pow3); a++ {
+		t.pow3[a].Mul(&t.pow3[a-1], three)
+	}
+	return t
+}
+
+// selectJump builds the jump table from the configured k, or
+// defaultJumpBits if it is zero; a negative k disables the jump
+// engine.
+func selectJump(k int) error {
+	if k < 0 {
+		jumps = nil
+		return nil
+	}
+	if k == 0 {
+		k = defaultJumpBits
+	}
+	if k < minJumpBits || k > maxJumpBits {
+		return fmt.Errorf("jumpBits must be from %d to %d, or negative to disable the jump engine", minJumpBits, maxJumpBits)
+	}
+	jumps = newJumpTable(uint(k))
+	return nil
+}
+
+// jumpIterator is the jump engine.  It follows trajectories in the
+// scratch space of a math/big iterator.
+type jumpIterator struct {
+	table   *jumpTable
+	scratch iterator
+	d       big.Int
+}
+
+// name returns the engine's name, as recorded in results.
+func (it *jumpIterator) name() string {
+	return engineJump
+}
+
+// iterate follows the trajectory of s, as iterator.iterate does, and
+// counts iterations the same way.  It jumps wherever n has more bits
+// to spare over s than the jump's dip, as no value within the jump can
+// then come down to s; elsewhere it steps as iterator.follow does, so
+// the trajectory stops exactly where it would.
+func (it *jumpIterator) iterate(s *big.Int, watch *candidateWatch) (interesting bool, iterCount uint64, abandoned bool) {
+	it.scratch.reserve(2 * s.BitLen())
+	n, h, d := &it.scratch.n, &it.scratch.t, &it.d
+	n.Set(s)
+	t := it.table
+	bits := s.BitLen()
+	for {
+		if n.BitLen() > bits {
+			e := t.entries[uint64(n.Bits()[0])&t.mask]
+			if spare := uint64(n.BitLen() - bits); spare > e>>jumpDipShift&0xff {
+				a := e >> jumpOddShift
+				h.Rsh(n, t.bits)
+				n.Mul(h, &t.pow3[a])
+				n.Add(n, d.SetUint64(e&jumpDMask))
+				before := iterCount
+				iterCount += a + uint64(t.bits)
+				if watch != nil && before/watchIterations != iterCount/watchIterations && watch.check(iterCount) {
+					return false, iterCount, true
+				}
+				continue
+			}
+		}
+		iterCount++
+		if watch != nil && iterCount%watchIterations == 0 && watch.check(iterCount) {
+			return false, iterCount, true
+		}
+		if n.Bit(0) == 1 {
+			h.Lsh(n, 1)
+			n.Add(n, h)
+			n.Add(n, one)
+			continue
+		}
+		n.Rsh(n, 1)
+		if n.BitLen() > bits {
+			continue
+		}
+		c := n.Cmp(s)
+		if c == 0 {
+			slog.Warn("found a loop back to starting value", "value", n)
+			return true, iterCount, false
+		} else if c == -1 {
+			return false, iterCount, false
+		}
+	}
+}
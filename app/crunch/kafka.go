@@ -0,0 +1,226 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// Kafka message key schemes.
+const (
+	// kafkaKeyNode keys each message by our node ID, so a node's
+	// events stay in order on one partition.
+	kafkaKeyNode = "node"
+
+	// kafkaKeyPacket keys each message by the packet's ID.
+	kafkaKeyPacket = "packet"
+
+	// kafkaKeyKind keys each message by the event's kind.
+	kafkaKeyKind = "kind"
+
+	// kafkaKeyNone leaves messages without a key, spread over the
+	// partitions at random.
+	kafkaKeyNone = "none"
+)
+
+// kafkaConfig produces what we find to a Kafka topic, for those
+// gathering the results of many nodes into a stream.  Each message's
+// value is the event as the webhook sends it by default, and it has a
+// "kind" header naming the event's kind.
+type kafkaConfig struct {
+	// Brokers are the addresses of the brokers first contacted, such
+	// as "kafka-1:9092".
+	Brokers []string `yaml:"brokers,omitempty"`
+
+	// Topic is the topic produced to.  It must exist.
+	Topic string `yaml:"topic,omitempty"`
+
+	// Key is how messages are keyed, and so partitioned: by "node",
+	// the default, "packet", "kind", or "none".
+	Key string `yaml:"key,omitempty"`
+
+	sinkConfig `yaml:",inline"`
+
+	// TLS connects to the brokers with TLS, checking their
+	// certificates against the system's roots.
+	TLS bool `yaml:"tls,omitempty"`
+
+	// SASL is the SASL mechanism authenticated with: "plain",
+	// "scram-sha-256", or "scram-sha-512".  By default, none is.
+	SASL string `yaml:"sasl,omitempty"`
+
+	// Username and Password are the SASL credentials.
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+
+	// Timeout bounds each attempt to produce an event.  The default is
+	// 10s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// Attempts is how many times an event is tried before it is
+	// dropped.  The default is 3.
+	Attempts int `yaml:"attempts,omitempty"`
+}
+
+type plainKafkaConfig kafkaConfig
+
+// String and GoString keep the password out of anything dumping the
+// config.
+func (c kafkaConfig) String() string { return fmt.Sprintf("%+v", c.redacted()) }
+
+func (c kafkaConfig) GoString() string { return fmt.Sprintf("%#v", c.redacted()) }
+
+func (c kafkaConfig) redacted() plainKafkaConfig {
+	ret := plainKafkaConfig(c)
+	if ret.Password != "" {
+		ret.Password = internal.Redacted
+	}
+	return ret
+}
+
+func (c *kafkaConfig) applyDefaults() error {
+	if len(c.Brokers) == 0 {
+		return fmt.Errorf("kafka.brokers is required")
+	}
+	if c.Topic == "" {
+		return fmt.Errorf("kafka.topic is required")
+	}
+	switch c.Key {
+	case "":
+		c.Key = kafkaKeyNode
+	case kafkaKeyNode, kafkaKeyPacket, kafkaKeyKind, kafkaKeyNone:
+	default:
+		return fmt.Errorf("kafka.key must be one of %q, %q, %q, or %q",
+			kafkaKeyNode, kafkaKeyPacket, kafkaKeyKind, kafkaKeyNone)
+	}
+	if err := c.sinkConfig.applyDefaults("kafka"); err != nil {
+		return err
+	}
+	if _, err := c.mechanism(); err != nil {
+		return err
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.Attempts == 0 {
+		c.Attempts = 3
+	}
+	if c.Timeout < 0 || c.Attempts < 0 {
+		return fmt.Errorf("kafka limits cannot be negative")
+	}
+	return nil
+}
+
+// mechanism returns the SASL mechanism configured, or nil if there is
+// none.
+func (c *kafkaConfig) mechanism() (sasl.Mechanism, error) {
+	if c.SASL != "" && c.Username == "" {
+		return nil, fmt.Errorf("kafka.username is required with kafka.sasl")
+	}
+	switch c.SASL {
+	case "":
+		return nil, nil
+	case "plain":
+		return plain.Mechanism{Username: c.Username, Password: c.Password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, c.Username, c.Password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, c.Username, c.Password)
+	}
+	return nil, fmt.Errorf("kafka.sasl must be \"plain\", \"scram-sha-256\", or \"scram-sha-512\"")
+}
+
+// kafkaProducer produces events to the topic kafkaConfig names.
+type kafkaProducer struct {
+	config *kafkaConfig
+	w      *kafka.Writer
+}
+
+func newKafkaProducer(config *kafkaConfig) *kafkaProducer {
+	transport := &kafka.Transport{ClientID: "crunch"}
+	if config.TLS {
+		transport.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	// checked when the config was loaded
+	transport.SASL, _ = config.mechanism()
+	slog.Info("producing results to Kafka", "brokers", config.Brokers, "topic", config.Topic, "events", config.Events)
+	return &kafkaProducer{
+		config: config,
+		w: &kafka.Writer{
+			Addr:         kafka.TCP(config.Brokers...),
+			Topic:        config.Topic,
+			Balancer:     &kafka.Murmur2Balancer{},
+			MaxAttempts:  config.Attempts,
+			RequiredAcks: kafka.RequireAll,
+			ReadTimeout:  config.Timeout,
+			WriteTimeout: config.Timeout,
+			// Events are produced one at a time, so there is no
+			// batch worth waiting to fill.
+			BatchTimeout: time.Millisecond,
+			Transport:    transport,
+		},
+	}
+}
+
+// deliver produces e, which the writer retries as configured.
+func (k *kafkaProducer) deliver(e publishedEvent) error {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	m := kafka.Message{
+		Key:     k.key(e),
+		Value:   value,
+		Headers: []kafka.Header{{Key: "kind", Value: []byte(e.Kind)}},
+		Time:    e.Time,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(k.config.Attempts)*k.config.Timeout)
+	defer cancel()
+	return k.w.WriteMessages(ctx, m)
+}
+
+// key returns the key of the message for e.
+func (k *kafkaProducer) key(e publishedEvent) []byte {
+	switch k.config.Key {
+	case kafkaKeyNode:
+		return []byte(e.NodeID)
+	case kafkaKeyKind:
+		return []byte(e.Kind)
+	case kafkaKeyPacket:
+		if e.Block != nil {
+			return []byte(e.Block.PacketID)
+		}
+		return []byte(e.Finding.PacketID)
+	}
+	return nil
+}
+
+func (k *kafkaProducer) close() error {
+	return k.w.Close()
+}
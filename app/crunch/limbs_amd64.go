@@ -0,0 +1,33 @@
+//go:build !purego
+
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+// defaultLimbBatch is limbBatch unless configured: here the assembly
+// kernel is faster than a batch in Go.
+const defaultLimbBatch = 1
+
+// limbKernel describes the limbSteps in use, for "crunch bench".
+const limbKernel = "amd64 assembly"
+
+// limbSteps follows n for at most max iterations, stopping early if it
+// drops below start or returns to it, or if the next 3n+1 would
+// overflow.  It is limbStepsGeneric in amd64 assembly.
+//
+//go:noescape
+func limbSteps(n, start *u256, max uint64) (steps uint64, stop int)
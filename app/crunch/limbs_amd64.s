@@ -0,0 +1,106 @@
+//go:build !purego
+
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+#include "textflag.h"
+
+// func limbSteps(n, start *u256, max uint64) (steps uint64, stop int)
+//
+// n is kept in R8-R11, least significant limb first, and compared with
+// start in memory.  3n+1 is n+2n+1: 2n is built in AX, BX, CX and DX,
+// then n added with the carry set for the +1.  Either carrying out of
+// the top limb is an overflow, which leaves n as it was.
+TEXT ·limbSteps(SB), NOSPLIT, $0-40
+	MOVQ n+0(FP), R13
+	MOVQ start+8(FP), SI
+	MOVQ max+16(FP), R12
+	MOVQ 0(R13), R8
+	MOVQ 8(R13), R9
+	MOVQ 16(R13), R10
+	MOVQ 24(R13), R11
+	XORQ DI, DI
+
+loop:
+	CMPQ DI, R12
+	JAE  limit
+	TESTQ $1, R8
+	JEQ  even
+
+	MOVQ R8, AX
+	MOVQ R9, BX
+	MOVQ R10, CX
+	MOVQ R11, DX
+	ADDQ AX, AX
+	ADCQ BX, BX
+	ADCQ CX, CX
+	ADCQ DX, DX
+	JCS  overflow
+	STC
+	ADCQ R8, AX
+	ADCQ R9, BX
+	ADCQ R10, CX
+	ADCQ R11, DX
+	JCS  overflow
+	MOVQ AX, R8
+	MOVQ BX, R9
+	MOVQ CX, R10
+	MOVQ DX, R11
+	INCQ DI
+	JMP  loop
+
+even:
+	SHRQ $1, R9, R8
+	SHRQ $1, R10, R9
+	SHRQ $1, R11, R10
+	SHRQ $1, R11
+	INCQ DI
+
+	// compare with start, most significant limb first
+	CMPQ R11, 24(SI)
+	JHI  loop
+	JCS  below
+	CMPQ R10, 16(SI)
+	JHI  loop
+	JCS  below
+	CMPQ R9, 8(SI)
+	JHI  loop
+	JCS  below
+	CMPQ R8, 0(SI)
+	JHI  loop
+	JCS  below
+	MOVQ $2, AX // stopLoop
+	JMP  done
+
+below:
+	MOVQ $1, AX // stopBelow
+	JMP  done
+
+limit:
+	MOVQ $0, AX // stopLimit
+	JMP  done
+
+overflow:
+	MOVQ $3, AX // stopOverflow
+
+done:
+	MOVQ R8, 0(R13)
+	MOVQ R9, 8(R13)
+	MOVQ R10, 16(R13)
+	MOVQ R11, 24(R13)
+	MOVQ DI, steps+24(FP)
+	MOVQ AX, stop+32(FP)
+	RET
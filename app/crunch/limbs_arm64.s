@@ -0,0 +1,102 @@
+//go:build !purego
+
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+#include "textflag.h"
+
+// func limbSteps(n, start *u256, max uint64) (steps uint64, stop int)
+//
+// n is kept in R4-R7 and start in R8-R11, least significant limb
+// first.  3n+1 is n+2n+1: 2n is built in R12-R15, then n added with
+// the carry set for the +1.  Either carrying out of the top limb is an
+// overflow, which leaves n as it was.
+TEXT ·limbSteps(SB), NOSPLIT, $0-40
+	MOVD n+0(FP), R0
+	MOVD start+8(FP), R1
+	MOVD max+16(FP), R2
+	LDP  0(R0), (R4, R5)
+	LDP  16(R0), (R6, R7)
+	LDP  0(R1), (R8, R9)
+	LDP  16(R1), (R10, R11)
+	MOVD ZR, R3
+
+loop:
+	CMP  R2, R3
+	BHS  limit
+	TBZ  $0, R4, even
+
+	ADDS R4, R4, R12
+	ADCS R5, R5, R13
+	ADCS R6, R6, R14
+	ADCS R7, R7, R15
+	BCS  overflow
+	CMP  ZR, ZR // sets the carry, as nothing was borrowed
+	ADCS R4, R12, R12
+	ADCS R5, R13, R13
+	ADCS R6, R14, R14
+	ADCS R7, R15, R15
+	BCS  overflow
+	MOVD R12, R4
+	MOVD R13, R5
+	MOVD R14, R6
+	MOVD R15, R7
+	ADD  $1, R3
+	B    loop
+
+even:
+	LSR  $1, R4
+	ORR  R5<<63, R4
+	LSR  $1, R5
+	ORR  R6<<63, R5
+	LSR  $1, R6
+	ORR  R7<<63, R6
+	LSR  $1, R7
+	ADD  $1, R3
+
+	// compare with start, most significant limb first
+	CMP  R11, R7
+	BHI  loop
+	BLO  below
+	CMP  R10, R6
+	BHI  loop
+	BLO  below
+	CMP  R9, R5
+	BHI  loop
+	BLO  below
+	CMP  R8, R4
+	BHI  loop
+	BLO  below
+	MOVD $2, R16 // stopLoop
+	B    done
+
+below:
+	MOVD $1, R16 // stopBelow
+	B    done
+
+limit:
+	MOVD $0, R16 // stopLimit
+	B    done
+
+overflow:
+	MOVD $3, R16 // stopOverflow
+
+done:
+	STP  (R4, R5), 0(R0)
+	STP  (R6, R7), 16(R0)
+	MOVD R3, steps+24(FP)
+	MOVD R16, stop+32(FP)
+	RET
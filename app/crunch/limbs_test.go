@@ -0,0 +1,134 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+// limbStepsBig is limbSteps in math/big, the model both kernels are
+// checked against.
+func limbStepsBig(n, start *big.Int, max uint64) (steps uint64, stop int) {
+	t := new(big.Int)
+	for steps < max {
+		if n.Bit(0) == 1 {
+			t.Mul(n, three)
+			t.Add(t, one)
+			if t.BitLen() > 256 {
+				return steps, stopOverflow
+			}
+			n.Set(t)
+			steps++
+			continue
+		}
+		n.Rsh(n, 1)
+		steps++
+		switch n.Cmp(start) {
+		case 0:
+			return steps, stopLoop
+		case -1:
+			return steps, stopBelow
+		}
+	}
+	return steps, stopLimit
+}
+
+// randomStart returns a random odd value of the given number of bits.
+func randomStart(r *rand.Rand, bits int) *big.Int {
+	v := new(big.Int).Rand(r, new(big.Int).Lsh(one, uint(bits)))
+	v.SetBit(v, bits-1, 1)
+	return v.SetBit(v, 0, 1)
+}
+
+// TestLimbSteps runs limbSteps, limbStepsGeneric and limbStepsBig from
+// random odd starts of 64 to 256 bits, in slices of random length so
+// that each stops on its limit as well as for every other reason, and
+// fails unless all three agree at every stop.
+func TestLimbSteps(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	starts := []*big.Int{
+		// overflows on the first step
+		new(big.Int).Sub(new(big.Int).Lsh(one, 256), one),
+		// the largest which does not
+		new(big.Int).Div(new(big.Int).Lsh(one, 256), three),
+	}
+	starts[1].SetBit(starts[1], 0, 1).Sub(starts[1], two)
+	for i := 0; i < 2000; i++ {
+		starts = append(starts, randomStart(r, 64+r.Intn(193)))
+	}
+	for _, s := range starts {
+		var start, n, g u256
+		if !start.setBig(s) {
+			t.Fatalf("%s does not fit in a u256", s)
+		}
+		n, g = start, start
+		b := new(big.Int).Set(s)
+		for total := uint64(0); ; {
+			max := uint64(math.MaxUint64)
+			if r.Intn(2) == 0 {
+				max = uint64(1 + r.Intn(64))
+			}
+			steps, stop := limbSteps(&n, &start, max)
+			gSteps, gStop := limbStepsGeneric(&g, &start, max)
+			bSteps, bStop := limbStepsBig(b, s, max)
+			total += steps
+			if steps != bSteps || stop != bStop || gSteps != bSteps || gStop != bStop {
+				t.Fatalf("from %s after %d steps: limbSteps took %d and stopped with %d, limbStepsGeneric %d and %d, math/big %d and %d",
+					s, total, steps, stop, gSteps, gStop, bSteps, bStop)
+			}
+			if n.toBig(new(big.Int)).Cmp(b) != 0 || g != n {
+				t.Fatalf("from %s after %d steps: limbSteps left %s, limbStepsGeneric %s, math/big %s",
+					s, total, n.toBig(new(big.Int)), g.toBig(new(big.Int)), b)
+			}
+			if stop != stopLimit {
+				break
+			}
+		}
+	}
+}
+
+// BenchmarkLimbSteps follows one candidate per op to below its start
+// with each kernel.
+func BenchmarkLimbSteps(b *testing.B) {
+	kernels := []struct {
+		name string
+		f    func(n, start *u256, max uint64) (uint64, int)
+	}{
+		{limbKernel, limbSteps},
+		{"generic", limbStepsGeneric},
+	}
+	for _, bits := range []int{64, 128} {
+		for _, k := range kernels {
+			b.Run(fmt.Sprintf("bits=%d/kernel=%s", bits, k.name), func(b *testing.B) {
+				var start, n u256
+				start.setBig(benchStart(bits))
+				steps := uint64(0)
+				for i := 0; i < b.N; i++ {
+					n = start
+					s, _ := k.f(&n, &start, math.MaxUint64)
+					steps += s
+					start.add2()
+				}
+				b.ReportMetric(float64(steps)/float64(b.N), "steps/op")
+			})
+		}
+	}
+}
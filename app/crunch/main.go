@@ -17,12 +17,22 @@
 package main
 
 import (
-	"log"
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
 	"math/big"
+	"math/bits"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/auth"
+	"github.com/skandragon/collatz/internal/debug"
+	"github.com/skandragon/collatz/internal/logging"
+	"github.com/skandragon/collatz/internal/statsd"
+	"github.com/skandragon/collatz/internal/trace"
 )
 
 var (
@@ -37,126 +47,614 @@ const (
 )
 
 func main() {
+	configFile := flag.String("config", defaultConfigPath(), "configuration file")
+	debugListen := flag.String("debug", "", "serve pprof and expvar on this loopback address, such as localhost:6060")
+	engineName := flag.String("engine", engineAuto, "engine to test candidates with: auto, big, u256, jump, gmp or gpu")
+	gpuDevice := flag.Int("gpu-device", 0, "GPU for -engine=gpu, as listed by \"crunch gpus\"")
+	shadowName := flag.String("shadow", "", "engine to run alongside -engine, cross-checking every candidate: big, u256, jump, gmp or gpu")
+	tableMiB := flag.Int("table-memory", 0, "MiB the lookup tables may take, overriding tableMemory; by default, half the last level cache")
+	flag.Parse()
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		logging.Fatal("cannot load config", "file", *configFile, "err", err)
+	}
+	if err := logging.Setup(config.Logging, config.Campaign); err != nil {
+		logging.Fatal("cannot set up logging", "err", err)
+	}
+
+	ctx := context.Background()
+	if *debugListen != "" {
+		if err := debug.CheckAddr(*debugListen); err != nil {
+			logging.Fatal("cannot serve debug endpoints", "err", err)
+		}
+		go func() {
+			if err := debug.Serve(ctx, *debugListen); err != nil {
+				slog.Error("debug server failed", "err", err)
+			}
+		}()
+	}
+
+	if *tableMiB != 0 {
+		config.TableMemory = *tableMiB
+	}
+	if err := selectTableMemory(config.TableMemory); err != nil {
+		logging.Fatal("cannot budget lookup tables", "err", err)
+	}
+	if err := selectJump(config.JumpBits); err != nil {
+		logging.Fatal("cannot build jump table", "err", err)
+	}
+	if err := selectEngine(*engineName, *gpuDevice); err != nil {
+		logging.Fatal("cannot use engine", "engine", *engineName, "err", err)
+	}
+	if err := selectShadow(*shadowName, *gpuDevice); err != nil {
+		logging.Fatal("cannot use shadow engine", "engine", *shadowName, "err", err)
+	}
+	if err := selectWheel(config.WheelBits); err != nil {
+		logging.Fatal("cannot use residue wheel", "err", err)
+	}
+	if err := selectLimbBatch(config.LimbBatch); err != nil {
+		logging.Fatal("cannot batch candidates", "err", err)
+	}
+	checkTableMemory()
+
+	switch flag.Arg(0) {
+	case "", "run":
+		runCommand(ctx, config)
+	case "secret":
+		err = secretCommand(config, flag.Args()[1:])
+	case "bench":
+		err = benchCommand(flag.Args()[1:])
+	case "gpus":
+		err = gpusCommand()
+	case "enroll":
+		err = enrollCommand(ctx, config, *configFile, flag.Args()[1:])
+	case "receipts":
+		err = receiptsCommand(ctx, config, flag.Args()[1:])
+	case "results":
+		err = resultsCommand(config, flag.Args()[1:])
+	case "events":
+		err = eventsCommand(config, flag.Args()[1:])
+	case "graph":
+		err = graphCommand(flag.Args()[1:])
+	case "scatter":
+		err = scatterCommand(flag.Args()[1:])
+	default:
+		err = fmt.Errorf("unknown command %q", flag.Arg(0))
+	}
+	if err != nil {
+		logging.Fatal("command failed", "command", flag.Arg(0), "err", err)
+	}
+}
+
+func runCommand(ctx context.Context, config *config) {
+	st, err := openLocalStore(config)
+	if err != nil {
+		logging.Fatal("cannot open local state", "dir", config.StateDir, "err", err)
+	}
+	defer st.Close()
+
 	ni, err := internal.CPUInfo()
 	if err != nil {
-		log.Fatalf("cannot get node or cpu info: %v", err)
+		logging.Fatal("cannot get node or cpu info", "err", err)
+	}
+	workers := config.Workers
+	if workers == 0 {
+		workers = ni.CPUInfo.DefaultWorkers()
 	}
-	workers := ni.CPUInfo.Count
 	ni.Workers = workers
-	log.Printf("Node Info: %#v", ni)
+	ni.NodeID, err = loadOrCreateNodeID(st, config.StateDir)
+	if err != nil {
+		logging.Fatal("cannot load node ID", "dir", config.StateDir, "err", err)
+	}
+	slog.SetDefault(slog.With("node", ni.NodeID))
+	if engineChoice == engineAuto && !config.NoCalibration {
+		tuned = calibrate(config.JumpBits)
+		ni.Tuning = tuned
+	}
+	slog.Info("starting", "workers", workers, "nodeInfo", *ni)
+	topo, err := detectTopology(config.Placement)
+	if err == nil {
+		err = topo.buildTables()
+	}
+	if err != nil {
+		slog.Warn("cannot place workers", "err", err)
+		topo = &topology{}
+	}
+	if config.CandidateLog != nil {
+		l, err := openCandidateLog(config.CandidateLog)
+		if err != nil {
+			logging.Fatal("cannot open candidate log", "path", config.CandidateLog.Path, "err", err)
+		}
+		defer l.close()
+		addCandidateOutput("candidateLog", config.CandidateLog.SampleRate, l.write)
+	}
+	if config.ResultsDB != nil {
+		localResults, err = openResultsDB(ctx, config.ResultsDB)
+		if err != nil {
+			logging.Fatal("cannot open results database", "path", config.ResultsDB.Path, "err", err)
+		}
+		defer localResults.close()
+		if config.ResultsDB.SampleRate > 0 {
+			addCandidateOutput("resultsDB", config.ResultsDB.SampleRate, localResults.writeCandidates)
+		}
+	}
+	if config.Publish != nil {
+		startPublisher("publish", &config.Publish.sinkConfig, ni.NodeID, config.Campaign, newWebhook(config.Publish).deliver)
+	}
+	if config.Kafka != nil {
+		k := newKafkaProducer(config.Kafka)
+		defer k.close()
+		startPublisher("kafka", &config.Kafka.sinkConfig, ni.NodeID, config.Campaign, k.deliver)
+	}
+	if config.MQTT != nil {
+		m := newMQTTPublisher(config.MQTT, ni.NodeID, config.Campaign)
+		defer m.close()
+		startPublisher("mqtt", &config.MQTT.sinkConfig, ni.NodeID, config.Campaign, m.deliver)
+		go m.reportProgress(ctx)
+	}
+	// before the Kafka and MQTT clients are closed
+	defer drainPublishers()
 
-	initial := big.NewInt(0)
-	initial.SetBit(initial, 40, 1)
-	initial.SetBit(initial, 0, 1) // make odd
+	if config.ServerURL == "" {
+		runLocal(workers, topo, config.Local)
+		return
+	}
 
+	c, creds, err := newClient(config)
+	if err != nil {
+		logging.Fatal("cannot create client", "err", err)
+	}
+	m := newMetrics(st)
+	if config.MetricsListen != "" || config.Statsd != nil || config.Health != nil {
+		c.Observe = m.observeCall
+	}
+	if config.MetricsListen != "" {
+		go m.serve(ctx, config.MetricsListen)
+	}
+	if config.Statsd != nil {
+		go statsd.Push(ctx, config.Statsd, m.write)
+	}
+	go m.sampleMemory(ctx)
+	if config.SummaryInterval > 0 {
+		go m.summarize(ctx, config.SummaryInterval)
+	}
+	var tracer *trace.Tracer
+	if config.Tracing != nil {
+		tracer = trace.New(config.Tracing.ServiceName, config.Tracing.Endpoint)
+		go tracer.Run(ctx)
+	}
+	p := newPipeline(c, st, *ni, workers, config.PrefetchDepth)
+	p.tracer = tracer
+	if config.ServerPublicKey != "" {
+		// checked when the config was loaded
+		p.serverKey, _ = auth.ParsePublicKey(config.ServerPublicKey)
+	}
+	var yielding *yieldConfig
+	if !config.Yield.Disabled {
+		yielding = &config.Yield
+	}
+	if config.Thermal != nil || yielding != nil {
+		p.throttle = newThrottle(config.Thermal, yielding, workers)
+		m.throttle = p.throttle
+		go p.throttle.run(ctx)
+	}
+	if config.Health != nil {
+		go newHealth(config.Health, m, p).serve(ctx)
+	}
+	if config.Alerts != nil {
+		go newAlerter(config.Alerts, m, p, ni.NodeID, config.Campaign).run(ctx)
+	}
+	go p.fetch(ctx)
+	events, err := openEventLog(filepath.Join(config.StateDir, eventsFile))
+	if err != nil {
+		logging.Fatal("cannot open event log", "dir", config.StateDir, "err", err)
+	}
+	attestations := newAttestations()
+	for _, e := range engines() {
+		attestation := attestations[e.name()]
+		if attestation.Conformance != attestations[engineBig].Conformance {
+			slog.Error("engine disagrees with math/big on the conformance candidates; not using it",
+				"engine", e.name())
+			disabledEngines[e.name()] = true
+		}
+		slog.Info("attesting", "version", attestation.Version, "engine", attestation.Engine,
+			"convention", attestation.Convention, "conformance", attestation.Conformance)
+	}
+	r := &reporter{
+		c:            c,
+		creds:        creds,
+		ni:           *ni,
+		settings:     config.Reports,
+		store:        st,
+		tracer:       tracer,
+		metrics:      m,
+		crashDir:     filepath.Join(config.StateDir, "crashes"),
+		events:       events,
+		attestations: attestations,
+	}
+	if config.Watchdog != nil {
+		r.watchdog = &watchdog{
+			config:    config.Watchdog,
+			reviewDir: filepath.Join(config.StateDir, "stalled"),
+			events:    events,
+			nodeID:    ni.NodeID,
+		}
+	}
+	go r.flushSpool(ctx)
+	agg := newAggregator(r, m, workers)
+	go agg.run()
 	var wg sync.WaitGroup
-
 	for workerID := 0; workerID < workers; workerID++ {
 		wg.Add(1)
-		starting := big.NewInt(0)
-		starting.Add(starting, initial)
-
-		initial.Add(initial, blocksize)
+		go func(workerID int) {
+			defer wg.Done()
+			dom := topo.domainFor(workerID, workers)
+			dom.enter()
+			dom.warm()
+			remoteWorker(ctx, p, r, agg, m, config.packetLimits(), config.JournalInterval, workerID, dom)
+		}(workerID)
+	}
+	wg.Wait()
+	agg.close()
+}
 
-		ending := big.NewInt(0)
-		ending.Add(ending, starting)
-		ending.Add(ending, blocksize)
+// recordFinished keeps and publishes the result of a finished block,
+// as configured.
+func recordFinished(work *internal.WorkPacket, workerID int, startedOn, completedOn time.Time, result *blockResult) {
+	localResults.recordBlock(work, workerID, startedOn, completedOn, result)
+	publishFinished(work, workerID, startedOn, completedOn, result)
+}
 
-		ntests := big.NewInt(0)
-		ntests.Sub(ending, starting)
-		ntestsInt := ntests.Int64()
+// runLocal runs the configured range without a server.  The range is
+// divided into small sub-ranges, scheduled among the workers as they
+// go, so a worker slowed by heat or other load does not hold up the
+// others.  Every candidate in the range must be counted exactly once.
+func runLocal(workers int, topo *topology, local localConfig) {
+	first, last, err := local.candidates(workers)
+	if err != nil {
+		logging.Fatal("cannot run local range", "err", err)
+	}
 
-		work := &internal.WorkPacket{
-			ID:            "id-of-packet",
-			Nonce:         "nonce-of-packet",
-			AssignedOn:    time.Now().UTC(),
-			StartingValue: starting,
-			EndingValue:   ending,
+	sched := newScheduler(first, last, localSubBlock, workers)
+	// Workers hand their results to a collector, rather than sharing
+	// a map.
+	type indexed struct {
+		index  int
+		result *blockResult
+	}
+	results := make(chan indexed, workers)
+	collected := make(chan []*blockResult)
+	go func() {
+		ordered := []*blockResult{}
+		for r := range results {
+			for len(ordered) <= r.index {
+				ordered = append(ordered, nil)
+			}
+			ordered[r.index] = r.result
 		}
+		collected <- ordered
+	}()
+	var wg sync.WaitGroup
+	started := time.Now()
+	for workerID := 0; workerID < workers; workerID++ {
+		wg.Add(1)
 		go func(workerID int) {
 			defer wg.Done()
-			totalInterations, max, found := run(work, workerID)
-			log.Printf("%04d: totalIterations: %d", workerID, totalInterations)
-			log.Printf("%04d: found: %v", workerID, found)
-			log.Printf("%04d: Average iterations per test: %.6f",
-				workerID, float64(totalInterations)/float64(ntestsInt))
-			log.Printf("%04d:   max %d", workerID, max)
+			dom := topo.domainFor(workerID, workers)
+			dom.enter()
+			dom.warm()
+			ranges := 0
+			for {
+				sr, ok := sched.take(workerID)
+				if !ok {
+					break
+				}
+				startedOn := time.Now()
+				result := run(sr.work, dom, packetLogger(workerID, sr.work.ID), nil, nil, nil, nil)
+				recordFinished(sr.work, workerID, startedOn, time.Now(), result)
+				results <- indexed{index: sr.index, result: result}
+				ranges++
+			}
+			slog.Info("local worker finished", "worker", workerID, "subRanges", ranges)
 		}(workerID)
 	}
 	wg.Wait()
+	close(results)
+	ordered := <-collected
+	result := mergeResults(ordered)
+	ntests := countCandidates(first, last)
+	counted := new(big.Int).SetUint64(uint64(len(result.Skipped)))
+	for _, n := range result.Histogram {
+		counted.Add(counted, new(big.Int).SetUint64(n))
+	}
+	if counted.Cmp(ntests) != 0 {
+		slog.Error("local run did not count every candidate once", "candidates", ntests, "counted", counted)
+	}
+	slog.Info("local run finished",
+		"first", first, "last", last, "candidates", ntests, "subRanges", len(ordered),
+		"elapsed", time.Since(started).Round(time.Millisecond),
+		"totalIterations", result.TotalIterations,
+		"found", result.Interesting,
+		"averageIterations", float64(result.TotalIterations)/float64(ntests.Uint64()),
+		"maxIterations", result.MaxIterations,
+		"maxIterationsValue", result.MaxIterationsValue)
+}
+
+// blockResult is what we learned from running one work packet.
+type blockResult struct {
+	TotalIterations uint64
+	MaxIterations   uint64
+	Interesting     []*big.Int
+
+	// Skipped lists candidates the watchdog gave up on.  They are not
+	// counted in the rest of the result.
+	Skipped []*big.Int
+
+	// ChallengeResponses answer the packet's challenges.
+	ChallengeResponses []internal.ChallengeResponse
+
+	// MaxIterationsValue is the first candidate taking MaxIterations.
+	MaxIterationsValue *big.Int
+
+	// Histogram counts candidates by the number of iterations they took.
+	Histogram []uint64
+
+	// Engine names the implementation which produced the result.
+	Engine string
 }
 
-func run(work *internal.WorkPacket, workerID int) (uint64, uint64, []*big.Int) {
-	startTime := time.Now().UTC().UnixMilli()
-	counter := 0
+// engineBig tests candidates using math/big.
+const engineBig = "big"
+
+// journalFunc is called at sub-block boundaries with the next candidate
+// to test and the results so far.  run does not advance until it returns.
+type journalFunc func(position *big.Int, partial *blockResult)
+
+// run tests every odd candidate in the work packet, but those its
+// filter leaves out, logging progress to logger from a
+// progressReporter.  Candidates the residue wheel sieves are counted
+// without being followed.  If position and partial are set, it resumes
+// from a previous journal entry.  If watch is set, run keeps it up to
+// date, and skips a candidate if asked to.  The packet's size picks
+// the engine; see engineFor.  Dom is the worker's domain, if workers
+// are placed.  The trajectories of findings, and of candidates taking
+// more iterations than any tested since we started, are captured for
+// the server to ask for.  A sample of candidates is written to the
+// candidate log, if there is one.  Progress is published, journal
+// called, and sampled candidates written, between sub-blocks, which a
+// subBlockSizer keeps to a steady length of time.
+func run(work *internal.WorkPacket, dom *domain, logger *slog.Logger, position *big.Int, partial *blockResult, journal journalFunc, watch *candidateWatch) *blockResult {
 	current := big.NewInt(0)
 	current.Add(current, work.StartingValue)
+	if position != nil {
+		current.Set(position)
+	}
+	rate := newRateTracker(current, time.Now())
+	eng := engineFor(work, dom)
+	defer releaseEngine(eng)
+	defer repanicAt(current, eng.name())
 	interestingNumbers := []*big.Int{}
+	skipped := []*big.Int{}
+	answers := []internal.ChallengeResponse{}
 	totalIterations := uint64(0)
 	maxIterations := uint64(0)
-	for {
-		counter++
-		if counter == 10000000 {
-			now := time.Now().UTC().UnixMilli()
-			rate := calcRate(work.StartingValue, current, startTime, now)
-
-			log.Printf("%04d: bitlen %d testing %s, totalIterations %d, rate %.5f",
-				workerID, current.BitLen(), current, totalIterations, rate)
-			counter = 0
-		}
-		interesting, iterCount := iterate(current)
-		totalIterations += iterCount
-		if maxIterations < iterCount {
-			maxIterations = iterCount
-		}
-		if interesting {
-			v := big.NewInt(0)
-			v.Add(v, current)
-			interestingNumbers = append(interestingNumbers, v)
-		}
-		shouldEnd := current.Cmp(work.EndingValue)
-		if shouldEnd >= 0 {
-			break
-		}
-		current.Add(current, two)
-	}
-	endTime := time.Now().UTC().UnixMilli()
-	rate := calcRate(work.StartingValue, work.EndingValue, startTime, endTime)
-
-	log.Printf("%04d: Block completed.", workerID)
-	log.Printf("%04d:    Starting: %s", workerID, work.StartingValue)
-	log.Printf("%04d:      Ending: %s", workerID, work.EndingValue)
-	log.Printf("%04d:        last: %s", workerID, current)
-	log.Printf("%04d:        Rate: %.5f", workerID, rate)
-	log.Printf("%04d: Interesting: %v", workerID, interestingNumbers)
-	return totalIterations, maxIterations, interestingNumbers
+	maxIterationsValue := big.NewInt(0)
+	histogram := []uint64{}
+	if partial != nil {
+		totalIterations = partial.TotalIterations
+		maxIterations = partial.MaxIterations
+		if partial.MaxIterationsValue != nil {
+			maxIterationsValue.Set(partial.MaxIterationsValue)
+		}
+		interestingNumbers = append(interestingNumbers, partial.Interesting...)
+		skipped = append(skipped, partial.Skipped...)
+		answers = append(answers, partial.ChallengeResponses...)
+		histogram = append(histogram, partial.Histogram...)
+	}
+	pending := pendingChallenges(work.Challenges, current, answers)
+	progress := startProgress(work, logger, current, rate)
+	defer progress.stop()
+	wheel := wheelFor(work, dom)
+	mod3 := work.Filter == internal.FilterMod3
+	// tested and totalIterations were counted in totals up to
+	// countedTested and countedIterations.
+	tested := uint64(0)
+	countedTested, countedIterations := tested, totalIterations
+	sizer := newSubBlockSizer()
+	sample := newSampler(work.ID)
+	var remaining, scratch, sieved big.Int
+	for current.Cmp(work.EndingValue) <= 0 {
+		// a sub-block, or what remains of the packet
+		n := sizer.next()
+		remaining.Sub(work.EndingValue, current)
+		remaining.Rsh(&remaining, 1)
+		if remaining.IsInt64() && remaining.Int64() < int64(n) {
+			n = int(remaining.Int64()) + 1
+		}
+		tested += uint64(n)
+		subBlock, started := n, time.Now()
+		record, _, _ := totals.maxIterations()
+
+		// Candidates left out by the filter, or counted from the
+		// wheel, are passed over without touching current, which
+		// is then ahead candidates behind.
+		low := uint64(0)
+		if len(current.Bits()) > 0 {
+			low = uint64(current.Bits()[0])
+		}
+		r3 := scratch.Mod(current, three).Uint64()
+		ahead := uint64(0)
+		for ; n > 0; n, low, r3 = n-1, low+2, (r3+2)%3 {
+			if mod3 && r3 == 2 {
+				ahead++
+				continue
+			}
+			if wheel != nil {
+				if iterCount := wheel.sieved(low); iterCount != 0 {
+					totalIterations += iterCount
+					if maxIterations < iterCount {
+						maxIterations = iterCount
+						maxIterationsValue.Add(current, scratch.SetUint64(2*ahead))
+					}
+					for uint64(len(histogram)) <= iterCount {
+						histogram = append(histogram, 0)
+					}
+					histogram[iterCount]++
+					if sample.take() {
+						sample.record(sieved.Add(current, sieved.SetUint64(2*ahead)), iterCount)
+					}
+					ahead++
+					continue
+				}
+			}
+			if ahead > 0 {
+				current.Add(current, scratch.SetUint64(2*ahead))
+				ahead = 0
+			}
+			// Challenges passed over with the candidates before
+			// current are answered here too.
+			for len(pending) > 0 && pending[0].Value.Cmp(current) <= 0 {
+				answers = append(answers, pending[0].Answer())
+				pending = pending[1:]
+			}
+			interesting, iterCount, abandoned := eng.iterate(current, watch)
+			if abandoned {
+				logger.Warn("skipped candidate", "value", current, "iterations", iterCount)
+				skipped = append(skipped, new(big.Int).Set(current))
+				watch.skipped()
+				current.Add(current, two)
+				continue
+			}
+			watch.tested()
+			if sample.take() {
+				sample.record(current, iterCount)
+			}
+			if interesting || iterCount > maxIterations && iterCount > record {
+				captureFinding(current)
+			}
+			totalIterations += iterCount
+			if maxIterations < iterCount {
+				maxIterations = iterCount
+				maxIterationsValue.Set(current)
+			}
+			for uint64(len(histogram)) <= iterCount {
+				histogram = append(histogram, 0)
+			}
+			histogram[iterCount]++
+			if interesting {
+				v := big.NewInt(0)
+				v.Add(v, current)
+				interestingNumbers = append(interestingNumbers, v)
+			}
+			current.Add(current, two)
+		}
+		if ahead > 0 {
+			current.Add(current, scratch.SetUint64(2*ahead))
+		}
+		sizer.observe(subBlock, time.Since(started))
+		sample.flush()
+		progress.publish(tested, totalIterations)
+		totals.add(tested-countedTested, totalIterations-countedIterations)
+		totals.observeMax(maxIterations, maxIterationsValue)
+		countedTested, countedIterations = tested, totalIterations
+		if journal != nil && current.Cmp(work.EndingValue) <= 0 {
+			journal(current, &blockResult{
+				TotalIterations:    totalIterations,
+				MaxIterations:      maxIterations,
+				MaxIterationsValue: maxIterationsValue,
+				Interesting:        interestingNumbers,
+				Skipped:            skipped,
+				ChallengeResponses: answers,
+				Histogram:          histogram,
+				Engine:             eng.name(),
+			})
+		}
+	}
+	progress.stop()
+	rate.observe(current, time.Now())
+
+	logger.Info("block completed", "start", work.StartingValue, "end", work.EndingValue,
+		"last", current, "rate", rate.average(), "smoothedRate", rate.smoothed(),
+		"interesting", interestingNumbers)
+	return &blockResult{
+		TotalIterations:    totalIterations,
+		MaxIterations:      maxIterations,
+		MaxIterationsValue: maxIterationsValue,
+		Interesting:        interestingNumbers,
+		Skipped:            skipped,
+		ChallengeResponses: answerRemaining(work.Challenges, answers),
+		Histogram:          histogram,
+		Engine:             eng.name(),
+	}
+}
+
+// iterator holds the scratch space for following trajectories, so a
+// worker reusing one allocates nothing once it has grown to fit.
+type iterator struct {
+	n, t big.Int
+}
+
+// iterate follows the trajectory of s until it drops below s, or
+// loops back to it.  If watch is set, it publishes its progress
+// every watchIterations, and gives up if asked to.
+//
+// Only a halving can bring the trajectory down to s: 3n+1 is larger
+// than n, which has been larger than s since the first step.  And
+// after a halving, n is only compared with s when it has no more bits
+// than s, as otherwise it must be larger.  BenchmarkIterate measures
+// this against the loop which compared at every step.
+func (it *iterator) iterate(s *big.Int, watch *candidateWatch) (interesting bool, iterCount uint64, abandoned bool) {
+	it.reserve(2 * s.BitLen())
+	it.n.Set(s)
+	return it.follow(s, 0, watch)
 }
 
-func calcRate(s *big.Int, c *big.Int, startTime int64, endTime int64) float64 {
-	duration := float64(endTime-startTime) / 1000.0
-	computed := big.NewInt(0)
-	computed.Sub(c, s)
-	computedi := computed.Int64()
-	return float64(computedi) / duration
+// name returns the engine's name, as recorded in results.
+func (it *iterator) name() string {
+	return engineBig
 }
 
-func iterate(s *big.Int) (interesting bool, iterCount uint64) {
-	n := big.NewInt(0)
-	n.Add(n, s)
+// reserve gives n and t room for a trajectory peaking at bitLen bits,
+// so they are not regrown a word at a time as it climbs.  Trajectories
+// seldom climb above twice their start's length.
+func (it *iterator) reserve(bitLen int) {
+	words := bitLen/bits.UintSize + 2
+	if cap(it.n.Bits()) < words {
+		it.n.SetBits(make([]big.Word, 0, words))
+	}
+	if cap(it.t.Bits()) < words {
+		it.t.SetBits(make([]big.Word, 0, words))
+	}
+}
+
+// follow continues the trajectory of s from it.n, which is reached
+// after iterCount iterations.
+func (it *iterator) follow(s *big.Int, iterCount uint64, watch *candidateWatch) (interesting bool, iterations uint64, abandoned bool) {
+	n, t := &it.n, &it.t
+	bits := s.BitLen()
 	for {
 		iterCount++
-		if n.Bit(0) == 0 {
-			n.Rsh(n, 1)
-		} else {
-			n.Mul(n, three)
+		if watch != nil && iterCount%watchIterations == 0 && watch.check(iterCount) {
+			return false, iterCount, true
+		}
+		if n.Bit(0) == 1 {
+			// 3n+1, as n+2n+1: multiplying n in place allocates.
+			t.Lsh(n, 1)
+			n.Add(n, t)
 			n.Add(n, one)
+			continue
+		}
+		n.Rsh(n, 1)
+		if n.BitLen() > bits {
+			continue
 		}
 		c := n.Cmp(s)
 		if c == 0 {
-			log.Printf("Found a loop back to starting value: %s", n)
-			return true, iterCount
+			slog.Warn("found a loop back to starting value", "value", n)
+			return true, iterCount, false
 		} else if c == -1 {
-			return false, iterCount
+			return false, iterCount, false
 		}
 	}
 }
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/skandragon/collatz/internal/prom"
+)
+
+// memorySampleInterval is how often allocation rates are measured.
+const memorySampleInterval = 15 * time.Second
+
+// engineMetrics measures the work, and the allocations, of one
+// engine.  The runtime counts allocations for the whole process, so
+// each engine is charged in proportion to the candidates it tested.
+type engineMetrics struct {
+	candidates uint64
+
+	// sampled is candidates as of the last sample.
+	sampled uint64
+
+	allocsPerSecond    float64
+	allocsPerCandidate float64
+}
+
+// memorySample is what we keep of the runtime's memory statistics.
+type memorySample struct {
+	at          time.Time
+	heapInUse   uint64
+	heapObjects uint64
+	totalAlloc  uint64
+	mallocs     uint64
+	gcCycles    uint32
+	gcPause     time.Duration
+}
+
+func readMemory(now time.Time) memorySample {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return memorySample{
+		at:          now,
+		heapInUse:   ms.HeapInuse,
+		heapObjects: ms.HeapObjects,
+		totalAlloc:  ms.TotalAlloc,
+		mallocs:     ms.Mallocs,
+		gcCycles:    ms.NumGC,
+		gcPause:     time.Duration(ms.PauseTotalNs),
+	}
+}
+
+// countEngine charges candidates to an engine.  The lock must be held.
+func (m *metrics) countEngine(engine string, candidates uint64) {
+	if engine == "" || candidates == 0 {
+		return
+	}
+	e, found := m.engines[engine]
+	if !found {
+		e = &engineMetrics{}
+		m.engines[engine] = e
+	}
+	e.candidates += candidates
+}
+
+// sampleMemory measures the runtime's memory use, and each engine's
+// share of the allocations, until the context is cancelled.
+func (m *metrics) sampleMemory(ctx context.Context) {
+	ticker := time.NewTicker(memorySampleInterval)
+	defer ticker.Stop()
+	for {
+		m.observeMemory(readMemory(time.Now()))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *metrics) observeMemory(s memorySample) {
+	m.Lock()
+	defer m.Unlock()
+	last := m.memory
+	m.memory = s
+	if last.at.IsZero() {
+		for _, e := range m.engines {
+			e.sampled = e.candidates
+		}
+		return
+	}
+	seconds := s.at.Sub(last.at).Seconds()
+	allocs := float64(s.mallocs - last.mallocs)
+	total := uint64(0)
+	for _, e := range m.engines {
+		total += e.candidates - e.sampled
+	}
+	for _, e := range m.engines {
+		tested := e.candidates - e.sampled
+		e.sampled = e.candidates
+		e.allocsPerSecond, e.allocsPerCandidate = 0, 0
+		if tested == 0 || seconds <= 0 {
+			continue
+		}
+		share := allocs * float64(tested) / float64(total)
+		e.allocsPerSecond = share / seconds
+		e.allocsPerCandidate = share / float64(tested)
+	}
+}
+
+// allocsPerCandidate returns the allocations per candidate tested by
+// each engine which tested any in the last sample.
+func (m *metrics) allocsPerCandidate() map[string]float64 {
+	m.Lock()
+	defer m.Unlock()
+	ret := map[string]float64{}
+	for name, e := range m.engines {
+		if e.allocsPerCandidate > 0 {
+			ret[name] = e.allocsPerCandidate
+		}
+	}
+	return ret
+}
+
+// writeMemory writes the memory metrics.  The lock must be held.
+func (m *metrics) writeMemory(w io.Writer) {
+	if m.memory.at.IsZero() {
+		return
+	}
+	s := m.memory
+	gauges := []struct {
+		name, kind, help string
+		value            string
+	}{
+		{prom.CrunchHeapInUse, "gauge", "Bytes in in-use heap spans.", fmt.Sprint(s.heapInUse)},
+		{prom.CrunchHeapObjects, "gauge", "Objects allocated on the heap.", fmt.Sprint(s.heapObjects)},
+		{prom.CrunchAllocatedBytes, "counter", "Bytes allocated on the heap.", fmt.Sprint(s.totalAlloc)},
+		{prom.CrunchAllocations, "counter", "Heap objects allocated.", fmt.Sprint(s.mallocs)},
+		{prom.CrunchGCCycles, "counter", "Completed garbage collection cycles.", fmt.Sprint(s.gcCycles)},
+		{prom.CrunchGCPause, "counter", "Time the world was stopped for garbage collection.", prom.FormatFloat(s.gcPause.Seconds())},
+	}
+	for _, g := range gauges {
+		prom.WriteHeader(w, g.name, g.kind, g.help)
+		fmt.Fprintf(w, "%s %s\n", g.name, g.value)
+	}
+
+	names := make([]string, 0, len(m.engines))
+	for name := range m.engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	engineGauges := []struct {
+		name, kind, help string
+		value            func(*engineMetrics) string
+	}{
+		{prom.CrunchEngineCandidates, "counter", "Candidates tested, by engine.",
+			func(e *engineMetrics) string { return fmt.Sprint(e.candidates) }},
+		{prom.CrunchEngineAllocRate, "gauge", "Heap objects allocated per second, by engine.",
+			func(e *engineMetrics) string { return prom.FormatFloat(e.allocsPerSecond) }},
+		{prom.CrunchEngineAllocsPerCandidate, "gauge", "Heap objects allocated per candidate tested, by engine.",
+			func(e *engineMetrics) string { return prom.FormatFloat(e.allocsPerCandidate) }},
+	}
+	for _, g := range engineGauges {
+		prom.WriteHeader(w, g.name, g.kind, g.help)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s%s %s\n", g.name, prom.Labels("engine", name), g.value(m.engines[name]))
+		}
+	}
+}
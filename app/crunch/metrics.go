@@ -0,0 +1,386 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/localstore"
+	"github.com/skandragon/collatz/internal/prom"
+)
+
+// metrics collects what we expose at /metrics in the Prometheus text
+// format.
+type metrics struct {
+	sync.Mutex
+	store   *localstore.Store
+	workers map[int]*workerMetrics
+	calls   map[callKey]*prom.Histogram
+
+	// throttle, if set, adds its state.
+	throttle *throttle
+
+	// blocks counts packets finished.
+	blocks uint64
+
+	// phases holds the time packets spent in each phase.
+	phases map[string]*prom.Histogram
+
+	// contactOn is when the server last answered a request, and
+	// failedOn is when a request last got no answer, or a 5xx.
+	contactOn time.Time
+	failedOn  time.Time
+
+	// failedReports counts reports in a row which could not be sent.
+	failedReports int
+
+	// engines measures the work and allocations of each engine, and
+	// memory is the last sample of the runtime's memory statistics.
+	engines map[string]*engineMetrics
+	memory  memorySample
+}
+
+type workerMetrics struct {
+	candidates uint64
+	iterations uint64
+
+	// Candidates and iterations per second, measured from the totals.
+	candidateRate *rateTracker
+	iterationRate *rateTracker
+
+	bitLength int
+	progress  float64
+
+	// The packet being run, and where and when we last observed it.
+	// running is cleared once the packet is finished.
+	running    bool
+	observedOn time.Time
+	packetID   string
+	position   *big.Int
+	end        *big.Int
+	blockIters uint64
+}
+
+// eta returns how long the worker should take to finish its packet at
+// its smoothed rate.
+func (w *workerMetrics) eta() (time.Duration, bool) {
+	return etaFor(distance(w.position, w.end)/2, w.candidateRate.smoothed())
+}
+
+type callKey struct {
+	path string
+	code int
+}
+
+func newMetrics(st *localstore.Store) *metrics {
+	return &metrics{
+		store:   st,
+		workers: map[int]*workerMetrics{},
+		calls:   map[callKey]*prom.Histogram{},
+		phases:  map[string]*prom.Histogram{},
+		engines: map[string]*engineMetrics{},
+	}
+}
+
+// observeWorker records a worker's position in a packet, and the
+// iterations it has counted in the packet so far, using engine.  The
+// first observation of a packet only sets the baseline, so work done
+// before a restart is not counted again.
+func (m *metrics) observeWorker(workerID int, work *internal.WorkPacket, position *big.Int, blockIters uint64, engine string) {
+	now := time.Now()
+	m.Lock()
+	defer m.Unlock()
+	w, found := m.workers[workerID]
+	if !found {
+		w = &workerMetrics{}
+		m.workers[workerID] = w
+	}
+	if w.packetID == work.ID {
+		candidates := new(big.Int).Sub(position, w.position)
+		candidates.Rsh(candidates, 1)
+		iterations := blockIters - w.blockIters
+		w.candidates += candidates.Uint64()
+		w.iterations += iterations
+		m.countEngine(engine, candidates.Uint64())
+	}
+	candidates := new(big.Int).SetUint64(w.candidates)
+	iterations := new(big.Int).SetUint64(w.iterations)
+	if w.candidateRate == nil {
+		w.candidateRate = newRateTracker(candidates, now)
+		w.iterationRate = newRateTracker(iterations, now)
+	} else {
+		w.candidateRate.observe(candidates, now)
+		w.iterationRate.observe(iterations, now)
+	}
+	w.running = true
+	w.observedOn = now
+	w.packetID = work.ID
+	w.position = new(big.Int).Set(position)
+	w.end = work.EndingValue
+	w.blockIters = blockIters
+	w.bitLength = position.BitLen()
+	done := new(big.Int).Sub(position, work.StartingValue)
+	size := new(big.Int).Sub(work.EndingValue, work.StartingValue)
+	size.Add(size, big.NewInt(1))
+	w.progress, _ = new(big.Rat).SetFrac(done, size).Float64()
+	if w.progress > 1 {
+		w.progress = 1
+	}
+}
+
+// journal returns a journalFunc which observes the worker's progress,
+// then calls next.
+func (m *metrics) journal(workerID int, work *internal.WorkPacket, next journalFunc) journalFunc {
+	return func(position *big.Int, partial *blockResult) {
+		m.observeWorker(workerID, work, position, partial.TotalIterations, partial.Engine)
+		next(position, partial)
+	}
+}
+
+// finished counts the rest of a packet once run returns.
+func (m *metrics) finished(workerID int, work *internal.WorkPacket, result *blockResult) {
+	m.observeWorker(workerID, work, new(big.Int).Add(work.EndingValue, two), result.TotalIterations, result.Engine)
+	m.Lock()
+	defer m.Unlock()
+	m.workers[workerID].running = false
+	m.blocks++
+}
+
+// observeBlock records where the time to run a packet went.
+func (m *metrics) observeBlock(timing *blockTiming) {
+	m.Lock()
+	defer m.Unlock()
+	for phase, d := range timing.phases() {
+		h, found := m.phases[phase]
+		if !found {
+			h = prom.NewHistogram(phaseBuckets)
+			m.phases[phase] = h
+		}
+		h.Observe(d.Seconds())
+	}
+}
+
+// blockETA returns a worker's position in a packet, and how long it
+// should take to finish it.  It returns false if the worker is not
+// running the packet, or we do not yet know its rate.
+func (m *metrics) blockETA(workerID int, packetID string) (*big.Int, time.Duration, bool) {
+	m.Lock()
+	defer m.Unlock()
+	w, found := m.workers[workerID]
+	if !found || w.packetID != packetID {
+		return nil, 0, false
+	}
+	remaining, ok := w.eta()
+	return new(big.Int).Set(w.position), remaining, ok
+}
+
+// runETA returns how long we should take to finish every packet we
+// hold, running or queued, at the workers' combined smoothed rate.
+func (m *metrics) runETA() (time.Duration, bool) {
+	checkpoints, err := m.store.Checkpoints()
+	if err != nil {
+		slog.Error("cannot read checkpoints", "err", err)
+		return 0, false
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	rate := 0.0
+	positions := map[string]*big.Int{}
+	for _, w := range m.workers {
+		rate += w.candidateRate.smoothed()
+		positions[w.packetID] = w.position
+	}
+	remaining := 0.0
+	for _, cp := range checkpoints {
+		position := cp.Work.StartingValue
+		if cp.Position != nil && cp.Position.Cmp(position) > 0 {
+			position = cp.Position
+		}
+		if p, found := positions[cp.Work.ID]; found && p.Cmp(position) > 0 {
+			position = p
+		}
+		if d := distance(position, cp.Work.EndingValue); d >= 0 {
+			remaining += d/2 + 1
+		}
+	}
+	return etaFor(remaining, rate)
+}
+
+// observeCall is set as the client's Observe function.
+func (m *metrics) observeCall(path string, code int, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	key := callKey{path: path, code: code}
+	h, found := m.calls[key]
+	if !found {
+		h = prom.NewHistogram(prom.DefaultBuckets)
+		m.calls[key] = h
+	}
+	h.Observe(d.Seconds())
+	if code == 0 || code >= 500 {
+		m.failedOn = time.Now()
+	} else {
+		m.contactOn = time.Now()
+	}
+}
+
+// observeReport records whether a report reached the server.
+func (m *metrics) observeReport(sent bool) {
+	m.Lock()
+	defer m.Unlock()
+	if sent {
+		m.failedReports = 0
+	} else {
+		m.failedReports++
+	}
+}
+
+// reportFailures returns the number of reports in a row which could
+// not be sent.
+func (m *metrics) reportFailures() int {
+	m.Lock()
+	defer m.Unlock()
+	return m.failedReports
+}
+
+// candidatesTested returns the candidates tested by all workers.
+func (m *metrics) candidatesTested() uint64 {
+	return totals.candidates.Load()
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *metrics) write(w io.Writer) {
+	depth, err := m.store.SpoolDepth()
+	if err != nil {
+		slog.Error("cannot read report spool", "err", err)
+	}
+	runRemaining, runKnown := m.runETA()
+
+	m.Lock()
+	defer m.Unlock()
+	ids := make([]int, 0, len(m.workers))
+	for id := range m.workers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	workerGauges := []struct {
+		name, kind, help string
+		value            func(*workerMetrics) string
+	}{
+		{prom.CrunchCandidates, "counter", "Candidates tested.",
+			func(wm *workerMetrics) string { return strconv.FormatUint(wm.candidates, 10) }},
+		{prom.CrunchIterations, "counter", "Iterations performed.",
+			func(wm *workerMetrics) string { return strconv.FormatUint(wm.iterations, 10) }},
+		{prom.CrunchCandidateRate, "gauge", "Candidates tested per second, over the last minute.",
+			func(wm *workerMetrics) string { return prom.FormatFloat(wm.candidateRate.instant()) }},
+		{prom.CrunchCandidateRateSmoothed, "gauge", "Exponential moving average of candidates tested per second.",
+			func(wm *workerMetrics) string { return prom.FormatFloat(wm.candidateRate.smoothed()) }},
+		{prom.CrunchIterationRate, "gauge", "Iterations performed per second, over the last minute.",
+			func(wm *workerMetrics) string { return prom.FormatFloat(wm.iterationRate.instant()) }},
+		{prom.CrunchIterationRateSmoothed, "gauge", "Exponential moving average of iterations performed per second.",
+			func(wm *workerMetrics) string { return prom.FormatFloat(wm.iterationRate.smoothed()) }},
+		{prom.CrunchBitLength, "gauge", "Bit length of the candidate being tested.",
+			func(wm *workerMetrics) string { return strconv.Itoa(wm.bitLength) }},
+		{prom.CrunchPacketProgress, "gauge", "Fraction of the current packet done.",
+			func(wm *workerMetrics) string { return prom.FormatFloat(wm.progress) }},
+	}
+	for _, g := range workerGauges {
+		prom.WriteHeader(w, g.name, g.kind, g.help)
+		for _, id := range ids {
+			fmt.Fprintf(w, "%s%s %s\n", g.name, prom.Labels("worker", strconv.Itoa(id)), g.value(m.workers[id]))
+		}
+	}
+
+	prom.WriteHeader(w, prom.CrunchPacketETA, "gauge", "Estimated time for the worker to finish its packet.")
+	for _, id := range ids {
+		if remaining, ok := m.workers[id].eta(); ok {
+			fmt.Fprintf(w, "%s%s %s\n", prom.CrunchPacketETA, prom.Labels("worker", strconv.Itoa(id)), prom.FormatFloat(remaining.Seconds()))
+		}
+	}
+	if runKnown {
+		prom.WriteHeader(w, prom.CrunchHeldETA, "gauge", "Estimated time to finish every packet we hold.")
+		fmt.Fprintf(w, "%s %s\n", prom.CrunchHeldETA, prom.FormatFloat(runRemaining.Seconds()))
+	}
+
+	if m.throttle != nil {
+		m.throttle.write(w)
+	}
+	writeShadow(w)
+	totals.write(w)
+
+	prom.WriteHeader(w, prom.CrunchPacketsCompleted, "counter", "Packets completed.")
+	fmt.Fprintf(w, "%s %d\n", prom.CrunchPacketsCompleted, m.blocks)
+
+	phases := make([]string, 0, len(m.phases))
+	for phase := range m.phases {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	prom.WriteHeader(w, prom.CrunchPacketPhase, "histogram", "Time each packet spent computing, checkpointing, throttled, and reporting.")
+	for _, phase := range phases {
+		m.phases[phase].Write(w, prom.CrunchPacketPhase, "phase", phase)
+	}
+
+	m.writeMemory(w)
+
+	prom.WriteHeader(w, prom.CrunchSpooledReports, "gauge", "Reports awaiting delivery to the server.")
+	fmt.Fprintf(w, "%s %d\n", prom.CrunchSpooledReports, depth)
+
+	keys := make([]callKey, 0, len(m.calls))
+	for k := range m.calls {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].path != keys[j].path {
+			return keys[i].path < keys[j].path
+		}
+		return keys[i].code < keys[j].code
+	})
+	prom.WriteHeader(w, prom.CrunchRequestDuration, "histogram", "Latency of requests to the server, by handler and status code (0 if none).")
+	for _, k := range keys {
+		m.calls[k].Write(w, prom.CrunchRequestDuration, "handler", k.path, "code", strconv.Itoa(k.code))
+	}
+}
+
+// serve serves /metrics on addr until the context is cancelled.
+func (m *metrics) serve(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", prom.ContentType)
+		m.write(w)
+	})
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	slog.Info("serving metrics", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("metrics server failed", "err", err)
+	}
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// mqttConfig publishes what we find, and our progress, to an MQTT
+// broker, for small nodes whose owners already run one for their other
+// devices.  Under <topic>/<node ID>, it publishes
+//
+//	block     each block finished, as the webhook sends it by default
+//	finding   each finding, likewise
+//	progress  our totals, every ProgressInterval, retained
+//	status    "online", or "offline" when we stop or are cut off, retained
+type mqttConfig struct {
+	// Broker is the broker's URL, such as "tcp://broker:1883",
+	// "ssl://broker:8883", or "wss://broker/mqtt".
+	Broker string `yaml:"broker,omitempty"`
+
+	// Topic is the topic under which we publish.  It defaults to
+	// "collatz".
+	Topic string `yaml:"topic,omitempty"`
+
+	sinkConfig `yaml:",inline"`
+
+	// QoS is the MQTT quality of service of blocks and findings: 0,
+	// the default and cheapest, or 1 or 2, for those to be held and
+	// sent again if the connection drops.
+	QoS int `yaml:"qos,omitempty"`
+
+	// ClientID defaults to "crunch-" and the start of our node ID.
+	ClientID string `yaml:"clientID,omitempty"`
+
+	// Username and Password, if set, authenticate us to the broker.
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+
+	// ProgressInterval is how often progress is published.  The
+	// default is 1m.
+	ProgressInterval time.Duration `yaml:"progressInterval,omitempty"`
+}
+
+type plainMQTTConfig mqttConfig
+
+// String and GoString keep the password out of anything dumping the
+// config.
+func (c mqttConfig) String() string { return fmt.Sprintf("%+v", c.redacted()) }
+
+func (c mqttConfig) GoString() string { return fmt.Sprintf("%#v", c.redacted()) }
+
+func (c mqttConfig) redacted() plainMQTTConfig {
+	ret := plainMQTTConfig(c)
+	if ret.Password != "" {
+		ret.Password = internal.Redacted
+	}
+	return ret
+}
+
+func (c *mqttConfig) applyDefaults() error {
+	u, err := url.Parse(c.Broker)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("mqtt.broker must be a URL such as tcp://broker:1883")
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss":
+	default:
+		return fmt.Errorf("mqtt.broker cannot be a %s:// URL", u.Scheme)
+	}
+	if c.Topic == "" {
+		c.Topic = "collatz"
+	}
+	c.Topic = strings.TrimSuffix(c.Topic, "/")
+	if strings.ContainsAny(c.Topic, "+#") {
+		return fmt.Errorf("mqtt.topic cannot contain wildcards")
+	}
+	if err := c.sinkConfig.applyDefaults("mqtt"); err != nil {
+		return err
+	}
+	if c.QoS < 0 || c.QoS > 2 {
+		return fmt.Errorf("mqtt.qos must be 0, 1, or 2")
+	}
+	if c.ProgressInterval == 0 {
+		c.ProgressInterval = time.Minute
+	}
+	if c.ProgressInterval < 0 {
+		return fmt.Errorf("mqtt.progressInterval cannot be negative")
+	}
+	return nil
+}
+
+// mqttStatus values.
+const (
+	mqttOnline  = "online"
+	mqttOffline = "offline"
+)
+
+// mqttPublisher publishes to the broker mqttConfig names.  It connects
+// in the background, and reconnects as the broker comes and goes.
+type mqttPublisher struct {
+	config   *mqttConfig
+	nodeID   string
+	campaign string
+	topic    string
+	client   mqtt.Client
+}
+
+func newMQTTPublisher(config *mqttConfig, nodeID, campaign string) *mqttPublisher {
+	m := &mqttPublisher{
+		config:   config,
+		nodeID:   nodeID,
+		campaign: campaign,
+		topic:    config.Topic + "/" + nodeID,
+	}
+	clientID := config.ClientID
+	if clientID == "" {
+		// MQTT 3.1 brokers may refuse IDs over 23 characters.
+		clientID = "crunch-" + nodeID[:min(len(nodeID), 16)]
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(clientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10*time.Second).
+		SetAutoReconnect(true).
+		// Otherwise what was published while the broker was away is
+		// discarded when we connect.
+		SetCleanSession(false).
+		SetWill(m.topic+"/status", mqttOffline, 1, true).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			slog.Info("connected to MQTT broker", "broker", config.Broker)
+			c.Publish(m.topic+"/status", 1, true, mqttOnline)
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("lost connection to MQTT broker", "broker", config.Broker, "err", err)
+		})
+	m.client = mqtt.NewClient(opts)
+	m.client.Connect()
+	slog.Info("publishing results over MQTT", "broker", config.Broker, "topic", m.topic, "events", config.Events)
+	return m
+}
+
+// deliver publishes e.  While the broker is away, the client holds it
+// until it is back.
+func (m *mqttPublisher) deliver(e publishedEvent) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	t := m.client.Publish(m.topic+"/"+e.Kind, byte(m.config.QoS), false, payload)
+	t.Wait()
+	return t.Error()
+}
+
+// mqttProgress is what is published as progress.
+type mqttProgress struct {
+	NodeID              string    `json:"nodeID"`
+	Campaign            string    `json:"campaign,omitempty"`
+	Time                time.Time `json:"time"`
+	Candidates          uint64    `json:"candidates"`
+	Iterations          uint64    `json:"iterations"`
+	CandidatesPerSecond float64   `json:"candidatesPerSecond"`
+	MaxIterations       uint64    `json:"maxIterations,omitempty"`
+	MaxIterationsValue  *big.Int  `json:"maxIterationsValue,omitempty"`
+}
+
+// reportProgress publishes our totals every interval until ctx is done.
+// Only the latest matters, so one the broker is not there for is not
+// kept.
+func (m *mqttPublisher) reportProgress(ctx context.Context) {
+	ticker := time.NewTicker(m.config.ProgressInterval)
+	defer ticker.Stop()
+	last, lastAt := totals.candidates.Load(), time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		p := mqttProgress{
+			NodeID:     m.nodeID,
+			Campaign:   m.campaign,
+			Time:       now.UTC(),
+			Candidates: totals.candidates.Load(),
+			Iterations: totals.iterations.Load(),
+		}
+		p.CandidatesPerSecond = float64(p.Candidates-last) / now.Sub(lastAt).Seconds()
+		last, lastAt = p.Candidates, now
+		if iterations, value, ok := totals.maxIterations(); ok {
+			p.MaxIterations, p.MaxIterationsValue = iterations, value
+		}
+		payload, err := json.Marshal(p)
+		if err != nil {
+			continue
+		}
+		if m.client.IsConnectionOpen() {
+			m.client.Publish(m.topic+"/progress", 0, true, payload)
+		}
+	}
+}
+
+// close says we are offline and disconnects.
+func (m *mqttPublisher) close() {
+	if m.client.IsConnectionOpen() {
+		m.client.Publish(m.topic+"/status", 1, true, mqttOffline).WaitTimeout(time.Second)
+	}
+	m.client.Disconnect(250)
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log/slog"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// progressInterval is how often a running packet's progress is
+// logged.
+const progressInterval = 10 * time.Second
+
+// progressReporter samples run's progress from its own goroutine, so
+// that the loop testing candidates need only publish two counters
+// once a sub-block.
+type progressReporter struct {
+	// tested and iterations are stored by run.
+	tested     atomic.Uint64
+	iterations atomic.Uint64
+
+	work   *internal.WorkPacket
+	logger *slog.Logger
+	origin *big.Int
+	rate   *rateTracker
+
+	stopOnce sync.Once
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+// startProgress starts logging progress through work from origin.
+// The reporter owns rate until stopped.
+func startProgress(work *internal.WorkPacket, logger *slog.Logger, origin *big.Int, rate *rateTracker) *progressReporter {
+	p := &progressReporter{
+		work:   work,
+		logger: logger,
+		origin: new(big.Int).Set(origin),
+		rate:   rate,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// publish records the candidates tested since origin, and the
+// iterations they took.
+func (p *progressReporter) publish(tested, iterations uint64) {
+	p.tested.Store(tested)
+	p.iterations.Store(iterations)
+}
+
+// stop stops the reporter, and waits for it to let go of its rate
+// tracker.  It may be called more than once.
+func (p *progressReporter) stop() {
+	p.stopOnce.Do(func() {
+		close(p.quit)
+	})
+	<-p.done
+}
+
+func (p *progressReporter) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	position := new(big.Int)
+	for {
+		select {
+		case <-p.quit:
+			return
+		case now := <-ticker.C:
+			position.SetUint64(p.tested.Load())
+			position.Lsh(position, 1)
+			position.Add(position, p.origin)
+			p.rate.observe(position, now)
+			remaining, _ := p.rate.eta(p.work.EndingValue)
+			p.logger.Debug("progress", "bitlen", position.BitLen(), "testing", position,
+				"totalIterations", p.iterations.Load(), "rate", p.rate.average(),
+				"instantRate", p.rate.instant(), "smoothedRate", p.rate.smoothed(),
+				"remaining", remaining.Round(time.Second))
+		}
+	}
+}
@@ -0,0 +1,443 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// Published event kinds.
+const (
+	// publishBlock is sent for each block finished.
+	publishBlock = "block"
+
+	// publishFinding is sent for each candidate which looped, or took
+	// more iterations than any we have tested since we started.
+	publishFinding = "finding"
+)
+
+// sinkConfig is what every sink of published events is configured
+// with.
+type sinkConfig struct {
+	// Events lists the kinds of event sent, "block" and "finding".
+	// The default is both.
+	Events []string `yaml:"events,omitempty"`
+
+	// QueueSize is the number of events held while the sink is slow;
+	// beyond it, events are dropped rather than hold up the workers.
+	// The default is 256.
+	QueueSize int `yaml:"queueSize,omitempty"`
+}
+
+func (c *sinkConfig) applyDefaults(name string) error {
+	if len(c.Events) == 0 {
+		c.Events = []string{publishBlock, publishFinding}
+	}
+	for _, e := range c.Events {
+		if e != publishBlock && e != publishFinding {
+			return fmt.Errorf("%s.events must be %q or %q, not %q", name, publishBlock, publishFinding, e)
+		}
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = 256
+	}
+	if c.QueueSize < 0 {
+		return fmt.Errorf("%s.queueSize cannot be negative", name)
+	}
+	return nil
+}
+
+// publishConfig POSTs what we find to an endpoint of the user's, so it
+// can be wired into a dashboard of their own without running a
+// server.  Each event is sent as JSON, or as Template makes it.
+//
+// If SigningSecret is set, each request carries
+//
+//	X-Collatz-Timestamp: <Unix seconds>
+//	X-Collatz-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+// so the endpoint can check that it came from us, and recently.
+type publishConfig struct {
+	// URL is the endpoint.  It must be https, unless its host is a
+	// loopback address.
+	URL string `yaml:"url,omitempty"`
+
+	sinkConfig `yaml:",inline"`
+
+	// Template, if set, is a Go text/template making the body from
+	// the event, whose fields are those of its JSON.  Its "json"
+	// function encodes a value as JSON.
+	Template string `yaml:"template,omitempty"`
+
+	// ContentType is the body's Content-Type.  The default is
+	// "application/json".
+	ContentType string `yaml:"contentType,omitempty"`
+
+	// Headers are added to each request.
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// SigningSecret, if set, is the HMAC key requests are signed
+	// with.
+	SigningSecret string `yaml:"signingSecret,omitempty"`
+
+	// Timeout bounds each attempt to send an event.  The default is
+	// 10s.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// Attempts is how many times an event is tried before it is
+	// dropped.  The default is 3.
+	Attempts int `yaml:"attempts,omitempty"`
+
+	tmpl *template.Template
+}
+
+type plainPublishConfig publishConfig
+
+// String and GoString keep the signing secret out of anything dumping
+// the config.
+func (c publishConfig) String() string { return fmt.Sprintf("%+v", c.redacted()) }
+
+func (c publishConfig) GoString() string { return fmt.Sprintf("%#v", c.redacted()) }
+
+func (c publishConfig) redacted() plainPublishConfig {
+	ret := plainPublishConfig(c)
+	if ret.SigningSecret != "" {
+		ret.SigningSecret = internal.Redacted
+	}
+	return ret
+}
+
+func (c *publishConfig) applyDefaults() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("publish.url must be an absolute URL")
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && isLoopback(u.Hostname())) {
+		return fmt.Errorf("publish.url must be https, unless it is to this host")
+	}
+	if err := c.sinkConfig.applyDefaults("publish"); err != nil {
+		return err
+	}
+	if c.Template != "" {
+		c.tmpl, err = template.New("publish").Funcs(template.FuncMap{"json": toJSON}).Parse(c.Template)
+		if err != nil {
+			return fmt.Errorf("publish.template: %v", err)
+		}
+	}
+	if c.ContentType == "" {
+		c.ContentType = "application/json"
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.Attempts == 0 {
+		c.Attempts = 3
+	}
+	if c.Timeout < 0 || c.Attempts < 0 {
+		return fmt.Errorf("publish limits cannot be negative")
+	}
+	return nil
+}
+
+// isLoopback reports whether host is localhost or a loopback address.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func toJSON(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// publishedEvent is what is sent.
+type publishedEvent struct {
+	Kind     string    `json:"kind"`
+	NodeID   string    `json:"nodeID"`
+	Campaign string    `json:"campaign,omitempty"`
+	Time     time.Time `json:"time"`
+
+	Block   *publishedBlock   `json:"block,omitempty"`
+	Finding *publishedFinding `json:"finding,omitempty"`
+}
+
+// publishedBlock summarizes a block finished.
+type publishedBlock struct {
+	PacketID           string     `json:"packetID"`
+	StartingValue      *big.Int   `json:"startingValue"`
+	EndingValue        *big.Int   `json:"endingValue"`
+	Filter             string     `json:"filter,omitempty"`
+	WorkerID           int        `json:"workerID"`
+	Engine             string     `json:"engine"`
+	StartedOn          time.Time  `json:"startedOn"`
+	CompletedOn        time.Time  `json:"completedOn"`
+	Tested             uint64     `json:"tested"`
+	TotalIterations    uint64     `json:"totalIterations"`
+	MaxIterations      uint64     `json:"maxIterations"`
+	MaxIterationsValue *big.Int   `json:"maxIterationsValue,omitempty"`
+	Interesting        []*big.Int `json:"interesting,omitempty"`
+	Skipped            []*big.Int `json:"skipped,omitempty"`
+}
+
+// publishedFinding is a candidate worth telling of.  Kind is one of
+// the server's record kinds, "maxIterations" or "loop".
+type publishedFinding struct {
+	Kind       string   `json:"kind"`
+	Value      *big.Int `json:"value"`
+	Iterations uint64   `json:"iterations,omitempty"`
+	PacketID   string   `json:"packetID"`
+}
+
+// publisher sends events to a sink, one at a time, in the order they
+// happened.
+type publisher struct {
+	name     string
+	config   *sinkConfig
+	nodeID   string
+	campaign string
+
+	// deliver sends an event, retrying as the sink should.  Calls are
+	// serialized.
+	deliver func(publishedEvent) error
+
+	events chan publishedEvent
+
+	// pending counts events queued and not yet sent or dropped.
+	pending sync.WaitGroup
+
+	// best is the most iterations of any block published.
+	sync.Mutex
+	best uint64
+}
+
+// publishers are the sinks finished blocks are published to.
+var publishers []*publisher
+
+// publishDrainTimeout is the longest we wait at exit for events queued
+// to be sent.
+const publishDrainTimeout = 30 * time.Second
+
+// startPublisher starts publishing finished blocks to deliver.
+func startPublisher(name string, config *sinkConfig, nodeID, campaign string, deliver func(publishedEvent) error) {
+	p := &publisher{
+		name:     name,
+		config:   config,
+		nodeID:   nodeID,
+		campaign: campaign,
+		deliver:  deliver,
+		events:   make(chan publishedEvent, config.QueueSize),
+	}
+	publishers = append(publishers, p)
+	go p.run()
+}
+
+// publishFinished queues the events for a finished block to each sink.
+func publishFinished(work *internal.WorkPacket, workerID int, startedOn, completedOn time.Time, result *blockResult) {
+	for _, p := range publishers {
+		p.block(work, workerID, startedOn, completedOn, result)
+	}
+}
+
+// drainPublishers waits, up to publishDrainTimeout, for the events
+// queued to be sent.
+func drainPublishers() {
+	done := make(chan struct{})
+	go func() {
+		for _, p := range publishers {
+			p.pending.Wait()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(publishDrainTimeout):
+		slog.Warn("exiting with results not yet published")
+	}
+}
+
+// block queues the events for a finished block.
+func (p *publisher) block(work *internal.WorkPacket, workerID int, startedOn, completedOn time.Time, result *blockResult) {
+	now := time.Now().UTC()
+	if slices.Contains(p.config.Events, publishBlock) {
+		tested := uint64(0)
+		for _, n := range result.Histogram {
+			tested += n
+		}
+		p.queue(publishedEvent{Kind: publishBlock, Time: now, Block: &publishedBlock{
+			PacketID:           work.ID,
+			StartingValue:      work.StartingValue,
+			EndingValue:        work.EndingValue,
+			Filter:             work.Filter,
+			WorkerID:           workerID,
+			Engine:             result.Engine,
+			StartedOn:          startedOn.UTC(),
+			CompletedOn:        completedOn.UTC(),
+			Tested:             tested,
+			TotalIterations:    result.TotalIterations,
+			MaxIterations:      result.MaxIterations,
+			MaxIterationsValue: result.MaxIterationsValue,
+			Interesting:        result.Interesting,
+			Skipped:            result.Skipped,
+		}})
+	}
+	if !slices.Contains(p.config.Events, publishFinding) {
+		return
+	}
+	p.Lock()
+	record := result.MaxIterations > p.best && result.MaxIterationsValue != nil
+	if record {
+		p.best = result.MaxIterations
+	}
+	p.Unlock()
+	if record {
+		p.queue(publishedEvent{Kind: publishFinding, Time: now, Finding: &publishedFinding{
+			Kind: store.RecordMaxIterations, Value: result.MaxIterationsValue,
+			Iterations: result.MaxIterations, PacketID: work.ID,
+		}})
+	}
+	for _, v := range result.Interesting {
+		p.queue(publishedEvent{Kind: publishFinding, Time: now, Finding: &publishedFinding{
+			Kind: store.RecordLoop, Value: v, PacketID: work.ID,
+		}})
+	}
+}
+
+// queue adds e to the queue, or drops it if the queue is full.
+func (p *publisher) queue(e publishedEvent) {
+	e.NodeID, e.Campaign = p.nodeID, p.campaign
+	p.pending.Add(1)
+	select {
+	case p.events <- e:
+	default:
+		p.pending.Done()
+		slog.Warn("publish queue full; dropping event", "sink", p.name, "kind", e.Kind)
+	}
+}
+
+// run sends queued events.  It is not stopped, as drainPublishers
+// waits for those queued before we exit.
+func (p *publisher) run() {
+	for e := range p.events {
+		if err := p.deliver(e); err != nil {
+			slog.Error("cannot publish event; dropping it", "sink", p.name, "kind", e.Kind, "err", err)
+		}
+		p.pending.Done()
+	}
+}
+
+// webhook POSTs events to the endpoint publishConfig names.
+type webhook struct {
+	config *publishConfig
+	client *http.Client
+}
+
+func newWebhook(config *publishConfig) *webhook {
+	slog.Info("publishing results", "url", config.URL, "events", config.Events)
+	return &webhook{config: config, client: &http.Client{Timeout: config.Timeout}}
+}
+
+// deliver tries to send e, backing off between attempts.
+func (w *webhook) deliver(e publishedEvent) error {
+	body, err := w.body(e)
+	if err != nil {
+		return fmt.Errorf("making body: %v", err)
+	}
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err = w.post(body)
+		if err == nil || attempt >= w.config.Attempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// body returns the body sent for e.
+func (w *webhook) body(e publishedEvent) ([]byte, error) {
+	if w.config.tmpl == nil {
+		return json.Marshal(e)
+	}
+	// The template sees the event as its JSON has it, so templates
+	// use the same names, and values are not Go types.
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]any
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&data); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := w.config.tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (w *webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.config.ContentType)
+	for k, v := range w.config.Headers {
+		req.Header.Set(k, v)
+	}
+	if w.config.SigningSecret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(w.config.SigningSecret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		req.Header.Set("X-Collatz-Timestamp", timestamp)
+		req.Header.Set("X-Collatz-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
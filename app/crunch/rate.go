@@ -0,0 +1,138 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"math"
+	"math/big"
+	"time"
+)
+
+// rateWindow is the period over which the instantaneous rate is
+// measured.
+const rateWindow = time.Minute
+
+// rateHalfLife is how long it takes the smoothed rate to give half its
+// weight to new observations.
+const rateHalfLife = 5 * time.Minute
+
+type rateSample struct {
+	at       time.Time
+	position *big.Int
+}
+
+// rateTracker measures how quickly a position advances: on average
+// since it was created, over the last rateWindow, and as an exponential
+// moving average.  Positions are big.Ints, so the distance covered may
+// be larger than an int64.
+type rateTracker struct {
+	first rateSample
+
+	// samples covers the window, oldest first.  The first sample is at
+	// or before the start of the window, if we have been running that
+	// long.
+	samples []rateSample
+
+	// ema starts from zero, so it is divided by weight, the total
+	// weight given to observations so far, to correct for the bias.
+	ema    float64
+	weight float64
+}
+
+func newRateTracker(position *big.Int, now time.Time) *rateTracker {
+	s := rateSample{at: now, position: new(big.Int).Set(position)}
+	return &rateTracker{first: s, samples: []rateSample{s}}
+}
+
+// observe records the position at a point in time.
+func (t *rateTracker) observe(position *big.Int, now time.Time) {
+	last := t.samples[len(t.samples)-1]
+	dt := now.Sub(last.at)
+	if dt <= 0 {
+		return
+	}
+	s := rateSample{at: now, position: new(big.Int).Set(position)}
+	alpha := 1 - math.Exp2(-dt.Seconds()/rateHalfLife.Seconds())
+	t.ema += alpha * (rateBetween(last, s) - t.ema)
+	t.weight += alpha * (1 - t.weight)
+	t.samples = append(t.samples, s)
+	start := now.Add(-rateWindow)
+	i := 0
+	for i+1 < len(t.samples) && !t.samples[i+1].at.After(start) {
+		i++
+	}
+	t.samples = t.samples[i:]
+}
+
+func (t *rateTracker) last() rateSample {
+	return t.samples[len(t.samples)-1]
+}
+
+// average returns the rate since the tracker was created.
+func (t *rateTracker) average() float64 {
+	return rateBetween(t.first, t.last())
+}
+
+// instant returns the rate over the last rateWindow.
+func (t *rateTracker) instant() float64 {
+	return rateBetween(t.samples[0], t.last())
+}
+
+// smoothed returns the exponential moving average of the rate.
+func (t *rateTracker) smoothed() float64 {
+	if t.weight == 0 {
+		return 0
+	}
+	return t.ema / t.weight
+}
+
+// eta returns how long it will take to reach target at the smoothed
+// rate, or false if we do not yet know the rate.
+func (t *rateTracker) eta(target *big.Int) (time.Duration, bool) {
+	return etaFor(distance(t.last().position, target), t.smoothed())
+}
+
+// etaFor returns how long it will take to cover remaining at rate per
+// second, or false if the rate is unknown.
+func etaFor(remaining, rate float64) (time.Duration, bool) {
+	if rate <= 0 {
+		return 0, false
+	}
+	if remaining <= 0 {
+		return 0, true
+	}
+	seconds := remaining / rate
+	if seconds >= math.MaxInt64/float64(time.Second) {
+		return math.MaxInt64, true
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+func rateBetween(a, b rateSample) float64 {
+	seconds := b.at.Sub(a.at).Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return distance(a.position, b.position) / seconds
+}
+
+// distance returns b - a, which may be too large for an int64, as a
+// float64.
+func distance(a, b *big.Int) float64 {
+	f, _ := new(big.Float).SetInt(new(big.Int).Sub(b, a)).Float64()
+	return f
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/localstore"
+)
+
+// syncReceipts fetches the server's receipts for our user, and adds any
+// we do not already have.  This is how a user's history follows them to
+// a new machine.
+func syncReceipts(ctx context.Context, st *localstore.Store, c *config) (int, error) {
+	cl, _, err := newClient(c)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := cl.Receipts(ctx)
+	if err != nil {
+		return 0, err
+	}
+	added := 0
+	for _, r := range resp.Receipts {
+		have, err := st.HasReceipt(r.PacketID)
+		if err != nil {
+			return added, err
+		}
+		if have {
+			continue
+		}
+		if err := st.AddReceipt(r); err != nil {
+			return added, err
+		}
+		added++
+	}
+	return added, nil
+}
+
+func printReceipts(receipts []internal.Receipt) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCEPTED\tPACKET\tNODE\tSTART\tEND\tITERATIONS\tMAX")
+	for _, r := range receipts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\n",
+			r.AcceptedOn.Format(time.RFC3339), r.PacketID, r.NodeID,
+			r.StartingValue, r.EndingValue, r.Evidence.TotalIterations, r.Evidence.MaxIterations)
+	}
+	return w.Flush()
+}
+
+func receiptsCommand(ctx context.Context, c *config, args []string) error {
+	if len(args) != 1 || (args[0] != "list" && args[0] != "sync") {
+		return fmt.Errorf("usage: crunch receipts list|sync")
+	}
+	st, err := openLocalStore(c)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	if args[0] == "sync" {
+		added, err := syncReceipts(ctx, st, c)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added %d receipts from the server.\n", added)
+		return nil
+	}
+	receipts, err := st.Receipts()
+	if err != nil {
+		return err
+	}
+	return printReceipts(receipts)
+}
@@ -0,0 +1,403 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/auth"
+	"github.com/skandragon/collatz/internal/client"
+	"github.com/skandragon/collatz/internal/localstore"
+	"github.com/skandragon/collatz/internal/trace"
+)
+
+const claimRetryDelay = 30 * time.Second
+
+// newClient returns a client for the configured server, along with
+// the credentials it uses.
+func newClient(c *config) (*client.Client, internal.UserCredentials, error) {
+	if c.ServerURL == "" {
+		return nil, internal.UserCredentials{}, fmt.Errorf("serverURL is not configured")
+	}
+	secret, err := loadUserSecret(c)
+	if err != nil {
+		return nil, internal.UserCredentials{}, fmt.Errorf("cannot load user secret: %v", err)
+	}
+	creds := internal.UserCredentials{
+		UserID:            c.UserID,
+		UserSecretVersion: c.UserSecretVersion,
+		UserSecret:        secret,
+	}
+	// derived once, as it is slow, for the v3 authenticator
+	creds.SecretKey = auth.SecretKey(creds)
+	return client.New(c.ServerURL, creds, c.MaxClockSkew), creds, nil
+}
+
+// pipeline keeps a queue of claimed work packets ahead of the workers,
+// so a worker finishing one packet never waits on the network for the
+// next.  It aims to hold one packet per worker plus depth more,
+// limited by the quota the server advertises.
+type pipeline struct {
+	sync.Mutex
+	c       *client.Client
+	store   *localstore.Store
+	ni      internal.NodeInfo
+	workers int
+	depth   int
+	tracer  *trace.Tracer
+
+	// throttle, if set, pauses workers while the CPU is too hot, or
+	// the machine busy with other work.
+	throttle *throttle
+
+	// serverKey, if set, must have signed every packet we run.
+	serverKey ed25519.PublicKey
+
+	queue chan internal.WorkPacket
+	wake  chan struct{}
+
+	// outstanding counts packets queued or being worked on.
+	outstanding int
+	quota       int
+
+	// authenticators are the versions the server advertised when we
+	// last claimed work.
+	authenticators []string
+
+	// crashes counts workers which have panicked.  Each crash makes
+	// the surviving workers journal their progress at once.
+	crashes atomic.Int64
+}
+
+func newPipeline(c *client.Client, st *localstore.Store, ni internal.NodeInfo, workers int, depth int) *pipeline {
+	return &pipeline{
+		c:       c,
+		store:   st,
+		ni:      ni,
+		workers: workers,
+		depth:   depth,
+		queue:   make(chan internal.WorkPacket, workers+depth),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// wanted returns how many more packets we should claim right now.
+func (p *pipeline) wanted() int {
+	p.Lock()
+	defer p.Unlock()
+	target := p.workers + p.depth
+	if p.quota > 0 && target > p.quota {
+		target = p.quota
+	}
+	return target - p.outstanding
+}
+
+// done is called once a worker has finished with a packet.
+func (p *pipeline) done() {
+	p.Lock()
+	p.outstanding--
+	p.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// resume queues packets which were claimed, and possibly started,
+// before we were last stopped.  Workers restart them from their
+// last checkpoint.
+func (p *pipeline) resume() {
+	checkpoints, err := p.store.Checkpoints()
+	if err != nil {
+		slog.Error("cannot read checkpoints", "err", err)
+		return
+	}
+	p.Lock()
+	p.outstanding += len(checkpoints)
+	p.Unlock()
+	for _, cp := range checkpoints {
+		slog.Info("resuming packet", "packet", cp.Work.ID,
+			"start", cp.Work.StartingValue, "end", cp.Work.EndingValue)
+		p.queue <- cp.Work
+	}
+}
+
+// authenticator returns the authenticator version to use: configured,
+// if it is set, or else negotiated with the server.
+func (p *pipeline) authenticator(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	p.Lock()
+	defer p.Unlock()
+	return auth.Negotiate(p.authenticators)
+}
+
+// forget drops a packet we will not run.
+func (p *pipeline) forget(work internal.WorkPacket) {
+	if err := p.store.DeleteCheckpoint(work.ID); err != nil {
+		slog.Error("cannot remove checkpoint", "packet", work.ID, "err", err)
+	}
+	p.done()
+}
+
+// fetch claims work until the context is cancelled.
+func (p *pipeline) fetch(ctx context.Context) {
+	defer close(p.queue)
+	p.resume()
+	for ctx.Err() == nil {
+		want := p.wanted()
+		if want <= 0 {
+			select {
+			case <-ctx.Done():
+			case <-p.wake:
+			}
+			continue
+		}
+
+		cctx, span := p.tracer.Start(ctx, "claim", trace.KindClient)
+		span.SetAttribute("collatz.requested", want)
+		resp, err := p.c.Claim(cctx, internal.ClaimRequest{NodeInfo: p.ni, Count: want, Filters: internal.Filters})
+		span.SetError(err)
+		span.End()
+		if err != nil {
+			slog.Error("cannot claim work", "err", err)
+			sleep(ctx, claimRetryDelay)
+			continue
+		}
+		p.Lock()
+		p.quota = resp.MaxOutstanding
+		p.authenticators = resp.Authenticators
+		p.outstanding += len(resp.Work)
+		p.Unlock()
+		if len(resp.Work) == 0 {
+			slog.Info("server has no work for us, waiting", "quota", resp.MaxOutstanding)
+			sleep(ctx, claimRetryDelay)
+			continue
+		}
+		for _, work := range resp.Work {
+			cp := localstore.Checkpoint{Work: work}
+			if sc := span.Context(); sc.IsValid() {
+				cp.TraceParent = sc.TraceParent()
+			}
+			if err := p.store.PutCheckpoint(cp); err != nil {
+				slog.Error("cannot checkpoint packet", "packet", work.ID, "err", err)
+			}
+			p.queue <- work
+		}
+	}
+}
+
+// remoteWorker runs packets from the pipeline, handing the results to
+// the aggregator to record and report.  Dom is the worker's domain, if
+// workers are placed.
+func remoteWorker(ctx context.Context, p *pipeline, r *reporter, agg *aggregator, m *metrics, limits internal.PacketLimits, journalInterval time.Duration, workerID int, dom *domain) {
+	c := p.c
+	for work := range p.queue {
+		work := work
+		if ctx.Err() != nil {
+			p.done()
+			continue
+		}
+		logger := packetLogger(workerID, work.ID)
+		if err := work.Validate(limits); err != nil {
+			logger.Warn("rejecting malformed packet", "err", err)
+			r.rejected(ctx, work, workerID, err)
+			p.forget(work)
+			continue
+		}
+		if p.serverKey != nil {
+			if err := auth.VerifyPacket(p.serverKey, work); err != nil {
+				// not reported; it may never have come from the server
+				logger.Error("refusing packet with a bad signature", "err", err,
+					"start", work.StartingValue, "end", work.EndingValue)
+				r.events.add(internal.Event{
+					Kind:     internal.EventAuditFailure,
+					NodeID:   p.ni.NodeID,
+					PacketID: work.ID,
+					Message:  err.Error(),
+				})
+				p.forget(work)
+				continue
+			}
+		}
+		if work.ExpiredAt(c.Skew.ServerNow()) {
+			logger.Warn("packet already expired, skipping", "expiry", work.Expiry)
+			p.forget(work)
+			continue
+		}
+		timing := &blockTiming{}
+		start := time.Now()
+		cp := p.resumePoint(work, workerID, logger)
+		timing.since(&timing.checkpoint, start)
+		startedOn := cp.StartedOn
+		pctx := ctx
+		if sc, ok := trace.ParseTraceParent(cp.TraceParent); ok {
+			pctx = trace.ContextWithSpanContext(ctx, sc)
+		}
+		_, span := p.tracer.Start(pctx, "compute", trace.KindInternal)
+		span.SetAttribute("collatz.packet", work.ID)
+		span.SetAttribute("collatz.worker", workerID)
+		span.SetAttribute("collatz.start", work.StartingValue.String())
+		span.SetAttribute("collatz.end", work.EndingValue.String())
+		hbctx, stopHeartbeat := context.WithCancel(ctx)
+		go r.heartbeat(hbctx, work, workerID, startedOn)
+		m.observeWorker(workerID, &work, cp.Position, cp.TotalIterations, "")
+		journal := p.throttle.journal(workerID, timing,
+			m.journal(workerID, &work, p.journal(cp, journalInterval, logger, timing)))
+		start = time.Now()
+		overhead := timing.checkpoint
+		watch := r.watchdog.watch(hbctx, workerID, &work, cp.Position)
+		result, crash := runRecovering(&work, dom, logger, cp.Position, partialResult(cp), journal, watch)
+		timing.compute = time.Since(start) - (timing.checkpoint - overhead) - timing.throttled
+		if crash != nil {
+			// The packet's checkpoint is kept, so it is retried after a
+			// restart, but this worker takes no more work.
+			span.SetError(fmt.Errorf("panic: %s", crash.Panic))
+			span.End()
+			stopHeartbeat()
+			p.crashes.Add(1)
+			crash.WorkerID = workerID
+			r.crashed(ctx, *crash)
+			p.done()
+			return
+		}
+		m.finished(workerID, &work, result)
+		span.SetAttribute("collatz.iterations", result.TotalIterations)
+		span.End()
+		stopHeartbeat()
+		completedOn := c.Skew.ServerNow()
+		recordFinished(&work, workerID, startedOn, completedOn, result)
+		p.done()
+		if work.ExpiredAt(completedOn) {
+			logger.Warn("packet completed after expiry, reporting anyway",
+				"expiry", work.Expiry, "completedOn", completedOn)
+		}
+		agg.submit(&finishedPacket{
+			ctx:         pctx,
+			work:        work,
+			workerID:    workerID,
+			startedOn:   startedOn,
+			completedOn: completedOn,
+			result:      result,
+			version:     p.authenticator(r.settings.Authenticator),
+			timing:      timing,
+			logger:      logger,
+		})
+	}
+}
+
+// resumePoint returns the checkpoint to start a packet from.  If an
+// earlier run journaled progress through it, we pick up from there.
+func (p *pipeline) resumePoint(work internal.WorkPacket, workerID int, logger *slog.Logger) *localstore.Checkpoint {
+	cp, err := p.store.Checkpoint(work.ID)
+	if err != nil {
+		logger.Error("cannot read checkpoint", "err", err)
+	}
+	if cp != nil && cp.Position != nil && !cp.StartedOn.IsZero() &&
+		cp.Position.Cmp(work.StartingValue) >= 0 && cp.Position.Bit(0) == work.StartingValue.Bit(0) {
+		if cp.Position.Cmp(work.StartingValue) > 0 {
+			logger.Info("resuming packet", "position", cp.Position)
+		}
+		cp.WorkerID = workerID
+		return cp
+	}
+	traceParent := ""
+	if cp != nil {
+		traceParent = cp.TraceParent
+	}
+	cp = &localstore.Checkpoint{
+		Work:        work,
+		WorkerID:    workerID,
+		StartedOn:   p.c.Skew.ServerNow(),
+		TraceParent: traceParent,
+		Position:    work.StartingValue,
+	}
+	if err := p.store.PutCheckpoint(*cp); err != nil {
+		logger.Error("cannot checkpoint packet", "err", err)
+	}
+	return cp
+}
+
+// partialResult returns the results journaled in a checkpoint, or nil
+// if the packet has not been started.
+func partialResult(cp *localstore.Checkpoint) *blockResult {
+	if cp.JournaledOn.IsZero() {
+		return nil
+	}
+	return &blockResult{
+		TotalIterations:    cp.TotalIterations,
+		MaxIterations:      cp.MaxIterations,
+		MaxIterationsValue: cp.MaxIterationsValue,
+		Histogram:          cp.Histogram,
+		Interesting:        cp.Interesting,
+		Skipped:            cp.Skipped,
+		ChallengeResponses: cp.ChallengeResponses,
+	}
+}
+
+// journal returns a journalFunc which writes the worker's progress to
+// the checkpoint at most once per interval, and at once after another
+// worker crashes.  The write is synchronous,
+// so a journaled position is never ahead of the work actually done.
+func (p *pipeline) journal(cp *localstore.Checkpoint, interval time.Duration, logger *slog.Logger, timing *blockTiming) journalFunc {
+	last := time.Now()
+	crashes := p.crashes.Load()
+	return func(position *big.Int, partial *blockResult) {
+		if time.Since(last) < interval && p.crashes.Load() == crashes {
+			return
+		}
+		last = time.Now()
+		defer timing.since(&timing.checkpoint, last)
+		crashes = p.crashes.Load()
+		entry := *cp
+		entry.Position = position
+		entry.TotalIterations = partial.TotalIterations
+		entry.MaxIterations = partial.MaxIterations
+		entry.MaxIterationsValue = partial.MaxIterationsValue
+		entry.Histogram = partial.Histogram
+		entry.Interesting = partial.Interesting
+		entry.Skipped = partial.Skipped
+		entry.ChallengeResponses = partial.ChallengeResponses
+		entry.JournaledOn = time.Now().UTC()
+		if err := p.store.PutCheckpoint(entry); err != nil {
+			logger.Error("cannot journal packet", "err", err)
+		}
+	}
+}
+
+// packetLogger returns a logger for a worker's progress on a packet.
+func packetLogger(workerID int, packetID string) *slog.Logger {
+	return slog.With("worker", workerID, "packet", packetID)
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
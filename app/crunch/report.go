@@ -0,0 +1,281 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/auth"
+	"github.com/skandragon/collatz/internal/client"
+	"github.com/skandragon/collatz/internal/localstore"
+	"github.com/skandragon/collatz/internal/trace"
+)
+
+// Values for reportSettings.NodeInfo.
+const (
+	nodeInfoAlways    = "always"
+	nodeInfoCompleted = "completed"
+	nodeInfoNever     = "never"
+)
+
+// reportSettings control how often we report to the server, and what
+// optional content is attached to each report.
+type reportSettings struct {
+	// HeartbeatInterval is how often a "running" report is sent for
+	// each packet being worked on.  Zero disables heartbeats; only
+	// "completed" reports are required by the server.
+	HeartbeatInterval time.Duration `yaml:"heartbeatInterval,omitempty"`
+
+	// NodeInfo is one of "always", "completed" (the default), or
+	// "never", and controls which reports carry the full NodeInfo.
+	// Reports without it still carry our node ID.
+	NodeInfo string `yaml:"nodeInfo,omitempty"`
+
+	// Histogram controls whether the iteration histogram is attached
+	// to "completed" reports.
+	Histogram *bool `yaml:"histogram,omitempty"`
+
+	// Crashes controls whether reports of panics in workers are sent
+	// to the server.  They are always written to the state directory.
+	Crashes bool `yaml:"crashes,omitempty"`
+
+	// Authenticator, if set, is the version of the authenticator sent
+	// with "completed" reports.  By default, we use the version the
+	// server prefers of those it advertised when we last claimed work.
+	Authenticator string `yaml:"authenticator,omitempty"`
+}
+
+// reporter sends progress reports for one node.
+type reporter struct {
+	c        *client.Client
+	creds    internal.UserCredentials
+	ni       internal.NodeInfo
+	settings reportSettings
+	store    *localstore.Store
+	tracer   *trace.Tracer
+
+	// metrics supplies the position and estimated completion time
+	// sent with "running" reports.
+	metrics *metrics
+
+	// crashDir holds reports of panics in workers.
+	crashDir string
+
+	// events is the node's event log.
+	events *eventLog
+
+	// watchdog, if set, watches for workers stuck on a candidate.
+	watchdog *watchdog
+
+	// attestations describe our build, by engine, and are sent with
+	// "completed" reports.
+	attestations map[string]internal.Attestation
+}
+
+// spoolRetryInterval is how often we retry delivering spooled reports.
+const spoolRetryInterval = 5 * time.Minute
+
+func (r *reporter) nodeInfo(status string) internal.NodeInfo {
+	switch r.settings.NodeInfo {
+	case nodeInfoAlways:
+		return r.ni
+	case nodeInfoNever:
+	default:
+		if status == "completed" {
+			return r.ni
+		}
+	}
+	return internal.NodeInfo{NodeID: r.ni.NodeID}
+}
+
+// send delivers a report.  It returns false if the report could not
+// be delivered and should be retried later.
+func (r *reporter) send(ctx context.Context, report internal.WorkProgressReport) bool {
+	logger := packetLogger(report.WorkerID, report.Work.ID).With("status", report.Status)
+	rr, err := r.c.Report(ctx, report)
+	r.metrics.observeReport(err == nil)
+	if err != nil {
+		logger.Error("cannot send report", "err", err)
+		return false
+	}
+	if !rr.Accepted {
+		logger.Warn("report rejected", "message", rr.Message)
+		if report.Status == "completed" {
+			r.events.add(internal.Event{
+				Kind:     internal.EventAuditFailure,
+				NodeID:   r.ni.NodeID,
+				PacketID: report.Work.ID,
+				Message:  rr.Message,
+			})
+		}
+		return true
+	}
+	if rr.Receipt != nil {
+		if err := r.store.AddReceipt(*rr.Receipt); err != nil {
+			logger.Error("cannot record receipt", "err", err)
+		}
+	}
+	for _, req := range rr.Trajectories {
+		r.trajectory(ctx, req, logger)
+	}
+	return true
+}
+
+// trajectory computes and sends the trajectory of a finding, as the
+// server asked.
+func (r *reporter) trajectory(ctx context.Context, req internal.TrajectoryRequest, logger *slog.Logger) {
+	if req.Value == nil {
+		return
+	}
+	t, captured := captures.trajectory(req)
+	if !captured {
+		t = internal.ComputeTrajectory(req)
+	}
+	tr, err := r.c.Trajectory(ctx, t)
+	if err != nil {
+		logger.Error("cannot send trajectory", "value", req.Value, "err", err)
+		return
+	}
+	if !tr.Accepted {
+		logger.Warn("trajectory rejected", "value", req.Value, "message", tr.Message)
+		return
+	}
+	logger.Info("sent trajectory", "value", req.Value, "steps", t.Steps, "captured", captured)
+}
+
+// deliver sends a spooled report, removing it from the spool once
+// the server has given a definite answer.
+func (r *reporter) deliver(ctx context.Context, report internal.WorkProgressReport) {
+	if !r.send(ctx, report) {
+		return
+	}
+	if err := r.store.UnspoolReport(report.Work.ID); err != nil {
+		packetLogger(report.WorkerID, report.Work.ID).Error("cannot remove report from spool", "err", err)
+	}
+}
+
+// flushSpool retries delivery of spooled reports until the context is
+// cancelled.
+func (r *reporter) flushSpool(ctx context.Context) {
+	for {
+		reports, err := r.store.SpooledReports()
+		if err != nil {
+			slog.Error("cannot read report spool", "err", err)
+		}
+		for _, report := range reports {
+			r.deliver(ctx, report)
+		}
+		sleep(ctx, spoolRetryInterval)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// heartbeat sends "running" reports for a packet until the context
+// is cancelled.
+func (r *reporter) heartbeat(ctx context.Context, work internal.WorkPacket, workerID int, startedOn time.Time) {
+	if r.settings.HeartbeatInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.settings.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		report := internal.WorkProgressReport{
+			Work:      work,
+			NodeInfo:  r.nodeInfo("running"),
+			WorkerID:  workerID,
+			Status:    "running",
+			StartedOn: startedOn,
+		}
+		if position, remaining, ok := r.metrics.blockETA(workerID, work.ID); ok {
+			report.Position = position
+			report.EstimatedCompletion = r.c.Skew.ServerNow().Add(remaining)
+		}
+		r.send(ctx, report)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rejected tells the server we will not run a malformed packet.
+func (r *reporter) rejected(ctx context.Context, work internal.WorkPacket, workerID int, reason error) {
+	r.send(ctx, internal.WorkProgressReport{
+		Work:     work,
+		NodeInfo: r.nodeInfo("rejected"),
+		WorkerID: workerID,
+		Status:   "rejected",
+		Message:  reason.Error(),
+	})
+}
+
+// finished builds the final report for a packet, and the summary we
+// keep of it.
+func (r *reporter) finished(f *finishedPacket) localstore.Finished {
+	work, result := f.work, f.result
+	evidence := internal.WorkEvidence{
+		TotalIterations: result.TotalIterations,
+		MaxIterations:   result.MaxIterations,
+		Filter:          work.Filter,
+	}
+	// the version was checked when the config was loaded, or
+	// negotiated from those we know
+	authenticator, _ := auth.Generate(f.version, r.creds, work, evidence)
+	report := internal.WorkProgressReport{
+		Work:          work,
+		NodeInfo:      r.nodeInfo("completed"),
+		WorkerID:      f.workerID,
+		Status:        "completed",
+		StartedOn:     f.startedOn,
+		CompletedOn:   f.completedOn,
+		Evidence:      evidence,
+		Authenticator: authenticator,
+
+		MaxIterationsValue: result.MaxIterationsValue,
+		Interesting:        result.Interesting,
+		Skipped:            result.Skipped,
+		ChallengeResponses: result.ChallengeResponses,
+	}
+	if attestation, ok := r.attestations[result.Engine]; ok {
+		report.Attestation = &attestation
+	}
+	if r.settings.Histogram == nil || *r.settings.Histogram {
+		report.Histogram = result.Histogram
+	}
+	return localstore.Finished{
+		Completed: localstore.Completed{
+			PacketID:      work.ID,
+			StartingValue: work.StartingValue,
+			EndingValue:   work.EndingValue,
+			StartedOn:     f.startedOn,
+			CompletedOn:   f.completedOn,
+			Evidence:      evidence,
+
+			MaxIterationsValue: result.MaxIterationsValue,
+			Interesting:        result.Interesting,
+			WorkerID:           f.workerID,
+			Engine:             result.Engine,
+		},
+		Report: report,
+	}
+}
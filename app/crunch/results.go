@@ -0,0 +1,205 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/skandragon/collatz/internal/localstore"
+)
+
+// resultsFilter selects completed packets for "crunch results list".
+type resultsFilter struct {
+	since, until  time.Time
+	minIterations uint64
+	interesting   bool
+	unconfirmed   bool
+}
+
+func (f *resultsFilter) match(c localstore.Completed, confirmed bool) bool {
+	if !f.since.IsZero() && c.CompletedOn.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !c.CompletedOn.Before(f.until) {
+		return false
+	}
+	if c.Evidence.MaxIterations < f.minIterations {
+		return false
+	}
+	if f.interesting && len(c.Interesting) == 0 {
+		return false
+	}
+	if f.unconfirmed && confirmed {
+		return false
+	}
+	return true
+}
+
+// timeFlag accepts a date, or a time in RFC 3339 format.
+type timeFlag struct {
+	t *time.Time
+}
+
+func (f timeFlag) String() string {
+	if f.t == nil || f.t.IsZero() {
+		return ""
+	}
+	return f.t.Format(time.RFC3339)
+}
+
+func (f timeFlag) Set(s string) error {
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			*f.t = t
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not a date or RFC 3339 time", s)
+}
+
+// candidates returns the number of odd values tested in a packet.
+func candidates(c localstore.Completed) *big.Int {
+	n := new(big.Int).Sub(c.EndingValue, c.StartingValue)
+	n.Rsh(n, 1)
+	return n.Add(n, big.NewInt(1))
+}
+
+func resultsList(st *localstore.Store, args []string) error {
+	var filter resultsFilter
+	fs := flag.NewFlagSet("results list", flag.ContinueOnError)
+	fs.Var(timeFlag{&filter.since}, "since", "only packets completed at or after this date or time")
+	fs.Var(timeFlag{&filter.until}, "until", "only packets completed before this date or time")
+	fs.Uint64Var(&filter.minIterations, "min-iterations", 0, "only packets whose longest candidate took at least this many iterations")
+	fs.BoolVar(&filter.interesting, "interesting", false, "only packets with looping candidates")
+	fs.BoolVar(&filter.unconfirmed, "unconfirmed", false, "only packets the server has not yet issued a receipt for")
+	limit := fs.Int("limit", 0, "show only the most recent packets matching")
+	asJSON := fs.Bool("json", false, "print JSON lines instead of a table")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	all, err := st.Completed()
+	if err != nil {
+		return err
+	}
+	matched := []localstore.Completed{}
+	confirmed := map[string]bool{}
+	for _, c := range all {
+		have, err := st.HasReceipt(c.PacketID)
+		if err != nil {
+			return err
+		}
+		confirmed[c.PacketID] = have
+		if filter.match(c, have) {
+			matched = append(matched, c)
+		}
+	}
+	if *limit > 0 && len(matched) > *limit {
+		matched = matched[len(matched)-*limit:]
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, c := range matched {
+			if err := enc.Encode(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "COMPLETED\tPACKET\tSTART\tEND\tDURATION\tITERATIONS\tMAX\tRECEIPT")
+	for _, c := range matched {
+		receipt := "no"
+		if confirmed[c.PacketID] {
+			receipt = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n",
+			c.CompletedOn.Format(time.RFC3339), c.PacketID, c.StartingValue, c.EndingValue,
+			c.Duration().Round(time.Second), c.Evidence.TotalIterations, c.Evidence.MaxIterations, receipt)
+	}
+	return w.Flush()
+}
+
+func resultsShow(st *localstore.Store, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: crunch results show <packet ID>")
+	}
+	c, err := st.CompletedPacket(args[0])
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return fmt.Errorf("no completed packet %s", args[0])
+	}
+	receipt, err := st.Receipt(c.PacketID)
+	if err != nil {
+		return err
+	}
+
+	n := candidates(*c)
+	rate := 0.0
+	if d := c.Duration().Seconds(); d > 0 {
+		rate, _ = new(big.Float).Quo(new(big.Float).SetInt(n), big.NewFloat(d)).Float64()
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Packet:\t%s\n", c.PacketID)
+	fmt.Fprintf(w, "Range:\t%s..%s\n", c.StartingValue, c.EndingValue)
+	fmt.Fprintf(w, "Candidates:\t%s\n", n)
+	fmt.Fprintf(w, "Started:\t%s\n", c.StartedOn.Format(time.RFC3339))
+	fmt.Fprintf(w, "Completed:\t%s\n", c.CompletedOn.Format(time.RFC3339))
+	fmt.Fprintf(w, "Duration:\t%s\n", c.Duration().Round(time.Millisecond))
+	fmt.Fprintf(w, "Rate:\t%.0f candidates/s\n", rate)
+	fmt.Fprintf(w, "Worker:\t%d\n", c.WorkerID)
+	fmt.Fprintf(w, "Engine:\t%s\n", c.Engine)
+	fmt.Fprintf(w, "Total iterations:\t%d\n", c.Evidence.TotalIterations)
+	fmt.Fprintf(w, "Max iterations:\t%d\n", c.Evidence.MaxIterations)
+	if c.MaxIterationsValue != nil {
+		fmt.Fprintf(w, "Max iterations value:\t%s\n", c.MaxIterationsValue)
+	}
+	for _, v := range c.Interesting {
+		fmt.Fprintf(w, "Interesting:\t%s\n", v)
+	}
+	if receipt != nil {
+		fmt.Fprintf(w, "Receipt:\taccepted %s\n", receipt.AcceptedOn.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(w, "Receipt:\tnone\n")
+	}
+	return w.Flush()
+}
+
+func resultsCommand(c *config, args []string) error {
+	if len(args) < 1 || (args[0] != "list" && args[0] != "show") {
+		return fmt.Errorf("usage: crunch results list [flags] | show <packet ID>")
+	}
+	st, err := openLocalStore(c)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	if args[0] == "show" {
+		return resultsShow(st, args[1:])
+	}
+	return resultsList(st, args[1:])
+}
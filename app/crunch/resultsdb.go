@@ -0,0 +1,211 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/url"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/store"
+
+	// registers the "sqlite" driver
+	_ "modernc.org/sqlite"
+)
+
+// resultsSchema creates the results database.  It documents the
+// tables for those querying them.
+//
+//go:embed resultsdb.sql
+var resultsSchema string
+
+// resultsSchemaVersion is the user_version resultsSchema sets.
+const resultsSchemaVersion = 1
+
+// resultsTimeLayout is how times are stored, in UTC.
+const resultsTimeLayout = "2006-01-02T15:04:05.000Z"
+
+// resultsDBConfig keeps what we find in a local SQLite database, so it
+// can be analysed with SQL without a server.  resultsdb.sql documents
+// its schema.
+type resultsDBConfig struct {
+	// Path is the database file, created if need be.
+	Path string `yaml:"path,omitempty"`
+
+	// SampleRate is the fraction of candidates stored in the
+	// candidates table, such as 0.0001.  By default none are.
+	SampleRate float64 `yaml:"sampleRate,omitempty"`
+}
+
+func (c *resultsDBConfig) applyDefaults() error {
+	if c.Path == "" {
+		return fmt.Errorf("resultsDB.path is required")
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("resultsDB.sampleRate must be from 0 to 1")
+	}
+	return nil
+}
+
+// resultsDB is the results database.  Its methods do nothing if it is
+// nil.
+type resultsDB struct {
+	db *sql.DB
+}
+
+// localResults is the results database, or nil if none is configured.
+var localResults *resultsDB
+
+// openResultsDB opens the results database, creating it if need be.
+func openResultsDB(ctx context.Context, c *resultsDBConfig) (*resultsDB, error) {
+	dsn := "file:" + c.Path + "?" + url.Values{
+		"_pragma": []string{"busy_timeout(10000)", "journal_mode(WAL)", "synchronous(NORMAL)"},
+	}.Encode()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// Workers write one at a time, so none waits on SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	var version int
+	if err := db.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version); err != nil {
+		db.Close()
+		return nil, err
+	}
+	switch version {
+	case 0:
+		if _, err := db.ExecContext(ctx, resultsSchema); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("creating schema: %v", err)
+		}
+	case resultsSchemaVersion:
+	default:
+		db.Close()
+		return nil, fmt.Errorf("schema version %d is not %d; it was written by another version of crunch", version, resultsSchemaVersion)
+	}
+	slog.Info("keeping results in a database", "path", c.Path, "sampleRate", c.SampleRate)
+	return &resultsDB{db: db}, nil
+}
+
+func (r *resultsDB) close() error {
+	if r == nil {
+		return nil
+	}
+	return r.db.Close()
+}
+
+// recordBlock stores the summary of a finished block, and the records
+// it sets.  Failures are logged, as the block's result is kept and
+// reported regardless.
+func (r *resultsDB) recordBlock(work *internal.WorkPacket, workerID int, startedOn, completedOn time.Time, result *blockResult) {
+	if r == nil {
+		return
+	}
+	if err := r.insertBlock(work, workerID, startedOn, completedOn, result); err != nil {
+		slog.Error("cannot record block in results database", "packet", work.ID, "err", err)
+	}
+}
+
+func (r *resultsDB) insertBlock(work *internal.WorkPacket, workerID int, startedOn, completedOn time.Time, result *blockResult) error {
+	tested := uint64(0)
+	for _, n := range result.Histogram {
+		tested += n
+	}
+	// empty arrays, rather than null, so json_each works on every row
+	histogram, err := json.Marshal(append([]uint64{}, result.Histogram...))
+	if err != nil {
+		return err
+	}
+	skipped, err := json.Marshal(append([]*big.Int{}, result.Skipped...))
+	if err != nil {
+		return err
+	}
+	completed := completedOn.UTC().Format(resultsTimeLayout)
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO blocks (packet_id, starting_value, ending_value, filter, worker_id, engine,
+		started_on, completed_on, tested, total_iterations, max_iterations, max_iterations_value, histogram, skipped)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		work.ID, work.StartingValue.String(), work.EndingValue.String(), work.Filter, workerID, result.Engine,
+		startedOn.UTC().Format(resultsTimeLayout), completed, tested, result.TotalIterations,
+		result.MaxIterations, decimalOrNull(result.MaxIterationsValue), string(histogram), string(skipped))
+	if err != nil {
+		return err
+	}
+	var best uint64
+	err = tx.QueryRow(`SELECT COALESCE(MAX(iterations), 0) FROM records WHERE kind = ?`, store.RecordMaxIterations).Scan(&best)
+	if err != nil {
+		return err
+	}
+	if result.MaxIterations > best && result.MaxIterationsValue != nil {
+		if err := insertRecord(tx, store.RecordMaxIterations, result.MaxIterationsValue, result.MaxIterations, work.ID, completed); err != nil {
+			return err
+		}
+	}
+	for _, v := range result.Interesting {
+		// the length of a loop is not kept
+		if err := insertRecord(tx, store.RecordLoop, v, 0, work.ID, completed); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func insertRecord(tx *sql.Tx, kind string, value *big.Int, iterations uint64, packetID, foundOn string) error {
+	_, err := tx.Exec(`INSERT INTO records (kind, value, iterations, packet_id, found_on) VALUES (?, ?, ?, ?, ?)`,
+		kind, value.String(), iterations, packetID, foundOn)
+	return err
+}
+
+// writeCandidates stores sampled candidates.
+func (r *resultsDB) writeCandidates(packetID string, samples []sampledCandidate) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO candidates (packet_id, value, iterations, max_bits) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, c := range samples {
+		if _, err := stmt.Exec(packetID, c.value.String(), c.iterations, c.maxBits); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// decimalOrNull returns v in decimal, or nil if it is nil.
+func decimalOrNull(v *big.Int) any {
+	if v == nil {
+		return nil
+	}
+	return v.String()
+}
@@ -0,0 +1,66 @@
+-- The schema of the results database crunch writes when resultsDB is
+-- configured, for analysis with any SQLite client.  Values, which may
+-- be too large for SQLite's integers, are decimal text; cast them only
+-- when they fit.  Times are UTC, as "2006-01-02T15:04:05.000Z", which
+-- SQLite's date functions understand.  PRAGMA user_version is the
+-- version of this schema.
+
+-- blocks has a row for each packet, or sub-range of a local run,
+-- finished.
+CREATE TABLE blocks (
+	id INTEGER PRIMARY KEY,
+	-- packet_id is the server's ID for the packet, or "local-N" for
+	-- the Nth sub-range of a local run.
+	packet_id TEXT NOT NULL,
+	starting_value TEXT NOT NULL,
+	ending_value TEXT NOT NULL,
+	-- filter is the residue filter the packet was run with, if any.
+	filter TEXT NOT NULL,
+	worker_id INTEGER NOT NULL,
+	engine TEXT NOT NULL,
+	started_on TEXT NOT NULL,
+	completed_on TEXT NOT NULL,
+	-- tested is the number of candidates counted: followed, or
+	-- counted by the residue wheel.  Candidates the filter left out,
+	-- or the watchdog skipped, are not.
+	tested INTEGER NOT NULL,
+	total_iterations INTEGER NOT NULL,
+	max_iterations INTEGER NOT NULL,
+	max_iterations_value TEXT,
+	-- histogram is a JSON array counting candidates by the number of
+	-- iterations they took, for use with json_each.
+	histogram TEXT NOT NULL,
+	-- skipped is a JSON array of the candidates the watchdog gave up
+	-- on.
+	skipped TEXT NOT NULL
+);
+
+CREATE INDEX blocks_completed_on ON blocks (completed_on);
+
+-- records has a row for each candidate taking more iterations than any
+-- in an earlier block in this database ("maxIterations"), and for each
+-- which looped back to itself ("loop"), whose iterations are 0.
+CREATE TABLE records (
+	id INTEGER PRIMARY KEY,
+	kind TEXT NOT NULL,
+	value TEXT NOT NULL,
+	iterations INTEGER NOT NULL,
+	packet_id TEXT NOT NULL,
+	found_on TEXT NOT NULL
+);
+
+CREATE INDEX records_kind ON records (kind, iterations);
+
+-- candidates has a row for each candidate sampled, at the rate
+-- resultsDB.sampleRate, if it is set.
+CREATE TABLE candidates (
+	id INTEGER PRIMARY KEY,
+	packet_id TEXT NOT NULL,
+	value TEXT NOT NULL,
+	iterations INTEGER NOT NULL,
+	-- max_bits is the bit length of the highest value the trajectory
+	-- reached before dropping below its start.
+	max_bits INTEGER NOT NULL
+);
+
+PRAGMA user_version = 1;
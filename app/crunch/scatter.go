@@ -0,0 +1,256 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+
+	"github.com/apache/arrow/go/v15/arrow"
+	"github.com/apache/arrow/go/v15/arrow/array"
+	"github.com/apache/arrow/go/v15/arrow/ipc"
+	"github.com/apache/arrow/go/v15/arrow/memory"
+)
+
+// scatterBatch is the number of rows in each Arrow record batch.
+const scatterBatch = 1 << 16
+
+// scatterPoint is one row of "crunch scatter": the trajectory of n,
+// followed down to 1.
+type scatterPoint struct {
+	n *big.Int
+
+	// stopping is the number of steps until the trajectory first drops
+	// below n, as records count them, and total the number until it
+	// reaches 1.  For 1, both are zero.
+	stopping, total uint64
+
+	// peak is the highest value the trajectory reaches.
+	peak *big.Int
+
+	// truncated is set if the trajectory was cut off before reaching
+	// 1, so only stopping, if it is not zero, is known.
+	truncated bool
+}
+
+// scatterer follows trajectories, reusing its scratch values.
+type scatterer struct {
+	v, t     big.Int
+	maxSteps uint64
+}
+
+// follow returns the point for n, which it does not keep.
+func (s *scatterer) follow(n *big.Int) scatterPoint {
+	p := scatterPoint{n: n, peak: new(big.Int).Set(n)}
+	v, t := &s.v, &s.t
+	v.Set(n)
+	for v.Cmp(one) > 0 {
+		if p.total == s.maxSteps {
+			p.truncated = true
+			break
+		}
+		p.total++
+		if v.Bit(0) == 0 {
+			v.Rsh(v, 1)
+		} else {
+			// 3n+1 as n+2n+1, so v's words are reused
+			t.Lsh(v, 1)
+			v.Add(v, t)
+			v.Add(v, one)
+			if v.Cmp(p.peak) > 0 {
+				p.peak.Set(v)
+			}
+		}
+		if p.stopping == 0 && v.Cmp(n) < 0 {
+			p.stopping = p.total
+		}
+	}
+	return p
+}
+
+// scatterWriter writes points in some format.
+type scatterWriter interface {
+	write(p scatterPoint) error
+	close() error
+}
+
+// csvScatter writes points as CSV, with a header, which gnuplot reads
+// with "set datafile separator comma".  A truncated trajectory's
+// total is left empty.
+type csvScatter struct {
+	w *csv.Writer
+}
+
+func newCSVScatter(w io.Writer) (*csvScatter, error) {
+	c := &csvScatter{w: csv.NewWriter(w)}
+	err := c.w.Write([]string{"n", "stopping_time", "total_stopping_time", "max_excursion"})
+	return c, err
+}
+
+func (c *csvScatter) write(p scatterPoint) error {
+	total := ""
+	if !p.truncated {
+		total = strconv.FormatUint(p.total, 10)
+	}
+	return c.w.Write([]string{p.n.String(), strconv.FormatUint(p.stopping, 10), total, p.peak.String()})
+}
+
+func (c *csvScatter) close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// arrowScatter writes points as an Arrow IPC stream, which pyarrow
+// reads with pyarrow.ipc.open_stream.  n must fit in 64 bits, and
+// max_excursion, for plotting, is a float64, so exact only to 2^53.
+// A truncated trajectory's total is null.
+type arrowScatter struct {
+	w *ipc.Writer
+	b *array.RecordBuilder
+}
+
+var scatterSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "n", Type: arrow.PrimitiveTypes.Uint64},
+	{Name: "stopping_time", Type: arrow.PrimitiveTypes.Uint64},
+	{Name: "total_stopping_time", Type: arrow.PrimitiveTypes.Uint64, Nullable: true},
+	{Name: "max_excursion", Type: arrow.PrimitiveTypes.Float64},
+}, nil)
+
+func newArrowScatter(w io.Writer) *arrowScatter {
+	return &arrowScatter{
+		w: ipc.NewWriter(w, ipc.WithSchema(scatterSchema)),
+		b: array.NewRecordBuilder(memory.DefaultAllocator, scatterSchema),
+	}
+}
+
+func (a *arrowScatter) write(p scatterPoint) error {
+	a.b.Field(0).(*array.Uint64Builder).Append(p.n.Uint64())
+	a.b.Field(1).(*array.Uint64Builder).Append(p.stopping)
+	if p.truncated {
+		a.b.Field(2).(*array.Uint64Builder).AppendNull()
+	} else {
+		a.b.Field(2).(*array.Uint64Builder).Append(p.total)
+	}
+	peak, _ := new(big.Float).SetInt(p.peak).Float64()
+	a.b.Field(3).(*array.Float64Builder).Append(peak)
+	if a.b.Field(0).Len() == scatterBatch {
+		return a.flush()
+	}
+	return nil
+}
+
+func (a *arrowScatter) flush() error {
+	rec := a.b.NewRecord()
+	defer rec.Release()
+	return a.w.Write(rec)
+}
+
+func (a *arrowScatter) close() error {
+	defer a.b.Release()
+	if a.b.Field(0).Len() > 0 {
+		if err := a.flush(); err != nil {
+			return err
+		}
+	}
+	return a.w.Close()
+}
+
+// scatterCommand implements "crunch scatter <from> <to>", writing the
+// stopping time, total stopping time, and highest value reached of
+// each value in [from, to], or with -every or -points, of one in so
+// many, for the classic Collatz scatter plots.
+func scatterCommand(args []string) error {
+	flags := flag.NewFlagSet("scatter", flag.ContinueOnError)
+	every := flags.Int64("every", 1, "take one value in this many")
+	points := flags.Int64("points", 0, "take at most about this many values, spread evenly over the range")
+	maxSteps := flags.Uint64("max-steps", 1000000, "cut off each trajectory after this many steps")
+	format := flags.String("format", "csv", "write \"csv\", or \"arrow\" for an Arrow IPC stream")
+	output := flags.String("o", "", "write to this file, rather than standard output")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: crunch scatter [flags] <from> <to>")
+	}
+	from, ok := new(big.Int).SetString(flags.Arg(0), 10)
+	if !ok || from.Sign() <= 0 {
+		return fmt.Errorf("%q is not a positive integer", flags.Arg(0))
+	}
+	to, ok := new(big.Int).SetString(flags.Arg(1), 10)
+	if !ok || to.Cmp(from) < 0 {
+		return fmt.Errorf("%q is not an integer at least %s", flags.Arg(1), from)
+	}
+	if *every <= 0 || *points < 0 || *maxSteps == 0 {
+		return fmt.Errorf("-every and -max-steps must be positive, and -points cannot be negative")
+	}
+	stride := big.NewInt(*every)
+	if *points > 0 {
+		// the stride spreading the points over the range, if larger
+		span := new(big.Int).Sub(to, from)
+		span.Add(span, one)
+		spread := new(big.Int).Add(span, big.NewInt(*points-1))
+		spread.Quo(spread, big.NewInt(*points))
+		if spread.Cmp(stride) > 0 {
+			stride = spread
+		}
+	}
+
+	out := io.WriteCloser(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	var w scatterWriter
+	switch *format {
+	case "csv":
+		c, err := newCSVScatter(out)
+		if err != nil {
+			return err
+		}
+		w = c
+	case "arrow":
+		if !to.IsUint64() {
+			return fmt.Errorf("-format arrow needs values below 2^64; use csv")
+		}
+		w = newArrowScatter(out)
+	default:
+		return fmt.Errorf("-format must be \"csv\" or \"arrow\"")
+	}
+
+	s := &scatterer{maxSteps: *maxSteps}
+	for n := new(big.Int).Set(from); n.Cmp(to) <= 0; n = new(big.Int).Add(n, stride) {
+		if err := w.write(s.follow(n)); err != nil {
+			return err
+		}
+	}
+	if err := w.close(); err != nil {
+		return err
+	}
+	if *output != "" {
+		return out.Close()
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// localSubBlock is the number of candidates in each sub-range a local
+// run is divided into.
+const localSubBlock = 1 << 21
+
+// localLookahead is how many sub-ranges a worker holds beyond the one
+// it is running.
+const localLookahead = 2
+
+// subRange is one slice of a local run.  Index orders it within the
+// run, so results are merged the same way however they were scheduled.
+type subRange struct {
+	index int
+	work  *internal.WorkPacket
+}
+
+// scheduler hands out the sub-ranges of a local run to workers.  They
+// come from a shared channel, and each worker keeps a few queued ahead,
+// to take the channel less often.  A worker which finds the channel
+// empty steals from the back of the longest queue, so a slow worker
+// holds up the run by at most the sub-range it is running.
+type scheduler struct {
+	sync.Mutex
+	ranges chan subRange
+	queues [][]subRange
+}
+
+// localConfig sets the range of a local run.
+type localConfig struct {
+	// Start and End bound the range, inclusive, as decimal integers.
+	// Only the odd ones are tested.  Start defaults to 2^40+1, and End
+	// to 100,000,000 integers per worker beyond it.
+	Start string `yaml:"start,omitempty"`
+	End   string `yaml:"end,omitempty"`
+}
+
+// candidates returns the first and last odd candidates in the range,
+// for the number of workers.
+func (c localConfig) candidates(workers int) (first, last *big.Int, err error) {
+	first = new(big.Int).SetBit(new(big.Int), 40, 1)
+	first.SetBit(first, 0, 1)
+	if c.Start != "" {
+		if _, ok := first.SetString(c.Start, 10); !ok || first.Sign() <= 0 {
+			return nil, nil, fmt.Errorf("local.start must be a positive integer, not %q", c.Start)
+		}
+	}
+	if first.Bit(0) == 0 {
+		first.Add(first, one)
+	}
+	last = new(big.Int).Mul(blocksize, big.NewInt(int64(workers)))
+	last.Add(last, first).Sub(last, one)
+	if c.End != "" {
+		if _, ok := last.SetString(c.End, 10); !ok {
+			return nil, nil, fmt.Errorf("local.end must be an integer, not %q", c.End)
+		}
+	}
+	if last.Bit(0) == 0 {
+		last.Sub(last, one)
+	}
+	if last.Cmp(first) < 0 {
+		return nil, nil, fmt.Errorf("local.start and local.end leave no odd integers to test")
+	}
+	return first, last, nil
+}
+
+// countCandidates returns the number of odd candidates from first to
+// last, which are both odd.
+func countCandidates(first, last *big.Int) *big.Int {
+	n := new(big.Int).Sub(last, first)
+	n.Rsh(n, 1)
+	return n.Add(n, one)
+}
+
+// newScheduler divides the odd candidates from first to last inclusive,
+// which are both odd, into sub-ranges of size candidates for workers;
+// the last has what remains.  Sub-ranges are made only as workers
+// take them, so a long run holds no more of them than a short one.
+func newScheduler(first, last *big.Int, size int64, workers int) *scheduler {
+	s := &scheduler{
+		ranges: make(chan subRange, workers*(localLookahead+1)),
+		queues: make([][]subRange, workers),
+	}
+	step := big.NewInt(2 * (size - 1))
+	go func() {
+		defer close(s.ranges)
+		next := new(big.Int).Set(first)
+		for index := 0; next.Cmp(last) <= 0; index++ {
+			ending := new(big.Int).Add(next, step)
+			if ending.Cmp(last) > 0 {
+				ending.Set(last)
+			}
+			s.ranges <- subRange{
+				index: index,
+				work: &internal.WorkPacket{
+					ID:            fmt.Sprintf("local-%d", index),
+					AssignedOn:    time.Now().UTC(),
+					StartingValue: new(big.Int).Set(next),
+					EndingValue:   ending,
+				},
+			}
+			next.Add(ending, two)
+		}
+	}()
+	return s
+}
+
+// take returns the next sub-range for a worker, or false once the run
+// has none left.
+func (s *scheduler) take(workerID int) (subRange, bool) {
+	s.Lock()
+	if q := s.queues[workerID]; len(q) > 0 {
+		s.queues[workerID] = q[1:]
+		s.Unlock()
+		return q[0], true
+	}
+	s.Unlock()
+
+	if r, ok := <-s.ranges; ok {
+		s.Lock()
+		defer s.Unlock()
+	fill:
+		for len(s.queues[workerID]) < localLookahead {
+			select {
+			case more, ok := <-s.ranges:
+				if !ok {
+					break fill
+				}
+				s.queues[workerID] = append(s.queues[workerID], more)
+			default:
+				break fill
+			}
+		}
+		return r, true
+	}
+	return s.steal()
+}
+
+// steal takes the last sub-range from the longest queue.
+func (s *scheduler) steal() (subRange, bool) {
+	s.Lock()
+	defer s.Unlock()
+	victim := -1
+	for i, q := range s.queues {
+		if len(q) > 0 && (victim < 0 || len(q) > len(s.queues[victim])) {
+			victim = i
+		}
+	}
+	if victim < 0 {
+		return subRange{}, false
+	}
+	q := s.queues[victim]
+	s.queues[victim] = q[:len(q)-1]
+	return q[len(q)-1], true
+}
+
+// mergeResults combines the results of consecutive sub-ranges, in
+// order, into the result of the whole run.
+func mergeResults(results []*blockResult) *blockResult {
+	ret := &blockResult{
+		Interesting: []*big.Int{},
+		Skipped:     []*big.Int{},
+	}
+	for _, r := range results {
+		// sub-ranges either side of limbsMaxStartBits use different engines
+		if ret.Engine == "" {
+			ret.Engine = r.Engine
+		} else if !strings.Contains(ret.Engine, r.Engine) {
+			ret.Engine += "," + r.Engine
+		}
+		ret.TotalIterations += r.TotalIterations
+		// the first candidate taking the most iterations
+		if r.MaxIterations > ret.MaxIterations {
+			ret.MaxIterations = r.MaxIterations
+			ret.MaxIterationsValue = r.MaxIterationsValue
+		}
+		ret.Interesting = append(ret.Interesting, r.Interesting...)
+		ret.Skipped = append(ret.Skipped, r.Skipped...)
+		for len(ret.Histogram) < len(r.Histogram) {
+			ret.Histogram = append(ret.Histogram, 0)
+		}
+		for i, n := range r.Histogram {
+			ret.Histogram[i] += n
+		}
+	}
+	return ret
+}
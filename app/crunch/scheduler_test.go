@@ -0,0 +1,163 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+// drain returns every sub-range the scheduler makes, in the order it
+// makes them.
+func drain(s *scheduler) []subRange {
+	var ret []subRange
+	for r := range s.ranges {
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+// checkCoverage fails unless the sub-ranges cover every odd candidate
+// from first to last exactly once, in index order, each holding at
+// most size of them.
+func checkCoverage(t *testing.T, ranges []subRange, first, last *big.Int, size int64) {
+	t.Helper()
+	next := new(big.Int).Set(first)
+	covered := new(big.Int)
+	for i, r := range ranges {
+		if r.index != i {
+			t.Fatalf("sub-range %d has index %d", i, r.index)
+		}
+		start, end := r.work.StartingValue, r.work.EndingValue
+		if start.Cmp(next) != 0 {
+			t.Fatalf("sub-range %d starts at %s, want %s", i, start, next)
+		}
+		if start.Bit(0) != 1 || end.Bit(0) != 1 {
+			t.Fatalf("sub-range %d is [%s, %s], want odd bounds", i, start, end)
+		}
+		if end.Cmp(start) < 0 {
+			t.Fatalf("sub-range %d is [%s, %s], which is empty", i, start, end)
+		}
+		n := countCandidates(start, end)
+		if n.Cmp(big.NewInt(size)) > 0 {
+			t.Fatalf("sub-range %d has %s candidates, more than %d", i, n, size)
+		}
+		if n.Cmp(big.NewInt(size)) < 0 && i != len(ranges)-1 {
+			t.Fatalf("sub-range %d has %s candidates, but is not the last", i, n)
+		}
+		covered.Add(covered, n)
+		next.Add(end, two)
+	}
+	if want := new(big.Int).Add(last, two); next.Cmp(want) != 0 {
+		t.Fatalf("sub-ranges end at %s, want %s", new(big.Int).Sub(next, two), last)
+	}
+	if want := countCandidates(first, last); covered.Cmp(want) != 0 {
+		t.Fatalf("sub-ranges cover %s candidates, countCandidates says %s", covered, want)
+	}
+}
+
+func TestSchedulerCoverage(t *testing.T) {
+	tests := []struct {
+		name        string
+		first, last int64
+		size        int64
+		wantRanges  int
+	}{
+		{"single candidate", 101, 101, 4, 1},
+		{"exact multiple", 1, 15, 4, 2},
+		{"remainder", 1, 19, 4, 3},
+		{"one candidate remaining", 1, 17, 4, 3},
+		{"sub-blocks of one", 3, 11, 1, 5},
+		{"one sub-block", 1, 5, 4, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, last := big.NewInt(tt.first), big.NewInt(tt.last)
+			ranges := drain(newScheduler(first, last, tt.size, 2))
+			if len(ranges) != tt.wantRanges {
+				t.Errorf("got %d sub-ranges, want %d", len(ranges), tt.wantRanges)
+			}
+			checkCoverage(t, ranges, first, last, tt.size)
+		})
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	tests := []struct {
+		name        string
+		start, end  string
+		first, last int64
+	}{
+		{"odd", "11", "21", 11, 21},
+		{"even start and end", "10", "22", 11, 21},
+		{"start equals end", "7", "7", 7, 7},
+		{"even start equals end", "8", "9", 9, 9},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, last, err := localConfig{Start: tt.start, End: tt.end}.candidates(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first.Int64() != tt.first || last.Int64() != tt.last {
+				t.Fatalf("got [%s, %s], want [%d, %d]", first, last, tt.first, tt.last)
+			}
+			checkCoverage(t, drain(newScheduler(first, last, 3, 1)), first, last, 3)
+		})
+	}
+}
+
+func TestCandidatesEmpty(t *testing.T) {
+	for _, c := range []localConfig{
+		{Start: "21", End: "11"},
+		{Start: "8", End: "8"},
+		{Start: "11", End: "10"},
+	} {
+		if first, last, err := c.candidates(1); err == nil {
+			t.Errorf("start %s, end %s: got [%s, %s], want an error", c.Start, c.End, first, last)
+		}
+	}
+}
+
+func TestCandidatesDefault(t *testing.T) {
+	first, last, err := localConfig{}.candidates(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := new(big.Int).Lsh(one, 40)
+	want.Add(want, one)
+	if first.Cmp(want) != 0 {
+		t.Errorf("got first %s, want %s", first, want)
+	}
+	// three workers' worth of integers, so half as many candidates
+	n := countCandidates(first, last)
+	if want := new(big.Int).Mul(blocksize, big.NewInt(3)); new(big.Int).Lsh(n, 1).Cmp(want) != 0 {
+		t.Errorf("got %s candidates, want %s", n, new(big.Int).Rsh(want, 1))
+	}
+}
+
+func TestCountCandidates(t *testing.T) {
+	for _, tt := range []struct{ first, last, want int64 }{
+		{1, 1, 1},
+		{1, 3, 2},
+		{3, 101, 50},
+	} {
+		if got := countCandidates(big.NewInt(tt.first), big.NewInt(tt.last)); got.Int64() != tt.want {
+			t.Errorf("countCandidates(%d, %d) = %s, want %d", tt.first, tt.last, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"sync/atomic"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/prom"
+)
+
+// shadowChoice is the engine named by -shadow, run alongside the one
+// engineFor picks, or "" for none.
+var shadowChoice string
+
+// shadowed counts the candidates the shadow engine has checked, and
+// the disagreements it has found, for every worker.
+var shadowed struct {
+	compared  atomic.Uint64
+	disagreed atomic.Uint64
+}
+
+// selectShadow checks the engine named by -shadow, opening the GPU if
+// it is "gpu".
+func selectShadow(name string, device int) error {
+	if name == "" {
+		return nil
+	}
+	if name == engineAuto {
+		return fmt.Errorf("the shadow engine must be named, not %q", engineAuto)
+	}
+	if err := openEngine(name, device); err != nil {
+		return err
+	}
+	shadowChoice = name
+	return nil
+}
+
+// shadowFor returns the shadow engine for the work packet.  Unlike
+// engineFor, it uses the engine named even if conformance disabled it,
+// as finding out how it goes wrong is the point.
+func shadowFor(work *internal.WorkPacket, dom *domain) engine {
+	switch shadowChoice {
+	case engineBig:
+		return getIterator()
+	case engineLimbs:
+		return newLimbBatchIterator(work, dom)
+	case engineJump:
+		return &jumpIterator{table: dom.jumpTable()}
+	case engineGMP:
+		return newGMPIterator()
+	case engineGPU:
+		return newGPUIterator(gpu, work.EndingValue)
+	}
+	return nil
+}
+
+// shadowEngine runs a second engine over every candidate the first
+// tests, comparing their results, so an engine can be checked against
+// a trusted one on real work before its results are trusted.  Where
+// they disagree, math/big decides, and its answer is the one run
+// records.
+type shadowEngine struct {
+	primary, shadow engine
+}
+
+// name returns the primary engine's name, as its results are the ones
+// recorded unless the engines disagree.
+func (e *shadowEngine) name() string {
+	return e.primary.name()
+}
+
+// release returns both engines' scratch space to their pools.
+func (e *shadowEngine) release() {
+	releaseEngine(e.primary)
+	releaseEngine(e.shadow)
+}
+
+// iterate follows s with both engines.  Both are watched, so the
+// watchdog can skip a candidate the shadow engine never finishes.
+func (e *shadowEngine) iterate(s *big.Int, watch *candidateWatch) (interesting bool, iterCount uint64, abandoned bool) {
+	interesting, iterCount, abandoned = e.primary.iterate(s, watch)
+	if abandoned {
+		return interesting, iterCount, abandoned
+	}
+	shadowInteresting, shadowCount, shadowAbandoned := e.shadow.iterate(s, watch)
+	if shadowAbandoned {
+		slog.Warn("shadow engine abandoned a candidate", "value", s, "engine", e.shadow.name(),
+			"iterations", shadowCount, "primary", e.primary.name(), "primaryIterations", iterCount)
+		return false, shadowCount, true
+	}
+	shadowed.compared.Add(1)
+	if shadowInteresting == interesting && shadowCount == iterCount {
+		return interesting, iterCount, false
+	}
+	shadowed.disagreed.Add(1)
+
+	// Asking for one more step than either found shows whether both
+	// are wrong.
+	answer := internal.Challenge{Value: s, Steps: max(iterCount, shadowCount) + 1}.Answer()
+	truth := fmt.Sprintf("%d iterations", answer.Steps)
+	if answer.Result.Cmp(s) > 0 {
+		truth = fmt.Sprintf("more than %d iterations", max(iterCount, shadowCount))
+	} else if answer.Result.Cmp(s) == 0 {
+		truth += ", looping"
+	}
+	slog.Error("engines disagree", "value", s, "math/big", truth,
+		"primary", e.primary.name(), "primaryIterations", iterCount, "primaryLoops", interesting,
+		"shadow", e.shadow.name(), "shadowIterations", shadowCount, "shadowLoops", shadowInteresting)
+	if answer.Result.Cmp(s) > 0 {
+		// neither is right; follow it to the end
+		fallback := getIterator()
+		defer putIterator(fallback)
+		return fallback.iterate(s, watch)
+	}
+	return answer.Result.Cmp(s) == 0, answer.Steps, false
+}
+
+// writeShadow writes the shadow engine's metrics, if there is one.
+func writeShadow(w io.Writer) {
+	if shadowChoice == "" {
+		return
+	}
+	labels := prom.Labels("engine", shadowChoice)
+	prom.WriteHeader(w, prom.CrunchShadowCompared, "counter", "Candidates the shadow engine checked.")
+	fmt.Fprintf(w, "%s%s %d\n", prom.CrunchShadowCompared, labels, shadowed.compared.Load())
+	prom.WriteHeader(w, prom.CrunchShadowDisagreed, "counter", "Candidates on which the shadow engine disagreed.")
+	fmt.Fprintf(w, "%s%s %d\n", prom.CrunchShadowDisagreed, labels, shadowed.disagreed.Load())
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/localstore"
+)
+
+const (
+	// localStoreFile is the client's database, in the state directory.
+	localStoreFile = "state.db"
+
+	// legacyReceiptsFile is the JSON-lines receipt ledger used before
+	// the local store existed.  It is imported once, then renamed.
+	legacyReceiptsFile = "receipts.jsonl"
+)
+
+// openLocalStore opens the client's database, importing any state
+// left in older ad-hoc files, and rewriting any values not in the
+// configured encoding.
+func openLocalStore(c *config) (*localstore.Store, error) {
+	if err := os.MkdirAll(c.StateDir, 0o700); err != nil {
+		return nil, err
+	}
+	filename := filepath.Join(c.StateDir, localStoreFile)
+	st, err := localstore.Open(filename, localstore.Encoding(c.StateEncoding))
+	if err != nil {
+		return nil, err
+	}
+	if err := importLegacyReceipts(st, c.StateDir); err != nil {
+		st.Close()
+		return nil, err
+	}
+	n, err := st.Reencode()
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+	if n > 0 {
+		slog.Info("re-encoded local state", "count", n, "encoding", c.StateEncoding, "file", filename)
+	}
+	return st, nil
+}
+
+func importLegacyReceipts(st *localstore.Store, stateDir string) error {
+	filename := filepath.Join(stateDir, legacyReceiptsFile)
+	f, err := os.Open(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var r internal.Receipt
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+		if err := st.AddReceipt(r); err != nil {
+			return err
+		}
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	slog.Info("imported receipts", "count", count, "file", filename)
+	return os.Rename(filename, filename+".imported")
+}
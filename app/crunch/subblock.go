@@ -0,0 +1,81 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Sub-blocks are sized to take about subBlockTarget, but never fewer
+// than minSubBlock candidates or more than maxSubBlock.
+const (
+	subBlockTarget = 100 * time.Millisecond
+	minSubBlock    = 1 << 10
+	maxSubBlock    = 1 << 20
+)
+
+// subBlockWeight is the weight of each sub-block in the moving
+// averages.
+const subBlockWeight = 0.25
+
+// subBlockSizer picks the size of run's sub-blocks from how long the
+// last ones took, so that run journals, publishes its progress, and
+// may be paused at a steady cadence, however the cost of a candidate
+// grows with its bit length.  It keeps a moving average of the time
+// each candidate takes and of its variance, and sizes sub-blocks for
+// a candidate two standard deviations slower than the average, so a
+// run of slow candidates seldom holds one up for long.  A sub-block
+// at most doubles on the last, so the first, at minSubBlock, cannot
+// take long whatever the candidates cost.
+type subBlockSizer struct {
+	size int
+
+	// mean and variance are of the seconds per candidate.
+	mean, variance float64
+	observed       bool
+}
+
+func newSubBlockSizer() *subBlockSizer {
+	return &subBlockSizer{size: minSubBlock}
+}
+
+// next returns the number of candidates in the next sub-block.
+func (s *subBlockSizer) next() int {
+	return s.size
+}
+
+// observe records that a sub-block of n candidates took elapsed, and
+// sizes the next one.
+func (s *subBlockSizer) observe(n int, elapsed time.Duration) {
+	if n <= 0 {
+		return
+	}
+	perCandidate := elapsed.Seconds() / float64(n)
+	if !s.observed {
+		s.mean, s.observed = perCandidate, true
+	} else {
+		d := perCandidate - s.mean
+		s.mean += subBlockWeight * d
+		s.variance = (1 - subBlockWeight) * (s.variance + subBlockWeight*d*d)
+	}
+	size := 2 * s.size
+	if slow := s.mean + 2*math.Sqrt(s.variance); slow > 0 {
+		size = min(size, int(subBlockTarget.Seconds()/slow))
+	}
+	s.size = max(minSubBlock, min(maxSubBlock, size))
+}
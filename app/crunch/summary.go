@@ -0,0 +1,60 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// summarize logs a summary of our work every interval until the
+// context is cancelled.
+func (m *metrics) summarize(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		slog.Info("summary", m.summary()...)
+	}
+}
+
+// summary returns the blocks done, the live totals, the combined rate
+// of all workers, and the candidate taking the most iterations so far,
+// as log attributes.
+func (m *metrics) summary() []any {
+	m.Lock()
+	defer m.Unlock()
+	rate := 0.0
+	for _, w := range m.workers {
+		rate += w.candidateRate.smoothed()
+	}
+	ret := []any{
+		"blocks", m.blocks,
+		"candidates", totals.candidates.Load(),
+		"iterations", totals.iterations.Load(),
+		"candidatesPerSecond", rate,
+	}
+	if iterations, value, ok := totals.maxIterations(); ok {
+		ret = append(ret, "maxIterations", iterations, "maxIterationsValue", value)
+	}
+	return ret
+}
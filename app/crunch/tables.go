@@ -0,0 +1,110 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime"
+	"unsafe"
+)
+
+// defaultTableMemory is the budget for the lookup tables if the size
+// of the last level cache cannot be found.
+const defaultTableMemory = 4 << 20
+
+// tableMemory is the most memory the jump table and residue wheel may
+// take together, in bytes, for calibration to pick a jump table that
+// fits.  Tables which do not fit in the last level cache with room to
+// spare for the trajectories themselves are slower, not faster.
+var tableMemory = defaultTableMemory
+
+// selectTableMemory sets tableMemory from the configured budget in
+// MiB, or if it is zero, half the last level cache.
+func selectTableMemory(mib int) error {
+	if mib < 0 {
+		return fmt.Errorf("tableMemory cannot be negative")
+	}
+	if mib > 0 {
+		tableMemory = mib << 20
+		return nil
+	}
+	if size := lastLevelCache(); size > 0 {
+		tableMemory = size / 2
+	}
+	return nil
+}
+
+// tableBytes returns the memory taken by a jump table of jumpBits, or
+// none if it is zero, and by the residue wheel in use.
+func tableBytes(jumpBits uint) int {
+	size := 0
+	if jumpBits > 0 {
+		size += 8 << jumpBits
+	}
+	if wheel != nil {
+		size += len(wheel.steps)
+	}
+	return size
+}
+
+// checkTableMemory warns if the tables configured do not fit in
+// tableMemory.  They are used anyway, as they were asked for.
+func checkTableMemory() {
+	k := uint(0)
+	if jumps != nil {
+		k = jumps.bits
+	}
+	if size := tableBytes(k); size > tableMemory {
+		slog.Warn("lookup tables exceed their memory budget", "bytes", size, "budget", tableMemory)
+	}
+}
+
+// tableBuffer is the memory under a lookup table.  On Linux it is
+// mapped on its own, so it can be pinned, and held in huge pages if it
+// is large enough.  The table must keep its buffer, as the buffer's
+// memory is released once it is collected.
+type tableBuffer struct {
+	bytes []byte
+}
+
+// uint64s returns the buffer's memory as n uint64s.
+func (b *tableBuffer) uint64s(n int) []uint64 {
+	if n == 0 {
+		return nil
+	}
+	return unsafe.Slice((*uint64)(unsafe.Pointer(&b.bytes[0])), n)
+}
+
+// warm reads every cache line of the tables workers on d use, so the
+// first candidates a worker tests do not wait on them.  Tables are
+// built by another thread, which on a placed domain may have a cache
+// of its own.
+func (d *domain) warm() {
+	sum := uint64(0)
+	if t := d.jumpTable(); t != nil {
+		for i := 0; i < len(t.entries); i += 8 {
+			sum += t.entries[i]
+		}
+	}
+	if w := d.residueWheel(); w != nil {
+		for i := 0; i < len(w.steps); i += 64 {
+			sum += uint64(w.steps[i])
+		}
+	}
+	runtime.KeepAlive(sum)
+}
@@ -0,0 +1,104 @@
+//go:build linux
+
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// hugePageSize is the smallest table worth holding in huge pages.
+const hugePageSize = 2 << 20
+
+// pinWarning reports once that tables cannot be pinned, which is
+// usually RLIMIT_MEMLOCK.
+var pinWarning sync.Once
+
+// newTableBuffer maps size bytes for a table, pinned so it is never
+// swapped out, and in transparent huge pages if it is large enough to
+// fill one, so walking it does not miss the TLB at every page.  If it
+// cannot be mapped, it is allocated as usual.
+func newTableBuffer(size int) *tableBuffer {
+	bytes, err := unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		slog.Debug("cannot map lookup table", "bytes", size, "err", err)
+		return &tableBuffer{bytes: make([]byte, size)}
+	}
+	if size >= hugePageSize {
+		if err := unix.Madvise(bytes, unix.MADV_HUGEPAGE); err != nil {
+			slog.Debug("cannot use huge pages for lookup table", "bytes", size, "err", err)
+		}
+	}
+	if err := unix.Mlock(bytes); err != nil {
+		pinWarning.Do(func() {
+			slog.Info("cannot pin lookup tables in memory", "bytes", size, "err", err)
+		})
+	}
+	b := &tableBuffer{bytes: bytes}
+	runtime.SetFinalizer(b, func(b *tableBuffer) { unix.Munmap(b.bytes) })
+	return b
+}
+
+// lastLevelCache returns the size in bytes of the first CPU's last
+// level cache, or zero if it cannot be read from sysfs.
+func lastLevelCache() int {
+	caches, _ := filepath.Glob("/sys/devices/system/cpu/cpu0/cache/index[0-9]*")
+	best, size := 0, 0
+	for _, dir := range caches {
+		b, err := os.ReadFile(filepath.Join(dir, "level"))
+		if err != nil {
+			continue
+		}
+		level, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil || level < best {
+			continue
+		}
+		if b, err = os.ReadFile(filepath.Join(dir, "size")); err != nil {
+			continue
+		}
+		if n := parseCacheSize(strings.TrimSpace(string(b))); n > 0 {
+			best, size = level, n
+		}
+	}
+	return size
+}
+
+// parseCacheSize parses a size in sysfs's form, such as "32768K", or
+// returns zero.
+func parseCacheSize(s string) int {
+	scale := 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		scale = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		scale = 1 << 20
+	}
+	n, err := strconv.Atoi(strings.TrimRight(s, "KM"))
+	if err != nil {
+		return 0
+	}
+	return n * scale
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+// newTableBuffer allocates size bytes for a table.  Pinning it, and
+// huge pages, need Linux.
+func newTableBuffer(size int) *tableBuffer {
+	return &tableBuffer{bytes: make([]byte, size)}
+}
+
+// lastLevelCache returns zero, as the cache cannot be found.
+func lastLevelCache() int {
+	return 0
+}
@@ -0,0 +1,258 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/host"
+	"github.com/skandragon/collatz/internal/prom"
+)
+
+// thermalConfig controls throttling when the CPU gets too hot.
+type thermalConfig struct {
+	// MaxTemperature, in degrees Celsius, is the temperature above
+	// which we pause workers.  The default is 85.
+	MaxTemperature float64 `yaml:"maxTemperature,omitempty"`
+
+	// ResumeTemperature is the temperature below which paused
+	// workers resume.  The default is 5 degrees below MaxTemperature.
+	ResumeTemperature float64 `yaml:"resumeTemperature,omitempty"`
+
+	// Interval is how often the temperature is checked.  Each check
+	// pauses or resumes at most one worker.  The default is 10s.
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// Sensors selects the sensors which measure the CPU, by
+	// case-insensitive substrings of their keys.  The hottest is
+	// used.  The default matches common CPU sensor drivers.
+	Sensors []string `yaml:"sensors,omitempty"`
+}
+
+func (c *thermalConfig) applyDefaults() error {
+	if c.MaxTemperature == 0 {
+		c.MaxTemperature = 85
+	}
+	if c.ResumeTemperature == 0 {
+		c.ResumeTemperature = c.MaxTemperature - 5
+	}
+	if c.ResumeTemperature >= c.MaxTemperature {
+		return fmt.Errorf("thermal.resumeTemperature must be below thermal.maxTemperature")
+	}
+	if c.Interval == 0 {
+		c.Interval = 10 * time.Second
+	}
+	if len(c.Sensors) == 0 {
+		c.Sensors = []string{"coretemp", "k10temp", "zenpower", "cpu"}
+	}
+	return nil
+}
+
+// throttle pauses workers while the CPU is too hot, or while other
+// work wants the machine.  Workers check it at each journal point, and
+// the highest-numbered are paused first.
+type throttle struct {
+	sync.Mutex
+	cond     *sync.Cond
+	config   *thermalConfig
+	yielding *yieldConfig
+	workers  int
+
+	// paused is the number of workers asked to pause for the heat,
+	// and yielded the number asked to pause for other work.  Workers
+	// pause for whichever asks more.
+	paused  int
+	events  uint64
+	yielded int
+	yields  uint64
+
+	// The last readings, or zero if unknown.
+	temperature float64
+	mhz         float64
+	loadAverage float64
+	otherLoad   float64
+	steal       float64
+}
+
+// newThrottle returns a throttle for the given number of workers.
+// Either config may be nil, disabling that check.
+func newThrottle(config *thermalConfig, yielding *yieldConfig, workers int) *throttle {
+	t := &throttle{config: config, yielding: yielding, workers: workers}
+	t.cond = sync.NewCond(&t.Mutex)
+	return t
+}
+
+// journal returns a journalFunc which waits while the worker is
+// paused, adding the time to timing, then calls next.  A nil throttle
+// never pauses.
+func (t *throttle) journal(workerID int, timing *blockTiming, next journalFunc) journalFunc {
+	if t == nil {
+		return next
+	}
+	return func(position *big.Int, partial *blockResult) {
+		t.Lock()
+		if workerID >= t.running() {
+			start := time.Now()
+			for workerID >= t.running() {
+				t.cond.Wait()
+			}
+			timing.since(&timing.throttled, start)
+		}
+		t.Unlock()
+		next(position, partial)
+	}
+}
+
+// pausing returns true if the worker is asked to pause.  A nil
+// throttle never pauses.
+func (t *throttle) pausing(workerID int) bool {
+	if t == nil {
+		return false
+	}
+	t.Lock()
+	defer t.Unlock()
+	return workerID >= t.running()
+}
+
+// running returns the number of workers not asked to pause.  The
+// caller holds the lock.
+func (t *throttle) running() int {
+	return t.workers - max(t.paused, t.yielded)
+}
+
+// run runs the checks configured until the context is cancelled.
+func (t *throttle) run(ctx context.Context) {
+	if t.yielding != nil {
+		go t.runYield(ctx)
+	}
+	if t.config != nil {
+		t.runThermal(ctx)
+	}
+}
+
+// runThermal checks the temperature until the context is cancelled.
+func (t *throttle) runThermal(ctx context.Context) {
+	ticker := time.NewTicker(t.config.Interval)
+	defer ticker.Stop()
+	for {
+		t.check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *throttle) check() {
+	temperature, err := t.readTemperature()
+	if err != nil {
+		slog.Warn("cannot read CPU temperature", "err", err)
+	}
+	mhz := readMHz()
+
+	t.Lock()
+	defer t.Unlock()
+	t.temperature = temperature
+	t.mhz = mhz
+	switch {
+	case err != nil:
+		// Do not keep workers paused on a reading we no longer have.
+		if t.paused > 0 {
+			t.paused = 0
+			t.cond.Broadcast()
+		}
+	case temperature > t.config.MaxTemperature && t.paused < t.workers:
+		t.paused++
+		t.events++
+		slog.Warn("CPU too hot, pausing a worker", "temperature", temperature,
+			"mhz", mhz, "paused", t.paused)
+	case temperature < t.config.ResumeTemperature && t.paused > 0:
+		t.paused--
+		t.cond.Broadcast()
+		slog.Info("CPU cooler, resuming a worker", "temperature", temperature,
+			"mhz", mhz, "paused", t.paused)
+	}
+}
+
+// readTemperature returns the hottest of the configured sensors.
+func (t *throttle) readTemperature() (float64, error) {
+	// Some sensors failing to read is reported as an error, along
+	// with the rest.
+	stats, err := host.SensorsTemperatures()
+	found := false
+	hottest := 0.0
+	for _, s := range stats {
+		key := strings.ToLower(s.SensorKey)
+		for _, want := range t.config.Sensors {
+			if strings.Contains(key, strings.ToLower(want)) {
+				if !found || s.Temperature > hottest {
+					hottest = s.Temperature
+				}
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		if err == nil {
+			err = fmt.Errorf("no sensor matches %q", t.config.Sensors)
+		}
+		return 0, err
+	}
+	return hottest, nil
+}
+
+// readMHz returns the average clock of the CPUs, or zero if unknown.
+// Some platforms report only the maximum clock.
+func readMHz() float64 {
+	infos, err := cpu.Info()
+	if err != nil || len(infos) == 0 {
+		return 0
+	}
+	total := 0.0
+	for _, info := range infos {
+		total += info.Mhz
+	}
+	return total / float64(len(infos))
+}
+
+// write writes the throttle's metrics in the Prometheus text format.
+func (t *throttle) write(w io.Writer) {
+	t.Lock()
+	defer t.Unlock()
+	t.writeYield(w)
+	if t.config == nil {
+		return
+	}
+	prom.WriteHeader(w, prom.CrunchCPUTemperature, "gauge", "Hottest CPU sensor, or 0 if unknown.")
+	fmt.Fprintf(w, "%s %s\n", prom.CrunchCPUTemperature, prom.FormatFloat(t.temperature))
+	prom.WriteHeader(w, prom.CrunchCPUFrequency, "gauge", "Average CPU clock, or 0 if unknown.")
+	fmt.Fprintf(w, "%s %s\n", prom.CrunchCPUFrequency, prom.FormatFloat(t.mhz*1e6))
+	prom.WriteHeader(w, prom.CrunchThrottledWorkers, "gauge", "Workers paused because the CPU is too hot.")
+	fmt.Fprintf(w, "%s %d\n", prom.CrunchThrottledWorkers, t.paused)
+	prom.WriteHeader(w, prom.CrunchThrottleEvents, "counter", "Times a worker was paused because the CPU was too hot.")
+	fmt.Fprintf(w, "%s %d\n", prom.CrunchThrottleEvents, t.events)
+}
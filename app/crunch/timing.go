@@ -0,0 +1,62 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"time"
+)
+
+// phaseBuckets are the histogram upper bounds, in seconds, for the
+// time a packet spends in each phase.  Computation takes minutes or
+// hours, while the overhead should take well under a second.
+var phaseBuckets = []float64{0.001, 0.01, 0.1, 1, 10, 60, 300, 900, 3600, 4 * 3600, 16 * 3600}
+
+// blockTiming is where the time to run one packet went.  It is only
+// touched by the worker running the packet, and then by the aggregator
+// it hands the packet to.
+type blockTiming struct {
+	// compute excludes the time run spent journaling or paused.
+	compute    time.Duration
+	checkpoint time.Duration
+	throttled  time.Duration
+	network    time.Duration
+}
+
+// since adds the time since start to the phase.
+func (t *blockTiming) since(phase *time.Duration, start time.Time) {
+	*phase += time.Since(start)
+}
+
+// phases returns each phase's time, by name.
+func (t *blockTiming) phases() map[string]time.Duration {
+	return map[string]time.Duration{
+		"compute":    t.compute,
+		"checkpoint": t.checkpoint,
+		"throttled":  t.throttled,
+		"network":    t.network,
+	}
+}
+
+// logAttrs returns the phases' times as log attributes.
+func (t *blockTiming) logAttrs() []any {
+	return []any{
+		"compute", t.compute.Round(time.Millisecond),
+		"checkpoint", t.checkpoint.Round(time.Millisecond),
+		"throttled", t.throttled.Round(time.Millisecond),
+		"network", t.network.Round(time.Millisecond),
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime"
+)
+
+// Values for config.Placement.
+const (
+	placementAuto = "auto"
+	placementNone = "none"
+)
+
+// domain is a set of CPUs sharing a NUMA node, or on a machine with a
+// single node, an L3 cache.  Workers placed on a domain run only on
+// its CPUs, and use lookup tables built there, so that the tables are
+// in the domain's memory and caches rather than another socket's.
+type domain struct {
+	id   int
+	cpus []int
+
+	jumps *jumpTable
+	wheel *residueWheel
+}
+
+// topology is the domains workers are spread over, which is empty if
+// they are not placed.
+type topology struct {
+	domains []*domain
+}
+
+// detectTopology finds the domains to place workers on.  It finds
+// none if placement is "none", or if the machine has only one.
+func detectTopology(placement string) (*topology, error) {
+	t := &topology{}
+	if placement == placementNone {
+		return t, nil
+	}
+	sets, err := cpuDomains()
+	if err != nil {
+		return nil, err
+	}
+	if len(sets) < 2 {
+		return t, nil
+	}
+	for i, cpus := range sets {
+		t.domains = append(t.domains, &domain{id: i, cpus: cpus})
+	}
+	return t, nil
+}
+
+// buildTables gives each domain its own copy of the lookup tables in
+// use, built by a thread running on the domain, so that their memory
+// is allocated there.
+func (t *topology) buildTables() error {
+	for _, d := range t.domains {
+		errs := make(chan error, 1)
+		go func(d *domain) {
+			// the thread ends with this goroutine, taking its
+			// affinity with it
+			runtime.LockOSThread()
+			if err := pinThread(d.cpus); err != nil {
+				errs <- err
+				return
+			}
+			if jumps != nil {
+				d.jumps = newJumpTable(jumps.bits)
+			}
+			if wheel != nil {
+				d.wheel = newResidueWheel(wheel.bits)
+			}
+			errs <- nil
+		}(d)
+		if err := <-errs; err != nil {
+			return fmt.Errorf("domain %d: %v", d.id, err)
+		}
+	}
+	for _, d := range t.domains {
+		slog.Info("placing workers", "domain", d.id, "cpus", d.cpus)
+	}
+	return nil
+}
+
+// domainFor returns the domain for a worker, spreading workers over
+// the domains in proportion to their CPUs, or nil if workers are not
+// placed.
+func (t *topology) domainFor(workerID int, workers int) *domain {
+	total := 0
+	for _, d := range t.domains {
+		total += len(d.cpus)
+	}
+	if total == 0 {
+		return nil
+	}
+	cpu := workerID * total / workers
+	for _, d := range t.domains {
+		if cpu < len(d.cpus) {
+			return d
+		}
+		cpu -= len(d.cpus)
+	}
+	return nil
+}
+
+// enter pins the calling goroutine's thread to d's CPUs, for the rest
+// of the goroutine's life.  It does nothing on a nil domain.
+func (d *domain) enter() {
+	if d == nil {
+		return
+	}
+	runtime.LockOSThread()
+	if err := pinThread(d.cpus); err != nil {
+		slog.Warn("cannot place worker", "domain", d.id, "err", err)
+	}
+}
+
+// jumpTable returns the jump table for workers on d.
+func (d *domain) jumpTable() *jumpTable {
+	if d == nil || d.jumps == nil || jumps == nil {
+		return jumps
+	}
+	return d.jumps
+}
+
+// residueWheel returns the wheel for workers on d.
+func (d *domain) residueWheel() *residueWheel {
+	if d == nil || d.wheel == nil || wheel == nil {
+		return wheel
+	}
+	return d.wheel
+}
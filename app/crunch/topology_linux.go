@@ -0,0 +1,128 @@
+//go:build linux
+
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// cpuDomains reads the NUMA nodes' CPUs from sysfs.  If there is a
+// single node, it is divided by L3 cache instead.
+func cpuDomains() ([][]int, error) {
+	nodes, err := filepath.Glob("/sys/devices/system/node/node[0-9]*/cpulist")
+	if err != nil {
+		return nil, err
+	}
+	var ret [][]int
+	for _, name := range nodes {
+		cpus, err := readCPUList(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(cpus) > 0 {
+			ret = append(ret, cpus)
+		}
+	}
+	if len(ret) > 1 {
+		return ret, nil
+	}
+	return l3Domains()
+}
+
+// l3Domains groups the online CPUs by the L3 cache they share.
+func l3Domains() ([][]int, error) {
+	online, err := readCPUList("/sys/devices/system/cpu/online")
+	if err != nil {
+		return nil, err
+	}
+	var ret [][]int
+	seen := map[string]bool{}
+	for _, cpu := range online {
+		caches, _ := filepath.Glob("/sys/devices/system/cpu/cpu" + strconv.Itoa(cpu) + "/cache/index[0-9]*")
+		for _, dir := range caches {
+			level, err := os.ReadFile(filepath.Join(dir, "level"))
+			if err != nil || strings.TrimSpace(string(level)) != "3" {
+				continue
+			}
+			shared, err := os.ReadFile(filepath.Join(dir, "shared_cpu_list"))
+			if err != nil {
+				continue
+			}
+			key := strings.TrimSpace(string(shared))
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			cpus, err := parseCPUList(key)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, cpus)
+		}
+	}
+	return ret, nil
+}
+
+// readCPUList reads a file in the kernel's CPU list format.
+func readCPUList(name string) ([]int, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return parseCPUList(strings.TrimSpace(string(b)))
+}
+
+// parseCPUList parses the kernel's CPU list format, such as "0-3,8".
+func parseCPUList(s string) ([]int, error) {
+	var ret []int
+	if s == "" {
+		return ret, nil
+	}
+	for _, r := range strings.Split(s, ",") {
+		lo, hi, found := strings.Cut(r, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if found {
+			if last, err = strconv.Atoi(hi); err != nil {
+				return nil, err
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			ret = append(ret, cpu)
+		}
+	}
+	return ret, nil
+}
+
+// pinThread restricts the calling thread to cpus.
+func pinThread(cpus []int) error {
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return unix.SchedSetaffinity(0, &set)
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"sync/atomic"
+
+	"github.com/skandragon/collatz/internal/prom"
+)
+
+// totals is the live view of every worker's work since we started,
+// which run publishes to once per sub-block.  It takes no lock, so
+// workers never wait on each other, or on a reader, to publish.
+var totals globalTotals
+
+type globalTotals struct {
+	candidates atomic.Uint64
+	iterations atomic.Uint64
+
+	// best is the candidate taking the most iterations.  It is
+	// replaced, never changed, so a reader sees the iterations and
+	// the value together.
+	best atomic.Pointer[bestCandidate]
+}
+
+// bestCandidate is a candidate and the iterations it took.
+type bestCandidate struct {
+	iterations uint64
+	value      *big.Int
+}
+
+// add counts candidates tested and the iterations they took.
+func (t *globalTotals) add(candidates, iterations uint64) {
+	t.candidates.Add(candidates)
+	t.iterations.Add(iterations)
+}
+
+// observeMax records that value took iterations, if it took more than
+// the best so far.  Value is copied only if it is, so a worker may
+// offer the same one every sub-block at the cost of a load.
+func (t *globalTotals) observeMax(iterations uint64, value *big.Int) {
+	if iterations == 0 {
+		return
+	}
+	var next *bestCandidate
+	for {
+		best := t.best.Load()
+		if best != nil && best.iterations >= iterations {
+			return
+		}
+		if next == nil {
+			next = &bestCandidate{iterations: iterations, value: new(big.Int).Set(value)}
+		}
+		if t.best.CompareAndSwap(best, next) {
+			return
+		}
+	}
+}
+
+// maxIterations returns the most iterations any candidate took, and
+// which one it was, or false if none has been tested.
+func (t *globalTotals) maxIterations() (uint64, *big.Int, bool) {
+	best := t.best.Load()
+	if best == nil {
+		return 0, nil, false
+	}
+	return best.iterations, best.value, true
+}
+
+// write writes the totals in the Prometheus text format.
+func (t *globalTotals) write(w io.Writer) {
+	prom.WriteHeader(w, prom.CrunchTotalCandidates, "counter", "Candidates tested by all workers.")
+	fmt.Fprintf(w, "%s %d\n", prom.CrunchTotalCandidates, t.candidates.Load())
+	prom.WriteHeader(w, prom.CrunchTotalIterations, "counter", "Iterations performed by all workers.")
+	fmt.Fprintf(w, "%s %d\n", prom.CrunchTotalIterations, t.iterations.Load())
+	if iterations, _, ok := t.maxIterations(); ok {
+		prom.WriteHeader(w, prom.CrunchMaxIterations, "gauge", "Most iterations taken by any candidate tested.")
+		fmt.Fprintf(w, "%s %d\n", prom.CrunchMaxIterations, iterations)
+	}
+}
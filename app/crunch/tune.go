@@ -0,0 +1,118 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log/slog"
+	"math/big"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// tuned is the calibration's choice of engines for -engine=auto, or
+// nil if it did not run.
+var tuned *internal.Tuning
+
+// calibrationCandidates is the number of consecutive odd candidates
+// each configuration is timed over, in each of calibrationRounds.
+const (
+	calibrationCandidates = 1 << 13
+	calibrationRounds     = 3
+)
+
+// calibrationJumpBits are the jump table sizes calibration tries.
+var calibrationJumpBits = []int{8, 10, 12, 14, 16}
+
+// calibrationStarts are where calibration times packets which fit the
+// u256 engine, and those too wide for it.
+var (
+	calibrationStart     = new(big.Int).SetBit(big.NewInt(1), 60, 1)
+	calibrationWideStart = new(big.Int).SetBit(big.NewInt(1), 160, 1)
+)
+
+// calibrate times the CPU engines on this machine, and the jump table
+// sizes unless jumpBits is set, and picks the fastest for packets
+// which fit the u256 engine and for wider ones.  It tries only jump
+// tables which fit in tableMemory with the wheel, but the smallest.  It leaves the jump
+// table at the size chosen, and returns what it found.
+func calibrate(jumpBits int) *internal.Tuning {
+	t := &internal.Tuning{}
+	measure := func(e engine, k int, wide bool) float64 {
+		first := calibrationStart
+		if wide {
+			first = calibrationWideStart
+		}
+		var best time.Duration
+		for round := 0; round < calibrationRounds; round++ {
+			d := timeLoop(first, calibrationCandidates, func(v *big.Int) { e.iterate(v, nil) })
+			if round == 0 || d < best {
+				best = d
+			}
+		}
+		r := float64(calibrationCandidates) / best.Seconds()
+		t.Rates = append(t.Rates, internal.EngineRate{Engine: e.name(), JumpBits: k, Wide: wide, Rate: r})
+		return r
+	}
+
+	// the jump table size is chosen on wide packets, where the jump
+	// engine is used unless calibration finds math/big faster
+	sizes := calibrationJumpBits
+	if jumpBits > 0 {
+		sizes = []int{jumpBits}
+	} else if jumpBits < 0 {
+		sizes = nil
+	} else {
+		sizes = nil
+		for _, k := range calibrationJumpBits {
+			if len(sizes) == 0 || tableBytes(uint(k)) <= tableMemory {
+				sizes = append(sizes, k)
+			}
+		}
+	}
+	jumps = nil
+	var wideJump float64
+	for _, k := range sizes {
+		table := newJumpTable(uint(k))
+		if r := measure(&jumpIterator{table: table}, k, true); r > wideJump {
+			wideJump, t.JumpBits, jumps = r, k, table
+		}
+	}
+
+	var best, bestWide float64
+	for _, e := range engines() {
+		k := 0
+		if e.name() == engineJump {
+			k = t.JumpBits
+		}
+		if r := measure(e, k, false); r > best {
+			best, t.Engine = r, e.name()
+		}
+		if e.name() == engineLimbs {
+			continue
+		}
+		r := wideJump
+		if e.name() != engineJump {
+			r = measure(e, 0, true)
+		}
+		if r > bestWide {
+			bestWide, t.WideEngine = r, e.name()
+		}
+	}
+	slog.Info("calibrated engines", "engine", t.Engine, "wideEngine", t.WideEngine, "jumpBits", t.JumpBits)
+	return t
+}
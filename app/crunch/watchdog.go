@@ -0,0 +1,191 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// watchdogConfig controls the watchdog, which looks for workers stuck
+// on one candidate, as by a runaway trajectory.
+type watchdogConfig struct {
+	// Window is how long a worker may spend on one candidate before
+	// it is stalled.  The default is 1m.
+	Window time.Duration `yaml:"window,omitempty"`
+
+	// Skip, if set, gives up on a stalled candidate, recording it for
+	// manual review, so the worker can finish its packet.  Otherwise
+	// a stall is only logged.
+	Skip bool `yaml:"skip,omitempty"`
+}
+
+func (c *watchdogConfig) applyDefaults() {
+	if c.Window == 0 {
+		c.Window = time.Minute
+	}
+}
+
+// watchIterations is how often, in iterations, a trajectory publishes
+// its progress and checks whether it should give up.
+const watchIterations = 1 << 16
+
+// candidateWatch is shared by a running worker and its watchdog.  All
+// methods are safe on a nil candidateWatch, which watches nothing.
+type candidateWatch struct {
+	// done counts the candidates finished, tested or skipped.
+	done atomic.Uint64
+
+	// iterations is the progress of the current candidate, as of the
+	// last time it was published.
+	iterations atomic.Uint64
+
+	// abandon asks the worker to skip the current candidate.
+	abandon atomic.Bool
+}
+
+func (w *candidateWatch) tested() {
+	if w != nil {
+		w.done.Add(1)
+	}
+}
+
+func (w *candidateWatch) skipped() {
+	if w != nil {
+		w.abandon.Store(false)
+		w.done.Add(1)
+	}
+}
+
+// check publishes the iterations done on the current candidate, and
+// returns true if the worker should give up on it.
+func (w *candidateWatch) check(iterations uint64) bool {
+	w.iterations.Store(iterations)
+	return w.abandon.Load()
+}
+
+// watchdog watches the workers' candidates.
+type watchdog struct {
+	config *watchdogConfig
+
+	// reviewDir holds the candidates skipped, for manual review.
+	reviewDir string
+	events    *eventLog
+	nodeID    string
+}
+
+// stalledCandidate is written to the review directory for each
+// candidate skipped.
+type stalledCandidate struct {
+	PacketID   string        `json:"packetID"`
+	WorkerID   int           `json:"workerID"`
+	Value      *big.Int      `json:"value"`
+	Iterations uint64        `json:"iterations"`
+	Stalled    time.Duration `json:"stalled"`
+	SkippedOn  time.Time     `json:"skippedOn"`
+}
+
+// watch returns a candidateWatch for a worker about to run a packet
+// from position, and watches it until the context is cancelled.  A nil
+// watchdog returns nil.
+func (d *watchdog) watch(ctx context.Context, workerID int, work *internal.WorkPacket, position *big.Int) *candidateWatch {
+	if d == nil {
+		return nil
+	}
+	w := &candidateWatch{}
+	go d.run(ctx, w, workerID, work, new(big.Int).Set(position))
+	return w
+}
+
+func (d *watchdog) run(ctx context.Context, w *candidateWatch, workerID int, work *internal.WorkPacket, position *big.Int) {
+	logger := packetLogger(workerID, work.ID)
+	ticker := time.NewTicker(d.config.Window / 4)
+	defer ticker.Stop()
+	done := w.done.Load()
+	changedOn := time.Now()
+	reported := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if n := w.done.Load(); n != done {
+			done, changedOn, reported = n, time.Now(), false
+			continue
+		}
+		stalled := time.Since(changedOn)
+		if stalled < d.config.Window || reported {
+			continue
+		}
+		reported = true
+		value := new(big.Int).Lsh(new(big.Int).SetUint64(done), 1)
+		value.Add(value, position)
+		iterations := w.iterations.Load()
+		logger.Warn("worker stalled on a candidate", "value", value, "bitlen", value.BitLen(),
+			"iterations", iterations, "stalled", stalled.Round(time.Second), "skip", d.config.Skip)
+		e := internal.Event{
+			Kind:       internal.EventStall,
+			NodeID:     d.nodeID,
+			PacketID:   work.ID,
+			Value:      value,
+			Iterations: iterations,
+			Message:    fmt.Sprintf("worker %d stalled for %s", workerID, stalled.Round(time.Second)),
+		}
+		if d.config.Skip {
+			d.review(stalledCandidate{
+				PacketID:   work.ID,
+				WorkerID:   workerID,
+				Value:      value,
+				Iterations: iterations,
+				Stalled:    stalled,
+				SkippedOn:  time.Now().UTC(),
+			}, logger)
+			e.Message += ", skipped"
+			w.abandon.Store(true)
+		}
+		d.events.add(e)
+	}
+}
+
+// review writes a skipped candidate to the review directory.
+func (d *watchdog) review(c stalledCandidate, logger *slog.Logger) {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		logger.Error("cannot encode stalled candidate", "err", err)
+		return
+	}
+	if err := os.MkdirAll(d.reviewDir, 0o700); err != nil {
+		logger.Error("cannot create review directory", "dir", d.reviewDir, "err", err)
+		return
+	}
+	name := filepath.Join(d.reviewDir, fmt.Sprintf("%s-%s.json", c.PacketID, c.Value))
+	if err := os.WriteFile(name, b, 0o600); err != nil {
+		logger.Error("cannot write stalled candidate", "file", name, "err", err)
+		return
+	}
+	logger.Info("wrote stalled candidate for review", "file", name)
+}
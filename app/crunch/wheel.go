@@ -0,0 +1,129 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// defaultWheelBits is the size of the residue wheel unless configured.
+const defaultWheelBits = 16
+
+// maxWheelBits bounds the wheel, whose table has a byte for each odd
+// residue.
+const maxWheelBits = 20
+
+// wheel is the residue wheel run uses, or nil to test every candidate.
+var wheel *residueWheel
+
+// residueWheel sieves candidates by their residue mod 2^bits.  The
+// first steps of a trajectory depend only on the low bits of its
+// start: n = r (mod 2^bits) reaches (3^a n + c)/2^b after a odd steps
+// and b halvings, for as long as b < bits.  If 2^b > 3^a first, the
+// trajectory drops below n there, for every n above c/(2^b - 3^a),
+// having taken a+b iterations, so run counts such candidates without
+// following them.  This changes nothing in the result.
+type residueWheel struct {
+	bits uint
+	mask uint64
+
+	// steps, indexed by an odd residue shifted right once, is the
+	// iterations every candidate with that residue takes, or zero if
+	// it must be tested.  They are in mem.
+	steps []uint8
+	mem   *tableBuffer
+
+	// threshold is the largest candidate the wheel does not apply to.
+	threshold *big.Int
+}
+
+// newResidueWheel builds the wheel for residues mod 2^bits.
+func newResidueWheel(bits uint) *residueWheel {
+	w := &residueWheel{
+		bits:      bits,
+		mask:      1<<bits - 1,
+		mem:       newTableBuffer(1 << (bits - 1)),
+		threshold: new(big.Int),
+	}
+	w.steps = w.mem.bytes
+	x, c, pow3, pow2, bound := new(big.Int), new(big.Int), new(big.Int), new(big.Int), new(big.Int)
+	for i := range w.steps {
+		x.SetUint64(uint64(2*i + 1))
+		c.SetUint64(0)
+		pow3.SetUint64(1)
+		pow2.SetUint64(1)
+		a, b := uint(0), uint(0)
+		for b < bits {
+			if x.Bit(0) == 1 {
+				x.Mul(x, three)
+				x.Add(x, one)
+				c.Mul(c, three)
+				c.Add(c, pow2)
+				pow3.Mul(pow3, three)
+				a++
+				continue
+			}
+			x.Rsh(x, 1)
+			pow2.Lsh(pow2, 1)
+			b++
+			if pow2.Cmp(pow3) > 0 {
+				w.steps[i] = uint8(a + b)
+				bound.Sub(pow2, pow3)
+				bound.Quo(c, bound)
+				if bound.Cmp(w.threshold) > 0 {
+					w.threshold.Set(bound)
+				}
+				break
+			}
+		}
+	}
+	return w
+}
+
+// selectWheel sets the wheel from the configured size; a negative one
+// disables it.
+func selectWheel(bits int) error {
+	if bits < 0 {
+		wheel = nil
+		return nil
+	}
+	if bits < 2 || bits > maxWheelBits {
+		return fmt.Errorf("wheelBits must be from 2 to %d, or negative to disable the wheel", maxWheelBits)
+	}
+	wheel = newResidueWheel(uint(bits))
+	return nil
+}
+
+// wheelFor returns the wheel run applies to the work packet, that of
+// the worker's domain if it has one, or nil if any of the packet's
+// candidates is too small for it.
+func wheelFor(work *internal.WorkPacket, dom *domain) *residueWheel {
+	w := dom.residueWheel()
+	if w == nil || work.StartingValue.Cmp(w.threshold) <= 0 {
+		return nil
+	}
+	return w
+}
+
+// sieved returns the iterations taken by a candidate whose low bits
+// are low, or zero if it must be tested.
+func (w *residueWheel) sieved(low uint64) uint64 {
+	return uint64(w.steps[(low&w.mask)>>1])
+}
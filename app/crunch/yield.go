@@ -0,0 +1,230 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"time"
+
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/load"
+	"github.com/shirou/gopsutil/process"
+	"github.com/skandragon/collatz/internal/prom"
+)
+
+// yieldConfig controls yielding the machine to other work.  We are a
+// guest on it: when its owner's work, or on a VM other tenants, want
+// the CPUs, we pause workers to make room, and resume them as it
+// quietens.
+type yieldConfig struct {
+	// Disabled keeps every worker running however busy the machine.
+	Disabled bool `yaml:"disabled,omitempty"`
+
+	// Threshold is the share of the machine other work may use, from
+	// 0 to 1, before we yield any of it.  Above it, workers are
+	// paused in proportion to the share used.  The default is 0.1.
+	Threshold float64 `yaml:"threshold,omitempty"`
+
+	// Interval is how often the load is checked.  Workers are paused
+	// at once, but each check resumes at most one.  The default is
+	// 15s.
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+func (c *yieldConfig) applyDefaults() error {
+	if c.Threshold < 0 || c.Threshold >= 1 {
+		return fmt.Errorf("yield.threshold must be at least 0, and below 1")
+	}
+	if c.Threshold == 0 {
+		c.Threshold = 0.1
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("yield.interval cannot be negative")
+	}
+	if c.Interval == 0 {
+		c.Interval = 15 * time.Second
+	}
+	return nil
+}
+
+// loadAveragePeriod is the time constant of the 1 minute load average.
+const loadAveragePeriod = time.Minute
+
+// loadSample is what we measured at one check.
+type loadSample struct {
+	at time.Time
+
+	// ours is the CPU time we have used, and cpu the machine's.
+	ours float64
+	cpu  cpu.TimesStat
+}
+
+// loadMeter tells our load on the machine from others'.
+type loadMeter struct {
+	self *process.Process
+	cpus int
+	last loadSample
+
+	// ownLoad is our share of the load average.  It is averaged as
+	// the kernel averages the load, so when we pause workers, they
+	// are not taken for other work while the load average decays.
+	ownLoad float64
+}
+
+func newLoadMeter() (*loadMeter, error) {
+	self, err := process.NewProcess(int32(os.Getpid()))
+	if err != nil {
+		return nil, err
+	}
+	cpus, err := cpu.Counts(true)
+	if err != nil {
+		return nil, err
+	}
+	lm := &loadMeter{self: self, cpus: cpus}
+	lm.last, err = lm.sample()
+	return lm, err
+}
+
+func (lm *loadMeter) sample() (loadSample, error) {
+	ret := loadSample{at: time.Now()}
+	ours, err := lm.self.Times()
+	if err != nil {
+		return ret, err
+	}
+	ret.ours = ours.User + ours.System
+	total, err := cpu.Times(false)
+	if err != nil {
+		return ret, err
+	}
+	if len(total) > 0 {
+		ret.cpu = total[0]
+	}
+	return ret, nil
+}
+
+// measure returns the load average, the part of it which is not ours,
+// and the fraction of CPU time stolen by the hypervisor, since the last
+// measurement.
+func (lm *loadMeter) measure() (average, other, steal float64, err error) {
+	avg, err := load.Avg()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	s, err := lm.sample()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	elapsed := s.at.Sub(lm.last.at)
+	if elapsed <= 0 {
+		return avg.Load1, math.Max(0, avg.Load1-lm.ownLoad), 0, nil
+	}
+	ours := (s.ours - lm.last.ours) / elapsed.Seconds()
+	decay := math.Exp(-elapsed.Seconds() / loadAveragePeriod.Seconds())
+	lm.ownLoad = lm.ownLoad*decay + ours*(1-decay)
+	if total := s.cpu.Total() - lm.last.cpu.Total(); total > 0 {
+		steal = (s.cpu.Steal - lm.last.cpu.Steal) / total
+	}
+	lm.last = s
+	return avg.Load1, math.Max(0, avg.Load1-lm.ownLoad), math.Max(0, steal), nil
+}
+
+// runYield checks the load until the context is cancelled.  If the load
+// cannot be read, as on some platforms, we stop checking it, and no
+// workers are held for it.
+func (t *throttle) runYield(ctx context.Context) {
+	lm, err := newLoadMeter()
+	if err != nil {
+		slog.Warn("cannot measure the load, so not yielding to other work", "err", err)
+		return
+	}
+	ticker := time.NewTicker(t.yielding.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		average, other, steal, err := lm.measure()
+		if err != nil {
+			slog.Warn("cannot measure the load, so not yielding to other work", "err", err)
+			t.yield(0)
+			return
+		}
+		t.checkLoad(float64(lm.cpus), average, other, steal)
+	}
+}
+
+// checkLoad sets the number of workers yielded for the load measured.
+// Others' share of the machine is the part of the load average which
+// is not ours, plus the time stolen from us; above the threshold, we
+// keep the rest of it.
+func (t *throttle) checkLoad(cpus, average, other, steal float64) {
+	busy := math.Min(1, other/cpus+steal)
+	want := 0
+	if busy > t.yielding.Threshold {
+		want = int(math.Round(float64(t.workers) * busy))
+	}
+
+	t.Lock()
+	t.loadAverage, t.otherLoad, t.steal = average, other, steal
+	yielded := t.yielded
+	t.Unlock()
+	switch {
+	case want > yielded:
+		slog.Info("machine busy with other work, pausing workers", "load", average,
+			"otherLoad", other, "steal", steal, "yielded", want)
+		t.yield(want)
+	case want < yielded:
+		slog.Info("machine less busy, resuming a worker", "load", average,
+			"otherLoad", other, "steal", steal, "yielded", yielded-1)
+		t.yield(yielded - 1)
+	}
+}
+
+// yield sets the number of workers paused for other work.
+func (t *throttle) yield(workers int) {
+	t.Lock()
+	defer t.Unlock()
+	if workers > t.yielded {
+		t.yields++
+	}
+	t.yielded = workers
+	t.cond.Broadcast()
+}
+
+// writeYield writes the load metrics.  The caller holds the lock.
+func (t *throttle) writeYield(w io.Writer) {
+	if t.yielding == nil {
+		return
+	}
+	prom.WriteHeader(w, prom.CrunchLoadAverage, "gauge", "The machine's 1 minute load average.")
+	fmt.Fprintf(w, "%s %s\n", prom.CrunchLoadAverage, prom.FormatFloat(t.loadAverage))
+	prom.WriteHeader(w, prom.CrunchOtherLoad, "gauge", "The part of the load average which is not ours.")
+	fmt.Fprintf(w, "%s %s\n", prom.CrunchOtherLoad, prom.FormatFloat(t.otherLoad))
+	prom.WriteHeader(w, prom.CrunchCPUSteal, "gauge", "Fraction of CPU time stolen by the hypervisor.")
+	fmt.Fprintf(w, "%s %s\n", prom.CrunchCPUSteal, prom.FormatFloat(t.steal))
+	prom.WriteHeader(w, prom.CrunchYieldedWorkers, "gauge", "Workers paused to make room for other work.")
+	fmt.Fprintf(w, "%s %d\n", prom.CrunchYieldedWorkers, t.yielded)
+	prom.WriteHeader(w, prom.CrunchYieldEvents, "counter", "Times workers were paused to make room for other work.")
+	fmt.Fprintf(w, "%s %d\n", prom.CrunchYieldEvents, t.yields)
+}
@@ -0,0 +1,291 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Secretcheck looks for the ways secrets leak which go vet does not:
+// secrets compared with == or bytes.Equal, which return as soon as a
+// byte differs, and struct types holding a secret which a %v or %#v
+// would print.  Run it over the tree as
+//
+//	go run ./app/secretcheck ./...
+//
+// It exits non-zero if it finds anything.  A comparison which is not
+// of a secret, despite its name, is allowed by a "secretcheck:ignore"
+// comment on its line or the one before, saying why.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const ignoreDirective = "secretcheck:ignore"
+
+var (
+	// comparedName matches names whose values must only be compared
+	// in constant time.
+	comparedName = regexp.MustCompile(`(?i)(secret|secretkey|token|authenticator|signature|mac|nonce)$`)
+
+	// heldName matches struct fields which must not be printed.
+	heldName = regexp.MustCompile(`^[A-Z]\w*(Secret|SecretKey|Token)$`)
+)
+
+type finding struct {
+	pos     token.Position
+	message string
+}
+
+type checker struct {
+	fset     *token.FileSet
+	findings []finding
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [dir | dir/...]...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	patterns := flag.Args()
+	if len(patterns) == 0 {
+		patterns = []string{"./..."}
+	}
+
+	dirs, err := expand(patterns)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	c := &checker{fset: token.NewFileSet()}
+	for _, dir := range dirs {
+		if err := c.checkDir(dir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	sort.Slice(c.findings, func(i, j int) bool {
+		a, b := c.findings[i].pos, c.findings[j].pos
+		if a.Filename != b.Filename {
+			return a.Filename < b.Filename
+		}
+		return a.Line < b.Line
+	})
+	for _, f := range c.findings {
+		fmt.Printf("%s: %s\n", f.pos, f.message)
+	}
+	if len(c.findings) > 0 {
+		os.Exit(1)
+	}
+}
+
+// expand turns the patterns into directories, walking those ending
+// in "/...".
+func expand(patterns []string) ([]string, error) {
+	var ret []string
+	for _, pattern := range patterns {
+		root, recursive := strings.CutSuffix(pattern, "/...")
+		if !recursive {
+			ret = append(ret, pattern)
+			continue
+		}
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() {
+				return nil
+			}
+			name := d.Name()
+			if path != root && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") || name == "testdata") {
+				return filepath.SkipDir
+			}
+			ret = append(ret, path)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (c *checker) checkDir(dir string) error {
+	pkgs, err := parser.ParseDir(c.fset, dir, nil, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+	for _, pkg := range pkgs {
+		c.checkPackage(pkg)
+	}
+	return nil
+}
+
+func (c *checker) checkPackage(pkg *ast.Package) {
+	// methods maps a type name to the names of its methods.
+	methods := map[string]map[string]bool{}
+	var structs []*ast.TypeSpec
+	for _, file := range pkg.Files {
+		ignored := ignoredLines(c.fset, file)
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncDecl:
+				if recv := receiverName(n); recv != "" {
+					if methods[recv] == nil {
+						methods[recv] = map[string]bool{}
+					}
+					methods[recv][n.Name.Name] = true
+				}
+			case *ast.TypeSpec:
+				if _, ok := n.Type.(*ast.StructType); ok {
+					structs = append(structs, n)
+				}
+			case *ast.BinaryExpr:
+				if n.Op == token.EQL || n.Op == token.NEQ {
+					c.checkComparison(ignored, n, n.X, n.Y)
+				}
+			case *ast.CallExpr:
+				if isBytesEqual(n) && len(n.Args) == 2 {
+					c.checkComparison(ignored, n, n.Args[0], n.Args[1])
+				}
+			}
+			return true
+		})
+	}
+
+	for _, spec := range structs {
+		field := heldField(spec.Type.(*ast.StructType))
+		if field == "" {
+			continue
+		}
+		m := methods[spec.Name.Name]
+		if !m["String"] || !m["GoString"] {
+			c.report(spec.Pos(), "%s holds secret %s but lacks String and GoString methods redacting it", spec.Name.Name, field)
+		}
+	}
+}
+
+func (c *checker) checkComparison(ignored map[int]bool, n ast.Node, x, y ast.Expr) {
+	if isHarmless(x) || isHarmless(y) {
+		return
+	}
+	name := secretName(x)
+	if name == "" {
+		name = secretName(y)
+	}
+	if name == "" {
+		return
+	}
+	if line := c.fset.Position(n.Pos()).Line; ignored[line] || ignored[line-1] {
+		return
+	}
+	c.report(n.Pos(), "%s compared in variable time; use crypto/subtle", name)
+}
+
+func (c *checker) report(pos token.Pos, format string, args ...any) {
+	c.findings = append(c.findings, finding{pos: c.fset.Position(pos), message: fmt.Sprintf(format, args...)})
+}
+
+// ignoredLines returns the lines holding an ignore directive.
+func ignoredLines(fset *token.FileSet, file *ast.File) map[int]bool {
+	ret := map[int]bool{}
+	for _, group := range file.Comments {
+		for _, comment := range group.List {
+			if strings.Contains(comment.Text, ignoreDirective) {
+				ret[fset.Position(comment.Slash).Line] = true
+			}
+		}
+	}
+	return ret
+}
+
+func receiverName(fn *ast.FuncDecl) string {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 {
+		return ""
+	}
+	typ := fn.Recv.List[0].Type
+	if star, ok := typ.(*ast.StarExpr); ok {
+		typ = star.X
+	}
+	if ident, ok := typ.(*ast.Ident); ok {
+		return ident.Name
+	}
+	return ""
+}
+
+func heldField(st *ast.StructType) string {
+	for _, field := range st.Fields.List {
+		for _, name := range field.Names {
+			if heldName.MatchString(name.Name) {
+				return name.Name
+			}
+		}
+	}
+	return ""
+}
+
+func isBytesEqual(call *ast.CallExpr) bool {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "Equal" {
+		return false
+	}
+	pkg, ok := sel.X.(*ast.Ident)
+	return ok && pkg.Name == "bytes"
+}
+
+// isHarmless returns true for operands which cannot leak a secret when
+// compared: literals, nil, and lengths.
+func isHarmless(e ast.Expr) bool {
+	switch e := e.(type) {
+	case *ast.BasicLit:
+		return true
+	case *ast.Ident:
+		return e.Name == "nil"
+	case *ast.CallExpr:
+		ident, ok := e.Fun.(*ast.Ident)
+		return ok && ident.Name == "len"
+	case *ast.ParenExpr:
+		return isHarmless(e.X)
+	}
+	return false
+}
+
+// secretName returns the name of the operand if it looks like a secret.
+func secretName(e ast.Expr) string {
+	var name string
+	switch e := e.(type) {
+	case *ast.Ident:
+		name = e.Name
+	case *ast.SelectorExpr:
+		name = e.Sel.Name
+	case *ast.ParenExpr:
+		return secretName(e.X)
+	case *ast.StarExpr:
+		return secretName(e.X)
+	}
+	if comparedName.MatchString(name) {
+		return name
+	}
+	return ""
+}
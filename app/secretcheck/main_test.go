@@ -0,0 +1,94 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"go/token"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestTree fails on anything secretcheck finds in the module.
+func TestTree(t *testing.T) {
+	dirs, err := expand([]string{filepath.Join("..", "..") + "/..."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &checker{fset: token.NewFileSet()}
+	for _, dir := range dirs {
+		if err := c.checkDir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range c.findings {
+		t.Errorf("%s: %s", f.pos, f.message)
+	}
+}
+
+// want matches the comments in testdata marking what secretcheck must
+// report on their lines.
+var want = regexp.MustCompile(`// want "([^"]*)"`)
+
+// TestFindings checks that secretcheck reports exactly what testdata
+// marks.
+func TestFindings(t *testing.T) {
+	dir := filepath.Join("testdata", "leaky")
+	c := &checker{fset: token.NewFileSet()}
+	if err := c.checkDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{}
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, line := range strings.Split(string(b), "\n") {
+			if m := want.FindStringSubmatch(line); m != nil {
+				expected[filepath.Base(file)+":"+strconv.Itoa(i+1)] = m[1]
+			}
+		}
+	}
+	if len(expected) == 0 {
+		t.Fatal("testdata marks nothing to find")
+	}
+
+	for _, f := range c.findings {
+		at := filepath.Base(f.pos.Filename) + ":" + strconv.Itoa(f.pos.Line)
+		message, ok := expected[at]
+		if !ok {
+			t.Errorf("%s: unexpected finding: %s", at, f.message)
+			continue
+		}
+		if message != f.message {
+			t.Errorf("%s: found %q, want %q", at, f.message, message)
+		}
+		delete(expected, at)
+	}
+	for at, message := range expected {
+		t.Errorf("%s: not found: %s", at, message)
+	}
+}
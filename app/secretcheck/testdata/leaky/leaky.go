@@ -0,0 +1,63 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package leaky holds what secretcheck must find, each on a line
+// marked with what it reports, and what it must not.
+package leaky
+
+import "bytes"
+
+type Credentials struct { // want "Credentials holds secret ClientSecret but lacks String and GoString methods redacting it"
+	ID           string
+	ClientSecret []byte
+}
+
+type Session struct { // want "Session holds secret AccessToken but lacks String and GoString methods redacting it"
+	AccessToken string
+}
+
+func (s Session) String() string { return "session" }
+
+type Redacted struct {
+	SigningSecretKey []byte
+}
+
+func (r Redacted) String() string   { return "redacted" }
+func (r Redacted) GoString() string { return "redacted" }
+
+type Challenge struct {
+	Nonce string
+}
+
+func compare(c *Credentials, s *Session, r *Redacted, x, y *Challenge, other []byte, token string) bool {
+	if string(c.ClientSecret) == "" {
+		return false
+	}
+	if len(s.AccessToken) == 0 || r.SigningSecretKey == nil {
+		return false
+	}
+	if x.Nonce == y.Nonce { // want "Nonce compared in variable time; use crypto/subtle"
+		return true
+	}
+	if s.AccessToken != token { // want "AccessToken compared in variable time; use crypto/subtle"
+		return false
+	}
+	if bytes.Equal(other, c.ClientSecret) { // want "ClientSecret compared in variable time; use crypto/subtle"
+		return true
+	}
+	// secretcheck:ignore: IDs are public
+	return c.ID == token
+}
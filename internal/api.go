@@ -17,26 +17,91 @@
 package internal
 
 import (
-	"encoding/base64"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"math/big"
 	"time"
 
 	"github.com/shirou/gopsutil/host"
+	"github.com/skandragon/collatz/internal/intervals"
 	"github.com/tklauser/numcpus"
-	"github.com/zeebo/blake3"
 )
 
 type cpuinfo struct {
 	Count int `json:"count,omitempty"`
+
+	// Usable is the number of CPUs our affinity mask allows, and
+	// Cores the physical cores they are on.  Quota is the CPUs our
+	// cgroup's quota allows.  Each is zero if unknown or unlimited.
+	Usable int     `json:"usable,omitempty"`
+	Cores  int     `json:"cores,omitempty"`
+	Quota  float64 `json:"quota,omitempty"`
+}
+
+// DefaultWorkers returns the number of workers to run: one per
+// physical core we may use, as SMT siblings only contend for the same
+// core, and no more than the cgroup's quota, rounded up.
+func (c cpuinfo) DefaultWorkers() int {
+	n := c.Count
+	if c.Usable > 0 && c.Usable < n {
+		n = c.Usable
+	}
+	if c.Cores > 0 && c.Cores < n {
+		n = c.Cores
+	}
+	if quota := int(math.Ceil(c.Quota)); quota > 0 && quota < n {
+		n = quota
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
 }
 
 // NodeInfo holds some somewhat arbitrary info about a worker node.
 type NodeInfo struct {
+	// NodeID is a stable identifier for this node, generated once
+	// and persisted by the client.  It is distinct from the UserID,
+	// as one user may run many nodes.
+	NodeID string `json:"nodeID,omitempty"`
+
 	HostInfo host.InfoStat `json:"hostInfo,omitempty"`
 	CPUInfo  cpuinfo       `json:"cpuInfo,omitempty"`
 	Workers  int           `json:"workers,omitempty"`
+
+	// Tuning, if set, is what the client chose by timing its engines
+	// at startup.
+	Tuning *Tuning `json:"tuning,omitempty"`
+}
+
+// Tuning records the engines a client picked by calibration, and the
+// rates it measured to pick them.
+type Tuning struct {
+	// Engine is used for packets the u256 engine can run, and
+	// WideEngine for larger ones.
+	Engine     string `json:"engine,omitempty"`
+	WideEngine string `json:"wideEngine,omitempty"`
+
+	// JumpBits is the size of the jump engine's table.
+	JumpBits int `json:"jumpBits,omitempty"`
+
+	Rates []EngineRate `json:"rates,omitempty"`
+}
+
+// String shows the tuning, rather than its address, where NodeInfo is
+// logged.
+func (t *Tuning) String() string {
+	return fmt.Sprintf("%+v", *t)
+}
+
+// EngineRate is the candidates per second an engine tested during
+// calibration, on packets which fit the u256 engine or on wider ones.
+type EngineRate struct {
+	Engine   string  `json:"engine"`
+	JumpBits int     `json:"jumpBits,omitempty"`
+	Wide     bool    `json:"wide,omitempty"`
+	Rate     float64 `json:"rate"`
 }
 
 // WorkPacket is a message from the server to incidate a work
@@ -63,6 +128,20 @@ type WorkPacket struct {
 	// completed after this time, if the evidence is accepted,
 	// work will still be considered complete.
 	Expiry time.Time `json:"expiry,omitempty"`
+
+	// Challenges, if set, are spot checks the client answers in its
+	// "completed" report.
+	Challenges []Challenge `json:"challenges,omitempty"`
+
+	// Filter, if set, names the candidates the client leaves out, one
+	// of Filters.  The server only sets it for clients which claimed
+	// to know it.
+	Filter string `json:"filter,omitempty"`
+
+	// Signature, if the server signs packets, is its Ed25519
+	// signature on the ID, nonce, range, expiry, challenges, and
+	// filter, in base64.
+	Signature string `json:"signature,omitempty"`
 }
 
 // UserCredentials hold the userid, secret, and secret version we will use
@@ -74,8 +153,36 @@ type UserCredentials struct {
 	UserID            string `json:"userID,omitempty"`
 	UserSecretVersion string `json:"userSecretVersion,omitempty"`
 	UserSecret        string `json:"userSecret,omitempty"`
+
+	// SecretKey, if set, is the key derived from UserSecret by
+	// auth.SecretKey.  It is all a server storing hashed secrets has.
+	SecretKey []byte `json:"-"`
 }
 
+// Redacted stands in for a secret in anything formatted for a log.
+const Redacted = "[REDACTED]"
+
+// plainCredentials has none of UserCredentials' methods, so it formats
+// field by field.
+type plainCredentials UserCredentials
+
+func (c UserCredentials) redacted() plainCredentials {
+	ret := plainCredentials(c)
+	if ret.UserSecret != "" {
+		ret.UserSecret = Redacted
+	}
+	ret.SecretKey = nil
+	return ret
+}
+
+// String, GoString, and LogValue keep the secret out of logs, even
+// from a %#v dump of something holding the credentials.
+func (c UserCredentials) String() string { return fmt.Sprintf("%+v", c.redacted()) }
+
+func (c UserCredentials) GoString() string { return fmt.Sprintf("%#v", c.redacted()) }
+
+func (c UserCredentials) LogValue() slog.Value { return slog.AnyValue(c.redacted()) }
+
 // WorkAuthenticator is a signature on the work we performed.
 type WorkAuthenticator struct {
 	AuthenticatorVersion string `json:"authenticatorVersion,omitempty"`
@@ -88,6 +195,10 @@ type WorkAuthenticator struct {
 type WorkEvidence struct {
 	TotalIterations uint64 `json:"totalIterations,omitempty"`
 	MaxIterations   uint64 `json:"maxIterations,omitempty"`
+
+	// Filter is the packet's filter, which the iterations exclude
+	// candidates by.
+	Filter string `json:"filter,omitempty"`
 }
 
 // WorkProgressReport is a message sent to indicate
@@ -109,37 +220,538 @@ type WorkProgressReport struct {
 	//   running = currently running on a worker.
 	//   abandoned = we no longer wish to work on this.
 	//   completed = we have completed the work requested.
+	//   rejected = the packet failed validation, and was not run.
 	// While statuses other than "completed" can be sent and will
 	// update the user's view of work they have in progress,
 	// only "completed" is required to be sent.  Work without
 	// any other update will be marked as "pending" in the UI.
 	Status string `json:"status,omitempty"`
 
+	// Message optionally explains the status, such as why a
+	// packet was rejected.
+	Message string `json:"message,omitempty"`
+
 	// StartedOn is the UTC timestamp of when we began working on this specific work packet.
 	StartedOn time.Time `json:"startedOn,omitempty"`
 
 	// CompletedOn is when we completed the work.
 	CompletedOn time.Time `json:"completedOn,omitempty"`
 
+	// Position and EstimatedCompletion are optional parts of a
+	// "running" report: the next candidate the worker will test, and
+	// when, in server time, it expects to complete the packet.
+	Position            *big.Int  `json:"position,omitempty"`
+	EstimatedCompletion time.Time `json:"estimatedCompletion,omitempty"`
+
 	Evidence      WorkEvidence      `json:"evidence,omitempty"`
 	Authenticator WorkAuthenticator `json:"authenticator,omitempty"`
+
+	// Histogram is an optional attachment to a "completed" report.
+	// Histogram[i] is the number of candidates which took i iterations
+	// to drop below their starting value.
+	Histogram []uint64 `json:"histogram,omitempty"`
+
+	// MaxIterationsValue is the first candidate which took
+	// Evidence.MaxIterations iterations.
+	MaxIterationsValue *big.Int `json:"maxIterationsValue,omitempty"`
+
+	// Interesting lists any candidates which looped back to their
+	// starting value.  We do not expect to ever see one.
+	Interesting []*big.Int `json:"interesting,omitempty"`
+
+	// Skipped lists any candidates the client's watchdog gave up on,
+	// which are not counted in the evidence, and need manual review.
+	Skipped []*big.Int `json:"skipped,omitempty"`
+
+	// ChallengeResponses answer the packet's challenges.
+	ChallengeResponses []ChallengeResponse `json:"challengeResponses,omitempty"`
+
+	// Attestation describes the client build which did the work, and
+	// is sent with "completed" reports.
+	Attestation *Attestation `json:"attestation,omitempty"`
 }
 
-// envidenceHash returns a base64 encoded hash for the evidence provided.
-func evidenceHash(user UserCredentials, work WorkPacket, evidence WorkEvidence) WorkAuthenticator {
-	h := blake3.New()
-	s := fmt.Sprintf("%s:%s:%s:%s:%s:%s:%s:%d:%d",
-		work.ID, work.Nonce, work.StartingValue, work.EndingValue,
-		user.UserID, user.UserSecretVersion, user.UserSecret,
-		evidence.TotalIterations, evidence.MaxIterations)
-	h.Write([]byte(s))
-	sum := h.Sum(nil)
-	authenticator := base64.StdEncoding.EncodeToString(sum)
-	return WorkAuthenticator{
-		UserSecretVersion:    user.UserSecretVersion,
-		AuthenticatorVersion: "v1-blake3",
-		Authenticator:        authenticator,
+// Attestation is a client's account of the build which produced a
+// result, so results from a build later found to be faulty can be
+// found and redone.  It is not authenticated; a client may claim
+// whatever it likes.
+type Attestation struct {
+	// Version is the client's version, as recorded in its binary.
+	Version string `json:"version,omitempty"`
+
+	// Engine names the implementation which tested the candidates.
+	Engine string `json:"engine,omitempty"`
+
+	// Convention names what the engine counts as an iteration.
+	Convention string `json:"convention,omitempty"`
+
+	// Conformance is a hash of the engine's results on a fixed set of
+	// candidates, run when the client starts.  Builds which agree on
+	// the arithmetic agree on it.
+	Conformance string `json:"conformance,omitempty"`
+}
+
+// ClaimRequest is sent by a client to ask the server for more work.
+type ClaimRequest struct {
+	// NodeInfo describes the node which will perform the work.
+	NodeInfo NodeInfo `json:"nodeInfo,omitempty"`
+
+	// Count is the number of work packets requested.  The server
+	// may return fewer.
+	Count int `json:"count,omitempty"`
+
+	// Filters lists the filters the client can apply.
+	Filters []string `json:"filters,omitempty"`
+}
+
+// ClaimResponse is returned by the server in response to a ClaimRequest.
+type ClaimResponse struct {
+	Work []WorkPacket `json:"work,omitempty"`
+
+	// MaxOutstanding is the number of packets this user may hold at
+	// once, including those just assigned.  Clients should not claim
+	// more work once they hold this many packets.  Zero means no limit.
+	MaxOutstanding int `json:"maxOutstanding,omitempty"`
+
+	// Authenticators lists the authenticator versions the server
+	// accepts, most preferred first.  Servers which predate it
+	// accept only v1.
+	Authenticators []string `json:"authenticators,omitempty"`
+}
+
+// ReportResponse is returned by the server in response to a WorkProgressReport.
+type ReportResponse struct {
+	Accepted bool   `json:"accepted,omitempty"`
+	Message  string `json:"message,omitempty"`
+
+	// Receipt is set when a "completed" report was accepted and the
+	// work credited.
+	Receipt *Receipt `json:"receipt,omitempty"`
+
+	// Trajectories asks the client to send the trajectories of
+	// findings in the report.
+	Trajectories []TrajectoryRequest `json:"trajectories,omitempty"`
+}
+
+// Receipt is the server's acknowledgement that a user completed, and
+// was credited for, a specific block of work.
+type Receipt struct {
+	PacketID      string       `json:"packetID,omitempty"`
+	UserID        string       `json:"userID,omitempty"`
+	NodeID        string       `json:"nodeID,omitempty"`
+	StartingValue *big.Int     `json:"startingValue,omitempty"`
+	EndingValue   *big.Int     `json:"endingValue,omitempty"`
+	Evidence      WorkEvidence `json:"evidence,omitempty"`
+	AcceptedOn    time.Time    `json:"acceptedOn,omitempty"`
+}
+
+// Token scopes.
+const (
+	// ScopeWork allows claiming work and sending reports.
+	ScopeWork = "work"
+
+	// ScopeRead allows reading receipts, progress, rates, and exports.
+	ScopeRead = "read"
+)
+
+// LoginRequest asks the server for a bearer token, authenticating with
+// the user's secret.  Further requests use the token instead, so the
+// secret is sent only to log in.
+type LoginRequest struct {
+	// Scopes limits what the token allows.  The default is every scope.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// LoginResponse is returned by the server in response to a LoginRequest.
+type LoginResponse struct {
+	Token     string    `json:"token,omitempty"`
+	Scopes    []string  `json:"scopes,omitempty"`
+	ExpiresOn time.Time `json:"expiresOn,omitempty"`
+}
+
+type plainLoginResponse LoginResponse
+
+func (r LoginResponse) redacted() plainLoginResponse {
+	ret := plainLoginResponse(r)
+	if ret.Token != "" {
+		ret.Token = Redacted
 	}
+	return ret
+}
+
+// String, GoString, and LogValue keep the token out of logs.
+func (r LoginResponse) String() string { return fmt.Sprintf("%+v", r.redacted()) }
+
+func (r LoginResponse) GoString() string { return fmt.Sprintf("%#v", r.redacted()) }
+
+func (r LoginResponse) LogValue() slog.Value { return slog.AnyValue(r.redacted()) }
+
+// EnrollRequest exchanges a one-time enrollment code for the
+// credentials of the user it was issued for.
+type EnrollRequest struct {
+	Code   string `json:"code"`
+	NodeID string `json:"nodeID,omitempty"`
+}
+
+type plainEnrollRequest EnrollRequest
+
+func (r EnrollRequest) redacted() plainEnrollRequest {
+	ret := plainEnrollRequest(r)
+	if ret.Code != "" {
+		ret.Code = Redacted
+	}
+	return ret
+}
+
+// String, GoString, and LogValue keep the code out of logs.
+func (r EnrollRequest) String() string { return fmt.Sprintf("%+v", r.redacted()) }
+
+func (r EnrollRequest) GoString() string { return fmt.Sprintf("%#v", r.redacted()) }
+
+func (r EnrollRequest) LogValue() slog.Value { return slog.AnyValue(r.redacted()) }
+
+// EnrollResponse is returned by the server in response to an
+// EnrollRequest.
+type EnrollResponse struct {
+	UserID            string `json:"userID"`
+	UserSecretVersion string `json:"userSecretVersion"`
+	UserSecret        string `json:"userSecret"`
+}
+
+type plainEnrollResponse EnrollResponse
+
+func (r EnrollResponse) redacted() plainEnrollResponse {
+	ret := plainEnrollResponse(r)
+	if ret.UserSecret != "" {
+		ret.UserSecret = Redacted
+	}
+	return ret
+}
+
+// String, GoString, and LogValue keep the secret out of logs.
+func (r EnrollResponse) String() string { return fmt.Sprintf("%+v", r.redacted()) }
+
+func (r EnrollResponse) GoString() string { return fmt.Sprintf("%#v", r.redacted()) }
+
+func (r EnrollResponse) LogValue() slog.Value { return slog.AnyValue(r.redacted()) }
+
+// ReceiptsResponse lists the receipts held by the server for a user.
+type ReceiptsResponse struct {
+	Receipts []Receipt `json:"receipts,omitempty"`
+}
+
+// ProgressResponse describes how much of the search space is done.
+type ProgressResponse struct {
+	// Frontier is the next value the server will assign.
+	Frontier *big.Int `json:"frontier,omitempty"`
+
+	// CompletedThrough is the first value, at or after the server's
+	// starting value, not yet covered by completed work.
+	CompletedThrough *big.Int `json:"completedThrough,omitempty"`
+
+	// Completed holds all completed work as merged, half-open intervals.
+	Completed []intervals.Interval `json:"completed,omitempty"`
+}
+
+// RatePoint is the work completed in one step of a RatesResponse.
+type RatePoint struct {
+	Start      time.Time `json:"start"`
+	Integers   int64     `json:"integers"`
+	Iterations int64     `json:"iterations"`
+	Packets    int64     `json:"packets"`
+
+	// Rate is integers (not candidates) checked per second.
+	Rate float64 `json:"rate"`
+}
+
+// RatesResponse is the throughput history of a user, or of everyone.
+type RatesResponse struct {
+	Step   time.Duration `json:"step"`
+	Points []RatePoint   `json:"points"`
+}
+
+// CrashReport describes a panic in a client worker, so it can be
+// diagnosed after the fact.
+type CrashReport struct {
+	Time     time.Time `json:"time"`
+	NodeID   string    `json:"nodeID,omitempty"`
+	WorkerID int       `json:"workerID"`
+	PacketID string    `json:"packetID,omitempty"`
+
+	// Value is the candidate being tested when the panic occurred, if
+	// known, and Engine the implementation testing it.
+	Value  *big.Int `json:"value,omitempty"`
+	Engine string   `json:"engine,omitempty"`
+
+	Panic string `json:"panic"`
+	Stack string `json:"stack"`
+}
+
+// CrashReportResponse is returned by the server in response to a
+// CrashReport.
+type CrashReportResponse struct {
+	Accepted bool `json:"accepted,omitempty"`
+}
+
+// Event kinds.
+const (
+	// EventLoop is a candidate which looped back to itself.
+	EventLoop = "loop"
+
+	// EventRecord is a candidate taking more iterations than any
+	// before it.  On a client, it is a record for the node.
+	EventRecord = "record"
+
+	// EventAuditFailure is a report which failed verification, or
+	// conflicted with the report already accepted for its packet, or
+	// a packet whose signature a client could not verify.
+	EventAuditFailure = "auditFailure"
+
+	// EventStall is a candidate a worker was stuck on.  If the
+	// watchdog skipped it, it needs manual review.
+	EventStall = "stall"
+
+	// EventLockout is a user or address locked out after repeated
+	// authentication failures.
+	EventLockout = "lockout"
+
+	// EventEnrolled is a node given its user's credentials in exchange
+	// for an enrollment code.
+	EventEnrolled = "enrolled"
+)
+
+// Event is an entry in an event log: an append-only record of notable
+// events, kept apart from the general log.
+type Event struct {
+	// Seq numbers the events in a log, from 1.
+	Seq  int64     `json:"seq"`
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+
+	UserID   string `json:"userID,omitempty"`
+	NodeID   string `json:"nodeID,omitempty"`
+	PacketID string `json:"packetID,omitempty"`
+
+	Value      *big.Int `json:"value,omitempty"`
+	Iterations uint64   `json:"iterations,omitempty"`
+	Message    string   `json:"message,omitempty"`
+}
+
+// EventsResponse is returned by the server's event log API.
+type EventsResponse struct {
+	Events []Event `json:"events"`
+}
+
+// GCCounts counts what server garbage collection removed.
+type GCCounts struct {
+	ExpiredPackets   int64 `json:"expiredPackets"`
+	CompletedPackets int64 `json:"completedPackets"`
+	Reports          int64 `json:"reports"`
+	Nodes            int64 `json:"nodes"`
+	RateSamples      int64 `json:"rateSamples"`
+}
+
+// Add adds o to the counts.
+func (c *GCCounts) Add(o GCCounts) {
+	c.ExpiredPackets += o.ExpiredPackets
+	c.CompletedPackets += o.CompletedPackets
+	c.Reports += o.Reports
+	c.Nodes += o.Nodes
+	c.RateSamples += o.RateSamples
+}
+
+// GCSweep describes one garbage collection pass.
+type GCSweep struct {
+	GCCounts
+	StartedOn time.Time     `json:"startedOn"`
+	Duration  time.Duration `json:"duration"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// Lockout describes the recent authentication failures of a user or
+// client address.
+type Lockout struct {
+	// Kind is "user" or "address".  A user is locked out only at an
+	// address, so their ID is "<user>@<address>".
+	Kind     string `json:"kind"`
+	ID       string `json:"id"`
+	Failures int    `json:"failures"`
+
+	// Lockouts counts the lockouts in a row; each lasts twice as long
+	// as the last.
+	Lockouts int `json:"lockouts,omitempty"`
+
+	// LockedUntil is set while locked out.
+	LockedUntil time.Time `json:"lockedUntil,omitempty"`
+}
+
+// UserTrust is a user's audit history, and the trust score the server
+// computes from it.
+type UserTrust struct {
+	UserID        string    `json:"userID"`
+	Confirmed     int64     `json:"confirmed"`
+	Disputed      int64     `json:"disputed"`
+	AuditFailures int64     `json:"auditFailures"`
+	Score         int64     `json:"score"`
+	Trusted       bool      `json:"trusted"`
+	UpdatedOn     time.Time `json:"updatedOn"`
+}
+
+// TrustResponse is returned by the server's trust admin API.
+type TrustResponse struct {
+	Users []UserTrust `json:"users"`
+}
+
+// QuarantinedReport is an accepted report from a quarantined build.
+type QuarantinedReport struct {
+	PacketID      string       `json:"packetID"`
+	UserID        string       `json:"userID"`
+	NodeID        string       `json:"nodeID"`
+	StartingValue *big.Int     `json:"startingValue"`
+	EndingValue   *big.Int     `json:"endingValue"`
+	ReceivedOn    time.Time    `json:"receivedOn"`
+	Attestation   *Attestation `json:"attestation"`
+
+	// Filter is the residue filter the packet was issued with, which
+	// its double check uses too.
+	Filter string `json:"filter,omitempty"`
+
+	// Reason is why the build is quarantined.
+	Reason string `json:"reason,omitempty"`
+
+	// CheckID, if set, is the double check queued to redo the packet.
+	CheckID string `json:"checkID,omitempty"`
+}
+
+// QuarantineResponse is returned by the server's quarantine admin API.
+type QuarantineResponse struct {
+	Reports []QuarantinedReport `json:"reports"`
+}
+
+// EnrollmentRequest asks the server's enrollment admin API for a
+// one-time code enrolling a node as a user.
+type EnrollmentRequest struct {
+	UserID string `json:"userID"`
+
+	// Lifetime is how long the code is valid, by default as
+	// configured on the server.
+	Lifetime time.Duration `json:"lifetime,omitempty"`
+}
+
+// Enrollment describes an enrollment code, but not the code itself,
+// which is shown only when issued.
+type Enrollment struct {
+	// Code is set only in the response issuing it.
+	Code string `json:"code,omitempty"`
+
+	UserID     string    `json:"userID"`
+	IssuedOn   time.Time `json:"issuedOn"`
+	ExpiresOn  time.Time `json:"expiresOn"`
+	RedeemedOn time.Time `json:"redeemedOn,omitempty"`
+	RedeemedBy string    `json:"redeemedBy,omitempty"`
+}
+
+// EnrollmentsResponse is returned by the server's enrollment admin API.
+type EnrollmentsResponse struct {
+	Enrollments []Enrollment `json:"enrollments"`
+}
+
+// LockoutsResponse is returned by the server's lockouts admin API.
+type LockoutsResponse struct {
+	Lockouts []Lockout `json:"lockouts"`
+}
+
+// GCStatus is returned by the server's garbage collection admin API.
+type GCStatus struct {
+	Sweeps int      `json:"sweeps"`
+	Last   *GCSweep `json:"last,omitempty"`
+	Total  GCCounts `json:"total"`
+}
+
+// LatencyBucket counts operations which took at most LE, and longer
+// than the bucket before.  The last bucket has no LE.
+type LatencyBucket struct {
+	LE    time.Duration `json:"le,omitempty"`
+	Count int64         `json:"count"`
+}
+
+// StoreOperation describes the calls to one store operation.
+type StoreOperation struct {
+	Name    string          `json:"name"`
+	Calls   int64           `json:"calls"`
+	Errors  int64           `json:"errors"`
+	Total   time.Duration   `json:"total"`
+	Max     time.Duration   `json:"max"`
+	Buckets []LatencyBucket `json:"buckets"`
+}
+
+// StoreMetrics is returned by the server's store metrics admin API.
+type StoreMetrics struct {
+	Operations []StoreOperation `json:"operations"`
+}
+
+// ServerTimeHeader is set by the server on every response, and holds the
+// server's idea of the current time in RFC 3339 format with nanoseconds.
+// Clients use it to detect local clock skew.
+const ServerTimeHeader = "X-Server-Time"
+
+// PacketLimits bound what a client considers a sane work packet.
+type PacketLimits struct {
+	// MaxBitLength is the largest bit length of any value in a packet.
+	MaxBitLength int
+
+	// MaxBlockSize is the largest number of integers in a packet.
+	MaxBlockSize int64
+}
+
+// DefaultPacketLimits are generous bounds for the current campaign.
+var DefaultPacketLimits = PacketLimits{
+	MaxBitLength: 128,
+	MaxBlockSize: 1 << 40,
+}
+
+// Validate checks that a work packet received from the server is
+// well formed, and within the limits provided.
+func (w WorkPacket) Validate(limits PacketLimits) error {
+	if w.ID == "" {
+		return fmt.Errorf("packet has no ID")
+	}
+	if w.Nonce == "" {
+		return fmt.Errorf("packet %s has no nonce", w.ID)
+	}
+	if w.StartingValue == nil || w.EndingValue == nil {
+		return fmt.Errorf("packet %s is missing its range", w.ID)
+	}
+	if w.StartingValue.Sign() <= 0 {
+		return fmt.Errorf("packet %s starts at non-positive value %s", w.ID, w.StartingValue)
+	}
+	if w.StartingValue.Bit(0) == 0 {
+		// every candidate is odd, and they are counted from the start
+		return fmt.Errorf("packet %s starts at even value %s", w.ID, w.StartingValue)
+	}
+	if w.StartingValue.Cmp(w.EndingValue) >= 0 {
+		return fmt.Errorf("packet %s starting value %s is not less than ending value %s",
+			w.ID, w.StartingValue, w.EndingValue)
+	}
+	if w.EndingValue.BitLen() > limits.MaxBitLength {
+		return fmt.Errorf("packet %s ending value has %d bits, limit is %d",
+			w.ID, w.EndingValue.BitLen(), limits.MaxBitLength)
+	}
+	size := new(big.Int).Sub(w.EndingValue, w.StartingValue)
+	if !size.IsInt64() || size.Int64() >= limits.MaxBlockSize {
+		return fmt.Errorf("packet %s covers %s integers, limit is %d", w.ID, size, limits.MaxBlockSize)
+	}
+	if err := CheckFilter(w.Filter); err != nil {
+		return fmt.Errorf("packet %s: %v", w.ID, err)
+	}
+	return nil
+}
+
+// ExpiredAt returns true if the work packet has an expiry set, and
+// the time provided is after it.  The time should be the server's
+// idea of the current time, not the local clock.
+func (w WorkPacket) ExpiredAt(t time.Time) bool {
+	return !w.Expiry.IsZero() && t.After(w.Expiry)
 }
 
 // CPUInfo returns the data about this specific node, to be used in reports as-is.
@@ -148,12 +760,17 @@ func CPUInfo() (*NodeInfo, error) {
 	if err != nil {
 		return nil, fmt.Errorf("numcpus.GetOnline(): %v", err)
 	}
-	log.Printf("Found %d online CPUs", online)
+	info := cpuinfo{Count: online, Quota: cpuQuota()}
+	if cpus, err := usableCPUs(); err == nil && len(cpus) > 0 {
+		info.Usable = len(cpus)
+		info.Cores = physicalCores(cpus)
+	}
+	slog.Info("found online CPUs", "count", online, "usable", info.Usable, "cores", info.Cores, "quota", info.Quota)
 
 	hostInfo, err := host.Info()
 	if err != nil {
 		return nil, fmt.Errorf("host.Info(): %v", err)
 	}
 
-	return &NodeInfo{HostInfo: *hostInfo, CPUInfo: cpuinfo{Count: online}, Workers: -1}, nil
+	return &NodeInfo{HostInfo: *hostInfo, CPUInfo: info, Workers: -1}, nil
 }
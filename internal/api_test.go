@@ -0,0 +1,55 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestWorkPacketValidate(t *testing.T) {
+	limits := PacketLimits{MaxBitLength: 64, MaxBlockSize: 1000}
+	packet := func(start, end int64) WorkPacket {
+		return WorkPacket{ID: "p1", Nonce: "n1", StartingValue: big.NewInt(start), EndingValue: big.NewInt(end)}
+	}
+	tests := []struct {
+		name    string
+		work    WorkPacket
+		wantErr bool
+	}{
+		{"valid", packet(101, 199), false},
+		{"filtered", WorkPacket{ID: "p1", Nonce: "n1", StartingValue: big.NewInt(101), EndingValue: big.NewInt(199), Filter: FilterMod3}, false},
+		{"no ID", WorkPacket{Nonce: "n1", StartingValue: big.NewInt(101), EndingValue: big.NewInt(199)}, true},
+		{"no nonce", WorkPacket{ID: "p1", StartingValue: big.NewInt(101), EndingValue: big.NewInt(199)}, true},
+		{"no range", WorkPacket{ID: "p1", Nonce: "n1"}, true},
+		{"zero start", packet(0, 199), true},
+		{"even start", packet(100, 199), true},
+		{"empty", packet(101, 101), true},
+		{"backwards", packet(199, 101), true},
+		{"too large", packet(101, 1101), true},
+		{"too wide", WorkPacket{ID: "p1", Nonce: "n1", StartingValue: big.NewInt(101), EndingValue: new(big.Int).Lsh(big.NewInt(1), 64)}, true},
+		{"unknown filter", WorkPacket{ID: "p1", Nonce: "n1", StartingValue: big.NewInt(101), EndingValue: big.NewInt(199), Filter: "mod5"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.work.Validate(limits)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package archive writes batches of records to long-term storage, as
+// gzip-compressed JSON lines, so they can be dropped from the database.
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Destination stores archive objects.
+type Destination interface {
+	// Put stores body under key, replacing any existing object.
+	Put(ctx context.Context, key string, body []byte) error
+}
+
+// EncodeJSONL returns the items as gzip-compressed JSON lines.
+func EncodeJSONL[T any](items []T) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, item := range items {
+		if err := enc.Encode(item); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Dir is a Destination which writes objects as files under a directory,
+// for deployments without object storage, and for testing.
+type Dir string
+
+// Put writes the object to a temporary file and renames it into place,
+// so a partially written object is never visible under its key.
+func (d Dir) Put(ctx context.Context, key string, body []byte) error {
+	filename := filepath.Join(string(d), filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, body, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package auth generates and verifies the authenticators which prove
+// a user performed the work they report, in every version we have
+// shipped, and decides which versions a server accepts.
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/zeebo/blake3"
+)
+
+// Authenticator versions.
+const (
+	// V1 hashes the fields, secret included, joined by colons.  It is
+	// kept for clients and servers which predate v2.
+	V1 = "v1-blake3"
+
+	// V2 is a BLAKE3 MAC, keyed by the user secret, over the canonical
+	// encoding of the fields from CanonicalEvidence.
+	V2 = "v2-blake3-keyed"
+
+	// V3 is V2 keyed by SecretKey instead, so a server which stores
+	// only hashed secrets can verify it.
+	V3 = "v3-argon2id-blake3-keyed"
+)
+
+// Versions lists every version we can generate and verify, most
+// preferred first.
+var Versions = []string{V3, V2, V1}
+
+func known(version string) bool {
+	for _, v := range Versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsSecret returns true if a version cannot be generated or verified
+// without the plaintext secret.
+func NeedsSecret(version string) bool {
+	return version != V3
+}
+
+// Usable returns the versions which can be verified with the
+// credentials given.
+func Usable(versions []string, user internal.UserCredentials) []string {
+	ret := []string{}
+	for _, v := range versions {
+		if user.UserSecret != "" || !NeedsSecret(v) {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// Generate returns the authenticator of the given version for the
+// evidence provided.  All versions but v3 need the plaintext secret;
+// v3 uses the credentials' SecretKey, or derives it if it is not set.
+func Generate(version string, user internal.UserCredentials, work internal.WorkPacket, evidence internal.WorkEvidence) (internal.WorkAuthenticator, error) {
+	if user.UserSecret == "" && NeedsSecret(version) {
+		return internal.WorkAuthenticator{}, fmt.Errorf("authenticator version %q needs the plaintext secret", version)
+	}
+	var sum []byte
+	switch version {
+	case V1:
+		h := blake3.New()
+		fmt.Fprintf(h, "%s:%s:%s:%s:%s:%s:%s:%d:%d",
+			work.ID, work.Nonce, work.StartingValue, work.EndingValue,
+			user.UserID, user.UserSecretVersion, user.UserSecret,
+			evidence.TotalIterations, evidence.MaxIterations)
+		sum = h.Sum(nil)
+	case V2:
+		h, err := blake3.NewKeyed(key(user.UserSecret))
+		if err != nil {
+			return internal.WorkAuthenticator{}, err
+		}
+		h.Write(CanonicalEvidence(user, work, evidence))
+		sum = h.Sum(nil)
+	case V3:
+		key := user.SecretKey
+		if key == nil {
+			key = SecretKey(user)
+		}
+		h, err := blake3.NewKeyed(key)
+		if err != nil {
+			return internal.WorkAuthenticator{}, err
+		}
+		h.Write(CanonicalEvidence(user, work, evidence))
+		sum = h.Sum(nil)
+	default:
+		return internal.WorkAuthenticator{}, fmt.Errorf("unknown authenticator version %q", version)
+	}
+	return internal.WorkAuthenticator{
+		UserSecretVersion:    user.UserSecretVersion,
+		AuthenticatorVersion: version,
+		Authenticator:        base64.StdEncoding.EncodeToString(sum),
+	}, nil
+}
+
+// keyContext is the BLAKE3 key derivation context for v2 keys.  It
+// must never change.
+const keyContext = "github.com/skandragon/collatz 2024-01 evidence authenticator v2"
+
+// key derives the v2 MAC key from a user secret.
+func key(secret string) []byte {
+	k := make([]byte, 32)
+	blake3.DeriveKey(keyContext, []byte(secret), k)
+	return k
+}
+
+// Verify returns true if a is a correct authenticator, of whichever
+// version it claims to be, for the evidence provided.  An authenticator
+// with no version is taken to be v1, as the earliest clients did not
+// always send it.
+func Verify(user internal.UserCredentials, work internal.WorkPacket, evidence internal.WorkEvidence, a internal.WorkAuthenticator) bool {
+	expected, err := Generate(Version(a), user, work, evidence)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected.Authenticator), []byte(a.Authenticator)) == 1
+}
+
+// Version returns the version of an authenticator.
+func Version(a internal.WorkAuthenticator) string {
+	if a.AuthenticatorVersion == "" {
+		return V1
+	}
+	return a.AuthenticatorVersion
+}
+
+// Negotiate returns the version a client should use, given the
+// versions a server advertised.  A server which advertised none
+// predates negotiation, and accepts only v1.
+func Negotiate(advertised []string) string {
+	if len(advertised) == 0 {
+		return V1
+	}
+	for _, theirs := range advertised {
+		if known(theirs) {
+			return theirs
+		}
+	}
+	// nothing in common; v1 at least gets a clear rejection
+	return V1
+}
+
+// Policy is a server's choice of the versions it accepts.
+type Policy struct {
+	// Sunset maps a version to the time after which it is no longer
+	// accepted.  Versions not listed are accepted indefinitely.
+	Sunset map[string]time.Time `yaml:"sunset,omitempty"`
+}
+
+// Validate checks that the policy names only known versions, and
+// leaves at least one accepted.
+func (p Policy) Validate() error {
+	for v := range p.Sunset {
+		if !known(v) {
+			return fmt.Errorf("authenticators.sunset: unknown version %q", v)
+		}
+	}
+	if len(p.Sunset) == len(Versions) {
+		return fmt.Errorf("authenticators.sunset: every version has a sunset date")
+	}
+	return nil
+}
+
+// Supported returns the versions accepted at now, most preferred first.
+func (p Policy) Supported(now time.Time) []string {
+	ret := []string{}
+	for _, v := range Versions {
+		if p.Check(v, now) == nil {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// Check returns an error if version is not accepted at now.
+func (p Policy) Check(version string, now time.Time) error {
+	if !known(version) {
+		return fmt.Errorf("unknown authenticator version %q", version)
+	}
+	if sunset, ok := p.Sunset[version]; ok && !now.Before(sunset) {
+		return fmt.Errorf("authenticator version %q was retired on %s", version, sunset.UTC().Format(time.DateOnly))
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// katUser, katWork and katEvidence are the inputs of the known-answer
+// vectors.
+var (
+	katUser = internal.UserCredentials{UserID: "alice", UserSecretVersion: "1", UserSecret: "correct horse battery staple"}
+	katWork = internal.WorkPacket{
+		ID:            "packet-1",
+		Nonce:         "nonce-1",
+		StartingValue: big.NewInt(1<<40 + 1),
+		EndingValue:   big.NewInt(1<<40 + 99),
+	}
+	katEvidence = internal.WorkEvidence{TotalIterations: 123456, MaxIterations: 789}
+)
+
+// TestGenerateKnownAnswers pins every version's authenticator, as
+// clients and servers of different releases must agree on them.  Should
+// one of these change, that version is no longer the one shipped.
+func TestGenerateKnownAnswers(t *testing.T) {
+	tests := []struct {
+		version string
+		filter  string
+		want    string
+	}{
+		{V1, "", "57YeegYwnTgfxWYFOwLqQ/o7c5U4RT9lm6TcGA7qKN8="},
+		{V2, "", "k2sdR3PbN0fsv7wfLnNQifU+rvuMruyokKXZ3UoynNA="},
+		{V3, "", "3nzMzRqO7unkMEUQuV4+j6YFq4RneQsXmK6hdVg2Ja4="},
+		// v1 predates filters, and does not cover them
+		{V1, internal.FilterMod3, "57YeegYwnTgfxWYFOwLqQ/o7c5U4RT9lm6TcGA7qKN8="},
+		{V2, internal.FilterMod3, "ekhFb+mCZl0dXfqGrR8pQqXmMbyMV0tmGDfovsGdqYY="},
+		{V3, internal.FilterMod3, "axXgQfE3JzfsM3gYEIgNeZ0iKhJNKJtTj8+0ymW41wg="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version+"/"+tt.filter, func(t *testing.T) {
+			evidence := katEvidence
+			evidence.Filter = tt.filter
+			a, err := Generate(tt.version, katUser, katWork, evidence)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// secretcheck:ignore: a known answer, not a secret
+			if a.Authenticator != tt.want {
+				t.Errorf("got %s, want %s", a.Authenticator, tt.want)
+			}
+			if a.AuthenticatorVersion != tt.version || a.UserSecretVersion != katUser.UserSecretVersion {
+				t.Errorf("got version %q and secret version %q", a.AuthenticatorVersion, a.UserSecretVersion)
+			}
+			if !Verify(katUser, katWork, evidence, a) {
+				t.Error("Verify rejects it")
+			}
+		})
+	}
+}
+
+// TestV3StoredCredentials checks that a server storing only the hashed
+// secret verifies v3, and nothing needing the plaintext.
+func TestV3StoredCredentials(t *testing.T) {
+	stored := HashSecret(katUser)
+	if want := "argon2id:rySMAF+xw8mxV9QAcDIpuZo/CWy5zTAA/N8k7hBsmCQ="; stored != want {
+		t.Fatalf("HashSecret returns %s, want %s", stored, want)
+	}
+	creds := StoredCredentials(katUser.UserID, katUser.UserSecretVersion, stored)
+	if creds.UserSecret != "" || creds.SecretKey == nil {
+		t.Fatal("StoredCredentials does not hold just the key")
+	}
+	for _, version := range Versions {
+		a, err := Generate(version, katUser, katWork, katEvidence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := Verify(creds, katWork, katEvidence, a), !NeedsSecret(version); got != want {
+			t.Errorf("%s: Verify returns %v with the hashed secret, want %v", version, got, want)
+		}
+	}
+}
+
+// TestVerifyRejects checks that every version rejects its authenticator
+// once any field it covers changes.
+func TestVerifyRejects(t *testing.T) {
+	changes := []struct {
+		name   string
+		change func(*internal.UserCredentials, *internal.WorkPacket, *internal.WorkEvidence)
+	}{
+		{"ID", func(_ *internal.UserCredentials, w *internal.WorkPacket, _ *internal.WorkEvidence) { w.ID = "packet-2" }},
+		{"nonce", func(_ *internal.UserCredentials, w *internal.WorkPacket, _ *internal.WorkEvidence) {
+			w.Nonce = "nonce-2"
+		}},
+		{"start", func(_ *internal.UserCredentials, w *internal.WorkPacket, _ *internal.WorkEvidence) {
+			w.StartingValue = big.NewInt(1<<40 + 3)
+		}},
+		{"end", func(_ *internal.UserCredentials, w *internal.WorkPacket, _ *internal.WorkEvidence) {
+			w.EndingValue = big.NewInt(1<<40 + 97)
+		}},
+		{"user", func(u *internal.UserCredentials, _ *internal.WorkPacket, _ *internal.WorkEvidence) { u.UserID = "bob" }},
+		{"secret version", func(u *internal.UserCredentials, _ *internal.WorkPacket, _ *internal.WorkEvidence) {
+			u.UserSecretVersion = "2"
+		}},
+		{"secret", func(u *internal.UserCredentials, _ *internal.WorkPacket, _ *internal.WorkEvidence) {
+			u.UserSecret = "incorrect horse battery staple"
+		}},
+		{"total", func(_ *internal.UserCredentials, _ *internal.WorkPacket, e *internal.WorkEvidence) {
+			e.TotalIterations++
+		}},
+		{"max", func(_ *internal.UserCredentials, _ *internal.WorkPacket, e *internal.WorkEvidence) { e.MaxIterations++ }},
+	}
+	for _, version := range Versions {
+		a, err := Generate(version, katUser, katWork, katEvidence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range changes {
+			user, work, evidence := katUser, katWork, katEvidence
+			c.change(&user, &work, &evidence)
+			if Verify(user, work, evidence, a) {
+				t.Errorf("%s: Verify accepts it with the %s changed", version, c.name)
+			}
+		}
+		tampered := a
+		tampered.AuthenticatorVersion = ""
+		if version != V1 && Verify(katUser, katWork, katEvidence, tampered) {
+			t.Errorf("%s: Verify accepts it as v1", version)
+		}
+	}
+}
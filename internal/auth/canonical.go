@@ -0,0 +1,83 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"encoding/binary"
+	"math/big"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// canonical builds the canonical encoding of the fields covered by an
+// authenticator.  Every field is self-delimiting, so two different
+// sets of fields never encode alike, however their values are chosen:
+//
+//   - a string is its length, as 8 bytes big-endian, then its bytes
+//   - a uint64 is 8 bytes big-endian
+//   - a big.Int is a sign byte, 0 for nil, 1 for zero or positive, or
+//     2 for negative, then, unless nil, its magnitude as a string of
+//     big-endian bytes with no leading zeros, so zero is empty
+//
+// Big integers are encoded by value, never as text, so differing
+// formatting of the same number cannot change the encoding.
+type canonical struct {
+	b []byte
+}
+
+func (c *canonical) string(s string) *canonical {
+	c.b = binary.BigEndian.AppendUint64(c.b, uint64(len(s)))
+	c.b = append(c.b, s...)
+	return c
+}
+
+func (c *canonical) uint64(v uint64) *canonical {
+	c.b = binary.BigEndian.AppendUint64(c.b, v)
+	return c
+}
+
+func (c *canonical) bigInt(v *big.Int) *canonical {
+	switch {
+	case v == nil:
+		c.b = append(c.b, 0)
+		return c
+	case v.Sign() < 0:
+		c.b = append(c.b, 2)
+	default:
+		c.b = append(c.b, 1)
+	}
+	mag := v.Bytes()
+	c.b = binary.BigEndian.AppendUint64(c.b, uint64(len(mag)))
+	c.b = append(c.b, mag...)
+	return c
+}
+
+// CanonicalEvidence returns the canonical encoding of the fields
+// covered by the v2 authenticator, in order: the packet's ID, nonce,
+// starting and ending values, the user's ID and secret version, and
+// the total and maximum iterations, and the filter if one was used.
+// The secret is not included; it keys the MAC instead.
+func CanonicalEvidence(user internal.UserCredentials, work internal.WorkPacket, evidence internal.WorkEvidence) []byte {
+	c := &canonical{}
+	c.string(work.ID).string(work.Nonce).bigInt(work.StartingValue).bigInt(work.EndingValue)
+	c.string(user.UserID).string(user.UserSecretVersion)
+	c.uint64(evidence.TotalIterations).uint64(evidence.MaxIterations)
+	if evidence.Filter != "" {
+		c.string(evidence.Filter)
+	}
+	return c.b
+}
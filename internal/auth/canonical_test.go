@@ -0,0 +1,116 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+func TestCanonicalEvidence(t *testing.T) {
+	want := "0000000000000008" + hex.EncodeToString([]byte("packet-1")) +
+		"0000000000000007" + hex.EncodeToString([]byte("nonce-1")) +
+		"01" + "0000000000000006" + "010000000001" +
+		"01" + "0000000000000006" + "010000000063" +
+		"0000000000000005" + hex.EncodeToString([]byte("alice")) +
+		"0000000000000001" + hex.EncodeToString([]byte("1")) +
+		"000000000001e240" +
+		"0000000000000315"
+	if got := hex.EncodeToString(CanonicalEvidence(katUser, katWork, katEvidence)); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+	evidence := katEvidence
+	evidence.Filter = internal.FilterMod3
+	want += "0000000000000004" + hex.EncodeToString([]byte(internal.FilterMod3))
+	if got := hex.EncodeToString(CanonicalEvidence(katUser, katWork, evidence)); got != want {
+		t.Errorf("with a filter, got  %s\nwant %s", got, want)
+	}
+}
+
+// TestCanonicalBoundaries checks that moving bytes across the boundary
+// between neighbouring fields, which would leave a plain concatenation
+// unchanged, changes the encoding.
+func TestCanonicalBoundaries(t *testing.T) {
+	type fields struct {
+		user     internal.UserCredentials
+		work     internal.WorkPacket
+		evidence internal.WorkEvidence
+	}
+	base := func() fields {
+		return fields{user: katUser, work: katWork, evidence: katEvidence}
+	}
+	tests := []struct {
+		name string
+		a, b func(*fields)
+	}{
+		{"ID and nonce",
+			func(f *fields) { f.work.ID, f.work.Nonce = "ab", "c" },
+			func(f *fields) { f.work.ID, f.work.Nonce = "a", "bc" }},
+		{"empty ID",
+			func(f *fields) { f.work.ID, f.work.Nonce = "", "abc" },
+			func(f *fields) { f.work.ID, f.work.Nonce = "abc", "" }},
+		{"user and secret version",
+			func(f *fields) { f.user.UserID, f.user.UserSecretVersion = "alice1", "" },
+			func(f *fields) { f.user.UserID, f.user.UserSecretVersion = "alice", "1" }},
+		{"start and end",
+			func(f *fields) { f.work.StartingValue, f.work.EndingValue = big.NewInt(0x0102), big.NewInt(0x03) },
+			func(f *fields) { f.work.StartingValue, f.work.EndingValue = big.NewInt(0x01), big.NewInt(0x0203) }},
+		{"nil and zero",
+			func(f *fields) { f.work.StartingValue = nil },
+			func(f *fields) { f.work.StartingValue = big.NewInt(0) }},
+		{"sign",
+			func(f *fields) { f.work.StartingValue = big.NewInt(5) },
+			func(f *fields) { f.work.StartingValue = big.NewInt(-5) }},
+		{"nonce and start",
+			func(f *fields) { f.work.Nonce, f.work.StartingValue = "n\x01", nil },
+			func(f *fields) { f.work.Nonce, f.work.StartingValue = "n", nil }},
+		{"secret version and totals",
+			func(f *fields) { f.user.UserSecretVersion, f.evidence.TotalIterations = "1\x00", 0 },
+			func(f *fields) { f.user.UserSecretVersion, f.evidence.TotalIterations = "1", 0 }},
+		{"filter",
+			func(f *fields) { f.evidence.Filter = "" },
+			func(f *fields) { f.evidence.Filter = internal.FilterMod3 }},
+		{"totals and filter",
+			func(f *fields) { f.evidence.MaxIterations, f.evidence.Filter = 0, "x" },
+			func(f *fields) { f.evidence.MaxIterations, f.evidence.Filter = 0, "" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := base(), base()
+			tt.a(&a)
+			tt.b(&b)
+			ea := CanonicalEvidence(a.user, a.work, a.evidence)
+			eb := CanonicalEvidence(b.user, b.work, b.evidence)
+			if bytes.Equal(ea, eb) {
+				t.Fatalf("both encode as %x", ea)
+			}
+			for _, version := range []string{V2, V3} {
+				auth, err := Generate(version, a.user, a.work, a.evidence)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if Verify(b.user, b.work, b.evidence, auth) {
+					t.Errorf("%s: Verify accepts one's authenticator for the other", version)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// ErrUnsigned is returned when verifying a packet with no signature.
+var ErrUnsigned = errors.New("packet is not signed")
+
+// CanonicalPacket returns the canonical encoding of the fields of a
+// work packet covered by its signature, in order: the ID, nonce,
+// starting and ending values, and expiry, in nanoseconds since the
+// Unix epoch, or zero if there is none.  If there are challenges, the
+// value and steps of each follow.  If there is a filter, a 0xff byte,
+// which cannot start a challenge, and then the filter follow.
+func CanonicalPacket(w internal.WorkPacket) []byte {
+	expiry := int64(0)
+	if !w.Expiry.IsZero() {
+		expiry = w.Expiry.UnixNano()
+	}
+	c := &canonical{}
+	c.string(w.ID).string(w.Nonce).bigInt(w.StartingValue).bigInt(w.EndingValue)
+	c.uint64(uint64(expiry))
+	for _, ch := range w.Challenges {
+		c.bigInt(ch.Value).uint64(ch.Steps)
+	}
+	if w.Filter != "" {
+		c.b = append(c.b, 0xff)
+		c.string(w.Filter)
+	}
+	return c.b
+}
+
+// SignPacket sets the packet's signature.
+func SignPacket(key ed25519.PrivateKey, w *internal.WorkPacket) {
+	w.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, CanonicalPacket(*w)))
+}
+
+// VerifyPacket returns an error unless the packet carries a valid
+// signature by key.
+func VerifyPacket(key ed25519.PublicKey, w internal.WorkPacket) error {
+	if w.Signature == "" {
+		return ErrUnsigned
+	}
+	sig, err := base64.StdEncoding.DecodeString(w.Signature)
+	if err != nil {
+		return fmt.Errorf("packet signature is not valid base64: %v", err)
+	}
+	if !ed25519.Verify(key, CanonicalPacket(w), sig) {
+		return errors.New("packet signature is not valid")
+	}
+	return nil
+}
+
+// ParsePublicKey decodes a base64 Ed25519 public key.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("public key is not valid base64: %v", err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key is %d bytes, not %d", len(b), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(b), nil
+}
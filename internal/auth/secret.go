@@ -0,0 +1,114 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"strings"
+	"sync"
+
+	"github.com/skandragon/collatz/internal"
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters for deriving secret keys.  They are part of the
+// v3 authenticator, as clients must derive the same key the server
+// stores, and must never change.
+const (
+	argonTime    = 2
+	argonMemory  = 19 * 1024
+	argonThreads = 1
+	argonKeySize = 32
+)
+
+// hashedPrefix marks a stored secret which is a key derived from the
+// secret, rather than the secret itself.
+const hashedPrefix = "argon2id:"
+
+// SecretKey derives the key for a user's secret with Argon2id.  The
+// salt is the user ID and secret version, so the key can be derived by
+// the client as well as stored by the server.  It is deliberately slow.
+func SecretKey(user internal.UserCredentials) []byte {
+	salt := "github.com/skandragon/collatz secret\x00" + user.UserID + "\x00" + user.UserSecretVersion
+	return argon2.IDKey([]byte(user.UserSecret), []byte(salt), argonTime, argonMemory, argonThreads, argonKeySize)
+}
+
+// HashSecret returns the form of a user's secret a server stores
+// instead of the secret itself.
+func HashSecret(user internal.UserCredentials) string {
+	return hashedPrefix + base64.StdEncoding.EncodeToString(SecretKey(user))
+}
+
+// IsHashed returns true if a stored secret is hashed.
+func IsHashed(stored string) bool {
+	return strings.HasPrefix(stored, hashedPrefix)
+}
+
+// StoredCredentials returns credentials for a user given their stored
+// secret.  If it is hashed, UserSecret is empty and SecretKey is set,
+// so only versions which need no plaintext secret can be verified.
+func StoredCredentials(userID, secretVersion, stored string) internal.UserCredentials {
+	creds := internal.UserCredentials{UserID: userID, UserSecretVersion: secretVersion}
+	if !IsHashed(stored) {
+		creds.UserSecret = stored
+		return creds
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, hashedPrefix))
+	if err == nil && len(key) == argonKeySize {
+		creds.SecretKey = key
+	}
+	return creds
+}
+
+// SecretChecker checks the secrets users present against those stored.
+// As hashed secrets are slow to check, a secret which matched is
+// remembered, by its SHA-256, until the stored secret changes.
+type SecretChecker struct {
+	sync.Mutex
+	matched map[string][sha256.Size]byte
+}
+
+// NewSecretChecker returns an empty SecretChecker.
+func NewSecretChecker() *SecretChecker {
+	return &SecretChecker{matched: map[string][sha256.Size]byte{}}
+}
+
+// Check returns true if presented is the secret stored for the user,
+// either in plaintext or hashed.
+func (c *SecretChecker) Check(userID, secretVersion, stored, presented string) bool {
+	if !IsHashed(stored) {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(presented)) == 1
+	}
+	cacheKey := userID + "\x00" + secretVersion + "\x00" + stored
+	sum := sha256.Sum256([]byte(presented))
+	c.Lock()
+	prev, found := c.matched[cacheKey]
+	c.Unlock()
+	if found {
+		return subtle.ConstantTimeCompare(prev[:], sum[:]) == 1
+	}
+	expected := HashSecret(internal.UserCredentials{UserID: userID, UserSecretVersion: secretVersion, UserSecret: presented})
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(stored)) != 1 {
+		return false
+	}
+	c.Lock()
+	c.matched[cacheKey] = sum
+	c.Unlock()
+	return true
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+func TestSecretChecker(t *testing.T) {
+	const secret = "correct horse battery staple"
+	hashed := HashSecret(internal.UserCredentials{UserID: "alice", UserSecretVersion: "1", UserSecret: secret})
+	wrong := []string{"", "correct", secret + " ", "Correct horse battery staple", "correct horse battery stapl_", hashed}
+	for _, stored := range []string{secret, hashed} {
+		c := NewSecretChecker()
+		for _, presented := range wrong {
+			if c.Check("alice", "1", stored, presented) {
+				t.Errorf("stored %q: accepts %q", stored, presented)
+			}
+		}
+		// twice, the second from the cache of matches for hashed secrets
+		for i := 0; i < 2; i++ {
+			if !c.Check("alice", "1", stored, secret) {
+				t.Errorf("stored %q: rejects the secret", stored)
+			}
+		}
+		for _, presented := range wrong {
+			if c.Check("alice", "1", stored, presented) {
+				t.Errorf("stored %q: accepts %q once the secret has matched", stored, presented)
+			}
+		}
+		if IsHashed(stored) && c.Check("alice", "2", stored, secret) {
+			t.Errorf("accepts the secret for another secret version")
+		}
+		if IsHashed(stored) && c.Check("bob", "1", stored, secret) {
+			t.Errorf("accepts the secret for another user")
+		}
+	}
+}
+
+// TestSecretCheckerConstantTime checks that rejecting a plaintext
+// secret, and a hashed one once it has matched, takes as long however
+// much of the presented secret is right.  The secrets are long enough
+// that a comparison stopping at the first difference would take orders
+// of magnitude less time when it comes first, so the bound is loose.
+func TestSecretCheckerConstantTime(t *testing.T) {
+	if testing.Short() {
+		t.Skip("timing test")
+	}
+	secret := strings.Repeat("s", 1<<20)
+	early := "x" + secret[1:]
+	late := secret[:len(secret)-1] + "x"
+	hashed := HashSecret(internal.UserCredentials{UserID: "alice", UserSecretVersion: "1", UserSecret: secret})
+
+	fastest := func(c *SecretChecker, stored, presented string) time.Duration {
+		best := time.Duration(1 << 62)
+		for i := 0; i < 50; i++ {
+			start := time.Now()
+			if c.Check("alice", "1", stored, presented) {
+				t.Fatal("accepts a wrong secret")
+			}
+			if d := time.Since(start); d < best {
+				best = d
+			}
+		}
+		return best
+	}
+	for _, stored := range []string{secret, hashed} {
+		c := NewSecretChecker()
+		if !c.Check("alice", "1", stored, secret) {
+			t.Fatal("rejects the secret")
+		}
+		e, l := fastest(c, stored, early), fastest(c, stored, late)
+		if e*4 < l || l*4 < e {
+			t.Errorf("hashed %v: rejecting a secret wrong from its first byte takes %v, from its last %v",
+				IsHashed(stored), e, l)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"math/big"
+)
+
+// Challenge asks a client to report where the trajectory of Value, a
+// candidate in its packet, is after Steps steps.  An honest client
+// follows the trajectory anyway, so answering costs it next to
+// nothing, while evidence made up without running the packet cannot
+// answer it.
+type Challenge struct {
+	Value *big.Int `json:"value,omitempty"`
+	Steps uint64   `json:"steps,omitempty"`
+}
+
+// ChallengeResponse answers a Challenge.
+type ChallengeResponse struct {
+	Value *big.Int `json:"value,omitempty"`
+
+	// Steps is the number of steps taken, which is fewer than asked
+	// for if the trajectory dropped below, or looped back to, Value
+	// first.
+	Steps uint64 `json:"steps,omitempty"`
+
+	// Result is where the trajectory was after Steps steps.
+	Result *big.Int `json:"result,omitempty"`
+}
+
+// Answer follows the challenge's trajectory, with the same steps
+// counted as iterations.
+func (c Challenge) Answer() ChallengeResponse {
+	resp := ChallengeResponse{Value: new(big.Int).Set(c.Value)}
+	n := new(big.Int).Set(c.Value)
+	three := big.NewInt(3)
+	one := big.NewInt(1)
+	for resp.Steps < c.Steps {
+		resp.Steps++
+		if n.Bit(0) == 0 {
+			n.Rsh(n, 1)
+		} else {
+			n.Mul(n, three)
+			n.Add(n, one)
+		}
+		if n.Cmp(c.Value) <= 0 {
+			break
+		}
+	}
+	resp.Result = n
+	return resp
+}
+
+// Equal returns true if the responses are the same.
+func (r ChallengeResponse) Equal(o ChallengeResponse) bool {
+	return r.Value != nil && o.Value != nil && r.Result != nil && o.Result != nil &&
+		r.Value.Cmp(o.Value) == 0 && r.Steps == o.Steps && r.Result.Cmp(o.Result) == 0
+}
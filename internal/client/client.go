@@ -0,0 +1,317 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package client implements the crunch side of the work server protocol.
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/natshttp"
+	"github.com/skandragon/collatz/internal/trace"
+)
+
+// DefaultMaxSkew is the clock skew above which we warn if none is configured.
+const DefaultMaxSkew = 30 * time.Second
+
+// compressThreshold is the request body size above which we compress,
+// if the server has told us it accepts compressed requests.
+const compressThreshold = 4096
+
+// loginPath is where we trade our secret for a bearer token.
+const loginPath = "/api/v1/login"
+
+// enrollPath is where we trade an enrollment code for credentials.
+// The code is the only authentication.
+const enrollPath = "/api/v1/enroll"
+
+// tokenRenewal is how long before it expires a token is replaced.
+const tokenRenewal = time.Minute
+
+// Client talks to the work server.
+type Client struct {
+	baseURL     string
+	credentials internal.UserCredentials
+	httpClient  *http.Client
+
+	// tokens holds the bearer token from our last login, if the
+	// server issues them.
+	tokens struct {
+		sync.Mutex
+		token     string
+		expiresOn time.Time
+
+		// unsupported is set if the server does not issue tokens,
+		// so we send our secret with every request.
+		unsupported bool
+	}
+
+	// gzipAccepted is set once the server advertises, using the
+	// Accept-Encoding response header (RFC 7694), that it will accept
+	// gzip request bodies.  It is cleared if the server then rejects one.
+	gzipAccepted atomic.Bool
+
+	// Skew tracks the difference between our clock and the server's.
+	Skew *SkewTracker
+
+	// Observe, if set, is called after each request to the server
+	// with the status code, or zero if there was no response, and
+	// how long it took.
+	Observe func(path string, code int, d time.Duration)
+}
+
+// New returns a new Client which will talk to the server at baseURL,
+// authenticating with the credentials provided.  A "nats://" baseURL
+// reaches the server through a NATS server, as package natshttp
+// describes.
+func New(baseURL string, credentials internal.UserCredentials, maxSkew time.Duration) *Client {
+	if maxSkew == 0 {
+		maxSkew = DefaultMaxSkew
+	}
+	httpClient := &http.Client{Timeout: 60 * time.Second}
+	if natshttp.IsURL(baseURL) {
+		httpClient.Transport = natshttp.NewTransport(baseURL, "crunch")
+	}
+	return &Client{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		credentials: credentials,
+		httpClient:  httpClient,
+		Skew:        &SkewTracker{Threshold: maxSkew},
+	}
+}
+
+// Claim asks the server for more work.
+func (c *Client) Claim(ctx context.Context, req internal.ClaimRequest) (*internal.ClaimResponse, error) {
+	var resp internal.ClaimResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/claim", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Report sends a progress report to the server.
+func (c *Client) Report(ctx context.Context, report internal.WorkProgressReport) (*internal.ReportResponse, error) {
+	var resp internal.ReportResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/report", report, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Receipts fetches all receipts the server holds for our user.
+func (c *Client) Receipts(ctx context.Context) (*internal.ReceiptsResponse, error) {
+	var resp internal.ReceiptsResponse
+	if err := c.do(ctx, http.MethodGet, "/api/v1/receipts", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Trajectory sends the trajectory of a finding.
+func (c *Client) Trajectory(ctx context.Context, t internal.Trajectory) (*internal.TrajectoryResponse, error) {
+	var resp internal.TrajectoryResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/trajectory", t, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Crash sends a report of a panic in a worker.
+func (c *Client) Crash(ctx context.Context, report internal.CrashReport) (*internal.CrashReportResponse, error) {
+	var resp internal.CrashReportResponse
+	if err := c.do(ctx, http.MethodPost, "/api/v1/crash", report, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Enroll exchanges an enrollment code for the credentials of the user
+// it was issued for.  The client's own credentials are not used.
+func (c *Client) Enroll(ctx context.Context, req internal.EnrollRequest) (*internal.EnrollResponse, error) {
+	var resp internal.EnrollResponse
+	if err := c.do(ctx, http.MethodPost, enrollPath, req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, in any, out any) error {
+	var body []byte
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("json.Marshal(): %v", err)
+		}
+		body = b
+	}
+	compress := len(body) >= compressThreshold && c.gzipAccepted.Load()
+	resp, err := c.send(ctx, method, path, body, compress)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && path != loginPath && c.dropToken() {
+		// revoked, or the server restarted with a new key
+		resp.Body.Close()
+		resp, err = c.send(ctx, method, path, body, compress)
+		if err != nil {
+			return err
+		}
+	}
+	if compress && resp.StatusCode == http.StatusUnsupportedMediaType {
+		resp.Body.Close()
+		c.gzipAccepted.Store(false)
+		resp, err = c.send(ctx, method, path, body, false)
+		if err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &statusError{method: method, path: path, code: resp.StatusCode, status: resp.Status, msg: strings.TrimSpace(string(msg))}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding response from %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c *Client) send(ctx context.Context, method string, path string, body []byte, compress bool) (*http.Response, error) {
+	if compress {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(body); err != nil {
+			return nil, err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if token := c.token(ctx, path); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if path != enrollPath {
+		req.SetBasicAuth(c.credentials.UserID, c.credentials.UserSecret)
+	}
+	trace.Inject(ctx, req.Header)
+
+	sent := time.Now()
+	resp, err := c.httpClient.Do(req)
+	if c.Observe != nil {
+		code := 0
+		if resp != nil {
+			code = resp.StatusCode
+		}
+		c.Observe(path, code, time.Since(sent))
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.observeServerTime(resp, sent, time.Now())
+	if strings.Contains(resp.Header.Get("Accept-Encoding"), "gzip") {
+		c.gzipAccepted.Store(true)
+	}
+	return resp, nil
+}
+
+// token returns the bearer token for a request to path, logging in
+// for a new one if need be.  It returns "" if the request should send
+// our secret instead: to log in, or if the server does not issue
+// tokens, or if logging in failed, which the request will then report.
+func (c *Client) token(ctx context.Context, path string) string {
+	if path == loginPath || path == enrollPath {
+		return ""
+	}
+	c.tokens.Lock()
+	defer c.tokens.Unlock()
+	if c.tokens.unsupported {
+		return ""
+	}
+	if c.tokens.token != "" && c.Skew.ServerNow().Add(tokenRenewal).Before(c.tokens.expiresOn) {
+		return c.tokens.token
+	}
+	c.tokens.token = ""
+	var resp internal.LoginResponse
+	err := c.do(ctx, http.MethodPost, loginPath, internal.LoginRequest{}, &resp)
+	var status *statusError
+	if errors.As(err, &status) && status.code == http.StatusNotFound {
+		c.tokens.unsupported = true
+		return ""
+	}
+	if err != nil {
+		return ""
+	}
+	c.tokens.token, c.tokens.expiresOn = resp.Token, resp.ExpiresOn
+	return resp.Token
+}
+
+// dropToken forgets our token, returning true if we had one.
+func (c *Client) dropToken() bool {
+	c.tokens.Lock()
+	defer c.tokens.Unlock()
+	had := c.tokens.token != ""
+	c.tokens.token = ""
+	return had
+}
+
+// statusError is a response from the server other than 200 OK.
+type statusError struct {
+	method, path string
+	code         int
+	status, msg  string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s %s: %s: %s", e.method, e.path, e.status, e.msg)
+}
+
+// observeServerTime feeds the skew tracker from the response.  The
+// high-resolution server time header is preferred, with the standard
+// Date header (one second resolution) as a fallback.
+func (c *Client) observeServerTime(resp *http.Response, sent time.Time, received time.Time) {
+	if v := resp.Header.Get(internal.ServerTimeHeader); v != "" {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			c.Skew.Observe(sent, received, t)
+			return
+		}
+	}
+	if v := resp.Header.Get("Date"); v != "" {
+		if t, err := http.ParseTime(v); err == nil {
+			c.Skew.Observe(sent, received, t)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// skewSmoothing is the weight given to each new skew sample.
+const skewSmoothing = 0.25
+
+// skewWarningInterval limits how often we complain about the same skew.
+const skewWarningInterval = 10 * time.Minute
+
+// SkewTracker estimates the offset between the local clock and the
+// server's clock from the timestamps the server attaches to its responses.
+// All decisions involving server-assigned times, such as work packet
+// expiry, should be made using ServerNow() rather than time.Now().
+type SkewTracker struct {
+	sync.Mutex
+
+	// Threshold is the absolute skew above which a warning is logged.
+	Threshold time.Duration
+
+	offset     time.Duration
+	samples    int
+	lastWarned time.Time
+}
+
+// Observe records one sample.  sent and received are local times taken
+// just before the request was sent and just after the response arrived,
+// and server is the time the server reported.  The server is assumed to
+// have generated its timestamp half way through the round trip.
+func (s *SkewTracker) Observe(sent time.Time, received time.Time, server time.Time) {
+	midpoint := sent.Add(received.Sub(sent) / 2)
+	sample := server.Sub(midpoint)
+
+	s.Lock()
+	defer s.Unlock()
+	if s.samples == 0 {
+		s.offset = sample
+	} else {
+		s.offset += time.Duration(float64(sample-s.offset) * skewSmoothing)
+	}
+	s.samples++
+
+	if s.Threshold > 0 && abs(s.offset) > s.Threshold && time.Since(s.lastWarned) > skewWarningInterval {
+		slog.Warn("local clock differs from server clock; "+
+			"work expiry will be evaluated in server time, but you should fix your clock",
+			"offset", s.offset.Round(time.Millisecond), "threshold", s.Threshold)
+		s.lastWarned = time.Now()
+	}
+}
+
+// Offset returns the current estimate of server time minus local time.
+func (s *SkewTracker) Offset() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	return s.offset
+}
+
+// ServerNow returns the current time, as the server would see it.
+func (s *SkewTracker) ServerNow() time.Time {
+	return time.Now().UTC().Add(s.Offset())
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,156 @@
+//go:build linux
+
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// usableCPUs returns the CPUs our affinity mask lets us run on.
+func usableCPUs() ([]int, error) {
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return nil, err
+	}
+	var ret []int
+	for cpu := 0; cpu < len(set)*64; cpu++ {
+		if set.IsSet(cpu) {
+			ret = append(ret, cpu)
+		}
+	}
+	return ret, nil
+}
+
+// physicalCores counts the cores cpus are on, which is fewer than the
+// CPUs if they include SMT siblings.  It returns zero if the topology
+// cannot be read.
+func physicalCores(cpus []int) int {
+	cores := map[string]bool{}
+	for _, cpu := range cpus {
+		dir := "/sys/devices/system/cpu/cpu" + strconv.Itoa(cpu) + "/topology/"
+		pkg, err := os.ReadFile(dir + "physical_package_id")
+		if err != nil {
+			return 0
+		}
+		core, err := os.ReadFile(dir + "core_id")
+		if err != nil {
+			return 0
+		}
+		cores[strings.TrimSpace(string(pkg))+"/"+strings.TrimSpace(string(core))] = true
+	}
+	return len(cores)
+}
+
+// cpuQuota returns the CPUs our cgroup's quota allows, under cgroups
+// v2 or v1, or zero if there is no quota.
+func cpuQuota() float64 {
+	groups, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(groups), "\n") {
+		// hierarchy-ID:controllers:path
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			if q := cgroupQuota(filepath.Join("/sys/fs/cgroup", fields[2]), "/sys/fs/cgroup", cgroup2Quota); q > 0 {
+				return q
+			}
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			if controller != "cpu" {
+				continue
+			}
+			for _, root := range []string{"/sys/fs/cgroup/cpu", "/sys/fs/cgroup/cpu,cpuacct"} {
+				if q := cgroupQuota(filepath.Join(root, fields[2]), root, cgroup1Quota); q > 0 {
+					return q
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// cgroupQuota returns the smallest quota read from dir and each of its
+// parents up to root.  In a container, our cgroup's path may be that
+// on the host, so root itself is tried if dir does not exist.
+func cgroupQuota(dir string, root string, read func(dir string) float64) float64 {
+	if _, err := os.Stat(dir); err != nil {
+		dir = root
+	}
+	ret := 0.0
+	for {
+		if q := read(dir); q > 0 && (ret == 0 || q < ret) {
+			ret = q
+		}
+		if dir == root || !strings.HasPrefix(dir, root) {
+			return ret
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// cgroup2Quota reads cpu.max, which is "max" or a quota, then the
+// period, in microseconds.
+func cgroup2Quota(dir string) float64 {
+	b, err := os.ReadFile(filepath.Join(dir, "cpu.max"))
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0
+	}
+	return quotaRatio(fields[0], fields[1])
+}
+
+// cgroup1Quota reads cpu.cfs_quota_us, which is -1 for no quota, and
+// cpu.cfs_period_us.
+func cgroup1Quota(dir string) float64 {
+	quota, err := os.ReadFile(filepath.Join(dir, "cpu.cfs_quota_us"))
+	if err != nil {
+		return 0
+	}
+	period, err := os.ReadFile(filepath.Join(dir, "cpu.cfs_period_us"))
+	if err != nil {
+		return 0
+	}
+	return quotaRatio(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+func quotaRatio(quota, period string) float64 {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return math.Round(q/p*100) / 100
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// Filters a packet may ask for.  A filter leaves out candidates whose
+// trajectories another candidate, no larger, is sure to cover; they
+// are neither tested nor counted in the evidence, so a report says
+// which filter it used, and a double check uses the same one.
+const (
+	// FilterNone tests every odd candidate.
+	FilterNone = ""
+
+	// FilterMod3 leaves out odd n = 2 (mod 3).  For those,
+	// m = (2n-1)/3 is a smaller odd number with 3m+1 = 2n, so m's
+	// trajectory reaches n two steps in, without having dropped below
+	// m, and testing m covers n.
+	FilterMod3 = "mod3"
+)
+
+// Filters lists the filters this build can apply, for clients to send
+// in their claims.
+var Filters = []string{FilterMod3}
+
+// CheckFilter returns an error if filter is not one we know.
+func CheckFilter(filter string) error {
+	if filter == FilterNone {
+		return nil
+	}
+	for _, f := range Filters {
+		if f == filter {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown filter %q", filter)
+}
+
+// Excluded returns true if filter leaves out the odd candidate n.
+func Excluded(filter string, n *big.Int) bool {
+	switch filter {
+	case FilterMod3:
+		return new(big.Int).Mod(n, big.NewInt(3)).Int64() == 2
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+//go:build gmp && cgo
+
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package gmp follows Collatz trajectories in GMP integers, which are
+// faster than math/big at this.  It is built only with -tags gmp, and
+// needs cgo and libgmp.
+package gmp
+
+/*
+#cgo LDFLAGS: -lgmp
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+#include <gmp.h>
+
+// How collatz_steps stopped; the same as the Stop constants.
+enum { STOP_LIMIT, STOP_BELOW, STOP_LOOP };
+
+// collatz_t is a trajectory, in limbs, least significant first.  Only
+// GMP's low level mpn functions are used on them, as the mpz ones cost
+// more in their overhead than in arithmetic on numbers this size.
+typedef struct {
+	mp_limb_t *n, *start;
+	mp_size_t sn, ss, cap;
+	size_t bits;
+} collatz_t;
+
+// collatz_reserve makes room in c for at least size limbs.
+static void collatz_reserve(collatz_t *c, mp_size_t size) {
+	if (size <= c->cap) {
+		return;
+	}
+	mp_size_t cap = 2 * size;
+	c->n = realloc(c->n, cap * sizeof(mp_limb_t));
+	c->start = realloc(c->start, cap * sizeof(mp_limb_t));
+	if (c->n == NULL || c->start == NULL) {
+		abort();
+	}
+	c->cap = cap;
+}
+
+static void collatz_free(collatz_t *c) {
+	free(c->n);
+	free(c->start);
+	free(c);
+}
+
+// collatz_bits returns the length of n in bits.
+static size_t collatz_bits(const collatz_t *c) {
+	return c->sn * GMP_NUMB_BITS - __builtin_clzll(c->n[c->sn - 1]);
+}
+
+// collatz_steps continues c's trajectory for at most max iterations,
+// adding those taken to *steps.  Each 3n+1 and each n/2 is one
+// iteration.  A run of halvings is taken at once, down to start's
+// length, as until then n cannot be below start.
+static int collatz_steps(collatz_t *c, uint64_t max, uint64_t *steps) {
+	uint64_t taken = 0;
+	int stop = STOP_LIMIT;
+	while (taken < max) {
+		if (c->n[0] & 1) {
+			mp_limb_t carry = mpn_mul_1(c->n, c->n, c->sn, 3);
+			carry += mpn_add_1(c->n, c->n, c->sn, 1);
+			if (carry != 0) {
+				collatz_reserve(c, c->sn + 1);
+				c->n[c->sn++] = carry;
+			}
+			taken++;
+			continue;
+		}
+		size_t size = collatz_bits(c);
+		uint64_t k = 1;
+		if (size > c->bits) {
+			k = mpn_scan1(c->n, 0);
+			if (k > size - c->bits) {
+				k = size - c->bits;
+			}
+			if (k > max - taken) {
+				k = max - taken;
+			}
+		}
+		mp_size_t words = k / GMP_NUMB_BITS;
+		unsigned shift = k % GMP_NUMB_BITS;
+		if (words > 0) {
+			memmove(c->n, c->n + words, (c->sn - words) * sizeof(mp_limb_t));
+			c->sn -= words;
+		}
+		if (shift > 0) {
+			mpn_rshift(c->n, c->n, c->sn, shift);
+		}
+		if (c->sn > 1 && c->n[c->sn - 1] == 0) {
+			c->sn--;
+		}
+		taken += k;
+		if (size - k > c->bits) {
+			continue;
+		}
+		int cmp = c->sn != c->ss ? (c->sn > c->ss ? 1 : -1) : mpn_cmp(c->n, c->start, c->sn);
+		if (cmp == 0) {
+			stop = STOP_LOOP;
+			break;
+		}
+		if (cmp < 0) {
+			stop = STOP_BELOW;
+			break;
+		}
+	}
+	*steps += taken;
+	return stop;
+}
+
+// collatz_start begins c's trajectory at the count limbs at p, with no
+// high zero limbs, and follows it as collatz_steps does.
+static int collatz_start(collatz_t *c, const mp_limb_t *p, mp_size_t count, uint64_t max, uint64_t *steps) {
+	collatz_reserve(c, count + 1);
+	memcpy(c->start, p, count * sizeof(mp_limb_t));
+	memcpy(c->n, p, count * sizeof(mp_limb_t));
+	c->sn = c->ss = count;
+	c->bits = collatz_bits(c);
+	return collatz_steps(c, max, steps);
+}
+*/
+import "C"
+
+import (
+	"math/big"
+	"runtime"
+	"unsafe"
+)
+
+// How Steps stopped.
+const (
+	StopLimit = C.STOP_LIMIT // took as many steps as allowed
+	StopBelow = C.STOP_BELOW // dropped below the start
+	StopLoop  = C.STOP_LOOP  // came back to the start
+)
+
+// Stepper follows one trajectory at a time.  Its limbs are kept
+// between trajectories, so once grown to fit, it allocates nothing.
+// A Stepper must not be used by more than one goroutine at once.
+type Stepper struct {
+	c *C.collatz_t
+}
+
+// NewStepper returns a Stepper.  Its limbs are freed when it is
+// garbage collected.
+func NewStepper() *Stepper {
+	s := &Stepper{c: (*C.collatz_t)(C.calloc(1, C.sizeof_collatz_t))}
+	runtime.SetFinalizer(s, func(s *Stepper) { C.collatz_free(s.c) })
+	return s
+}
+
+// Start begins the trajectory of v, which must be positive, and
+// follows it as Steps does.
+func (s *Stepper) Start(v *big.Int, max uint64) (steps uint64, stop int) {
+	words := v.Bits()
+	if unsafe.Sizeof(words[0]) != unsafe.Sizeof(C.mp_limb_t(0)) {
+		panic("gmp: big.Word is not the size of a limb")
+	}
+	var taken C.uint64_t
+	stop = int(C.collatz_start(s.c, (*C.mp_limb_t)(unsafe.Pointer(&words[0])), C.mp_size_t(len(words)),
+		C.uint64_t(max), &taken))
+	return uint64(taken), stop
+}
+
+// Steps continues the trajectory for at most max iterations, returning
+// the number taken, and why it stopped.
+func (s *Stepper) Steps(max uint64) (steps uint64, stop int) {
+	var taken C.uint64_t
+	stop = int(C.collatz_steps(s.c, C.uint64_t(max), &taken))
+	return uint64(taken), stop
+}
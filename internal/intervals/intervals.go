@@ -0,0 +1,114 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package intervals keeps sets of integers as sorted, merged, half-open
+// intervals.  Completed work is allocated sequentially, so even after
+// millions of packets the set is only as large as the number of gaps.
+package intervals
+
+import (
+	"math/big"
+	"sort"
+)
+
+// Interval is the half-open range [Start, End).
+type Interval struct {
+	Start *big.Int `json:"start"`
+	End   *big.Int `json:"end"`
+}
+
+// Touches returns true if the intervals overlap or are adjacent, and
+// so would merge into one.
+func (iv Interval) Touches(o Interval) bool {
+	return iv.Start.Cmp(o.End) <= 0 && o.Start.Cmp(iv.End) <= 0
+}
+
+// Size returns the number of integers in the interval.
+func (iv Interval) Size() *big.Int {
+	return new(big.Int).Sub(iv.End, iv.Start)
+}
+
+// Union returns the smallest interval covering both.
+func (iv Interval) Union(o Interval) Interval {
+	ret := Interval{Start: iv.Start, End: iv.End}
+	if o.Start.Cmp(ret.Start) < 0 {
+		ret.Start = o.Start
+	}
+	if o.End.Cmp(ret.End) > 0 {
+		ret.End = o.End
+	}
+	return ret
+}
+
+// Set is a set of integers.  The zero value is an empty set.
+type Set struct {
+	ivs []Interval
+}
+
+// Add adds [start, end) to the set.  Empty intervals are ignored.
+func (s *Set) Add(start, end *big.Int) {
+	if start.Cmp(end) >= 0 {
+		return
+	}
+	iv := Interval{Start: new(big.Int).Set(start), End: new(big.Int).Set(end)}
+	// first interval which could touch iv
+	i := sort.Search(len(s.ivs), func(i int) bool { return s.ivs[i].End.Cmp(iv.Start) >= 0 })
+	j := i
+	for j < len(s.ivs) && s.ivs[j].Touches(iv) {
+		iv = iv.Union(s.ivs[j])
+		j++
+	}
+	s.ivs = append(s.ivs[:i], append([]Interval{iv}, s.ivs[j:]...)...)
+}
+
+// Contains returns true if v is in the set.
+func (s *Set) Contains(v *big.Int) bool {
+	i := sort.Search(len(s.ivs), func(i int) bool { return s.ivs[i].End.Cmp(v) > 0 })
+	return i < len(s.ivs) && s.ivs[i].Start.Cmp(v) <= 0
+}
+
+// ContiguousFrom returns the first value at or after v which is not in
+// the set.
+func (s *Set) ContiguousFrom(v *big.Int) *big.Int {
+	i := sort.Search(len(s.ivs), func(i int) bool { return s.ivs[i].End.Cmp(v) > 0 })
+	if i < len(s.ivs) && s.ivs[i].Start.Cmp(v) <= 0 {
+		return new(big.Int).Set(s.ivs[i].End)
+	}
+	return new(big.Int).Set(v)
+}
+
+// Len returns the number of intervals, not the number of integers.
+func (s *Set) Len() int {
+	return len(s.ivs)
+}
+
+// Size returns the number of integers in the set.
+func (s *Set) Size() *big.Int {
+	ret := big.NewInt(0)
+	for _, iv := range s.ivs {
+		ret.Add(ret, iv.Size())
+	}
+	return ret
+}
+
+// Intervals returns a copy of the set's intervals, lowest first.
+func (s *Set) Intervals() []Interval {
+	ret := make([]Interval, len(s.ivs))
+	for i, iv := range s.ivs {
+		ret[i] = Interval{Start: new(big.Int).Set(iv.Start), End: new(big.Int).Set(iv.End)}
+	}
+	return ret
+}
@@ -0,0 +1,154 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package intervals
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+// set returns a set of the half-open intervals whose bounds are given.
+func set(bounds ...int64) *Set {
+	s := &Set{}
+	for i := 0; i+1 < len(bounds); i += 2 {
+		s.Add(big.NewInt(bounds[i]), big.NewInt(bounds[i+1]))
+	}
+	return s
+}
+
+func TestAdd(t *testing.T) {
+	tests := []struct {
+		name string
+		add  []int64
+		want string
+	}{
+		{"empty", nil, "[]"},
+		{"empty interval", []int64{5, 5, 7, 6}, "[]"},
+		{"one", []int64{1, 10}, "[{1 10}]"},
+		{"apart", []int64{20, 30, 1, 10}, "[{1 10} {20 30}]"},
+		{"adjacent", []int64{1, 10, 10, 20}, "[{1 20}]"},
+		{"adjacent before", []int64{10, 20, 1, 10}, "[{1 20}]"},
+		{"overlapping", []int64{1, 15, 10, 30}, "[{1 30}]"},
+		{"inside", []int64{1, 30, 10, 20}, "[{1 30}]"},
+		{"covering", []int64{10, 20, 1, 30}, "[{1 30}]"},
+		{"filling a gap", []int64{1, 10, 20, 30, 10, 20}, "[{1 30}]"},
+		{"covering several", []int64{10, 20, 30, 40, 50, 60, 70, 80, 15, 55}, "[{10 60} {70 80}]"},
+		{"into a gap", []int64{1, 10, 20, 30, 12, 18}, "[{1 10} {12 18} {20 30}]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fmt.Sprint(set(tt.add...).Intervals()); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestAddRandom checks Add against a set of small integers.
+func TestAddRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 100; round++ {
+		s := &Set{}
+		in := make([]bool, 200)
+		for i := 0; i < 20; i++ {
+			start := r.Intn(190)
+			end := start + r.Intn(10)
+			s.Add(big.NewInt(int64(start)), big.NewInt(int64(end)))
+			for v := start; v < end; v++ {
+				in[v] = true
+			}
+		}
+		size := int64(0)
+		for v, want := range in {
+			if want {
+				size++
+			}
+			if got := s.Contains(big.NewInt(int64(v))); got != want {
+				t.Fatalf("round %d: Contains(%d) = %v in %v", round, v, got, s.Intervals())
+			}
+		}
+		if s.Size().Int64() != size {
+			t.Fatalf("round %d: Size() = %s, want %d", round, s.Size(), size)
+		}
+		ivs := s.Intervals()
+		for i := 1; i < len(ivs); i++ {
+			if ivs[i-1].End.Cmp(ivs[i].Start) >= 0 {
+				t.Fatalf("round %d: %v is not sorted and merged", round, ivs)
+			}
+		}
+	}
+}
+
+func TestContiguousFrom(t *testing.T) {
+	s := set(1, 10, 20, 30)
+	for _, tt := range []struct{ from, want int64 }{
+		{0, 0},
+		{1, 10},
+		{5, 10},
+		{10, 10},
+		{15, 15},
+		{20, 30},
+		{29, 30},
+		{30, 30},
+	} {
+		if got := s.ContiguousFrom(big.NewInt(tt.from)); got.Int64() != tt.want {
+			t.Errorf("ContiguousFrom(%d) = %s, want %d", tt.from, got, tt.want)
+		}
+	}
+}
+
+// TestCopies checks that a set shares no values with its callers.
+func TestCopies(t *testing.T) {
+	start, end := big.NewInt(1), big.NewInt(10)
+	s := &Set{}
+	s.Add(start, end)
+	start.SetInt64(100)
+	end.SetInt64(200)
+	s.Intervals()[0].End.SetInt64(300)
+	s.ContiguousFrom(big.NewInt(1)).SetInt64(400)
+	if got := fmt.Sprint(s.Intervals()); got != "[{1 10}]" {
+		t.Errorf("got %s, want [{1 10}]", got)
+	}
+}
+
+func TestInterval(t *testing.T) {
+	iv := func(start, end int64) Interval {
+		return Interval{Start: big.NewInt(start), End: big.NewInt(end)}
+	}
+	for _, tt := range []struct {
+		a, b    Interval
+		touches bool
+		union   string
+	}{
+		{iv(1, 10), iv(10, 20), true, "{1 20}"},
+		{iv(10, 20), iv(1, 10), true, "{1 20}"},
+		{iv(1, 10), iv(11, 20), false, "{1 20}"},
+		{iv(1, 20), iv(5, 6), true, "{1 20}"},
+	} {
+		if got := tt.a.Touches(tt.b); got != tt.touches {
+			t.Errorf("%v.Touches(%v) = %v", tt.a, tt.b, got)
+		}
+		if got := fmt.Sprint(tt.a.Union(tt.b)); got != tt.union {
+			t.Errorf("%v.Union(%v) = %s, want %s", tt.a, tt.b, got, tt.union)
+		}
+	}
+	if got := iv(5, 12).Size().Int64(); got != 7 {
+		t.Errorf("Size() = %d, want 7", got)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package keyring seals small secrets with AES-256-GCM under a set of
+// named master keys.  New values are sealed with the primary key;
+// values sealed with any key in the ring can be opened, so keys can be
+// rotated by adding a new primary and resealing.
+package keyring
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KeySize is the size of a master key, in bytes.
+const KeySize = 32
+
+// prefix marks a sealed value.  Values without it are plaintext,
+// written before encryption was enabled.
+const prefix = "sealed:v1:"
+
+// Keyring holds master keys by ID.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// New returns an empty keyring.
+func New() *Keyring {
+	return &Keyring{keys: map[string]cipher.AEAD{}}
+}
+
+// Add adds a key.  The first key added is the primary until SetPrimary
+// is called.
+func (k *Keyring) Add(id string, key []byte) error {
+	if id == "" || strings.Contains(id, ":") {
+		return fmt.Errorf("invalid key ID %q", id)
+	}
+	if len(key) != KeySize {
+		return fmt.Errorf("key %s is %d bytes, not %d", id, len(key), KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.keys[id] = aead
+	if k.primary == "" {
+		k.primary = id
+	}
+	return nil
+}
+
+// SetPrimary selects the key used to seal new values.
+func (k *Keyring) SetPrimary(id string) error {
+	if _, found := k.keys[id]; !found {
+		return fmt.Errorf("primary key %q is not in the keyring", id)
+	}
+	k.primary = id
+	return nil
+}
+
+// Primary returns the ID of the key used to seal new values.
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// Seal encrypts plaintext with the primary key.  The context, such as
+// the owner of the secret, must be given again to Open, so sealed
+// values cannot be swapped between records.
+func (k *Keyring) Seal(plaintext, context string) (string, error) {
+	aead, found := k.keys[k.primary]
+	if !found {
+		return "", errors.New("keyring is empty")
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(context))
+	return prefix + k.primary + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value from Seal.  Values which are not sealed are
+// returned unchanged.
+func (k *Keyring) Open(value, context string) (string, error) {
+	if !IsSealed(value) {
+		return value, nil
+	}
+	id, data, _ := strings.Cut(strings.TrimPrefix(value, prefix), ":")
+	aead, found := k.keys[id]
+	if !found {
+		return "", fmt.Errorf("value is sealed with key %q, which is not in the keyring", id)
+	}
+	b, err := base64.RawStdEncoding.DecodeString(data)
+	if err != nil || len(b) < aead.NonceSize() {
+		return "", errors.New("malformed sealed value")
+	}
+	plaintext, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(context))
+	if err != nil {
+		return "", fmt.Errorf("cannot open value sealed with key %q: %v", id, err)
+	}
+	return string(plaintext), nil
+}
+
+// IsSealed returns true if value came from Seal.
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// KeyID returns the ID of the key a value was sealed with, or "" if it
+// is not sealed.
+func KeyID(value string) string {
+	if !IsSealed(value) {
+		return ""
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(value, prefix), ":")
+	return id
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package localstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/skandragon/collatz/internal"
+)
+
+// Encoding is how values are written to the store.  Values in either
+// encoding are read, so the encoding may be changed at any time.
+type Encoding string
+
+const (
+	// EncodingCBOR writes values as CBOR (RFC 8949), which takes
+	// about a third less space than JSON, mostly for big integers and
+	// histograms, and so less disk churn for nodes checkpointing often.
+	EncodingCBOR Encoding = "cbor"
+
+	// EncodingJSON writes values as bare JSON, as clients did before
+	// there was a choice, so their stores can be read by those
+	// clients again.
+	EncodingJSON Encoding = "json"
+)
+
+// Each encoded value starts with a byte saying how it is encoded.
+// JSON values are objects, so theirs is '{'.
+const (
+	formatJSON  byte = '{'
+	formatCBOR1 byte = 0x01
+)
+
+var (
+	cborEnc cbor.EncMode
+	cborDec cbor.DecMode
+)
+
+func init() {
+	var err error
+	// Times keep their nanoseconds and zone, as they do in JSON.
+	cborEnc, err = cbor.EncOptions{
+		Time:          cbor.TimeRFC3339Nano,
+		BigIntConvert: cbor.BigIntConvertShortest,
+	}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	cborDec, err = cbor.DecOptions{}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// ParseEncoding returns the encoding named, which "" defaults to CBOR.
+func ParseEncoding(name string) (Encoding, error) {
+	switch e := Encoding(name); e {
+	case "":
+		return EncodingCBOR, nil
+	case EncodingCBOR, EncodingJSON:
+		return e, nil
+	}
+	return "", fmt.Errorf("unknown encoding %q; must be %q or %q", name, EncodingCBOR, EncodingJSON)
+}
+
+// format returns the first byte of values in the encoding.
+func (e Encoding) format() byte {
+	if e == EncodingJSON {
+		return formatJSON
+	}
+	return formatCBOR1
+}
+
+// encode returns v in the encoding.
+func (e Encoding) encode(v any) ([]byte, error) {
+	if e == EncodingJSON {
+		return json.Marshal(v)
+	}
+	b, err := cborEnc.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{formatCBOR1}, b...), nil
+}
+
+// decode decodes b, in whichever encoding it was written, into v.
+func decode(b []byte, v any) error {
+	if len(b) == 0 {
+		return fmt.Errorf("empty value")
+	}
+	switch b[0] {
+	case formatJSON:
+		return json.Unmarshal(b, v)
+	case formatCBOR1:
+		return cborDec.Unmarshal(b[1:], v)
+	}
+	return fmt.Errorf("unknown encoding %#02x; was it written by a newer client?", b[0])
+}
+
+// reencodeBatch bounds the values rewritten in one transaction.
+const reencodeBatch = 1000
+
+// Reencode rewrites every value not in the store's encoding, returning
+// how many it rewrote.  Values are otherwise only rewritten as they
+// change, so this lets a store be handed back to an older client after
+// going back to JSON.
+func (s *Store) Reencode() (int, error) {
+	total := 0
+	for _, fn := range []func(*Store) (int, error){
+		reencodeBucket[Checkpoint](checkpointsBucket),
+		reencodeBucket[internal.WorkProgressReport](spoolBucket),
+		reencodeBucket[internal.Receipt](receiptsBucket),
+		reencodeBucket[Completed](completedBucket),
+	} {
+		n, err := fn(s)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// reencodeBucket returns a function rewriting the values of a bucket
+// holding Ts, reencodeBatch to a transaction.
+func reencodeBucket[T any](bucket []byte) func(*Store) (int, error) {
+	return func(s *Store) (int, error) {
+		total := 0
+		var after []byte
+		for {
+			n, last, err := reencodeBatchAfter[T](s, bucket, after)
+			total += n
+			if err != nil || last == nil {
+				return total, err
+			}
+			after = last
+		}
+	}
+}
+
+// reencodeBatchAfter rewrites up to reencodeBatch values with keys after
+// the one given, returning how many it rewrote, and the last key it
+// rewrote, or nil if it reached the end of the bucket.
+func reencodeBatchAfter[T any](s *Store, bucket []byte, after []byte) (int, []byte, error) {
+	type rewrite struct{ k, v []byte }
+	var rewrites []rewrite
+	var last []byte
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		c := b.Cursor()
+		k, v := c.First()
+		if after != nil {
+			k, v = c.Seek(after)
+			if bytes.Equal(k, after) {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil; k, v = c.Next() {
+			if len(v) > 0 && v[0] == s.encoding.format() {
+				continue
+			}
+			var item T
+			if err := decode(v, &item); err != nil {
+				return fmt.Errorf("%s/%s: %v", bucket, k, err)
+			}
+			enc, err := s.encoding.encode(item)
+			if err != nil {
+				return err
+			}
+			rewrites = append(rewrites, rewrite{append([]byte{}, k...), enc})
+			if len(rewrites) == reencodeBatch {
+				last = rewrites[len(rewrites)-1].k
+				break
+			}
+		}
+		for _, r := range rewrites {
+			if err := b.Put(r.k, r.v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return len(rewrites), last, nil
+}
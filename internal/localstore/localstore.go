@@ -0,0 +1,334 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package localstore holds the crunch client's durable state in a
+// single embedded key-value database: node identity, per-packet
+// checkpoints, spooled reports, receipts, and completed work.  Every
+// write is a transaction synced to disk before it returns.  Values are
+// written in the store's Encoding.
+package localstore
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	metaBucket        = []byte("meta")
+	checkpointsBucket = []byte("checkpoints")
+	spoolBucket       = []byte("spool")
+	receiptsBucket    = []byte("receipts")
+	completedBucket   = []byte("completed")
+
+	nodeIDKey = []byte("nodeID")
+)
+
+// Checkpoint records a packet a worker has started, and how far it got.
+type Checkpoint struct {
+	Work      internal.WorkPacket `json:"work"`
+	WorkerID  int                 `json:"workerID"`
+	StartedOn time.Time           `json:"startedOn"`
+
+	// TraceParent, if set, is the trace context of the claim which
+	// fetched the packet, so its whole lifecycle is one trace.
+	TraceParent string `json:"traceParent,omitempty"`
+
+	// Position is the next candidate to test.  The fields below it
+	// hold the results for candidates before Position.
+	Position *big.Int `json:"position,omitempty"`
+
+	TotalIterations    uint64     `json:"totalIterations,omitempty"`
+	MaxIterations      uint64     `json:"maxIterations,omitempty"`
+	MaxIterationsValue *big.Int   `json:"maxIterationsValue,omitempty"`
+	Histogram          []uint64   `json:"histogram,omitempty"`
+	Interesting        []*big.Int `json:"interesting,omitempty"`
+	Skipped            []*big.Int `json:"skipped,omitempty"`
+
+	// ChallengeResponses answer the packet's challenges reached so far.
+	ChallengeResponses []internal.ChallengeResponse `json:"challengeResponses,omitempty"`
+
+	// JournaledOn is when Position was last advanced.
+	JournaledOn time.Time `json:"journaledOn,omitempty"`
+}
+
+// Completed summarizes a packet we finished.
+type Completed struct {
+	PacketID      string                `json:"packetID"`
+	StartingValue *big.Int              `json:"startingValue"`
+	EndingValue   *big.Int              `json:"endingValue"`
+	StartedOn     time.Time             `json:"startedOn"`
+	CompletedOn   time.Time             `json:"completedOn"`
+	Evidence      internal.WorkEvidence `json:"evidence"`
+
+	// MaxIterationsValue is the first candidate taking
+	// Evidence.MaxIterations, and Interesting lists any candidates
+	// which looped.
+	MaxIterationsValue *big.Int   `json:"maxIterationsValue,omitempty"`
+	Interesting        []*big.Int `json:"interesting,omitempty"`
+
+	// WorkerID and Engine record which worker ran the packet, and how.
+	WorkerID int    `json:"workerID"`
+	Engine   string `json:"engine,omitempty"`
+}
+
+// Duration is how long the packet took, in server time.
+func (c *Completed) Duration() time.Duration {
+	return c.CompletedOn.Sub(c.StartedOn)
+}
+
+// Store is the client's local database.  Only one process may have it
+// open at a time.
+type Store struct {
+	db       *bolt.DB
+	encoding Encoding
+}
+
+// Open opens, creating if needed, the database at filename, writing
+// values in the encoding given.
+func Open(filename string, encoding Encoding) (*Store, error) {
+	db, err := bolt.Open(filename, 0o600, &bolt.Options{Timeout: 2 * time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%s is locked; is another crunch running?", filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{metaBucket, checkpointsBucket, spoolBucket, receiptsBucket, completedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db, encoding: encoding}, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) put(bucket []byte, key string, v any) error {
+	b, err := s.encoding.encode(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), b)
+	})
+}
+
+func (s *Store) delete(bucket []byte, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	})
+}
+
+// each decodes every value in a bucket, in key order, calling fn
+// with a pointer to a freshly decoded T.
+func each[T any](s *Store, bucket []byte, fn func(*T)) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			var item T
+			if err := decode(v, &item); err != nil {
+				return fmt.Errorf("%s/%s: %v", bucket, k, err)
+			}
+			fn(&item)
+			return nil
+		})
+	})
+}
+
+// NodeID returns the stored node ID, or "" if none is set.
+func (s *Store) NodeID() (string, error) {
+	var id string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id = string(tx.Bucket(metaBucket).Get(nodeIDKey))
+		return nil
+	})
+	return id, err
+}
+
+// SetNodeID stores the node ID.
+func (s *Store) SetNodeID(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(nodeIDKey, []byte(id))
+	})
+}
+
+// PutCheckpoint creates or replaces the checkpoint for a packet.
+func (s *Store) PutCheckpoint(c Checkpoint) error {
+	return s.put(checkpointsBucket, c.Work.ID, c)
+}
+
+// Checkpoint returns the checkpoint for a packet, or nil if there is none.
+func (s *Store) Checkpoint(packetID string) (*Checkpoint, error) {
+	var ret *Checkpoint
+	err := get(s, checkpointsBucket, packetID, &ret)
+	return ret, err
+}
+
+// DeleteCheckpoint removes the checkpoint for a packet.
+func (s *Store) DeleteCheckpoint(packetID string) error {
+	return s.delete(checkpointsBucket, packetID)
+}
+
+// Checkpoints returns all packets which were started but not finished.
+func (s *Store) Checkpoints() ([]Checkpoint, error) {
+	ret := []Checkpoint{}
+	err := each(s, checkpointsBucket, func(c *Checkpoint) { ret = append(ret, *c) })
+	return ret, err
+}
+
+// SpoolReport saves a report which must be delivered to the server.
+func (s *Store) SpoolReport(r internal.WorkProgressReport) error {
+	return s.put(spoolBucket, r.Work.ID, r)
+}
+
+// UnspoolReport removes a delivered report.
+func (s *Store) UnspoolReport(packetID string) error {
+	return s.delete(spoolBucket, packetID)
+}
+
+// SpooledReports returns all reports awaiting delivery.
+func (s *Store) SpooledReports() ([]internal.WorkProgressReport, error) {
+	ret := []internal.WorkProgressReport{}
+	err := each(s, spoolBucket, func(r *internal.WorkProgressReport) { ret = append(ret, *r) })
+	return ret, err
+}
+
+// SpoolDepth returns the number of reports awaiting delivery.
+func (s *Store) SpoolDepth() (int, error) {
+	n := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(spoolBucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+// AddReceipt stores a receipt from the server.  Adding a receipt we
+// already hold replaces it.
+func (s *Store) AddReceipt(r internal.Receipt) error {
+	return s.put(receiptsBucket, r.PacketID, r)
+}
+
+// HasReceipt returns true if we hold a receipt for the packet.
+func (s *Store) HasReceipt(packetID string) (bool, error) {
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(receiptsBucket).Get([]byte(packetID)) != nil
+		return nil
+	})
+	return found, err
+}
+
+// Receipts returns all receipts, ordered by acceptance time.
+func (s *Store) Receipts() ([]internal.Receipt, error) {
+	ret := []internal.Receipt{}
+	err := each(s, receiptsBucket, func(r *internal.Receipt) { ret = append(ret, *r) })
+	sortBy(ret, func(r internal.Receipt) time.Time { return r.AcceptedOn })
+	return ret, err
+}
+
+// Finished is a packet we finished, and the report to spool for it.
+type Finished struct {
+	Completed Completed
+	Report    internal.WorkProgressReport
+}
+
+// AddFinished records packets we finished, removes their checkpoints,
+// and spools their reports, all in one transaction.
+func (s *Store) AddFinished(batch []Finished) error {
+	type encoded struct{ id, completed, report []byte }
+	entries := make([]encoded, 0, len(batch))
+	for _, f := range batch {
+		c, err := s.encoding.encode(f.Completed)
+		if err != nil {
+			return err
+		}
+		r, err := s.encoding.encode(f.Report)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, encoded{[]byte(f.Completed.PacketID), c, r})
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, e := range entries {
+			if err := tx.Bucket(completedBucket).Put(e.id, e.completed); err != nil {
+				return err
+			}
+			if err := tx.Bucket(checkpointsBucket).Delete(e.id); err != nil {
+				return err
+			}
+			if err := tx.Bucket(spoolBucket).Put(e.id, e.report); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Completed returns all packets we finished, ordered by completion time.
+func (s *Store) Completed() ([]Completed, error) {
+	ret := []Completed{}
+	err := each(s, completedBucket, func(c *Completed) { ret = append(ret, *c) })
+	sortBy(ret, func(c Completed) time.Time { return c.CompletedOn })
+	return ret, err
+}
+
+// CompletedPacket returns the summary of a packet we finished, or nil
+// if there is none.
+func (s *Store) CompletedPacket(packetID string) (*Completed, error) {
+	var ret *Completed
+	err := get(s, completedBucket, packetID, &ret)
+	return ret, err
+}
+
+// Receipt returns the receipt for a packet, or nil if there is none.
+func (s *Store) Receipt(packetID string) (*internal.Receipt, error) {
+	var ret *internal.Receipt
+	err := get(s, receiptsBucket, packetID, &ret)
+	return ret, err
+}
+
+// get decodes the item at key into a new T, leaving *dest nil if
+// it does not exist.
+func get[T any](s *Store, bucket []byte, key string, dest **T) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket).Get([]byte(key))
+		if b == nil {
+			return nil
+		}
+		*dest = new(T)
+		return decode(b, *dest)
+	})
+}
+
+func sortBy[T any](items []T, key func(T) time.Time) {
+	sort.SliceStable(items, func(i, j int) bool { return key(items[i]).Before(key(items[j])) })
+}
@@ -0,0 +1,294 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logging
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileConfig writes the log to a file, rotated by size and age, so a
+// node left running for months does not fill its disk.  OpenFile
+// writes other output to files the same way.
+type FileConfig struct {
+	// Path is the log file.  Rotated files are kept beside it, named
+	// for when they were rotated, as "crunch-20060102T150405.000.log".
+	Path string `yaml:"path"`
+
+	// MaxSize is the size, in megabytes, at which the file is
+	// rotated.  The default is 100.
+	MaxSize int64 `yaml:"maxSize,omitempty"`
+
+	// MaxAge is how long a file is written before it is rotated,
+	// however small.  The age counts from when the file was opened,
+	// so a restart starts it over.  The default is 24h.
+	MaxAge time.Duration `yaml:"maxAge,omitempty"`
+
+	// MaxBackups is how many rotated files are kept.  The default is 5.
+	MaxBackups int `yaml:"maxBackups,omitempty"`
+
+	// Retain, if set, removes rotated files older than this, even if
+	// there are fewer than MaxBackups.
+	Retain time.Duration `yaml:"retain,omitempty"`
+
+	// Compress gzips rotated files, as "crunch-20060102T150405.000.log.gz".
+	// It is done in the background, so writes are not held up.
+	Compress bool `yaml:"compress,omitempty"`
+}
+
+// ApplyDefaults checks the config and fills in defaults.
+func (c *FileConfig) ApplyDefaults() error {
+	if c.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if c.MaxSize < 0 || c.MaxAge < 0 || c.MaxBackups < 0 || c.Retain < 0 {
+		return fmt.Errorf("limits cannot be negative")
+	}
+	if c.MaxSize == 0 {
+		c.MaxSize = 100
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = 24 * time.Hour
+	}
+	if c.MaxBackups == 0 {
+		c.MaxBackups = 5
+	}
+	return nil
+}
+
+// rotateLayout names rotated files.  It sorts by time.  Milliseconds
+// keep apart files rotated within a second of each other; parsing
+// with rotateLayout accepts names with or without them.
+const (
+	rotateLayout       = "20060102T150405"
+	rotateLayoutMillis = rotateLayout + ".000"
+)
+
+// compressedExt is added to the names of rotated files compressed.
+const compressedExt = ".gz"
+
+// rotatingFile is an io.Writer appending to a file, rotating it when
+// it grows too large or too old.
+type rotatingFile struct {
+	sync.Mutex
+	config   *FileConfig
+	f        *os.File
+	size     int64
+	openedOn time.Time
+
+	// compressing is held while rotated files are compressed.
+	compressing sync.Mutex
+}
+
+// OpenFile opens c's file for appending, creating its directory if
+// need be.  Writes to it are rotated as c says.  Defaults must have
+// been applied to c.
+func OpenFile(c *FileConfig) (io.WriteCloser, error) {
+	r := &rotatingFile{config: c}
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	if c.Compress {
+		go r.compressRotated()
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.openedOn = f, info.Size(), time.Now()
+	return nil
+}
+
+// Write appends p, rotating first if need be.  If rotation fails, the
+// current file is written to regardless, as losing logs is worse than
+// a large file.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.size > 0 && (r.size+int64(len(p)) > r.config.MaxSize<<20 || time.Since(r.openedOn) > r.config.MaxAge) {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot rotate log file %s: %v\n", r.config.Path, err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the file.
+func (r *rotatingFile) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.f.Close()
+}
+
+// rotate renames the current file aside, opens a new one, and removes
+// rotated files beyond the retention limits.  If rotated files are
+// compressed, that is done in the background, and they are pruned
+// after.  The lock must be held.
+func (r *rotatingFile) rotate() error {
+	base, ext := r.names()
+	rotated := fmt.Sprintf("%s-%s%s", base, time.Now().UTC().Format(rotateLayoutMillis), ext)
+	if err := os.Rename(r.config.Path, rotated); err != nil {
+		return err
+	}
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	if r.config.Compress {
+		go r.compressRotated()
+		return nil
+	}
+	return r.prune()
+}
+
+// names returns the path without its extension, and the extension,
+// which rotated files are named between.
+func (r *rotatingFile) names() (base, ext string) {
+	ext = filepath.Ext(r.config.Path)
+	return strings.TrimSuffix(r.config.Path, ext), ext
+}
+
+// compressRotated compresses every rotated file not yet compressed,
+// including any left by an earlier run, then prunes.  Only one runs at
+// a time.
+func (r *rotatingFile) compressRotated() {
+	r.compressing.Lock()
+	defer r.compressing.Unlock()
+	base, ext := r.names()
+	matches, err := filepath.Glob(base + "-*" + ext)
+	if err == nil {
+		for _, name := range matches {
+			if _, ok := r.rotatedOn(name); !ok || strings.HasSuffix(name, compressedExt) {
+				continue
+			}
+			if err := compress(name); err != nil {
+				fmt.Fprintf(os.Stderr, "cannot compress %s: %v\n", name, err)
+			}
+		}
+	}
+	if err := r.prune(); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot remove old files beside %s: %v\n", r.config.Path, err)
+	}
+}
+
+// compress replaces name with a gzipped copy.  A partial copy, left
+// by an earlier run, is replaced.
+func compress(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name+compressedExt, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Remove(name)
+}
+
+// rotatedOn returns when name was rotated, or false if it is not a
+// rotated file of ours.
+func (r *rotatingFile) rotatedOn(name string) (time.Time, bool) {
+	base, ext := r.names()
+	stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, base+"-"), compressedExt), ext)
+	t, err := time.Parse(rotateLayout, stamp)
+	return t, err == nil
+}
+
+// prune removes the oldest rotated files beyond MaxBackups, and any
+// older than Retain.  A file and its compressed copy count as one.
+func (r *rotatingFile) prune() error {
+	base, ext := r.names()
+	matches, err := filepath.Glob(base + "-*" + ext)
+	if err != nil {
+		return err
+	}
+	compressed, err := filepath.Glob(base + "-*" + ext + compressedExt)
+	if err != nil {
+		return err
+	}
+	type backup struct {
+		names     []string
+		rotatedOn time.Time
+	}
+	byStamp := map[time.Time]*backup{}
+	for _, name := range append(matches, compressed...) {
+		t, ok := r.rotatedOn(name)
+		if !ok {
+			// not one of ours
+			continue
+		}
+		if byStamp[t] == nil {
+			byStamp[t] = &backup{rotatedOn: t}
+		}
+		byStamp[t].names = append(byStamp[t].names, name)
+	}
+	backups := []*backup{}
+	for _, b := range byStamp {
+		backups = append(backups, b)
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].rotatedOn.After(backups[j].rotatedOn) })
+	for i, b := range backups {
+		if i < r.config.MaxBackups && (r.config.Retain == 0 || time.Since(b.rotatedOn) <= r.config.Retain) {
+			continue
+		}
+		for _, name := range b.names {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
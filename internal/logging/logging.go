@@ -0,0 +1,127 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package logging configures the structured logger shared by the
+// commands.
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Config selects the log format and level.
+type Config struct {
+	// Format is "text" (the default) or "json".
+	Format string `yaml:"format,omitempty"`
+
+	// Level is "debug", "info" (the default), "warn", or "error".
+	Level string `yaml:"level,omitempty"`
+
+	// File, if set, writes the log to a rotated file rather than to
+	// stderr.
+	File *FileConfig `yaml:"file,omitempty"`
+}
+
+// Validate checks the format and level, and the file config if any,
+// filling in its defaults.
+func (c Config) Validate() error {
+	switch c.Format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("logging.format must be text or json, not %q", c.Format)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.level())); err != nil {
+		return fmt.Errorf("logging.level: %v", err)
+	}
+	if c.File != nil {
+		if err := c.File.ApplyDefaults(); err != nil {
+			return fmt.Errorf("logging.file: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c Config) level() string {
+	if c.Level == "" {
+		return "info"
+	}
+	return strings.ToLower(c.Level)
+}
+
+// New returns a logger writing to w.
+func New(c Config, w io.Writer) (*slog.Logger, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	var level slog.Level
+	_ = level.UnmarshalText([]byte(c.level()))
+	opts := &slog.HandlerOptions{Level: level}
+	if c.Format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return slog.New(slog.NewTextHandler(w, opts)), nil
+}
+
+// Setup makes a logger writing to stderr, or to the configured file,
+// the default, so both slog and the standard log package use it.  Every line carries a run ID,
+// so lines from one run can be told apart from those of another, and
+// the campaign if it is set.
+func Setup(c Config, campaign string) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	var w io.Writer = os.Stderr
+	if c.File != nil {
+		f, err := OpenFile(c.File)
+		if err != nil {
+			return fmt.Errorf("cannot open log file: %w", err)
+		}
+		w = f
+	}
+	logger, err := New(c, w)
+	if err != nil {
+		return err
+	}
+	logger = logger.With("run", runID())
+	if campaign != "" {
+		logger = logger.With("campaign", campaign)
+	}
+	log.SetFlags(0)
+	slog.SetDefault(logger)
+	return nil
+}
+
+func runID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Fatal logs an error and exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,306 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package natshttp carries the work API over NATS request and reply,
+// for those coordinating a LAN of nodes through a NATS server rather
+// than exposing the HTTP listener.  An HTTP request to a path is sent
+// to the subject made from the path's segments after a prefix, so
+// "/api/v1/claim" is "collatz.api.v1.claim", with the request's
+// headers and body; the reply carries the response's status, headers,
+// and body.  The server answers with the same handler it serves over
+// HTTP, so authentication, throttling, and everything else are as
+// they are there, but for every client sharing one address.
+package natshttp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Scheme is the URL scheme of a work server reached over NATS, as in
+// "nats://nats.example.com:4222/collatz", whose path is the subject
+// prefix.
+const Scheme = "nats"
+
+// DefaultPrefix is the subject prefix if the URL has no path.
+const DefaultPrefix = "collatz"
+
+// Headers carrying what an HTTP request or response has besides its
+// headers and body.
+const (
+	methodHeader = "Collatz-Method"
+	queryHeader  = "Collatz-Query"
+	statusHeader = "Collatz-Status"
+)
+
+// RemoteAddr is the RemoteAddr of every request served.  The NATS
+// server does not tell us who sent a message, and what a client says
+// of itself cannot be trusted, so clients share this address as those
+// behind a proxy share the proxy's.  Handlers should not throttle or
+// lock out by it, as one client would be throttling them all.
+const RemoteAddr = "nats"
+
+// maxInFlight bounds the requests a server handles at once.  Beyond
+// it, messages wait in the subscription, and once it is full, the
+// NATS client drops them and their senders time out.
+const maxInFlight = 64
+
+// IsURL reports whether rawURL names a server reached over NATS.
+func IsURL(rawURL string) bool {
+	return strings.HasPrefix(rawURL, Scheme+"://")
+}
+
+// Parse returns the NATS server's URL, without its path, and the
+// subject prefix rawURL names.
+func Parse(rawURL string) (server string, prefix string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != Scheme || u.Host == "" {
+		return "", "", fmt.Errorf("%q is not a %s:// URL", rawURL, Scheme)
+	}
+	prefix = strings.Trim(u.Path, "/")
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	if !validSubject(prefix) {
+		return "", "", fmt.Errorf("%q is not a valid subject prefix", prefix)
+	}
+	u.Path, u.RawPath, u.RawQuery, u.Fragment = "", "", "", ""
+	return u.String(), prefix, nil
+}
+
+// validSubject reports whether s is a subject without wildcards.
+func validSubject(s string) bool {
+	for _, token := range strings.Split(s, ".") {
+		if token == "" || token == "*" || token == ">" || strings.ContainsAny(token, " \t\r\n") {
+			return false
+		}
+	}
+	return true
+}
+
+// subject returns the subject path is sent to.
+func subject(prefix, path string) (string, error) {
+	s := prefix + "." + strings.ReplaceAll(strings.Trim(path, "/"), "/", ".")
+	if !validSubject(s) {
+		return "", fmt.Errorf("path %q cannot be sent over NATS", path)
+	}
+	return s, nil
+}
+
+// Transport is an http.RoundTripper sending requests over NATS.  It
+// connects when it is first used, so a server not yet up is reported
+// as any request error is.
+type Transport struct {
+	rawURL string
+	name   string
+
+	sync.Mutex
+	conn   *nats.Conn
+	prefix string
+}
+
+// NewTransport returns a Transport to the server rawURL names.  The
+// connection is named name, as the NATS server's monitoring shows it.
+func NewTransport(rawURL, name string) *Transport {
+	return &Transport{rawURL: rawURL, name: name}
+}
+
+// connection returns the connection, connecting if need be.  Once
+// connected, the client reconnects as the server comes and goes.
+func (t *Transport) connection() (*nats.Conn, string, error) {
+	t.Lock()
+	defer t.Unlock()
+	if t.conn != nil {
+		return t.conn, t.prefix, nil
+	}
+	server, prefix, err := Parse(t.rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	conn, err := nats.Connect(server, nats.Name(t.name), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, "", err
+	}
+	t.conn, t.prefix = conn, prefix
+	return conn, prefix, nil
+}
+
+// basePath is the path of the URL the client was given, which precedes
+// that of each request.
+func (t *Transport) basePath() string {
+	u, err := url.Parse(t.rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	conn, prefix, err := t.connection()
+	if err != nil {
+		return nil, err
+	}
+	subj, err := subject(prefix, strings.TrimPrefix(req.URL.Path, t.basePath()))
+	if err != nil {
+		return nil, err
+	}
+	msg := nats.NewMsg(subj)
+	if req.Body != nil {
+		msg.Data, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for name, values := range req.Header {
+		msg.Header[name] = values
+	}
+	msg.Header.Set(methodHeader, req.Method)
+	if req.URL.RawQuery != "" {
+		msg.Header.Set(queryHeader, req.URL.RawQuery)
+	}
+	reply, err := conn.RequestMsgWithContext(req.Context(), msg)
+	if errors.Is(err, nats.ErrNoResponders) {
+		return nil, fmt.Errorf("no server is answering on %s", subj)
+	}
+	if err != nil {
+		return nil, err
+	}
+	code, err := strconv.Atoi(reply.Header.Get(statusHeader))
+	if err != nil {
+		return nil, fmt.Errorf("reply on %s has no status", subj)
+	}
+	header := http.Header(reply.Header)
+	header.Del(statusHeader)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(reply.Data)),
+		ContentLength: int64(len(reply.Data)),
+		Request:       req,
+	}, nil
+}
+
+// Serve answers requests sent to prefix's subjects with h until ctx is
+// done.  Every server in queue shares the requests, each handling at
+// most maxInFlight at once.  Every request's RemoteAddr is RemoteAddr.
+func Serve(ctx context.Context, conn *nats.Conn, prefix, queue string, h http.Handler) error {
+	inFlight := make(chan struct{}, maxInFlight)
+	sub, err := conn.QueueSubscribe(prefix+".>", queue, func(m *nats.Msg) {
+		inFlight <- struct{}{}
+		go func() {
+			defer func() { <-inFlight }()
+			serveMsg(ctx, prefix, h, m)
+		}()
+	})
+	if err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return sub.Drain()
+}
+
+func serveMsg(ctx context.Context, prefix string, h http.Handler, m *nats.Msg) {
+	if m.Reply == "" {
+		// a publish, not a request, so there is no one to answer
+		return
+	}
+	path := "/" + strings.ReplaceAll(strings.TrimPrefix(m.Subject, prefix+"."), ".", "/")
+	w := &response{header: http.Header{}}
+	r, err := newRequest(ctx, path, m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else {
+		h.ServeHTTP(w, r)
+	}
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	reply := nats.NewMsg(m.Reply)
+	for name, values := range w.header {
+		reply.Header[name] = values
+	}
+	reply.Header.Set(statusHeader, strconv.Itoa(w.code))
+	reply.Data = w.body.Bytes()
+	if err := m.RespondMsg(reply); err != nil {
+		slog.Warn("cannot reply over NATS", "subject", m.Subject, "err", err)
+	}
+}
+
+// newRequest returns the HTTP request m carries.
+func newRequest(ctx context.Context, path string, m *nats.Msg) (*http.Request, error) {
+	method := m.Header.Get(methodHeader)
+	if method == "" {
+		method = http.MethodPost
+	}
+	target := path
+	if q := m.Header.Get(queryHeader); q != "" {
+		target += "?" + q
+	}
+	r, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(m.Data))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range m.Header {
+		r.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	for _, name := range []string{methodHeader, queryHeader} {
+		r.Header.Del(name)
+	}
+	r.RequestURI = target
+	r.RemoteAddr = RemoteAddr
+	return r, nil
+}
+
+// response collects the response to a request.
+type response struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *response) Header() http.Header {
+	return w.header
+}
+
+func (w *response) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *response) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
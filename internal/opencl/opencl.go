@@ -0,0 +1,367 @@
+//go:build opencl && cgo
+
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package opencl runs the limbs kernel, which follows Collatz
+// trajectories in four 64-bit limbs, on GPUs through OpenCL.  It is
+// built only with -tags opencl, and needs cgo and libOpenCL.
+package opencl
+
+/*
+#cgo LDFLAGS: -lOpenCL
+#include <stdint.h>
+#include <stdlib.h>
+
+// The little of the OpenCL 1.2 API we use, declared here so that the
+// headers are not needed to build, only the library to link.
+typedef int32_t cl_int;
+typedef uint32_t cl_uint;
+typedef uint64_t cl_ulong;
+typedef cl_ulong cl_bitfield;
+typedef cl_uint cl_bool;
+typedef struct _cl_platform_id *cl_platform_id;
+typedef struct _cl_device_id *cl_device_id;
+typedef struct _cl_context *cl_context;
+typedef struct _cl_command_queue *cl_command_queue;
+typedef struct _cl_mem *cl_mem;
+typedef struct _cl_program *cl_program;
+typedef struct _cl_kernel *cl_kernel;
+typedef struct _cl_event *cl_event;
+typedef intptr_t cl_context_properties;
+
+#define CL_SUCCESS 0
+#define CL_DEVICE_NOT_FOUND -1
+#define CL_TRUE 1
+#define CL_DEVICE_TYPE_GPU (1 << 2)
+#define CL_PLATFORM_NAME 0x0902
+#define CL_DEVICE_MAX_COMPUTE_UNITS 0x1002
+#define CL_DEVICE_GLOBAL_MEM_SIZE 0x101F
+#define CL_DEVICE_NAME 0x102B
+#define CL_DEVICE_VENDOR 0x102C
+#define CL_DEVICE_VERSION 0x102F
+#define CL_MEM_WRITE_ONLY (1 << 1)
+#define CL_MEM_READ_ONLY (1 << 2)
+#define CL_PROGRAM_BUILD_LOG 0x1183
+
+extern cl_int clGetPlatformIDs(cl_uint, cl_platform_id *, cl_uint *);
+extern cl_int clGetPlatformInfo(cl_platform_id, cl_uint, size_t, void *, size_t *);
+extern cl_int clGetDeviceIDs(cl_platform_id, cl_bitfield, cl_uint, cl_device_id *, cl_uint *);
+extern cl_int clGetDeviceInfo(cl_device_id, cl_uint, size_t, void *, size_t *);
+extern cl_context clCreateContext(const cl_context_properties *, cl_uint, const cl_device_id *,
+	void (*)(const char *, const void *, size_t, void *), void *, cl_int *);
+extern cl_command_queue clCreateCommandQueue(cl_context, cl_device_id, cl_bitfield, cl_int *);
+extern cl_program clCreateProgramWithSource(cl_context, cl_uint, const char **, const size_t *, cl_int *);
+extern cl_int clBuildProgram(cl_program, cl_uint, const cl_device_id *, const char *,
+	void (*)(cl_program, void *), void *);
+extern cl_int clGetProgramBuildInfo(cl_program, cl_device_id, cl_uint, size_t, void *, size_t *);
+extern cl_kernel clCreateKernel(cl_program, const char *, cl_int *);
+extern cl_mem clCreateBuffer(cl_context, cl_bitfield, size_t, void *, cl_int *);
+extern cl_int clSetKernelArg(cl_kernel, cl_uint, size_t, const void *);
+extern cl_int clEnqueueWriteBuffer(cl_command_queue, cl_mem, cl_bool, size_t, size_t, const void *,
+	cl_uint, const cl_event *, cl_event *);
+extern cl_int clEnqueueReadBuffer(cl_command_queue, cl_mem, cl_bool, size_t, size_t, void *,
+	cl_uint, const cl_event *, cl_event *);
+extern cl_int clEnqueueNDRangeKernel(cl_command_queue, cl_kernel, cl_uint, const size_t *, const size_t *,
+	const size_t *, cl_uint, const cl_event *, cl_event *);
+extern cl_int clFinish(cl_command_queue);
+extern cl_int clReleaseMemObject(cl_mem);
+
+// Kernel arguments are passed by address, which cgo cannot take of a
+// Go value holding a C pointer without this help.
+static cl_int setMemArg(cl_kernel k, cl_uint i, cl_mem m) {
+	return clSetKernelArg(k, i, sizeof(cl_mem), &m);
+}
+
+static cl_int setULongArg(cl_kernel k, cl_uint i, cl_ulong v) {
+	return clSetKernelArg(k, i, sizeof(cl_ulong), &v);
+}
+
+static cl_program buildSource(cl_context ctx, const char *src, cl_int *err) {
+	return clCreateProgramWithSource(ctx, 1, &src, NULL, err);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// limbStepsKernel is crunch's limbStepsGeneric in OpenCL C, one work
+// item per starting value.  Stops are 0 for the step limit, 1 for
+// below the start, 2 for back at the start, and 3 for an overflow.
+const limbStepsKernel = `
+ulong addc(ulong a, ulong b, ulong *carry) {
+	ulong r = a + b;
+	ulong c = r < a;
+	ulong s = r + *carry;
+	*carry = c | (s < r);
+	return s;
+}
+
+__kernel void limbSteps(__global const ulong *starts, ulong maxSteps,
+		__global ulong *steps, __global uchar *stops) {
+	size_t id = get_global_id(0);
+	ulong s0 = starts[4*id], s1 = starts[4*id+1], s2 = starts[4*id+2], s3 = starts[4*id+3];
+	ulong n0 = s0, n1 = s1, n2 = s2, n3 = s3;
+	ulong count = 0;
+	uchar stop = 0;
+	while (count < maxSteps) {
+		if (n0 & 1) {
+			if (n3 >> 63) {
+				stop = 3;
+				break;
+			}
+			ulong t0 = n0 << 1, t1 = n1 << 1 | n0 >> 63, t2 = n2 << 1 | n1 >> 63, t3 = n3 << 1 | n2 >> 63;
+			ulong carry = 1;
+			t0 = addc(t0, n0, &carry);
+			t1 = addc(t1, n1, &carry);
+			t2 = addc(t2, n2, &carry);
+			t3 = addc(t3, n3, &carry);
+			if (carry) {
+				stop = 3;
+				break;
+			}
+			n0 = t0; n1 = t1; n2 = t2; n3 = t3;
+			count++;
+			continue;
+		}
+		n0 = n0 >> 1 | n1 << 63;
+		n1 = n1 >> 1 | n2 << 63;
+		n2 = n2 >> 1 | n3 << 63;
+		n3 >>= 1;
+		count++;
+		if (n3 != s3) {
+			if (n3 < s3) { stop = 1; break; }
+			continue;
+		}
+		if (n2 != s2) {
+			if (n2 < s2) { stop = 1; break; }
+			continue;
+		}
+		if (n1 != s1) {
+			if (n1 < s1) { stop = 1; break; }
+			continue;
+		}
+		if (n0 != s0) {
+			if (n0 < s0) { stop = 1; break; }
+			continue;
+		}
+		stop = 2;
+		break;
+	}
+	steps[id] = count;
+	stops[id] = stop;
+}
+`
+
+// DeviceInfo describes a GPU found by Probe.
+type DeviceInfo struct {
+	Index        int
+	Platform     string
+	Name         string
+	Vendor       string
+	Version      string
+	ComputeUnits int
+	Memory       uint64
+}
+
+// Device is a GPU opened by Open, with the kernel built for it.
+type Device struct {
+	Info DeviceInfo
+	id   C.cl_device_id
+
+	// sync.Mutex serializes batches; workers do the CPU's share of
+	// the work meanwhile.
+	sync.Mutex
+	queue  C.cl_command_queue
+	ctx    C.cl_context
+	kernel C.cl_kernel
+}
+
+// probed holds the device IDs found by the last probe, by index.
+var probed []C.cl_device_id
+
+// Probe lists the GPUs of every OpenCL platform.
+func Probe() ([]DeviceInfo, error) {
+	var nplatforms C.cl_uint
+	if rc := C.clGetPlatformIDs(0, nil, &nplatforms); rc != C.CL_SUCCESS || nplatforms == 0 {
+		if rc == C.CL_SUCCESS || rc == -1001 { // CL_PLATFORM_NOT_FOUND_KHR
+			return nil, nil
+		}
+		return nil, fmt.Errorf("listing OpenCL platforms: error %d", rc)
+	}
+	platforms := make([]C.cl_platform_id, nplatforms)
+	if rc := C.clGetPlatformIDs(nplatforms, &platforms[0], nil); rc != C.CL_SUCCESS {
+		return nil, fmt.Errorf("listing OpenCL platforms: error %d", rc)
+	}
+	var ret []DeviceInfo
+	probed = nil
+	for _, p := range platforms {
+		platform := platformString(p, C.CL_PLATFORM_NAME)
+		var ndevices C.cl_uint
+		rc := C.clGetDeviceIDs(p, C.CL_DEVICE_TYPE_GPU, 0, nil, &ndevices)
+		if rc == C.CL_DEVICE_NOT_FOUND || ndevices == 0 {
+			continue
+		}
+		if rc != C.CL_SUCCESS {
+			return nil, fmt.Errorf("listing GPUs of %s: error %d", platform, rc)
+		}
+		devices := make([]C.cl_device_id, ndevices)
+		if rc := C.clGetDeviceIDs(p, C.CL_DEVICE_TYPE_GPU, ndevices, &devices[0], nil); rc != C.CL_SUCCESS {
+			return nil, fmt.Errorf("listing GPUs of %s: error %d", platform, rc)
+		}
+		for _, d := range devices {
+			var units C.cl_uint
+			var memory C.cl_ulong
+			C.clGetDeviceInfo(d, C.CL_DEVICE_MAX_COMPUTE_UNITS, C.size_t(unsafe.Sizeof(units)), unsafe.Pointer(&units), nil)
+			C.clGetDeviceInfo(d, C.CL_DEVICE_GLOBAL_MEM_SIZE, C.size_t(unsafe.Sizeof(memory)), unsafe.Pointer(&memory), nil)
+			ret = append(ret, DeviceInfo{
+				Index:        len(ret),
+				Platform:     platform,
+				Name:         deviceString(d, C.CL_DEVICE_NAME),
+				Vendor:       deviceString(d, C.CL_DEVICE_VENDOR),
+				Version:      deviceString(d, C.CL_DEVICE_VERSION),
+				ComputeUnits: int(units),
+				Memory:       uint64(memory),
+			})
+			probed = append(probed, d)
+		}
+	}
+	return ret, nil
+}
+
+// Open builds the kernel for the device described by info, as
+// returned by the last call to Probe.
+func Open(info DeviceInfo) (*Device, error) {
+	if info.Index < 0 || info.Index >= len(probed) {
+		return nil, fmt.Errorf("no GPU %d", info.Index)
+	}
+	d := &Device{Info: info, id: probed[info.Index]}
+	var rc C.cl_int
+	d.ctx = C.clCreateContext(nil, 1, &d.id, nil, nil, &rc)
+	if rc != C.CL_SUCCESS {
+		return nil, fmt.Errorf("creating OpenCL context: error %d", rc)
+	}
+	d.queue = C.clCreateCommandQueue(d.ctx, d.id, 0, &rc)
+	if rc != C.CL_SUCCESS {
+		return nil, fmt.Errorf("creating OpenCL queue: error %d", rc)
+	}
+	src := C.CString(limbStepsKernel)
+	defer C.free(unsafe.Pointer(src))
+	program := C.buildSource(d.ctx, src, &rc)
+	if rc != C.CL_SUCCESS {
+		return nil, fmt.Errorf("loading kernel: error %d", rc)
+	}
+	if rc := C.clBuildProgram(program, 1, &d.id, nil, nil, nil); rc != C.CL_SUCCESS {
+		var size C.size_t
+		C.clGetProgramBuildInfo(program, d.id, C.CL_PROGRAM_BUILD_LOG, 0, nil, &size)
+		buildLog := make([]byte, size+1)
+		C.clGetProgramBuildInfo(program, d.id, C.CL_PROGRAM_BUILD_LOG, size, unsafe.Pointer(&buildLog[0]), nil)
+		return nil, fmt.Errorf("building kernel: error %d: %s", rc, cString(buildLog))
+	}
+	name := C.CString("limbSteps")
+	defer C.free(unsafe.Pointer(name))
+	d.kernel = C.clCreateKernel(program, name, &rc)
+	if rc != C.CL_SUCCESS {
+		return nil, fmt.Errorf("creating kernel: error %d", rc)
+	}
+	return d, nil
+}
+
+// LimbSteps runs the kernel over starts, four limbs to a value, least
+// significant first, setting the steps each took and how it stopped.
+// It waits for the results, and may be called from several
+// goroutines.
+func (d *Device) LimbSteps(starts []uint64, maxSteps uint64, steps []uint64, stops []uint8) error {
+	n := C.size_t(len(starts) / 4)
+	if n == 0 {
+		return nil
+	}
+	if len(steps) < int(n) || len(stops) < int(n) {
+		return fmt.Errorf("room for %d and %d results, not %d", len(steps), len(stops), n)
+	}
+	d.Lock()
+	defer d.Unlock()
+	var rc C.cl_int
+	in := C.clCreateBuffer(d.ctx, C.CL_MEM_READ_ONLY, n*32, nil, &rc)
+	if rc != C.CL_SUCCESS {
+		return fmt.Errorf("allocating GPU memory: error %d", rc)
+	}
+	defer C.clReleaseMemObject(in)
+	outSteps := C.clCreateBuffer(d.ctx, C.CL_MEM_WRITE_ONLY, n*8, nil, &rc)
+	if rc != C.CL_SUCCESS {
+		return fmt.Errorf("allocating GPU memory: error %d", rc)
+	}
+	defer C.clReleaseMemObject(outSteps)
+	outStops := C.clCreateBuffer(d.ctx, C.CL_MEM_WRITE_ONLY, n, nil, &rc)
+	if rc != C.CL_SUCCESS {
+		return fmt.Errorf("allocating GPU memory: error %d", rc)
+	}
+	defer C.clReleaseMemObject(outStops)
+
+	if rc := C.clEnqueueWriteBuffer(d.queue, in, C.CL_TRUE, 0, n*32, unsafe.Pointer(&starts[0]), 0, nil, nil); rc != C.CL_SUCCESS {
+		return fmt.Errorf("copying to the GPU: error %d", rc)
+	}
+	for i, rc := range []C.cl_int{
+		C.setMemArg(d.kernel, 0, in),
+		C.setULongArg(d.kernel, 1, C.cl_ulong(maxSteps)),
+		C.setMemArg(d.kernel, 2, outSteps),
+		C.setMemArg(d.kernel, 3, outStops),
+	} {
+		if rc != C.CL_SUCCESS {
+			return fmt.Errorf("setting kernel argument %d: error %d", i, rc)
+		}
+	}
+	if rc := C.clEnqueueNDRangeKernel(d.queue, d.kernel, 1, nil, &n, nil, 0, nil, nil); rc != C.CL_SUCCESS {
+		return fmt.Errorf("running kernel: error %d", rc)
+	}
+	if rc := C.clEnqueueReadBuffer(d.queue, outSteps, C.CL_TRUE, 0, n*8, unsafe.Pointer(&steps[0]), 0, nil, nil); rc != C.CL_SUCCESS {
+		return fmt.Errorf("copying from the GPU: error %d", rc)
+	}
+	if rc := C.clEnqueueReadBuffer(d.queue, outStops, C.CL_TRUE, 0, n, unsafe.Pointer(&stops[0]), 0, nil, nil); rc != C.CL_SUCCESS {
+		return fmt.Errorf("copying from the GPU: error %d", rc)
+	}
+	return nil
+}
+
+func platformString(p C.cl_platform_id, param C.cl_uint) string {
+	var buf [256]byte
+	if C.clGetPlatformInfo(p, param, C.size_t(len(buf)), unsafe.Pointer(&buf[0]), nil) != C.CL_SUCCESS {
+		return ""
+	}
+	return cString(buf[:])
+}
+
+func deviceString(d C.cl_device_id, param C.cl_uint) string {
+	var buf [256]byte
+	if C.clGetDeviceInfo(d, param, C.size_t(len(buf)), unsafe.Pointer(&buf[0]), nil) != C.CL_SUCCESS {
+		return ""
+	}
+	return cString(buf[:])
+}
+
+// cString returns buf up to its first NUL.
+func cString(buf []byte) string {
+	for i, b := range buf {
+		if b == 0 {
+			return string(buf[:i])
+		}
+	}
+	return string(buf)
+}
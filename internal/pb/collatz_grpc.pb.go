@@ -0,0 +1,296 @@
+// Copyright 2022 Michael Graff.
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The types of the work server's API, as in package internal, and the
+// records it keeps.  Where a field is also in the JSON API, it has the
+// same meaning; see the Go type's documentation.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.4.0
+// - protoc             (unknown)
+// source: collatz.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.62.0 or later.
+const _ = grpc.SupportPackageIsVersion8
+
+const (
+	WorkService_Claim_FullMethodName      = "/collatz.v1.WorkService/Claim"
+	WorkService_Report_FullMethodName     = "/collatz.v1.WorkService/Report"
+	WorkService_StreamWork_FullMethodName = "/collatz.v1.WorkService/StreamWork"
+	WorkService_Heartbeat_FullMethodName  = "/collatz.v1.WorkService/Heartbeat"
+)
+
+// WorkServiceClient is the client API for WorkService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// WorkService is the work API over gRPC.  Each call is authorized as
+// the REST call it mirrors is, from the "authorization" metadata, and
+// answered by the same handler.
+type WorkServiceClient interface {
+	// Claim asks for work, as POST /api/v1/claim does.
+	Claim(ctx context.Context, in *ClaimRequest, opts ...grpc.CallOption) (*ClaimResponse, error)
+	// Report reports progress on, or the result of, a packet, as POST
+	// /api/v1/report does.
+	Report(ctx context.Context, in *WorkProgressReport, opts ...grpc.CallOption) (*ReportResponse, error)
+	// StreamWork claims work again and again, count packets at a time,
+	// sending each packet as it is assigned, until the client hangs up.
+	// The user's limit on outstanding packets paces it: while the client
+	// holds all it may, the stream waits for it to report some.
+	StreamWork(ctx context.Context, in *ClaimRequest, opts ...grpc.CallOption) (WorkService_StreamWorkClient, error)
+	// Heartbeat reports a packet still running, so it is not reassigned.
+	// The report's status is ignored.
+	Heartbeat(ctx context.Context, in *WorkProgressReport, opts ...grpc.CallOption) (*ReportResponse, error)
+}
+
+type workServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewWorkServiceClient(cc grpc.ClientConnInterface) WorkServiceClient {
+	return &workServiceClient{cc}
+}
+
+func (c *workServiceClient) Claim(ctx context.Context, in *ClaimRequest, opts ...grpc.CallOption) (*ClaimResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ClaimResponse)
+	err := c.cc.Invoke(ctx, WorkService_Claim_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *workServiceClient) Report(ctx context.Context, in *WorkProgressReport, opts ...grpc.CallOption) (*ReportResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ReportResponse)
+	err := c.cc.Invoke(ctx, WorkService_Report_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *workServiceClient) StreamWork(ctx context.Context, in *ClaimRequest, opts ...grpc.CallOption) (WorkService_StreamWorkClient, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &WorkService_ServiceDesc.Streams[0], WorkService_StreamWork_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &workServiceStreamWorkClient{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type WorkService_StreamWorkClient interface {
+	Recv() (*WorkPacket, error)
+	grpc.ClientStream
+}
+
+type workServiceStreamWorkClient struct {
+	grpc.ClientStream
+}
+
+func (x *workServiceStreamWorkClient) Recv() (*WorkPacket, error) {
+	m := new(WorkPacket)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *workServiceClient) Heartbeat(ctx context.Context, in *WorkProgressReport, opts ...grpc.CallOption) (*ReportResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ReportResponse)
+	err := c.cc.Invoke(ctx, WorkService_Heartbeat_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// WorkServiceServer is the server API for WorkService service.
+// All implementations must embed UnimplementedWorkServiceServer
+// for forward compatibility
+//
+// WorkService is the work API over gRPC.  Each call is authorized as
+// the REST call it mirrors is, from the "authorization" metadata, and
+// answered by the same handler.
+type WorkServiceServer interface {
+	// Claim asks for work, as POST /api/v1/claim does.
+	Claim(context.Context, *ClaimRequest) (*ClaimResponse, error)
+	// Report reports progress on, or the result of, a packet, as POST
+	// /api/v1/report does.
+	Report(context.Context, *WorkProgressReport) (*ReportResponse, error)
+	// StreamWork claims work again and again, count packets at a time,
+	// sending each packet as it is assigned, until the client hangs up.
+	// The user's limit on outstanding packets paces it: while the client
+	// holds all it may, the stream waits for it to report some.
+	StreamWork(*ClaimRequest, WorkService_StreamWorkServer) error
+	// Heartbeat reports a packet still running, so it is not reassigned.
+	// The report's status is ignored.
+	Heartbeat(context.Context, *WorkProgressReport) (*ReportResponse, error)
+	mustEmbedUnimplementedWorkServiceServer()
+}
+
+// UnimplementedWorkServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedWorkServiceServer struct {
+}
+
+func (UnimplementedWorkServiceServer) Claim(context.Context, *ClaimRequest) (*ClaimResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Claim not implemented")
+}
+func (UnimplementedWorkServiceServer) Report(context.Context, *WorkProgressReport) (*ReportResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Report not implemented")
+}
+func (UnimplementedWorkServiceServer) StreamWork(*ClaimRequest, WorkService_StreamWorkServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamWork not implemented")
+}
+func (UnimplementedWorkServiceServer) Heartbeat(context.Context, *WorkProgressReport) (*ReportResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Heartbeat not implemented")
+}
+func (UnimplementedWorkServiceServer) mustEmbedUnimplementedWorkServiceServer() {}
+
+// UnsafeWorkServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to WorkServiceServer will
+// result in compilation errors.
+type UnsafeWorkServiceServer interface {
+	mustEmbedUnimplementedWorkServiceServer()
+}
+
+func RegisterWorkServiceServer(s grpc.ServiceRegistrar, srv WorkServiceServer) {
+	s.RegisterService(&WorkService_ServiceDesc, srv)
+}
+
+func _WorkService_Claim_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ClaimRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WorkServiceServer).Claim(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: WorkService_Claim_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WorkServiceServer).Claim(ctx, req.(*ClaimRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WorkService_Report_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WorkProgressReport)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WorkServiceServer).Report(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: WorkService_Report_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WorkServiceServer).Report(ctx, req.(*WorkProgressReport))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WorkService_StreamWork_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ClaimRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(WorkServiceServer).StreamWork(m, &workServiceStreamWorkServer{ServerStream: stream})
+}
+
+type WorkService_StreamWorkServer interface {
+	Send(*WorkPacket) error
+	grpc.ServerStream
+}
+
+type workServiceStreamWorkServer struct {
+	grpc.ServerStream
+}
+
+func (x *workServiceStreamWorkServer) Send(m *WorkPacket) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _WorkService_Heartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WorkProgressReport)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WorkServiceServer).Heartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: WorkService_Heartbeat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WorkServiceServer).Heartbeat(ctx, req.(*WorkProgressReport))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// WorkService_ServiceDesc is the grpc.ServiceDesc for WorkService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var WorkService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "collatz.v1.WorkService",
+	HandlerType: (*WorkServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Claim",
+			Handler:    _WorkService_Claim_Handler,
+		},
+		{
+			MethodName: "Report",
+			Handler:    _WorkService_Report_Handler,
+		},
+		{
+			MethodName: "Heartbeat",
+			Handler:    _WorkService_Heartbeat_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamWork",
+			Handler:       _WorkService_StreamWork_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "collatz.proto",
+}
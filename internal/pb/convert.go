@@ -0,0 +1,605 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package pb holds the Protocol Buffers form of the API's types, for
+// gRPC and for compact storage, and converts them to and from the
+// types in package internal.  Each message also encodes to JSON, with
+// encoding/json, exactly as its type in package internal does, so it
+// can be used where the JSON API is spoken.  collatz.proto defines
+// the messages and the gRPC service; collatz.pb.go and
+// collatz_grpc.pb.go are generated from it.
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative collatz.proto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/shirou/gopsutil/host"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// NewBigInt returns v in its canonical encoding, or nil if v is.
+func NewBigInt(v *big.Int) *BigInt {
+	if v == nil {
+		return nil
+	}
+	return &BigInt{Magnitude: v.Bytes(), Negative: v.Sign() < 0}
+}
+
+// Int returns the integer x encodes, or nil if x is nil.  It fails if
+// x is not in the canonical encoding, so no value has two.
+func (x *BigInt) Int() (*big.Int, error) {
+	if x == nil {
+		return nil, nil
+	}
+	if len(x.Magnitude) > 0 && x.Magnitude[0] == 0 {
+		return nil, errors.New("integer has a leading zero byte")
+	}
+	if len(x.Magnitude) == 0 && x.Negative {
+		return nil, errors.New("integer is negative zero")
+	}
+	v := new(big.Int).SetBytes(x.Magnitude)
+	if x.Negative {
+		v.Neg(v)
+	}
+	return v, nil
+}
+
+// newBigInts returns the canonical encoding of each of vs.
+func newBigInts(vs []*big.Int) []*BigInt {
+	if vs == nil {
+		return nil
+	}
+	ret := make([]*BigInt, len(vs))
+	for i, v := range vs {
+		ret[i] = NewBigInt(v)
+	}
+	return ret
+}
+
+// ints returns the integers xs encode.
+func ints(xs []*BigInt) ([]*big.Int, error) {
+	if xs == nil {
+		return nil, nil
+	}
+	ret := make([]*big.Int, len(xs))
+	for i, x := range xs {
+		v, err := x.Int()
+		if err != nil {
+			return nil, err
+		}
+		ret[i] = v
+	}
+	return ret, nil
+}
+
+// newTimestamp returns t, or nil if t is the zero time, which the
+// JSON API sends for "never".
+func newTimestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+// asTime returns the time ts holds, in UTC, or the zero time if ts is
+// nil.
+func asTime(ts *timestamppb.Timestamp) (time.Time, error) {
+	if ts == nil {
+		return time.Time{}, nil
+	}
+	if err := ts.CheckValid(); err != nil {
+		return time.Time{}, err
+	}
+	return ts.AsTime(), nil
+}
+
+// NewWorkPacket returns p as a message.
+func NewWorkPacket(p *internal.WorkPacket) *WorkPacket {
+	x := &WorkPacket{
+		Id:            p.ID,
+		Nonce:         p.Nonce,
+		StartingValue: NewBigInt(p.StartingValue),
+		EndingValue:   NewBigInt(p.EndingValue),
+		AssignedOn:    newTimestamp(p.AssignedOn),
+		Expiry:        newTimestamp(p.Expiry),
+		Filter:        p.Filter,
+		Signature:     p.Signature,
+	}
+	for _, c := range p.Challenges {
+		x.Challenges = append(x.Challenges, &Challenge{Value: NewBigInt(c.Value), Steps: c.Steps})
+	}
+	return x
+}
+
+// Internal returns the packet x holds.
+func (x *WorkPacket) Internal() (internal.WorkPacket, error) {
+	p := internal.WorkPacket{
+		ID:        x.GetId(),
+		Nonce:     x.GetNonce(),
+		Filter:    x.GetFilter(),
+		Signature: x.GetSignature(),
+	}
+	var err error
+	if p.StartingValue, err = x.GetStartingValue().Int(); err != nil {
+		return p, fmt.Errorf("startingValue: %v", err)
+	}
+	if p.EndingValue, err = x.GetEndingValue().Int(); err != nil {
+		return p, fmt.Errorf("endingValue: %v", err)
+	}
+	if p.AssignedOn, err = asTime(x.GetAssignedOn()); err != nil {
+		return p, fmt.Errorf("assignedOn: %v", err)
+	}
+	if p.Expiry, err = asTime(x.GetExpiry()); err != nil {
+		return p, fmt.Errorf("expiry: %v", err)
+	}
+	for _, c := range x.GetChallenges() {
+		v, err := c.GetValue().Int()
+		if err != nil {
+			return p, fmt.Errorf("challenges: %v", err)
+		}
+		p.Challenges = append(p.Challenges, internal.Challenge{Value: v, Steps: c.GetSteps()})
+	}
+	return p, nil
+}
+
+// NewWorkEvidence returns e as a message.
+func NewWorkEvidence(e *internal.WorkEvidence) *WorkEvidence {
+	return &WorkEvidence{TotalIterations: e.TotalIterations, MaxIterations: e.MaxIterations, Filter: e.Filter}
+}
+
+// Internal returns the evidence x holds.
+func (x *WorkEvidence) Internal() (internal.WorkEvidence, error) {
+	return internal.WorkEvidence{
+		TotalIterations: x.GetTotalIterations(),
+		MaxIterations:   x.GetMaxIterations(),
+		Filter:          x.GetFilter(),
+	}, nil
+}
+
+// NewNodeInfo returns ni as a message.
+func NewNodeInfo(ni *internal.NodeInfo) *NodeInfo {
+	h := &ni.HostInfo
+	x := &NodeInfo{
+		NodeId: ni.NodeID,
+		HostInfo: &HostInfo{
+			Hostname:             h.Hostname,
+			Uptime:               h.Uptime,
+			BootTime:             h.BootTime,
+			Procs:                h.Procs,
+			Os:                   h.OS,
+			Platform:             h.Platform,
+			PlatformFamily:       h.PlatformFamily,
+			PlatformVersion:      h.PlatformVersion,
+			KernelVersion:        h.KernelVersion,
+			KernelArch:           h.KernelArch,
+			VirtualizationSystem: h.VirtualizationSystem,
+			VirtualizationRole:   h.VirtualizationRole,
+			HostId:               h.HostID,
+		},
+		CpuInfo: &CPUInfo{
+			Count:  int64(ni.CPUInfo.Count),
+			Usable: int64(ni.CPUInfo.Usable),
+			Cores:  int64(ni.CPUInfo.Cores),
+			Quota:  ni.CPUInfo.Quota,
+		},
+		Workers: int64(ni.Workers),
+	}
+	if t := ni.Tuning; t != nil {
+		x.Tuning = &Tuning{Engine: t.Engine, WideEngine: t.WideEngine, JumpBits: int64(t.JumpBits)}
+		for _, r := range t.Rates {
+			x.Tuning.Rates = append(x.Tuning.Rates, &EngineRate{
+				Engine: r.Engine, JumpBits: int64(r.JumpBits), Wide: r.Wide, Rate: r.Rate,
+			})
+		}
+	}
+	return x
+}
+
+// Internal returns the node info x holds.
+func (x *NodeInfo) Internal() (internal.NodeInfo, error) {
+	h := x.GetHostInfo()
+	c := x.GetCpuInfo()
+	ni := internal.NodeInfo{
+		NodeID: x.GetNodeId(),
+		HostInfo: host.InfoStat{
+			Hostname:             h.GetHostname(),
+			Uptime:               h.GetUptime(),
+			BootTime:             h.GetBootTime(),
+			Procs:                h.GetProcs(),
+			OS:                   h.GetOs(),
+			Platform:             h.GetPlatform(),
+			PlatformFamily:       h.GetPlatformFamily(),
+			PlatformVersion:      h.GetPlatformVersion(),
+			KernelVersion:        h.GetKernelVersion(),
+			KernelArch:           h.GetKernelArch(),
+			VirtualizationSystem: h.GetVirtualizationSystem(),
+			VirtualizationRole:   h.GetVirtualizationRole(),
+			HostID:               h.GetHostId(),
+		},
+		Workers: int(x.GetWorkers()),
+	}
+	ni.CPUInfo.Count = int(c.GetCount())
+	ni.CPUInfo.Usable = int(c.GetUsable())
+	ni.CPUInfo.Cores = int(c.GetCores())
+	ni.CPUInfo.Quota = c.GetQuota()
+	if t := x.GetTuning(); t != nil {
+		ni.Tuning = &internal.Tuning{Engine: t.GetEngine(), WideEngine: t.GetWideEngine(), JumpBits: int(t.GetJumpBits())}
+		for _, r := range t.GetRates() {
+			ni.Tuning.Rates = append(ni.Tuning.Rates, internal.EngineRate{
+				Engine: r.GetEngine(), JumpBits: int(r.GetJumpBits()), Wide: r.GetWide(), Rate: r.GetRate(),
+			})
+		}
+	}
+	return ni, nil
+}
+
+// NewWorkProgressReport returns r as a message.
+func NewWorkProgressReport(r *internal.WorkProgressReport) *WorkProgressReport {
+	x := &WorkProgressReport{
+		Work:                NewWorkPacket(&r.Work),
+		NodeInfo:            NewNodeInfo(&r.NodeInfo),
+		WorkerId:            int64(r.WorkerID),
+		Status:              r.Status,
+		Message:             r.Message,
+		StartedOn:           newTimestamp(r.StartedOn),
+		CompletedOn:         newTimestamp(r.CompletedOn),
+		Position:            NewBigInt(r.Position),
+		EstimatedCompletion: newTimestamp(r.EstimatedCompletion),
+		Evidence:            NewWorkEvidence(&r.Evidence),
+		Authenticator: &WorkAuthenticator{
+			AuthenticatorVersion: r.Authenticator.AuthenticatorVersion,
+			UserSecretVersion:    r.Authenticator.UserSecretVersion,
+			Authenticator:        r.Authenticator.Authenticator,
+		},
+		Histogram:          r.Histogram,
+		MaxIterationsValue: NewBigInt(r.MaxIterationsValue),
+		Interesting:        newBigInts(r.Interesting),
+		Skipped:            newBigInts(r.Skipped),
+	}
+	for _, c := range r.ChallengeResponses {
+		x.ChallengeResponses = append(x.ChallengeResponses, &ChallengeResponse{
+			Value: NewBigInt(c.Value), Steps: c.Steps, Result: NewBigInt(c.Result),
+		})
+	}
+	if a := r.Attestation; a != nil {
+		x.Attestation = &Attestation{Version: a.Version, Engine: a.Engine, Convention: a.Convention, Conformance: a.Conformance}
+	}
+	return x
+}
+
+// Internal returns the report x holds.
+func (x *WorkProgressReport) Internal() (internal.WorkProgressReport, error) {
+	r := internal.WorkProgressReport{
+		WorkerID:  int(x.GetWorkerId()),
+		Status:    x.GetStatus(),
+		Message:   x.GetMessage(),
+		Histogram: x.GetHistogram(),
+	}
+	var err error
+	if r.Work, err = x.GetWork().Internal(); err != nil {
+		return r, fmt.Errorf("work: %v", err)
+	}
+	if r.NodeInfo, err = x.GetNodeInfo().Internal(); err != nil {
+		return r, fmt.Errorf("nodeInfo: %v", err)
+	}
+	if r.StartedOn, err = asTime(x.GetStartedOn()); err != nil {
+		return r, fmt.Errorf("startedOn: %v", err)
+	}
+	if r.CompletedOn, err = asTime(x.GetCompletedOn()); err != nil {
+		return r, fmt.Errorf("completedOn: %v", err)
+	}
+	if r.Position, err = x.GetPosition().Int(); err != nil {
+		return r, fmt.Errorf("position: %v", err)
+	}
+	if r.EstimatedCompletion, err = asTime(x.GetEstimatedCompletion()); err != nil {
+		return r, fmt.Errorf("estimatedCompletion: %v", err)
+	}
+	if r.Evidence, err = x.GetEvidence().Internal(); err != nil {
+		return r, fmt.Errorf("evidence: %v", err)
+	}
+	a := x.GetAuthenticator()
+	r.Authenticator = internal.WorkAuthenticator{
+		AuthenticatorVersion: a.GetAuthenticatorVersion(),
+		UserSecretVersion:    a.GetUserSecretVersion(),
+		Authenticator:        a.GetAuthenticator(),
+	}
+	if r.MaxIterationsValue, err = x.GetMaxIterationsValue().Int(); err != nil {
+		return r, fmt.Errorf("maxIterationsValue: %v", err)
+	}
+	if r.Interesting, err = ints(x.GetInteresting()); err != nil {
+		return r, fmt.Errorf("interesting: %v", err)
+	}
+	if r.Skipped, err = ints(x.GetSkipped()); err != nil {
+		return r, fmt.Errorf("skipped: %v", err)
+	}
+	for _, c := range x.GetChallengeResponses() {
+		value, err := c.GetValue().Int()
+		if err != nil {
+			return r, fmt.Errorf("challengeResponses: %v", err)
+		}
+		result, err := c.GetResult().Int()
+		if err != nil {
+			return r, fmt.Errorf("challengeResponses: %v", err)
+		}
+		r.ChallengeResponses = append(r.ChallengeResponses, internal.ChallengeResponse{Value: value, Steps: c.GetSteps(), Result: result})
+	}
+	if a := x.GetAttestation(); a != nil {
+		r.Attestation = &internal.Attestation{
+			Version: a.GetVersion(), Engine: a.GetEngine(), Convention: a.GetConvention(), Conformance: a.GetConformance(),
+		}
+	}
+	return r, nil
+}
+
+// NewRecord returns r as a message.
+func NewRecord(r *store.Record) *Record {
+	return &Record{
+		Kind:       r.Kind,
+		Value:      NewBigInt(r.Value),
+		Iterations: r.Iterations,
+		PacketId:   r.PacketID,
+		UserId:     r.UserID,
+		FoundOn:    newTimestamp(r.FoundOn),
+	}
+}
+
+// Internal returns the record x holds.
+func (x *Record) Internal() (store.Record, error) {
+	r := store.Record{
+		Kind:       x.GetKind(),
+		Iterations: x.GetIterations(),
+		PacketID:   x.GetPacketId(),
+		UserID:     x.GetUserId(),
+	}
+	var err error
+	if r.Value, err = x.GetValue().Int(); err != nil {
+		return r, fmt.Errorf("value: %v", err)
+	}
+	if r.FoundOn, err = asTime(x.GetFoundOn()); err != nil {
+		return r, fmt.Errorf("foundOn: %v", err)
+	}
+	return r, nil
+}
+
+// NewClaimRequest returns r as a message.
+func NewClaimRequest(r *internal.ClaimRequest) *ClaimRequest {
+	return &ClaimRequest{NodeInfo: NewNodeInfo(&r.NodeInfo), Count: int64(r.Count), Filters: r.Filters}
+}
+
+// Internal returns the request x holds.
+func (x *ClaimRequest) Internal() (internal.ClaimRequest, error) {
+	r := internal.ClaimRequest{Count: int(x.GetCount()), Filters: x.GetFilters()}
+	var err error
+	if r.NodeInfo, err = x.GetNodeInfo().Internal(); err != nil {
+		return r, fmt.Errorf("nodeInfo: %v", err)
+	}
+	return r, nil
+}
+
+// NewClaimResponse returns r as a message.
+func NewClaimResponse(r *internal.ClaimResponse) *ClaimResponse {
+	x := &ClaimResponse{MaxOutstanding: int64(r.MaxOutstanding), Authenticators: r.Authenticators}
+	for i := range r.Work {
+		x.Work = append(x.Work, NewWorkPacket(&r.Work[i]))
+	}
+	return x
+}
+
+// Internal returns the response x holds.
+func (x *ClaimResponse) Internal() (internal.ClaimResponse, error) {
+	r := internal.ClaimResponse{MaxOutstanding: int(x.GetMaxOutstanding()), Authenticators: x.GetAuthenticators()}
+	for _, w := range x.GetWork() {
+		p, err := w.Internal()
+		if err != nil {
+			return r, fmt.Errorf("work: %v", err)
+		}
+		r.Work = append(r.Work, p)
+	}
+	return r, nil
+}
+
+// NewReceipt returns r as a message.
+func NewReceipt(r *internal.Receipt) *Receipt {
+	return &Receipt{
+		PacketId:      r.PacketID,
+		UserId:        r.UserID,
+		NodeId:        r.NodeID,
+		StartingValue: NewBigInt(r.StartingValue),
+		EndingValue:   NewBigInt(r.EndingValue),
+		Evidence:      NewWorkEvidence(&r.Evidence),
+		AcceptedOn:    newTimestamp(r.AcceptedOn),
+	}
+}
+
+// Internal returns the receipt x holds.
+func (x *Receipt) Internal() (internal.Receipt, error) {
+	r := internal.Receipt{PacketID: x.GetPacketId(), UserID: x.GetUserId(), NodeID: x.GetNodeId()}
+	var err error
+	if r.StartingValue, err = x.GetStartingValue().Int(); err != nil {
+		return r, fmt.Errorf("startingValue: %v", err)
+	}
+	if r.EndingValue, err = x.GetEndingValue().Int(); err != nil {
+		return r, fmt.Errorf("endingValue: %v", err)
+	}
+	if r.Evidence, err = x.GetEvidence().Internal(); err != nil {
+		return r, fmt.Errorf("evidence: %v", err)
+	}
+	if r.AcceptedOn, err = asTime(x.GetAcceptedOn()); err != nil {
+		return r, fmt.Errorf("acceptedOn: %v", err)
+	}
+	return r, nil
+}
+
+// NewTrajectoryRequest returns r as a message.
+func NewTrajectoryRequest(r *internal.TrajectoryRequest) *TrajectoryRequest {
+	return &TrajectoryRequest{PacketId: r.PacketID, Value: NewBigInt(r.Value), Format: r.Format, MaxSteps: r.MaxSteps}
+}
+
+// Internal returns the request x holds.
+func (x *TrajectoryRequest) Internal() (internal.TrajectoryRequest, error) {
+	r := internal.TrajectoryRequest{PacketID: x.GetPacketId(), Format: x.GetFormat(), MaxSteps: x.GetMaxSteps()}
+	var err error
+	if r.Value, err = x.GetValue().Int(); err != nil {
+		return r, fmt.Errorf("value: %v", err)
+	}
+	return r, nil
+}
+
+// NewReportResponse returns r as a message.
+func NewReportResponse(r *internal.ReportResponse) *ReportResponse {
+	x := &ReportResponse{Accepted: r.Accepted, Message: r.Message}
+	if r.Receipt != nil {
+		x.Receipt = NewReceipt(r.Receipt)
+	}
+	for i := range r.Trajectories {
+		x.Trajectories = append(x.Trajectories, NewTrajectoryRequest(&r.Trajectories[i]))
+	}
+	return x
+}
+
+// Internal returns the response x holds.
+func (x *ReportResponse) Internal() (internal.ReportResponse, error) {
+	r := internal.ReportResponse{Accepted: x.GetAccepted(), Message: x.GetMessage()}
+	if rc := x.GetReceipt(); rc != nil {
+		receipt, err := rc.Internal()
+		if err != nil {
+			return r, fmt.Errorf("receipt: %v", err)
+		}
+		r.Receipt = &receipt
+	}
+	for _, t := range x.GetTrajectories() {
+		req, err := t.Internal()
+		if err != nil {
+			return r, fmt.Errorf("trajectories: %v", err)
+		}
+		r.Trajectories = append(r.Trajectories, req)
+	}
+	return r, nil
+}
+
+// The JSON shims encode each message as its type in package internal
+// does, so a message can stand in for it in the JSON API.  Times come
+// back in UTC.
+
+// MarshalJSON encodes x as internal.WorkPacket does.
+func (x *WorkPacket) MarshalJSON() ([]byte, error) {
+	return marshalVia(x.Internal)
+}
+
+// UnmarshalJSON decodes x as internal.WorkPacket does.
+func (x *WorkPacket) UnmarshalJSON(b []byte) error {
+	return unmarshalVia(b, x, NewWorkPacket)
+}
+
+// MarshalJSON encodes x as internal.WorkEvidence does.
+func (x *WorkEvidence) MarshalJSON() ([]byte, error) {
+	return marshalVia(x.Internal)
+}
+
+// UnmarshalJSON decodes x as internal.WorkEvidence does.
+func (x *WorkEvidence) UnmarshalJSON(b []byte) error {
+	return unmarshalVia(b, x, NewWorkEvidence)
+}
+
+// MarshalJSON encodes x as internal.NodeInfo does.
+func (x *NodeInfo) MarshalJSON() ([]byte, error) {
+	return marshalVia(x.Internal)
+}
+
+// UnmarshalJSON decodes x as internal.NodeInfo does.
+func (x *NodeInfo) UnmarshalJSON(b []byte) error {
+	return unmarshalVia(b, x, NewNodeInfo)
+}
+
+// MarshalJSON encodes x as internal.WorkProgressReport does.
+func (x *WorkProgressReport) MarshalJSON() ([]byte, error) {
+	return marshalVia(x.Internal)
+}
+
+// UnmarshalJSON decodes x as internal.WorkProgressReport does.
+func (x *WorkProgressReport) UnmarshalJSON(b []byte) error {
+	return unmarshalVia(b, x, NewWorkProgressReport)
+}
+
+// MarshalJSON encodes x as store.Record does.
+func (x *Record) MarshalJSON() ([]byte, error) {
+	return marshalVia(x.Internal)
+}
+
+// UnmarshalJSON decodes x as store.Record does.
+func (x *Record) UnmarshalJSON(b []byte) error {
+	return unmarshalVia(b, x, NewRecord)
+}
+
+// MarshalJSON encodes x as internal.ClaimRequest does.
+func (x *ClaimRequest) MarshalJSON() ([]byte, error) {
+	return marshalVia(x.Internal)
+}
+
+// UnmarshalJSON decodes x as internal.ClaimRequest does.
+func (x *ClaimRequest) UnmarshalJSON(b []byte) error {
+	return unmarshalVia(b, x, NewClaimRequest)
+}
+
+// MarshalJSON encodes x as internal.ClaimResponse does.
+func (x *ClaimResponse) MarshalJSON() ([]byte, error) {
+	return marshalVia(x.Internal)
+}
+
+// UnmarshalJSON decodes x as internal.ClaimResponse does.
+func (x *ClaimResponse) UnmarshalJSON(b []byte) error {
+	return unmarshalVia(b, x, NewClaimResponse)
+}
+
+// MarshalJSON encodes x as internal.ReportResponse does.
+func (x *ReportResponse) MarshalJSON() ([]byte, error) {
+	return marshalVia(x.Internal)
+}
+
+// UnmarshalJSON decodes x as internal.ReportResponse does.
+func (x *ReportResponse) UnmarshalJSON(b []byte) error {
+	return unmarshalVia(b, x, NewReportResponse)
+}
+
+// marshalVia encodes the value internal returns.
+func marshalVia[T any](get func() (T, error)) ([]byte, error) {
+	v, err := get()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// unmarshalVia decodes b as a T, and sets x to its message.
+func unmarshalVia[T any, M proto.Message](b []byte, x M, message func(*T) M) error {
+	var v T
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	proto.Reset(x)
+	proto.Merge(x, message(&v))
+	return nil
+}
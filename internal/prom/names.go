@@ -0,0 +1,83 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package prom
+
+// The names of the metrics exposed by crunch and the server.  Every
+// name starts with "collatz_" and the program exposing it, and ends
+// with its base unit, if any.  Labels are:
+//
+//	worker   a crunch worker, numbered from zero
+//	user     a user ID
+//	handler  an API route, such as "/api/v1/claim"
+//	code     an HTTP status code, or 0 if there was no response
+//	status   a report status, such as "completed"
+//	result   how a report was answered
+//	phase    where the time to run a packet went
+//	engine   the implementation testing candidates, such as "big"
+//
+// The dashboard written by "blockserver dashboard export" queries these
+// names, so it stays in step with them.
+const (
+	CrunchCandidates               = "collatz_crunch_candidates_total"
+	CrunchIterations               = "collatz_crunch_iterations_total"
+	CrunchCandidateRate            = "collatz_crunch_candidates_per_second"
+	CrunchCandidateRateSmoothed    = "collatz_crunch_candidates_per_second_smoothed"
+	CrunchIterationRate            = "collatz_crunch_iterations_per_second"
+	CrunchIterationRateSmoothed    = "collatz_crunch_iterations_per_second_smoothed"
+	CrunchBitLength                = "collatz_crunch_bit_length"
+	CrunchPacketProgress           = "collatz_crunch_packet_progress_ratio"
+	CrunchPacketETA                = "collatz_crunch_packet_eta_seconds"
+	CrunchHeldETA                  = "collatz_crunch_held_packets_eta_seconds"
+	CrunchPacketsCompleted         = "collatz_crunch_packets_completed_total"
+	CrunchPacketPhase              = "collatz_crunch_packet_phase_seconds"
+	CrunchCPUTemperature           = "collatz_crunch_cpu_temperature_celsius"
+	CrunchCPUFrequency             = "collatz_crunch_cpu_frequency_hertz"
+	CrunchThrottledWorkers         = "collatz_crunch_throttled_workers"
+	CrunchThrottleEvents           = "collatz_crunch_throttle_events_total"
+	CrunchLoadAverage              = "collatz_crunch_load_average"
+	CrunchOtherLoad                = "collatz_crunch_other_load"
+	CrunchCPUSteal                 = "collatz_crunch_cpu_steal_ratio"
+	CrunchYieldedWorkers           = "collatz_crunch_yielded_workers"
+	CrunchYieldEvents              = "collatz_crunch_yield_events_total"
+	CrunchShadowCompared           = "collatz_crunch_shadow_compared_total"
+	CrunchShadowDisagreed          = "collatz_crunch_shadow_disagreed_total"
+	CrunchTotalCandidates          = "collatz_crunch_total_candidates_total"
+	CrunchTotalIterations          = "collatz_crunch_total_iterations_total"
+	CrunchMaxIterations            = "collatz_crunch_max_iterations"
+	CrunchSpooledReports           = "collatz_crunch_spooled_reports"
+	CrunchRequestDuration          = "collatz_crunch_request_duration_seconds"
+	CrunchHeapInUse                = "collatz_crunch_heap_inuse_bytes"
+	CrunchHeapObjects              = "collatz_crunch_heap_objects"
+	CrunchAllocatedBytes           = "collatz_crunch_allocated_bytes_total"
+	CrunchAllocations              = "collatz_crunch_allocations_total"
+	CrunchGCCycles                 = "collatz_crunch_gc_cycles_total"
+	CrunchGCPause                  = "collatz_crunch_gc_pause_seconds_total"
+	CrunchEngineCandidates         = "collatz_crunch_engine_candidates_total"
+	CrunchEngineAllocRate          = "collatz_crunch_engine_allocations_per_second"
+	CrunchEngineAllocsPerCandidate = "collatz_crunch_engine_allocations_per_candidate"
+
+	ServerPacketsOutstanding = "collatz_server_packets_outstanding"
+	ServerFrontierBitLength  = "collatz_server_frontier_bit_length"
+	ServerReportsWaiting     = "collatz_server_reports_waiting"
+	ServerReports            = "collatz_server_reports_total"
+	ServerUserIntegers       = "collatz_server_user_integers_total"
+	ServerUserIterations     = "collatz_server_user_iterations_total"
+	ServerUserPackets        = "collatz_server_user_packets_total"
+	ServerRequestDuration    = "collatz_server_request_duration_seconds"
+	ServerAudits             = "collatz_server_audits_total"
+	ServerAuditsQueued       = "collatz_server_audits_queued"
+)
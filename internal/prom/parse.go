@@ -0,0 +1,126 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package prom
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Label is a label name and value.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is one sample parsed from the text format.
+type Sample struct {
+	// Name is the sample's name, which for histograms includes the
+	// _bucket, _sum, or _count suffix.
+	Name string
+
+	// Family is the name of the metric the sample belongs to, and
+	// Kind its type, such as "counter" or "histogram".
+	Family string
+	Kind   string
+
+	Labels []Label
+	Value  float64
+}
+
+// Parse reads samples in the text format, as written by this package.
+// Samples without a TYPE line are untyped.
+func Parse(r io.Reader) ([]Sample, error) {
+	kinds := map[string]string{}
+	var ret []Sample
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) == 4 && fields[1] == "TYPE" {
+				kinds[fields[2]] = fields[3]
+			}
+			continue
+		}
+		s, err := parseSample(line)
+		if err != nil {
+			return nil, err
+		}
+		s.Family, s.Kind = s.Name, "untyped"
+		if kind, found := kinds[s.Name]; found {
+			s.Kind = kind
+		} else {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				family := strings.TrimSuffix(s.Name, suffix)
+				if kind, found := kinds[family]; found && family != s.Name {
+					s.Family, s.Kind = family, kind
+					break
+				}
+			}
+		}
+		ret = append(ret, s)
+	}
+	return ret, scanner.Err()
+}
+
+func parseSample(line string) (Sample, error) {
+	s := Sample{}
+	end := strings.IndexAny(line, "{ ")
+	if end < 0 {
+		return s, fmt.Errorf("malformed sample %q", line)
+	}
+	s.Name = line[:end]
+	rest := line[end:]
+	if strings.HasPrefix(rest, "{") {
+		rest = rest[1:]
+		for !strings.HasPrefix(rest, "}") {
+			eq := strings.Index(rest, "=")
+			if eq < 0 {
+				return s, fmt.Errorf("malformed labels in %q", line)
+			}
+			name := rest[:eq]
+			quoted, err := strconv.QuotedPrefix(rest[eq+1:])
+			if err != nil {
+				return s, fmt.Errorf("malformed label value in %q", line)
+			}
+			value, _ := strconv.Unquote(quoted)
+			s.Labels = append(s.Labels, Label{Name: name, Value: value})
+			rest = strings.TrimPrefix(rest[eq+1+len(quoted):], ",")
+			if rest == "" {
+				return s, fmt.Errorf("unterminated labels in %q", line)
+			}
+		}
+		rest = rest[1:]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return s, fmt.Errorf("missing value in %q", line)
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, fmt.Errorf("malformed value in %q", line)
+	}
+	s.Value = v
+	return s, nil
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package prom writes metrics in the Prometheus text exposition
+// format, which is all we need of a Prometheus client.
+package prom
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the content type of the text format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the histogram upper bounds, in seconds, used for
+// request latency.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// FormatFloat formats a sample value.
+func FormatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Labels formats label pairs, given as name, value, name, value...,
+// including the braces, or "" if there are none.
+func Labels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", pairs[i], pairs[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// WriteHeader writes the HELP and TYPE lines of a metric.
+func WriteHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Histogram counts observations into buckets.  It is not safe for
+// concurrent use.
+type Histogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram returns an empty histogram with the upper bounds given.
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+// Observe adds an observation.
+func (h *Histogram) Observe(v float64) {
+	h.count++
+	h.sum += v
+	for i, le := range h.bounds {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+}
+
+// Write writes the histogram's samples with the label pairs given.
+func (h *Histogram) Write(w io.Writer, name string, pairs ...string) {
+	for i, le := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, Labels(append(pairs, "le", FormatFloat(le))...), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, Labels(append(pairs, "le", "+Inf")...), h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, Labels(pairs...), FormatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, Labels(pairs...), h.count)
+}
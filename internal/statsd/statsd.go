@@ -0,0 +1,218 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package statsd pushes metrics to a statsd or DogStatsD server, for
+// those whose monitoring is push-based.  The metrics are the ones we
+// expose to Prometheus, read from the same text format, so the two
+// never disagree.
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skandragon/collatz/internal/prom"
+)
+
+// Flavors of the protocol.
+const (
+	// FlavorStatsd has no tags, so label values are appended to the
+	// metric name.
+	FlavorStatsd = "statsd"
+
+	// FlavorDogStatsD sends labels as tags.
+	FlavorDogStatsD = "dogstatsd"
+)
+
+// maxPacket keeps each datagram within a typical MTU.
+const maxPacket = 1432
+
+// Config selects the server to push to.
+type Config struct {
+	// Address is the server's UDP address, such as "127.0.0.1:8125".
+	Address string `yaml:"address"`
+
+	// Flavor is "statsd" (the default) or "dogstatsd".
+	Flavor string `yaml:"flavor,omitempty"`
+
+	// Prefix, if set, is prepended to every metric name.
+	Prefix string `yaml:"prefix,omitempty"`
+
+	// Interval is how often metrics are pushed.  The default is 10s.
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// Tags are added to every metric, as "name:value", by DogStatsD.
+	Tags []string `yaml:"tags,omitempty"`
+}
+
+// ApplyDefaults checks the config and fills in defaults.
+func (c *Config) ApplyDefaults() error {
+	if c.Address == "" {
+		return fmt.Errorf("statsd.address is required")
+	}
+	switch c.Flavor {
+	case "":
+		c.Flavor = FlavorStatsd
+	case FlavorStatsd, FlavorDogStatsD:
+	default:
+		return fmt.Errorf("statsd.flavor must be %s or %s, not %q", FlavorStatsd, FlavorDogStatsD, c.Flavor)
+	}
+	if c.Interval == 0 {
+		c.Interval = 10 * time.Second
+	}
+	return nil
+}
+
+// Push sends the metrics written by write every interval until the
+// context is cancelled.  Gauges are sent as they are.  Counters, and
+// the sum and count of histograms, are sent as the increase since the
+// last push.  Histogram buckets have no statsd equivalent, and are not
+// sent.
+func Push(ctx context.Context, c *Config, write func(io.Writer)) {
+	conn, err := net.Dial("udp", c.Address)
+	if err != nil {
+		slog.Error("cannot push metrics to statsd", "addr", c.Address, "err", err)
+		return
+	}
+	defer conn.Close()
+	slog.Info("pushing metrics to statsd", "addr", c.Address, "flavor", c.Flavor)
+
+	p := &pusher{config: c, last: map[string]float64{}}
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var buf bytes.Buffer
+		write(&buf)
+		samples, err := prom.Parse(&buf)
+		if err != nil {
+			slog.Error("cannot read metrics for statsd", "err", err)
+			continue
+		}
+		for _, packet := range p.packets(samples) {
+			if _, err := conn.Write(packet); err != nil {
+				slog.Warn("cannot push metrics to statsd", "addr", c.Address, "err", err)
+				break
+			}
+		}
+	}
+}
+
+// pusher remembers what it last sent, to turn counters into increments.
+type pusher struct {
+	config *Config
+	last   map[string]float64
+}
+
+// packets returns the lines for samples, packed into datagrams.
+func (p *pusher) packets(samples []prom.Sample) [][]byte {
+	var ret [][]byte
+	var packet []byte
+	for _, s := range samples {
+		line := p.line(s)
+		if line == "" {
+			continue
+		}
+		if len(packet) > 0 && len(packet)+1+len(line) > maxPacket {
+			ret = append(ret, packet)
+			packet = nil
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		ret = append(ret, packet)
+	}
+	return ret
+}
+
+// line returns the statsd line for a sample, or "" if there is nothing
+// to send.
+func (p *pusher) line(s prom.Sample) string {
+	kind := "g"
+	value := s.Value
+	switch {
+	case s.Kind == "histogram" && strings.HasSuffix(s.Name, "_bucket"):
+		return ""
+	case s.Kind == "counter" || s.Kind == "histogram":
+		kind = "c"
+		key := s.Name + prom.Labels(labelPairs(s.Labels)...)
+		last, seen := p.last[key]
+		p.last[key] = s.Value
+		if !seen {
+			// The first push sets the baseline.
+			return ""
+		}
+		value = s.Value - last
+		if value < 0 {
+			// The counter was reset.
+			value = s.Value
+		}
+		if value == 0 {
+			return ""
+		}
+	}
+
+	name := p.config.Prefix + s.Name
+	var tags []string
+	if p.config.Flavor == FlavorDogStatsD {
+		tags = append(tags, p.config.Tags...)
+		for _, l := range s.Labels {
+			tags = append(tags, l.Name+":"+sanitize(l.Value))
+		}
+	} else {
+		for _, l := range s.Labels {
+			name += "." + l.Name + "." + sanitize(l.Value)
+		}
+	}
+	line := fmt.Sprintf("%s:%s|%s", name, strconv.FormatFloat(value, 'f', -1, 64), kind)
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+func labelPairs(labels []prom.Label) []string {
+	ret := make([]string, 0, 2*len(labels))
+	for _, l := range labels {
+		ret = append(ret, l.Name, l.Value)
+	}
+	return ret
+}
+
+// sanitize replaces the characters which delimit the protocol.
+func sanitize(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', ',', '#', '@', '\n', ' ':
+			return '_'
+		}
+		return r
+	}, v)
+}
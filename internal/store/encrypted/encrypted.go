@@ -0,0 +1,104 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package encrypted wraps a store.Store so user secrets are sealed
+// before they reach the database, and opened as they are read back.
+package encrypted
+
+import (
+	"context"
+
+	"github.com/skandragon/collatz/internal/keyring"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// Store seals user secrets in an underlying store.
+type Store struct {
+	store.Store
+	keys *keyring.Keyring
+}
+
+var _ store.Store = (*Store)(nil)
+
+// New wraps st.
+func New(st store.Store, keys *keyring.Keyring) *Store {
+	return &Store{Store: st, keys: keys}
+}
+
+func secretContext(userID string) string {
+	return "user-secret:" + userID
+}
+
+// PutUser seals the user's secret, and stores the user.
+func (s *Store) PutUser(ctx context.Context, user store.User) error {
+	sealed, err := s.keys.Seal(user.UserSecret, secretContext(user.UserID))
+	if err != nil {
+		return err
+	}
+	user.UserSecret = sealed
+	return s.Store.PutUser(ctx, user)
+}
+
+// GetUser returns the user with their secret opened.
+func (s *Store) GetUser(ctx context.Context, userID string) (*store.User, error) {
+	u, err := s.Store.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if u.UserSecret, err = s.keys.Open(u.UserSecret, secretContext(u.UserID)); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Users returns all users with their secrets opened.
+func (s *Store) Users(ctx context.Context) ([]store.User, error) {
+	users, err := s.Store.Users(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range users {
+		u := &users[i]
+		if u.UserSecret, err = s.keys.Open(u.UserSecret, secretContext(u.UserID)); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// Reseal seals every user secret which is plaintext, or sealed with a
+// key other than the primary, with the primary key.  It returns the
+// number of users updated.
+func (s *Store) Reseal(ctx context.Context) (int, error) {
+	raw, err := s.Store.Users(ctx)
+	if err != nil {
+		return 0, err
+	}
+	updated := 0
+	for _, u := range raw {
+		if keyring.KeyID(u.UserSecret) == s.keys.Primary() {
+			continue
+		}
+		if u.UserSecret, err = s.keys.Open(u.UserSecret, secretContext(u.UserID)); err != nil {
+			return updated, err
+		}
+		if err := s.PutUser(ctx, u); err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, nil
+}
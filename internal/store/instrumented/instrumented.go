@@ -0,0 +1,139 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package instrumented wraps a store.Store to measure how long each
+// operation takes, count its failures, and log slow operations, so
+// operators can see when the database becomes the bottleneck.
+package instrumented
+
+import (
+	"errors"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// Buckets are the upper bounds of the latency histogram.  Slower
+// operations are counted in a final, unbounded bucket.
+var Buckets = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Metrics accumulates the measurements of one or more Stores.
+type Metrics struct {
+	sync.Mutex
+	slow time.Duration
+	ops  map[string]*operation
+}
+
+type operation struct {
+	calls   int64
+	errors  int64
+	total   time.Duration
+	max     time.Duration
+	buckets []int64
+}
+
+// NewMetrics returns empty Metrics, which log operations taking at
+// least slow.  Zero disables the log.
+func NewMetrics(slow time.Duration) *Metrics {
+	return &Metrics{slow: slow, ops: map[string]*operation{}}
+}
+
+// observe records one call to the named operation, which started at
+// start and returned *err.  Not finding something, and finding it
+// already done, are answers rather than failures, and are not counted
+// as errors.
+func (m *Metrics) observe(name string, start time.Time, err *error) {
+	d := time.Since(start)
+	failed := *err != nil && !errors.Is(*err, store.ErrNotFound) && !errors.Is(*err, store.ErrAlreadyAccepted)
+
+	m.Lock()
+	op, found := m.ops[name]
+	if !found {
+		op = &operation{buckets: make([]int64, len(Buckets)+1)}
+		m.ops[name] = op
+	}
+	op.calls++
+	if failed {
+		op.errors++
+	}
+	op.total += d
+	if d > op.max {
+		op.max = d
+	}
+	op.buckets[sort.Search(len(Buckets), func(i int) bool { return d <= Buckets[i] })]++
+	m.Unlock()
+
+	if m.slow > 0 && d >= m.slow {
+		slog.Warn("slow store operation", "op", name, "duration", d)
+	}
+}
+
+// Snapshot returns the measurements so far, by operation name.
+func (m *Metrics) Snapshot() internal.StoreMetrics {
+	m.Lock()
+	defer m.Unlock()
+	ret := internal.StoreMetrics{Operations: []internal.StoreOperation{}}
+	for name, op := range m.ops {
+		s := internal.StoreOperation{
+			Name:    name,
+			Calls:   op.calls,
+			Errors:  op.errors,
+			Total:   op.total,
+			Max:     op.max,
+			Buckets: make([]internal.LatencyBucket, len(op.buckets)),
+		}
+		for i, n := range op.buckets {
+			s.Buckets[i].Count = n
+			if i < len(Buckets) {
+				s.Buckets[i].LE = Buckets[i]
+			}
+		}
+		ret.Operations = append(ret.Operations, s)
+	}
+	sort.Slice(ret.Operations, func(i, j int) bool { return ret.Operations[i].Name < ret.Operations[j].Name })
+	return ret
+}
+
+// Store measures the operations of an underlying store.
+type Store struct {
+	store.Store
+	metrics *Metrics
+}
+
+var _ store.Store = (*Store)(nil)
+
+// New wraps st, recording into metrics.
+func New(st store.Store, metrics *Metrics) *Store {
+	return &Store{Store: st, metrics: metrics}
+}
@@ -0,0 +1,275 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package instrumented
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/intervals"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// Each method times one call to the underlying store, under its own
+// name.
+
+func (s *Store) Migrate(ctx context.Context) (ret int, err error) {
+	defer s.metrics.observe("Migrate", time.Now(), &err)
+	return s.Store.Migrate(ctx)
+}
+
+func (s *Store) CheckSchema(ctx context.Context) (err error) {
+	defer s.metrics.observe("CheckSchema", time.Now(), &err)
+	return s.Store.CheckSchema(ctx)
+}
+
+func (s *Store) PutUser(ctx context.Context, user store.User) (err error) {
+	defer s.metrics.observe("PutUser", time.Now(), &err)
+	return s.Store.PutUser(ctx, user)
+}
+
+func (s *Store) GetUser(ctx context.Context, userID string) (ret *store.User, err error) {
+	defer s.metrics.observe("GetUser", time.Now(), &err)
+	return s.Store.GetUser(ctx, userID)
+}
+
+func (s *Store) Users(ctx context.Context) (ret []store.User, err error) {
+	defer s.metrics.observe("Users", time.Now(), &err)
+	return s.Store.Users(ctx)
+}
+
+func (s *Store) AddPacket(ctx context.Context, packet *store.Packet) (err error) {
+	defer s.metrics.observe("AddPacket", time.Now(), &err)
+	return s.Store.AddPacket(ctx, packet)
+}
+
+func (s *Store) GetPacket(ctx context.Context, packetID string) (ret *store.Packet, err error) {
+	defer s.metrics.observe("GetPacket", time.Now(), &err)
+	return s.Store.GetPacket(ctx, packetID)
+}
+
+func (s *Store) Packets(ctx context.Context, status string) (ret []*store.Packet, err error) {
+	defer s.metrics.observe("Packets", time.Now(), &err)
+	return s.Store.Packets(ctx, status)
+}
+
+func (s *Store) UpdatePacket(ctx context.Context, packet *store.Packet) (err error) {
+	defer s.metrics.observe("UpdatePacket", time.Now(), &err)
+	return s.Store.UpdatePacket(ctx, packet)
+}
+
+func (s *Store) ReclaimExpired(ctx context.Context, now time.Time) (ret *store.Packet, err error) {
+	defer s.metrics.observe("ReclaimExpired", time.Now(), &err)
+	return s.Store.ReclaimExpired(ctx, now)
+}
+
+func (s *Store) ClaimVerification(ctx context.Context, claim *store.Packet, filters []string) (ret *store.Packet, err error) {
+	defer s.metrics.observe("ClaimVerification", time.Now(), &err)
+	return s.Store.ClaimVerification(ctx, claim, filters)
+}
+
+func (s *Store) CountOutstanding(ctx context.Context, userID string, now time.Time) (ret int, err error) {
+	defer s.metrics.observe("CountOutstanding", time.Now(), &err)
+	return s.Store.CountOutstanding(ctx, userID, now)
+}
+
+func (s *Store) GetNode(ctx context.Context, nodeID string) (ret *store.Node, err error) {
+	defer s.metrics.observe("GetNode", time.Now(), &err)
+	return s.Store.GetNode(ctx, nodeID)
+}
+
+func (s *Store) PutNode(ctx context.Context, node *store.Node) (err error) {
+	defer s.metrics.observe("PutNode", time.Now(), &err)
+	return s.Store.PutNode(ctx, node)
+}
+
+func (s *Store) AcceptReport(ctx context.Context, a *store.Acceptance) (err error) {
+	defer s.metrics.observe("AcceptReport", time.Now(), &err)
+	return s.Store.AcceptReport(ctx, a)
+}
+
+func (s *Store) AddReportConflict(ctx context.Context, c store.ReportConflict) (err error) {
+	defer s.metrics.observe("AddReportConflict", time.Now(), &err)
+	return s.Store.AddReportConflict(ctx, c)
+}
+
+func (s *Store) ReportConflicts(ctx context.Context, since time.Time, limit int) (ret []store.ReportConflict, err error) {
+	defer s.metrics.observe("ReportConflicts", time.Now(), &err)
+	return s.Store.ReportConflicts(ctx, since, limit)
+}
+
+func (s *Store) GetReceipt(ctx context.Context, packetID string) (ret *internal.Receipt, err error) {
+	defer s.metrics.observe("GetReceipt", time.Now(), &err)
+	return s.Store.GetReceipt(ctx, packetID)
+}
+
+func (s *Store) CompletedRanges(ctx context.Context) (ret *intervals.Set, err error) {
+	defer s.metrics.observe("CompletedRanges", time.Now(), &err)
+	return s.Store.CompletedRanges(ctx)
+}
+
+func (s *Store) AddCompletedRange(ctx context.Context, iv intervals.Interval) (err error) {
+	defer s.metrics.observe("AddCompletedRange", time.Now(), &err)
+	return s.Store.AddCompletedRange(ctx, iv)
+}
+
+func (s *Store) ReportsBefore(ctx context.Context, before time.Time, limit int) (ret []store.StoredReport, err error) {
+	defer s.metrics.observe("ReportsBefore", time.Now(), &err)
+	return s.Store.ReportsBefore(ctx, before, limit)
+}
+
+func (s *Store) ReportsAfter(ctx context.Context, afterPacketID string, limit int) (ret []store.StoredReport, err error) {
+	defer s.metrics.observe("ReportsAfter", time.Now(), &err)
+	return s.Store.ReportsAfter(ctx, afterPacketID, limit)
+}
+
+func (s *Store) DeleteReports(ctx context.Context, packetIDs []string) (err error) {
+	defer s.metrics.observe("DeleteReports", time.Now(), &err)
+	return s.Store.DeleteReports(ctx, packetIDs)
+}
+
+func (s *Store) Receipts(ctx context.Context, userID string) (ret []internal.Receipt, err error) {
+	defer s.metrics.observe("Receipts", time.Now(), &err)
+	return s.Store.Receipts(ctx, userID)
+}
+
+func (s *Store) AddRecord(ctx context.Context, record store.Record) (err error) {
+	defer s.metrics.observe("AddRecord", time.Now(), &err)
+	return s.Store.AddRecord(ctx, record)
+}
+
+func (s *Store) Records(ctx context.Context, kind string) (ret []store.Record, err error) {
+	defer s.metrics.observe("Records", time.Now(), &err)
+	return s.Store.Records(ctx, kind)
+}
+
+func (s *Store) AddTrajectory(ctx context.Context, t store.StoredTrajectory) (err error) {
+	defer s.metrics.observe("AddTrajectory", time.Now(), &err)
+	return s.Store.AddTrajectory(ctx, t)
+}
+
+func (s *Store) GetTrajectory(ctx context.Context, value *big.Int) (ret *store.StoredTrajectory, err error) {
+	defer s.metrics.observe("GetTrajectory", time.Now(), &err)
+	return s.Store.GetTrajectory(ctx, value)
+}
+
+func (s *Store) ConsumeNonce(ctx context.Context, n store.Nonce) (err error) {
+	defer s.metrics.observe("ConsumeNonce", time.Now(), &err)
+	return s.Store.ConsumeNonce(ctx, n)
+}
+
+func (s *Store) AddTrust(ctx context.Context, t store.Trust) (err error) {
+	defer s.metrics.observe("AddTrust", time.Now(), &err)
+	return s.Store.AddTrust(ctx, t)
+}
+
+func (s *Store) GetTrust(ctx context.Context, userID string) (ret *store.Trust, err error) {
+	defer s.metrics.observe("GetTrust", time.Now(), &err)
+	return s.Store.GetTrust(ctx, userID)
+}
+
+func (s *Store) TrustHistory(ctx context.Context) (ret []store.Trust, err error) {
+	defer s.metrics.observe("TrustHistory", time.Now(), &err)
+	return s.Store.TrustHistory(ctx)
+}
+
+func (s *Store) AddEnrollment(ctx context.Context, e store.Enrollment) (err error) {
+	defer s.metrics.observe("AddEnrollment", time.Now(), &err)
+	return s.Store.AddEnrollment(ctx, e)
+}
+
+func (s *Store) GetEnrollment(ctx context.Context, codeHash string) (ret *store.Enrollment, err error) {
+	defer s.metrics.observe("GetEnrollment", time.Now(), &err)
+	return s.Store.GetEnrollment(ctx, codeHash)
+}
+
+func (s *Store) RedeemEnrollment(ctx context.Context, codeHash string, nodeID string, now time.Time) (ret *store.Enrollment, err error) {
+	defer s.metrics.observe("RedeemEnrollment", time.Now(), &err)
+	return s.Store.RedeemEnrollment(ctx, codeHash, nodeID, now)
+}
+
+func (s *Store) Enrollments(ctx context.Context, since time.Time) (ret []store.Enrollment, err error) {
+	defer s.metrics.observe("Enrollments", time.Now(), &err)
+	return s.Store.Enrollments(ctx, since)
+}
+
+func (s *Store) AddEvent(ctx context.Context, e *internal.Event) (err error) {
+	defer s.metrics.observe("AddEvent", time.Now(), &err)
+	return s.Store.AddEvent(ctx, e)
+}
+
+func (s *Store) Events(ctx context.Context, afterSeq int64, limit int) (ret []internal.Event, err error) {
+	defer s.metrics.observe("Events", time.Now(), &err)
+	return s.Store.Events(ctx, afterSeq, limit)
+}
+
+func (s *Store) InitFrontier(ctx context.Context, next *big.Int) (err error) {
+	defer s.metrics.observe("InitFrontier", time.Now(), &err)
+	return s.Store.InitFrontier(ctx, next)
+}
+
+func (s *Store) Frontier(ctx context.Context) (ret *big.Int, err error) {
+	defer s.metrics.observe("Frontier", time.Now(), &err)
+	return s.Store.Frontier(ctx)
+}
+
+func (s *Store) AllocateRange(ctx context.Context, size *big.Int) (ret *big.Int, err error) {
+	defer s.metrics.observe("AllocateRange", time.Now(), &err)
+	return s.Store.AllocateRange(ctx, size)
+}
+
+func (s *Store) AddRateSample(ctx context.Context, sample store.RateSample) (err error) {
+	defer s.metrics.observe("AddRateSample", time.Now(), &err)
+	return s.Store.AddRateSample(ctx, sample)
+}
+
+func (s *Store) RateSamples(ctx context.Context, userID string, from, to time.Time) (ret []store.RateSample, err error) {
+	defer s.metrics.observe("RateSamples", time.Now(), &err)
+	return s.Store.RateSamples(ctx, userID, from, to)
+}
+
+func (s *Store) UserTotals(ctx context.Context) (ret []store.UserTotals, err error) {
+	defer s.metrics.observe("UserTotals", time.Now(), &err)
+	return s.Store.UserTotals(ctx)
+}
+
+func (s *Store) PurgeRateSamples(ctx context.Context, before time.Time) (ret int64, err error) {
+	defer s.metrics.observe("PurgeRateSamples", time.Now(), &err)
+	return s.Store.PurgeRateSamples(ctx, before)
+}
+
+func (s *Store) PurgePackets(ctx context.Context, status string, assignedBefore time.Time) (ret int64, err error) {
+	defer s.metrics.observe("PurgePackets", time.Now(), &err)
+	return s.Store.PurgePackets(ctx, status, assignedBefore)
+}
+
+func (s *Store) PurgeReports(ctx context.Context, receivedBefore time.Time) (ret int64, err error) {
+	defer s.metrics.observe("PurgeReports", time.Now(), &err)
+	return s.Store.PurgeReports(ctx, receivedBefore)
+}
+
+func (s *Store) PurgeNodes(ctx context.Context, lastSeenBefore time.Time) (ret int64, err error) {
+	defer s.metrics.observe("PurgeNodes", time.Now(), &err)
+	return s.Store.PurgeNodes(ctx, lastSeenBefore)
+}
+
+func (s *Store) Backup(ctx context.Context, filename string) (err error) {
+	defer s.metrics.observe("Backup", time.Now(), &err)
+	return s.Store.Backup(ctx, filename)
+}
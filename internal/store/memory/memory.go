@@ -0,0 +1,808 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package memory implements store.Store in memory, for tests and small
+// runs where losing state on restart is acceptable.
+package memory
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/intervals"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// Store is a store.Store which keeps everything in memory.
+type Store struct {
+	sync.Mutex
+	users    map[string]store.User
+	packets  map[string]store.Packet
+	nodes    map[string]store.Node
+	reports  []store.StoredReport
+	conflict []store.ReportConflict
+	receipts map[string][]internal.Receipt
+	records  []store.Record
+	paths    map[string]store.StoredTrajectory
+	nonces   map[string]store.Nonce
+	trust    map[string]store.Trust
+	enrolls  map[string]store.Enrollment
+	events   []internal.Event
+	frontier *big.Int
+	complete intervals.Set
+	rates    map[rateKey]store.RateSample
+}
+
+type rateKey struct {
+	userID string
+	bucket int64
+}
+
+var _ store.Store = (*Store)(nil)
+
+// New returns an empty Store.
+func New() *Store {
+	return &Store{
+		users:    map[string]store.User{},
+		packets:  map[string]store.Packet{},
+		nodes:    map[string]store.Node{},
+		paths:    map[string]store.StoredTrajectory{},
+		nonces:   map[string]store.Nonce{},
+		trust:    map[string]store.Trust{},
+		enrolls:  map[string]store.Enrollment{},
+		receipts: map[string][]internal.Receipt{},
+		rates:    map[rateKey]store.RateSample{},
+	}
+}
+
+// Backup fails, as there is nothing durable to back up.
+func (s *Store) Backup(ctx context.Context, filename string) error {
+	return errors.New("the memory store cannot be backed up")
+}
+
+// Close does nothing.
+func (s *Store) Close() error {
+	return nil
+}
+
+func copyBig(v *big.Int) *big.Int {
+	if v == nil {
+		return nil
+	}
+	return new(big.Int).Set(v)
+}
+
+func copyPacket(p store.Packet) *store.Packet {
+	p.StartingValue = copyBig(p.StartingValue)
+	p.EndingValue = copyBig(p.EndingValue)
+	return &p
+}
+
+// Migrate does nothing, as there is no schema.
+func (s *Store) Migrate(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+// CheckSchema always succeeds.
+func (s *Store) CheckSchema(ctx context.Context) error {
+	return nil
+}
+
+// PutUser creates or replaces a user.
+func (s *Store) PutUser(ctx context.Context, user store.User) error {
+	s.Lock()
+	defer s.Unlock()
+	if existing, found := s.users[user.UserID]; found {
+		user.CreatedAt = existing.CreatedAt
+	}
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now().UTC()
+	}
+	s.users[user.UserID] = user
+	return nil
+}
+
+// GetUser returns store.ErrNotFound if the user does not exist.
+func (s *Store) GetUser(ctx context.Context, userID string) (*store.User, error) {
+	s.Lock()
+	defer s.Unlock()
+	u, found := s.users[userID]
+	if !found {
+		return nil, store.ErrNotFound
+	}
+	return &u, nil
+}
+
+// Users returns all users.
+func (s *Store) Users(ctx context.Context) ([]store.User, error) {
+	s.Lock()
+	defer s.Unlock()
+	ret := []store.User{}
+	for _, u := range s.users {
+		ret = append(ret, u)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].UserID < ret[j].UserID })
+	return ret, nil
+}
+
+// AddPacket records a newly assigned packet.
+func (s *Store) AddPacket(ctx context.Context, p *store.Packet) error {
+	s.Lock()
+	defer s.Unlock()
+	s.packets[p.ID] = *copyPacket(*p)
+	return nil
+}
+
+// GetPacket returns store.ErrNotFound if the packet does not exist.
+func (s *Store) GetPacket(ctx context.Context, packetID string) (*store.Packet, error) {
+	s.Lock()
+	defer s.Unlock()
+	p, found := s.packets[packetID]
+	if !found {
+		return nil, store.ErrNotFound
+	}
+	return copyPacket(p), nil
+}
+
+// Packets returns all packets with the given status.
+func (s *Store) Packets(ctx context.Context, status string) ([]*store.Packet, error) {
+	s.Lock()
+	defer s.Unlock()
+	ret := []*store.Packet{}
+	for _, p := range s.packets {
+		if p.Status == status {
+			ret = append(ret, copyPacket(p))
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].AssignedOn.Before(ret[j].AssignedOn) })
+	return ret, nil
+}
+
+// UpdatePacket replaces the mutable fields of an existing packet.
+func (s *Store) UpdatePacket(ctx context.Context, p *store.Packet) error {
+	s.Lock()
+	defer s.Unlock()
+	existing, found := s.packets[p.ID]
+	if !found {
+		return store.ErrNotFound
+	}
+	existing.Status = p.Status
+	existing.Expiry = p.Expiry
+	existing.LastHeartbeat = p.LastHeartbeat
+	existing.EstimatedCompletion = p.EstimatedCompletion
+	s.packets[p.ID] = existing
+	return nil
+}
+
+// ReclaimExpired marks one expired packet as such, and returns it
+// with its previous status.
+func (s *Store) ReclaimExpired(ctx context.Context, now time.Time) (*store.Packet, error) {
+	s.Lock()
+	defer s.Unlock()
+	var oldest *store.Packet
+	for _, p := range s.packets {
+		p := p
+		if p.Status != store.PacketOutstanding && p.Status != store.PacketRejected {
+			continue
+		}
+		if !p.Expiry.Before(now) {
+			continue
+		}
+		if oldest == nil || p.Expiry.Before(oldest.Expiry) {
+			oldest = &p
+		}
+	}
+	if oldest == nil {
+		return nil, nil
+	}
+	updated := *oldest
+	updated.Status = store.PacketExpired
+	s.packets[oldest.ID] = updated
+	return copyPacket(*oldest), nil
+}
+
+// ClaimVerification assigns the oldest double check of a packet not
+// completed by the claiming user, with a filter it supports.
+func (s *Store) ClaimVerification(ctx context.Context, claim *store.Packet, filters []string) (*store.Packet, error) {
+	s.Lock()
+	defer s.Unlock()
+	var oldest *store.Packet
+	for _, p := range s.packets {
+		p := p
+		if p.Status != store.PacketVerify || !hasFilter(filters, p.Filter) {
+			continue
+		}
+		if checked, found := s.packets[p.Verifies]; found && checked.UserID == claim.UserID {
+			continue
+		}
+		if oldest == nil || p.AssignedOn.Before(oldest.AssignedOn) ||
+			(p.AssignedOn.Equal(oldest.AssignedOn) && p.ID < oldest.ID) {
+			oldest = &p
+		}
+	}
+	if oldest == nil {
+		return nil, nil
+	}
+	oldest.Status = store.PacketOutstanding
+	oldest.UserID = claim.UserID
+	oldest.NodeID = claim.NodeID
+	oldest.Nonce = claim.Nonce
+	oldest.AssignedOn = claim.AssignedOn
+	oldest.Expiry = claim.Expiry
+	s.packets[oldest.ID] = *oldest
+	return copyPacket(*oldest), nil
+}
+
+// hasFilter returns true if filter is none, or in filters.
+func hasFilter(filters []string, filter string) bool {
+	if filter == internal.FilterNone {
+		return true
+	}
+	for _, f := range filters {
+		if f == filter {
+			return true
+		}
+	}
+	return false
+}
+
+// CountOutstanding returns the number of unexpired packets held by a user.
+func (s *Store) CountOutstanding(ctx context.Context, userID string, now time.Time) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	count := 0
+	for _, p := range s.packets {
+		if p.UserID == userID && p.Status == store.PacketOutstanding && !p.Expiry.Before(now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// GetNode returns store.ErrNotFound if the node has not been seen.
+func (s *Store) GetNode(ctx context.Context, nodeID string) (*store.Node, error) {
+	s.Lock()
+	defer s.Unlock()
+	n, found := s.nodes[nodeID]
+	if !found {
+		return nil, store.ErrNotFound
+	}
+	return &n, nil
+}
+
+// PutNode creates or replaces a node's history.
+func (s *Store) PutNode(ctx context.Context, n *store.Node) error {
+	s.Lock()
+	defer s.Unlock()
+	s.nodes[n.NodeID] = *n
+	return nil
+}
+
+// AcceptReport applies everything that changes when a report is
+// accepted, while holding the lock.
+func (s *Store) AcceptReport(ctx context.Context, a *store.Acceptance) error {
+	s.Lock()
+	defer s.Unlock()
+	receipt := a.Receipt
+	p, found := s.packets[receipt.PacketID]
+	if !found {
+		return store.ErrNotFound
+	}
+	if p.Status == store.PacketCompleted || p.Status == store.PacketUnverified {
+		return store.ErrAlreadyAccepted
+	}
+	for _, r := range s.reports {
+		// secretcheck:ignore -- the nonce was already checked by the server.
+		if r.PacketID == receipt.PacketID && r.Report.Work.Nonce == a.Report.Work.Nonce {
+			return store.ErrAlreadyAccepted
+		}
+	}
+	p.Status = store.PacketCompleted
+	if a.Verify != nil {
+		p.Status = store.PacketUnverified
+		s.packets[a.Verify.ID] = *copyPacket(*a.Verify)
+	}
+	s.packets[receipt.PacketID] = p
+	if checked, found := s.packets[a.Confirms]; found && checked.Status == store.PacketUnverified {
+		checked.Status = store.PacketCompleted
+		s.packets[a.Confirms] = checked
+	}
+	s.reports = append(s.reports, store.StoredReport{
+		PacketID:   receipt.PacketID,
+		UserID:     receipt.UserID,
+		NodeID:     receipt.NodeID,
+		ReceivedOn: receipt.AcceptedOn,
+		Report:     a.Report,
+	})
+	s.receipts[receipt.UserID] = append(s.receipts[receipt.UserID], receipt)
+	if a.Verify == nil {
+		iv := store.CompletedInterval(receipt)
+		s.complete.Add(iv.Start, iv.End)
+	}
+	for _, r := range a.Records {
+		s.addRecord(r)
+	}
+	if a.Node != nil {
+		s.nodes[a.Node.NodeID] = *a.Node
+	}
+	for _, sample := range a.Rates {
+		s.addRateSample(sample)
+	}
+	return nil
+}
+
+// AddReportConflict keeps a report which conflicts with the accepted
+// report for its packet.
+func (s *Store) AddReportConflict(ctx context.Context, c store.ReportConflict) error {
+	s.Lock()
+	defer s.Unlock()
+	s.conflict = append(s.conflict, c)
+	return nil
+}
+
+// ReportConflicts returns up to limit conflicting reports received at
+// or after the time given, oldest first.
+func (s *Store) ReportConflicts(ctx context.Context, since time.Time, limit int) ([]store.ReportConflict, error) {
+	s.Lock()
+	defer s.Unlock()
+	ret := []store.ReportConflict{}
+	for _, c := range s.conflict {
+		if !c.ReceivedOn.Before(since) {
+			ret = append(ret, c)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].ReceivedOn.Before(ret[j].ReceivedOn) })
+	if len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret, nil
+}
+
+// GetReceipt returns store.ErrNotFound if no receipt was issued for
+// the packet.
+func (s *Store) GetReceipt(ctx context.Context, packetID string) (*internal.Receipt, error) {
+	s.Lock()
+	defer s.Unlock()
+	for _, receipts := range s.receipts {
+		for _, r := range receipts {
+			if r.PacketID == packetID {
+				return &r, nil
+			}
+		}
+	}
+	return nil, store.ErrNotFound
+}
+
+// AddCompletedRange merges an interval into the completed ranges.
+func (s *Store) AddCompletedRange(ctx context.Context, iv intervals.Interval) error {
+	s.Lock()
+	defer s.Unlock()
+	s.complete.Add(iv.Start, iv.End)
+	return nil
+}
+
+// CompletedRanges returns all completed work, merged into intervals.
+func (s *Store) CompletedRanges(ctx context.Context) (*intervals.Set, error) {
+	s.Lock()
+	defer s.Unlock()
+	ret := &intervals.Set{}
+	for _, iv := range s.complete.Intervals() {
+		ret.Add(iv.Start, iv.End)
+	}
+	return ret, nil
+}
+
+// ReportsBefore returns up to limit reports received before the time
+// given, oldest first.
+func (s *Store) ReportsBefore(ctx context.Context, before time.Time, limit int) ([]store.StoredReport, error) {
+	s.Lock()
+	defer s.Unlock()
+	ret := []store.StoredReport{}
+	for _, r := range s.reports {
+		if r.ReceivedOn.Before(before) {
+			ret = append(ret, r)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].ReceivedOn.Before(ret[j].ReceivedOn) })
+	if len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret, nil
+}
+
+// ReportsAfter returns up to limit reports with packet IDs after the
+// one given, in packet ID order.
+func (s *Store) ReportsAfter(ctx context.Context, afterPacketID string, limit int) ([]store.StoredReport, error) {
+	s.Lock()
+	defer s.Unlock()
+	ret := []store.StoredReport{}
+	for _, r := range s.reports {
+		if r.PacketID > afterPacketID {
+			ret = append(ret, r)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].PacketID < ret[j].PacketID })
+	if len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret, nil
+}
+
+// DeleteReports removes the reports for the packets listed.
+func (s *Store) DeleteReports(ctx context.Context, packetIDs []string) error {
+	s.Lock()
+	defer s.Unlock()
+	deleted := map[string]bool{}
+	for _, id := range packetIDs {
+		deleted[id] = true
+	}
+	kept := s.reports[:0]
+	for _, r := range s.reports {
+		if !deleted[r.PacketID] {
+			kept = append(kept, r)
+		}
+	}
+	s.reports = kept
+	return nil
+}
+
+// AddRateSample adds to the bucket holding sample.Start.
+func (s *Store) AddRateSample(ctx context.Context, sample store.RateSample) error {
+	s.Lock()
+	defer s.Unlock()
+	s.addRateSample(sample)
+	return nil
+}
+
+func (s *Store) addRateSample(sample store.RateSample) {
+	start := sample.Start.Truncate(store.RateBucket).UTC()
+	key := rateKey{sample.UserID, start.UnixNano()}
+	r, found := s.rates[key]
+	if !found {
+		r = store.RateSample{UserID: sample.UserID, Start: start}
+	}
+	r.Integers += sample.Integers
+	r.Iterations += sample.Iterations
+	r.Packets += sample.Packets
+	s.rates[key] = r
+}
+
+// RateSamples returns a user's samples in [from, to), oldest first.
+func (s *Store) RateSamples(ctx context.Context, userID string, from, to time.Time) ([]store.RateSample, error) {
+	s.Lock()
+	defer s.Unlock()
+	ret := []store.RateSample{}
+	for key, r := range s.rates {
+		if key.userID == userID && !r.Start.Before(from) && r.Start.Before(to) {
+			ret = append(ret, r)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Start.Before(ret[j].Start) })
+	return ret, nil
+}
+
+// UserTotals sums each user's throughput history.
+func (s *Store) UserTotals(ctx context.Context) ([]store.UserTotals, error) {
+	s.Lock()
+	defer s.Unlock()
+	totals := map[string]*store.UserTotals{}
+	for _, r := range s.rates {
+		if r.UserID == store.AllUsers {
+			continue
+		}
+		t, found := totals[r.UserID]
+		if !found {
+			t = &store.UserTotals{UserID: r.UserID, First: r.Start, Last: r.Start}
+			totals[r.UserID] = t
+		}
+		t.Integers += r.Integers
+		t.Iterations += r.Iterations
+		t.Packets += r.Packets
+		if r.Start.Before(t.First) {
+			t.First = r.Start
+		}
+		if r.Start.After(t.Last) {
+			t.Last = r.Start
+		}
+	}
+	ret := []store.UserTotals{}
+	for _, t := range totals {
+		ret = append(ret, *t)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Integers != ret[j].Integers {
+			return ret[i].Integers > ret[j].Integers
+		}
+		return ret[i].UserID < ret[j].UserID
+	})
+	return ret, nil
+}
+
+// PurgeRateSamples deletes samples which started before the time given.
+func (s *Store) PurgeRateSamples(ctx context.Context, before time.Time) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	n := int64(0)
+	for key, r := range s.rates {
+		if r.Start.Before(before) {
+			delete(s.rates, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// PurgePackets deletes packets with the given status assigned before
+// the time given.
+func (s *Store) PurgePackets(ctx context.Context, status string, assignedBefore time.Time) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	n := int64(0)
+	for id, p := range s.packets {
+		if p.Status == status && p.AssignedOn.Before(assignedBefore) {
+			delete(s.packets, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// PurgeReports deletes reports received before the time given.
+func (s *Store) PurgeReports(ctx context.Context, receivedBefore time.Time) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	kept := s.reports[:0]
+	for _, r := range s.reports {
+		if !r.ReceivedOn.Before(receivedBefore) {
+			kept = append(kept, r)
+		}
+	}
+	n := int64(len(s.reports) - len(kept))
+	s.reports = kept
+	return n, nil
+}
+
+// PurgeNodes deletes nodes last seen before the time given.
+func (s *Store) PurgeNodes(ctx context.Context, lastSeenBefore time.Time) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	n := int64(0)
+	for id, node := range s.nodes {
+		if node.LastSeen.Before(lastSeenBefore) {
+			delete(s.nodes, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Receipts returns all receipts issued to a user, oldest first.
+func (s *Store) Receipts(ctx context.Context, userID string) ([]internal.Receipt, error) {
+	s.Lock()
+	defer s.Unlock()
+	return append([]internal.Receipt{}, s.receipts[userID]...), nil
+}
+
+// AddRecord records a notable finding.
+func (s *Store) AddRecord(ctx context.Context, r store.Record) error {
+	s.Lock()
+	defer s.Unlock()
+	s.addRecord(r)
+	return nil
+}
+
+func (s *Store) addRecord(r store.Record) {
+	r.Value = copyBig(r.Value)
+	s.records = append(s.records, r)
+}
+
+// Records returns all records of a kind, oldest first.
+func (s *Store) Records(ctx context.Context, kind string) ([]store.Record, error) {
+	s.Lock()
+	defer s.Unlock()
+	ret := []store.Record{}
+	for _, r := range s.records {
+		if r.Kind == kind {
+			r.Value = copyBig(r.Value)
+			ret = append(ret, r)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].FoundOn.Before(ret[j].FoundOn) })
+	return ret, nil
+}
+
+// AddTrajectory stores the trajectory of a finding, keeping any
+// already stored for the value.
+func (s *Store) AddTrajectory(ctx context.Context, t store.StoredTrajectory) error {
+	s.Lock()
+	defer s.Unlock()
+	key := t.Trajectory.Value.String()
+	if _, found := s.paths[key]; !found {
+		s.paths[key] = t
+	}
+	return nil
+}
+
+// GetTrajectory returns store.ErrNotFound if no trajectory is stored
+// for the value.
+func (s *Store) GetTrajectory(ctx context.Context, value *big.Int) (*store.StoredTrajectory, error) {
+	s.Lock()
+	defer s.Unlock()
+	t, found := s.paths[value.String()]
+	if !found {
+		return nil, store.ErrNotFound
+	}
+	return &t, nil
+}
+
+// ConsumeNonce records a nonce as used, returning store.ErrNonceReused
+// if it was used for a different packet, user, or range.
+func (s *Store) ConsumeNonce(ctx context.Context, n store.Nonce) error {
+	s.Lock()
+	defer s.Unlock()
+	if prev, found := s.nonces[n.Nonce]; found {
+		if !prev.Same(n) {
+			return store.ErrNonceReused
+		}
+		return nil
+	}
+	n.StartingValue = copyBig(n.StartingValue)
+	n.EndingValue = copyBig(n.EndingValue)
+	s.nonces[n.Nonce] = n
+	return nil
+}
+
+// AddTrust adds to a user's audit history.
+func (s *Store) AddTrust(ctx context.Context, t store.Trust) error {
+	s.Lock()
+	defer s.Unlock()
+	existing := s.trust[t.UserID]
+	existing.UserID = t.UserID
+	existing.Confirmed += t.Confirmed
+	existing.Disputed += t.Disputed
+	existing.AuditFailures += t.AuditFailures
+	existing.UpdatedOn = t.UpdatedOn
+	s.trust[t.UserID] = existing
+	return nil
+}
+
+// GetTrust returns store.ErrNotFound if the user has no audit history.
+func (s *Store) GetTrust(ctx context.Context, userID string) (*store.Trust, error) {
+	s.Lock()
+	defer s.Unlock()
+	t, found := s.trust[userID]
+	if !found {
+		return nil, store.ErrNotFound
+	}
+	return &t, nil
+}
+
+// TrustHistory returns the audit history of every user with one.
+func (s *Store) TrustHistory(ctx context.Context) ([]store.Trust, error) {
+	s.Lock()
+	defer s.Unlock()
+	ret := []store.Trust{}
+	for _, t := range s.trust {
+		ret = append(ret, t)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].UserID < ret[j].UserID })
+	return ret, nil
+}
+
+// AddEnrollment records a newly issued enrollment code.
+func (s *Store) AddEnrollment(ctx context.Context, e store.Enrollment) error {
+	s.Lock()
+	defer s.Unlock()
+	s.enrolls[e.CodeHash] = e
+	return nil
+}
+
+// GetEnrollment returns store.ErrNotFound if no code has the hash.
+func (s *Store) GetEnrollment(ctx context.Context, codeHash string) (*store.Enrollment, error) {
+	s.Lock()
+	defer s.Unlock()
+	e, found := s.enrolls[codeHash]
+	if !found {
+		return nil, store.ErrNotFound
+	}
+	return &e, nil
+}
+
+// RedeemEnrollment marks an unused, unexpired enrollment code used.
+func (s *Store) RedeemEnrollment(ctx context.Context, codeHash string, nodeID string, now time.Time) (*store.Enrollment, error) {
+	s.Lock()
+	defer s.Unlock()
+	e, found := s.enrolls[codeHash]
+	if !found || !e.Redeemable(now) {
+		return nil, store.ErrNotFound
+	}
+	e.RedeemedOn = now
+	e.RedeemedBy = nodeID
+	s.enrolls[codeHash] = e
+	return &e, nil
+}
+
+// Enrollments returns the enrollment codes issued since the time
+// given, oldest first.
+func (s *Store) Enrollments(ctx context.Context, since time.Time) ([]store.Enrollment, error) {
+	s.Lock()
+	defer s.Unlock()
+	ret := []store.Enrollment{}
+	for _, e := range s.enrolls {
+		if !e.IssuedOn.Before(since) {
+			ret = append(ret, e)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].IssuedOn.Before(ret[j].IssuedOn) })
+	return ret, nil
+}
+
+// AddEvent appends an event to the event log, setting its Seq.
+func (s *Store) AddEvent(ctx context.Context, e *internal.Event) error {
+	s.Lock()
+	defer s.Unlock()
+	e.Seq = int64(len(s.events)) + 1
+	s.events = append(s.events, *e)
+	return nil
+}
+
+// Events returns up to limit events with Seq after the one given,
+// oldest first.
+func (s *Store) Events(ctx context.Context, afterSeq int64, limit int) ([]internal.Event, error) {
+	s.Lock()
+	defer s.Unlock()
+	ret := []internal.Event{}
+	for _, e := range s.events {
+		if e.Seq > afterSeq && len(ret) < limit {
+			ret = append(ret, e)
+		}
+	}
+	return ret, nil
+}
+
+// InitFrontier sets the next value to assign, if it is not already set.
+func (s *Store) InitFrontier(ctx context.Context, next *big.Int) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.frontier == nil {
+		s.frontier = copyBig(next)
+	}
+	return nil
+}
+
+// Frontier returns the next value to assign.
+func (s *Store) Frontier(ctx context.Context) (*big.Int, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.frontier == nil {
+		return nil, store.ErrNotFound
+	}
+	return copyBig(s.frontier), nil
+}
+
+// AllocateRange advances the frontier by size, returning the old value.
+func (s *Store) AllocateRange(ctx context.Context, size *big.Int) (*big.Int, error) {
+	s.Lock()
+	defer s.Unlock()
+	start := copyBig(s.frontier)
+	s.frontier.Add(s.frontier, size)
+	return start, nil
+}
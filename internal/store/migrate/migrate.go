@@ -0,0 +1,183 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package migrate applies versioned, embedded SQL migrations to a
+// database, and checks that a database's schema matches the code.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migration is one versioned schema change.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Options customize how migrations are applied for a specific database.
+type Options struct {
+	// LockSQL and UnlockSQL, if set, are run on the connection used
+	// for migrations, to keep concurrent servers from migrating at
+	// the same time.
+	LockSQL   string
+	UnlockSQL string
+}
+
+const versionTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at TEXT NOT NULL
+)`
+
+// Load reads migrations from files in dir named like "0001_initial.sql".
+// Versions must start at 1 and have no gaps.
+func Load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := []Migration{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".sql") {
+			continue
+		}
+		base := strings.TrimSuffix(e.Name(), ".sql")
+		num, name, found := strings.Cut(base, "_")
+		if !found {
+			return nil, fmt.Errorf("migration %s: name must be NNNN_description.sql", e.Name())
+		}
+		version, err := strconv.Atoi(num)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %v", e.Name(), err)
+		}
+		b, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, Migration{Version: version, Name: name, SQL: string(b)})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Version < ret[j].Version })
+	for i, m := range ret {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must be sequential from 1, found %d at position %d", m.Version, i+1)
+		}
+	}
+	return ret, nil
+}
+
+// Latest returns the highest version in a list of migrations.
+func Latest(migrations []Migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// Version returns the current schema version of the database, or
+// zero if no migrations have been applied.
+func Version(ctx context.Context, db *sql.DB) (int, error) {
+	if _, err := db.ExecContext(ctx, versionTable); err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	if err := db.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// Apply runs any migrations not yet applied, each in its own transaction,
+// and returns the number applied.
+func Apply(ctx context.Context, db *sql.DB, migrations []Migration, opts Options) (int, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if opts.LockSQL != "" {
+		if _, err := conn.ExecContext(ctx, opts.LockSQL); err != nil {
+			return 0, fmt.Errorf("locking for migration: %v", err)
+		}
+		defer func() {
+			_, _ = conn.ExecContext(context.Background(), opts.UnlockSQL)
+		}()
+	}
+
+	if _, err := conn.ExecContext(ctx, versionTable); err != nil {
+		return 0, err
+	}
+	var current sql.NullInt64
+	if err := conn.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_migrations`).Scan(&current); err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, m := range migrations {
+		if m.Version <= int(current.Int64) {
+			continue
+		}
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return applied, err
+		}
+		if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+			tx.Rollback()
+			return applied, fmt.Errorf("migration %04d_%s: %v", m.Version, m.Name, err)
+		}
+		// The version and name are ours, not user input, so formatting
+		// them in avoids differences in placeholder syntax.
+		record := fmt.Sprintf(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (%d, '%s', '%s')`,
+			m.Version, strings.ReplaceAll(m.Name, "'", "''"), time.Now().UTC().Format(time.RFC3339))
+		if _, err := tx.ExecContext(ctx, record); err != nil {
+			tx.Rollback()
+			return applied, err
+		}
+		if err := tx.Commit(); err != nil {
+			return applied, err
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// Check returns an error unless the database schema is exactly the
+// latest version known to this code.
+func Check(ctx context.Context, db *sql.DB, migrations []Migration) error {
+	version, err := Version(ctx, db)
+	if err != nil {
+		return err
+	}
+	latest := Latest(migrations)
+	switch {
+	case version < latest:
+		return fmt.Errorf("database schema is version %d, but this server requires %d; run \"blockserver migrate\"", version, latest)
+	case version > latest:
+		return fmt.Errorf("database schema is version %d, newer than this server supports (%d); upgrade the server", version, latest)
+	}
+	return nil
+}
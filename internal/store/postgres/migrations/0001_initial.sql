@@ -0,0 +1,63 @@
+CREATE TABLE IF NOT EXISTS users (
+	user_id TEXT PRIMARY KEY,
+	user_secret_version TEXT NOT NULL,
+	user_secret TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS packets (
+	id TEXT PRIMARY KEY,
+	nonce TEXT NOT NULL,
+	starting_value NUMERIC NOT NULL,
+	ending_value NUMERIC NOT NULL,
+	assigned_on TIMESTAMPTZ NOT NULL,
+	expiry TIMESTAMPTZ NOT NULL,
+	user_id TEXT NOT NULL,
+	node_id TEXT NOT NULL,
+	status TEXT NOT NULL,
+	last_heartbeat TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS packets_status_expiry ON packets (status, expiry);
+CREATE INDEX IF NOT EXISTS packets_user_status ON packets (user_id, status);
+
+CREATE TABLE IF NOT EXISTS nodes (
+	node_id TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	assigned INTEGER NOT NULL,
+	completed INTEGER NOT NULL,
+	expired INTEGER NOT NULL,
+	last_seen TIMESTAMPTZ NOT NULL,
+	rate DOUBLE PRECISION NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS reports (
+	packet_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	node_id TEXT NOT NULL,
+	received_on TIMESTAMPTZ NOT NULL,
+	report JSONB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS reports_packet ON reports (packet_id);
+
+CREATE TABLE IF NOT EXISTS receipts (
+	packet_id TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	accepted_on TIMESTAMPTZ NOT NULL,
+	receipt JSONB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS receipts_user ON receipts (user_id, accepted_on);
+
+CREATE TABLE IF NOT EXISTS records (
+	kind TEXT NOT NULL,
+	value NUMERIC,
+	iterations BIGINT NOT NULL,
+	packet_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	found_on TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS records_kind ON records (kind, found_on);
+
+CREATE TABLE IF NOT EXISTS frontier (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	next_value NUMERIC NOT NULL
+);
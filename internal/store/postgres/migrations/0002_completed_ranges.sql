@@ -0,0 +1,24 @@
+-- Completed work as merged ranges.  Both ends are inclusive, matching
+-- packets.  Existing completed packets are merged with the usual
+-- gaps-and-islands query.
+CREATE TABLE IF NOT EXISTS completed_ranges (
+	start_value NUMERIC PRIMARY KEY,
+	last_value NUMERIC NOT NULL
+);
+CREATE INDEX IF NOT EXISTS completed_ranges_last ON completed_ranges (last_value);
+
+INSERT INTO completed_ranges (start_value, last_value)
+SELECT MIN(start_value), MAX(last_value)
+FROM (
+	SELECT start_value, last_value,
+		SUM(CASE WHEN start_value <= prev_last + 1 THEN 0 ELSE 1 END)
+			OVER (ORDER BY start_value) AS island
+	FROM (
+		SELECT starting_value AS start_value, ending_value AS last_value,
+			MAX(ending_value) OVER (ORDER BY starting_value
+				ROWS BETWEEN UNBOUNDED PRECEDING AND 1 PRECEDING) AS prev_last
+		FROM packets WHERE status = 'completed'
+	) AS ordered
+) AS islands
+GROUP BY island
+ON CONFLICT (start_value) DO NOTHING;
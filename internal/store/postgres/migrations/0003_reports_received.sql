@@ -0,0 +1,2 @@
+-- The archiver reads the oldest reports first.
+CREATE INDEX IF NOT EXISTS reports_received ON reports (received_on);
@@ -0,0 +1,11 @@
+-- Completed work per user per minute, for throughput history.  The
+-- empty user_id holds the totals across all users.
+CREATE TABLE IF NOT EXISTS rate_samples (
+	user_id TEXT NOT NULL,
+	bucket TIMESTAMPTZ NOT NULL,
+	integers BIGINT NOT NULL,
+	iterations BIGINT NOT NULL,
+	packets BIGINT NOT NULL,
+	PRIMARY KEY (user_id, bucket)
+);
+CREATE INDEX IF NOT EXISTS rate_samples_bucket ON rate_samples (bucket);
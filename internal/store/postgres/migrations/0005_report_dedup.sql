@@ -0,0 +1,33 @@
+-- Accepted reports are unique by packet and nonce.  A later completed
+-- report for the same packet is kept in report_conflicts for audit,
+-- rather than replacing the first.
+ALTER TABLE reports ADD COLUMN IF NOT EXISTS nonce TEXT NOT NULL DEFAULT '';
+UPDATE reports SET nonce = COALESCE(report->'work'->>'nonce', '');
+
+CREATE TABLE IF NOT EXISTS report_conflicts (
+	packet_id TEXT NOT NULL,
+	nonce TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	node_id TEXT NOT NULL,
+	received_on TIMESTAMPTZ NOT NULL,
+	report JSONB NOT NULL,
+	reason TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS report_conflicts_received ON report_conflicts (received_on);
+
+-- Duplicates from before the index: the first received stays, and the
+-- rest become conflicts.
+WITH duplicates AS (
+	DELETE FROM reports WHERE ctid IN (
+		SELECT ctid FROM (
+			SELECT ctid, row_number() OVER (PARTITION BY packet_id, nonce ORDER BY received_on, ctid) AS n
+			FROM reports
+		) ranked WHERE n > 1
+	)
+	RETURNING packet_id, nonce, user_id, node_id, received_on, report
+)
+INSERT INTO report_conflicts (packet_id, nonce, user_id, node_id, received_on, report, reason)
+SELECT packet_id, nonce, user_id, node_id, received_on, report, 'duplicate' FROM duplicates;
+
+DROP INDEX IF EXISTS reports_packet;
+CREATE UNIQUE INDEX IF NOT EXISTS reports_packet_nonce ON reports (packet_id, nonce);
@@ -0,0 +1,8 @@
+-- Trajectories of findings, sent by clients on request.
+CREATE TABLE IF NOT EXISTS trajectories (
+	value NUMERIC PRIMARY KEY,
+	packet_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	received_on TIMESTAMPTZ NOT NULL,
+	trajectory JSONB NOT NULL
+);
@@ -0,0 +1,8 @@
+-- The event log: findings, records, and audit failures.  The event
+-- itself is JSON; seq orders the log.
+CREATE TABLE IF NOT EXISTS events (
+	seq BIGSERIAL PRIMARY KEY,
+	time TIMESTAMPTZ NOT NULL,
+	kind TEXT NOT NULL,
+	event JSONB NOT NULL
+);
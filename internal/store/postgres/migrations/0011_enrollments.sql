@@ -0,0 +1,11 @@
+-- One-time codes a new node exchanges for its user's credentials.
+-- Only a hash of each code is kept.
+CREATE TABLE IF NOT EXISTS enrollments (
+	code_hash TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	issued_on TIMESTAMPTZ NOT NULL,
+	expires_on TIMESTAMPTZ NOT NULL,
+	redeemed_on TIMESTAMPTZ,
+	redeemed_by TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS enrollments_issued_on ON enrollments (issued_on);
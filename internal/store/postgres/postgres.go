@@ -0,0 +1,1070 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package postgres implements store.Store on PostgreSQL, for deployments
+// which run several server replicas against one database.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os/exec"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/intervals"
+	"github.com/skandragon/collatz/internal/store"
+	"github.com/skandragon/collatz/internal/store/migrate"
+
+	// registers the "pgx" driver
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is an arbitrary key for the advisory lock which keeps
+// replicas from migrating concurrently.
+const migrationLockID int64 = 0x636f6c6c61747a
+
+// Store is a store.Store backed by PostgreSQL.
+type Store struct {
+	db  *sql.DB
+	dsn string
+}
+
+var _ store.Store = (*Store)(nil)
+
+// Open connects to the database described by the URL or DSN provided.
+// The schema is not created or checked; see Migrate and CheckSchema.
+func Open(ctx context.Context, dsn string) (*Store, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db, dsn: dsn}, nil
+}
+
+// Backup runs pg_dump, which must be on the PATH, writing a custom
+// format archive to filename.
+func (s *Store) Backup(ctx context.Context, filename string) error {
+	return run(ctx, "pg_dump", "--format=custom", "--file="+filename, "--dbname="+s.dsn)
+}
+
+// Restore runs pg_restore, which must be on the PATH, replacing the
+// contents of the database with a backup made by Backup.  The server
+// should not be running.
+func Restore(ctx context.Context, dsn, backup string) error {
+	return run(ctx, "pg_restore", "--clean", "--if-exists", "--no-owner",
+		"--single-transaction", "--dbname="+dsn, backup)
+}
+
+func run(ctx context.Context, name string, args ...string) error {
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", name, err, out)
+	}
+	return nil
+}
+
+func migrations() ([]migrate.Migration, error) {
+	return migrate.Load(migrationFiles, "migrations")
+}
+
+// Migrate brings the schema up to date, returning the number of
+// migrations applied.
+func (s *Store) Migrate(ctx context.Context) (int, error) {
+	m, err := migrations()
+	if err != nil {
+		return 0, err
+	}
+	return migrate.Apply(ctx, s.db, m, migrate.Options{
+		LockSQL:   fmt.Sprintf("SELECT pg_advisory_lock(%d)", migrationLockID),
+		UnlockSQL: fmt.Sprintf("SELECT pg_advisory_unlock(%d)", migrationLockID),
+	})
+}
+
+// CheckSchema returns an error if the schema is not the version this
+// code expects.
+func (s *Store) CheckSchema(ctx context.Context) error {
+	m, err := migrations()
+	if err != nil {
+		return err
+	}
+	return migrate.Check(ctx, s.db, m)
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func parseBig(s string) (*big.Int, error) {
+	v, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid integer %q in database", s)
+	}
+	return v, nil
+}
+
+// PutUser creates or replaces a user.
+func (s *Store) PutUser(ctx context.Context, user store.User) error {
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now().UTC()
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO users (user_id, user_secret_version, user_secret, created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE SET
+			user_secret_version = excluded.user_secret_version,
+			user_secret = excluded.user_secret`,
+		user.UserID, user.UserSecretVersion, user.UserSecret, user.CreatedAt)
+	return err
+}
+
+// GetUser returns store.ErrNotFound if the user does not exist.
+func (s *Store) GetUser(ctx context.Context, userID string) (*store.User, error) {
+	var u store.User
+	err := s.db.QueryRowContext(ctx, `
+		SELECT user_id, user_secret_version, user_secret, created_at
+		FROM users WHERE user_id = $1`, userID).
+		Scan(&u.UserID, &u.UserSecretVersion, &u.UserSecret, &u.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.CreatedAt = u.CreatedAt.UTC()
+	return &u, nil
+}
+
+// Users returns all users.
+func (s *Store) Users(ctx context.Context) ([]store.User, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT user_id, user_secret_version, user_secret, created_at
+		FROM users ORDER BY user_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []store.User{}
+	for rows.Next() {
+		var u store.User
+		if err := rows.Scan(&u.UserID, &u.UserSecretVersion, &u.UserSecret, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		u.CreatedAt = u.CreatedAt.UTC()
+		ret = append(ret, u)
+	}
+	return ret, rows.Err()
+}
+
+const packetColumns = `id, nonce, starting_value::text, ending_value::text, assigned_on, expiry,
+	user_id, node_id, status, last_heartbeat, estimated_completion, verifies, filter`
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPacket(row scanner) (*store.Packet, error) {
+	var p store.Packet
+	var start, end string
+	var lastHeartbeat, estimatedCompletion sql.NullTime
+	err := row.Scan(&p.ID, &p.Nonce, &start, &end, &p.AssignedOn, &p.Expiry,
+		&p.UserID, &p.NodeID, &p.Status, &lastHeartbeat, &estimatedCompletion, &p.Verifies, &p.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if p.StartingValue, err = parseBig(start); err != nil {
+		return nil, err
+	}
+	if p.EndingValue, err = parseBig(end); err != nil {
+		return nil, err
+	}
+	p.AssignedOn = p.AssignedOn.UTC()
+	p.Expiry = p.Expiry.UTC()
+	if lastHeartbeat.Valid {
+		p.LastHeartbeat = lastHeartbeat.Time.UTC()
+	}
+	if estimatedCompletion.Valid {
+		p.EstimatedCompletion = estimatedCompletion.Time.UTC()
+	}
+	return &p, nil
+}
+
+// AddPacket records a newly assigned packet.
+func (s *Store) AddPacket(ctx context.Context, p *store.Packet) error {
+	return addPacket(ctx, s.db, p)
+}
+
+func addPacket(ctx context.Context, ex execer, p *store.Packet) error {
+	_, err := ex.ExecContext(ctx, `
+		INSERT INTO packets (id, nonce, starting_value, ending_value, assigned_on, expiry,
+			user_id, node_id, status, last_heartbeat, estimated_completion, verifies, filter)
+		VALUES ($1, $2, $3::numeric, $4::numeric, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		p.ID, p.Nonce, p.StartingValue.String(), p.EndingValue.String(),
+		p.AssignedOn, p.Expiry, p.UserID, p.NodeID, p.Status, nullTime(p.LastHeartbeat),
+		nullTime(p.EstimatedCompletion), p.Verifies, p.Filter)
+	return err
+}
+
+// GetPacket returns store.ErrNotFound if the packet does not exist.
+func (s *Store) GetPacket(ctx context.Context, packetID string) (*store.Packet, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+packetColumns+` FROM packets WHERE id = $1`, packetID)
+	p, err := scanPacket(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	return p, err
+}
+
+// Packets returns all packets with the given status.
+func (s *Store) Packets(ctx context.Context, status string) ([]*store.Packet, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+packetColumns+` FROM packets WHERE status = $1 ORDER BY assigned_on`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []*store.Packet{}
+	for rows.Next() {
+		p, err := scanPacket(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, p)
+	}
+	return ret, rows.Err()
+}
+
+// UpdatePacket replaces the mutable fields of an existing packet.
+func (s *Store) UpdatePacket(ctx context.Context, p *store.Packet) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE packets SET status = $1, expiry = $2, last_heartbeat = $3, estimated_completion = $4
+		WHERE id = $5`,
+		p.Status, p.Expiry, nullTime(p.LastHeartbeat), nullTime(p.EstimatedCompletion), p.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// ReclaimExpired marks one expired packet as such, and returns it
+// with its previous status.  Rows locked by another replica are skipped rather than waited on.
+func (s *Store) ReclaimExpired(ctx context.Context, now time.Time) (*store.Packet, error) {
+	row := s.db.QueryRowContext(ctx, `
+		WITH victim AS (
+			SELECT id, status FROM packets
+			WHERE status IN ($2, $3) AND expiry < $4
+			ORDER BY expiry LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE packets p SET status = $1
+		FROM victim WHERE p.id = victim.id
+		RETURNING p.id, p.nonce, p.starting_value::text, p.ending_value::text, p.assigned_on,
+			p.expiry, p.user_id, p.node_id, victim.status, p.last_heartbeat, p.estimated_completion,
+			p.verifies, p.filter`,
+		store.PacketExpired, store.PacketOutstanding, store.PacketRejected, now)
+	p, err := scanPacket(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return p, err
+}
+
+// ClaimVerification assigns the oldest double check of a packet not
+// completed by the claiming user, with a filter it supports.  Rows
+// locked by another replica are skipped rather than waited on.
+func (s *Store) ClaimVerification(ctx context.Context, claim *store.Packet, filters []string) (*store.Packet, error) {
+	row := s.db.QueryRowContext(ctx, `
+		WITH victim AS (
+			SELECT v.id FROM packets v LEFT JOIN packets c ON c.id = v.verifies
+			WHERE v.status = $1 AND (c.user_id IS NULL OR c.user_id <> $2)
+				AND v.filter = ANY($8)
+			ORDER BY v.assigned_on, v.id LIMIT 1
+			FOR UPDATE OF v SKIP LOCKED
+		)
+		UPDATE packets p SET status = $3, user_id = $2, node_id = $4, nonce = $5,
+			assigned_on = $6, expiry = $7
+		FROM victim WHERE p.id = victim.id
+		RETURNING p.id, p.nonce, p.starting_value::text, p.ending_value::text, p.assigned_on,
+			p.expiry, p.user_id, p.node_id, p.status, p.last_heartbeat, p.estimated_completion,
+			p.verifies, p.filter`,
+		store.PacketVerify, claim.UserID, store.PacketOutstanding, claim.NodeID, claim.Nonce,
+		claim.AssignedOn, claim.Expiry, append([]string{internal.FilterNone}, filters...))
+	p, err := scanPacket(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return p, err
+}
+
+// CountOutstanding returns the number of unexpired packets held by a user.
+func (s *Store) CountOutstanding(ctx context.Context, userID string, now time.Time) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM packets
+		WHERE user_id = $1 AND status = $2 AND expiry >= $3`,
+		userID, store.PacketOutstanding, now).Scan(&count)
+	return count, err
+}
+
+// GetNode returns store.ErrNotFound if the node has not been seen.
+func (s *Store) GetNode(ctx context.Context, nodeID string) (*store.Node, error) {
+	var n store.Node
+	err := s.db.QueryRowContext(ctx, `
+		SELECT node_id, user_id, assigned, completed, expired, last_seen, rate
+		FROM nodes WHERE node_id = $1`, nodeID).
+		Scan(&n.NodeID, &n.UserID, &n.Assigned, &n.Completed, &n.Expired, &n.LastSeen, &n.Rate)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	n.LastSeen = n.LastSeen.UTC()
+	return &n, nil
+}
+
+// PutNode creates or replaces a node's history.
+func (s *Store) PutNode(ctx context.Context, n *store.Node) error {
+	return putNode(ctx, s.db, n)
+}
+
+func putNode(ctx context.Context, ex execer, n *store.Node) error {
+	_, err := ex.ExecContext(ctx, `
+		INSERT INTO nodes (node_id, user_id, assigned, completed, expired, last_seen, rate)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (node_id) DO UPDATE SET
+			user_id = excluded.user_id,
+			assigned = excluded.assigned,
+			completed = excluded.completed,
+			expired = excluded.expired,
+			last_seen = excluded.last_seen,
+			rate = excluded.rate`,
+		n.NodeID, n.UserID, n.Assigned, n.Completed, n.Expired, n.LastSeen, n.Rate)
+	return err
+}
+
+// AcceptReport applies everything that changes when a report is
+// accepted, in one transaction.
+func (s *Store) AcceptReport(ctx context.Context, a *store.Acceptance) error {
+	reportJSON, err := json.Marshal(a.Report)
+	if err != nil {
+		return err
+	}
+	receiptJSON, err := json.Marshal(a.Receipt)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	status := store.PacketCompleted
+	if a.Verify != nil {
+		status = store.PacketUnverified
+	}
+	res, err := tx.ExecContext(ctx, `UPDATE packets SET status = $1 WHERE id = $2 AND status NOT IN ($3, $4)`,
+		status, a.Receipt.PacketID, store.PacketCompleted, store.PacketUnverified)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var status string
+		err := tx.QueryRowContext(ctx, `SELECT status FROM packets WHERE id = $1`, a.Receipt.PacketID).Scan(&status)
+		if errors.Is(err, sql.ErrNoRows) {
+			return store.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return store.ErrAlreadyAccepted
+	}
+	res, err = tx.ExecContext(ctx, `
+		INSERT INTO reports (packet_id, nonce, user_id, node_id, received_on, report)
+		VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (packet_id, nonce) DO NOTHING`,
+		a.Receipt.PacketID, a.Report.Work.Nonce, a.Receipt.UserID, a.Receipt.NodeID, a.Receipt.AcceptedOn, reportJSON)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return store.ErrAlreadyAccepted
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO receipts (packet_id, user_id, accepted_on, receipt)
+		VALUES ($1, $2, $3, $4)`,
+		a.Receipt.PacketID, a.Receipt.UserID, a.Receipt.AcceptedOn, receiptJSON); err != nil {
+		return err
+	}
+	if a.Verify != nil {
+		if err := addPacket(ctx, tx, a.Verify); err != nil {
+			return err
+		}
+	} else if err := addCompletedRange(ctx, tx, store.CompletedInterval(a.Receipt)); err != nil {
+		return err
+	}
+	if a.Confirms != "" {
+		if _, err := tx.ExecContext(ctx, `UPDATE packets SET status = $1 WHERE id = $2 AND status = $3`,
+			store.PacketCompleted, a.Confirms, store.PacketUnverified); err != nil {
+			return err
+		}
+	}
+	for _, r := range a.Records {
+		if err := addRecord(ctx, tx, r); err != nil {
+			return err
+		}
+	}
+	if a.Node != nil {
+		if err := putNode(ctx, tx, a.Node); err != nil {
+			return err
+		}
+	}
+	for _, sample := range a.Rates {
+		if err := addRateSample(ctx, tx, sample); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AddReportConflict keeps a report which conflicts with the accepted
+// report for its packet.
+func (s *Store) AddReportConflict(ctx context.Context, c store.ReportConflict) error {
+	b, err := json.Marshal(c.Report)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO report_conflicts (packet_id, nonce, user_id, node_id, received_on, report, reason)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		c.PacketID, c.Report.Work.Nonce, c.UserID, c.NodeID, c.ReceivedOn, b, c.Reason)
+	return err
+}
+
+// ReportConflicts returns up to limit conflicting reports received at
+// or after the time given, oldest first.
+func (s *Store) ReportConflicts(ctx context.Context, since time.Time, limit int) ([]store.ReportConflict, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT packet_id, user_id, node_id, received_on, report, reason FROM report_conflicts
+		WHERE received_on >= $1 ORDER BY received_on LIMIT $2`,
+		since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []store.ReportConflict{}
+	for rows.Next() {
+		var c store.ReportConflict
+		var b []byte
+		if err := rows.Scan(&c.PacketID, &c.UserID, &c.NodeID, &c.ReceivedOn, &b, &c.Reason); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &c.Report); err != nil {
+			return nil, err
+		}
+		c.ReceivedOn = c.ReceivedOn.UTC()
+		ret = append(ret, c)
+	}
+	return ret, rows.Err()
+}
+
+// GetReceipt returns store.ErrNotFound if no receipt was issued for
+// the packet.
+func (s *Store) GetReceipt(ctx context.Context, packetID string) (*internal.Receipt, error) {
+	var b []byte
+	err := s.db.QueryRowContext(ctx, `SELECT receipt FROM receipts WHERE packet_id = $1`, packetID).Scan(&b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r internal.Receipt
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// completedRangesLockID serializes merges into completed_ranges, as two
+// replicas completing neighbouring packets would otherwise both insert.
+const completedRangesLockID int64 = migrationLockID + 1
+
+// addCompletedRange merges iv with any stored ranges it touches: those
+// starting from the last to start below iv, which may end just before
+// it, up to just after iv's end.  Bounding start_value, rather than
+// testing each range's end, keeps the search to the primary key.
+func addCompletedRange(ctx context.Context, tx *sql.Tx, iv intervals.Interval) error {
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, completedRangesLockID); err != nil {
+		return err
+	}
+	last := new(big.Int).Sub(iv.End, big.NewInt(1))
+	var start, newLast string
+	err := tx.QueryRowContext(ctx, `
+		WITH merged AS (
+			DELETE FROM completed_ranges
+			WHERE start_value >= COALESCE(
+					(SELECT MAX(start_value) FROM completed_ranges WHERE start_value < $1::numeric),
+					$1::numeric)
+				AND start_value <= $2::numeric + 1 AND last_value >= $1::numeric - 1
+			RETURNING start_value, last_value
+		)
+		SELECT LEAST(MIN(start_value), $1::numeric)::text,
+			GREATEST(MAX(last_value), $2::numeric)::text
+		FROM merged`, iv.Start.String(), last.String()).Scan(&start, &newLast)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO completed_ranges (start_value, last_value)
+		VALUES ($1::numeric, $2::numeric)`, start, newLast)
+	return err
+}
+
+// AddCompletedRange merges an interval into the completed ranges.
+func (s *Store) AddCompletedRange(ctx context.Context, iv intervals.Interval) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := addCompletedRange(ctx, tx, iv); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CompletedRanges returns all completed work, merged into intervals.
+func (s *Store) CompletedRanges(ctx context.Context) (*intervals.Set, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT start_value::text, (last_value + 1)::text
+		FROM completed_ranges ORDER BY start_value`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := &intervals.Set{}
+	for rows.Next() {
+		var start, end string
+		if err := rows.Scan(&start, &end); err != nil {
+			return nil, err
+		}
+		lo, err := parseBig(start)
+		if err != nil {
+			return nil, err
+		}
+		hi, err := parseBig(end)
+		if err != nil {
+			return nil, err
+		}
+		ret.Add(lo, hi)
+	}
+	return ret, rows.Err()
+}
+
+// ReportsBefore returns up to limit reports received before the time
+// given, oldest first.
+func (s *Store) ReportsBefore(ctx context.Context, before time.Time, limit int) ([]store.StoredReport, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT packet_id, user_id, node_id, received_on, report FROM reports
+		WHERE received_on < $1 ORDER BY received_on, packet_id LIMIT $2`,
+		before, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanReports(rows)
+}
+
+// ReportsAfter returns up to limit reports with packet IDs after the
+// one given, in packet ID order.
+func (s *Store) ReportsAfter(ctx context.Context, afterPacketID string, limit int) ([]store.StoredReport, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT packet_id, user_id, node_id, received_on, report FROM reports
+		WHERE packet_id > $1 ORDER BY packet_id LIMIT $2`,
+		afterPacketID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanReports(rows)
+}
+
+// DeleteReports removes the reports for the packets listed.
+func (s *Store) DeleteReports(ctx context.Context, packetIDs []string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM reports WHERE packet_id = ANY($1)`, packetIDs)
+	return err
+}
+
+// AddRateSample adds to the bucket holding sample.Start.
+func (s *Store) AddRateSample(ctx context.Context, sample store.RateSample) error {
+	return addRateSample(ctx, s.db, sample)
+}
+
+func addRateSample(ctx context.Context, ex execer, sample store.RateSample) error {
+	_, err := ex.ExecContext(ctx, `
+		INSERT INTO rate_samples (user_id, bucket, integers, iterations, packets)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, bucket) DO UPDATE SET
+			integers = rate_samples.integers + excluded.integers,
+			iterations = rate_samples.iterations + excluded.iterations,
+			packets = rate_samples.packets + excluded.packets`,
+		sample.UserID, sample.Start.Truncate(store.RateBucket),
+		sample.Integers, sample.Iterations, sample.Packets)
+	return err
+}
+
+// RateSamples returns a user's samples in [from, to), oldest first.
+func (s *Store) RateSamples(ctx context.Context, userID string, from, to time.Time) ([]store.RateSample, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT bucket, integers, iterations, packets FROM rate_samples
+		WHERE user_id = $1 AND bucket >= $2 AND bucket < $3 ORDER BY bucket`,
+		userID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []store.RateSample{}
+	for rows.Next() {
+		r := store.RateSample{UserID: userID}
+		if err := rows.Scan(&r.Start, &r.Integers, &r.Iterations, &r.Packets); err != nil {
+			return nil, err
+		}
+		r.Start = r.Start.UTC()
+		ret = append(ret, r)
+	}
+	return ret, rows.Err()
+}
+
+// UserTotals sums each user's throughput history.
+func (s *Store) UserTotals(ctx context.Context) ([]store.UserTotals, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT user_id, SUM(integers), SUM(iterations), SUM(packets), MIN(bucket), MAX(bucket)
+		FROM rate_samples WHERE user_id <> $1
+		GROUP BY user_id ORDER BY SUM(integers) DESC, user_id`, store.AllUsers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []store.UserTotals{}
+	for rows.Next() {
+		var t store.UserTotals
+		if err := rows.Scan(&t.UserID, &t.Integers, &t.Iterations, &t.Packets, &t.First, &t.Last); err != nil {
+			return nil, err
+		}
+		t.First = t.First.UTC()
+		t.Last = t.Last.UTC()
+		ret = append(ret, t)
+	}
+	return ret, rows.Err()
+}
+
+// PurgeRateSamples deletes samples which started before the time given.
+func (s *Store) PurgeRateSamples(ctx context.Context, before time.Time) (int64, error) {
+	return s.purge(ctx, `DELETE FROM rate_samples WHERE bucket < $1`, before)
+}
+
+// PurgePackets deletes packets with the given status assigned before
+// the time given.
+func (s *Store) PurgePackets(ctx context.Context, status string, assignedBefore time.Time) (int64, error) {
+	return s.purge(ctx, `DELETE FROM packets WHERE status = $1 AND assigned_on < $2`,
+		status, assignedBefore)
+}
+
+// PurgeReports deletes reports received before the time given.
+func (s *Store) PurgeReports(ctx context.Context, receivedBefore time.Time) (int64, error) {
+	return s.purge(ctx, `DELETE FROM reports WHERE received_on < $1`, receivedBefore)
+}
+
+// PurgeNodes deletes nodes last seen before the time given.
+func (s *Store) PurgeNodes(ctx context.Context, lastSeenBefore time.Time) (int64, error) {
+	return s.purge(ctx, `DELETE FROM nodes WHERE last_seen < $1`, lastSeenBefore)
+}
+
+func (s *Store) purge(ctx context.Context, query string, args ...any) (int64, error) {
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Receipts returns all receipts issued to a user, oldest first.
+func (s *Store) Receipts(ctx context.Context, userID string) ([]internal.Receipt, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT receipt FROM receipts WHERE user_id = $1 ORDER BY accepted_on`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []internal.Receipt{}
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		var r internal.Receipt
+		if err := json.Unmarshal(b, &r); err != nil {
+			return nil, err
+		}
+		ret = append(ret, r)
+	}
+	return ret, rows.Err()
+}
+
+// AddRecord records a notable finding.
+func (s *Store) AddRecord(ctx context.Context, r store.Record) error {
+	return addRecord(ctx, s.db, r)
+}
+
+func addRecord(ctx context.Context, ex execer, r store.Record) error {
+	var value sql.NullString
+	if r.Value != nil {
+		value = sql.NullString{String: r.Value.String(), Valid: true}
+	}
+	_, err := ex.ExecContext(ctx, `
+		INSERT INTO records (kind, value, iterations, packet_id, user_id, found_on)
+		VALUES ($1, $2::numeric, $3, $4, $5, $6)`,
+		r.Kind, value, int64(r.Iterations), r.PacketID, r.UserID, r.FoundOn)
+	return err
+}
+
+// Records returns all records of a kind, oldest first.
+func (s *Store) Records(ctx context.Context, kind string) ([]store.Record, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT kind, value::text, iterations, packet_id, user_id, found_on
+		FROM records WHERE kind = $1 ORDER BY found_on`, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []store.Record{}
+	for rows.Next() {
+		var r store.Record
+		var value sql.NullString
+		var iterations int64
+		if err := rows.Scan(&r.Kind, &value, &iterations, &r.PacketID, &r.UserID, &r.FoundOn); err != nil {
+			return nil, err
+		}
+		if value.Valid {
+			if r.Value, err = parseBig(value.String); err != nil {
+				return nil, err
+			}
+		}
+		r.Iterations = uint64(iterations)
+		r.FoundOn = r.FoundOn.UTC()
+		ret = append(ret, r)
+	}
+	return ret, rows.Err()
+}
+
+// AddTrajectory stores the trajectory of a finding, keeping any
+// already stored for the value.
+func (s *Store) AddTrajectory(ctx context.Context, t store.StoredTrajectory) error {
+	b, err := json.Marshal(t.Trajectory)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO trajectories (value, packet_id, user_id, received_on, trajectory)
+		VALUES ($1::numeric, $2, $3, $4, $5) ON CONFLICT (value) DO NOTHING`,
+		t.Trajectory.Value.String(), t.Trajectory.PacketID, t.UserID, t.ReceivedOn, b)
+	return err
+}
+
+// GetTrajectory returns store.ErrNotFound if no trajectory is stored
+// for the value.
+func (s *Store) GetTrajectory(ctx context.Context, value *big.Int) (*store.StoredTrajectory, error) {
+	var t store.StoredTrajectory
+	var b []byte
+	err := s.db.QueryRowContext(ctx, `
+		SELECT user_id, received_on, trajectory FROM trajectories WHERE value = $1::numeric`,
+		value.String()).Scan(&t.UserID, &t.ReceivedOn, &b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &t.Trajectory); err != nil {
+		return nil, err
+	}
+	t.ReceivedOn = t.ReceivedOn.UTC()
+	return &t, nil
+}
+
+// AddEvent appends an event to the event log, setting its Seq.
+func (s *Store) AddEvent(ctx context.Context, e *internal.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.db.QueryRowContext(ctx, `
+		INSERT INTO events (time, kind, event) VALUES ($1, $2, $3) RETURNING seq`,
+		e.Time, e.Kind, b).Scan(&e.Seq)
+}
+
+// ConsumeNonce records a nonce as used, returning store.ErrNonceReused
+// if it was used for a different packet, user, or range.
+func (s *Store) ConsumeNonce(ctx context.Context, n store.Nonce) error {
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO nonces (nonce, packet_id, user_id, starting_value, ending_value, consumed_on)
+		VALUES ($1, $2, $3, $4::numeric, $5::numeric, $6) ON CONFLICT (nonce) DO NOTHING`,
+		n.Nonce, n.PacketID, n.UserID, n.StartingValue.String(), n.EndingValue.String(), n.ConsumedOn)
+	if err != nil {
+		return err
+	}
+	if inserted, err := res.RowsAffected(); err != nil || inserted == 1 {
+		return err
+	}
+	prev := store.Nonce{Nonce: n.Nonce}
+	var start, end string
+	err = s.db.QueryRowContext(ctx, `
+		SELECT packet_id, user_id, starting_value::text, ending_value::text FROM nonces WHERE nonce = $1`,
+		n.Nonce).Scan(&prev.PacketID, &prev.UserID, &start, &end)
+	if err != nil {
+		return err
+	}
+	prev.StartingValue, _ = new(big.Int).SetString(start, 10)
+	prev.EndingValue, _ = new(big.Int).SetString(end, 10)
+	if prev.StartingValue == nil || prev.EndingValue == nil || !prev.Same(n) {
+		return store.ErrNonceReused
+	}
+	return nil
+}
+
+// AddTrust adds to a user's audit history.
+func (s *Store) AddTrust(ctx context.Context, t store.Trust) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO trust (user_id, confirmed, disputed, audit_failures, updated_on)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE SET
+			confirmed = trust.confirmed + excluded.confirmed,
+			disputed = trust.disputed + excluded.disputed,
+			audit_failures = trust.audit_failures + excluded.audit_failures,
+			updated_on = excluded.updated_on`,
+		t.UserID, t.Confirmed, t.Disputed, t.AuditFailures, t.UpdatedOn)
+	return err
+}
+
+const trustColumns = `user_id, confirmed, disputed, audit_failures, updated_on`
+
+func scanTrust(row scanner) (*store.Trust, error) {
+	var t store.Trust
+	if err := row.Scan(&t.UserID, &t.Confirmed, &t.Disputed, &t.AuditFailures, &t.UpdatedOn); err != nil {
+		return nil, err
+	}
+	t.UpdatedOn = t.UpdatedOn.UTC()
+	return &t, nil
+}
+
+// GetTrust returns store.ErrNotFound if the user has no audit history.
+func (s *Store) GetTrust(ctx context.Context, userID string) (*store.Trust, error) {
+	t, err := scanTrust(s.db.QueryRowContext(ctx, `SELECT `+trustColumns+` FROM trust WHERE user_id = $1`, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	return t, err
+}
+
+// TrustHistory returns the audit history of every user with one.
+func (s *Store) TrustHistory(ctx context.Context) ([]store.Trust, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+trustColumns+` FROM trust ORDER BY user_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []store.Trust{}
+	for rows.Next() {
+		t, err := scanTrust(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, *t)
+	}
+	return ret, rows.Err()
+}
+
+// AddEnrollment records a newly issued enrollment code.
+func (s *Store) AddEnrollment(ctx context.Context, e store.Enrollment) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO enrollments (code_hash, user_id, issued_on, expires_on, redeemed_by)
+		VALUES ($1, $2, $3, $4, '')`,
+		e.CodeHash, e.UserID, e.IssuedOn, e.ExpiresOn)
+	return err
+}
+
+const enrollmentColumns = `code_hash, user_id, issued_on, expires_on, redeemed_on, redeemed_by`
+
+func scanEnrollment(row scanner) (*store.Enrollment, error) {
+	var e store.Enrollment
+	var redeemedOn sql.NullTime
+	if err := row.Scan(&e.CodeHash, &e.UserID, &e.IssuedOn, &e.ExpiresOn, &redeemedOn, &e.RedeemedBy); err != nil {
+		return nil, err
+	}
+	e.IssuedOn = e.IssuedOn.UTC()
+	e.ExpiresOn = e.ExpiresOn.UTC()
+	if redeemedOn.Valid {
+		e.RedeemedOn = redeemedOn.Time.UTC()
+	}
+	return &e, nil
+}
+
+// GetEnrollment returns store.ErrNotFound if no code has the hash.
+func (s *Store) GetEnrollment(ctx context.Context, codeHash string) (*store.Enrollment, error) {
+	e, err := scanEnrollment(s.db.QueryRowContext(ctx, `
+		SELECT `+enrollmentColumns+` FROM enrollments WHERE code_hash = $1`, codeHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	return e, err
+}
+
+// RedeemEnrollment marks an unused, unexpired enrollment code used.
+func (s *Store) RedeemEnrollment(ctx context.Context, codeHash string, nodeID string, now time.Time) (*store.Enrollment, error) {
+	e, err := scanEnrollment(s.db.QueryRowContext(ctx, `
+		UPDATE enrollments SET redeemed_on = $1, redeemed_by = $2
+		WHERE code_hash = $3 AND redeemed_on IS NULL AND expires_on > $1
+		RETURNING `+enrollmentColumns,
+		now, nodeID, codeHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	return e, err
+}
+
+// Enrollments returns the enrollment codes issued since the time
+// given, oldest first.
+func (s *Store) Enrollments(ctx context.Context, since time.Time) ([]store.Enrollment, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+enrollmentColumns+` FROM enrollments WHERE issued_on >= $1 ORDER BY issued_on`,
+		since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []store.Enrollment{}
+	for rows.Next() {
+		e, err := scanEnrollment(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, *e)
+	}
+	return ret, rows.Err()
+}
+
+// Events returns up to limit events with Seq after the one given,
+// oldest first.
+func (s *Store) Events(ctx context.Context, afterSeq int64, limit int) ([]internal.Event, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT seq, event FROM events WHERE seq > $1 ORDER BY seq LIMIT $2`,
+		afterSeq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []internal.Event{}
+	for rows.Next() {
+		var e internal.Event
+		var seq int64
+		var b []byte
+		if err := rows.Scan(&seq, &b); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &e); err != nil {
+			return nil, err
+		}
+		e.Seq = seq
+		ret = append(ret, e)
+	}
+	return ret, rows.Err()
+}
+
+// InitFrontier sets the next value to assign, if it is not already set.
+func (s *Store) InitFrontier(ctx context.Context, next *big.Int) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO frontier (id, next_value) VALUES (1, $1::numeric)
+		ON CONFLICT (id) DO NOTHING`, next.String())
+	return err
+}
+
+// Frontier returns the next value to assign.
+func (s *Store) Frontier(ctx context.Context) (*big.Int, error) {
+	var v string
+	err := s.db.QueryRowContext(ctx, `SELECT next_value::text FROM frontier WHERE id = 1`).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading frontier: %v", err)
+	}
+	return parseBig(v)
+}
+
+// AllocateRange advances the frontier by size, returning the old value.
+// The single-row update is atomic across replicas.
+func (s *Store) AllocateRange(ctx context.Context, size *big.Int) (*big.Int, error) {
+	var v string
+	err := s.db.QueryRowContext(ctx, `
+		UPDATE frontier SET next_value = next_value + $1::numeric
+		WHERE id = 1
+		RETURNING (next_value - $1::numeric)::text`, size.String()).Scan(&v)
+	if err != nil {
+		return nil, fmt.Errorf("advancing frontier: %v", err)
+	}
+	return parseBig(v)
+}
+
+func scanReports(rows *sql.Rows) ([]store.StoredReport, error) {
+	defer rows.Close()
+	ret := []store.StoredReport{}
+	for rows.Next() {
+		var r store.StoredReport
+		var b []byte
+		if err := rows.Scan(&r.PacketID, &r.UserID, &r.NodeID, &r.ReceivedOn, &b); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &r.Report); err != nil {
+			return nil, err
+		}
+		r.ReceivedOn = r.ReceivedOn.UTC()
+		ret = append(ret, r)
+	}
+	return ret, rows.Err()
+}
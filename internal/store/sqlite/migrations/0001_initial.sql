@@ -0,0 +1,63 @@
+CREATE TABLE IF NOT EXISTS users (
+	user_id TEXT PRIMARY KEY,
+	user_secret_version TEXT NOT NULL,
+	user_secret TEXT NOT NULL,
+	created_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS packets (
+	id TEXT PRIMARY KEY,
+	nonce TEXT NOT NULL,
+	starting_value TEXT NOT NULL,
+	ending_value TEXT NOT NULL,
+	assigned_on INTEGER NOT NULL,
+	expiry INTEGER NOT NULL,
+	user_id TEXT NOT NULL,
+	node_id TEXT NOT NULL,
+	status TEXT NOT NULL,
+	last_heartbeat INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS packets_status_expiry ON packets (status, expiry);
+CREATE INDEX IF NOT EXISTS packets_user_status ON packets (user_id, status);
+
+CREATE TABLE IF NOT EXISTS nodes (
+	node_id TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	assigned INTEGER NOT NULL,
+	completed INTEGER NOT NULL,
+	expired INTEGER NOT NULL,
+	last_seen INTEGER NOT NULL,
+	rate REAL NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS reports (
+	packet_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	node_id TEXT NOT NULL,
+	received_on INTEGER NOT NULL,
+	report TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS reports_packet ON reports (packet_id);
+
+CREATE TABLE IF NOT EXISTS receipts (
+	packet_id TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	accepted_on INTEGER NOT NULL,
+	receipt TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS receipts_user ON receipts (user_id, accepted_on);
+
+CREATE TABLE IF NOT EXISTS records (
+	kind TEXT NOT NULL,
+	value TEXT NOT NULL,
+	iterations INTEGER NOT NULL,
+	packet_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	found_on INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS records_kind ON records (kind, found_on);
+
+CREATE TABLE IF NOT EXISTS frontier (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	next_value TEXT NOT NULL
+);
@@ -0,0 +1,10 @@
+-- Completed work as merged ranges.  Both ends are inclusive, matching
+-- packets, so existing completed packets can be copied in directly, one
+-- row each; they merge as neighbouring packets complete.
+CREATE TABLE IF NOT EXISTS completed_ranges (
+	start_value TEXT PRIMARY KEY,
+	last_value TEXT NOT NULL
+);
+
+INSERT OR IGNORE INTO completed_ranges (start_value, last_value)
+SELECT starting_value, ending_value FROM packets WHERE status = 'completed';
@@ -0,0 +1,34 @@
+-- Accepted reports are unique by packet and nonce.  A later completed
+-- report for the same packet is kept in report_conflicts for audit,
+-- rather than replacing the first.
+ALTER TABLE reports ADD COLUMN nonce TEXT NOT NULL DEFAULT '';
+UPDATE reports SET nonce = COALESCE(json_extract(report, '$.work.nonce'), '');
+
+CREATE TABLE IF NOT EXISTS report_conflicts (
+	packet_id TEXT NOT NULL,
+	nonce TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	node_id TEXT NOT NULL,
+	received_on INTEGER NOT NULL,
+	report TEXT NOT NULL,
+	reason TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS report_conflicts_received ON report_conflicts (received_on);
+
+-- Duplicates from before the index: the first received stays, and the
+-- rest become conflicts.
+CREATE TEMP TABLE duplicate_reports AS
+SELECT r.rowid AS id FROM reports r
+WHERE EXISTS (
+	SELECT 1 FROM reports f
+	WHERE f.packet_id = r.packet_id AND f.nonce = r.nonce
+	AND (f.received_on < r.received_on OR (f.received_on = r.received_on AND f.rowid < r.rowid))
+);
+INSERT INTO report_conflicts (packet_id, nonce, user_id, node_id, received_on, report, reason)
+SELECT packet_id, nonce, user_id, node_id, received_on, report, 'duplicate'
+FROM reports WHERE rowid IN (SELECT id FROM duplicate_reports);
+DELETE FROM reports WHERE rowid IN (SELECT id FROM duplicate_reports);
+DROP TABLE duplicate_reports;
+
+DROP INDEX IF EXISTS reports_packet;
+CREATE UNIQUE INDEX IF NOT EXISTS reports_packet_nonce ON reports (packet_id, nonce);
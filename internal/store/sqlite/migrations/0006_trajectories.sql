@@ -0,0 +1,8 @@
+-- Trajectories of findings, sent by clients on request.
+CREATE TABLE IF NOT EXISTS trajectories (
+	value TEXT PRIMARY KEY,
+	packet_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	received_on INTEGER NOT NULL,
+	trajectory TEXT NOT NULL
+);
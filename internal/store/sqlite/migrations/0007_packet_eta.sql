@@ -0,0 +1,3 @@
+-- When the client running a packet expects to complete it, from its
+-- "running" reports.
+ALTER TABLE packets ADD COLUMN estimated_completion INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,8 @@
+-- The event log: findings, records, and audit failures.  The event
+-- itself is JSON; seq orders the log.
+CREATE TABLE IF NOT EXISTS events (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	time INTEGER NOT NULL,
+	kind TEXT NOT NULL,
+	event TEXT NOT NULL
+);
@@ -0,0 +1,11 @@
+-- Nonces consumed by accepted reports, kept after their packets are
+-- collected, so evidence cannot be replayed for another packet, user,
+-- or range.
+CREATE TABLE IF NOT EXISTS nonces (
+	nonce TEXT PRIMARY KEY,
+	packet_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	starting_value TEXT NOT NULL,
+	ending_value TEXT NOT NULL,
+	consumed_on INTEGER NOT NULL
+);
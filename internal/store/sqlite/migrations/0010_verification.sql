@@ -0,0 +1,13 @@
+-- Double checks: a packet completed by a user who is not yet trusted
+-- is checked by another, with a packet which verifies it.
+ALTER TABLE packets ADD COLUMN verifies TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS packets_verifies ON packets (verifies);
+
+-- Each user's audit history, from which their trust is scored.
+CREATE TABLE IF NOT EXISTS trust (
+	user_id TEXT PRIMARY KEY,
+	confirmed INTEGER NOT NULL,
+	disputed INTEGER NOT NULL,
+	audit_failures INTEGER NOT NULL,
+	updated_on INTEGER NOT NULL
+);
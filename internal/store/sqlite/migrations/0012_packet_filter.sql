@@ -0,0 +1,3 @@
+-- The filter a packet asked its client to apply, which double checks
+-- of it must apply too.
+ALTER TABLE packets ADD COLUMN filter TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,16 @@
+-- Completed ranges keyed so SQLite can compare them: each value is its
+-- decimal digits prefixed by their count, zero-padded to three, so the
+-- keys sort as the values do.  A merge then reads only the ranges
+-- either side of a report's, rather than the whole table.
+CREATE TABLE completed_range_keys (
+	start_key TEXT PRIMARY KEY,
+	last_key TEXT NOT NULL
+);
+
+INSERT INTO completed_range_keys (start_key, last_key)
+SELECT printf('%03d', length(start_value)) || start_value,
+	printf('%03d', length(last_value)) || last_value
+FROM completed_ranges;
+
+DROP TABLE completed_ranges;
+ALTER TABLE completed_range_keys RENAME TO completed_ranges;
@@ -0,0 +1,1198 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package sqlite implements store.Store on SQLite, using a pure-Go
+// driver so the server remains a single, dependency-free binary.
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/intervals"
+	"github.com/skandragon/collatz/internal/store"
+	"github.com/skandragon/collatz/internal/store/migrate"
+
+	// registers the "sqlite" driver
+	_ "modernc.org/sqlite"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Store is a store.Store backed by a SQLite database file.
+type Store struct {
+	db *sql.DB
+}
+
+var _ store.Store = (*Store)(nil)
+
+// Open opens (creating if needed) the SQLite database at filename.
+// The schema is not created or checked; see Migrate and CheckSchema.
+func Open(filename string) (*Store, error) {
+	dsn := "file:" + filename + "?" + url.Values{
+		"_pragma": []string{"busy_timeout(10000)", "journal_mode(WAL)", "synchronous(NORMAL)"},
+	}.Encode()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time; serializing here avoids
+	// SQLITE_BUSY errors and keeps read-modify-write operations atomic.
+	db.SetMaxOpenConns(1)
+	return &Store{db: db}, nil
+}
+
+func migrations() ([]migrate.Migration, error) {
+	return migrate.Load(migrationFiles, "migrations")
+}
+
+// Migrate brings the schema up to date, returning the number of
+// migrations applied.
+func (s *Store) Migrate(ctx context.Context) (int, error) {
+	m, err := migrations()
+	if err != nil {
+		return 0, err
+	}
+	return migrate.Apply(ctx, s.db, m, migrate.Options{})
+}
+
+// CheckSchema returns an error if the schema is not the version this
+// code expects.
+func (s *Store) CheckSchema(ctx context.Context) error {
+	m, err := migrations()
+	if err != nil {
+		return err
+	}
+	return migrate.Check(ctx, s.db, m)
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Backup writes a consistent, compacted copy of the database to
+// filename using VACUUM INTO, which does not block other readers.
+func (s *Store) Backup(ctx context.Context, filename string) error {
+	_, err := s.db.ExecContext(ctx, `VACUUM INTO ?`, filename)
+	return err
+}
+
+// Restore replaces the database file with a backup.  The server must
+// not be running.
+func Restore(backup, filename string) error {
+	db, err := sql.Open("sqlite", "file:"+backup+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	err = (&Store{db: db}).CheckIntegrity()
+	db.Close()
+	if err != nil {
+		return fmt.Errorf("backup %s: %v", backup, err)
+	}
+
+	data, err := os.ReadFile(backup)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".restore"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	// Stale WAL files would be replayed over the restored database.
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(filename + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(tmp, filename)
+}
+
+// CheckIntegrity runs SQLite's integrity check.
+func (s *Store) CheckIntegrity() error {
+	var result string
+	if err := s.db.QueryRow(`PRAGMA integrity_check`).Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+	return nil
+}
+
+func toNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromNanos(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n).UTC()
+}
+
+func parseBig(s string) (*big.Int, error) {
+	v, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid integer %q in database", s)
+	}
+	return v, nil
+}
+
+// PutUser creates or replaces a user.
+func (s *Store) PutUser(ctx context.Context, user store.User) error {
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now().UTC()
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO users (user_id, user_secret_version, user_secret, created_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET
+			user_secret_version = excluded.user_secret_version,
+			user_secret = excluded.user_secret`,
+		user.UserID, user.UserSecretVersion, user.UserSecret, toNanos(user.CreatedAt))
+	return err
+}
+
+// GetUser returns store.ErrNotFound if the user does not exist.
+func (s *Store) GetUser(ctx context.Context, userID string) (*store.User, error) {
+	var u store.User
+	var createdAt int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT user_id, user_secret_version, user_secret, created_at
+		FROM users WHERE user_id = ?`, userID).
+		Scan(&u.UserID, &u.UserSecretVersion, &u.UserSecret, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.CreatedAt = fromNanos(createdAt)
+	return &u, nil
+}
+
+// Users returns all users.
+func (s *Store) Users(ctx context.Context) ([]store.User, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT user_id, user_secret_version, user_secret, created_at
+		FROM users ORDER BY user_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []store.User{}
+	for rows.Next() {
+		var u store.User
+		var createdAt int64
+		if err := rows.Scan(&u.UserID, &u.UserSecretVersion, &u.UserSecret, &createdAt); err != nil {
+			return nil, err
+		}
+		u.CreatedAt = fromNanos(createdAt)
+		ret = append(ret, u)
+	}
+	return ret, rows.Err()
+}
+
+const packetColumns = `id, nonce, starting_value, ending_value, assigned_on, expiry,
+	user_id, node_id, status, last_heartbeat, estimated_completion, verifies, filter`
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPacket(row scanner) (*store.Packet, error) {
+	var p store.Packet
+	var start, end string
+	var assignedOn, expiry, lastHeartbeat, estimatedCompletion int64
+	err := row.Scan(&p.ID, &p.Nonce, &start, &end, &assignedOn, &expiry,
+		&p.UserID, &p.NodeID, &p.Status, &lastHeartbeat, &estimatedCompletion, &p.Verifies, &p.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if p.StartingValue, err = parseBig(start); err != nil {
+		return nil, err
+	}
+	if p.EndingValue, err = parseBig(end); err != nil {
+		return nil, err
+	}
+	p.AssignedOn = fromNanos(assignedOn)
+	p.Expiry = fromNanos(expiry)
+	p.LastHeartbeat = fromNanos(lastHeartbeat)
+	p.EstimatedCompletion = fromNanos(estimatedCompletion)
+	return &p, nil
+}
+
+// AddPacket records a newly assigned packet.
+func (s *Store) AddPacket(ctx context.Context, p *store.Packet) error {
+	return addPacket(ctx, s.db, p)
+}
+
+func addPacket(ctx context.Context, ex execer, p *store.Packet) error {
+	_, err := ex.ExecContext(ctx, `
+		INSERT INTO packets (`+packetColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.ID, p.Nonce, p.StartingValue.String(), p.EndingValue.String(),
+		toNanos(p.AssignedOn), toNanos(p.Expiry), p.UserID, p.NodeID, p.Status,
+		toNanos(p.LastHeartbeat), toNanos(p.EstimatedCompletion), p.Verifies, p.Filter)
+	return err
+}
+
+// GetPacket returns store.ErrNotFound if the packet does not exist.
+func (s *Store) GetPacket(ctx context.Context, packetID string) (*store.Packet, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+packetColumns+` FROM packets WHERE id = ?`, packetID)
+	p, err := scanPacket(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	return p, err
+}
+
+// Packets returns all packets with the given status.
+func (s *Store) Packets(ctx context.Context, status string) ([]*store.Packet, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+packetColumns+` FROM packets WHERE status = ? ORDER BY assigned_on`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []*store.Packet{}
+	for rows.Next() {
+		p, err := scanPacket(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, p)
+	}
+	return ret, rows.Err()
+}
+
+// UpdatePacket replaces the mutable fields of an existing packet.
+func (s *Store) UpdatePacket(ctx context.Context, p *store.Packet) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE packets SET status = ?, expiry = ?, last_heartbeat = ?, estimated_completion = ?
+		WHERE id = ?`,
+		p.Status, toNanos(p.Expiry), toNanos(p.LastHeartbeat), toNanos(p.EstimatedCompletion), p.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
+
+// ReclaimExpired marks one expired packet as such, and returns it
+// with its previous status.
+func (s *Store) ReclaimExpired(ctx context.Context, now time.Time) (*store.Packet, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	row := tx.QueryRowContext(ctx, `
+		SELECT `+packetColumns+` FROM packets
+		WHERE status IN (?, ?) AND expiry < ?
+		ORDER BY expiry LIMIT 1`,
+		store.PacketOutstanding, store.PacketRejected, toNanos(now))
+	p, err := scanPacket(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE packets SET status = ? WHERE id = ?`,
+		store.PacketExpired, p.ID); err != nil {
+		return nil, err
+	}
+	return p, tx.Commit()
+}
+
+// ClaimVerification assigns the oldest double check of a packet not
+// completed by the claiming user, with a filter it supports.
+func (s *Store) ClaimVerification(ctx context.Context, claim *store.Packet, filters []string) (*store.Packet, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	args := []any{store.PacketVerify, claim.UserID, internal.FilterNone}
+	for _, f := range filters {
+		args = append(args, f)
+	}
+	var id string
+	err = tx.QueryRowContext(ctx, `
+		SELECT v.id FROM packets v LEFT JOIN packets c ON c.id = v.verifies
+		WHERE v.status = ? AND (c.user_id IS NULL OR c.user_id <> ?)
+			AND v.filter IN (?`+strings.Repeat(", ?", len(filters))+`)
+		ORDER BY v.assigned_on, v.id LIMIT 1`,
+		args...).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE packets SET status = ?, user_id = ?, node_id = ?, nonce = ?, assigned_on = ?, expiry = ?
+		WHERE id = ?`,
+		store.PacketOutstanding, claim.UserID, claim.NodeID, claim.Nonce,
+		toNanos(claim.AssignedOn), toNanos(claim.Expiry), id); err != nil {
+		return nil, err
+	}
+	p, err := scanPacket(tx.QueryRowContext(ctx, `SELECT `+packetColumns+` FROM packets WHERE id = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+	return p, tx.Commit()
+}
+
+// CountOutstanding returns the number of unexpired packets held by a user.
+func (s *Store) CountOutstanding(ctx context.Context, userID string, now time.Time) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM packets
+		WHERE user_id = ? AND status = ? AND expiry >= ?`,
+		userID, store.PacketOutstanding, toNanos(now)).Scan(&count)
+	return count, err
+}
+
+// GetNode returns store.ErrNotFound if the node has not been seen.
+func (s *Store) GetNode(ctx context.Context, nodeID string) (*store.Node, error) {
+	var n store.Node
+	var lastSeen int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT node_id, user_id, assigned, completed, expired, last_seen, rate
+		FROM nodes WHERE node_id = ?`, nodeID).
+		Scan(&n.NodeID, &n.UserID, &n.Assigned, &n.Completed, &n.Expired, &lastSeen, &n.Rate)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	n.LastSeen = fromNanos(lastSeen)
+	return &n, nil
+}
+
+// PutNode creates or replaces a node's history.
+func (s *Store) PutNode(ctx context.Context, n *store.Node) error {
+	return putNode(ctx, s.db, n)
+}
+
+func putNode(ctx context.Context, ex execer, n *store.Node) error {
+	_, err := ex.ExecContext(ctx, `
+		INSERT INTO nodes (node_id, user_id, assigned, completed, expired, last_seen, rate)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (node_id) DO UPDATE SET
+			user_id = excluded.user_id,
+			assigned = excluded.assigned,
+			completed = excluded.completed,
+			expired = excluded.expired,
+			last_seen = excluded.last_seen,
+			rate = excluded.rate`,
+		n.NodeID, n.UserID, n.Assigned, n.Completed, n.Expired, toNanos(n.LastSeen), n.Rate)
+	return err
+}
+
+// AcceptReport applies everything that changes when a report is
+// accepted, in one transaction.
+func (s *Store) AcceptReport(ctx context.Context, a *store.Acceptance) error {
+	reportJSON, err := json.Marshal(a.Report)
+	if err != nil {
+		return err
+	}
+	receiptJSON, err := json.Marshal(a.Receipt)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	status := store.PacketCompleted
+	if a.Verify != nil {
+		status = store.PacketUnverified
+	}
+	res, err := tx.ExecContext(ctx, `UPDATE packets SET status = ? WHERE id = ? AND status NOT IN (?, ?)`,
+		status, a.Receipt.PacketID, store.PacketCompleted, store.PacketUnverified)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var status string
+		err := tx.QueryRowContext(ctx, `SELECT status FROM packets WHERE id = ?`, a.Receipt.PacketID).Scan(&status)
+		if errors.Is(err, sql.ErrNoRows) {
+			return store.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return store.ErrAlreadyAccepted
+	}
+	res, err = tx.ExecContext(ctx, `
+		INSERT INTO reports (packet_id, nonce, user_id, node_id, received_on, report)
+		VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (packet_id, nonce) DO NOTHING`,
+		a.Receipt.PacketID, a.Report.Work.Nonce, a.Receipt.UserID, a.Receipt.NodeID, toNanos(a.Receipt.AcceptedOn), string(reportJSON))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return store.ErrAlreadyAccepted
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO receipts (packet_id, user_id, accepted_on, receipt)
+		VALUES (?, ?, ?, ?)`,
+		a.Receipt.PacketID, a.Receipt.UserID, toNanos(a.Receipt.AcceptedOn), string(receiptJSON)); err != nil {
+		return err
+	}
+	if a.Verify != nil {
+		if err := addPacket(ctx, tx, a.Verify); err != nil {
+			return err
+		}
+	} else if err := addCompletedRange(ctx, tx, store.CompletedInterval(a.Receipt)); err != nil {
+		return err
+	}
+	if a.Confirms != "" {
+		if _, err := tx.ExecContext(ctx, `UPDATE packets SET status = ? WHERE id = ? AND status = ?`,
+			store.PacketCompleted, a.Confirms, store.PacketUnverified); err != nil {
+			return err
+		}
+	}
+	for _, r := range a.Records {
+		if err := addRecord(ctx, tx, r); err != nil {
+			return err
+		}
+	}
+	if a.Node != nil {
+		if err := putNode(ctx, tx, a.Node); err != nil {
+			return err
+		}
+	}
+	for _, sample := range a.Rates {
+		if err := addRateSample(ctx, tx, sample); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AddReportConflict keeps a report which conflicts with the accepted
+// report for its packet.
+func (s *Store) AddReportConflict(ctx context.Context, c store.ReportConflict) error {
+	b, err := json.Marshal(c.Report)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO report_conflicts (packet_id, nonce, user_id, node_id, received_on, report, reason)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		c.PacketID, c.Report.Work.Nonce, c.UserID, c.NodeID, toNanos(c.ReceivedOn), string(b), c.Reason)
+	return err
+}
+
+// ReportConflicts returns up to limit conflicting reports received at
+// or after the time given, oldest first.
+func (s *Store) ReportConflicts(ctx context.Context, since time.Time, limit int) ([]store.ReportConflict, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT packet_id, user_id, node_id, received_on, report, reason FROM report_conflicts
+		WHERE received_on >= ? ORDER BY received_on LIMIT ?`,
+		toNanos(since), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []store.ReportConflict{}
+	for rows.Next() {
+		var c store.ReportConflict
+		var receivedOn int64
+		var b string
+		if err := rows.Scan(&c.PacketID, &c.UserID, &c.NodeID, &receivedOn, &b, &c.Reason); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(b), &c.Report); err != nil {
+			return nil, err
+		}
+		c.ReceivedOn = fromNanos(receivedOn)
+		ret = append(ret, c)
+	}
+	return ret, rows.Err()
+}
+
+// GetReceipt returns store.ErrNotFound if no receipt was issued for
+// the packet.
+func (s *Store) GetReceipt(ctx context.Context, packetID string) (*internal.Receipt, error) {
+	var b []byte
+	err := s.db.QueryRowContext(ctx, `SELECT receipt FROM receipts WHERE packet_id = ?`, packetID).Scan(&b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r internal.Receipt
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// rangeKey returns the key of v in completed_ranges: its decimal
+// digits prefixed by their count, so keys sort as values do.
+func rangeKey(v *big.Int) (string, error) {
+	digits := v.String()
+	if v.Sign() < 0 || len(digits) > 999 {
+		return "", fmt.Errorf("%s cannot be stored as a completed range", digits)
+	}
+	return fmt.Sprintf("%03d%s", len(digits), digits), nil
+}
+
+// parseRangeKey returns the value of a key made by rangeKey.
+func parseRangeKey(key string) (*big.Int, error) {
+	if len(key) < 4 {
+		return nil, fmt.Errorf("invalid completed range key %q in database", key)
+	}
+	return parseBig(key[3:])
+}
+
+// scanRanges reads ranges, as start and last keys, into intervals.
+func scanRanges(rows *sql.Rows) ([]intervals.Interval, error) {
+	defer rows.Close()
+	ret := []intervals.Interval{}
+	for rows.Next() {
+		var start, last string
+		if err := rows.Scan(&start, &last); err != nil {
+			return nil, err
+		}
+		var iv intervals.Interval
+		var err error
+		if iv.Start, err = parseRangeKey(start); err != nil {
+			return nil, err
+		}
+		if iv.End, err = parseRangeKey(last); err != nil {
+			return nil, err
+		}
+		iv.End.Add(iv.End, big.NewInt(1))
+		ret = append(ret, iv)
+	}
+	return ret, rows.Err()
+}
+
+// addCompletedRange merges iv with any stored ranges it touches.  Those
+// are the ranges starting from the last to start below iv, which may
+// end just before it, up to just after iv's end; finding them takes
+// two lookups in the key index.  Ranges copied in by the migration may
+// be left adjacent but unmerged, until a report between them merges
+// them; CompletedRanges merges them as it reads.
+func addCompletedRange(ctx context.Context, tx *sql.Tx, iv intervals.Interval) error {
+	startKey, err := rangeKey(iv.Start)
+	if err != nil {
+		return err
+	}
+	beforeKey, err := rangeKey(new(big.Int).Sub(iv.Start, big.NewInt(1)))
+	if err != nil {
+		return err
+	}
+	afterKey, err := rangeKey(iv.End)
+	if err != nil {
+		return err
+	}
+	rows, err := tx.QueryContext(ctx, `
+		SELECT start_key, last_key FROM completed_ranges
+		WHERE start_key >= COALESCE((SELECT MAX(start_key) FROM completed_ranges WHERE start_key < ?1), ?1)
+			AND start_key <= ?2 AND last_key >= ?3`,
+		startKey, afterKey, beforeKey)
+	if err != nil {
+		return err
+	}
+	touching, err := scanRanges(rows)
+	if err != nil {
+		return err
+	}
+	merged := iv
+	for _, r := range touching {
+		key, err := rangeKey(r.Start)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM completed_ranges WHERE start_key = ?`, key); err != nil {
+			return err
+		}
+		merged = merged.Union(r)
+	}
+	mergedStart, err := rangeKey(merged.Start)
+	if err != nil {
+		return err
+	}
+	mergedLast, err := rangeKey(new(big.Int).Sub(merged.End, big.NewInt(1)))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO completed_ranges (start_key, last_key) VALUES (?, ?)`,
+		mergedStart, mergedLast)
+	return err
+}
+
+// AddCompletedRange merges an interval into the completed ranges.
+func (s *Store) AddCompletedRange(ctx context.Context, iv intervals.Interval) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := addCompletedRange(ctx, tx, iv); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CompletedRanges returns all completed work, merged into intervals.
+func (s *Store) CompletedRanges(ctx context.Context) (*intervals.Set, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT start_key, last_key FROM completed_ranges`)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := scanRanges(rows)
+	if err != nil {
+		return nil, err
+	}
+	ret := &intervals.Set{}
+	for _, iv := range stored {
+		ret.Add(iv.Start, iv.End)
+	}
+	return ret, nil
+}
+
+// ReportsBefore returns up to limit reports received before the time
+// given, oldest first.
+func (s *Store) ReportsBefore(ctx context.Context, before time.Time, limit int) ([]store.StoredReport, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT packet_id, user_id, node_id, received_on, report FROM reports
+		WHERE received_on < ? ORDER BY received_on, packet_id LIMIT ?`,
+		toNanos(before), limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanReports(rows)
+}
+
+// ReportsAfter returns up to limit reports with packet IDs after the
+// one given, in packet ID order.
+func (s *Store) ReportsAfter(ctx context.Context, afterPacketID string, limit int) ([]store.StoredReport, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT packet_id, user_id, node_id, received_on, report FROM reports
+		WHERE packet_id > ? ORDER BY packet_id LIMIT ?`,
+		afterPacketID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanReports(rows)
+}
+
+// DeleteReports removes the reports for the packets listed.
+func (s *Store) DeleteReports(ctx context.Context, packetIDs []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range packetIDs {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM reports WHERE packet_id = ?`, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AddRateSample adds to the bucket holding sample.Start.
+func (s *Store) AddRateSample(ctx context.Context, sample store.RateSample) error {
+	return addRateSample(ctx, s.db, sample)
+}
+
+func addRateSample(ctx context.Context, ex execer, sample store.RateSample) error {
+	_, err := ex.ExecContext(ctx, `
+		INSERT INTO rate_samples (user_id, bucket, integers, iterations, packets)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, bucket) DO UPDATE SET
+			integers = integers + excluded.integers,
+			iterations = iterations + excluded.iterations,
+			packets = packets + excluded.packets`,
+		sample.UserID, toNanos(sample.Start.Truncate(store.RateBucket)),
+		sample.Integers, sample.Iterations, sample.Packets)
+	return err
+}
+
+// RateSamples returns a user's samples in [from, to), oldest first.
+func (s *Store) RateSamples(ctx context.Context, userID string, from, to time.Time) ([]store.RateSample, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT bucket, integers, iterations, packets FROM rate_samples
+		WHERE user_id = ? AND bucket >= ? AND bucket < ? ORDER BY bucket`,
+		userID, toNanos(from), toNanos(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []store.RateSample{}
+	for rows.Next() {
+		r := store.RateSample{UserID: userID}
+		var bucket int64
+		if err := rows.Scan(&bucket, &r.Integers, &r.Iterations, &r.Packets); err != nil {
+			return nil, err
+		}
+		r.Start = fromNanos(bucket)
+		ret = append(ret, r)
+	}
+	return ret, rows.Err()
+}
+
+// UserTotals sums each user's throughput history.
+func (s *Store) UserTotals(ctx context.Context) ([]store.UserTotals, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT user_id, SUM(integers), SUM(iterations), SUM(packets), MIN(bucket), MAX(bucket)
+		FROM rate_samples WHERE user_id <> ?
+		GROUP BY user_id ORDER BY SUM(integers) DESC, user_id`, store.AllUsers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []store.UserTotals{}
+	for rows.Next() {
+		var t store.UserTotals
+		var first, last int64
+		if err := rows.Scan(&t.UserID, &t.Integers, &t.Iterations, &t.Packets, &first, &last); err != nil {
+			return nil, err
+		}
+		t.First = fromNanos(first)
+		t.Last = fromNanos(last)
+		ret = append(ret, t)
+	}
+	return ret, rows.Err()
+}
+
+// PurgeRateSamples deletes samples which started before the time given.
+func (s *Store) PurgeRateSamples(ctx context.Context, before time.Time) (int64, error) {
+	return s.purge(ctx, `DELETE FROM rate_samples WHERE bucket < ?`, toNanos(before))
+}
+
+// PurgePackets deletes packets with the given status assigned before
+// the time given.
+func (s *Store) PurgePackets(ctx context.Context, status string, assignedBefore time.Time) (int64, error) {
+	return s.purge(ctx, `DELETE FROM packets WHERE status = ? AND assigned_on < ?`,
+		status, toNanos(assignedBefore))
+}
+
+// PurgeReports deletes reports received before the time given.
+func (s *Store) PurgeReports(ctx context.Context, receivedBefore time.Time) (int64, error) {
+	return s.purge(ctx, `DELETE FROM reports WHERE received_on < ?`, toNanos(receivedBefore))
+}
+
+// PurgeNodes deletes nodes last seen before the time given.
+func (s *Store) PurgeNodes(ctx context.Context, lastSeenBefore time.Time) (int64, error) {
+	return s.purge(ctx, `DELETE FROM nodes WHERE last_seen < ?`, toNanos(lastSeenBefore))
+}
+
+func (s *Store) purge(ctx context.Context, query string, args ...any) (int64, error) {
+	res, err := s.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Receipts returns all receipts issued to a user, oldest first.
+func (s *Store) Receipts(ctx context.Context, userID string) ([]internal.Receipt, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT receipt FROM receipts WHERE user_id = ? ORDER BY accepted_on`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []internal.Receipt{}
+	for rows.Next() {
+		var b string
+		if err := rows.Scan(&b); err != nil {
+			return nil, err
+		}
+		var r internal.Receipt
+		if err := json.Unmarshal([]byte(b), &r); err != nil {
+			return nil, err
+		}
+		ret = append(ret, r)
+	}
+	return ret, rows.Err()
+}
+
+// AddRecord records a notable finding.
+func (s *Store) AddRecord(ctx context.Context, r store.Record) error {
+	return addRecord(ctx, s.db, r)
+}
+
+func addRecord(ctx context.Context, ex execer, r store.Record) error {
+	value := ""
+	if r.Value != nil {
+		value = r.Value.String()
+	}
+	_, err := ex.ExecContext(ctx, `
+		INSERT INTO records (kind, value, iterations, packet_id, user_id, found_on)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		r.Kind, value, int64(r.Iterations), r.PacketID, r.UserID, toNanos(r.FoundOn))
+	return err
+}
+
+// Records returns all records of a kind, oldest first.
+func (s *Store) Records(ctx context.Context, kind string) ([]store.Record, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT kind, value, iterations, packet_id, user_id, found_on
+		FROM records WHERE kind = ? ORDER BY found_on`, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []store.Record{}
+	for rows.Next() {
+		var r store.Record
+		var value string
+		var iterations, foundOn int64
+		if err := rows.Scan(&r.Kind, &value, &iterations, &r.PacketID, &r.UserID, &foundOn); err != nil {
+			return nil, err
+		}
+		if value != "" {
+			if r.Value, err = parseBig(value); err != nil {
+				return nil, err
+			}
+		}
+		r.Iterations = uint64(iterations)
+		r.FoundOn = fromNanos(foundOn)
+		ret = append(ret, r)
+	}
+	return ret, rows.Err()
+}
+
+// AddTrajectory stores the trajectory of a finding, keeping any
+// already stored for the value.
+func (s *Store) AddTrajectory(ctx context.Context, t store.StoredTrajectory) error {
+	b, err := json.Marshal(t.Trajectory)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO trajectories (value, packet_id, user_id, received_on, trajectory)
+		VALUES (?, ?, ?, ?, ?) ON CONFLICT (value) DO NOTHING`,
+		t.Trajectory.Value.String(), t.Trajectory.PacketID, t.UserID, toNanos(t.ReceivedOn), string(b))
+	return err
+}
+
+// GetTrajectory returns store.ErrNotFound if no trajectory is stored
+// for the value.
+func (s *Store) GetTrajectory(ctx context.Context, value *big.Int) (*store.StoredTrajectory, error) {
+	var t store.StoredTrajectory
+	var receivedOn int64
+	var b string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT user_id, received_on, trajectory FROM trajectories WHERE value = ?`,
+		value.String()).Scan(&t.UserID, &receivedOn, &b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(b), &t.Trajectory); err != nil {
+		return nil, err
+	}
+	t.ReceivedOn = fromNanos(receivedOn)
+	return &t, nil
+}
+
+// AddEvent appends an event to the event log, setting its Seq.
+func (s *Store) AddEvent(ctx context.Context, e *internal.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, `INSERT INTO events (time, kind, event) VALUES (?, ?, ?)`,
+		toNanos(e.Time), e.Kind, string(b))
+	if err != nil {
+		return err
+	}
+	e.Seq, err = res.LastInsertId()
+	return err
+}
+
+// ConsumeNonce records a nonce as used, returning store.ErrNonceReused
+// if it was used for a different packet, user, or range.
+func (s *Store) ConsumeNonce(ctx context.Context, n store.Nonce) error {
+	res, err := s.db.ExecContext(ctx, `
+		INSERT INTO nonces (nonce, packet_id, user_id, starting_value, ending_value, consumed_on)
+		VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (nonce) DO NOTHING`,
+		n.Nonce, n.PacketID, n.UserID, n.StartingValue.String(), n.EndingValue.String(), toNanos(n.ConsumedOn))
+	if err != nil {
+		return err
+	}
+	if inserted, err := res.RowsAffected(); err != nil || inserted == 1 {
+		return err
+	}
+	prev := store.Nonce{Nonce: n.Nonce}
+	var start, end string
+	err = s.db.QueryRowContext(ctx, `
+		SELECT packet_id, user_id, starting_value, ending_value FROM nonces WHERE nonce = ?`,
+		n.Nonce).Scan(&prev.PacketID, &prev.UserID, &start, &end)
+	if err != nil {
+		return err
+	}
+	prev.StartingValue, _ = new(big.Int).SetString(start, 10)
+	prev.EndingValue, _ = new(big.Int).SetString(end, 10)
+	if prev.StartingValue == nil || prev.EndingValue == nil || !prev.Same(n) {
+		return store.ErrNonceReused
+	}
+	return nil
+}
+
+// AddTrust adds to a user's audit history.
+func (s *Store) AddTrust(ctx context.Context, t store.Trust) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO trust (user_id, confirmed, disputed, audit_failures, updated_on)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET
+			confirmed = confirmed + excluded.confirmed,
+			disputed = disputed + excluded.disputed,
+			audit_failures = audit_failures + excluded.audit_failures,
+			updated_on = excluded.updated_on`,
+		t.UserID, t.Confirmed, t.Disputed, t.AuditFailures, toNanos(t.UpdatedOn))
+	return err
+}
+
+const trustColumns = `user_id, confirmed, disputed, audit_failures, updated_on`
+
+func scanTrust(row scanner) (*store.Trust, error) {
+	var t store.Trust
+	var updatedOn int64
+	if err := row.Scan(&t.UserID, &t.Confirmed, &t.Disputed, &t.AuditFailures, &updatedOn); err != nil {
+		return nil, err
+	}
+	t.UpdatedOn = fromNanos(updatedOn)
+	return &t, nil
+}
+
+// GetTrust returns store.ErrNotFound if the user has no audit history.
+func (s *Store) GetTrust(ctx context.Context, userID string) (*store.Trust, error) {
+	t, err := scanTrust(s.db.QueryRowContext(ctx, `SELECT `+trustColumns+` FROM trust WHERE user_id = ?`, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	return t, err
+}
+
+// TrustHistory returns the audit history of every user with one.
+func (s *Store) TrustHistory(ctx context.Context) ([]store.Trust, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+trustColumns+` FROM trust ORDER BY user_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []store.Trust{}
+	for rows.Next() {
+		t, err := scanTrust(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, *t)
+	}
+	return ret, rows.Err()
+}
+
+// AddEnrollment records a newly issued enrollment code.
+func (s *Store) AddEnrollment(ctx context.Context, e store.Enrollment) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO enrollments (code_hash, user_id, issued_on, expires_on, redeemed_on, redeemed_by)
+		VALUES (?, ?, ?, ?, 0, '')`,
+		e.CodeHash, e.UserID, toNanos(e.IssuedOn), toNanos(e.ExpiresOn))
+	return err
+}
+
+const enrollmentColumns = `code_hash, user_id, issued_on, expires_on, redeemed_on, redeemed_by`
+
+func scanEnrollment(row scanner) (*store.Enrollment, error) {
+	var e store.Enrollment
+	var issuedOn, expiresOn, redeemedOn int64
+	if err := row.Scan(&e.CodeHash, &e.UserID, &issuedOn, &expiresOn, &redeemedOn, &e.RedeemedBy); err != nil {
+		return nil, err
+	}
+	e.IssuedOn = fromNanos(issuedOn)
+	e.ExpiresOn = fromNanos(expiresOn)
+	if redeemedOn != 0 {
+		e.RedeemedOn = fromNanos(redeemedOn)
+	}
+	return &e, nil
+}
+
+// GetEnrollment returns store.ErrNotFound if no code has the hash.
+func (s *Store) GetEnrollment(ctx context.Context, codeHash string) (*store.Enrollment, error) {
+	e, err := scanEnrollment(s.db.QueryRowContext(ctx, `
+		SELECT `+enrollmentColumns+` FROM enrollments WHERE code_hash = ?`, codeHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	return e, err
+}
+
+// RedeemEnrollment marks an unused, unexpired enrollment code used.
+func (s *Store) RedeemEnrollment(ctx context.Context, codeHash string, nodeID string, now time.Time) (*store.Enrollment, error) {
+	e, err := scanEnrollment(s.db.QueryRowContext(ctx, `
+		UPDATE enrollments SET redeemed_on = ?, redeemed_by = ?
+		WHERE code_hash = ? AND redeemed_on = 0 AND expires_on > ?
+		RETURNING `+enrollmentColumns,
+		toNanos(now), nodeID, codeHash, toNanos(now)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	return e, err
+}
+
+// Enrollments returns the enrollment codes issued since the time
+// given, oldest first.
+func (s *Store) Enrollments(ctx context.Context, since time.Time) ([]store.Enrollment, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+enrollmentColumns+` FROM enrollments WHERE issued_on >= ? ORDER BY issued_on`,
+		toNanos(since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []store.Enrollment{}
+	for rows.Next() {
+		e, err := scanEnrollment(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, *e)
+	}
+	return ret, rows.Err()
+}
+
+// Events returns up to limit events with Seq after the one given,
+// oldest first.
+func (s *Store) Events(ctx context.Context, afterSeq int64, limit int) ([]internal.Event, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT seq, event FROM events WHERE seq > ? ORDER BY seq LIMIT ?`,
+		afterSeq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := []internal.Event{}
+	for rows.Next() {
+		var e internal.Event
+		var seq int64
+		var b string
+		if err := rows.Scan(&seq, &b); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(b), &e); err != nil {
+			return nil, err
+		}
+		e.Seq = seq
+		ret = append(ret, e)
+	}
+	return ret, rows.Err()
+}
+
+// InitFrontier sets the next value to assign, if it is not already set.
+func (s *Store) InitFrontier(ctx context.Context, next *big.Int) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO frontier (id, next_value) VALUES (1, ?)
+		ON CONFLICT (id) DO NOTHING`, next.String())
+	return err
+}
+
+// Frontier returns the next value to assign.
+func (s *Store) Frontier(ctx context.Context) (*big.Int, error) {
+	var v string
+	err := s.db.QueryRowContext(ctx, `SELECT next_value FROM frontier WHERE id = 1`).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading frontier: %v", err)
+	}
+	return parseBig(v)
+}
+
+// AllocateRange advances the frontier by size, returning the old value.
+func (s *Store) AllocateRange(ctx context.Context, size *big.Int) (*big.Int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var v string
+	if err := tx.QueryRowContext(ctx, `SELECT next_value FROM frontier WHERE id = 1`).Scan(&v); err != nil {
+		return nil, fmt.Errorf("reading frontier: %v", err)
+	}
+	start, err := parseBig(v)
+	if err != nil {
+		return nil, err
+	}
+	next := new(big.Int).Add(start, size)
+	if _, err := tx.ExecContext(ctx, `UPDATE frontier SET next_value = ? WHERE id = 1`, next.String()); err != nil {
+		return nil, err
+	}
+	return start, tx.Commit()
+}
+
+func scanReports(rows *sql.Rows) ([]store.StoredReport, error) {
+	defer rows.Close()
+	ret := []store.StoredReport{}
+	for rows.Next() {
+		var r store.StoredReport
+		var receivedOn int64
+		var b string
+		if err := rows.Scan(&r.PacketID, &r.UserID, &r.NodeID, &receivedOn, &b); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(b), &r.Report); err != nil {
+			return nil, err
+		}
+		r.ReceivedOn = fromNanos(receivedOn)
+		ret = append(ret, r)
+	}
+	return ret, rows.Err()
+}
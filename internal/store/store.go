@@ -0,0 +1,514 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package store defines how the work server persists its state.
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/auth"
+	"github.com/skandragon/collatz/internal/intervals"
+)
+
+// ErrNotFound is returned when a requested item does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrAlreadyAccepted is returned when accepting a report for a packet
+// which was already completed.
+var ErrAlreadyAccepted = errors.New("packet already accepted")
+
+// ErrNonceReused is returned when consuming a nonce already consumed
+// for a different packet, user, or range.
+var ErrNonceReused = errors.New("nonce already used")
+
+// Packet statuses.
+const (
+	PacketOutstanding = "outstanding"
+	PacketCompleted   = "completed"
+	PacketExpired     = "expired"
+	PacketRejected    = "rejected"
+
+	// PacketUnverified is a completed packet waiting to be
+	// double-checked by another user.  Its range is not yet in the
+	// completed ranges.
+	PacketUnverified = "unverified"
+
+	// PacketVerify is a double check of an unverified packet, waiting
+	// to be claimed by a user other than the one who completed it.
+	PacketVerify = "verify"
+
+	// PacketDisputed is a double check which disagreed with the packet
+	// it checked.
+	PacketDisputed = "disputed"
+)
+
+// User is a registered user.
+type User struct {
+	UserID            string `json:"userID"`
+	UserSecretVersion string `json:"userSecretVersion"`
+
+	// UserSecret is the secret, or if it starts with "argon2id:", a
+	// key derived from it, as by auth.HashSecret.
+	UserSecret string    `json:"userSecret"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// Credentials returns the user as credentials usable for evidence hashing.
+func (u *User) Credentials() internal.UserCredentials {
+	return auth.StoredCredentials(u.UserID, u.UserSecretVersion, u.UserSecret)
+}
+
+type plainUser User
+
+func (u User) redacted() plainUser {
+	ret := plainUser(u)
+	if ret.UserSecret != "" {
+		ret.UserSecret = internal.Redacted
+	}
+	return ret
+}
+
+// String, GoString, and LogValue keep the secret out of logs.
+func (u User) String() string { return fmt.Sprintf("%+v", u.redacted()) }
+
+func (u User) GoString() string { return fmt.Sprintf("%#v", u.redacted()) }
+
+func (u User) LogValue() slog.Value { return slog.AnyValue(u.redacted()) }
+
+// Packet is a work packet, and who it was given to.
+type Packet struct {
+	internal.WorkPacket
+
+	UserID string `json:"userID"`
+	NodeID string `json:"nodeID"`
+	Status string `json:"status"`
+
+	// LastHeartbeat is when we last heard a "running" report.
+	LastHeartbeat time.Time `json:"lastHeartbeat,omitempty"`
+
+	// EstimatedCompletion is when the client expected to complete the
+	// packet, as of its last "running" report, or zero if it has not
+	// said.
+	EstimatedCompletion time.Time `json:"estimatedCompletion,omitempty"`
+
+	// Verifies, if set, is the ID of the unverified packet this packet
+	// double-checks.
+	Verifies string `json:"verifies,omitempty"`
+}
+
+// Node is what we remember about a specific client node, used to
+// attribute work, spot flaky nodes, and size future packets.
+type Node struct {
+	NodeID    string
+	UserID    string
+	Assigned  int
+	Completed int
+	Expired   int
+	LastSeen  time.Time
+
+	// Rate is a smoothed measure of integers (not candidates) checked
+	// per second, or zero if we have no completed work from this node.
+	Rate float64
+}
+
+// CompletedInterval returns the half-open interval covered by a receipt.
+func CompletedInterval(receipt internal.Receipt) intervals.Interval {
+	return intervals.Interval{
+		Start: new(big.Int).Set(receipt.StartingValue),
+		End:   new(big.Int).Add(receipt.EndingValue, big.NewInt(1)),
+	}
+}
+
+// Acceptance is everything which changes when a completed report is
+// accepted.
+type Acceptance struct {
+	Report  internal.WorkProgressReport
+	Receipt internal.Receipt
+
+	// Records are new findings.
+	Records []Record
+
+	// Node, if set, is the reporting node's updated history.
+	Node *Node
+
+	// Rates are added to the throughput history, as by AddRateSample.
+	Rates []RateSample
+
+	// Verify, if set, is a double check of the packet, added with the
+	// packet left unverified, and its range out of the completed
+	// ranges.
+	Verify *Packet
+
+	// Confirms, if set, is the ID of the unverified packet this report
+	// double-checked and agreed with.  It is marked completed.
+	Confirms string
+}
+
+// StoredReport is an accepted report, as archived.
+type StoredReport struct {
+	PacketID   string                      `json:"packetID"`
+	UserID     string                      `json:"userID"`
+	NodeID     string                      `json:"nodeID"`
+	ReceivedOn time.Time                   `json:"receivedOn"`
+	Report     internal.WorkProgressReport `json:"report"`
+}
+
+// ReportConflict is a completed report for a packet which already had
+// an accepted report.  The first report stands; later ones are kept
+// for audit.
+type ReportConflict struct {
+	StoredReport
+	Reason string `json:"reason"`
+}
+
+// Reasons a report conflicts with the accepted one.
+const (
+	ConflictDifferentEvidence = "different evidence"
+	ConflictAuthenticator     = "authenticator mismatch"
+	ConflictDuplicate         = "duplicate"
+
+	// ConflictVerification is a double check which disagreed with the
+	// report it checked.
+	ConflictVerification = "double check disagrees"
+
+	// ConflictAudit is an accepted report which our own test of part
+	// of its range disagreed with.
+	ConflictAudit = "audit failed"
+)
+
+// RateBucket is the width of the time buckets rate samples are
+// accumulated in.
+const RateBucket = time.Minute
+
+// AllUsers is the user ID under which rate samples for all users are
+// accumulated.
+const AllUsers = ""
+
+// RateSample is the work completed by a user, or all users, in one
+// RateBucket.
+type RateSample struct {
+	UserID     string
+	Start      time.Time
+	Integers   int64
+	Iterations int64
+	Packets    int64
+}
+
+// UserTotals is a user's completed work, summed over the throughput
+// history.
+type UserTotals struct {
+	UserID     string
+	Integers   int64
+	Iterations int64
+	Packets    int64
+	First      time.Time
+	Last       time.Time
+}
+
+// Record kinds.
+const (
+	// RecordMaxIterations is a candidate taking more iterations to
+	// drop below its starting value than any before it.
+	RecordMaxIterations = "maxIterations"
+
+	// RecordLoop is a candidate which looped back to itself.
+	RecordLoop = "loop"
+)
+
+// Record is a notable finding.
+type Record struct {
+	Kind       string    `json:"kind"`
+	Value      *big.Int  `json:"value,omitempty"`
+	Iterations uint64    `json:"iterations"`
+	PacketID   string    `json:"packetID"`
+	UserID     string    `json:"userID"`
+	FoundOn    time.Time `json:"foundOn"`
+}
+
+// StoredTrajectory is the trajectory of a finding, as sent by the
+// user who found it.
+type StoredTrajectory struct {
+	UserID     string              `json:"userID"`
+	ReceivedOn time.Time           `json:"receivedOn"`
+	Trajectory internal.Trajectory `json:"trajectory"`
+}
+
+// Nonce is a packet nonce consumed by an accepted report.  Nonces are
+// kept after their packets are gone, so evidence cannot be replayed.
+type Nonce struct {
+	Nonce         string    `json:"nonce"`
+	PacketID      string    `json:"packetID"`
+	UserID        string    `json:"userID"`
+	StartingValue *big.Int  `json:"startingValue"`
+	EndingValue   *big.Int  `json:"endingValue"`
+	ConsumedOn    time.Time `json:"consumedOn"`
+}
+
+// Same returns true if o consumes the nonce for the same packet, user,
+// and range.
+func (n Nonce) Same(o Nonce) bool {
+	// secretcheck:ignore -- o was looked up by this nonce.
+	return n.Nonce == o.Nonce && n.PacketID == o.PacketID && n.UserID == o.UserID &&
+		n.StartingValue.Cmp(o.StartingValue) == 0 && n.EndingValue.Cmp(o.EndingValue) == 0
+}
+
+// Trust is a user's audit history, from which their trust score is
+// computed.
+type Trust struct {
+	UserID string `json:"userID"`
+
+	// Confirmed counts packets confirmed by another user's double check.
+	Confirmed int64 `json:"confirmed"`
+
+	// Disputed counts packets whose double check disagreed, as either
+	// the user checked or the user checking.
+	Disputed int64 `json:"disputed"`
+
+	// AuditFailures counts reports which failed verification, or
+	// conflicted with an accepted report.
+	AuditFailures int64 `json:"auditFailures"`
+
+	UpdatedOn time.Time `json:"updatedOn"`
+}
+
+// Enrollment is a one-time code, which a new node exchanges for its
+// user's credentials.  Only a hash of the code is kept.
+type Enrollment struct {
+	CodeHash  string    `json:"codeHash"`
+	UserID    string    `json:"userID"`
+	IssuedOn  time.Time `json:"issuedOn"`
+	ExpiresOn time.Time `json:"expiresOn"`
+
+	// RedeemedOn and RedeemedBy, the node ID given, are set once the
+	// code is used.
+	RedeemedOn time.Time `json:"redeemedOn,omitempty"`
+	RedeemedBy string    `json:"redeemedBy,omitempty"`
+}
+
+// Redeemable returns true if the code is unused, and unexpired at now.
+func (e Enrollment) Redeemable(now time.Time) bool {
+	return e.RedeemedOn.IsZero() && now.Before(e.ExpiresOn)
+}
+
+// RecordKinds lists every kind of record.
+var RecordKinds = []string{RecordMaxIterations, RecordLoop}
+
+// Store holds the server's durable state: users, the packet queue,
+// node history, the report archive, records, and the frontier.
+type Store interface {
+	// Migrate brings the schema up to date, returning the number of
+	// migrations applied.
+	Migrate(ctx context.Context) (int, error)
+
+	// CheckSchema returns an error unless the schema version is
+	// exactly what this code expects.
+	CheckSchema(ctx context.Context) error
+
+	// PutUser creates or replaces a user.
+	PutUser(ctx context.Context, user User) error
+
+	// GetUser returns ErrNotFound if the user does not exist.
+	GetUser(ctx context.Context, userID string) (*User, error)
+
+	// Users returns all users.
+	Users(ctx context.Context) ([]User, error)
+
+	// AddPacket records a newly assigned packet.
+	AddPacket(ctx context.Context, packet *Packet) error
+
+	// GetPacket returns ErrNotFound if the packet does not exist.
+	GetPacket(ctx context.Context, packetID string) (*Packet, error)
+
+	// Packets returns all packets with the given status.
+	Packets(ctx context.Context, status string) ([]*Packet, error)
+
+	// UpdatePacket replaces the mutable fields (status, expiry,
+	// heartbeat) of an existing packet.
+	UpdatePacket(ctx context.Context, packet *Packet) error
+
+	// ReclaimExpired atomically finds one outstanding or rejected
+	// packet which expired before now, marks it expired, and returns
+	// it with its previous status.  It returns nil if there are none.
+	ReclaimExpired(ctx context.Context, now time.Time) (*Packet, error)
+
+	// ClaimVerification atomically assigns the oldest packet waiting
+	// to double-check a packet not completed by claim.UserID, the
+	// lowest ID first among those assigned at the same time, to
+	// claim's user and node, with claim's nonce, assignment time, and
+	// expiry.  Only double checks with no filter, or one of filters,
+	// are claimed, as a double check must use the filter of the packet
+	// it checks.  It returns the packet as assigned, or nil if there
+	// are none.
+	ClaimVerification(ctx context.Context, claim *Packet, filters []string) (*Packet, error)
+
+	// CountOutstanding returns the number of unexpired outstanding
+	// packets held by a user.
+	CountOutstanding(ctx context.Context, userID string, now time.Time) (int, error)
+
+	// GetNode returns ErrNotFound if the node has not been seen.
+	GetNode(ctx context.Context, nodeID string) (*Node, error)
+
+	// PutNode creates or replaces a node's history.
+	PutNode(ctx context.Context, node *Node) error
+
+	// AcceptReport atomically marks a packet completed, adds its range
+	// to the completed ranges, archives the report and the receipt
+	// issued for it, and applies the records, node history, rate
+	// samples, and verification in the acceptance.  If the packet was
+	// already completed or unverified, or a report with the same
+	// packet ID and nonce was already accepted, nothing changes and it
+	// returns ErrAlreadyAccepted.
+	AcceptReport(ctx context.Context, a *Acceptance) error
+
+	// AddReportConflict keeps a report which conflicts with the
+	// accepted report for its packet.
+	AddReportConflict(ctx context.Context, c ReportConflict) error
+
+	// ReportConflicts returns up to limit conflicting reports received
+	// at or after the time given, oldest first.
+	ReportConflicts(ctx context.Context, since time.Time, limit int) ([]ReportConflict, error)
+
+	// GetReceipt returns ErrNotFound if no receipt was issued for the
+	// packet.
+	GetReceipt(ctx context.Context, packetID string) (*internal.Receipt, error)
+
+	// CompletedRanges returns all completed work, merged into intervals.
+	CompletedRanges(ctx context.Context) (*intervals.Set, error)
+
+	// AddCompletedRange merges an interval into the completed ranges
+	// without a packet, as when importing.
+	AddCompletedRange(ctx context.Context, iv intervals.Interval) error
+
+	// ReportsBefore returns up to limit accepted reports received
+	// before the time given, oldest first.
+	ReportsBefore(ctx context.Context, before time.Time, limit int) ([]StoredReport, error)
+
+	// ReportsAfter returns up to limit accepted reports with packet IDs
+	// after the one given, in packet ID order, for paging through all
+	// of them.
+	ReportsAfter(ctx context.Context, afterPacketID string, limit int) ([]StoredReport, error)
+
+	// DeleteReports removes the accepted reports for the packets
+	// listed, once they have been archived elsewhere.
+	DeleteReports(ctx context.Context, packetIDs []string) error
+
+	// Receipts returns all receipts issued to a user, oldest first.
+	Receipts(ctx context.Context, userID string) ([]internal.Receipt, error)
+
+	// AddRecord records a notable finding.
+	AddRecord(ctx context.Context, record Record) error
+
+	// Records returns all records of a kind, oldest first.
+	Records(ctx context.Context, kind string) ([]Record, error)
+
+	// AddTrajectory stores the trajectory of a finding.  If one is
+	// already stored for the value, it is kept, and nothing changes.
+	AddTrajectory(ctx context.Context, t StoredTrajectory) error
+
+	// GetTrajectory returns ErrNotFound if no trajectory is stored
+	// for the value.
+	GetTrajectory(ctx context.Context, value *big.Int) (*StoredTrajectory, error)
+
+	// ConsumeNonce records a nonce as used.  Consuming it again for
+	// the same packet, user, and range, as when a report is retried,
+	// succeeds; for anything else, it returns ErrNonceReused.
+	ConsumeNonce(ctx context.Context, n Nonce) error
+
+	// AddTrust adds the counts in t to the user's audit history,
+	// creating it if needed.
+	AddTrust(ctx context.Context, t Trust) error
+
+	// GetTrust returns ErrNotFound if the user has no audit history.
+	GetTrust(ctx context.Context, userID string) (*Trust, error)
+
+	// TrustHistory returns the audit history of every user with one.
+	TrustHistory(ctx context.Context) ([]Trust, error)
+
+	// AddEnrollment records a newly issued enrollment code.
+	AddEnrollment(ctx context.Context, e Enrollment) error
+
+	// GetEnrollment returns ErrNotFound if no enrollment code has the
+	// hash given.
+	GetEnrollment(ctx context.Context, codeHash string) (*Enrollment, error)
+
+	// RedeemEnrollment atomically marks an enrollment code used by
+	// nodeID, and returns it.  It returns ErrNotFound if there is no
+	// such code, or it has expired or was already used.
+	RedeemEnrollment(ctx context.Context, codeHash string, nodeID string, now time.Time) (*Enrollment, error)
+
+	// Enrollments returns the enrollment codes issued since the time
+	// given, oldest first.
+	Enrollments(ctx context.Context, since time.Time) ([]Enrollment, error)
+
+	// AddEvent appends an event to the event log, setting its Seq.
+	AddEvent(ctx context.Context, e *internal.Event) error
+
+	// Events returns up to limit events with Seq after the one given,
+	// oldest first.
+	Events(ctx context.Context, afterSeq int64, limit int) ([]internal.Event, error)
+
+	// InitFrontier sets the next value to assign, if it is not already set.
+	InitFrontier(ctx context.Context, next *big.Int) error
+
+	// Frontier returns the next value to assign, or ErrNotFound if
+	// InitFrontier has not been called.
+	Frontier(ctx context.Context) (*big.Int, error)
+
+	// AllocateRange atomically advances the frontier by size, and
+	// returns the start of the range allocated.
+	AllocateRange(ctx context.Context, size *big.Int) (*big.Int, error)
+
+	// AddRateSample adds the counts in sample to the bucket holding
+	// sample.Start, creating it if needed.
+	AddRateSample(ctx context.Context, sample RateSample) error
+
+	// RateSamples returns the samples for a user with start times in
+	// [from, to), oldest first.
+	RateSamples(ctx context.Context, userID string, from, to time.Time) ([]RateSample, error)
+
+	// UserTotals sums the throughput history of each user, most
+	// integers first.
+	UserTotals(ctx context.Context) ([]UserTotals, error)
+
+	// PurgeRateSamples deletes samples which started before the time
+	// given, returning the number deleted.
+	PurgeRateSamples(ctx context.Context, before time.Time) (int64, error)
+
+	// PurgePackets deletes packets with the given status which were
+	// assigned before the time given, returning the number deleted.
+	PurgePackets(ctx context.Context, status string, assignedBefore time.Time) (int64, error)
+
+	// PurgeReports deletes accepted reports received before the time
+	// given, returning the number deleted.
+	PurgeReports(ctx context.Context, receivedBefore time.Time) (int64, error)
+
+	// PurgeNodes deletes the history of nodes last seen before the
+	// time given, returning the number deleted.
+	PurgeNodes(ctx context.Context, lastSeenBefore time.Time) (int64, error)
+
+	// Backup writes a consistent copy of the database to filename
+	// while it remains in use.
+	Backup(ctx context.Context, filename string) error
+
+	Close() error
+}
@@ -0,0 +1,635 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package storetest checks that an implementation of store.Store does
+// what the interface documents, so every implementation is held to the
+// same tests.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/skandragon/collatz/internal"
+	"github.com/skandragon/collatz/internal/intervals"
+	"github.com/skandragon/collatz/internal/store"
+)
+
+// Open returns a new, empty store with its schema up to date, to be
+// closed when the test ends.
+type Open func(t *testing.T) store.Store
+
+// Run runs every test against stores from open.
+func Run(t *testing.T, open Open) {
+	tests := []struct {
+		name string
+		run  func(*testing.T, Open)
+	}{
+		{"AcceptReport", testAcceptReport},
+		{"ClaimVerification", testClaimVerification},
+		{"ConsumeNonce", testConsumeNonce},
+		{"RedeemEnrollment", testRedeemEnrollment},
+		{"CompletedRanges", testCompletedRanges},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) { tt.run(t, open) })
+	}
+}
+
+// epoch is the time the tests start from.  It is whole seconds, as not
+// every store keeps nanoseconds.
+var epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// at returns epoch plus d.
+func at(d time.Duration) time.Time {
+	return epoch.Add(d)
+}
+
+// newPacket returns a packet covering [start, end], assigned to a user.
+func newPacket(id string, start, end int64, status, userID string, assigned time.Time) *store.Packet {
+	return &store.Packet{
+		WorkPacket: internal.WorkPacket{
+			ID:            id,
+			Nonce:         "nonce-" + id,
+			StartingValue: big.NewInt(start),
+			EndingValue:   big.NewInt(end),
+			AssignedOn:    assigned,
+			Expiry:        assigned.Add(time.Hour),
+		},
+		UserID: userID,
+		NodeID: userID + "-node",
+		Status: status,
+	}
+}
+
+// acceptance returns the acceptance of a report completing p.
+func acceptance(p *store.Packet) *store.Acceptance {
+	evidence := internal.WorkEvidence{TotalIterations: 1000, MaxIterations: 10}
+	return &store.Acceptance{
+		Report: internal.WorkProgressReport{Work: p.WorkPacket, Status: "completed"},
+		Receipt: internal.Receipt{
+			PacketID:      p.ID,
+			UserID:        p.UserID,
+			NodeID:        p.NodeID,
+			StartingValue: p.StartingValue,
+			EndingValue:   p.EndingValue,
+			Evidence:      evidence,
+			AcceptedOn:    p.AssignedOn.Add(time.Minute),
+		},
+	}
+}
+
+func addPackets(t *testing.T, st store.Store, packets ...*store.Packet) {
+	t.Helper()
+	for _, p := range packets {
+		if err := st.AddPacket(context.Background(), p); err != nil {
+			t.Fatalf("adding packet %s: %v", p.ID, err)
+		}
+	}
+}
+
+func accept(t *testing.T, st store.Store, a *store.Acceptance) {
+	t.Helper()
+	if err := st.AcceptReport(context.Background(), a); err != nil {
+		t.Fatalf("accepting %s: %v", a.Receipt.PacketID, err)
+	}
+}
+
+// checkStatus fails unless each packet has the status given.
+func checkStatus(t *testing.T, st store.Store, want map[string]string) {
+	t.Helper()
+	for id, status := range want {
+		p, err := st.GetPacket(context.Background(), id)
+		if err != nil {
+			t.Errorf("getting packet %s: %v", id, err)
+			continue
+		}
+		if p.Status != status {
+			t.Errorf("packet %s is %s, want %s", id, p.Status, status)
+		}
+	}
+}
+
+// checkCompleted fails unless the completed ranges are those given, as
+// half-open pairs.
+func checkCompleted(t *testing.T, st store.Store, want [][2]int64) {
+	t.Helper()
+	expected := &intervals.Set{}
+	for _, iv := range want {
+		expected.Add(big.NewInt(iv[0]), big.NewInt(iv[1]))
+	}
+	checkRanges(t, st, expected)
+}
+
+func testAcceptReport(t *testing.T, open Open) {
+	p1 := newPacket("p1", 1, 100, store.PacketOutstanding, "alice", at(0))
+	p2 := newPacket("p2", 101, 200, store.PacketOutstanding, "alice", at(time.Minute))
+	p3 := newPacket("p3", 201, 300, store.PacketOutstanding, "alice", at(2*time.Minute))
+	verify := newPacket("v1", 1, 100, store.PacketVerify, "", at(time.Minute))
+	verify.Verifies = "p1"
+
+	withVerify := acceptance(p1)
+	withVerify.Verify = verify
+	confirming := acceptance(verify)
+	confirming.Receipt.UserID = "bob"
+	confirming.Confirms = "p1"
+
+	full := acceptance(p1)
+	full.Node = &store.Node{NodeID: p1.NodeID, UserID: "alice", Completed: 1, LastSeen: at(time.Minute), Rate: 100}
+	full.Records = []store.Record{{
+		Kind: store.RecordMaxIterations, Value: big.NewInt(27), Iterations: 96,
+		PacketID: "p1", UserID: "alice", FoundOn: at(time.Minute),
+	}}
+	full.Rates = []store.RateSample{{UserID: "alice", Start: at(0), Integers: 100, Iterations: 1000, Packets: 1}}
+
+	tests := []struct {
+		name  string
+		setup func(*testing.T, store.Store)
+		// accept is accepted after setup.
+		accept  *store.Acceptance
+		wantErr error
+		// wantStatus maps packet IDs to their status after.
+		wantStatus    map[string]string
+		wantCompleted [][2]int64
+		wantReceipts  int
+		check         func(*testing.T, store.Store)
+	}{
+		{
+			name:          "completes",
+			setup:         func(t *testing.T, st store.Store) { addPackets(t, st, p1) },
+			accept:        full,
+			wantStatus:    map[string]string{"p1": store.PacketCompleted},
+			wantCompleted: [][2]int64{{1, 101}},
+			wantReceipts:  1,
+			check: func(t *testing.T, st store.Store) {
+				ctx := context.Background()
+				r, err := st.GetReceipt(ctx, "p1")
+				if err != nil || r.EndingValue.Cmp(p1.EndingValue) != 0 || !r.AcceptedOn.Equal(full.Receipt.AcceptedOn) {
+					t.Errorf("got receipt %+v, %v", r, err)
+				}
+				reports, err := st.ReportsAfter(ctx, "", 10)
+				if err != nil || len(reports) != 1 || reports[0].PacketID != "p1" || reports[0].NodeID != p1.NodeID {
+					t.Errorf("got reports %+v, %v", reports, err)
+				}
+				n, err := st.GetNode(ctx, p1.NodeID)
+				if err != nil || n.Completed != 1 || n.Rate != 100 {
+					t.Errorf("got node %+v, %v", n, err)
+				}
+				records, err := st.Records(ctx, store.RecordMaxIterations)
+				if err != nil || len(records) != 1 || records[0].Value.Int64() != 27 {
+					t.Errorf("got records %+v, %v", records, err)
+				}
+				samples, err := st.RateSamples(ctx, "alice", at(0), at(time.Hour))
+				if err != nil || len(samples) != 1 || samples[0].Integers != 100 {
+					t.Errorf("got rate samples %+v, %v", samples, err)
+				}
+			},
+		},
+		{
+			name: "merges with neighbours",
+			setup: func(t *testing.T, st store.Store) {
+				addPackets(t, st, p1, p2, p3)
+				accept(t, st, acceptance(p1))
+				accept(t, st, acceptance(p3))
+			},
+			accept:        acceptance(p2),
+			wantStatus:    map[string]string{"p1": store.PacketCompleted, "p2": store.PacketCompleted, "p3": store.PacketCompleted},
+			wantCompleted: [][2]int64{{1, 301}},
+			wantReceipts:  3,
+		},
+		{
+			name: "expired",
+			setup: func(t *testing.T, st store.Store) {
+				addPackets(t, st, newPacket("p1", 1, 100, store.PacketExpired, "alice", at(0)))
+			},
+			accept:        acceptance(p1),
+			wantStatus:    map[string]string{"p1": store.PacketCompleted},
+			wantCompleted: [][2]int64{{1, 101}},
+			wantReceipts:  1,
+		},
+		{
+			name:    "unknown packet",
+			accept:  acceptance(p1),
+			wantErr: store.ErrNotFound,
+		},
+		{
+			name: "already completed",
+			setup: func(t *testing.T, st store.Store) {
+				addPackets(t, st, p1)
+				accept(t, st, acceptance(p1))
+			},
+			accept:        acceptance(p1),
+			wantErr:       store.ErrAlreadyAccepted,
+			wantStatus:    map[string]string{"p1": store.PacketCompleted},
+			wantCompleted: [][2]int64{{1, 101}},
+			wantReceipts:  1,
+		},
+		{
+			name: "nonce already accepted",
+			setup: func(t *testing.T, st store.Store) {
+				addPackets(t, st, p1)
+				accept(t, st, acceptance(p1))
+				reset := *p1
+				if err := st.UpdatePacket(context.Background(), &reset); err != nil {
+					t.Fatal(err)
+				}
+			},
+			accept:        acceptance(p1),
+			wantErr:       store.ErrAlreadyAccepted,
+			wantStatus:    map[string]string{"p1": store.PacketOutstanding},
+			wantCompleted: [][2]int64{{1, 101}},
+			wantReceipts:  1,
+		},
+		{
+			name:          "to be verified",
+			setup:         func(t *testing.T, st store.Store) { addPackets(t, st, p1) },
+			accept:        withVerify,
+			wantStatus:    map[string]string{"p1": store.PacketUnverified, "v1": store.PacketVerify},
+			wantCompleted: [][2]int64{},
+			wantReceipts:  1,
+		},
+		{
+			name: "already unverified",
+			setup: func(t *testing.T, st store.Store) {
+				addPackets(t, st, p1)
+				accept(t, st, withVerify)
+			},
+			accept:        acceptance(p1),
+			wantErr:       store.ErrAlreadyAccepted,
+			wantStatus:    map[string]string{"p1": store.PacketUnverified, "v1": store.PacketVerify},
+			wantCompleted: [][2]int64{},
+			wantReceipts:  1,
+		},
+		{
+			name: "confirms",
+			setup: func(t *testing.T, st store.Store) {
+				addPackets(t, st, p1)
+				accept(t, st, withVerify)
+			},
+			accept:        confirming,
+			wantStatus:    map[string]string{"p1": store.PacketCompleted, "v1": store.PacketCompleted},
+			wantCompleted: [][2]int64{{1, 101}},
+			wantReceipts:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := open(t)
+			ctx := context.Background()
+			if tt.setup != nil {
+				tt.setup(t, st)
+			}
+			if err := st.AcceptReport(ctx, tt.accept); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			checkStatus(t, st, tt.wantStatus)
+			if tt.wantCompleted != nil {
+				checkCompleted(t, st, tt.wantCompleted)
+			}
+			receipts, err := st.Receipts(ctx, "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(receipts) != tt.wantReceipts {
+				t.Errorf("alice has %d receipts, want %d", len(receipts), tt.wantReceipts)
+			}
+			if tt.check != nil {
+				tt.check(t, st)
+			}
+		})
+	}
+}
+
+func testClaimVerification(t *testing.T, open Open) {
+	// verifying returns a double check of checked, waiting since the
+	// time given.
+	verifying := func(id string, checked string, since time.Duration) *store.Packet {
+		p := newPacket(id, 1, 100, store.PacketVerify, "", at(since))
+		p.Verifies = checked
+		return p
+	}
+	filtered := func(p *store.Packet, filter string) *store.Packet {
+		p.Filter = filter
+		return p
+	}
+	byAlice := newPacket("c-alice", 1, 100, store.PacketUnverified, "alice", at(0))
+	byBob := newPacket("c-bob", 101, 200, store.PacketUnverified, "bob", at(0))
+
+	tests := []struct {
+		name    string
+		packets []*store.Packet
+		claimBy string
+		filters []string
+		// want is the ID of the packet claimed, or empty for none.
+		want string
+	}{
+		{
+			name:    "none waiting",
+			packets: []*store.Packet{byBob},
+			claimBy: "alice",
+		},
+		{
+			name:    "oldest first",
+			packets: []*store.Packet{byBob, verifying("v1", "c-bob", 2*time.Minute), verifying("v2", "c-bob", time.Minute)},
+			claimBy: "alice",
+			want:    "v2",
+		},
+		{
+			name:    "lowest ID first when as old",
+			packets: []*store.Packet{byBob, verifying("v2", "c-bob", time.Minute), verifying("v1", "c-bob", time.Minute)},
+			claimBy: "alice",
+			want:    "v1",
+		},
+		{
+			name:    "not of the claimant's own work",
+			packets: []*store.Packet{byAlice, byBob, verifying("v1", "c-alice", time.Minute), verifying("v2", "c-bob", 2*time.Minute)},
+			claimBy: "alice",
+			want:    "v2",
+		},
+		{
+			name:    "only the claimant's own work",
+			packets: []*store.Packet{byAlice, verifying("v1", "c-alice", time.Minute)},
+			claimBy: "alice",
+		},
+		{
+			name:    "of a packet since purged",
+			packets: []*store.Packet{verifying("v1", "gone", time.Minute)},
+			claimBy: "alice",
+			want:    "v1",
+		},
+		{
+			name: "only packets waiting",
+			packets: []*store.Packet{byBob,
+				newPacket("p1", 201, 300, store.PacketOutstanding, "bob", at(0)),
+				newPacket("p2", 301, 400, store.PacketExpired, "bob", at(0)),
+				verifying("v1", "c-bob", time.Minute)},
+			claimBy: "alice",
+			want:    "v1",
+		},
+		{
+			name:    "past an unsupported filter",
+			packets: []*store.Packet{byBob, filtered(verifying("v1", "c-bob", time.Minute), internal.FilterMod3), verifying("v2", "c-bob", 2*time.Minute)},
+			claimBy: "alice",
+			want:    "v2",
+		},
+		{
+			name:    "with a supported filter",
+			packets: []*store.Packet{byBob, filtered(verifying("v1", "c-bob", time.Minute), internal.FilterMod3), verifying("v2", "c-bob", 2*time.Minute)},
+			claimBy: "alice",
+			filters: []string{internal.FilterMod3},
+			want:    "v1",
+		},
+		{
+			name:    "only unsupported filters",
+			packets: []*store.Packet{byBob, filtered(verifying("v1", "c-bob", time.Minute), internal.FilterMod3)},
+			claimBy: "alice",
+			filters: []string{"other"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := open(t)
+			ctx := context.Background()
+			addPackets(t, st, tt.packets...)
+			claim := &store.Packet{
+				WorkPacket: internal.WorkPacket{Nonce: "claim-nonce", AssignedOn: at(time.Hour), Expiry: at(2 * time.Hour)},
+				UserID:     tt.claimBy,
+				NodeID:     tt.claimBy + "-node",
+			}
+			got, err := st.ClaimVerification(ctx, claim, tt.filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				if got != nil {
+					t.Fatalf("claimed %s, want none", got.ID)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("claimed none, want %s", tt.want)
+			}
+			if got.ID != tt.want {
+				t.Fatalf("claimed %s, want %s", got.ID, tt.want)
+			}
+			stored, err := st.GetPacket(ctx, got.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range []*store.Packet{got, stored} {
+				// secretcheck:ignore: a test's nonce, not a secret
+				if p.Status != store.PacketOutstanding || p.UserID != claim.UserID || p.NodeID != claim.NodeID || p.Nonce != claim.Nonce ||
+					!p.AssignedOn.Equal(claim.AssignedOn) || !p.Expiry.Equal(claim.Expiry) {
+					t.Errorf("claimed %+v, not as claim %+v", p, claim)
+				}
+			}
+			again, err := st.ClaimVerification(ctx, claim, tt.filters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if again != nil && again.ID == got.ID {
+				t.Errorf("claimed %s twice", got.ID)
+			}
+		})
+	}
+}
+
+func testConsumeNonce(t *testing.T, open Open) {
+	first := store.Nonce{
+		Nonce:         "nonce-1",
+		PacketID:      "p1",
+		UserID:        "alice",
+		StartingValue: big.NewInt(1),
+		EndingValue:   big.NewInt(100),
+		ConsumedOn:    at(0),
+	}
+	tests := []struct {
+		name    string
+		change  func(*store.Nonce)
+		wantErr error
+	}{
+		{"retried", func(n *store.Nonce) { n.ConsumedOn = at(time.Minute) }, nil},
+		{"another nonce", func(n *store.Nonce) { n.Nonce = "nonce-2" }, nil},
+		{"another packet", func(n *store.Nonce) { n.PacketID = "p2" }, store.ErrNonceReused},
+		{"another user", func(n *store.Nonce) { n.UserID = "bob" }, store.ErrNonceReused},
+		{"another start", func(n *store.Nonce) { n.StartingValue = big.NewInt(3) }, store.ErrNonceReused},
+		{"another end", func(n *store.Nonce) { n.EndingValue = big.NewInt(98) }, store.ErrNonceReused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := open(t)
+			ctx := context.Background()
+			if err := st.ConsumeNonce(ctx, first); err != nil {
+				t.Fatal(err)
+			}
+			second := first
+			tt.change(&second)
+			if err := st.ConsumeNonce(ctx, second); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			// the first is unchanged
+			if err := st.ConsumeNonce(ctx, first); err != nil {
+				t.Fatalf("consuming the first again: %v", err)
+			}
+		})
+	}
+}
+
+func testRedeemEnrollment(t *testing.T, open Open) {
+	issued := store.Enrollment{CodeHash: "hash-1", UserID: "alice", IssuedOn: at(0), ExpiresOn: at(time.Hour)}
+	type redeem struct {
+		code    string
+		nodeID  string
+		at      time.Time
+		wantErr error
+	}
+	tests := []struct {
+		name    string
+		redeems []redeem
+	}{
+		{"redeems", []redeem{{"hash-1", "node-1", at(time.Minute), nil}}},
+		{"unknown code", []redeem{{"hash-2", "node-1", at(time.Minute), store.ErrNotFound}}},
+		{"expired", []redeem{{"hash-1", "node-1", at(time.Hour), store.ErrNotFound}}},
+		{"already redeemed", []redeem{
+			{"hash-1", "node-1", at(time.Minute), nil},
+			{"hash-1", "node-2", at(2 * time.Minute), store.ErrNotFound},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := open(t)
+			ctx := context.Background()
+			if err := st.AddEnrollment(ctx, issued); err != nil {
+				t.Fatal(err)
+			}
+			var redeemed *redeem
+			for i, r := range tt.redeems {
+				e, err := st.RedeemEnrollment(ctx, r.code, r.nodeID, r.at)
+				if !errors.Is(err, r.wantErr) {
+					t.Fatalf("redeeming %d: got %v, want %v", i, err, r.wantErr)
+				}
+				if err != nil {
+					continue
+				}
+				if e.UserID != issued.UserID || e.RedeemedBy != r.nodeID || !e.RedeemedOn.Equal(r.at) {
+					t.Errorf("redeeming %d: got %+v", i, e)
+				}
+				redeemed = &tt.redeems[i]
+			}
+			if _, err := st.GetEnrollment(ctx, "hash-2"); !errors.Is(err, store.ErrNotFound) {
+				t.Errorf("getting an unknown code: got %v, want %v", err, store.ErrNotFound)
+			}
+			got, err := st.GetEnrollment(ctx, issued.CodeHash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			all, err := st.Enrollments(ctx, at(-time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(all) != 1 {
+				t.Fatalf("got %d enrollments, want 1", len(all))
+			}
+			if fmt.Sprint(*got) != fmt.Sprint(all[0]) {
+				t.Errorf("GetEnrollment returns %+v, Enrollments %+v", *got, all[0])
+			}
+			e := all[0]
+			if e.Redeemable(at(time.Minute)) != (redeemed == nil) {
+				t.Errorf("got %+v, which is redeemable: %v", e, e.Redeemable(at(time.Minute)))
+			}
+			switch {
+			case redeemed == nil && (!e.RedeemedOn.IsZero() || e.RedeemedBy != ""):
+				t.Errorf("got %+v, want it not redeemed", e)
+			case redeemed != nil && (!e.RedeemedOn.Equal(redeemed.at) || e.RedeemedBy != redeemed.nodeID):
+				t.Errorf("got %+v, want it redeemed by %s", e, redeemed.nodeID)
+			}
+		})
+	}
+}
+
+func testCompletedRanges(t *testing.T, open Open) {
+	big1 := new(big.Int).Lsh(big.NewInt(1), 100)
+	tests := []struct {
+		name string
+		add  [][2]*big.Int
+	}{
+		{"apart", pairs(1, 10, 20, 30)},
+		{"adjacent", pairs(20, 30, 1, 10, 10, 20)},
+		{"overlapping", pairs(1, 15, 10, 30, 5, 12)},
+		{"covering several", pairs(10, 20, 30, 40, 50, 60, 5, 55)},
+		{"between", pairs(1, 10, 20, 30, 11, 19)},
+		{"across digit counts", pairs(9, 10, 99, 101, 101, 1000, 1000, 1001, 10, 99)},
+		{"large", [][2]*big.Int{
+			{big1, new(big.Int).Add(big1, big.NewInt(100))},
+			{new(big.Int).Sub(big1, big.NewInt(100)), big1},
+			{big.NewInt(1), big.NewInt(100)},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := open(t)
+			want := &intervals.Set{}
+			for _, iv := range tt.add {
+				if err := st.AddCompletedRange(context.Background(), intervals.Interval{Start: iv[0], End: iv[1]}); err != nil {
+					t.Fatal(err)
+				}
+				want.Add(iv[0], iv[1])
+			}
+			checkRanges(t, st, want)
+		})
+	}
+
+	t.Run("random", func(t *testing.T) {
+		st := open(t)
+		r := rand.New(rand.NewSource(1))
+		want := &intervals.Set{}
+		for i := 0; i < 300; i++ {
+			start := int64(1 + r.Intn(2000))
+			end := start + int64(1+r.Intn(30))
+			if err := st.AddCompletedRange(context.Background(), intervals.Interval{Start: big.NewInt(start), End: big.NewInt(end)}); err != nil {
+				t.Fatal(err)
+			}
+			want.Add(big.NewInt(start), big.NewInt(end))
+		}
+		checkRanges(t, st, want)
+	})
+}
+
+// pairs returns half-open intervals from their bounds.
+func pairs(bounds ...int64) [][2]*big.Int {
+	ret := [][2]*big.Int{}
+	for i := 0; i+1 < len(bounds); i += 2 {
+		ret = append(ret, [2]*big.Int{big.NewInt(bounds[i]), big.NewInt(bounds[i+1])})
+	}
+	return ret
+}
+
+// checkRanges fails unless the completed ranges are want.
+func checkRanges(t *testing.T, st store.Store, want *intervals.Set) {
+	t.Helper()
+	got, err := st.CompletedRanges(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, w := fmt.Sprint(got.Intervals()), fmt.Sprint(want.Intervals()); g != w {
+		t.Errorf("completed ranges are %s, want %s", g, w)
+	}
+}
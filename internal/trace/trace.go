@@ -0,0 +1,230 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package trace records spans and exports them to an OpenTelemetry
+// collector using OTLP over HTTP with JSON encoding, and propagates
+// trace context between client and server in the W3C traceparent
+// header.  A nil *Tracer records nothing, but context is still
+// propagated, so one side may trace without the other.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header is the W3C trace context header.
+const Header = "traceparent"
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+// IsValid returns true if both IDs are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent returns the span context as a traceparent header value.
+func (sc SpanContext) TraceParent() string {
+	return fmt.Sprintf("00-%x-%x-01", sc.TraceID, sc.SpanID)
+}
+
+// ParseTraceParent parses a traceparent header value.
+func ParseTraceParent(v string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	return sc, sc.IsValid()
+}
+
+type contextKey struct{}
+
+// ContextWithSpanContext returns a context carrying sc, which becomes
+// the parent of spans started from it.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// FromContext returns the span context carried by ctx, if any.
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(contextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// Inject sets the traceparent header from ctx, if it carries a span
+// context.
+func Inject(ctx context.Context, h http.Header) {
+	if sc, ok := FromContext(ctx); ok {
+		h.Set(Header, sc.TraceParent())
+	}
+}
+
+// Extract returns ctx carrying the span context in the traceparent
+// header, if there is a valid one.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	if sc, ok := ParseTraceParent(h.Get(Header)); ok {
+		return ContextWithSpanContext(ctx, sc)
+	}
+	return ctx
+}
+
+// Kind is the OTLP span kind.
+type Kind int
+
+// Span kinds.
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// Span is one timed operation.  All methods of a nil *Span do nothing.
+type Span struct {
+	tracer *Tracer
+	name   string
+	kind   Kind
+	sc     SpanContext
+	parent [8]byte
+	start  time.Time
+
+	sync.Mutex
+	end   time.Time
+	attrs []attribute
+	err   string
+}
+
+type attribute struct {
+	key   string
+	value any
+}
+
+// Context returns the span's context, or the zero SpanContext for a
+// nil span.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttribute attaches a string, integer, or boolean attribute.
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.attrs = append(s.attrs, attribute{key: key, value: value})
+}
+
+// SetError marks the span as failed, if err is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.err = err.Error()
+}
+
+// End finishes the span and queues it for export.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	s.end = time.Now()
+	s.Unlock()
+	s.tracer.enqueue(s)
+}
+
+// Tracer starts spans, and exports them in batches.
+type Tracer struct {
+	service  string
+	endpoint string
+	client   *http.Client
+	queue    chan *Span
+}
+
+// queueSize is the most spans held for export.  Spans ended while the
+// queue is full are dropped, rather than slow the work being traced.
+const queueSize = 4096
+
+// batchSize is the most spans in one export request.
+const batchSize = 512
+
+// New returns a Tracer which exports spans for the service to the OTLP
+// HTTP endpoint, such as "http://localhost:4318/v1/traces".  Run must
+// be called to export them.
+func New(service string, endpoint string) *Tracer {
+	return &Tracer{
+		service:  service,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *Span, queueSize),
+	}
+}
+
+// Start starts a span as a child of the span context in ctx, or as the
+// root of a new trace, and returns a context carrying it.  With a nil
+// Tracer, it returns ctx and a nil span.
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent, ok := FromContext(ctx); ok {
+		s.sc.TraceID = parent.TraceID
+		s.parent = parent.SpanID
+	} else {
+		randomize(s.sc.TraceID[:])
+	}
+	randomize(s.sc.SpanID[:])
+	return ContextWithSpanContext(ctx, s.sc), s
+}
+
+func randomize(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+	}
+}
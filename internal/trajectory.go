@@ -0,0 +1,123 @@
+/*
+ * Copyright 2022 Michael Graff.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License")
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package internal
+
+import (
+	"math/big"
+	"strings"
+)
+
+// Trajectory formats.
+const (
+	// TrajectoryFull lists every value in the trajectory.
+	TrajectoryFull = "full"
+
+	// TrajectoryParity gives only the parity of each value, as a
+	// string of '0' and '1', which is enough to rebuild the full
+	// trajectory from the starting value.
+	TrajectoryParity = "parity"
+)
+
+// TrajectoryRequest asks a client to send the trajectory of a value it
+// reported as a finding.
+type TrajectoryRequest struct {
+	PacketID string   `json:"packetID,omitempty"`
+	Value    *big.Int `json:"value,omitempty"`
+	Format   string   `json:"format,omitempty"`
+	MaxSteps uint64   `json:"maxSteps,omitempty"`
+}
+
+// Trajectory is the path a value takes until it drops below, or loops
+// back to, its starting value, the same steps counted as iterations.
+type Trajectory struct {
+	PacketID string   `json:"packetID,omitempty"`
+	Value    *big.Int `json:"value,omitempty"`
+	Format   string   `json:"format,omitempty"`
+	Steps    uint64   `json:"steps,omitempty"`
+
+	// Values is set for the full format, and starts with Value.
+	Values []*big.Int `json:"values,omitempty"`
+
+	// Parity is set for the parity format.  Parity[i] is the parity
+	// of the value before step i.
+	Parity string `json:"parity,omitempty"`
+
+	// Truncated is set if the trajectory was cut off at MaxSteps.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// TrajectoryResponse is returned by the server in response to a
+// Trajectory.
+type TrajectoryResponse struct {
+	Accepted bool   `json:"accepted,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+// ComputeTrajectory follows the value for at most maxSteps steps, or
+// without limit if maxSteps is zero.
+func ComputeTrajectory(req TrajectoryRequest) Trajectory {
+	t := Trajectory{
+		PacketID: req.PacketID,
+		Value:    new(big.Int).Set(req.Value),
+		Format:   req.Format,
+	}
+	var parity strings.Builder
+	n := new(big.Int).Set(req.Value)
+	if req.Format == TrajectoryFull {
+		t.Values = append(t.Values, new(big.Int).Set(n))
+	}
+	three := big.NewInt(3)
+	for {
+		if req.MaxSteps != 0 && t.Steps == req.MaxSteps {
+			t.Truncated = true
+			break
+		}
+		t.Steps++
+		if n.Bit(0) == 0 {
+			parity.WriteByte('0')
+			n.Rsh(n, 1)
+		} else {
+			parity.WriteByte('1')
+			n.Mul(n, three)
+			n.Add(n, big.NewInt(1))
+		}
+		if req.Format == TrajectoryFull {
+			t.Values = append(t.Values, new(big.Int).Set(n))
+		}
+		if n.Cmp(req.Value) <= 0 {
+			break
+		}
+	}
+	if req.Format == TrajectoryParity {
+		t.Parity = parity.String()
+	}
+	return t
+}
+
+// Equal returns true if the trajectories are the same.
+func (t Trajectory) Equal(o Trajectory) bool {
+	if t.Value.Cmp(o.Value) != 0 || t.Format != o.Format || t.Steps != o.Steps ||
+		t.Parity != o.Parity || t.Truncated != o.Truncated || len(t.Values) != len(o.Values) {
+		return false
+	}
+	for i := range t.Values {
+		if t.Values[i].Cmp(o.Values[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}